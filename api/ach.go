@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/pci"
+)
+
+// ACHRequest is an electronic check (eCheck) transaction
+type ACHRequest struct {
+	APIKey            string       `json:"api_key,omitempty"`
+	Amount            string       `json:"amount"`
+	Type              string       `json:"type"` // sale or credit; defaults to sale
+	CheckName         string       `json:"checkname"`
+	CheckABA          string       `json:"checkaba"`
+	CheckAccount      string       `json:"checkaccount"`
+	AccountHolderType string       `json:"account_holder_type"` // business or personal
+	AccountType       string       `json:"account_type"`        // checking or savings
+	SECCode           string       `json:"sec_code"`            // PPD, WEB, TEL or CCD
+	OrderID           string       `json:"order_id,omitempty"`
+	OrderDescription  string       `json:"order_description,omitempty"`
+	Billing           *BillingInfo `json:"billing,omitempty"`
+}
+
+// ACHResponse is the gateway result of an ACH transaction. Settlement happens
+// days later, so an approval only means the entry was accepted for processing.
+type ACHResponse struct {
+	RawResponse       string            `json:"raw_response"`
+	StatusCode        int               `json:"status_code"`
+	Response          string            `json:"response"`
+	ResponseText      string            `json:"responsetext"`
+	TransactionID     string            `json:"transactionid"`
+	Type              string            `json:"type"`
+	ResponseCode      string            `json:"response_code"`
+	OrderID           string            `json:"orderid"`
+	MaskedAccount     string            `json:"masked_account"`
+	CheckABA          string            `json:"checkaba"`
+	AccountHolderType string            `json:"account_holder_type"`
+	AccountType       string            `json:"account_type"`
+	SECCode           string            `json:"sec_code"`
+	ExtraFields       map[string]string `json:"extra_fields,omitempty"`
+}
+
+// ProcessACH submits an eCheck transaction
+func (c *Client) ProcessACH(ctx context.Context, req ACHRequest) (*ACHResponse, error) {
+	if req.Type == "" {
+		req.Type = "sale"
+	}
+	req.SECCode = strings.ToUpper(req.SECCode)
+	req.AccountHolderType = strings.ToLower(req.AccountHolderType)
+	req.AccountType = strings.ToLower(req.AccountType)
+
+	startTime := time.Now()
+	defer func() {
+		metrics.RecordTransactionMetrics(logctx.Merchant(ctx), "ach_"+req.Type, "processed", time.Since(startTime).Seconds())
+	}()
+
+	if err := ValidateACHRequest(req); err != nil {
+		metrics.RecordErrorMetrics("ach_"+req.Type, "validation_error")
+		return nil, err
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", req.APIKey)
+	formData.Set("type", req.Type)
+	formData.Set("payment", "check")
+	formData.Set("amount", req.Amount)
+	formData.Set("checkname", req.CheckName)
+	formData.Set("checkaba", req.CheckABA)
+	formData.Set("checkaccount", req.CheckAccount)
+	formData.Set("account_holder_type", req.AccountHolderType)
+	formData.Set("account_type", req.AccountType)
+	formData.Set("sec_code", req.SECCode)
+
+	if req.OrderID != "" {
+		formData.Set("orderid", req.OrderID)
+	}
+	if req.OrderDescription != "" {
+		formData.Set("orderdescription", req.OrderDescription)
+	}
+	if req.Billing != nil {
+		addBillingInfo(formData, req.Billing)
+	}
+
+	resp, err := c.sendRequest(ctx, formData)
+	if err != nil {
+		metrics.RecordErrorMetrics("ach_"+req.Type, "network_error")
+		return nil, err
+	}
+
+	parsedResp, err := ParseNMIResponse(resp)
+	if parsedResp != nil {
+		recordGatewayResult(ctx, "ach_"+req.Type, "ach", parsedResp)
+	}
+	if err != nil {
+		metrics.RecordErrorMetrics("ach_"+req.Type, "parse_error")
+		return nil, err
+	}
+
+	recordActor(ctx, "ach_"+req.Type, parsedResp.TransactionID)
+	recordAmount(ctx, "ach_"+req.Type, req.Amount)
+
+	return &ACHResponse{
+		RawResponse:       pci.Scrub(resp),
+		StatusCode:        200,
+		Response:          parsedResp.Response,
+		ResponseText:      parsedResp.ResponseText,
+		TransactionID:     parsedResp.TransactionID,
+		Type:              parsedResp.Type,
+		ResponseCode:      parsedResp.ResponseCode,
+		OrderID:           parsedResp.OrderID,
+		MaskedAccount:     pci.MaskPAN(req.CheckAccount),
+		CheckABA:          req.CheckABA,
+		AccountHolderType: req.AccountHolderType,
+		AccountType:       req.AccountType,
+		SECCode:           req.SECCode,
+		ExtraFields:       c.passthroughFields(parsedResp.Values),
+	}, nil
+}
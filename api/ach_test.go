@@ -0,0 +1,50 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateACHRequest(t *testing.T) {
+	valid := ACHRequest{
+		Amount:            "25.00",
+		Type:              "sale",
+		CheckName:         "John Doe",
+		CheckABA:          "021000021",
+		CheckAccount:      "123456789",
+		AccountHolderType: "personal",
+		AccountType:       "checking",
+		SECCode:           "WEB",
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(req *ACHRequest)
+		wantErr bool
+	}{
+		{name: "Valid Request", modify: func(req *ACHRequest) {}},
+		{name: "Bad Routing Checksum", modify: func(req *ACHRequest) { req.CheckABA = "021000022" }, wantErr: true},
+		{name: "Short Routing Number", modify: func(req *ACHRequest) { req.CheckABA = "02100002" }, wantErr: true},
+		{name: "Unknown SEC Code", modify: func(req *ACHRequest) { req.SECCode = "ARC" }, wantErr: true},
+		{name: "CCD Personal Account", modify: func(req *ACHRequest) { req.SECCode = "CCD" }, wantErr: true},
+		{name: "CCD Business Account", modify: func(req *ACHRequest) {
+			req.SECCode = "CCD"
+			req.AccountHolderType = "business"
+		}},
+		{name: "Invalid Account Type", modify: func(req *ACHRequest) { req.AccountType = "brokerage" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+			err := ValidateACHRequest(req)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
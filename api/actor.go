@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+
+	"nmi-pay-int/metrics"
+)
+
+// Internal service accounts. Background jobs attach one of these to their
+// context so charges they issue are attributed to the job rather than to
+// an external API caller.
+const (
+	ActorExternal       = "api"
+	ActorScheduler      = "system/scheduler"
+	ActorReconciliation = "system/reconciliation"
+	ActorCLI            = "system/cli"
+)
+
+type actorKey struct{}
+
+// WithActor returns a context carrying the identity issuing gateway calls
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the identity attached to ctx, defaulting to an
+// external API caller
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return ActorExternal
+}
+
+// recordActor attributes a completed gateway operation to the actor in ctx
+func recordActor(ctx context.Context, operation, transactionID string) {
+	metrics.RecordActorOperation(ActorFromContext(ctx), operation, transactionID)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var amountPattern = regexp.MustCompile(`^(\d+)(?:\.(\d+))?$`)
+
+// Amount is a dollar amount normalized to exactly two decimal places
+// ("10.90"). It decodes from either a JSON string or a JSON number.
+type Amount string
+
+// ParseAmount normalizes a dollar amount to two decimal places. Values
+// without a decimal point are rejected because they are ambiguous: "1099"
+// may mean $1,099.00 or 1099 cents. Values with more than two significant
+// decimal places are rejected rather than rounded.
+func ParseAmount(raw string) (Amount, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+
+	match := amountPattern.FindStringSubmatch(raw)
+	if match == nil {
+		return "", NewNMIError(ErrInvalidAmount, "invalid amount "+strconv.Quote(raw)+": must be a positive dollar amount such as 10.99", "")
+	}
+
+	dollars, cents := strings.TrimLeft(match[1], "0"), match[2]
+	if dollars == "" {
+		dollars = "0"
+	}
+	if cents == "" {
+		return "", NewNMIError(ErrInvalidAmount, "ambiguous amount "+strconv.Quote(raw)+": include the decimal point in dollars (e.g. 10.99, or 1099.00 for $1,099)", "")
+	}
+	if len(cents) > 2 {
+		if strings.Trim(cents[2:], "0") != "" {
+			return "", NewNMIError(ErrInvalidAmount, "invalid amount "+strconv.Quote(raw)+": more than two decimal places", "")
+		}
+		cents = cents[:2]
+	}
+	for len(cents) < 2 {
+		cents += "0"
+	}
+
+	return Amount(dollars + "." + cents), nil
+}
+
+// UnmarshalJSON accepts "10.9", 10.9, "10.90" and 10.90 alike
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	raw := string(data)
+	if raw == "null" {
+		*a = ""
+		return nil
+	}
+	if strings.HasPrefix(raw, `"`) {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := ParseAmount(raw)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Minor returns the amount in cents
+func (a Amount) Minor() int64 {
+	minor, _ := strconv.ParseInt(strings.Replace(string(a), ".", "", 1), 10, 64)
+	return minor
+}
+
+// String returns the canonical two-decimal form
+func (a Amount) String() string {
+	return string(a)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    Amount
+		wantErr bool
+	}{
+		{raw: "10.99", want: "10.99"},
+		{raw: "10.9", want: "10.90"},
+		{raw: " 010.5 ", want: "10.50"},
+		{raw: "0.99", want: "0.99"},
+		{raw: "10.990", want: "10.99"},
+		{raw: "", want: ""},
+		{raw: "1099", wantErr: true},
+		{raw: "10.999", wantErr: true},
+		{raw: "-10.00", wantErr: true},
+		{raw: "1e3", wantErr: true},
+		{raw: "$10.00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseAmount(tt.raw)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, ErrInvalidAmount, err.(*NMIError).Code)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPaymentRequestAmountJSON(t *testing.T) {
+	var req PaymentRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"amount": 10.9}`), &req))
+	assert.Equal(t, Amount("10.90"), req.Amount)
+	assert.Equal(t, int64(1090), req.Amount.Minor())
+
+	require.NoError(t, json.Unmarshal([]byte(`{"amount": "25.00"}`), &req))
+	assert.Equal(t, Amount("25.00"), req.Amount)
+
+	err := json.Unmarshal([]byte(`{"amount": 1099}`), &req)
+	var nmiErr *NMIError
+	require.ErrorAs(t, err, &nmiErr)
+	assert.Equal(t, ErrInvalidAmount, nmiErr.Code)
+}
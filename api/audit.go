@@ -0,0 +1,442 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/requestid"
+)
+
+// DefaultMemoryAuditLogSize is how many records the in-memory audit log
+// retains
+const DefaultMemoryAuditLogSize = 10000
+
+// auditedOperations are the gateway calls that move money or change what a
+// customer will be charged. Reads, vault updates and device calls are left
+// out.
+var auditedOperations = map[string]bool{
+	"sale":                true,
+	"auth":                true,
+	"capture":             true,
+	"refund":              true,
+	"credit":              true,
+	"void":                true,
+	"offline":             true,
+	"add_subscription":    true,
+	"update_subscription": true,
+	"delete_subscription": true,
+	"add_plan":            true,
+	"edit_plan":           true,
+	"delete_plan":         true,
+}
+
+// Local plan changes, audited whether or not they are synced to the gateway
+const (
+	AuditPlanCreate = "plan_create"
+	AuditPlanUpdate = "plan_update"
+	AuditPlanDelete = "plan_delete"
+)
+
+// AuditRecord is one money-moving call. Each record's Hash covers its
+// fields and the previous record's hash, so editing, removing or reordering
+// a stored record breaks the chain from that point on.
+type AuditRecord struct {
+	Seq        int64     `json:"seq"`
+	CreatedAt  time.Time `json:"created_at"`
+	MerchantID string    `json:"merchant_id"`
+	// Actor is the API or the background job that made the call; Caller
+	// the authenticated API key name or JWT subject behind an API call
+	Actor     string `json:"actor"`
+	Caller    string `json:"caller,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Operation string `json:"operation"`
+	// Subject is the transaction, subscription or plan the call acted on
+	Subject string `json:"subject,omitempty"`
+	Amount  string `json:"amount,omitempty"`
+	// RequestHash is the SHA-256 of the sanitized gateway form, or of the
+	// plan for local plan changes, so a logged request can be matched to
+	// its record without the record holding card data
+	RequestHash string        `json:"request_hash"`
+	Response    AuditResponse `json:"response"`
+	PrevHash    string        `json:"prev_hash"`
+	Hash        string        `json:"hash"`
+}
+
+// AuditResponse summarizes the result of an audited call
+type AuditResponse struct {
+	// Outcome is approved, declined or error for gateway answers, ok for
+	// local changes, or the error code of a call that failed
+	Outcome       string `json:"outcome"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	ResponseCode  string `json:"response_code,omitempty"`
+	ResponseText  string `json:"response_text,omitempty"`
+}
+
+// AuditQuery selects audit records. Zero fields do not filter.
+type AuditQuery struct {
+	MerchantID string
+	FromSeq    int64
+	Limit      int
+}
+
+// AuditLog is an append-only, hash-chained record of money-moving calls
+type AuditLog interface {
+	// Append assigns the record the next sequence number, links it to the
+	// last record and stores it
+	Append(ctx context.Context, record AuditRecord) (AuditRecord, error)
+	// Read returns the records matching query in sequence order
+	Read(ctx context.Context, query AuditQuery) ([]AuditRecord, error)
+}
+
+// auditHash returns the hash chaining record to its predecessor
+func auditHash(record AuditRecord) string {
+	record.Hash = ""
+	record.CreatedAt = record.CreatedAt.UTC()
+	data, _ := json.Marshal(record)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// link places record after the record with seq and hash
+func link(record AuditRecord, seq int64, hash string) AuditRecord {
+	record.Seq = seq + 1
+	record.PrevHash = hash
+	// Stored timestamps keep microseconds, so hash no more than that
+	record.CreatedAt = record.CreatedAt.UTC().Truncate(time.Microsecond)
+	record.Hash = auditHash(record)
+	return record
+}
+
+// AuditVerification reports the state of the audit chain
+type AuditVerification struct {
+	Valid   bool  `json:"valid"`
+	Records int64 `json:"records"`
+	// HeadSeq and HeadHash identify the last record. Keeping the head hash
+	// elsewhere also exposes records removed from the end of the log.
+	HeadSeq  int64  `json:"head_seq"`
+	HeadHash string `json:"head_hash"`
+	// BrokenAt is the first record that does not match its hash or does
+	// not follow the one before it
+	BrokenAt int64 `json:"broken_at,omitempty"`
+}
+
+// auditVerifyPageSize is how many records VerifyAuditLog reads at a time
+const auditVerifyPageSize = 500
+
+// VerifyAuditLog walks the whole chain, recomputing every hash. The first
+// record read is trusted to follow whatever came before it, since the
+// in-memory log drops its oldest records.
+func VerifyAuditLog(ctx context.Context, log AuditLog) (AuditVerification, error) {
+	var result AuditVerification
+	fromSeq := int64(1)
+	for {
+		page, err := log.Read(ctx, AuditQuery{FromSeq: fromSeq, Limit: auditVerifyPageSize})
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		for _, record := range page {
+			linked := result.Records == 0 || (record.Seq == result.HeadSeq+1 && record.PrevHash == result.HeadHash)
+			if !linked || auditHash(record) != record.Hash {
+				result.BrokenAt = record.Seq
+				return result, nil
+			}
+			result.Records++
+			result.HeadSeq, result.HeadHash = record.Seq, record.Hash
+			fromSeq = record.Seq + 1
+		}
+		if len(page) < auditVerifyPageSize {
+			result.Valid = true
+			return result, nil
+		}
+	}
+}
+
+// MemoryAuditLog keeps the most recent records in process. Everything is
+// lost on restart, so it only suits development; set DATABASE_URL for a
+// durable audit log.
+type MemoryAuditLog struct {
+	mu      sync.RWMutex
+	records []AuditRecord
+	size    int
+	lastSeq int64
+	last    string
+}
+
+// NewMemoryAuditLog creates an in-memory audit log retaining up to size
+// records
+func NewMemoryAuditLog(size int) *MemoryAuditLog {
+	if size < 1 {
+		size = DefaultMemoryAuditLogSize
+	}
+	return &MemoryAuditLog{size: size}
+}
+
+func (l *MemoryAuditLog) Append(ctx context.Context, record AuditRecord) (AuditRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record = link(record, l.lastSeq, l.last)
+	l.lastSeq, l.last = record.Seq, record.Hash
+	l.records = append(l.records, record)
+	if len(l.records) > l.size {
+		l.records = append([]AuditRecord(nil), l.records[len(l.records)-l.size:]...)
+	}
+	return record, nil
+}
+
+func (l *MemoryAuditLog) Read(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start := sort.Search(len(l.records), func(i int) bool { return l.records[i].Seq >= query.FromSeq })
+	records := []AuditRecord{}
+	for _, record := range l.records[start:] {
+		if query.Limit > 0 && len(records) == query.Limit {
+			break
+		}
+		if query.MerchantID == "" || record.MerchantID == query.MerchantID {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+//go:embed migrations/audit/*.sql
+var auditMigrationFiles embed.FS
+
+// auditAppendAttempts bounds retries when instances race for the same
+// sequence number
+const auditAppendAttempts = 5
+
+// errAuditSeqTaken is returned when another instance appended first
+var errAuditSeqTaken = errors.New("audit sequence number already taken")
+
+// SQLAuditLog stores the audit log in Postgres or SQLite, shared by every
+// instance
+type SQLAuditLog struct {
+	db *db.DB
+}
+
+// NewSQLAuditLog migrates the audit schema and returns the log
+func NewSQLAuditLog(ctx context.Context, database *db.DB) (*SQLAuditLog, error) {
+	migrations, err := fs.Sub(auditMigrationFiles, "migrations/audit")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "audit", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLAuditLog{db: database}, nil
+}
+
+// Append links the record to the last one inside a transaction. Instances
+// appending at once collide on the sequence number and the loser relinks
+// to the winner's record, so the chain never forks.
+func (l *SQLAuditLog) Append(ctx context.Context, record AuditRecord) (AuditRecord, error) {
+	var err error
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		var appended AuditRecord
+		if appended, err = l.append(ctx, record); !errors.Is(err, errAuditSeqTaken) {
+			return appended, err
+		}
+	}
+	return AuditRecord{}, err
+}
+
+func (l *SQLAuditLog) append(ctx context.Context, record AuditRecord) (AuditRecord, error) {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	defer tx.Rollback()
+
+	var seq int64
+	var hash string
+	err = tx.QueryRowContext(ctx, `SELECT seq, hash FROM audit_records ORDER BY seq DESC LIMIT 1`).Scan(&seq, &hash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return AuditRecord{}, err
+	}
+
+	record = link(record, seq, hash)
+	_, err = tx.ExecContext(ctx, l.db.Rebind(`INSERT INTO audit_records
+		(seq, created_at, merchant_id, actor, caller, request_id, operation, subject, amount, request_hash,
+		 outcome, transaction_id, response_code, response_text, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		record.Seq, record.CreatedAt, record.MerchantID, record.Actor, record.Caller, record.RequestID,
+		record.Operation, record.Subject, record.Amount, record.RequestHash,
+		record.Response.Outcome, record.Response.TransactionID, record.Response.ResponseCode, record.Response.ResponseText,
+		record.PrevHash, record.Hash)
+	if db.IsUniqueViolation(err) {
+		return AuditRecord{}, errAuditSeqTaken
+	}
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	return record, tx.Commit()
+}
+
+func (l *SQLAuditLog) Read(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	sqlQuery := `SELECT seq, created_at, merchant_id, actor, caller, request_id, operation, subject, amount, request_hash,
+		outcome, transaction_id, response_code, response_text, prev_hash, hash
+		FROM audit_records WHERE seq >= ?`
+	args := []any{query.FromSeq}
+	if query.MerchantID != "" {
+		sqlQuery += ` AND merchant_id = ?`
+		args = append(args, query.MerchantID)
+	}
+	sqlQuery += ` ORDER BY seq`
+	if query.Limit > 0 {
+		sqlQuery += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+
+	rows, err := l.db.QueryContext(ctx, l.db.Rebind(sqlQuery), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []AuditRecord{}
+	for rows.Next() {
+		var r AuditRecord
+		if err := rows.Scan(&r.Seq, &r.CreatedAt, &r.MerchantID, &r.Actor, &r.Caller, &r.RequestID,
+			&r.Operation, &r.Subject, &r.Amount, &r.RequestHash,
+			&r.Response.Outcome, &r.Response.TransactionID, &r.Response.ResponseCode, &r.Response.ResponseText,
+			&r.PrevHash, &r.Hash); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = r.CreatedAt.UTC()
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// WithAuditLog keeps the audit log in log instead of in memory
+func WithAuditLog(log AuditLog) ClientOption {
+	return func(c *Client) {
+		c.audit = log
+	}
+}
+
+// AuditLog returns the log money-moving calls are recorded in
+func (c *Client) AuditLog() AuditLog {
+	return c.audit
+}
+
+// auditGatewayCall records a money-moving gateway call and its answer.
+// Declines and failed calls are recorded too; shadow clients record nothing.
+func (c *Client) auditGatewayCall(ctx context.Context, formData url.Values, body string, err error) {
+	operation := transactionType(formData)
+	if c.isolated || !auditedOperations[operation] {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(SanitizeFormData(formData).Encode()))
+	record := AuditRecord{
+		Operation:   operation,
+		Subject:     firstField(formData, "transactionid", "subscription_id", "current_plan_id", "plan_id"),
+		Amount:      firstField(formData, "amount", "plan_amount"),
+		RequestHash: hex.EncodeToString(sum[:]),
+		Response: AuditResponse{
+			Outcome:       gatewayOutcome(body, err),
+			TransactionID: ExtractValue(body, "transactionid"),
+			ResponseCode:  ExtractValue(body, "response_code"),
+			ResponseText:  ExtractValue(body, "responsetext"),
+		},
+	}
+	if record.Subject == "" {
+		record.Subject = ExtractValue(body, "subscription_id")
+	}
+	if err != nil {
+		record.Response.ResponseText = err.Error()
+	}
+	c.appendAudit(ctx, record)
+}
+
+// firstField returns the first of fields set in formData
+func firstField(formData url.Values, fields ...string) string {
+	for _, field := range fields {
+		if value := formData.Get(field); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// appendAudit fills in who made the call and appends the record. The call
+// has already happened, so a failed append is logged and counted rather
+// than returned.
+func (c *Client) appendAudit(ctx context.Context, record AuditRecord) {
+	record.CreatedAt = time.Now()
+	record.MerchantID = config.DefaultMerchantID
+	if merchant, ok := MerchantFromContext(ctx); ok {
+		record.MerchantID = merchant.ID
+	}
+	record.Actor = ActorFromContext(ctx)
+	record.Caller = logctx.Caller(ctx)
+	record.RequestID = requestid.From(ctx)
+
+	if _, err := c.audit.Append(context.WithoutCancel(ctx), record); err != nil {
+		logctx.From(ctx).WithError(err).WithField("operation", record.Operation).Error("Failed to append audit record")
+		metrics.RecordAuditRecord("failed")
+		return
+	}
+	metrics.RecordAuditRecord("appended")
+}
+
+// auditedPlans records every plan create, update and delete made through
+// the client's plan repository. It sits below gatewayPlans, so a synced
+// change shows as the local change followed by the gateway call.
+type auditedPlans struct {
+	PlanRepository
+	client *Client
+}
+
+func (a *auditedPlans) Create(ctx context.Context, plan Plan) (Plan, error) {
+	created, err := a.PlanRepository.Create(ctx, plan)
+	a.client.auditPlan(ctx, AuditPlanCreate, plan, err)
+	return created, err
+}
+
+func (a *auditedPlans) Update(ctx context.Context, plan Plan) (Plan, error) {
+	updated, err := a.PlanRepository.Update(ctx, plan)
+	a.client.auditPlan(ctx, AuditPlanUpdate, plan, err)
+	return updated, err
+}
+
+func (a *auditedPlans) Delete(ctx context.Context, id string) error {
+	err := a.PlanRepository.Delete(ctx, id)
+	a.client.auditPlan(ctx, AuditPlanDelete, Plan{ID: id}, err)
+	return err
+}
+
+// auditPlan records a local plan change and whether it was made
+func (c *Client) auditPlan(ctx context.Context, operation string, plan Plan, err error) {
+	data, _ := json.Marshal(plan)
+	sum := sha256.Sum256(data)
+	record := AuditRecord{
+		Operation:   operation,
+		Subject:     plan.ID,
+		Amount:      plan.Amount,
+		RequestHash: hex.EncodeToString(sum[:]),
+		Response:    AuditResponse{Outcome: "ok"},
+	}
+	if err != nil {
+		record.Response = AuditResponse{Outcome: gatewayOutcome("", err), ResponseText: err.Error()}
+	}
+	c.appendAudit(ctx, record)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+	"nmi-pay-int/logctx"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAuditLog(t *testing.T, log AuditLog) {
+	ctx := context.Background()
+	at := time.Date(2026, 10, 16, 14, 0, 0, 123456789, time.UTC)
+	for i, merchant := range []string{"m1", "m2", "m1"} {
+		record, err := log.Append(ctx, AuditRecord{
+			CreatedAt:   at.Add(time.Duration(i) * time.Minute),
+			MerchantID:  merchant,
+			Actor:       ActorExternal,
+			Operation:   "sale",
+			Amount:      "10.00",
+			RequestHash: "abc",
+			Response:    AuditResponse{Outcome: "approved", TransactionID: "100"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), record.Seq)
+		assert.Len(t, record.Hash, 64)
+	}
+
+	all, err := log.Read(ctx, AuditQuery{FromSeq: 1})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Empty(t, all[0].PrevHash)
+	assert.Equal(t, all[0].Hash, all[1].PrevHash)
+	assert.Equal(t, all[1].Hash, all[2].PrevHash)
+	assert.Equal(t, "approved", all[2].Response.Outcome)
+
+	m1, err := log.Read(ctx, AuditQuery{MerchantID: "m1", FromSeq: 2, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, m1, 1)
+	assert.Equal(t, int64(3), m1[0].Seq)
+
+	result, err := VerifyAuditLog(ctx, log)
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.Equal(t, int64(3), result.Records)
+	assert.Equal(t, all[2].Hash, result.HeadHash)
+}
+
+func TestMemoryAuditLog(t *testing.T) {
+	testAuditLog(t, NewMemoryAuditLog(DefaultMemoryAuditLogSize))
+}
+
+func TestSQLAuditLog(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	log, err := NewSQLAuditLog(ctx, database)
+	require.NoError(t, err)
+	testAuditLog(t, log)
+
+	// Rewriting a stored record is caught at that record
+	_, err = database.ExecContext(ctx, `UPDATE audit_records SET amount = '1.00' WHERE seq = 2`)
+	require.NoError(t, err)
+	result, err := VerifyAuditLog(ctx, log)
+	require.NoError(t, err)
+	assert.False(t, result.Valid)
+	assert.Equal(t, int64(2), result.BrokenAt)
+
+	// So is removing one
+	_, err = database.ExecContext(ctx, `UPDATE audit_records SET amount = '10.00' WHERE seq = 2`)
+	require.NoError(t, err)
+	_, err = database.ExecContext(ctx, `DELETE FROM audit_records WHERE seq = 2`)
+	require.NoError(t, err)
+	result, err = VerifyAuditLog(ctx, log)
+	require.NoError(t, err)
+	assert.False(t, result.Valid)
+	assert.Equal(t, int64(3), result.BrokenAt)
+}
+
+func TestMemoryAuditLogKeepsNewestRecords(t *testing.T) {
+	log := NewMemoryAuditLog(2)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(context.Background(), AuditRecord{Operation: "refund"})
+		require.NoError(t, err)
+	}
+
+	records, err := log.Read(context.Background(), AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, int64(2), records[0].Seq)
+
+	// The oldest retained record starts the chain
+	result, err := VerifyAuditLog(context.Background(), log)
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.Equal(t, int64(3), result.HeadSeq)
+}
+
+func TestClientAuditsMoneyMovingCalls(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("type") == "void" {
+			w.Write([]byte("response=3&responsetext=Transaction already settled&transactionid=&type=void&response_code=300"))
+			return
+		}
+		w.Write([]byte("response=1&responsetext=SUCCESS&authcode=123456&transactionid=900&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	ctx := WithMerchant(context.Background(), config.Merchant{ID: "m1"})
+	ctx = logctx.WithFields(ctx, logrus.Fields{logctx.FieldCaller: "checkout"})
+	_, err := client.ProcessPayment(ctx, PaymentRequest{APIKey: "key", Amount: "20.00", Type: "sale", CreditCard: "4111111111111111", ExpDate: "1230", CVV: "123"})
+	require.NoError(t, err)
+	_, err = client.VoidTransaction(WithActor(ctx, ActorReconciliation), VoidRequest{APIKey: "key", TransactionID: "900"})
+	require.Error(t, err)
+	_, err = client.Plans().Create(ctx, Plan{ID: "gold", Name: "Gold", Amount: "30.00"})
+	require.NoError(t, err)
+
+	records, err := client.AuditLog().Read(context.Background(), AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	sale := records[0]
+	assert.Equal(t, "sale", sale.Operation)
+	assert.Equal(t, "m1", sale.MerchantID)
+	assert.Equal(t, ActorExternal, sale.Actor)
+	assert.Equal(t, "checkout", sale.Caller)
+	assert.Equal(t, "20.00", sale.Amount)
+	assert.Equal(t, AuditResponse{Outcome: "approved", TransactionID: "900", ResponseCode: "100", ResponseText: "SUCCESS"}, sale.Response)
+	assert.Len(t, sale.RequestHash, 64)
+
+	void := records[1]
+	assert.Equal(t, "void", void.Operation)
+	assert.Equal(t, ActorReconciliation, void.Actor)
+	assert.Equal(t, "900", void.Subject)
+	assert.Equal(t, "error", void.Response.Outcome)
+
+	plan := records[2]
+	assert.Equal(t, AuditPlanCreate, plan.Operation)
+	assert.Equal(t, "gold", plan.Subject)
+	assert.Equal(t, "ok", plan.Response.Outcome)
+
+	result, err := VerifyAuditLog(context.Background(), client.AuditLog())
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// BatchCloseAutomatic reports that the gateway settles the batch on its own
+// schedule. NMI closes batches at the account's configured cutoff time and
+// has no API call to close one early, so closing a batch here summarizes
+// the day without asking NMI to settle.
+const BatchCloseAutomatic = "automatic"
+
+// BatchTotal counts successful actions of one kind and their amount
+type BatchTotal struct {
+	Count  int    `json:"count"`
+	Amount string `json:"amount"`
+}
+
+// BatchSummary is the end-of-day report produced when a batch is closed
+type BatchSummary struct {
+	Date         string    `json:"date"`
+	ClosedAt     time.Time `json:"closed_at"`
+	GatewayClose string    `json:"gateway_close"`
+	// Sales are sales and captures; Refunds include credits
+	Sales   BatchTotal `json:"sales"`
+	Refunds BatchTotal `json:"refunds"`
+	Voids   BatchTotal `json:"voids"`
+	// Declines counts sales and authorizations the issuer declined
+	Declines int `json:"declines"`
+	// NetAmount is what the day should settle: sales less refunds and voids
+	NetAmount string `json:"net_amount"`
+	// PendingSettlement counts the day's transactions still waiting for the
+	// gateway to settle them
+	PendingSettlement int `json:"pending_settlement"`
+}
+
+// CloseBatch closes the day's settlement batch and summarizes the day's
+// activity from the Query API. day is interpreted as a calendar date in the
+// gateway's reporting time zone.
+func (c *Client) CloseBatch(ctx context.Context, apiKey string, day time.Time) (*BatchSummary, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	summary := &BatchSummary{
+		Date:         start.Format("2006-01-02"),
+		GatewayClose: BatchCloseAutomatic,
+	}
+
+	var sales, refunds, voids int64
+	for page := 0; ; page++ {
+		records, err := c.SearchTransactions(ctx, TransactionSearch{
+			APIKey:    apiKey,
+			StartDate: start,
+			EndDate:   start.Add(24*time.Hour - time.Second),
+			Page:      page,
+			Limit:     MaxSearchLimit,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.Condition == "pendingsettlement" {
+				summary.PendingSettlement++
+			}
+			for _, action := range record.Actions {
+				if action.Date.Format("2006-01-02") != summary.Date {
+					continue
+				}
+				amount, _ := ParseAmount(action.Amount)
+				switch {
+				case !action.Success:
+					if action.Type == "sale" || action.Type == "auth" {
+						summary.Declines++
+					}
+				case action.Type == "sale" || action.Type == "capture":
+					summary.Sales.Count++
+					sales += amount.Minor()
+				case action.Type == "refund" || action.Type == "credit":
+					summary.Refunds.Count++
+					refunds += amount.Minor()
+				case action.Type == "void":
+					summary.Voids.Count++
+					voids += amount.Minor()
+				}
+			}
+		}
+
+		if len(records) < MaxSearchLimit {
+			break
+		}
+	}
+
+	summary.Sales.Amount = formatMinor(sales)
+	summary.Refunds.Amount = formatMinor(refunds)
+	summary.Voids.Amount = formatMinor(voids)
+	summary.NetAmount = formatMinor(sales - refunds - voids)
+	summary.ClosedAt = time.Now().UTC()
+	return summary, nil
+}
+
+// formatMinor formats an amount in cents as dollars, e.g. -1050 as "-10.50"
+func formatMinor(minor int64) string {
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	cents := strconv.FormatInt(minor%100, 10)
+	if len(cents) < 2 {
+		cents = "0" + cents
+	}
+	return sign + strconv.FormatInt(minor/100, 10) + "." + cents
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const batchDayFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<transaction>
+		<transaction_id>1</transaction_id>
+		<condition>pendingsettlement</condition>
+		<action><amount>100.00</amount><action_type>sale</action_type><date>20261016093000</date><success>1</success></action>
+		<action><amount>25.50</amount><action_type>refund</action_type><date>20261016150000</date><success>1</success></action>
+	</transaction>
+	<transaction>
+		<transaction_id>2</transaction_id>
+		<condition>complete</condition>
+		<action><amount>40.00</amount><action_type>auth</action_type><date>20261015180000</date><success>1</success></action>
+		<action><amount>40.00</amount><action_type>capture</action_type><date>20261016080000</date><success>1</success></action>
+	</transaction>
+	<transaction>
+		<transaction_id>3</transaction_id>
+		<condition>failed</condition>
+		<action><amount>9.99</amount><action_type>sale</action_type><date>20261016101500</date><success>0</success></action>
+	</transaction>
+	<transaction>
+		<transaction_id>4</transaction_id>
+		<condition>canceled</condition>
+		<action><amount>12.00</amount><action_type>sale</action_type><date>20261016110000</date><success>1</success></action>
+		<action><amount>12.00</amount><action_type>void</action_type><date>20261016111000</date><success>1</success></action>
+	</transaction>
+</nm_response>`
+
+func TestCloseBatchSummarizesDay(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte(batchDayFixture))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	summary, err := client.CloseBatch(context.Background(), "key", time.Date(2026, 10, 16, 22, 0, 0, 0, time.Local))
+	require.NoError(t, err)
+
+	assert.Equal(t, "20261016000000", form.Get("start_date"))
+	assert.Equal(t, "20261016235959", form.Get("end_date"))
+
+	assert.Equal(t, "2026-10-16", summary.Date)
+	assert.Equal(t, BatchCloseAutomatic, summary.GatewayClose)
+	// The sale and the void's original sale, plus the capture; the
+	// previous day's authorization is not counted
+	assert.Equal(t, BatchTotal{Count: 3, Amount: "152.00"}, summary.Sales)
+	assert.Equal(t, BatchTotal{Count: 1, Amount: "25.50"}, summary.Refunds)
+	assert.Equal(t, BatchTotal{Count: 1, Amount: "12.00"}, summary.Voids)
+	assert.Equal(t, 1, summary.Declines)
+	assert.Equal(t, "114.50", summary.NetAmount)
+	assert.Equal(t, 1, summary.PendingSettlement)
+	assert.False(t, summary.ClosedAt.IsZero())
+}
+
+func TestFormatMinor(t *testing.T) {
+	assert.Equal(t, "0.00", formatMinor(0))
+	assert.Equal(t, "0.05", formatMinor(5))
+	assert.Equal(t, "1234.50", formatMinor(123450))
+	assert.Equal(t, "-10.50", formatMinor(-1050))
+}
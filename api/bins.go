@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"net/url"
+
+	"nmi-pay-int/bins"
+	"nmi-pay-int/logctx"
+)
+
+// WithBINTable identifies cards in table, so payments report their level
+// and issuing country and BIN_REJECT_PREPAID can be enforced
+func WithBINTable(table *bins.Table) ClientOption {
+	return func(c *Client) {
+		c.bins = table
+	}
+}
+
+// cardDetails returns what is known of a card number or BIN, or nil when
+// there is none. Brands the table does not list come from CardBrand.
+func (c *Client) cardDetails(number string) *bins.Card {
+	digits := bins.Digits(number)
+	if len(digits) < bins.MinPrefix {
+		return nil
+	}
+	card := bins.Card{BIN: digits[:bins.MinPrefix]}
+	if c.bins != nil {
+		if found, ok := c.bins.Lookup(digits); ok {
+			card = found
+		}
+	}
+	if card.Brand == "" {
+		card.Brand = CardBrand(digits)
+	}
+	return &card
+}
+
+// checkPrepaid refuses a prepaid card for a payment BIN_REJECT_PREPAID
+// lists, before anything is sent to the gateway
+func (c *Client) checkPrepaid(payment string, card *bins.Card) error {
+	if card == nil || card.Level != bins.LevelPrepaid {
+		return nil
+	}
+	for _, refused := range c.cfg.BINRejectPrepaid {
+		if refused == payment {
+			return NewNMIError(ErrCardNotAccepted, "prepaid cards are not accepted for "+payment, "")
+		}
+	}
+	return nil
+}
+
+// vaultCardBIN returns the BIN of the card stored under vaultID: the one
+// seen when it was tokenized here, or the one the Query API reports. It
+// returns "" when neither knows.
+func (c *Client) vaultCardBIN(ctx context.Context, apiKey, vaultID string) string {
+	vaultCards.RLock()
+	card := vaultCards.data[vaultID]
+	vaultCards.RUnlock()
+	if card.bin != "" {
+		return card.bin
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("report_type", "customer_vault")
+	formData.Set("customer_vault_id", vaultID)
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil || len(parsed.Customers) == 0 {
+		logctx.From(ctx).WithField("customer_vault_id", vaultID).Debug("BIN of vaulted card unknown")
+		return ""
+	}
+	return parsed.Customers[0].CCBin
+}
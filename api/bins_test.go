@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nmi-pay-int/bins"
+	"nmi-pay-int/config"
+	"nmi-pay-int/fixtures"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openBINTable(t *testing.T) *bins.Table {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bins.csv")
+	require.NoError(t, os.WriteFile(path, []byte("bin,brand,level,country\n411111,visa,prepaid,US\n555555,,debit,GB\n"), 0o600))
+	table, err := bins.Open(path)
+	require.NoError(t, err)
+	return table
+}
+
+func TestCardDetails(t *testing.T) {
+	client := NewClient(&config.Config{}, WithBINTable(openBINTable(t)))
+	assert.Equal(t, &bins.Card{BIN: "411111", Brand: "visa", Level: bins.LevelPrepaid, Country: "US"}, client.cardDetails("4111111111111111"))
+	assert.Equal(t, &bins.Card{BIN: "555555", Brand: "mastercard", Level: bins.LevelDebit, Country: "GB"}, client.cardDetails("5555 5555 5555 4444"),
+		"the brand comes from the number when the table has none")
+	assert.Equal(t, &bins.Card{BIN: "378282", Brand: "amex"}, client.cardDetails("378282246310005"))
+	assert.Nil(t, client.cardDetails(""))
+
+	assert.Equal(t, &bins.Card{BIN: "411111", Brand: "visa"}, NewClient(&config.Config{}).cardDetails("4111111111111111"))
+}
+
+func TestProcessPaymentRejectsPrepaid(t *testing.T) {
+	calls := 0
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=778&type=auth&response_code=100"))
+	}))
+	defer gateway.Close()
+	cfg := &config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL, BINRejectPrepaid: []string{"sale"}}
+	client := NewClient(cfg, WithBINTable(openBINTable(t)))
+	req := PaymentRequest{APIKey: "key", Amount: "20.00", Type: "sale", CreditCard: "4111111111111111", ExpDate: "1230", CVV: "123"}
+
+	_, err := client.ProcessPayment(context.Background(), req)
+	var nmiErr *NMIError
+	require.ErrorAs(t, err, &nmiErr)
+	assert.Equal(t, ErrCardNotAccepted, nmiErr.Code)
+	assert.Equal(t, http.StatusPaymentRequired, HTTPStatus(err))
+	assert.Zero(t, calls, "refused before reaching the gateway")
+
+	// Authorizations are not refused, and report the card
+	req.Type = "auth"
+	resp, err := client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, &bins.Card{BIN: "411111", Brand: "visa", Level: bins.LevelPrepaid, Country: "US"}, resp.Card)
+}
+
+func TestSubscriptionRejectsPrepaidVaultCard(t *testing.T) {
+	subscribed := false
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("report_type") == "customer_vault" {
+			w.Write([]byte(fixtures.Body("query/vault_customer")))
+			return
+		}
+		subscribed = true
+		w.Write([]byte("response=1&responsetext=Subscription added&transactionid=7002&response_code=100"))
+	}))
+	defer gateway.Close()
+	cfg := &config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL, BINRejectPrepaid: []string{"subscription"}}
+	client := NewClient(cfg, WithBINTable(openBINTable(t)))
+	ctx := context.Background()
+	_, err := client.Plans().Create(ctx, Plan{ID: "prepaid-plan", Name: "Monthly", Amount: "30.00", MonthFrequency: "1", DayOfMonth: "1"})
+	require.NoError(t, err)
+
+	_, err = client.ProcessRecurringPayment(ctx, RecurringPaymentRequest{CustomerVaultID: "1184372911", PlanID: "prepaid-plan"})
+	var nmiErr *NMIError
+	require.ErrorAs(t, err, &nmiErr)
+	assert.Equal(t, ErrCardNotAccepted, nmiErr.Code)
+	assert.Equal(t, "prepaid cards are not accepted for subscription", nmiErr.Message)
+	assert.False(t, subscribed)
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// CircuitBreaker stops sending requests to NMI after repeated gateway
+// failures and lets a single trial request through once the cooldown has
+// passed
+type CircuitBreaker struct {
+	mu    sync.Mutex
+	state string
+	// probing is set while the half-open trial request is in flight; other
+	// requests are refused until it reports
+	probing          bool
+	failures         int
+	failureThreshold int
+	cooldown         time.Duration
+	openedAt         time.Time
+	forced           bool
+	lastChange       time.Time
+	// silent breakers keep their state out of the gateway breaker gauge and
+	// logs; the shadow client's breaker is one
+	silent bool
+	// transitions are the state changes of the last breakerHistory, oldest
+	// first, from which gateway incidents are derived
+	transitions []breakerTransition
+}
+
+// breakerHistory is how long breaker state changes are kept
+const breakerHistory = 7 * 24 * time.Hour
+
+// breakerTransition is one change of breaker state
+type breakerTransition struct {
+	at     time.Time
+	state  string
+	forced bool
+}
+
+// BreakerStatus is the JSON view of the circuit breaker
+type BreakerStatus struct {
+	State            string    `json:"state"`
+	Failures         int       `json:"failures"`
+	FailureThreshold int       `json:"failure_threshold"`
+	Cooldown         string    `json:"cooldown"`
+	Forced           bool      `json:"forced"`
+	LastChange       time.Time `json:"last_change"`
+}
+
+// BreakerActionRequest is the body accepted by the breaker admin endpoint
+type BreakerActionRequest struct {
+	Action string `json:"action"` // open or close
+}
+
+// GatewayBreaker guards all outbound NMI requests
+var GatewayBreaker = NewCircuitBreaker(5, 30*time.Second)
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:            BreakerClosed,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		lastChange:       time.Now(),
+	}
+}
+
+// Allow reports whether a request may be sent to the gateway. While half
+// open only one request is allowed, until it records its outcome or calls
+// Release.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && !b.forced && time.Since(b.openedAt) >= b.cooldown {
+		b.setState(BreakerHalfOpen)
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// Release ends a half-open trial that got no verdict on the gateway, such
+// as one its caller abandoned, so the next request can try instead
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// RecordSuccess closes the breaker after a successful gateway call
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state == BreakerHalfOpen {
+		b.setState(BreakerClosed)
+	}
+}
+
+// RecordFailure counts a gateway failure and opens the breaker once the
+// threshold is reached or a half-open trial request fails
+func (b *CircuitBreaker) RecordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.failureThreshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// ForceOpen trips the breaker and keeps it open until ForceClose is called
+func (b *CircuitBreaker) ForceOpen() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.forced = true
+	b.openedAt = time.Now()
+	b.setState(BreakerOpen)
+}
+
+// ForceClose closes the breaker and resets the failure count
+func (b *CircuitBreaker) ForceClose() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.forced = false
+	b.failures = 0
+	b.setState(BreakerClosed)
+}
+
+// Status returns a snapshot of the breaker state
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BreakerStatus{
+		State:            b.state,
+		Failures:         b.failures,
+		FailureThreshold: b.failureThreshold,
+		Cooldown:         b.cooldown.String(),
+		Forced:           b.forced,
+		LastChange:       b.lastChange,
+	}
+}
+
+// setState must be called with the mutex held
+func (b *CircuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	b.probing = false
+	b.lastChange = time.Now()
+	if b.silent {
+		return
+	}
+	b.transitions = append(pruneTransitions(b.transitions, b.lastChange), breakerTransition{
+		at:     b.lastChange,
+		state:  state,
+		forced: b.forced,
+	})
+	metrics.SetBreakerState(state)
+	metrics.LogInfo(context.Background(), "Gateway circuit breaker is now "+state)
+}
+
+// pruneTransitions drops state changes older than breakerHistory, keeping
+// the last of them so the state at the start of the history is known
+func pruneTransitions(transitions []breakerTransition, now time.Time) []breakerTransition {
+	cutoff := now.Add(-breakerHistory)
+	i := 0
+	for i+1 < len(transitions) && transitions[i+1].at.Before(cutoff) {
+		i++
+	}
+	return transitions[i:]
+}
+
+// Incident is a period during which the breaker stopped requests to the
+// gateway, from opening until it closed again
+type Incident struct {
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	// Manual incidents were opened by an operator rather than by failures
+	Manual bool `json:"manual"`
+}
+
+// Incidents returns the incidents that overlap the time since the given
+// instant, oldest first. An incident still in progress has no ResolvedAt.
+func (b *CircuitBreaker) Incidents(since time.Time) []Incident {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var incidents []Incident
+	var current *Incident
+	for _, t := range b.transitions {
+		switch {
+		case t.state == BreakerOpen && current == nil:
+			current = &Incident{StartedAt: t.at, Manual: t.forced}
+		case t.state == BreakerClosed && current != nil:
+			resolved := t.at
+			current.ResolvedAt = &resolved
+			if resolved.After(since) {
+				incidents = append(incidents, *current)
+			}
+			current = nil
+		}
+	}
+	if current != nil {
+		incidents = append(incidents, *current)
+	}
+	return incidents
+}
+
+// HandleBreakerStatus returns the current gateway breaker state
+func HandleBreakerStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GatewayBreaker.Status())
+	}
+}
+
+// HandleBreakerAction manually opens or closes the gateway breaker
+func HandleBreakerAction() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BreakerActionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteErrorCode(w, r, ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		switch req.Action {
+		case "open":
+			GatewayBreaker.ForceOpen()
+		case "close":
+			GatewayBreaker.ForceClose()
+		default:
+			WriteErrorCode(w, r, ErrInvalidRequest, "action must be open or close")
+			return
+		}
+
+		metrics.LogInfo(r.Context(), "Gateway circuit breaker manually set to "+req.Action)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GatewayBreaker.Status())
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("Opens After Threshold", func(t *testing.T) {
+		b := NewCircuitBreaker(2, time.Minute)
+		b.RecordFailure()
+		assert.True(t, b.Allow())
+		b.RecordFailure()
+		assert.False(t, b.Allow())
+		assert.Equal(t, BreakerOpen, b.Status().State)
+	})
+
+	t.Run("Half Open After Cooldown", func(t *testing.T) {
+		b := NewCircuitBreaker(1, time.Millisecond)
+		b.RecordFailure()
+		time.Sleep(5 * time.Millisecond)
+		assert.True(t, b.Allow())
+		assert.Equal(t, BreakerHalfOpen, b.Status().State)
+		b.RecordSuccess()
+		assert.Equal(t, BreakerClosed, b.Status().State)
+	})
+
+	t.Run("Half Open Admits One Trial", func(t *testing.T) {
+		b := NewCircuitBreaker(1, time.Millisecond)
+		b.RecordFailure()
+		time.Sleep(5 * time.Millisecond)
+		assert.True(t, b.Allow())
+		assert.False(t, b.Allow(), "the backlog waits for the trial")
+
+		b.Release()
+		assert.True(t, b.Allow(), "an abandoned trial is handed on")
+		assert.False(t, b.Allow())
+
+		b.RecordFailure()
+		assert.Equal(t, BreakerOpen, b.Status().State)
+		time.Sleep(5 * time.Millisecond)
+		assert.True(t, b.Allow())
+		b.RecordSuccess()
+		assert.True(t, b.Allow())
+		assert.True(t, b.Allow())
+	})
+
+	t.Run("Forced Open Ignores Cooldown", func(t *testing.T) {
+		b := NewCircuitBreaker(1, time.Millisecond)
+		b.ForceOpen()
+		time.Sleep(5 * time.Millisecond)
+		assert.False(t, b.Allow())
+		b.ForceClose()
+		assert.True(t, b.Allow())
+		assert.Equal(t, 0, b.Status().Failures)
+	})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/pci"
+)
+
+// CaptureRequest settles a previously authorized transaction. Amount may be
+// lower than the authorized amount for a partial capture; when omitted the
+// full authorization is captured.
+type CaptureRequest struct {
+	APIKey        string `json:"api_key,omitempty"`
+	TransactionID string `json:"transaction_id"`
+	Amount        string `json:"amount,omitempty"`
+	OrderID       string `json:"order_id,omitempty"`
+}
+
+type CaptureResponse struct {
+	RawResponse   string            `json:"raw_response"`
+	StatusCode    int               `json:"status_code"`
+	Response      string            `json:"response"`
+	ResponseText  string            `json:"responsetext"`
+	AuthCode      string            `json:"authcode"`
+	TransactionID string            `json:"transactionid"`
+	Type          string            `json:"type"`
+	ResponseCode  string            `json:"response_code"`
+	Amount        string            `json:"amount"`
+	ExtraFields   map[string]string `json:"extra_fields,omitempty"`
+}
+
+// authorizations remembers amounts authorized through this service so that
+// captures can be checked before they reach the gateway
+var authorizations = struct {
+	sync.RWMutex
+	amounts map[string]string
+}{amounts: make(map[string]string)}
+
+// AuthorizeTransaction places a hold for the amount without settling it
+func (c *Client) AuthorizeTransaction(ctx context.Context, req PaymentRequest) (*PaymentResponse, error) {
+	req.Type = "auth"
+
+	resp, err := c.ProcessPayment(ctx, req)
+	if err != nil || resp.IdempotentReplay {
+		return resp, err
+	}
+
+	// A surcharged authorization can be captured in full, surcharge included
+	authorized := req.Amount
+	if resp.Surcharge != nil {
+		authorized = resp.Surcharge.TotalAmount
+	}
+	authorizations.Lock()
+	authorizations.amounts[resp.TransactionID] = authorized.String()
+	authorizations.Unlock()
+
+	return resp, nil
+}
+
+// CaptureTransaction settles all or part of an authorization. Authorizations
+// made outside this service are passed through and checked by NMI.
+func (c *Client) CaptureTransaction(ctx context.Context, req CaptureRequest) (*CaptureResponse, error) {
+	startTime := time.Now()
+	defer func() {
+		metrics.RecordTransactionMetrics(logctx.Merchant(ctx), "capture", "processed", time.Since(startTime).Seconds())
+	}()
+
+	authorizations.RLock()
+	authorizedAmount := authorizations.amounts[req.TransactionID]
+	authorizations.RUnlock()
+
+	if err := ValidateCaptureRequest(req, authorizedAmount); err != nil {
+		metrics.RecordErrorMetrics("capture", "validation_error")
+		return nil, err
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", req.APIKey)
+	formData.Set("type", "capture")
+	formData.Set("transactionid", req.TransactionID)
+
+	if req.Amount != "" {
+		formData.Set("amount", req.Amount)
+	}
+	if req.OrderID != "" {
+		formData.Set("orderid", req.OrderID)
+	}
+
+	resp, err := c.sendRequest(ctx, formData)
+	if err != nil {
+		metrics.RecordErrorMetrics("capture", "network_error")
+		return nil, err
+	}
+
+	parsedResp, err := ParseNMIResponse(resp)
+	if err != nil {
+		metrics.RecordErrorMetrics("capture", "parse_error")
+		return nil, err
+	}
+
+	// An authorization can only be captured once
+	authorizations.Lock()
+	delete(authorizations.amounts, req.TransactionID)
+	authorizations.Unlock()
+
+	recordActor(ctx, "capture", parsedResp.TransactionID)
+
+	amount := req.Amount
+	if amount == "" {
+		amount = authorizedAmount
+	}
+
+	return &CaptureResponse{
+		RawResponse:   pci.Scrub(resp),
+		StatusCode:    200,
+		Response:      parsedResp.Response,
+		ResponseText:  parsedResp.ResponseText,
+		AuthCode:      parsedResp.AuthCode,
+		TransactionID: parsedResp.TransactionID,
+		Type:          parsedResp.Type,
+		ResponseCode:  parsedResp.ResponseCode,
+		Amount:        amount,
+		ExtraFields:   c.passthroughFields(parsedResp.Values),
+	}, nil
+}
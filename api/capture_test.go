@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeAndCapture(t *testing.T) {
+	var captured []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		switch r.PostForm.Get("type") {
+		case "auth":
+			w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=5001&type=auth&response_code=100"))
+		case "capture":
+			captured = append(captured, r.PostForm.Get("amount"))
+			w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=5001&type=capture&response_code=100"))
+		}
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	ctx := context.Background()
+
+	auth, err := client.AuthorizeTransaction(ctx, PaymentRequest{
+		Amount:     "50.00",
+		CreditCard: "4111111111111111",
+		ExpDate:    "1230",
+		CVV:        "123",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "5001", auth.TransactionID)
+
+	_, err = client.CaptureTransaction(ctx, CaptureRequest{TransactionID: "5001", Amount: "60.00"})
+	require.Error(t, err)
+	assert.Equal(t, ErrInvalidAmount, err.(*NMIError).Code)
+
+	resp, err := client.CaptureTransaction(ctx, CaptureRequest{TransactionID: "5001", Amount: "30.00"})
+	require.NoError(t, err)
+	assert.Equal(t, "30.00", resp.Amount)
+	assert.Equal(t, []string{"30.00"}, captured)
+}
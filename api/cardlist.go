@@ -0,0 +1,259 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"nmi-pay-int/bins"
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+)
+
+// Card lists
+const (
+	// CardListBlock cards are declined without reaching the gateway
+	CardListBlock = "block"
+	// CardListAllow marks cards the merchant trusts; they still go through
+	// the prepaid and AVS/CVV rules
+	CardListAllow = "allow"
+)
+
+// ErrCardListEntryNotFound is returned for a card on none of a merchant's
+// lists
+var ErrCardListEntryNotFound = errors.New("card is on no list")
+
+// CardListEntry puts one card, by fingerprint, on a merchant's blocklist or
+// allowlist. A card is on at most one of a merchant's lists.
+type CardListEntry struct {
+	MerchantID  string    `json:"merchant_id"`
+	Fingerprint string    `json:"fingerprint"`
+	List        string    `json:"list"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CardFingerprint identifies a card number without revealing it: an
+// HMAC-SHA256 of its digits keyed with salt, so fingerprints cannot be
+// reversed by hashing every possible number without the salt
+func CardFingerprint(salt, number string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(bins.Digits(number)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CardLists stores each merchant's blocked and allowed cards
+type CardLists interface {
+	// Get returns the entry for a card, or ErrCardListEntryNotFound
+	Get(ctx context.Context, merchantID, fingerprint string) (CardListEntry, error)
+	// Put adds the card to entry.List, moving it off the other list
+	Put(ctx context.Context, entry CardListEntry) error
+	// Delete takes the card off the merchant's lists, or returns
+	// ErrCardListEntryNotFound
+	Delete(ctx context.Context, merchantID, fingerprint string) error
+	// List returns the merchant's entries on list, or on both lists when it
+	// is empty, oldest first
+	List(ctx context.Context, merchantID, list string) ([]CardListEntry, error)
+}
+
+// MemoryCardLists keeps card lists in process. They are lost on restart and
+// not shared between instances.
+type MemoryCardLists struct {
+	mu      sync.RWMutex
+	entries map[[2]string]CardListEntry
+}
+
+// NewMemoryCardLists creates empty in-memory card lists
+func NewMemoryCardLists() *MemoryCardLists {
+	return &MemoryCardLists{entries: make(map[[2]string]CardListEntry)}
+}
+
+func (m *MemoryCardLists) Get(ctx context.Context, merchantID, fingerprint string) (CardListEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, ok := m.entries[[2]string{merchantID, fingerprint}]
+	if !ok {
+		return CardListEntry{}, ErrCardListEntryNotFound
+	}
+	return entry, nil
+}
+
+func (m *MemoryCardLists) Put(ctx context.Context, entry CardListEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[[2]string{entry.MerchantID, entry.Fingerprint}] = entry
+	return nil
+}
+
+func (m *MemoryCardLists) Delete(ctx context.Context, merchantID, fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{merchantID, fingerprint}
+	if _, ok := m.entries[key]; !ok {
+		return ErrCardListEntryNotFound
+	}
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *MemoryCardLists) List(ctx context.Context, merchantID, list string) ([]CardListEntry, error) {
+	m.mu.RLock()
+	entries := []CardListEntry{}
+	for _, entry := range m.entries {
+		if entry.MerchantID == merchantID && (list == "" || entry.List == list) {
+			entries = append(entries, entry)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+		}
+		return entries[i].Fingerprint < entries[j].Fingerprint
+	})
+	return entries, nil
+}
+
+//go:embed migrations/card_lists/*.sql
+var cardListMigrationFiles embed.FS
+
+// SQLCardLists stores card lists in Postgres or SQLite, so a card blocked
+// through one instance is declined by all of them
+type SQLCardLists struct {
+	db *db.DB
+}
+
+// NewSQLCardLists migrates the card list schema and returns the lists
+func NewSQLCardLists(ctx context.Context, database *db.DB) (*SQLCardLists, error) {
+	migrations, err := fs.Sub(cardListMigrationFiles, "migrations/card_lists")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "card_lists", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLCardLists{db: database}, nil
+}
+
+func (s *SQLCardLists) Get(ctx context.Context, merchantID, fingerprint string) (CardListEntry, error) {
+	entries, err := s.query(ctx, `WHERE merchant_id = ? AND fingerprint = ?`, merchantID, fingerprint)
+	if err != nil {
+		return CardListEntry{}, err
+	}
+	if len(entries) == 0 {
+		return CardListEntry{}, ErrCardListEntryNotFound
+	}
+	return entries[0], nil
+}
+
+func (s *SQLCardLists) Put(ctx context.Context, entry CardListEntry) error {
+	// ON CONFLICT ... DO UPDATE is understood by both Postgres and SQLite
+	_, err := s.db.ExecContext(ctx, s.db.Rebind(`INSERT INTO card_list_entries
+		(merchant_id, fingerprint, list, reason, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (merchant_id, fingerprint) DO UPDATE SET
+			list = excluded.list,
+			reason = excluded.reason,
+			created_at = excluded.created_at`),
+		entry.MerchantID, entry.Fingerprint, entry.List, entry.Reason, entry.CreatedAt.UTC())
+	return err
+}
+
+func (s *SQLCardLists) Delete(ctx context.Context, merchantID, fingerprint string) error {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(`DELETE FROM card_list_entries
+		WHERE merchant_id = ? AND fingerprint = ?`), merchantID, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCardListEntryNotFound
+	}
+	return err
+}
+
+func (s *SQLCardLists) List(ctx context.Context, merchantID, list string) ([]CardListEntry, error) {
+	if list == "" {
+		return s.query(ctx, `WHERE merchant_id = ? ORDER BY created_at, fingerprint`, merchantID)
+	}
+	return s.query(ctx, `WHERE merchant_id = ? AND list = ? ORDER BY created_at, fingerprint`, merchantID, list)
+}
+
+func (s *SQLCardLists) query(ctx context.Context, where string, args ...any) ([]CardListEntry, error) {
+	rows, err := s.db.QueryContext(ctx, s.db.Rebind(`SELECT merchant_id, fingerprint, list, reason, created_at
+		FROM card_list_entries `+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []CardListEntry{}
+	for rows.Next() {
+		var e CardListEntry
+		if err := rows.Scan(&e.MerchantID, &e.Fingerprint, &e.List, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// WithCardLists keeps card lists in lists instead of in memory
+func WithCardLists(lists CardLists) ClientOption {
+	return func(c *Client) {
+		c.cardLists = lists
+	}
+}
+
+// CardLists returns the merchants' card lists
+func (c *Client) CardLists() CardLists {
+	return c.cardLists
+}
+
+// CardFingerprint returns the fingerprint of a card number, or "" when
+// CARD_FINGERPRINT_SALT is not set or there is no number
+func (c *Client) CardFingerprint(number string) string {
+	if c.cfg.CardFingerprintSalt == "" || bins.Digits(number) == "" {
+		return ""
+	}
+	return CardFingerprint(c.cfg.CardFingerprintSalt, number)
+}
+
+// screenCard checks a fingerprinted card against the lists of the merchant
+// on ctx. A blocked card is refused with card_blocked; an allowed one is
+// only counted and still goes through the prepaid and verification checks.
+// Lists that cannot be read are logged and let the payment through, so a
+// database outage does not stop card payments.
+func (c *Client) screenCard(ctx context.Context, fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+	merchantID := config.DefaultMerchantID
+	if merchant, ok := MerchantFromContext(ctx); ok {
+		merchantID = merchant.ID
+	}
+
+	entry, err := c.cardLists.Get(ctx, merchantID, fingerprint)
+	if errors.Is(err, ErrCardListEntryNotFound) {
+		return nil
+	}
+	if err != nil {
+		logctx.From(ctx).WithError(err).Error("Failed to read card lists, not screening the card")
+		return nil
+	}
+
+	metrics.RecordCardListHit(logctx.Merchant(ctx), entry.List)
+	if entry.List == CardListBlock {
+		logctx.From(ctx).WithField("fingerprint", fingerprint).Warn("Blocked card refused")
+		return NewNMIError(ErrCardBlocked, "card is blocked by the merchant", "")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFingerprintSalt = "0123456789abcdef"
+
+func TestCardFingerprint(t *testing.T) {
+	fingerprint := CardFingerprint(testFingerprintSalt, "4111111111111111")
+	assert.Len(t, fingerprint, 64)
+	assert.NotContains(t, fingerprint, "4111")
+	assert.Equal(t, fingerprint, CardFingerprint(testFingerprintSalt, "4111 1111-1111 1111"))
+	assert.NotEqual(t, fingerprint, CardFingerprint("another-salt-value", "4111111111111111"))
+
+	assert.Empty(t, NewClient(&config.Config{}).CardFingerprint("4111111111111111"), "fingerprints need a salt")
+}
+
+func testCardLists(t *testing.T, lists CardLists) {
+	ctx := context.Background()
+	at := time.Date(2026, 10, 16, 14, 0, 0, 0, time.UTC)
+	require.NoError(t, lists.Put(ctx, CardListEntry{MerchantID: "m1", Fingerprint: "fp2", List: CardListAllow, CreatedAt: at.Add(time.Hour)}))
+	require.NoError(t, lists.Put(ctx, CardListEntry{MerchantID: "m1", Fingerprint: "fp1", List: CardListAllow, CreatedAt: at}))
+	require.NoError(t, lists.Put(ctx, CardListEntry{MerchantID: "m2", Fingerprint: "fp1", List: CardListBlock, CreatedAt: at}))
+
+	// Blocking an allowed card moves it
+	require.NoError(t, lists.Put(ctx, CardListEntry{MerchantID: "m1", Fingerprint: "fp1", List: CardListBlock, Reason: "chargeback", CreatedAt: at}))
+	entry, err := lists.Get(ctx, "m1", "fp1")
+	require.NoError(t, err)
+	assert.Equal(t, CardListBlock, entry.List)
+	assert.Equal(t, "chargeback", entry.Reason)
+	assert.True(t, at.Equal(entry.CreatedAt))
+
+	all, err := lists.List(ctx, "m1", "")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "fp1", all[0].Fingerprint)
+	blocked, err := lists.List(ctx, "m1", CardListBlock)
+	require.NoError(t, err)
+	require.Len(t, blocked, 1)
+
+	require.NoError(t, lists.Delete(ctx, "m1", "fp1"))
+	_, err = lists.Get(ctx, "m1", "fp1")
+	assert.ErrorIs(t, err, ErrCardListEntryNotFound)
+	assert.ErrorIs(t, lists.Delete(ctx, "m1", "fp1"), ErrCardListEntryNotFound)
+	_, err = lists.Get(ctx, "m2", "fp1")
+	assert.NoError(t, err, "lists are per merchant")
+}
+
+func TestMemoryCardLists(t *testing.T) {
+	testCardLists(t, NewMemoryCardLists())
+}
+
+func TestSQLCardLists(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	lists, err := NewSQLCardLists(ctx, database)
+	require.NoError(t, err)
+	testCardLists(t, lists)
+}
+
+func TestProcessPaymentScreensCardLists(t *testing.T) {
+	var types []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		types = append(types, r.PostForm.Get("type"))
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=900&avsresponse=N&cvvresponse=M&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL, CardFingerprintSalt: testFingerprintSalt})
+	merchant := config.Merchant{ID: "m1", Verification: config.VerificationPolicy{Rules: []config.VerificationRule{{Name: "avs", AVS: []string{"N"}}}}}
+	ctx := WithMerchant(context.Background(), merchant)
+	req := PaymentRequest{APIKey: "key", Amount: "20.00", Type: "sale", CreditCard: "4111111111111111", ExpDate: "1230", CVV: "123"}
+	fingerprint := CardFingerprint(testFingerprintSalt, req.CreditCard)
+
+	require.NoError(t, client.CardLists().Put(ctx, CardListEntry{MerchantID: "m1", Fingerprint: fingerprint, List: CardListBlock}))
+	_, err := client.ProcessPayment(ctx, req)
+	var nmiErr *NMIError
+	require.ErrorAs(t, err, &nmiErr)
+	assert.Equal(t, ErrCardBlocked, nmiErr.Code)
+	assert.Equal(t, http.StatusPaymentRequired, HTTPStatus(err))
+	assert.Empty(t, types, "blocked cards never reach the gateway")
+
+	// Other merchants still take the card
+	resp, err := client.ProcessPayment(WithMerchant(context.Background(), config.Merchant{ID: "m2"}), req)
+	require.NoError(t, err)
+	assert.Equal(t, fingerprint, resp.CardFingerprint)
+
+	// Allowed cards are still voided by the AVS rule
+	types = nil
+	require.NoError(t, client.CardLists().Put(ctx, CardListEntry{MerchantID: "m1", Fingerprint: fingerprint, List: CardListAllow}))
+	resp, err = client.ProcessPayment(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sale", "void"}, types)
+	require.NotNil(t, resp.Verification)
+	assert.Equal(t, VerificationVoided, resp.Verification.Decision)
+}
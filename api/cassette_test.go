@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"nmi-pay-int/cassette"
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Cassette tests replay gateway traffic from testdata/cassettes. To record
+// them again against the sandbox, run
+//
+//	NMI_CASSETTE=record NMI_SANDBOX_KEY=<key> go test ./api -run Cassette
+//
+// and review the cassette diff: card data and keys are masked, but response
+// shapes NMI changed show up there.
+func openCassette(t *testing.T, name string) (*Client, string) {
+	t.Helper()
+	apiKey := "cassette-key"
+	mode := cassette.ModeFromEnv()
+	if mode == cassette.ModeRecord {
+		apiKey = os.Getenv("NMI_SANDBOX_KEY")
+		if apiKey == "" {
+			t.Skip("NMI_SANDBOX_KEY is required to record cassettes")
+		}
+	}
+
+	tape, err := cassette.Open("testdata/cassettes/"+name+".json", mode, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, tape.Save())
+		assert.Empty(t, tape.Unplayed(), "the cassette holds calls the client no longer makes")
+	})
+
+	cfg := &config.Config{
+		APIBaseURL: "https://secure.nmi.com/api/transact.php",
+		QueryURL:   "https://secure.nmi.com/api/query.php",
+	}
+	return NewClient(cfg, WithTransport(tape)), apiKey
+}
+
+func TestCassetteSaleThenPartialRefund(t *testing.T) {
+	client, apiKey := openCassette(t, "sale_partial_refund")
+	ctx := context.Background()
+
+	sale, err := client.ProcessPayment(ctx, PaymentRequest{
+		APIKey:     apiKey,
+		Type:       "sale",
+		Amount:     "10.99",
+		CreditCard: "4111111111111111",
+		ExpDate:    "1230",
+		CVV:        "999",
+		OrderID:    "ORD-1001",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1", sale.Response)
+	require.NotEmpty(t, sale.TransactionID)
+
+	refund, err := client.ProcessRefund(ctx, RefundRequest{APIKey: apiKey, TransactionID: sale.TransactionID, Amount: "5.00"})
+	require.NoError(t, err)
+	assert.Equal(t, "1", refund.Response)
+	assert.NotEqual(t, sale.TransactionID, refund.TransactionID)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// MaxChargebackSearchDays bounds the date range of a chargeback search
+const MaxChargebackSearchDays = 180
+
+// Chargeback is a dispute the cardholder's issuer raised against a
+// transaction. NMI records it as a chargeback action on the disputed
+// transaction, with the amount taken back and the issuer's reason.
+type Chargeback struct {
+	// ID identifies the chargeback across searches: the transaction ID and
+	// the time NMI recorded the chargeback
+	ID             string    `json:"id"`
+	TransactionID  string    `json:"transaction_id"`
+	Amount         string    `json:"amount"`
+	OriginalAmount string    `json:"original_amount,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	ReasonCode     string    `json:"reason_code,omitempty"`
+	ReceivedAt     time.Time `json:"received_at"`
+	OrderID        string    `json:"order_id,omitempty"`
+	CustomerID     string    `json:"customer_id,omitempty"`
+	CardType       string    `json:"card_type,omitempty"`
+	MaskedNumber   string    `json:"masked_number,omitempty"`
+}
+
+// GetChargebacks lists the chargebacks NMI recorded between start and end,
+// inclusive, oldest first
+func (c *Client) GetChargebacks(ctx context.Context, apiKey string, start, end time.Time) ([]Chargeback, error) {
+	if start.IsZero() || end.IsZero() {
+		return nil, NewNMIError(ErrInvalidRequest, "start_date and end_date are required", "")
+	}
+	if end.Before(start) {
+		return nil, NewNMIError(ErrInvalidRequest, "end_date must not be before start_date", "")
+	}
+	if end.Sub(start) > MaxChargebackSearchDays*24*time.Hour {
+		return nil, NewNMIError(ErrInvalidRequest, "a chargeback search covers at most 180 days", "")
+	}
+
+	chargebacks := []Chargeback{}
+	for page := 0; ; page++ {
+		records, err := c.SearchTransactions(ctx, TransactionSearch{
+			APIKey:     apiKey,
+			StartDate:  start,
+			EndDate:    end,
+			ActionType: "chargeback",
+			Page:       page,
+			Limit:      MaxSearchLimit,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			for _, action := range record.Actions {
+				if action.Type != "chargeback" || action.Date.Before(start) || action.Date.After(end) {
+					continue
+				}
+				chargeback := Chargeback{
+					ID:             record.TransactionID + "-" + action.Date.Format(queryDateLayout),
+					TransactionID:  record.TransactionID,
+					Amount:         action.Amount,
+					OriginalAmount: record.Amount,
+					Reason:         action.ResponseText,
+					ReasonCode:     action.ResponseCode,
+					ReceivedAt:     action.Date,
+					OrderID:        record.OrderID,
+					CustomerID:     record.CustomerID,
+				}
+				if record.Card != nil {
+					chargeback.CardType = record.Card.Type
+					chargeback.MaskedNumber = record.Card.MaskedNumber
+				}
+				chargebacks = append(chargebacks, chargeback)
+			}
+		}
+
+		if len(records) < MaxSearchLimit {
+			break
+		}
+	}
+
+	sort.Slice(chargebacks, func(i, j int) bool {
+		if !chargebacks[i].ReceivedAt.Equal(chargebacks[j].ReceivedAt) {
+			return chargebacks[i].ReceivedAt.Before(chargebacks[j].ReceivedAt)
+		}
+		return chargebacks[i].ID < chargebacks[j].ID
+	})
+	return chargebacks, nil
+}
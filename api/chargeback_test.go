@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const chargebackFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<transaction>
+		<transaction_id>2001</transaction_id>
+		<order_id>ORD-7</order_id>
+		<customerid>cust-1</customerid>
+		<cc_number>4xxxxxxxxxxx1111</cc_number>
+		<cc_type>visa</cc_type>
+		<action><amount>40.00</amount><action_type>sale</action_type><date>20260901120000</date><success>1</success></action>
+		<action><amount>40.00</amount><action_type>settle</action_type><date>20260902020000</date><success>1</success></action>
+		<action><amount>15.00</amount><action_type>chargeback</action_type><date>20261008143000</date><success>1</success><response_text>Merchandise not received</response_text><response_code>13.1</response_code></action>
+	</transaction>
+	<transaction>
+		<transaction_id>2002</transaction_id>
+		<action><amount>9.00</amount><action_type>sale</action_type><date>20260920120000</date><success>1</success></action>
+		<action><amount>9.00</amount><action_type>chargeback</action_type><date>20261002090000</date><success>1</success><response_text>Fraud</response_text></action>
+	</transaction>
+</nm_response>`
+
+func TestGetChargebacks(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte(chargebackFixture))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 10, 15, 23, 59, 59, 0, time.UTC)
+
+	chargebacks, err := client.GetChargebacks(context.Background(), "key", start, end)
+	require.NoError(t, err)
+	assert.Equal(t, "chargeback", form.Get("action_type"))
+
+	require.Len(t, chargebacks, 2)
+	assert.Equal(t, "2002", chargebacks[0].TransactionID)
+	assert.Equal(t, Chargeback{
+		ID:             "2001-20261008143000",
+		TransactionID:  "2001",
+		Amount:         "15.00",
+		OriginalAmount: "40.00",
+		Reason:         "Merchandise not received",
+		ReasonCode:     "13.1",
+		ReceivedAt:     time.Date(2026, 10, 8, 14, 30, 0, 0, time.UTC),
+		OrderID:        "ORD-7",
+		CustomerID:     "cust-1",
+		CardType:       "visa",
+		MaskedNumber:   "4xxxxxxxxxxx1111",
+	}, chargebacks[1])
+
+	_, err = client.GetChargebacks(context.Background(), "key", start, start.AddDate(1, 0, 0))
+	assert.ErrorContains(t, err, "at most 180 days")
+}
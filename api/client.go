@@ -0,0 +1,307 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"nmi-pay-int/bins"
+	"nmi-pay-int/config"
+	"nmi-pay-int/fallback"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Client sends requests to the NMI gateway. Point it at the sandbox, a mock
+// server or a proxy by changing API_URL and API_QUERY_URL in the config.
+type Client struct {
+	transactURL string
+	queryURL    string
+	deviceURL   string
+	httpClient  *http.Client
+
+	// cfg supplies the cap on a single gateway call, which can change on
+	// reload; see GatewayBudget
+	cfg *config.Config
+
+	// responseFields are extra NMI response fields copied into API responses
+	responseFields []string
+
+	// idempotency remembers idempotency keys of processed payments
+	idempotency IdempotencyStore
+
+	// hedge duplicates slow Query API reads; nil when hedging is off
+	hedge *hedger
+
+	// plans holds the subscription plans recurring payments are created on
+	plans PlanRepository
+
+	// refunds records partial refunds so they cannot add up past the sale
+	refunds     RefundLedger
+	refundLocks *refundLocks
+
+	// breaker trips after repeated gateway failures; GatewayBreaker unless
+	// the client is isolated
+	breaker *CircuitBreaker
+	// isolated clients keep failures and throttling to themselves, so a
+	// shadow endpoint cannot trip the breaker or back off live requests
+	isolated bool
+
+	// shadow replays sampled reads against a secondary endpoint; nil when
+	// shadow traffic is off
+	shadow *shadow
+
+	// bins identifies cards by BIN; nil leaves only the brand known
+	bins *bins.Table
+
+	// cardLists holds the cards each merchant blocked or allowed
+	cardLists CardLists
+
+	// audit records money-moving gateway calls and plan changes
+	audit AuditLog
+}
+
+// ClientOption customizes a Client built by NewClient
+type ClientOption func(*Client)
+
+// WithPlanRepository stores plans in repo instead of in memory. Changes
+// made through the client are audited either way.
+func WithPlanRepository(repo PlanRepository) ClientOption {
+	return func(c *Client) {
+		c.plans = &auditedPlans{PlanRepository: repo, client: c}
+	}
+}
+
+// WithRefundLedger records refunds in ledger instead of in memory
+func WithRefundLedger(ledger RefundLedger) ClientOption {
+	return func(c *Client) {
+		c.refunds = ledger
+	}
+}
+
+// WithTransport sends gateway requests through rt instead of the pooled
+// transport, for example a cassette replaying recorded responses in tests
+func WithTransport(rt http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.httpClient.Transport = rt
+	}
+}
+
+// NewClient creates a gateway client from the service configuration
+func NewClient(cfg *config.Config, opts ...ClientOption) *Client {
+	c := &Client{
+		transactURL: cfg.APIBaseURL,
+		queryURL:    cfg.QueryURL,
+		deviceURL:   cfg.DeviceAPIURL,
+		// Each call's deadline comes from withGatewayDeadline rather than
+		// http.Client.Timeout, so a reloaded GATEWAY_TIMEOUT takes effect
+		httpClient: &http.Client{
+			Transport: newGatewayTransport(cfg),
+		},
+		cfg:            cfg,
+		responseFields: cfg.ResponseFieldAllowlist,
+		idempotency:    newIdempotencyStore(cfg),
+		refunds:        NewMemoryRefundLedger(),
+		refundLocks:    newRefundLocks(),
+		cardLists:      NewMemoryCardLists(),
+		audit:          NewMemoryAuditLog(DefaultMemoryAuditLogSize),
+		breaker:        GatewayBreaker,
+	}
+	c.plans = &auditedPlans{PlanRepository: NewMemoryPlanRepository(), client: c}
+	if cfg.QueryHedgeLimit > 0 {
+		c.hedge = newHedger(cfg.QueryHedgeLimit)
+	}
+	if cfg.ShadowSampleRate > 0 {
+		c.shadow = newShadow(cfg)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Plans returns the repository the client resolves plans from
+func (c *Client) Plans() PlanRepository {
+	return c.plans
+}
+
+// newIdempotencyStore builds the store selected by IDEMPOTENCY_STORE
+func newIdempotencyStore(cfg *config.Config) IdempotencyStore {
+	if cfg.IdempotencyStore == config.StoreRedis {
+		store, err := NewRedisIdempotencyStore(cfg.RedisURL, cfg.IdempotencyTTL)
+		if err == nil {
+			local := NewMemoryIdempotencyStore(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys)
+			return NewFallbackIdempotencyStore(store, local, fallback.NewDependency("redis_idempotency", 0))
+		}
+		metrics.LogError(context.Background(), fmt.Errorf("invalid REDIS_URL, using the in-memory idempotency store: %v", err))
+	}
+	return NewMemoryIdempotencyStore(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys)
+}
+
+// sendRequest posts form data to NMI's transaction endpoint
+func (c *Client) sendRequest(ctx context.Context, formData url.Values) (string, error) {
+	body, err := c.traceGateway(ctx, "nmi.transact", formData, func(ctx context.Context) (string, error) {
+		return c.sendRequestTo(ctx, c.transactURL, formData)
+	})
+	c.auditGatewayCall(ctx, formData, body, err)
+	return body, err
+}
+
+// traceGateway runs a gateway call inside a client span recording the
+// transaction type, response code and gateway latency, and records the
+// latency in nmi_gateway_request_duration_seconds
+func (c *Client) traceGateway(ctx context.Context, name string, formData url.Values, send func(context.Context) (string, error)) (string, error) {
+	txType := transactionType(formData)
+	ctx, span := tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("nmi.transaction_type", txType)),
+	)
+
+	start := time.Now()
+	body, err := send(ctx)
+	latency := time.Since(start)
+	// Shadow endpoints are left out so their latency does not blur NMI's
+	if !c.isolated {
+		metrics.RecordGatewayLatency(txType, gatewayOutcome(body, err), latency.Seconds())
+	}
+	span.SetAttributes(attribute.Int64("nmi.gateway_latency_ms", latency.Milliseconds()))
+	if code := ExtractValue(body, "response_code"); code != "" {
+		span.SetAttributes(attribute.String("nmi.response_code", code))
+	}
+	tracing.End(span, err)
+	return body, err
+}
+
+// gatewayOutcome classifies a gateway call for the latency histogram: the
+// NMI result for transactions, the error code when the call failed, and ok
+// for answers without a result such as Query API reports
+func gatewayOutcome(body string, err error) string {
+	if err != nil {
+		var nmiErr *NMIError
+		if errors.As(err, &nmiErr) {
+			return nmiErr.Code
+		}
+		return "error"
+	}
+	switch ExtractValue(body, "response") {
+	case "1":
+		return "approved"
+	case "2":
+		return "declined"
+	case "3":
+		return "error"
+	}
+	return "ok"
+}
+
+// transactionType names the gateway operation a form performs
+func transactionType(formData url.Values) string {
+	for _, field := range []string{"type", "recurring", "customer_vault", "report_type"} {
+		if value := formData.Get(field); value != "" {
+			return value
+		}
+	}
+	return "query"
+}
+
+// sendRequestTo posts form data to the given NMI endpoint
+func (c *Client) sendRequestTo(ctx context.Context, endpoint string, formData url.Values) (string, error) {
+	body, _, err := c.roundTrip(ctx, func(gatewayCtx context.Context) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(gatewayCtx, "POST",
+			endpoint,
+			bytes.NewBufferString(formData.Encode()))
+		if err != nil {
+			return nil, err
+		}
+
+		httpReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		logOutboundForm(ctx, endpoint, formData)
+		return httpReq, nil
+	})
+	return body, err
+}
+
+// roundTrip sends the request built by newRequest to NMI through the
+// circuit breaker and throttle, within the caller's deadline. It returns the
+// body and status of any answer below 500; the caller decides what a 4xx
+// means for its API.
+func (c *Client) roundTrip(ctx context.Context, newRequest func(gatewayCtx context.Context) (*http.Request, error)) (string, int, error) {
+	if !c.breaker.Allow() {
+		return "", 0, NewNMIError(ErrCircuitOpen, "gateway circuit breaker is open", "")
+	}
+	// Answers that say nothing about the gateway's health, like a throttle
+	// or a caller giving up, hand a half-open trial to the next request
+	defer c.breaker.Release()
+
+	// Honor the backoff NMI asked for instead of piling on more requests
+	if remaining := throttleRemaining(); remaining > 0 {
+		return "", 0, newThrottledError(remaining, "")
+	}
+
+	// Fit the gateway call inside whatever time the caller has left
+	gatewayCtx, cancel, err := withGatewayDeadline(ctx, gatewayTimeout(c.cfg))
+	if err != nil {
+		return "", 0, err
+	}
+	defer cancel()
+
+	httpReq, err := newRequest(gatewayCtx)
+	if err != nil {
+		return "", 0, NewNMIError(ErrProcessingError, "failed to create request", "")
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		// A caller giving up says nothing about the gateway's health
+		if ctx.Err() != nil {
+			return "", 0, NewNMIError(ErrDeadlineExceeded, "request cancelled while waiting for the gateway: "+ctx.Err().Error(), "")
+		}
+		c.breaker.RecordFailure()
+		return "", 0, NewNMIError(ErrNetworkError, "network error: "+err.Error(), "")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.backOff(parseRetryAfter(resp.Header.Get("Retry-After")))
+		return "", resp.StatusCode, newThrottledError(throttleRemaining(), "")
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		c.breaker.RecordFailure()
+		return "", resp.StatusCode, NewNMIError(ErrNetworkError, "gateway returned "+resp.Status, "")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.breaker.RecordFailure()
+		return "", resp.StatusCode, NewNMIError(ErrProcessingError, "failed to read response", "")
+	}
+
+	if isThrottleResponse(resp.StatusCode, string(body)) {
+		c.backOff(parseRetryAfter(resp.Header.Get("Retry-After")))
+		return "", resp.StatusCode, newThrottledError(throttleRemaining(), string(body))
+	}
+
+	c.breaker.RecordSuccess()
+	if !c.isolated {
+		clearThrottle()
+	}
+	return string(body), resp.StatusCode, nil
+}
+
+// backOff honors NMI's request to slow down. Isolated clients only fail the
+// current request.
+func (c *Client) backOff(backoff time.Duration) {
+	if !c.isolated {
+		recordThrottle(backoff)
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientUsesConfiguredGateway(t *testing.T) {
+	var received http.Header
+	var form map[string][]string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		received = r.Header
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=1234&type=void&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	resp, err := client.VoidTransaction(context.Background(), VoidRequest{APIKey: "test_key", TransactionID: "1234"})
+	require.NoError(t, err)
+	assert.Equal(t, "1", resp.Response)
+	assert.Equal(t, "1234", resp.TransactionID)
+
+	assert.Equal(t, "application/x-www-form-urlencoded", received.Get("Content-Type"))
+	assert.Equal(t, []string{"void"}, form["type"])
+	assert.Equal(t, []string{"1234"}, form["transactionid"])
+}
+
+func TestPassthroughFields(t *testing.T) {
+	client := NewClient(&config.Config{ResponseFieldAllowlist: []string{"processor_id", "batch_id", "ccnumber"}})
+
+	values, err := url.ParseQuery("response=1&processor_id=ccprocessora&ccnumber=4111111111111111&unlisted=x")
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"processor_id": "ccprocessora"}, client.passthroughFields(values))
+	assert.Nil(t, NewClient(&config.Config{}).passthroughFields(values))
+}
+
+func TestClientReusesGatewayConnections(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=1234&type=void&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL, GatewayTimeout: 5 * time.Second})
+	assert.Equal(t, 5*time.Second, gatewayTimeout(client.cfg))
+
+	reused := testutil.ToFloat64(metrics.GatewayConnections.WithLabelValues("true"))
+	for i := 0; i < 3; i++ {
+		_, err := client.VoidTransaction(context.Background(), VoidRequest{APIKey: "test_key", TransactionID: "1234"})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, reused+2, testutil.ToFloat64(metrics.GatewayConnections.WithLabelValues("true")))
+}
+
+func TestGatewayLatencyRecorded(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response=3&responsetext=Authentication Failed&response_code=300"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	series := testutil.CollectAndCount(metrics.GatewayRequestDuration)
+	client.ValidateCredentials(context.Background(), "bad_key")
+	assert.Equal(t, series+1, testutil.CollectAndCount(metrics.GatewayRequestDuration), "a validate/error series is added")
+}
+
+func TestGatewayOutcome(t *testing.T) {
+	assert.Equal(t, "approved", gatewayOutcome("response=1&responsetext=SUCCESS", nil))
+	assert.Equal(t, "declined", gatewayOutcome("response=2&responsetext=DECLINE", nil))
+	assert.Equal(t, "error", gatewayOutcome("response=3&responsetext=Invalid", nil))
+	assert.Equal(t, "ok", gatewayOutcome("<nm_response></nm_response>", nil))
+	assert.Equal(t, ErrCircuitOpen, gatewayOutcome("", NewNMIError(ErrCircuitOpen, "open", "")))
+	assert.Equal(t, "error", gatewayOutcome("", context.Canceled))
+}
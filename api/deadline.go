@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// MaxGatewayTimeout caps a single NMI call when the caller has no deadline
+	MaxGatewayTimeout = 20 * time.Second
+
+	// gatewaySafetyMargin is reserved out of the caller's deadline so there
+	// is still time to write a response after the gateway call gives up
+	gatewaySafetyMargin = 2 * time.Second
+)
+
+// GatewayBudget returns how long a gateway call may take within ctx: the
+// time left before the caller's deadline minus a safety margin, capped at
+// MaxGatewayTimeout
+func GatewayBudget(ctx context.Context) time.Duration {
+	return gatewayBudget(ctx, MaxGatewayTimeout)
+}
+
+// gatewayBudget is GatewayBudget with the cap set by GATEWAY_TIMEOUT
+func gatewayBudget(ctx context.Context, limit time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return limit
+	}
+
+	budget := time.Until(deadline) - gatewaySafetyMargin
+	if budget > limit {
+		return limit
+	}
+	return budget
+}
+
+// withGatewayDeadline derives the context for a single gateway call, failing
+// fast when the caller has already been cancelled or has no time left
+func withGatewayDeadline(ctx context.Context, limit time.Duration) (context.Context, context.CancelFunc, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, NewNMIError(ErrDeadlineExceeded, "request cancelled before contacting the gateway: "+err.Error(), "")
+	}
+
+	budget := gatewayBudget(ctx, limit)
+	if budget <= 0 {
+		return nil, nil, NewNMIError(ErrDeadlineExceeded, "not enough time left to contact the gateway", "")
+	}
+
+	gatewayCtx, cancel := context.WithTimeout(ctx, budget)
+	return gatewayCtx, cancel, nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatewayBudget(t *testing.T) {
+	assert.Equal(t, MaxGatewayTimeout, GatewayBudget(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	budget := GatewayBudget(ctx)
+	assert.True(t, budget <= 10*time.Second-gatewaySafetyMargin)
+	assert.True(t, budget > 7*time.Second)
+
+	long, cancelLong := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelLong()
+	assert.Equal(t, MaxGatewayTimeout, GatewayBudget(long))
+}
+
+func TestSendRequestContextCancellation(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: slow.URL, QueryURL: slow.URL})
+
+	assertDeadlineError := func(t *testing.T, err error) {
+		require.Error(t, err)
+		nmiErr, ok := err.(*NMIError)
+		require.True(t, ok)
+		assert.Equal(t, ErrDeadlineExceeded, nmiErr.Code)
+	}
+
+	t.Run("Already Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := client.sendRequest(ctx, url.Values{})
+		assertDeadlineError(t, err)
+	})
+
+	t.Run("Budget Exhausted", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), gatewaySafetyMargin/2)
+		defer cancel()
+
+		_, err := client.sendRequest(ctx, url.Values{})
+		assertDeadlineError(t, err)
+	})
+
+	t.Run("Cancelled In Flight", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := client.sendRequest(ctx, url.Values{})
+		assertDeadlineError(t, err)
+		assert.Less(t, time.Since(start), 2*time.Second)
+		assert.Equal(t, 0, GatewayBreaker.Status().Failures)
+	})
+
+	t.Run("Gateway Slower Than Budget", func(t *testing.T) {
+		defer GatewayBreaker.ForceClose()
+
+		ctx, cancel := context.WithTimeout(context.Background(), gatewaySafetyMargin+300*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := client.sendRequest(ctx, url.Values{})
+		require.Error(t, err)
+		assert.Equal(t, ErrNetworkError, err.(*NMIError).Code)
+		assert.Less(t, time.Since(start), gatewaySafetyMargin)
+		assert.Equal(t, 1, GatewayBreaker.Status().Failures)
+	})
+}
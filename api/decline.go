@@ -0,0 +1,237 @@
+package api
+
+import (
+	"strings"
+)
+
+// DeclineReason is a stable name for why the gateway refused a transaction,
+// derived from NMI's free-form responsetext. Processors word the same
+// outcome differently and reword it over time; clients should branch on the
+// reason rather than the text.
+type DeclineReason string
+
+// Decline reasons
+const (
+	DeclineGeneric              DeclineReason = "declined"
+	DeclineInsufficientFunds    DeclineReason = "insufficient_funds"
+	DeclineLimitExceeded        DeclineReason = "limit_exceeded"
+	DeclineExpiredCard          DeclineReason = "expired_card"
+	DeclineInvalidCardNumber    DeclineReason = "invalid_card_number"
+	DeclineInvalidExpiration    DeclineReason = "invalid_expiration"
+	DeclineCVVMismatch          DeclineReason = "cvv_mismatch"
+	DeclineAVSMismatch          DeclineReason = "avs_mismatch"
+	DeclinePickUpCard           DeclineReason = "pick_up_card"
+	DeclineCallIssuer           DeclineReason = "call_issuer"
+	DeclineNotPermitted         DeclineReason = "not_permitted"
+	DeclineSuspectedFraud       DeclineReason = "suspected_fraud"
+	DeclineDuplicate            DeclineReason = "duplicate_transaction"
+	DeclineInvalidAmount        DeclineReason = "invalid_amount"
+	DeclineAuthenticationFailed DeclineReason = "authentication_failed"
+	DeclineTransactionNotFound  DeclineReason = "transaction_not_found"
+	DeclineIssuerUnavailable    DeclineReason = "issuer_unavailable"
+	DeclineUnknown              DeclineReason = "unknown"
+)
+
+// DeclineReasons lists every reason NormalizeResponseText can return
+var DeclineReasons = []DeclineReason{
+	DeclineGeneric, DeclineInsufficientFunds, DeclineLimitExceeded, DeclineExpiredCard,
+	DeclineInvalidCardNumber, DeclineInvalidExpiration, DeclineCVVMismatch, DeclineAVSMismatch,
+	DeclinePickUpCard, DeclineCallIssuer, DeclineNotPermitted, DeclineSuspectedFraud,
+	DeclineDuplicate, DeclineInvalidAmount, DeclineAuthenticationFailed, DeclineTransactionNotFound,
+	DeclineIssuerUnavailable, DeclineUnknown,
+}
+
+// declineRule maps responsetext containing any of its phrases to a reason
+type declineRule struct {
+	reason  DeclineReason
+	phrases []string
+}
+
+// declineRules is checked in order against the lower-cased responsetext.
+// Specific outcomes come first, so "Declined - Insufficient funds" is
+// insufficient_funds rather than declined, and "Invalid card security code"
+// is cvv_mismatch rather than invalid_card_number.
+var declineRules = []declineRule{
+	{DeclineDuplicate, []string{"duplicate"}},
+	{DeclineInsufficientFunds, []string{"insufficient fund", "insuff fund", "not sufficient funds"}},
+	{DeclineLimitExceeded, []string{"exceeds withdrawal", "exceeds limit", "over limit", "exceeds approval amount", "activity limit", "withdrawal limit"}},
+	{DeclineExpiredCard, []string{"expired card", "card expired", "card is expired", "expired"}},
+	{DeclineInvalidExpiration, []string{"invalid exp", "expiration date", "bad exp"}},
+	{DeclineCVVMismatch, []string{"cvv", "cvc", "security code"}},
+	{DeclineInvalidCardNumber, []string{"invalid card", "invalid credit card", "invalid account", "no such issuer", "no such card issuer", "card number", "invalid ccnumber"}},
+	{DeclineAVSMismatch, []string{"avs", "address verification", "address mismatch"}},
+	{DeclinePickUpCard, []string{"pick up", "pickup", "lost card", "stolen card", "lost/stolen", "restricted card"}},
+	{DeclineSuspectedFraud, []string{"fraud", "security violation", "suspected"}},
+	{DeclineCallIssuer, []string{"call issuer", "call center", "refer to issuer", "referral", "call auth"}},
+	{DeclineNotPermitted, []string{"not permitted", "not allowed", "not supported", "transaction not allowed"}},
+	{DeclineInvalidAmount, []string{"invalid amount", "amount must", "amount field"}},
+	{DeclineAuthenticationFailed, []string{"authentication failed", "security key", "invalid username", "invalid login"}},
+	{DeclineTransactionNotFound, []string{"transaction not found", "no transactions", "transaction id not found", "invalid transaction id"}},
+	{DeclineIssuerUnavailable, []string{"issuer unavailable", "unavailable", "timeout", "timed out", "try again", "system error", "host error"}},
+	{DeclineGeneric, []string{"do not honor", "do not honour", "declined", "decline", "refused", "rejected", "not approved"}},
+}
+
+// approvalTexts are responsetexts NMI sends with approved actions
+var approvalTexts = []string{"success", "approved", "approval", "accepted"}
+
+// NormalizeResponseText maps NMI's responsetext to a DeclineReason. It
+// returns "" for approvals. Text no rule recognizes falls back on the
+// response code: NMI's 2xx codes are declines, anything else is unknown.
+func NormalizeResponseText(responseText, responseCode string) DeclineReason {
+	text := strings.ToLower(strings.TrimSpace(responseText))
+	// Duplicate notices end in "REFID:<id>"; the ID matches nothing useful
+	if i := strings.Index(text, "refid:"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+
+	for _, approval := range approvalTexts {
+		if strings.HasPrefix(text, approval) {
+			return ""
+		}
+	}
+	for _, rule := range declineRules {
+		for _, phrase := range rule.phrases {
+			if strings.Contains(text, phrase) {
+				return rule.reason
+			}
+		}
+	}
+	if strings.HasPrefix(responseCode, "2") && len(responseCode) == 3 {
+		return DeclineGeneric
+	}
+	return DeclineUnknown
+}
+
+// DeclineCategory groups a refusal by what the merchant should do about it,
+// chiefly whether retrying the same card can succeed. It comes from NMI's
+// response_code, refined by the responsetext where the code is generic.
+type DeclineCategory string
+
+// Decline categories
+const (
+	// Soft declines: the same card may be approved if retried later
+	CategoryInsufficientFunds DeclineCategory = "insufficient_funds"
+	CategoryLimitExceeded     DeclineCategory = "limit_exceeded"
+	CategoryDoNotHonor        DeclineCategory = "do_not_honor"
+	CategoryTryAgainLater     DeclineCategory = "try_again_later"
+	CategoryProcessorError    DeclineCategory = "processor_error"
+
+	// Hard declines: the card or request must change before trying again
+	CategoryExpiredCard           DeclineCategory = "expired_card"
+	CategoryInvalidCard           DeclineCategory = "invalid_card"
+	CategoryCVVFailure            DeclineCategory = "cvv_failure"
+	CategoryAVSFailure            DeclineCategory = "avs_failure"
+	CategoryLostOrStolen          DeclineCategory = "lost_or_stolen"
+	CategoryFraudHold             DeclineCategory = "fraud_hold"
+	CategoryNotPermitted          DeclineCategory = "not_permitted"
+	CategoryCallIssuer            DeclineCategory = "call_issuer"
+	CategoryStopRecurring         DeclineCategory = "stop_recurring"
+	CategoryUpdateCard            DeclineCategory = "update_card"
+	CategoryDuplicate             DeclineCategory = "duplicate"
+	CategoryInvalidRequest        DeclineCategory = "invalid_request"
+	CategoryGatewayRejected       DeclineCategory = "gateway_rejected"
+	CategoryMerchantConfiguration DeclineCategory = "merchant_configuration"
+	CategoryUnknown               DeclineCategory = "unknown"
+)
+
+// DeclineCategories lists every category CategorizeDecline can return
+var DeclineCategories = []DeclineCategory{
+	CategoryInsufficientFunds, CategoryLimitExceeded, CategoryDoNotHonor, CategoryTryAgainLater,
+	CategoryProcessorError, CategoryExpiredCard, CategoryInvalidCard, CategoryCVVFailure,
+	CategoryAVSFailure, CategoryLostOrStolen, CategoryFraudHold, CategoryNotPermitted,
+	CategoryCallIssuer, CategoryStopRecurring, CategoryUpdateCard, CategoryDuplicate,
+	CategoryInvalidRequest, CategoryGatewayRejected, CategoryMerchantConfiguration, CategoryUnknown,
+}
+
+// Retryable reports whether the same transaction may be approved if it is
+// retried later. Card networks penalize retrying hard declines, and a card
+// reported lost, stolen or with recurring billing revoked must never be
+// charged again.
+func (c DeclineCategory) Retryable() bool {
+	switch c {
+	case CategoryInsufficientFunds, CategoryLimitExceeded, CategoryDoNotHonor,
+		CategoryTryAgainLater, CategoryProcessorError:
+		return true
+	}
+	return false
+}
+
+// responseCodeCategories maps NMI's response codes to categories. 200
+// (declined) and 300 (rejected by the gateway) are generic; the
+// responsetext decides those.
+var responseCodeCategories = map[string]DeclineCategory{
+	"201": CategoryDoNotHonor,
+	"202": CategoryInsufficientFunds,
+	"203": CategoryLimitExceeded,
+	"204": CategoryNotPermitted,
+	"220": CategoryInvalidCard,
+	"221": CategoryInvalidCard,
+	"222": CategoryInvalidCard,
+	"223": CategoryExpiredCard,
+	"224": CategoryInvalidCard,
+	"225": CategoryCVVFailure,
+	"226": CategoryInvalidCard,
+	"240": CategoryCallIssuer,
+	"250": CategoryLostOrStolen,
+	"251": CategoryLostOrStolen,
+	"252": CategoryLostOrStolen,
+	"253": CategoryFraudHold,
+	"260": CategoryCallIssuer,
+	"261": CategoryStopRecurring,
+	"262": CategoryStopRecurring,
+	"263": CategoryUpdateCard,
+	"264": CategoryTryAgainLater,
+	"400": CategoryProcessorError,
+	"410": CategoryMerchantConfiguration,
+	"411": CategoryMerchantConfiguration,
+	"420": CategoryTryAgainLater,
+	"421": CategoryTryAgainLater,
+	"430": CategoryDuplicate,
+	"440": CategoryProcessorError,
+	"441": CategoryProcessorError,
+	"460": CategoryNotPermitted,
+	"461": CategoryNotPermitted,
+}
+
+// reasonCategories maps the reason read from a generic code's responsetext
+// to a category
+var reasonCategories = map[DeclineReason]DeclineCategory{
+	DeclineInsufficientFunds:    CategoryInsufficientFunds,
+	DeclineLimitExceeded:        CategoryLimitExceeded,
+	DeclineExpiredCard:          CategoryExpiredCard,
+	DeclineInvalidCardNumber:    CategoryInvalidCard,
+	DeclineInvalidExpiration:    CategoryInvalidCard,
+	DeclineCVVMismatch:          CategoryCVVFailure,
+	DeclineAVSMismatch:          CategoryAVSFailure,
+	DeclinePickUpCard:           CategoryLostOrStolen,
+	DeclineSuspectedFraud:       CategoryFraudHold,
+	DeclineCallIssuer:           CategoryCallIssuer,
+	DeclineNotPermitted:         CategoryNotPermitted,
+	DeclineDuplicate:            CategoryDuplicate,
+	DeclineInvalidAmount:        CategoryInvalidRequest,
+	DeclineTransactionNotFound:  CategoryInvalidRequest,
+	DeclineAuthenticationFailed: CategoryMerchantConfiguration,
+	DeclineIssuerUnavailable:    CategoryTryAgainLater,
+}
+
+// CategorizeDecline returns the category of a refused transaction from its
+// response code and the reason NormalizeResponseText read from its text. It
+// returns "" for approvals.
+func CategorizeDecline(responseCode string, reason DeclineReason) DeclineCategory {
+	if responseCode == "100" {
+		return ""
+	}
+	if category, ok := responseCodeCategories[responseCode]; ok {
+		return category
+	}
+	if category, ok := reasonCategories[reason]; ok {
+		return category
+	}
+	switch {
+	case responseCode == "300":
+		return CategoryGatewayRejected
+	case strings.HasPrefix(responseCode, "2") && len(responseCode) == 3:
+		return CategoryDoNotHonor
+	}
+	return CategoryUnknown
+}
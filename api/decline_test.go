@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeResponseText(t *testing.T) {
+	tests := []struct {
+		text   string
+		code   string
+		reason DeclineReason
+	}{
+		{"SUCCESS", "100", ""},
+		{"Approved", "100", ""},
+		{"DECLINE", "200", DeclineGeneric},
+		{"Do Not Honor", "200", DeclineGeneric},
+		{"Duplicate transaction REFID:3162835117", "300", DeclineDuplicate},
+		{"Declined - Insufficient funds", "202", DeclineInsufficientFunds},
+		{"Expired Card", "223", DeclineExpiredCard},
+		{"Invalid Credit Card Number REFID:123", "300", DeclineInvalidCardNumber},
+		{"CVV2/CVC2 Mismatch", "225", DeclineCVVMismatch},
+		{"AVS REJECTED", "300", DeclineAVSMismatch},
+		{"Pick Up Card - Stolen", "250", DeclinePickUpCard},
+		{"Call Issuer for further information", "201", DeclineCallIssuer},
+		{"Authentication Failed", "300", DeclineAuthenticationFailed},
+		{"Issuer Unavailable - Try Again", "460", DeclineIssuerUnavailable},
+		{"Trans denied code 05", "200", DeclineGeneric},
+		{"Something new", "300", DeclineUnknown},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.reason, NormalizeResponseText(tt.text, tt.code), tt.text)
+	}
+}
+
+func TestParseNMIResponseSetsDeclineReason(t *testing.T) {
+	_, err := ParseNMIResponse("response=2&responsetext=Insufficient+Funds&response_code=202")
+	nmiErr, ok := err.(*NMIError)
+	if assert.True(t, ok) {
+		assert.Equal(t, DeclineInsufficientFunds, nmiErr.DeclineReason)
+	}
+}
+
+func TestCategorizeDecline(t *testing.T) {
+	tests := []struct {
+		text     string
+		code     string
+		category DeclineCategory
+	}{
+		{"SUCCESS", "100", ""},
+		{"Insufficient funds", "202", CategoryInsufficientFunds},
+		{"Do Not Honor", "201", CategoryDoNotHonor},
+		{"Expired Card", "223", CategoryExpiredCard},
+		{"Invalid Card Security Code", "225", CategoryCVVFailure},
+		{"Fraudulent Card", "253", CategoryFraudHold},
+		{"Declined-Stop all recurring payments", "261", CategoryStopRecurring},
+		{"Communication error with issuer", "421", CategoryTryAgainLater},
+		// Generic codes are refined by the responsetext
+		{"AVS REJECTED", "200", CategoryAVSFailure},
+		{"DECLINE", "200", CategoryDoNotHonor},
+		{"Transaction held by fraud filters", "300", CategoryFraudHold},
+		{"Duplicate transaction REFID:3165548772", "300", CategoryDuplicate},
+		{"Only transactions pending settlement can be voided", "300", CategoryGatewayRejected},
+		{"Something new", "999", CategoryUnknown},
+	}
+	for _, tt := range tests {
+		reason := NormalizeResponseText(tt.text, tt.code)
+		assert.Equal(t, tt.category, CategorizeDecline(tt.code, reason), tt.text)
+	}
+
+	assert.True(t, CategoryInsufficientFunds.Retryable())
+	assert.True(t, CategoryTryAgainLater.Retryable())
+	assert.False(t, CategoryLostOrStolen.Retryable())
+	assert.False(t, CategoryStopRecurring.Retryable())
+	assert.False(t, CategoryExpiredCard.Retryable())
+}
+
+func TestGatewayResultsCounted(t *testing.T) {
+	answer := "response=2&responsetext=Insufficient funds&response_code=202"
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(answer))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	req := PaymentRequest{Type: "auth", Amount: "12.00", CreditCard: "378282246310005", ExpDate: "1230", CVV: "1234"}
+	declined := metrics.GatewayResults.WithLabelValues("default", "auth", "202", "insufficient_funds", "amex")
+	approved := metrics.GatewayResults.WithLabelValues("default", "auth", "100", "approved", "amex")
+	before := testutil.ToFloat64(declined)
+
+	_, err := client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(declined))
+
+	answer = "response=1&responsetext=SUCCESS&transactionid=77&response_code=100"
+	before = testutil.ToFloat64(approved)
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(approved))
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Connection states of a payment device
+const (
+	DeviceOnline  = "online"
+	DeviceOffline = "offline"
+	// DeviceBusy is an online device showing a payment prompt
+	DeviceBusy = "busy"
+)
+
+// States of a payment sent to a device that has not produced a gateway
+// result
+const (
+	// TerminalPaymentPending is a payment the cardholder has not finished
+	TerminalPaymentPending = "pending"
+	// TerminalPaymentCancelled is a payment whose prompt was cancelled
+	TerminalPaymentCancelled = "cancelled"
+)
+
+// MaxDeviceWait caps how long ProcessTerminalPayment waits for the
+// cardholder before answering with a pending payment
+const MaxDeviceWait = 2 * time.Minute
+
+// Device is a card-present payment terminal registered with NMI's payment
+// device API
+type Device struct {
+	ID              string     `json:"terminal_id"`
+	Nickname        string     `json:"nickname,omitempty"`
+	SerialNumber    string     `json:"serial_number,omitempty"`
+	Model           string     `json:"model,omitempty"`
+	FirmwareVersion string     `json:"firmware_version,omitempty"`
+	Status          string     `json:"status"`
+	LastSeen        *time.Time `json:"last_seen,omitempty"`
+}
+
+// nmiDevice is a device as the payment device API describes it
+type nmiDevice struct {
+	POIDeviceID      string `json:"poiDeviceId"`
+	Nickname         string `json:"deviceNickname"`
+	SerialNumber     string `json:"serialNumber"`
+	Model            string `json:"model"`
+	FirmwareVersion  string `json:"firmwareVersion"`
+	ConnectionStatus string `json:"connectionStatus"`
+	LastConnectedAt  string `json:"lastConnectedAt"`
+}
+
+// device converts the API's description, treating an unknown connection
+// status as offline
+func (d nmiDevice) device() *Device {
+	device := &Device{
+		ID:              d.POIDeviceID,
+		Nickname:        d.Nickname,
+		SerialNumber:    d.SerialNumber,
+		Model:           d.Model,
+		FirmwareVersion: d.FirmwareVersion,
+		Status:          DeviceOffline,
+	}
+	switch status := strings.ToLower(d.ConnectionStatus); status {
+	case DeviceOnline, DeviceBusy:
+		device.Status = status
+	}
+	if seen, err := time.Parse(time.RFC3339, d.LastConnectedAt); err == nil {
+		device.LastSeen = &seen
+	}
+	return device
+}
+
+// nmiAsyncStatus is the progress of a payment sent to a device
+type nmiAsyncStatus struct {
+	// Status is pending, complete or cancelled
+	Status string `json:"status"`
+	// Response is the transaction's gateway response once it is complete,
+	// in the same format transact.php answers with
+	Response string `json:"response"`
+}
+
+// RegisterDevice pairs a terminal with the merchant account using the
+// registration code the terminal displays
+func (c *Client) RegisterDevice(ctx context.Context, apiKey, registrationCode, nickname string) (*Device, error) {
+	payload := map[string]string{"registrationCode": registrationCode}
+	if nickname != "" {
+		payload["deviceNickname"] = nickname
+	}
+
+	var registered nmiDevice
+	if err := c.sendDeviceRequest(ctx, apiKey, "device_register", http.MethodPost, "/devices/register", payload, &registered); err != nil {
+		return nil, err
+	}
+	recordActor(ctx, "device_register", registered.POIDeviceID)
+	return registered.device(), nil
+}
+
+// GetDevice reports a registered terminal's details and whether it is
+// connected
+func (c *Client) GetDevice(ctx context.Context, apiKey, deviceID string) (*Device, error) {
+	if deviceID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "terminal_id is required", "")
+	}
+
+	var found nmiDevice
+	if err := c.sendDeviceRequest(ctx, apiKey, "device_status", http.MethodGet, "/devices/"+url.PathEscape(deviceID), nil, &found); err != nil {
+		return nil, err
+	}
+	return found.device(), nil
+}
+
+// CancelDevicePrompt withdraws the payment prompt a terminal is showing.
+// The payment then completes as cancelled.
+func (c *Client) CancelDevicePrompt(ctx context.Context, apiKey, deviceID string) error {
+	if deviceID == "" {
+		return NewNMIError(ErrInvalidRequest, "terminal_id is required", "")
+	}
+
+	if err := c.sendDeviceRequest(ctx, apiKey, "device_cancel", http.MethodPost, "/devices/"+url.PathEscape(deviceID)+"/cancel", nil, nil); err != nil {
+		return err
+	}
+	recordActor(ctx, "device_cancel", deviceID)
+	return nil
+}
+
+// TerminalPaymentStatus reports the progress of a payment sent to a
+// terminal, with the gateway's result once the cardholder has finished
+func (c *Client) TerminalPaymentStatus(ctx context.Context, apiKey, asyncStatusID string) (*TerminalResponse, error) {
+	if asyncStatusID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "async_status_id is required", "")
+	}
+
+	var status nmiAsyncStatus
+	if err := c.sendDeviceRequest(ctx, apiKey, "device_payment_status", http.MethodGet, "/async/"+url.PathEscape(asyncStatusID), nil, &status); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(status.Status) {
+	case "complete":
+		resp, err := parseTerminalResponse(status.Response)
+		if err != nil {
+			return nil, err
+		}
+		resp.AsyncStatusID = asyncStatusID
+		return resp, nil
+	case TerminalPaymentCancelled:
+		return &TerminalResponse{
+			Status:        TerminalPaymentCancelled,
+			AsyncStatusID: asyncStatusID,
+			ResponseText:  "Payment cancelled at the terminal",
+		}, nil
+	}
+	return &TerminalResponse{
+		Status:        TerminalPaymentPending,
+		AsyncStatusID: asyncStatusID,
+		ResponseText:  "Waiting for the cardholder",
+	}, nil
+}
+
+// WaitForTerminalPayment polls a payment StartTerminalPayment sent until
+// it finishes. When the caller's time, or MaxDeviceWait, runs out first the
+// payment is returned still pending so the caller can poll it later.
+func (c *Client) WaitForTerminalPayment(ctx context.Context, apiKey string, started *TerminalResponse) (*TerminalResponse, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, gatewayBudget(ctx, MaxDeviceWait))
+	defer cancel()
+
+	result := started
+	// Status calls run on ctx so the last one is not starved by the wait
+	// ending; PollUntil still stops polling when it does
+	err := PollUntil(waitCtx, DefaultPollBackoff, func(context.Context) (bool, error) {
+		current, err := c.TerminalPaymentStatus(ctx, apiKey, started.AsyncStatusID)
+		if err != nil {
+			return false, err
+		}
+		result = current
+		return current.Status != TerminalPaymentPending, nil
+	})
+	if err != nil && !(waitCtx.Err() != nil && ctx.Err() == nil) {
+		return nil, err
+	}
+
+	if result.TerminalID == "" {
+		result.TerminalID = started.TerminalID
+	}
+	if result.Amount == "" {
+		result.Amount = started.Amount
+	}
+	return result, nil
+}
+
+// deviceResponse reports a device's state as a terminal response
+func deviceResponse(device *Device) *TerminalResponse {
+	return &TerminalResponse{
+		Status:       device.Status,
+		TerminalID:   device.ID,
+		ResponseText: "Terminal " + device.ID + " is " + device.Status,
+		Success:      device.Status != DeviceOffline,
+		Terminal:     device,
+	}
+}
+
+// sendDeviceRequest makes a JSON call to the payment device API and
+// decodes its answer into out. The API authenticates with the merchant's
+// security key and answers errors with an HTTP status and a message.
+func (c *Client) sendDeviceRequest(ctx context.Context, apiKey, operation, method, path string, payload, out interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return NewNMIError(ErrProcessingError, "failed to encode request", "")
+		}
+	}
+	endpoint := strings.TrimSuffix(c.deviceURL, "/") + path
+
+	resp, err := c.traceGateway(ctx, "nmi.device", url.Values{"type": {operation}}, func(ctx context.Context) (string, error) {
+		resp, status, err := c.roundTrip(ctx, func(gatewayCtx context.Context) (*http.Request, error) {
+			httpReq, err := http.NewRequestWithContext(gatewayCtx, method, endpoint, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			httpReq.Header.Set("Authorization", apiKey)
+			httpReq.Header.Set("Accept", "application/json")
+			if payload != nil {
+				httpReq.Header.Set("Content-Type", "application/json")
+			}
+			return httpReq, nil
+		})
+		if err == nil && status >= http.StatusBadRequest {
+			err = deviceError(status, resp)
+		}
+		return resp, err
+	})
+	if err != nil {
+		return err
+	}
+
+	if out != nil {
+		if err := json.Unmarshal([]byte(resp), out); err != nil {
+			return NewNMIError(ErrPartialResponse, "unreadable response from the payment device API", resp)
+		}
+	}
+	return nil
+}
+
+// deviceError converts a payment device API error answer
+func deviceError(status int, body string) *NMIError {
+	var parsed struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal([]byte(body), &parsed)
+
+	message := parsed.Message
+	if message == "" {
+		message = parsed.Error
+	}
+	if message == "" {
+		message = "payment device API returned " + http.StatusText(status)
+	}
+
+	code := ErrInvalidRequest
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		code = ErrAuthenticationFailed
+	case http.StatusNotFound:
+		code = ErrNotFound
+	case http.StatusConflict:
+		code = ErrConflict
+	}
+	return NewNMIError(code, message, body)
+}
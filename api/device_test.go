@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deviceGateway serves transact.php and the payment device API for one
+// terminal. A payment stays pending for the given number of status polls.
+type deviceGateway struct {
+	mu        sync.Mutex
+	payment   url.Values
+	pending   int
+	cancelled bool
+	auth      []string
+}
+
+func (g *deviceGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if r.URL.Path == "/transact.php" {
+		r.ParseForm()
+		g.payment = r.PostForm
+		w.Write([]byte("response=1&responsetext=Pending&async_status_guid=guid-1&response_code=100"))
+		return
+	}
+
+	g.auth = append(g.auth, r.Header.Get("Authorization"))
+	switch r.Method + " " + r.URL.Path {
+	case "POST /v2/devices/register":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["registrationCode"] != "A1B2C3" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"Invalid registration code"}`))
+			return
+		}
+		w.Write([]byte(`{"poiDeviceId":"dev-1","deviceNickname":"` + body["deviceNickname"] + `","connectionStatus":"Online","lastConnectedAt":"2026-10-16T15:04:05Z"}`))
+	case "GET /v2/devices/dev-1":
+		w.Write([]byte(`{"poiDeviceId":"dev-1","model":"Lane/3000","firmwareVersion":"2.1.4","connectionStatus":"busy"}`))
+	case "POST /v2/devices/dev-1/cancel":
+		g.cancelled = true
+		w.Write([]byte(`{}`))
+	case "GET /v2/async/guid-1":
+		switch {
+		case g.cancelled:
+			w.Write([]byte(`{"status":"cancelled"}`))
+		case g.pending > 0:
+			g.pending--
+			w.Write([]byte(`{"status":"pending"}`))
+		default:
+			w.Write([]byte(`{"status":"complete","response":"response=1&responsetext=SUCCESS&authcode=123456&transactionid=9001&amount=25.99&response_code=100"}`))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Device not found"}`))
+	}
+}
+
+func newDeviceClient(t *testing.T, gateway *deviceGateway) *Client {
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+	return NewClient(&config.Config{
+		APIBaseURL:   server.URL + "/transact.php",
+		DeviceAPIURL: server.URL + "/v2",
+	})
+}
+
+func TestTerminalInit(t *testing.T) {
+	gateway := &deviceGateway{}
+	client := newDeviceClient(t, gateway)
+	ctx := context.Background()
+
+	resp, err := client.ProcessTerminalInit(ctx, TerminalInitRequest{APIKey: "key", RegistrationCode: "A1B2C3", Location: "Store-01"})
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", resp.TerminalID)
+	assert.Equal(t, DeviceOnline, resp.Status)
+	assert.True(t, resp.Success)
+	assert.Equal(t, "Store-01", resp.Terminal.Nickname)
+	require.NotNil(t, resp.Terminal.LastSeen)
+	assert.Equal(t, []string{"key"}, gateway.auth)
+
+	_, err = client.ProcessTerminalInit(ctx, TerminalInitRequest{APIKey: "key", RegistrationCode: "WRONG"})
+	assert.Equal(t, http.StatusBadRequest, HTTPStatus(err))
+	assert.ErrorContains(t, err, "Invalid registration code")
+
+	resp, err = client.ProcessTerminalInit(ctx, TerminalInitRequest{APIKey: "key", TerminalID: "dev-1"})
+	require.NoError(t, err)
+	assert.Equal(t, DeviceBusy, resp.Status)
+	assert.Equal(t, "2.1.4", resp.Terminal.FirmwareVersion)
+
+	_, err = client.GetDevice(ctx, "key", "dev-2")
+	assert.Equal(t, http.StatusNotFound, HTTPStatus(err))
+
+	_, err = client.ProcessTerminalInit(ctx, TerminalInitRequest{APIKey: "key"})
+	assert.ErrorContains(t, err, "registration_code")
+}
+
+func TestTerminalPayment(t *testing.T) {
+	gateway := &deviceGateway{pending: 1}
+	client := newDeviceClient(t, gateway)
+	ctx := context.Background()
+
+	_, err := client.ProcessTerminalPayment(ctx, TerminalPaymentRequest{TerminalID: "dev-1", Amount: "25.99", Type: "cc:sale"})
+	assert.ErrorContains(t, err, "type must be")
+
+	resp, err := client.ProcessTerminalPayment(ctx, TerminalPaymentRequest{APIKey: "key", TerminalID: "dev-1", Amount: "25.99", OrderID: "ORD-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", gateway.payment.Get("poi_device_id"))
+	assert.Equal(t, "asynchronous", gateway.payment.Get("response_method"))
+	assert.Equal(t, "sale", gateway.payment.Get("type"))
+	assert.Equal(t, "ORD-1", gateway.payment.Get("orderid"))
+
+	assert.True(t, resp.Success)
+	assert.Equal(t, "1", resp.Status)
+	assert.Equal(t, "9001", resp.TransactionID)
+	assert.Equal(t, "guid-1", resp.AsyncStatusID)
+	assert.Equal(t, "dev-1", resp.TerminalID)
+}
+
+func TestTerminalPaymentPendingAndCancelled(t *testing.T) {
+	gateway := &deviceGateway{pending: 100}
+	client := newDeviceClient(t, gateway)
+
+	// The request's deadline leaves no time to wait for the cardholder
+	ctx, cancel := context.WithTimeout(context.Background(), gatewaySafetyMargin+200*time.Millisecond)
+	defer cancel()
+	resp, err := client.ProcessTerminalPayment(ctx, TerminalPaymentRequest{APIKey: "key", TerminalID: "dev-1", Amount: "10.00"})
+	require.NoError(t, err)
+	assert.Equal(t, TerminalPaymentPending, resp.Status)
+	assert.Equal(t, "guid-1", resp.AsyncStatusID)
+	assert.Equal(t, "10.00", resp.Amount)
+	assert.False(t, resp.Success)
+
+	require.NoError(t, client.CancelDevicePrompt(context.Background(), "key", "dev-1"))
+	resp, err = client.TerminalPaymentStatus(context.Background(), "key", "guid-1")
+	require.NoError(t, err)
+	assert.Equal(t, TerminalPaymentCancelled, resp.Status)
+
+	err = client.CancelDevicePrompt(context.Background(), "key", "dev-2")
+	assert.Equal(t, http.StatusNotFound, HTTPStatus(err))
+}
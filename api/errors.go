@@ -1,8 +1,16 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/pci"
+	"nmi-pay-int/requestid"
 )
 
 // NMIError represents a structured error response from NMI
@@ -11,6 +19,22 @@ type NMIError struct {
 	Message string `json:"message"`
 	Details string `json:"details,omitempty"`
 	Raw     string `json:"raw,omitempty"`
+
+	// Gateway results for declined transactions
+	ResponseCode string `json:"response_code,omitempty"`
+	AVSResponse  string `json:"avsresponse,omitempty"`
+	CVVResponse  string `json:"cvvresponse,omitempty"`
+	// DeclineReason is the normalized responsetext of a refused transaction
+	DeclineReason DeclineReason `json:"decline_reason,omitempty"`
+	// DeclineCategory says whether and how the refusal can be retried
+	DeclineCategory DeclineCategory `json:"decline_category,omitempty"`
+
+	// RetryAfter is the number of seconds to wait before retrying, set when
+	// the gateway is throttling requests
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// RequestID identifies the request that failed, set on error responses
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func (e *NMIError) Error() string {
@@ -19,17 +43,38 @@ func (e *NMIError) Error() string {
 
 // Common error codes
 const (
-	ErrInvalidCard          = "invalid_card"
-	ErrInvalidAmount        = "invalid_amount"
-	ErrInvalidRequest       = "invalid_request"
-	ErrDuplicateTransaction = "duplicate_transaction"
-	ErrProcessingError      = "processing_error"
-	ErrPartialResponse      = "partial_response"
-	ErrInvalidRefund        = "invalid_refund"
-	ErrNetworkError         = "network_error"
-	ErrAuthenticationFailed = "authentication_failed"
-	ErrInvalidAction        = "invalid_action"
-	ErrSystemError          = "system_error"
+	ErrInvalidCard           = "invalid_card"
+	ErrCardDeclined          = "card_declined"
+	ErrInvalidAmount         = "invalid_amount"
+	ErrInvalidRequest        = "invalid_request"
+	ErrDuplicateTransaction  = "duplicate_transaction"
+	ErrProcessingError       = "processing_error"
+	ErrPartialResponse       = "partial_response"
+	ErrInvalidRefund         = "invalid_refund"
+	ErrNetworkError          = "network_error"
+	ErrAuthenticationFailed  = "authentication_failed"
+	ErrInvalidAction         = "invalid_action"
+	ErrSystemError           = "system_error"
+	ErrCircuitOpen           = "circuit_open"
+	ErrGatewayThrottled      = "gateway_throttled"
+	ErrDeadlineExceeded      = "deadline_exceeded"
+	ErrVaultCustomerNotFound = "vault_customer_not_found"
+	// ErrCardNotAccepted refuses a kind of card the merchant does not take
+	ErrCardNotAccepted = "card_not_accepted"
+	// ErrCardBlocked refuses a card on the merchant's blocklist
+	ErrCardBlocked = "card_blocked"
+
+	// Failures of the service itself rather than the gateway
+	ErrNotFound             = "not_found"
+	ErrConflict             = "conflict"
+	ErrPreconditionRequired = "precondition_required"
+	ErrInternal             = "internal_error"
+	// ErrUnauthorized and ErrForbidden reject callers of this service, as
+	// opposed to ErrAuthenticationFailed, the gateway rejecting the merchant
+	ErrUnauthorized = "unauthorized"
+	ErrForbidden    = "forbidden"
+	// ErrRateLimited turns away a caller that must wait RetryAfter seconds
+	ErrRateLimited = "rate_limited"
 )
 
 // NewNMIError creates a new NMIError
@@ -37,39 +82,146 @@ func NewNMIError(code, message string, rawResponse string) *NMIError {
 	return &NMIError{
 		Code:    code,
 		Message: message,
-		Raw:     rawResponse,
+		Raw:     pci.Scrub(rawResponse),
 	}
 }
 
 // ParseNMIErrorResponse parses NMI's error response
 func ParseNMIErrorResponse(responseText, responseCode, rawResponse string) *NMIError {
-	// Map NMI response codes to our error codes
-	codeMap := map[string]string{
-		"200": ErrInvalidCard,
-		"201": ErrInvalidAmount,
-		"300": ErrAuthenticationFailed,
-		"400": ErrProcessingError,
-		"500": ErrSystemError,
-		"600": ErrInvalidAction,
-		"601": ErrDuplicateTransaction,
-		"700": ErrNetworkError,
-	}
-
 	// Extract more detailed error information if available
 	details := ""
 	if strings.Contains(responseText, "REFID:") {
 		details = responseText[strings.Index(responseText, "REFID:"):]
 	}
 
-	code, exists := codeMap[responseCode]
-	if !exists {
-		code = ErrProcessingError
-	}
+	reason := NormalizeResponseText(responseText, responseCode)
+	category := CategorizeDecline(responseCode, reason)
 
 	return &NMIError{
-		Code:    code,
-		Message: responseText,
-		Details: details,
-		Raw:     rawResponse,
+		Code:            refusalCode(responseCode, responseText, reason, category),
+		Message:         responseText,
+		Details:         details,
+		Raw:             pci.Scrub(rawResponse),
+		ResponseCode:    responseCode,
+		DeclineReason:   reason,
+		DeclineCategory: category,
+	}
+}
+
+// refusalCode picks the error code for a refused transaction. Issuer
+// declines are card_declined, or invalid_card when the card details were
+// wrong; gateway rejections name what was wrong with the request.
+func refusalCode(responseCode, responseText string, reason DeclineReason, category DeclineCategory) string {
+	switch category {
+	case CategoryDuplicate:
+		return ErrDuplicateTransaction
+	case CategoryMerchantConfiguration:
+		return ErrAuthenticationFailed
+	case CategoryInvalidCard, CategoryExpiredCard, CategoryCVVFailure:
+		return ErrInvalidCard
+	case CategoryProcessorError:
+		return ErrProcessingError
+	case CategoryInvalidRequest:
+		switch reason {
+		case DeclineInvalidAmount:
+			return ErrInvalidAmount
+		case DeclineTransactionNotFound:
+			return ErrNotFound
+		}
+		return ErrInvalidRequest
+	case CategoryTryAgainLater:
+		if strings.HasPrefix(responseCode, "4") {
+			// Communication errors between NMI and the processor or issuer
+			return ErrNetworkError
+		}
+	case CategoryGatewayRejected, CategoryUnknown:
+		text := strings.ToLower(responseText)
+		switch {
+		case strings.Contains(text, "not found"):
+			return ErrNotFound
+		case strings.Contains(text, "refund"):
+			return ErrInvalidRefund
+		case strings.Contains(text, "void"):
+			return ErrInvalidAction
+		case strings.Contains(text, "amount"):
+			return ErrInvalidAmount
+		}
+		return ErrProcessingError
+	}
+	if strings.HasPrefix(responseCode, "4") {
+		return ErrProcessingError
 	}
+	return ErrCardDeclined
+}
+
+// HTTPStatus returns the status an error is reported to REST callers with:
+// 402 for gateway declines and refused cards, 400 for invalid input, 409 for
+// duplicates, and 502 when the gateway cannot be reached or rejects the
+// merchant's credentials, which is no fault of the caller's. Errors that are
+// not an NMIError are internal failures.
+func HTTPStatus(err error) int {
+	var nmiErr *NMIError
+	if !errors.As(err, &nmiErr) {
+		return http.StatusInternalServerError
+	}
+	switch nmiErr.Code {
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrDuplicateTransaction, ErrConflict:
+		return http.StatusConflict
+	case ErrVaultCustomerNotFound, ErrNotFound:
+		return http.StatusNotFound
+	case ErrPreconditionRequired:
+		return http.StatusPreconditionRequired
+	case ErrDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case ErrInternal:
+		return http.StatusInternalServerError
+	case ErrCardNotAccepted, ErrCardBlocked:
+		return http.StatusPaymentRequired
+	case ErrInvalidRequest, ErrInvalidAmount:
+		// Gateway rejections of the request carry a response code, but are
+		// not declines
+		return http.StatusBadRequest
+	case ErrAuthenticationFailed, ErrNetworkError, ErrSystemError, ErrPartialResponse, ErrCircuitOpen, ErrGatewayThrottled:
+		return http.StatusBadGateway
+	}
+	switch {
+	case nmiErr.ResponseCode != "":
+		return http.StatusPaymentRequired
+	case nmiErr.Code == ErrProcessingError:
+		// A processing error without a gateway result never reached a decision
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
+}
+
+// WriteError reports err as a JSON NMIError carrying the request ID, with
+// the status HTTPStatus picks. Other errors are logged and reported as a
+// bare internal_error, since their text can describe our internals.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var nmiErr *NMIError
+	if !errors.As(err, &nmiErr) {
+		logctx.From(r.Context()).WithError(err).Error("Request failed with an internal error")
+		nmiErr = NewNMIError(ErrInternal, "internal server error", "")
+	}
+	body := *nmiErr
+	body.RequestID = requestid.From(r.Context())
+
+	if body.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(body.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(HTTPStatus(nmiErr))
+	json.NewEncoder(w).Encode(body)
+}
+
+// WriteErrorCode reports a failure detected by a handler, such as a
+// malformed payload, with WriteError
+func WriteErrorCode(w http.ResponseWriter, r *http.Request, code, message string) {
+	WriteError(w, r, NewNMIError(code, message, ""))
 }
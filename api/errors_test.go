@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/requestid"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"decline", ParseNMIErrorResponse("DECLINE", "200", ""), http.StatusPaymentRequired},
+		{"validation", NewNMIError(ErrInvalidCard, "invalid credit card number length", ""), http.StatusBadRequest},
+		{"duplicate", ParseNMIErrorResponse("Duplicate transaction REFID:1", "601", ""), http.StatusConflict},
+		{"gateway auth", ParseNMIErrorResponse("Authentication Failed", "300", ""), http.StatusBadGateway},
+		{"gateway invalid amount", ParseNMIErrorResponse("Invalid amount REFID:1", "300", ""), http.StatusBadRequest},
+		{"gateway transaction not found", ParseNMIErrorResponse("Transaction not found REFID:1", "300", ""), http.StatusNotFound},
+		{"unreachable", NewNMIError(ErrNetworkError, "network error: timeout", ""), http.StatusBadGateway},
+		{"circuit open", NewNMIError(ErrCircuitOpen, "gateway unavailable", ""), http.StatusBadGateway},
+		{"deadline", NewNMIError(ErrDeadlineExceeded, "deadline exceeded", ""), http.StatusGatewayTimeout},
+		{"vault record", NewNMIError(ErrVaultCustomerNotFound, "not found", ""), http.StatusNotFound},
+		{"wrapped", errors.Join(errors.New("sale"), NewNMIError(ErrInvalidAmount, "bad", "")), http.StatusBadRequest},
+		{"internal", errors.New("disk full"), http.StatusInternalServerError},
+		{"caller unauthorized", NewNMIError(ErrUnauthorized, "missing or invalid credentials", ""), http.StatusUnauthorized},
+		{"caller forbidden", NewNMIError(ErrForbidden, "merchant not allowed for this caller", ""), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, HTTPStatus(tt.err))
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/payments/sale", nil)
+	req = req.WithContext(requestid.With(req.Context(), "req-42"))
+
+	rec := httptest.NewRecorder()
+	throttled := NewNMIError(ErrGatewayThrottled, "gateway is throttling requests", "")
+	throttled.RetryAfter = 5
+	WriteError(rec, req, throttled)
+
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+	var body NMIError
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, ErrGatewayThrottled, body.Code)
+	assert.Equal(t, "req-42", body.RequestID)
+	assert.Empty(t, throttled.RequestID, "the error itself is not modified")
+
+	// Errors that are not NMIErrors still get the JSON body
+	rec = httptest.NewRecorder()
+	WriteErrorCode(rec, req, ErrNotFound, "Plan not found")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"code":"not_found","message":"Plan not found","request_id":"req-42"}`, rec.Body.String())
+
+	// Other errors are not shown to the caller
+	rec = httptest.NewRecorder()
+	WriteError(rec, req, errors.New("pq: relation \"audit_records\" does not exist"))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.JSONEq(t, `{"code":"internal_error","message":"internal server error","request_id":"req-42"}`, rec.Body.String())
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/fixtures"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run `go test ./api -run Golden -update` after an intended parser change,
+// and review the golden diff like any other code change
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// golden is what the parser made of one fixture
+type golden struct {
+	Response *NMIResponse `json:"response,omitempty"`
+	// Extra holds the fields NMIResponse has no struct field for
+	Extra  map[string]string `json:"extra,omitempty"`
+	Result interface{}       `json:"result,omitempty"`
+	Error  *NMIError         `json:"error,omitempty"`
+	// ErrorText is set for failures that are not gateway errors
+	ErrorText string `json:"error_text,omitempty"`
+}
+
+func (g *golden) setError(err error) {
+	var nmiErr *NMIError
+	if errors.As(err, &nmiErr) {
+		g.Error = nmiErr
+	} else if err != nil {
+		g.ErrorText = err.Error()
+	}
+}
+
+// extraFields returns the response fields ParseNMIResponse does not map to
+// a struct field, such as subscription_id
+func extraFields(values url.Values) map[string]string {
+	extra := make(map[string]string)
+	for key := range values {
+		switch key {
+		case "response", "responsetext", "authcode", "transactionid", "avsresponse", "cvvresponse",
+			"orderid", "type", "response_code", "amount", "customer_vault_id":
+			continue
+		}
+		extra[key] = values.Get(key)
+	}
+	return extra
+}
+
+// checkGolden compares got with testdata/golden/<name>.json
+func checkGolden(t *testing.T, name string, got golden) {
+	t.Helper()
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	require.NoError(t, encoder.Encode(got))
+	data := buf.Bytes()
+
+	path := filepath.Join("testdata", "golden", filepath.FromSlash(name)+".json")
+	if *updateGolden {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+		return
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err, "no golden file; run with -update to create it")
+	// Checkouts may convert the golden files' line endings
+	assert.Equal(t, string(bytes.ReplaceAll(want, []byte("\r\n"), []byte("\n"))), string(data))
+}
+
+func TestTransactFixturesGolden(t *testing.T) {
+	for _, f := range fixtures.OfKind(fixtures.KindTransact) {
+		t.Run(f.Name, func(t *testing.T) {
+			var got golden
+			resp, err := ParseNMIResponse(f.Body)
+			if resp != nil {
+				got.Response = resp
+				got.Extra = extraFields(resp.Values)
+			}
+			got.setError(err)
+			checkGolden(t, f.Name, got)
+
+			// Only approvals parse without error, and every refusal has a
+			// decline reason
+			approved := resp != nil && resp.Response == "1"
+			assert.Equal(t, approved, err == nil)
+			var nmiErr *NMIError
+			if errors.As(err, &nmiErr) {
+				assert.NotEmpty(t, nmiErr.DeclineReason)
+			}
+		})
+	}
+}
+
+func TestQueryFixturesGolden(t *testing.T) {
+	ctx := context.Background()
+	for _, f := range fixtures.OfKind(fixtures.KindQuery) {
+		t.Run(f.Name, func(t *testing.T) {
+			gateway := httptest.NewServer(fixtures.Handler(f.Name))
+			defer gateway.Close()
+			client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+			// Each report goes through the call that requests it
+			var got golden
+			var err error
+			switch base := strings.TrimPrefix(f.Name, fixtures.KindQuery+"/"); {
+			case strings.HasPrefix(base, "subscription_"):
+				got.Result, err = client.GetSubscriptionPayments(ctx, "key", "4415586613")
+			case strings.HasPrefix(base, "vault_"):
+				got.Result, err = client.ListVaultCustomers(ctx, "key", 0, 0)
+			default:
+				got.Result, err = client.SearchTransactions(ctx, TransactionSearch{
+					APIKey:    "key",
+					StartDate: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					EndDate:   time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC),
+				})
+			}
+			if err != nil {
+				got.Result = nil
+			}
+			got.setError(err)
+			checkGolden(t, f.Name, got)
+		})
+	}
+}
+
+func TestFixturesCoverDeclineCodes(t *testing.T) {
+	// NMI's documented decline and error codes
+	codes := []string{
+		"200", "201", "202", "203", "204", "220", "221", "222", "223", "224", "225", "226",
+		"240", "250", "251", "252", "253", "260", "261", "262", "263", "264",
+		"300", "400", "410", "411", "420", "421", "430", "440", "441", "460", "461",
+	}
+	covered := make(map[string]bool)
+	for _, f := range fixtures.OfKind(fixtures.KindTransact) {
+		if values, err := url.ParseQuery(f.Body); err == nil {
+			covered[values.Get("response_code")] = true
+		}
+	}
+	for _, code := range codes {
+		assert.True(t, covered[code], "no fixture for response code %s", code)
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+	"net/url"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/pci"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SanitizeFormData returns a copy of outbound NMI form data with the
+// security key, card data, 3-D Secure CAVV and wallet tokens masked
+func SanitizeFormData(formData url.Values) url.Values {
+	sanitized := url.Values{}
+	for key, values := range formData {
+		for _, value := range values {
+			sanitized.Add(key, pci.MaskField(key, value))
+		}
+	}
+	return sanitized
+}
+
+// logOutboundForm writes the sanitized form data at debug level on the
+// request's log entry
+func logOutboundForm(ctx context.Context, endpoint string, formData url.Values) {
+	logctx.From(ctx).WithFields(logrus.Fields{
+		"endpoint":  endpoint,
+		"form_data": SanitizeFormData(formData).Encode(),
+	}).Debug("Outbound NMI request")
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeFormData(t *testing.T) {
+	formData := url.Values{}
+	formData.Set("security_key", "6457Thfj624V5r7WUwc5v6a68Zsd6YEm")
+	formData.Set("ccnumber", "4111111111111111")
+	formData.Set("cvv", "123")
+	formData.Set("ccexp", "1230")
+	formData.Set("amount", "10.99")
+
+	sanitized := SanitizeFormData(formData)
+
+	assert.Equal(t, "****************************6YEm", sanitized.Get("security_key"))
+	assert.Equal(t, "************1111", sanitized.Get("ccnumber"))
+	assert.Equal(t, "***", sanitized.Get("cvv"))
+	assert.Equal(t, "****", sanitized.Get("ccexp"))
+	assert.Equal(t, "10.99", sanitized.Get("amount"))
+	assert.NotContains(t, sanitized.Encode(), "4111111111111111")
+
+	// The original form data must be left untouched
+	assert.Equal(t, "123", formData.Get("cvv"))
+}
+
+func TestRequestString(t *testing.T) {
+	req := PaymentRequest{
+		APIKey:     "6457Thfj624V5r7WUwc5v6a68Zsd6YEm",
+		Amount:     "10.99",
+		CreditCard: "4111111111111111",
+		ExpDate:    "1230",
+		CVV:        "123",
+	}
+
+	for _, s := range []string{fmt.Sprintf("%v", req), fmt.Sprintf("%+v", req), fmt.Sprintf("%+v", &req)} {
+		assert.NotContains(t, s, "4111111111111111")
+		assert.NotContains(t, s, "CVV:123")
+		assert.NotContains(t, s, "6457Thfj")
+		assert.Contains(t, s, "CreditCard:************1111")
+		assert.Contains(t, s, "Amount:10.99")
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+const (
+	// hedgeWindow is how many recent query latencies the hedge delay is
+	// computed from
+	hedgeWindow = 256
+	// hedgeMinSamples is how many latencies must be observed before the
+	// first hedge, so a cold start does not hedge on noise
+	hedgeMinSamples = 20
+	// hedgeMinDelay keeps a very fast gateway from being hedged on every call
+	hedgeMinDelay = 50 * time.Millisecond
+)
+
+// hedger sends a second copy of a slow read after the recent P95 latency has
+// elapsed and returns whichever answer arrives first. Only idempotent Query
+// API reads are hedged; the limit bounds how many extra requests can be in
+// flight so a slow gateway is not hit with double the load.
+type hedger struct {
+	slots chan struct{}
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func newHedger(limit int) *hedger {
+	return &hedger{
+		slots:     make(chan struct{}, limit),
+		latencies: make([]time.Duration, 0, hedgeWindow),
+	}
+}
+
+type hedgeResult struct {
+	resp   string
+	err    error
+	hedged bool
+}
+
+// do runs send, and once more if the first attempt is slower than the hedge
+// delay. The losing attempt is cancelled.
+func (h *hedger) do(ctx context.Context, send func(context.Context) (string, error)) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	results := make(chan hedgeResult, 2)
+	attempt := func(hedged bool) {
+		resp, err := send(ctx)
+		results <- hedgeResult{resp: resp, err: err, hedged: hedged}
+	}
+	go attempt(false)
+
+	var timer <-chan time.Time
+	if delay, ok := h.delay(); ok {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	pending, hedgeSent := 1, false
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			select {
+			case h.slots <- struct{}{}:
+				pending++
+				hedgeSent = true
+				go func() {
+					defer func() { <-h.slots }()
+					attempt(true)
+				}()
+			default:
+				metrics.RecordQueryHedge("skipped")
+			}
+
+		case result := <-results:
+			pending--
+			// Wait for the other attempt when this one failed
+			if result.err != nil && pending > 0 {
+				continue
+			}
+			if result.err == nil {
+				// A lower bound on the primary's latency when the hedge won,
+				// which is what the next hedge delay should be based on
+				h.observe(time.Since(start))
+			}
+			if hedgeSent {
+				if result.hedged {
+					metrics.RecordQueryHedge("won")
+				} else {
+					metrics.RecordQueryHedge("lost")
+				}
+			}
+			return result.resp, result.err
+		}
+	}
+}
+
+// delay returns the P95 of recent latencies, or false until enough have been
+// observed
+func (h *hedger) delay() (time.Duration, bool) {
+	h.mu.Lock()
+	if len(h.latencies) < hedgeMinSamples {
+		h.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), h.latencies...)
+	h.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p95 := sorted[len(sorted)*95/100]
+	if p95 < hedgeMinDelay {
+		p95 = hedgeMinDelay
+	}
+	return p95, true
+}
+
+func (h *hedger) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.latencies) < hedgeWindow {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgeWindow
+}
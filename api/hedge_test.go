@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nmi-pay-int/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func warmHedger(limit int, latency time.Duration) *hedger {
+	h := newHedger(limit)
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.observe(latency)
+	}
+	return h
+}
+
+// slowFirst blocks the first call until its context is cancelled and answers
+// later calls immediately
+func slowFirst(calls *int32) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		if atomic.AddInt32(calls, 1) == 1 {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "response=1", nil
+	}
+}
+
+func TestHedgerSendsSecondRequestAfterP95(t *testing.T) {
+	h := warmHedger(1, 10*time.Millisecond)
+	won := testutil.ToFloat64(metrics.QueryHedges.WithLabelValues("won"))
+
+	var calls int32
+	start := time.Now()
+	resp, err := h.do(context.Background(), slowFirst(&calls))
+	require.NoError(t, err)
+	assert.Equal(t, "response=1", resp)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, won+1, testutil.ToFloat64(metrics.QueryHedges.WithLabelValues("won")))
+}
+
+func TestHedgerWaitsForSamplesBeforeHedging(t *testing.T) {
+	h := newHedger(1)
+	_, ok := h.delay()
+	assert.False(t, ok)
+
+	var calls int32
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := h.do(ctx, slowFirst(&calls))
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestHedgerRespectsLimit(t *testing.T) {
+	h := warmHedger(1, 10*time.Millisecond)
+	h.slots <- struct{}{} // another hedge already in flight
+	skipped := testutil.ToFloat64(metrics.QueryHedges.WithLabelValues("skipped"))
+
+	var calls int32
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := h.do(ctx, slowFirst(&calls))
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	assert.Equal(t, skipped+1, testutil.ToFloat64(metrics.QueryHedges.WithLabelValues("skipped")))
+}
+
+func TestHedgerDelayIsP95WithFloor(t *testing.T) {
+	h := newHedger(1)
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * 10 * time.Millisecond)
+	}
+	delay, ok := h.delay()
+	require.True(t, ok)
+	assert.Equal(t, 960*time.Millisecond, delay)
+
+	fast := warmHedger(1, time.Millisecond)
+	delay, _ = fast.delay()
+	assert.Equal(t, hedgeMinDelay, delay)
+}
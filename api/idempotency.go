@@ -0,0 +1,315 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/fallback"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/pci"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Idempotency store defaults
+const (
+	DefaultIdempotencyTTL     = 24 * time.Hour
+	DefaultIdempotencyMaxKeys = 100000
+)
+
+// IdempotencyStore remembers idempotency keys so a retried payment is not
+// charged twice. A key is reserved before the gateway is called, completed
+// with the serialized response once it answers, and released if the attempt
+// fails before reaching the gateway so the client can retry it.
+type IdempotencyStore interface {
+	// Reserve claims key. If it is already taken it returns false along with
+	// the stored result, which is empty while the first request is in flight.
+	Reserve(ctx context.Context, key string) (bool, []byte, error)
+	// Complete records the result of the request that reserved key
+	Complete(ctx context.Context, key string, result []byte) error
+	// Release frees key after a failed attempt
+	Release(ctx context.Context, key string) error
+}
+
+// merchantIdempotencyKey scopes a client's idempotency key to the merchant
+// on ctx, so that merchants choosing the same key do not get each other's
+// payments
+func merchantIdempotencyKey(ctx context.Context, key string) string {
+	merchantID := config.DefaultMerchantID
+	if merchant, ok := MerchantFromContext(ctx); ok {
+		merchantID = merchant.ID
+	}
+	return merchantID + ":" + key
+}
+
+// idempotentResult is what a completed key stores: the response, or the
+// error of a declined or refused payment, and a hash of the request it
+// answered, so that the key is not replayed for a different payment.
+// Indeterminate marks a request that may have reached the gateway without
+// an answer coming back.
+type idempotentResult struct {
+	RequestHash   string          `json:"request_hash"`
+	Response      json.RawMessage `json:"response,omitempty"`
+	Error         *NMIError       `json:"error,omitempty"`
+	Indeterminate bool            `json:"indeterminate,omitempty"`
+}
+
+// completeIdempotency stores result under key. The payment has already
+// been decided, so a failure is logged rather than returned.
+func (c *Client) completeIdempotency(ctx context.Context, key string, result idempotentResult) {
+	stored, _ := json.Marshal(result)
+	if err := c.idempotency.Complete(context.WithoutCancel(ctx), key, stored); err != nil {
+		metrics.LogError(ctx, fmt.Errorf("failed to record idempotency key: %v", err))
+	}
+}
+
+// definitiveAnswer reports whether NMI decided the transaction: approved,
+// declined or refused with an error, rather than an answer that cannot be
+// read
+func definitiveAnswer(resp *NMIResponse) bool {
+	switch resp.Response {
+	case "1", "2", "3":
+		return true
+	}
+	return false
+}
+
+// reachedGateway reports whether a failed gateway call may have been
+// processed by NMI. Calls stopped by the circuit breaker or the throttle
+// never left, so retrying them cannot charge twice.
+func reachedGateway(err error) bool {
+	var nmiErr *NMIError
+	if errors.As(err, &nmiErr) {
+		switch nmiErr.Code {
+		case ErrCircuitOpen, ErrGatewayThrottled:
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyHash summarizes a payment request for comparison with its
+// retries. The card number is cut to its last four digits and the CVV left
+// out, so the hash is not derived from card data.
+func idempotencyHash(req PaymentRequest) string {
+	req.APIKey = ""
+	req.CreditCard = pci.MaskPAN(req.CreditCard)
+	req.CVV = ""
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type idempotencyEntry struct {
+	key     string
+	result  []byte
+	expires time.Time
+}
+
+// MemoryIdempotencyStore keeps keys in process, evicting the least recently
+// used key once maxKeys is reached and any key older than the TTL. Keys do not
+// survive a restart and are not shared between replicas.
+type MemoryIdempotencyStore struct {
+	ttl     time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	order   *list.List // most recently used at the front
+	entries map[string]*list.Element
+}
+
+// NewMemoryIdempotencyStore creates an in-memory store. Zero values use the
+// package defaults.
+func NewMemoryIdempotencyStore(ttl time.Duration, maxKeys int) *MemoryIdempotencyStore {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if maxKeys <= 0 {
+		maxKeys = DefaultIdempotencyMaxKeys
+	}
+	return &MemoryIdempotencyStore{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Reserve claims key
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key string) (bool, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := s.entries[key]; ok {
+		if entry := elem.Value.(*idempotencyEntry); now.Before(entry.expires) {
+			s.order.MoveToFront(elem)
+			return false, entry.result, nil
+		}
+		s.remove(elem)
+	}
+
+	for s.order.Len() >= s.maxKeys {
+		s.remove(s.order.Back())
+	}
+	s.entries[key] = s.order.PushFront(&idempotencyEntry{key: key, expires: now.Add(s.ttl)})
+	return true, nil, nil
+}
+
+// Complete records the result for key
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, result []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*idempotencyEntry)
+		entry.result = result
+		entry.expires = time.Now().Add(s.ttl)
+		s.order.MoveToFront(elem)
+	}
+	return nil
+}
+
+// Release frees key
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+// Len returns the number of keys held, including expired ones not yet evicted
+func (s *MemoryIdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *MemoryIdempotencyStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*idempotencyEntry).key)
+}
+
+// redisIdempotencyPrefix namespaces keys in a shared Redis
+const redisIdempotencyPrefix = "nmi:idempotency:"
+
+// RedisIdempotencyStore shares keys between replicas through Redis and keeps
+// them across restarts. Redis expires keys after the TTL.
+type RedisIdempotencyStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisIdempotencyStore creates a store on the Redis server at redisURL
+// (redis:// or rediss://)
+func NewRedisIdempotencyStore(redisURL string, ttl time.Duration) (*RedisIdempotencyStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &RedisIdempotencyStore{client: redis.NewClient(opts), ttl: ttl}, nil
+}
+
+// Reserve claims key with SET NX, so only one replica wins a race
+func (s *RedisIdempotencyStore) Reserve(ctx context.Context, key string) (bool, []byte, error) {
+	reserved, err := s.client.SetNX(ctx, redisIdempotencyPrefix+key, "", s.ttl).Result()
+	if err != nil || reserved {
+		return reserved, nil, err
+	}
+
+	result, err := s.client.Get(ctx, redisIdempotencyPrefix+key).Bytes()
+	if err == redis.Nil {
+		// Released or expired between the two calls; report it as in flight
+		// rather than racing for it again
+		return false, nil, nil
+	}
+	return false, result, err
+}
+
+// Complete records the result for key
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, result []byte) error {
+	return s.client.Set(ctx, redisIdempotencyPrefix+key, result, s.ttl).Err()
+}
+
+// Release frees key
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, redisIdempotencyPrefix+key).Err()
+}
+
+// Close closes the Redis connection pool
+func (s *RedisIdempotencyStore) Close() error {
+	return s.client.Close()
+}
+
+// fallbackOpTimeout bounds each call to the primary store, so a hung Redis
+// costs a payment at most this long before the fallback takes over
+const fallbackOpTimeout = 500 * time.Millisecond
+
+// FallbackIdempotencyStore uses a shared primary store (Redis) and switches to
+// a local one while the primary is unreachable. Keys reserved during an
+// outage are only known to this replica, which is preferred over refusing
+// payments.
+type FallbackIdempotencyStore struct {
+	primary    IdempotencyStore
+	local      IdempotencyStore
+	dependency *fallback.Dependency
+}
+
+// NewFallbackIdempotencyStore wraps primary with a local fallback
+func NewFallbackIdempotencyStore(primary, local IdempotencyStore, dependency *fallback.Dependency) *FallbackIdempotencyStore {
+	return &FallbackIdempotencyStore{primary: primary, local: local, dependency: dependency}
+}
+
+// Reserve claims key in the primary store, or locally while it is down
+func (s *FallbackIdempotencyStore) Reserve(ctx context.Context, key string) (bool, []byte, error) {
+	if s.dependency.Available() {
+		opCtx, cancel := context.WithTimeout(ctx, fallbackOpTimeout)
+		reserved, result, err := s.primary.Reserve(opCtx, key)
+		cancel()
+		if err == nil {
+			s.dependency.Succeeded()
+			return reserved, result, nil
+		}
+		s.dependency.Failed(err)
+	}
+	return s.local.Reserve(ctx, key)
+}
+
+// Complete records the result in whichever store holds the reservation
+func (s *FallbackIdempotencyStore) Complete(ctx context.Context, key string, result []byte) error {
+	s.tryPrimary(ctx, func(ctx context.Context) error { return s.primary.Complete(ctx, key, result) })
+	return s.local.Complete(ctx, key, result)
+}
+
+// Release frees key in both stores
+func (s *FallbackIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.tryPrimary(ctx, func(ctx context.Context) error { return s.primary.Release(ctx, key) })
+	return s.local.Release(ctx, key)
+}
+
+func (s *FallbackIdempotencyStore) tryPrimary(ctx context.Context, op func(context.Context) error) {
+	if !s.dependency.Available() {
+		return
+	}
+	opCtx, cancel := context.WithTimeout(ctx, fallbackOpTimeout)
+	defer cancel()
+	if err := op(opCtx); err != nil {
+		s.dependency.Failed(err)
+		return
+	}
+	s.dependency.Succeeded()
+}
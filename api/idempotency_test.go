@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/fallback"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore(time.Hour, 2)
+
+	reserved, _, err := store.Reserve(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	reserved, _, _ = store.Reserve(ctx, "a")
+	assert.False(t, reserved, "a reserved key cannot be claimed again")
+
+	require.NoError(t, store.Release(ctx, "a"))
+	reserved, _, _ = store.Reserve(ctx, "a")
+	assert.True(t, reserved, "a released key can be retried")
+
+	// "a" is the least recently used once "b" and "c" arrive
+	store.Reserve(ctx, "b")
+	store.Reserve(ctx, "c")
+	assert.Equal(t, 2, store.Len())
+	reserved, _, _ = store.Reserve(ctx, "a")
+	assert.True(t, reserved, "evicted key is forgotten")
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore(10*time.Millisecond, 10)
+
+	store.Reserve(ctx, "a")
+	require.NoError(t, store.Complete(ctx, "a", []byte("1234")))
+	reserved, _, _ := store.Reserve(ctx, "a")
+	assert.False(t, reserved)
+
+	time.Sleep(20 * time.Millisecond)
+	reserved, _, _ = store.Reserve(ctx, "a")
+	assert.True(t, reserved, "expired key is forgotten")
+}
+
+func TestRedisIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	store, err := NewRedisIdempotencyStore("redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	defer store.Close()
+
+	reserved, _, err := store.Reserve(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	// A second replica sharing the server sees the key
+	other, _ := NewRedisIdempotencyStore("redis://"+server.Addr(), time.Hour)
+	defer other.Close()
+	reserved, _, err = other.Reserve(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, reserved)
+
+	require.NoError(t, store.Complete(ctx, "a", []byte("1234")))
+	assert.Equal(t, time.Hour, server.TTL(redisIdempotencyPrefix+"a"))
+
+	server.FastForward(2 * time.Hour)
+	reserved, _, _ = other.Reserve(ctx, "a")
+	assert.True(t, reserved, "expired key is forgotten")
+}
+
+func TestProcessPaymentReplaysDecline(t *testing.T) {
+	declined := true
+	var calls int
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if declined {
+			w.Write([]byte("response=2&responsetext=DECLINE&transactionid=1&response_code=200"))
+			return
+		}
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=2&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	req := PaymentRequest{
+		APIKey:         "test_key",
+		Amount:         "10.99",
+		CreditCard:     "4111111111111111",
+		ExpDate:        "1230",
+		CVV:            "123",
+		Type:           "sale",
+		IdempotencyKey: "order-42",
+	}
+
+	_, err := client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	first := err.(*NMIError)
+
+	// The retry gets the decline back without a second gateway call
+	declined = false
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, first.Code, err.(*NMIError).Code)
+	assert.Equal(t, "200", err.(*NMIError).ResponseCode)
+	assert.Equal(t, 1, calls)
+
+	// A failed validation releases the key for the corrected request
+	req.IdempotencyKey = "order-46"
+	req.ExpDate = "13"
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	req.ExpDate = "1230"
+	resp, err := client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "2", resp.TransactionID)
+	assert.False(t, resp.IdempotentReplay)
+	assert.Equal(t, 2, calls)
+}
+
+func TestProcessPaymentKeepsKeyAfterAmbiguousFailure(t *testing.T) {
+	var calls int
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	req := PaymentRequest{
+		APIKey:         "test_key",
+		Amount:         "10.99",
+		CreditCard:     "4111111111111111",
+		ExpDate:        "1230",
+		CVV:            "123",
+		Type:           "sale",
+		IdempotencyKey: "order-45",
+	}
+
+	// Refused before it leaves, the payment can be retried with its key
+	client.breaker.ForceOpen()
+	_, err := client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, ErrCircuitOpen, err.(*NMIError).Code)
+	client.breaker.ForceClose()
+
+	// The gateway may have charged the card before failing, so a retry is
+	// not sent again
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, ErrNetworkError, err.(*NMIError).Code)
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, ErrDuplicateTransaction, err.(*NMIError).Code)
+	assert.Equal(t, 1, calls)
+}
+
+func TestProcessPaymentReplaysStoredResponse(t *testing.T) {
+	var calls int
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("response=1&responsetext=SUCCESS&authcode=123456&transactionid=99&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	req := PaymentRequest{
+		APIKey:         "test_key",
+		Amount:         "10.99",
+		CreditCard:     "4111111111111111",
+		ExpDate:        "1230",
+		CVV:            "123",
+		Type:           "sale",
+		IdempotencyKey: "order-43",
+	}
+
+	first, err := client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+	second, err := client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, calls, "the retry is not sent to the gateway")
+	assert.True(t, second.IdempotentReplay)
+	second.IdempotentReplay = false
+	assert.Equal(t, first, second)
+
+	// The key cannot be reused for a different payment
+	changed := req
+	changed.Amount = "109.90"
+	_, err = client.ProcessPayment(context.Background(), changed)
+	require.Error(t, err)
+	assert.Equal(t, ErrConflict, err.(*NMIError).Code)
+	assert.Equal(t, http.StatusConflict, HTTPStatus(err))
+	assert.Equal(t, 1, calls)
+
+	// Another merchant's key of the same name is its own
+	other := WithMerchant(context.Background(), config.Merchant{ID: "m2", APIKey: "other_key"})
+	third, err := client.ProcessPayment(other, req)
+	require.NoError(t, err)
+	assert.False(t, third.IdempotentReplay)
+	assert.Equal(t, 2, calls)
+
+	// A key whose first request is still in flight has nothing to replay
+	client.idempotency.Reserve(context.Background(), merchantIdempotencyKey(context.Background(), "order-44"))
+	req.IdempotencyKey = "order-44"
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, ErrDuplicateTransaction, err.(*NMIError).Code)
+}
+
+func TestFallbackIdempotencyStoreSurvivesRedisOutage(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	primary, err := NewRedisIdempotencyStore("redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	defer primary.Close()
+
+	dependency := fallback.NewDependency("redis_idempotency_test", time.Hour)
+	store := NewFallbackIdempotencyStore(primary, NewMemoryIdempotencyStore(time.Hour, 10), dependency)
+
+	reserved, _, err := store.Reserve(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.True(t, server.Exists(redisIdempotencyPrefix+"a"))
+
+	server.Close()
+
+	reserved, _, err = store.Reserve(ctx, "b")
+	require.NoError(t, err, "payments continue while Redis is down")
+	assert.True(t, reserved)
+	assert.True(t, dependency.Degraded())
+
+	reserved, _, _ = store.Reserve(ctx, "b")
+	assert.False(t, reserved, "the local store still rejects duplicates")
+}
+
+func TestRedisIdempotencyStoreReturnsResult(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	store, err := NewRedisIdempotencyStore("redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	defer store.Close()
+
+	store.Reserve(ctx, "a")
+	_, result, err := store.Reserve(ctx, "a")
+	require.NoError(t, err)
+	assert.Empty(t, result, "nothing to replay while in flight")
+
+	require.NoError(t, store.Complete(ctx, "a", []byte(`{"transactionid":"1"}`)))
+	_, result, err = store.Reserve(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, `{"transactionid":"1"}`, string(result))
+}
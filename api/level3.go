@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// MaxLineItems is the most line items NMI accepts on one transaction
+const MaxLineItems = 99
+
+// LineItem is one Level III line item. Amounts are per line and in dollars.
+type LineItem struct {
+	ProductCode    string  `json:"product_code"`
+	Description    string  `json:"description"`
+	CommodityCode  string  `json:"commodity_code,omitempty"`
+	UnitOfMeasure  string  `json:"unit_of_measure,omitempty"`
+	Quantity       float64 `json:"quantity"`
+	UnitCost       Amount  `json:"unit_cost"`
+	TotalAmount    Amount  `json:"total_amount"`
+	TaxAmount      Amount  `json:"tax_amount,omitempty"`
+	TaxRate        string  `json:"tax_rate,omitempty"`
+	DiscountAmount Amount  `json:"discount_amount,omitempty"`
+}
+
+// hasCommercialData reports whether the request carries any Level II or
+// III data beyond the PO number, which predates this support
+func (req PaymentRequest) hasCommercialData() bool {
+	return req.TaxAmount != "" || req.ShippingAmount != "" || req.DutyAmount != "" ||
+		req.ShippingPostal != "" || req.ShipFromPostal != "" || len(req.LineItems) > 0
+}
+
+// validateLevel3 checks the commercial card data sent for lower B2B
+// interchange. Card brands only grant the Level II rate when tax and a PO
+// number are present, and Level III additionally needs the line items.
+func validateLevel3(req PaymentRequest) error {
+	if !req.hasCommercialData() {
+		return nil
+	}
+
+	if req.Type != "sale" && req.Type != "auth" {
+		return NewNMIError(ErrInvalidRequest, "Level II/III data is only accepted on sale and auth transactions", "")
+	}
+	if req.PONumber == "" {
+		return NewNMIError(ErrInvalidRequest, "ponumber is required with Level II/III data", "")
+	}
+	if req.TaxAmount == "" {
+		return NewNMIError(ErrInvalidRequest, "tax_amount is required with Level II/III data (use 0.00 for tax-exempt purchases)", "")
+	}
+	if req.TaxAmount.Minor() > req.Amount.Minor() {
+		return NewNMIError(ErrInvalidAmount, "tax_amount cannot exceed amount", "")
+	}
+
+	if len(req.LineItems) > MaxLineItems {
+		return NewNMIError(ErrInvalidRequest, "at most "+strconv.Itoa(MaxLineItems)+" line_items are allowed", "")
+	}
+	for i, item := range req.LineItems {
+		field := "line_items[" + strconv.Itoa(i) + "]"
+		if item.ProductCode == "" || item.Description == "" {
+			return NewNMIError(ErrInvalidRequest, field+": product_code and description are required", "")
+		}
+		if item.Quantity <= 0 {
+			return NewNMIError(ErrInvalidRequest, field+": quantity must be greater than 0", "")
+		}
+		if item.UnitCost == "" || item.TotalAmount == "" {
+			return NewNMIError(ErrInvalidAmount, field+": unit_cost and total_amount are required", "")
+		}
+		if item.TaxRate != "" {
+			if _, err := strconv.ParseFloat(item.TaxRate, 64); err != nil {
+				return NewNMIError(ErrInvalidRequest, field+": tax_rate must be a percentage such as 8.25", "")
+			}
+		}
+	}
+	return nil
+}
+
+// addLevel3Info maps Level II/III data onto NMI's fields, numbering line
+// items from 1
+func addLevel3Info(formData url.Values, req PaymentRequest) {
+	setIf := func(key, value string) {
+		if value != "" {
+			formData.Set(key, value)
+		}
+	}
+
+	setIf("tax", req.TaxAmount.String())
+	setIf("shipping", req.ShippingAmount.String())
+	setIf("duty_amount", req.DutyAmount.String())
+	setIf("shipping_postal", req.ShippingPostal)
+	setIf("ship_from_postal", req.ShipFromPostal)
+
+	for i, item := range req.LineItems {
+		n := "_" + strconv.Itoa(i+1)
+		setIf("item_product_code"+n, item.ProductCode)
+		setIf("item_description"+n, item.Description)
+		setIf("item_commodity_code"+n, item.CommodityCode)
+		setIf("item_unit_of_measure"+n, item.UnitOfMeasure)
+		setIf("item_quantity"+n, strconv.FormatFloat(item.Quantity, 'f', -1, 64))
+		setIf("item_unit_cost"+n, item.UnitCost.String())
+		setIf("item_total_amount"+n, item.TotalAmount.String())
+		setIf("item_tax_amount"+n, item.TaxAmount.String())
+		setIf("item_tax_rate"+n, item.TaxRate)
+		setIf("item_discount_amount"+n, item.DiscountAmount.String())
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var widgetItem = LineItem{
+	ProductCode: "WID-100", Description: "Widget", CommodityCode: "44121600", UnitOfMeasure: "EA",
+	Quantity: 4, UnitCost: "25.00", TotalAmount: "100.00", TaxAmount: "8.25", TaxRate: "8.25",
+}
+
+func TestValidateLevel3(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     PaymentRequest
+		wantErr string
+	}{
+		{
+			name: "Level II",
+			req:  PaymentRequest{PONumber: "PO-1", TaxAmount: "8.25"},
+		},
+		{
+			name: "Level III",
+			req:  PaymentRequest{PONumber: "PO-1", TaxAmount: "8.25", ShippingAmount: "10.00", DutyAmount: "0.00", ShippingPostal: "10001", LineItems: []LineItem{widgetItem}},
+		},
+		{
+			name: "PO Number Alone",
+			req:  PaymentRequest{PONumber: "PO-1"},
+		},
+		{
+			name:    "Missing PO Number",
+			req:     PaymentRequest{TaxAmount: "8.25"},
+			wantErr: "ponumber is required",
+		},
+		{
+			name:    "Missing Tax",
+			req:     PaymentRequest{PONumber: "PO-1", LineItems: []LineItem{widgetItem}},
+			wantErr: "tax_amount is required",
+		},
+		{
+			name:    "Tax Above Amount",
+			req:     PaymentRequest{PONumber: "PO-1", TaxAmount: "200.00"},
+			wantErr: "tax_amount cannot exceed amount",
+		},
+		{
+			name:    "Item Without Description",
+			req:     PaymentRequest{PONumber: "PO-1", TaxAmount: "8.25", LineItems: []LineItem{{ProductCode: "WID-100", Quantity: 1, UnitCost: "1.00", TotalAmount: "1.00"}}},
+			wantErr: "line_items[0]: product_code and description are required",
+		},
+		{
+			name:    "Item Without Quantity",
+			req:     PaymentRequest{PONumber: "PO-1", TaxAmount: "8.25", LineItems: []LineItem{{ProductCode: "WID-100", Description: "Widget", UnitCost: "1.00", TotalAmount: "1.00"}}},
+			wantErr: "quantity must be greater than 0",
+		},
+		{
+			name:    "Too Many Items",
+			req:     PaymentRequest{PONumber: "PO-1", TaxAmount: "8.25", LineItems: make([]LineItem, MaxLineItems+1)},
+			wantErr: "at most 99 line_items",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Amount = "118.25"
+			tt.req.Type = "sale"
+			tt.req.CustomerVaultID = "123456789"
+			err := ValidatePaymentRequest(tt.req)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var nmiErr *NMIError
+			require.True(t, errors.As(err, &nmiErr))
+			assert.Contains(t, nmiErr.Message, tt.wantErr)
+		})
+	}
+}
+
+func TestLineItemsDecodeAmounts(t *testing.T) {
+	var req PaymentRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"tax_amount":8.5,"line_items":[{"product_code":"A","description":"B","quantity":1.5,"unit_cost":"2.0","total_amount":3.0}]}`), &req))
+	assert.Equal(t, Amount("8.50"), req.TaxAmount)
+	assert.Equal(t, Amount("3.00"), req.LineItems[0].TotalAmount)
+
+	// Unit costs follow the same rules as amount
+	assert.Error(t, json.Unmarshal([]byte(`{"line_items":[{"unit_cost":"2"}]}`), &req))
+}
+
+func TestProcessPaymentMapsLevel3Fields(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=777&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	second := widgetItem
+	second.ProductCode, second.Quantity, second.TaxAmount, second.TaxRate = "FRT", 0.5, "", ""
+	_, err := client.ProcessPayment(context.Background(), PaymentRequest{
+		Amount: "118.25", Type: "sale", CustomerVaultID: "123456789", PONumber: "PO-1",
+		TaxAmount: "8.25", ShippingAmount: "10.00", DutyAmount: "1.50", ShippingPostal: "10001",
+		LineItems: []LineItem{widgetItem, second},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "PO-1", form.Get("ponumber"))
+	assert.Equal(t, "8.25", form.Get("tax"))
+	assert.Equal(t, "10.00", form.Get("shipping"))
+	assert.Equal(t, "1.50", form.Get("duty_amount"))
+	assert.Equal(t, "10001", form.Get("shipping_postal"))
+	assert.Equal(t, "WID-100", form.Get("item_product_code_1"))
+	assert.Equal(t, "Widget", form.Get("item_description_1"))
+	assert.Equal(t, "44121600", form.Get("item_commodity_code_1"))
+	assert.Equal(t, "EA", form.Get("item_unit_of_measure_1"))
+	assert.Equal(t, "4", form.Get("item_quantity_1"))
+	assert.Equal(t, "25.00", form.Get("item_unit_cost_1"))
+	assert.Equal(t, "100.00", form.Get("item_total_amount_1"))
+	assert.Equal(t, "8.25", form.Get("item_tax_amount_1"))
+	assert.Equal(t, "FRT", form.Get("item_product_code_2"))
+	assert.Equal(t, "0.5", form.Get("item_quantity_2"))
+	assert.False(t, form.Has("item_tax_amount_2"))
+	assert.False(t, form.Has("item_product_code_3"))
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+
+	"nmi-pay-int/config"
+)
+
+type merchantKey struct{}
+
+// WithMerchant returns a context whose gateway calls are for merchant m
+func WithMerchant(ctx context.Context, m config.Merchant) context.Context {
+	return context.WithValue(ctx, merchantKey{}, m)
+}
+
+// MerchantFromContext returns the merchant attached to ctx, if any
+func MerchantFromContext(ctx context.Context) (config.Merchant, bool) {
+	m, ok := ctx.Value(merchantKey{}).(config.Merchant)
+	return m, ok
+}
+
+// applyMerchantDefaults fills the descriptor and currency a request leaves
+// empty from the merchant on ctx
+func applyMerchantDefaults(ctx context.Context, req *PaymentRequest) {
+	m, ok := MerchantFromContext(ctx)
+	if !ok {
+		return
+	}
+	if req.Descriptor == "" {
+		req.Descriptor = m.Descriptor
+	}
+	if req.Currency == "" {
+		req.Currency = m.Currency
+	}
+}
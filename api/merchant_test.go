@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessPaymentUsesMerchantDefaults(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=777&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	ctx := WithMerchant(context.Background(), config.Merchant{ID: "eu-store", APIKey: "eu-key", Descriptor: "EU STORE", Currency: "EUR"})
+	_, err := client.ProcessPayment(ctx, PaymentRequest{APIKey: "eu-key", Amount: "10.00", Type: "sale", CustomerVaultID: "123456789"})
+	require.NoError(t, err)
+	assert.Equal(t, "EUR", form.Get("currency"))
+	assert.Equal(t, "EU STORE", form.Get("descriptor"))
+
+	// Values on the request win over the merchant's
+	_, err = client.ProcessPayment(ctx, PaymentRequest{APIKey: "eu-key", Amount: "10.00", Type: "sale", CustomerVaultID: "123456789", Currency: "GBP"})
+	require.NoError(t, err)
+	assert.Equal(t, "GBP", form.Get("currency"))
+
+	// Without a merchant nothing is added
+	_, err = client.ProcessPayment(context.Background(), PaymentRequest{Amount: "10.00", Type: "sale", CustomerVaultID: "123456789"})
+	require.NoError(t, err)
+	assert.False(t, form.Has("currency"))
+	assert.False(t, form.Has("descriptor"))
+}
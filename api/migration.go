@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Migration job statuses
+const (
+	MigrationRunning   = "running"
+	MigrationCompleted = "completed"
+	MigrationCancelled = "cancelled"
+)
+
+// Per-subscription migration results
+const (
+	MigrationResultMigrated     = "migrated"
+	MigrationResultWouldMigrate = "would_migrate"
+	MigrationResultFailed       = "failed"
+)
+
+// defaultMigrationRate is the number of gateway updates sent per second
+const defaultMigrationRate = 2.0
+
+// MigrationRequest moves every active subscription of a merchant from one
+// plan to another
+type MigrationRequest struct {
+	APIKey string `json:"api_key,omitempty"`
+	// MerchantID is the merchant account whose subscriptions move, set by
+	// the caller from the request's merchant
+	MerchantID string  `json:"-"`
+	FromPlanID string  `json:"from_plan_id"`
+	ToPlanID   string  `json:"to_plan_id"`
+	DryRun     bool    `json:"dry_run"`
+	RateLimit  float64 `json:"rate_limit,omitempty"` // gateway updates per second
+	// ResumeID continues a previous migration, skipping subscriptions it
+	// already migrated
+	ResumeID string `json:"resume_id,omitempty"`
+}
+
+// MigrationResult is the outcome for a single subscription
+type MigrationResult struct {
+	SubscriptionID string `json:"subscription_id"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+}
+
+// MigrationJob tracks the progress of a plan migration
+type MigrationJob struct {
+	mu          sync.Mutex
+	ID          string
+	MerchantID  string
+	FromPlanID  string
+	ToPlanID    string
+	DryRun      bool
+	Status      string
+	Total       int
+	Results     map[string]MigrationResult
+	StartedAt   time.Time
+	CompletedAt *time.Time
+	// cancel stops the run before its remaining gateway updates
+	cancel context.CancelFunc
+}
+
+// MigrationSummary is a point-in-time copy of a job safe to encode
+type MigrationSummary struct {
+	ID          string            `json:"id"`
+	FromPlanID  string            `json:"from_plan_id"`
+	ToPlanID    string            `json:"to_plan_id"`
+	DryRun      bool              `json:"dry_run"`
+	Status      string            `json:"status"`
+	Total       int               `json:"total"`
+	Migrated    int               `json:"migrated"`
+	Failed      int               `json:"failed"`
+	Results     []MigrationResult `json:"results"`
+	StartedAt   time.Time         `json:"started_at"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+}
+
+// MigrationStore keeps migration jobs so they can be inspected and resumed
+var MigrationStore = struct {
+	sync.RWMutex
+	Data map[string]*MigrationJob
+}{Data: make(map[string]*MigrationJob)}
+
+// StartSubscriptionMigration validates the request and migrates matching
+// subscriptions in the background, returning the job to poll. Invalid
+// requests fail with an invalid_request *NMIError; any other error is
+// internal.
+func (c *Client) StartSubscriptionMigration(req MigrationRequest) (*MigrationJob, error) {
+	if req.FromPlanID == "" || req.ToPlanID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "from_plan_id and to_plan_id are required", "")
+	}
+	if req.FromPlanID == req.ToPlanID {
+		return nil, NewNMIError(ErrInvalidRequest, "from_plan_id and to_plan_id must differ", "")
+	}
+
+	toPlan, err := c.plans.Get(context.Background(), req.ToPlanID)
+	if errors.Is(err, ErrPlanNotFound) {
+		return nil, NewNMIError(ErrInvalidRequest, "to_plan_id does not exist", "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load plan %s: %w", req.ToPlanID, err)
+	}
+
+	job := &MigrationJob{
+		ID:         "mig_" + generateUniqueVaultID(),
+		MerchantID: req.MerchantID,
+		FromPlanID: req.FromPlanID,
+		ToPlanID:   req.ToPlanID,
+		DryRun:     req.DryRun,
+		Status:     MigrationRunning,
+		Results:    make(map[string]MigrationResult),
+		StartedAt:  time.Now(),
+	}
+
+	// Carry over successful results so a resumed run skips them
+	if req.ResumeID != "" {
+		previous, exists := GetMigration(req.MerchantID, req.ResumeID)
+		if !exists {
+			return nil, NewNMIError(ErrInvalidRequest, "resume_id does not exist", "")
+		}
+		previous.mu.Lock()
+		if previous.Status == MigrationRunning {
+			previous.mu.Unlock()
+			return nil, NewNMIError(ErrInvalidRequest, "migration is still running", "")
+		}
+		// Results only carry over between runs of the same migration
+		if previous.FromPlanID != req.FromPlanID || previous.ToPlanID != req.ToPlanID {
+			previous.mu.Unlock()
+			return nil, NewNMIError(ErrInvalidRequest, fmt.Sprintf("resume_id is a migration from %s to %s", previous.FromPlanID, previous.ToPlanID), "")
+		}
+		job.ID = previous.ID
+		for id, result := range previous.Results {
+			if result.Status == MigrationResultMigrated {
+				job.Results[id] = result
+			}
+		}
+		previous.mu.Unlock()
+	}
+
+	// A carried-over subscription whose local record still shows the old
+	// plan is not sent to the gateway again
+	var subs []Subscription
+	for _, sub := range subscriptionsForPlan(req.MerchantID, req.FromPlanID) {
+		if _, done := job.Results[sub.ID]; !done {
+			subs = append(subs, sub)
+		}
+	}
+	job.Total = len(subs) + len(job.Results)
+
+	MigrationStore.Lock()
+	MigrationStore.Data[job.ID] = job
+	MigrationStore.Unlock()
+
+	limit := req.RateLimit
+	if limit <= 0 {
+		limit = defaultMigrationRate
+	}
+
+	ctx, cancel := context.WithCancel(WithActor(context.Background(), ActorScheduler))
+	job.cancel = cancel
+	go job.run(ctx, c, req.APIKey, toPlan, subs, rate.NewLimiter(rate.Limit(limit), 1))
+
+	return job, nil
+}
+
+// Cancel stops a running migration before its next gateway update.
+// Subscriptions already updated stay migrated; resume the job to finish.
+func (job *MigrationJob) Cancel() {
+	job.cancel()
+}
+
+// run sends one throttled gateway update per subscription until ctx ends
+func (job *MigrationJob) run(ctx context.Context, c *Client, apiKey string, toPlan Plan, subs []Subscription, limiter *rate.Limiter) {
+	defer job.cancel()
+
+	status := MigrationCompleted
+	for _, sub := range subs {
+		result := MigrationResult{SubscriptionID: sub.ID, Status: MigrationResultMigrated}
+
+		if job.DryRun {
+			result.Status = MigrationResultWouldMigrate
+		} else {
+			if err := limiter.Wait(ctx); err != nil {
+				status = MigrationCancelled
+				break
+			}
+
+			// An update already sent finishes, so its result is known
+			_, err := c.UpdateRecurringPayment(context.WithoutCancel(ctx), RecurringPaymentRequest{
+				APIKey:          apiKey,
+				CustomerVaultID: sub.CustomerVaultID,
+				PlanID:          toPlan.ID,
+				Amount:          toPlan.Amount,
+			}, sub.ID)
+			if err != nil {
+				result.Status = MigrationResultFailed
+				result.Error = err.Error()
+			}
+		}
+
+		job.mu.Lock()
+		job.Results[sub.ID] = result
+		job.mu.Unlock()
+	}
+
+	now := time.Now()
+	job.mu.Lock()
+	job.Status = status
+	job.CompletedAt = &now
+	job.mu.Unlock()
+}
+
+// Summary returns a consistent copy of the job with results sorted by ID
+func (job *MigrationJob) Summary() MigrationSummary {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	summary := MigrationSummary{
+		ID:          job.ID,
+		FromPlanID:  job.FromPlanID,
+		ToPlanID:    job.ToPlanID,
+		DryRun:      job.DryRun,
+		Status:      job.Status,
+		Total:       job.Total,
+		StartedAt:   job.StartedAt,
+		CompletedAt: job.CompletedAt,
+		Results:     make([]MigrationResult, 0, len(job.Results)),
+	}
+	for _, result := range job.Results {
+		switch result.Status {
+		case MigrationResultMigrated:
+			summary.Migrated++
+		case MigrationResultFailed:
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+	sort.Slice(summary.Results, func(i, j int) bool {
+		return summary.Results[i].SubscriptionID < summary.Results[j].SubscriptionID
+	})
+
+	return summary
+}
+
+// GetMigration returns a merchant's migration job by ID. Other merchants'
+// jobs are not found.
+func GetMigration(merchantID, id string) (*MigrationJob, bool) {
+	MigrationStore.RLock()
+	defer MigrationStore.RUnlock()
+	job, exists := MigrationStore.Data[id]
+	if !exists || job.MerchantID != merchantID {
+		return nil, false
+	}
+	return job, true
+}
+
+// String describes the job for transaction logs
+func (job *MigrationJob) String() string {
+	return fmt.Sprintf("migration %s (%s -> %s, dry_run=%t)", job.ID, job.FromPlanID, job.ToPlanID, job.DryRun)
+}
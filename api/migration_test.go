@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// migrationGateway answers subscription updates, failing those for the
+// subscriptions in failing, and returns a client using it with plans
+// from and to, from having the given active subscriptions
+func migrationGateway(t *testing.T, from, to string, subs []string, failing *sync.Map) *Client {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if _, fail := failing.Load(r.PostForm.Get("subscription_id")); fail {
+			w.Write([]byte("response=3&responsetext=Invalid Subscription ID&response_code=300"))
+			return
+		}
+		w.Write([]byte("response=1&responsetext=Subscription Updated&response_code=100"))
+	}))
+	t.Cleanup(gateway.Close)
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	for _, id := range []string{from, to} {
+		_, err := client.Plans().Create(context.Background(), Plan{ID: id, Name: id, Amount: "30.00", MonthFrequency: "1", DayOfMonth: "1"})
+		require.NoError(t, err)
+	}
+	for _, id := range subs {
+		saveSubscription(Subscription{ID: id, CustomerVaultID: "cv-" + id, PlanID: from})
+	}
+	t.Cleanup(func() {
+		SubscriptionStore.Lock()
+		defer SubscriptionStore.Unlock()
+		for _, id := range subs {
+			delete(SubscriptionStore.Data, id)
+		}
+	})
+	return client
+}
+
+func waitForMigration(t *testing.T, job *MigrationJob) MigrationSummary {
+	t.Helper()
+	require.Eventually(t, func() bool { return job.Summary().Status != MigrationRunning }, 5*time.Second, 5*time.Millisecond)
+	return job.Summary()
+}
+
+func TestSubscriptionMigration(t *testing.T) {
+	tests := []struct {
+		name         string
+		failing      []string
+		dryRun       bool
+		wantMigrated int
+		wantFailed   int
+		wantResults  map[string]string
+	}{
+		{
+			name:         "all migrate",
+			wantMigrated: 3,
+			wantResults:  map[string]string{"1": MigrationResultMigrated, "2": MigrationResultMigrated, "3": MigrationResultMigrated},
+		},
+		{
+			name:         "partial failure",
+			failing:      []string{"2"},
+			wantMigrated: 2,
+			wantFailed:   1,
+			wantResults:  map[string]string{"1": MigrationResultMigrated, "2": MigrationResultFailed, "3": MigrationResultMigrated},
+		},
+		{
+			name:        "dry run",
+			dryRun:      true,
+			failing:     []string{"2"},
+			wantResults: map[string]string{"1": MigrationResultWouldMigrate, "2": MigrationResultWouldMigrate, "3": MigrationResultWouldMigrate},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := "mig-" + t.Name() + "-"
+			var failing sync.Map
+			for _, id := range tt.failing {
+				failing.Store(prefix+id, true)
+			}
+			client := migrationGateway(t, prefix+"old", prefix+"new", []string{prefix + "1", prefix + "2", prefix + "3"}, &failing)
+
+			job, err := client.StartSubscriptionMigration(MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "new", DryRun: tt.dryRun, RateLimit: 1000})
+			require.NoError(t, err)
+			summary := waitForMigration(t, job)
+
+			assert.Equal(t, MigrationCompleted, summary.Status)
+			assert.Equal(t, 3, summary.Total)
+			assert.Equal(t, tt.wantMigrated, summary.Migrated)
+			assert.Equal(t, tt.wantFailed, summary.Failed)
+			for _, result := range summary.Results {
+				assert.Equal(t, tt.wantResults[result.SubscriptionID[len(prefix):]], result.Status, result.SubscriptionID)
+			}
+		})
+	}
+}
+
+func TestResumeSubscriptionMigration(t *testing.T) {
+	prefix := "mig-resume-"
+	var failing sync.Map
+	failing.Store(prefix+"2", true)
+	client := migrationGateway(t, prefix+"old", prefix+"new", []string{prefix + "1", prefix + "2"}, &failing)
+	_, err := client.Plans().Create(context.Background(), Plan{ID: prefix + "other", Name: "Other", Amount: "40.00", MonthFrequency: "1", DayOfMonth: "1"})
+	require.NoError(t, err)
+
+	first, err := client.StartSubscriptionMigration(MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "new", RateLimit: 1000})
+	require.NoError(t, err)
+	require.Equal(t, 1, waitForMigration(t, first).Failed)
+
+	tests := []struct {
+		name    string
+		req     MigrationRequest
+		wantErr string
+	}{
+		{
+			name:    "unknown job",
+			req:     MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "new", ResumeID: "mig_unknown"},
+			wantErr: "resume_id does not exist",
+		},
+		{
+			name:    "different target plan",
+			req:     MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "other", ResumeID: first.ID},
+			wantErr: "resume_id is a migration from " + prefix + "old to " + prefix + "new",
+		},
+		{
+			name: "same plans",
+			req:  MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "new", ResumeID: first.ID, RateLimit: 1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr == "" {
+				failing.Delete(prefix + "2")
+				// The migrated subscription is not updated again even if
+				// its local record still shows the old plan
+				failing.Store(prefix+"1", true)
+				SubscriptionStore.Lock()
+				sub := SubscriptionStore.Data[prefix+"1"]
+				sub.PlanID = prefix + "old"
+				SubscriptionStore.Data[prefix+"1"] = sub
+				SubscriptionStore.Unlock()
+			}
+			job, err := client.StartSubscriptionMigration(tt.req)
+			if tt.wantErr != "" {
+				var nmiErr *NMIError
+				require.ErrorAs(t, err, &nmiErr)
+				assert.Equal(t, tt.wantErr, nmiErr.Message)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, first.ID, job.ID)
+			summary := waitForMigration(t, job)
+			assert.Equal(t, 2, summary.Total)
+			assert.Equal(t, 2, summary.Migrated, "the earlier success is carried over and the failure retried")
+			assert.Zero(t, summary.Failed)
+		})
+	}
+}
+
+func TestCancelSubscriptionMigration(t *testing.T) {
+	prefix := "mig-cancel-"
+	client := migrationGateway(t, prefix+"old", prefix+"new", []string{prefix + "1", prefix + "2", prefix + "3"}, &sync.Map{})
+
+	// One update goes out at once; the next would wait an hour
+	job, err := client.StartSubscriptionMigration(MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "new", RateLimit: 1.0 / 3600})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return job.Summary().Migrated == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	job.Cancel()
+	summary := waitForMigration(t, job)
+	assert.Equal(t, MigrationCancelled, summary.Status)
+	assert.Equal(t, 1, summary.Migrated)
+	assert.Len(t, summary.Results, 1, "no update is sent after cancelling")
+	assert.NotNil(t, summary.CompletedAt)
+}
+
+func TestSubscriptionMigrationStaysWithinMerchant(t *testing.T) {
+	prefix := "mig-merchant-"
+	client := migrationGateway(t, prefix+"old", prefix+"new", []string{prefix + "1"}, &sync.Map{})
+	saveSubscription(Subscription{ID: prefix + "2", CustomerVaultID: "cv-2", PlanID: prefix + "old", MerchantID: "wholesale"})
+	defer func() {
+		SubscriptionStore.Lock()
+		delete(SubscriptionStore.Data, prefix+"2")
+		SubscriptionStore.Unlock()
+	}()
+
+	job, err := client.StartSubscriptionMigration(MigrationRequest{MerchantID: "wholesale", FromPlanID: prefix + "old", ToPlanID: prefix + "new", RateLimit: 1000})
+	require.NoError(t, err)
+	summary := waitForMigration(t, job)
+	assert.Equal(t, 1, summary.Total)
+	require.Len(t, summary.Results, 1)
+	assert.Equal(t, prefix+"2", summary.Results[0].SubscriptionID)
+
+	// Other merchants neither see nor resume the job
+	_, found := GetMigration("", job.ID)
+	assert.False(t, found)
+	_, err = client.StartSubscriptionMigration(MigrationRequest{FromPlanID: prefix + "old", ToPlanID: prefix + "new", ResumeID: job.ID})
+	assert.Error(t, err)
+	sub, _ := GetSubscription(prefix + "1")
+	assert.Equal(t, prefix+"old", sub.PlanID)
+}
+
+func TestStartSubscriptionMigrationPlanStoreError(t *testing.T) {
+	client := NewClient(&config.Config{}, WithPlanRepository(failingPlans{}))
+
+	_, err := client.StartSubscriptionMigration(MigrationRequest{FromPlanID: "old", ToPlanID: "new"})
+	require.Error(t, err)
+	var nmiErr *NMIError
+	assert.False(t, errors.As(err, &nmiErr), "store failures are internal, not invalid requests")
+}
+
+// failingPlans is a plan repository whose database is down
+type failingPlans struct{ PlanRepository }
+
+func (failingPlans) Get(ctx context.Context, id string) (Plan, error) {
+	return Plan{}, errors.New("connection refused")
+}
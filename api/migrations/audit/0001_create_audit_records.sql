@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS audit_records (
+    seq            BIGINT PRIMARY KEY,
+    created_at     TIMESTAMP NOT NULL,
+    merchant_id    TEXT NOT NULL,
+    actor          TEXT NOT NULL,
+    caller         TEXT NOT NULL DEFAULT '',
+    request_id     TEXT NOT NULL DEFAULT '',
+    operation      TEXT NOT NULL,
+    subject        TEXT NOT NULL DEFAULT '',
+    amount         TEXT NOT NULL DEFAULT '',
+    request_hash   TEXT NOT NULL,
+    outcome        TEXT NOT NULL,
+    transaction_id TEXT NOT NULL DEFAULT '',
+    response_code  TEXT NOT NULL DEFAULT '',
+    response_text  TEXT NOT NULL DEFAULT '',
+    prev_hash      TEXT NOT NULL,
+    hash           TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_records_merchant_seq ON audit_records (merchant_id, seq);
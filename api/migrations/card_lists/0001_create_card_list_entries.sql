@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS card_list_entries (
+    merchant_id TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    list        TEXT NOT NULL,
+    reason      TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (merchant_id, fingerprint)
+);
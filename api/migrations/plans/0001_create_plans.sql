@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS plans (
+    id              TEXT PRIMARY KEY,
+    name            TEXT NOT NULL,
+    amount          TEXT NOT NULL,
+    day_frequency   TEXT NOT NULL DEFAULT '',
+    payments        TEXT NOT NULL DEFAULT '',
+    month_frequency TEXT NOT NULL DEFAULT '',
+    day_of_month    TEXT NOT NULL DEFAULT '',
+    version         INTEGER NOT NULL DEFAULT 1,
+    created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS refunds (
+    refund_id      TEXT PRIMARY KEY,
+    transaction_id TEXT NOT NULL,
+    amount         TEXT NOT NULL,
+    created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS refunds_transaction_id ON refunds (transaction_id);
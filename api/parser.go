@@ -18,6 +18,10 @@ type NMIResponse struct {
 	ResponseCode    string `json:"response_code"`
 	Amount          string `json:"amount,omitempty"`
 	CustomerVaultID string `json:"customer_vault_id,omitempty"`
+
+	// Values retains every field NMI returned, including ones without a
+	// struct field
+	Values url.Values `json:"-"`
 }
 
 // ParseNMIResponse parses NMI's response with enhanced error handling
@@ -39,10 +43,14 @@ func ParseNMIResponse(rawResponse string) (*NMIResponse, error) {
 		ResponseCode:    values.Get("response_code"),
 		Amount:          values.Get("amount"),
 		CustomerVaultID: values.Get("customer_vault_id"),
+		Values:          values,
 	}
 
 	if response.Response != "1" {
-		return response, ParseNMIErrorResponse(response.ResponseText, response.ResponseCode, rawResponse)
+		nmiErr := ParseNMIErrorResponse(response.ResponseText, response.ResponseCode, rawResponse)
+		nmiErr.AVSResponse = response.AVSResponse
+		nmiErr.CVVResponse = response.CVVResponse
+		return response, nmiErr
 	}
 
 	return response, nil
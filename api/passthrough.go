@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/url"
+
+	"nmi-pay-int/pci"
+)
+
+// passthroughFields copies the allowlisted NMI response fields into a map for
+// the API response. Fields that are masked in logs are never passed through.
+func (c *Client) passthroughFields(values url.Values) map[string]string {
+	if len(c.responseFields) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, name := range c.responseFields {
+		if pci.Sensitive(name) {
+			continue
+		}
+		if value := values.Get(name); value != "" {
+			fields[name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
@@ -1,46 +1,75 @@
 package api
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
+	"nmi-pay-int/bins"
+	"nmi-pay-int/logctx"
 	"nmi-pay-int/metrics"
+	"nmi-pay-int/pci"
 
 	"github.com/gorilla/mux"
-)
-
-var (
-	transactionCache = struct {
-		sync.RWMutex
-		processed map[string]bool
-	}{processed: make(map[string]bool)}
+	"github.com/sirupsen/logrus"
 )
 
 // Request Structures
 type PaymentRequest struct {
-	APIKey           string       `json:"api_key,omitempty"`
-	Amount           string       `json:"amount"`
-	CreditCard       string       `json:"credit_card,omitempty"`
-	ExpDate          string       `json:"exp_date,omitempty"`
-	CVV              string       `json:"cvv,omitempty"`
-	Token            string       `json:"token,omitempty"`
-	CustomerVaultID  string       `json:"customer_vault_id,omitempty"`
+	APIKey          string `json:"api_key,omitempty"`
+	Amount          Amount `json:"amount"`
+	CreditCard      string `json:"credit_card,omitempty"`
+	ExpDate         string `json:"exp_date,omitempty"`
+	CVV             string `json:"cvv,omitempty"`
+	Token           string `json:"token,omitempty"`
+	CustomerVaultID string `json:"customer_vault_id,omitempty"`
+	// PaymentToken is a Collect.js token standing in for the card fields,
+	// so the card number never reaches this service
+	PaymentToken     string       `json:"payment_token,omitempty"`
 	Type             string       `json:"type"`
 	OrderID          string       `json:"order_id,omitempty"`
+	OrderDescription string       `json:"order_description,omitempty"`
+	PONumber         string       `json:"ponumber,omitempty"`
 	CustomerID       string       `json:"customer_id,omitempty"`
+	Currency         string       `json:"currency,omitempty"`
+	Descriptor       string       `json:"descriptor,omitempty"`
 	IdempotencyKey   string       `json:"idempotency_key,omitempty"`
 	RecurringPayment bool         `json:"recurring_payment,omitempty"`
 	PlanID           string       `json:"plan_id,omitempty"`
 	Billing          *BillingInfo `json:"billing,omitempty"`
+	// CustomerReceipt asks NMI to email its own receipt to billing.email;
+	// when omitted the merchant's configured default applies
+	CustomerReceipt *bool `json:"customer_receipt,omitempty"`
+
+	// 3-D Secure results from the merchant's own MPI, passed through to NMI
+	CAVV              string `json:"cavv,omitempty"`
+	XID               string `json:"xid,omitempty"`
+	ECI               string `json:"eci,omitempty"`
+	DirectoryServerID string `json:"directory_server_id,omitempty"`
+	ThreeDSVersion    string `json:"three_ds_version,omitempty"`
+	CardholderAuth    string `json:"cardholder_auth,omitempty"`
+
+	// Wallet payments replace the card fields with an Apple Pay or Google
+	// Pay token, either still encrypted or decrypted by the merchant
+	WalletType          string          `json:"wallet_type,omitempty"`
+	ApplePayPaymentData json.RawMessage `json:"apple_pay_payment_data,omitempty"`
+	GooglePayToken      json.RawMessage `json:"google_pay_token,omitempty"`
+
+	// Level II/III commercial card data; with PONumber it qualifies B2B
+	// card payments for lower interchange
+	TaxAmount      Amount     `json:"tax_amount,omitempty"`
+	ShippingAmount Amount     `json:"shipping_amount,omitempty"`
+	DutyAmount     Amount     `json:"duty_amount,omitempty"`
+	ShippingPostal string     `json:"shipping_postal,omitempty"`
+	ShipFromPostal string     `json:"ship_from_postal,omitempty"`
+	LineItems      []LineItem `json:"line_items,omitempty"`
 }
 
 type BillingInfo struct {
@@ -70,43 +99,68 @@ type PaymentResponse struct {
 	ResponseCode    string `json:"response_code"`
 	ErrorMessage    string `json:"error_message,omitempty"`
 	CustomerVaultID string `json:"customer_vault_id,omitempty"`
+	MaskedCard      string `json:"masked_card,omitempty"`
+	CardType        string `json:"card_type,omitempty"`
+	ExpiryDate      string `json:"expiry_date,omitempty"`
+	// ExtraFields holds allowlisted NMI fields without a dedicated field
+	ExtraFields map[string]string `json:"extra_fields,omitempty"`
+	// IdempotentReplay is set when this is the stored response to an earlier
+	// request with the same idempotency key rather than a new charge
+	IdempotentReplay bool `json:"idempotent_replay,omitempty"`
+	// ThreeDSecure echoes the 3-D Secure data the payment was submitted with
+	ThreeDSecure *ThreeDSResult `json:"three_ds,omitempty"`
+	// Surcharge breaks out the card fee the merchant's surcharge rules
+	// added to the amount
+	Surcharge *Surcharge `json:"surcharge,omitempty"`
+	// Verification is the merchant's AVS/CVV policy decision
+	Verification *VerificationDecision `json:"verification,omitempty"`
+	// Card is the brand, level and issuing country of the card number
+	Card *bins.Card `json:"card,omitempty"`
+	// CardFingerprint identifies the card on the merchant's card lists
+	CardFingerprint string `json:"card_fingerprint,omitempty"`
 }
 
 type RefundResponse struct {
-	RawResponse   string `json:"raw_response"`
-	StatusCode    int    `json:"status_code"`
-	Response      string `json:"response"`
-	ResponseText  string `json:"responsetext"`
-	AuthCode      string `json:"authcode"`
-	TransactionID string `json:"transactionid"`
-	Type          string `json:"type"`
-	ResponseCode  string `json:"response_code"`
-	Amount        string `json:"amount"`
-	ErrorMessage  string `json:"error_message,omitempty"`
+	RawResponse   string            `json:"raw_response"`
+	StatusCode    int               `json:"status_code"`
+	Response      string            `json:"response"`
+	ResponseText  string            `json:"responsetext"`
+	AuthCode      string            `json:"authcode"`
+	TransactionID string            `json:"transactionid"`
+	Type          string            `json:"type"`
+	ResponseCode  string            `json:"response_code"`
+	Amount        string            `json:"amount"`
+	ErrorMessage  string            `json:"error_message,omitempty"`
+	ExtraFields   map[string]string `json:"extra_fields,omitempty"`
 }
 
 type VoidResponse struct {
-	RawResponse   string `json:"raw_response"`
-	StatusCode    int    `json:"status_code"`
-	Response      string `json:"response"`
-	ResponseText  string `json:"responsetext"`
-	AuthCode      string `json:"authcode"`
-	TransactionID string `json:"transactionid"`
-	Type          string `json:"type"`
-	ResponseCode  string `json:"response_code"`
-	ErrorMessage  string `json:"error_message,omitempty"`
+	RawResponse   string            `json:"raw_response"`
+	StatusCode    int               `json:"status_code"`
+	Response      string            `json:"response"`
+	ResponseText  string            `json:"responsetext"`
+	AuthCode      string            `json:"authcode"`
+	TransactionID string            `json:"transactionid"`
+	Type          string            `json:"type"`
+	ResponseCode  string            `json:"response_code"`
+	ErrorMessage  string            `json:"error_message,omitempty"`
+	ExtraFields   map[string]string `json:"extra_fields,omitempty"`
 }
 
 type LookupResponse struct {
-	RawResponse   string `json:"raw_response"`
-	StatusCode    int    `json:"status_code"`
-	Response      string `json:"response"`
-	ResponseText  string `json:"responsetext"`
-	TransactionID string `json:"transactionid"`
-	Type          string `json:"type"`
-	Amount        string `json:"amount"`
-	ResponseCode  string `json:"response_code"`
-	ErrorMessage  string `json:"error_message,omitempty"`
+	RawResponse   string        `json:"raw_response"`
+	StatusCode    int           `json:"status_code"`
+	Response      string        `json:"response"`
+	ResponseText  string        `json:"responsetext"`
+	TransactionID string        `json:"transactionid"`
+	Type          string        `json:"type"`
+	Amount        string        `json:"amount"`
+	ResponseCode  string        `json:"response_code"`
+	DeclineReason DeclineReason `json:"decline_reason,omitempty"`
+	// DeclineCategory says whether a declined transaction can be retried
+	DeclineCategory DeclineCategory    `json:"decline_category,omitempty"`
+	ErrorMessage    string             `json:"error_message,omitempty"`
+	Record          *TransactionRecord `json:"record,omitempty"`
 }
 
 type TokenizeResponse struct {
@@ -117,6 +171,10 @@ type TokenizeResponse struct {
 	ExpiryDate      string `json:"expiry_date"`
 	Success         bool   `json:"success"`
 	Message         string `json:"message"`
+	ResponseCode    string `json:"response_code,omitempty"`
+	AVSResponse     string `json:"avsresponse,omitempty"`
+	CVVResponse     string `json:"cvvresponse,omitempty"`
+	CardFingerprint string `json:"card_fingerprint,omitempty"`
 }
 
 type RecurringResponse struct {
@@ -126,6 +184,11 @@ type RecurringResponse struct {
 	PlanID          string `json:"plan_id"`
 	Amount          string `json:"amount"`
 	CustomerVaultID string `json:"customer_vault_id"`
+	// StartDate is the first day the plan is charged, when set by a trial,
+	// first_charge or start_date
+	StartDate string `json:"start_date,omitempty"`
+	// TrialTransactionID is the sale that charged the trial amount
+	TrialTransactionID string `json:"trial_transaction_id,omitempty"`
 }
 
 type RefundRequest struct {
@@ -140,11 +203,27 @@ type VoidRequest struct {
 }
 
 type LookupRequest struct {
-	APIKey          string `json:"api_key,omitempty"`
-	TransactionID   string `json:"transaction_id"`
+	APIKey        string `json:"api_key,omitempty"`
+	TransactionID string `json:"transaction_id"`
+	// Without a transaction ID, transactions are found by order, vault
+	// customer or customer ID and returned a page at a time
+	OrderID         string `json:"order_id,omitempty"`
+	CustomerVaultID string `json:"customer_vault_id,omitempty"`
+	CustomerID      string `json:"customer_id,omitempty"`
 	Condition       string `json:"condition,omitempty"`
 	TransactionType string `json:"transaction_type,omitempty"`
 	ActionType      string `json:"action_type,omitempty"`
+	Page            int    `json:"page,omitempty"`
+	Limit           int    `json:"limit,omitempty"`
+}
+
+// LookupResults is one page of the transactions matching a lookup by order
+// or customer
+type LookupResults struct {
+	Transactions []LookupResponse `json:"transactions"`
+	Page         int              `json:"page"`
+	Limit        int              `json:"limit"`
+	HasMore      bool             `json:"has_more"`
 }
 
 type RecurringPaymentRequest struct {
@@ -155,6 +234,13 @@ type RecurringPaymentRequest struct {
 	BillingCycle    string       `json:"billing_cycle"` // monthly, yearly, etc.
 	StartDate       string       `json:"start_date,omitempty"`
 	Billing         *BillingInfo `json:"billing,omitempty"`
+	// TrialDays delays the first plan charge; TrialAmount, if above zero,
+	// is charged when the subscription is created
+	TrialDays   int    `json:"trial_days,omitempty"`
+	TrialAmount string `json:"trial_amount,omitempty"`
+	// FirstCharge is immediate or next_cycle for subscriptions without a
+	// trial or start_date
+	FirstCharge string `json:"first_charge,omitempty"`
 }
 
 type Plan struct {
@@ -165,6 +251,8 @@ type Plan struct {
 	Payments       string `json:"payments,omitempty"`
 	MonthFrequency string `json:"month_frequency,omitempty"`
 	DayOfMonth     string `json:"day_of_month,omitempty"`
+	// Version is incremented on every update and used for optimistic locking
+	Version int `json:"version"`
 }
 
 type PlanResponse struct {
@@ -176,45 +264,71 @@ type PlanResponse struct {
 type TerminalInitRequest struct {
 	APIKey     string `json:"api_key,omitempty"`
 	TerminalID string `json:"terminal_id"`
-	Location   string `json:"location"`
-	MerchantID string `json:"merchant_id,omitempty"`
+	// RegistrationCode is the code a new terminal displays; with it the
+	// terminal is registered with NMI and terminal_id may be omitted
+	RegistrationCode string `json:"registration_code,omitempty"`
+	Location         string `json:"location"`
+	MerchantID       string `json:"merchant_id,omitempty"`
+	// ConfigVersion is the device configuration version the terminal last
+	// applied, so a stale terminal can be sent the current one
+	ConfigVersion int `json:"config_version,omitempty"`
 }
 
 type TerminalPaymentRequest struct {
 	APIKey     string `json:"api_key,omitempty"`
 	TerminalID string `json:"terminal_id"`
 	Amount     string `json:"amount"`
-	Type       string `json:"type"` // sale, refund, etc.
+	Type       string `json:"type"` // sale (default), auth or credit
 	OrderID    string `json:"order_id,omitempty"`
 }
 
 // Terminal Response Structures
 type TerminalResponse struct {
+	// Status is the gateway response code (1 approved, 2 declined, 3
+	// error) of a finished payment, pending or cancelled for one without a
+	// result, and the device's connection state for init and status calls
 	Status        string `json:"status"`
+	TerminalID    string `json:"terminal_id,omitempty"`
 	TransactionID string `json:"transaction_id,omitempty"`
-	Amount        string `json:"amount,omitempty"`
-	ResponseText  string `json:"response_text"`
-	AuthCode      string `json:"auth_code,omitempty"`
-	Success       bool   `json:"success"`
+	// AsyncStatusID identifies a payment sent to a terminal; poll
+	// /terminal/payment/{async_status_id} while it is pending
+	AsyncStatusID string  `json:"async_status_id,omitempty"`
+	Amount        string  `json:"amount,omitempty"`
+	ResponseText  string  `json:"response_text"`
+	AuthCode      string  `json:"auth_code,omitempty"`
+	Success       bool    `json:"success"`
+	Terminal      *Device `json:"terminal,omitempty"`
 }
 
 // ProcessPayment handles all payment transactions
-func ProcessPayment(ctx context.Context, req PaymentRequest) (*PaymentResponse, error) {
+func (c *Client) ProcessPayment(ctx context.Context, req PaymentRequest) (*PaymentResponse, error) {
 	// Track transaction processing time
 	startTime := time.Now()
 	defer func() {
 		duration := time.Since(startTime).Seconds()
-		metrics.RecordTransactionMetrics(req.Type, "processed", duration)
+		metrics.RecordTransactionMetrics(logctx.Merchant(ctx), req.Type, "processed", duration)
 	}()
 
-	// Check for duplicate transactions
+	// Check for duplicate transactions, claiming the key so a concurrent retry
+	// cannot slip through while this one is at the gateway
+	completed := false
+	var idempotencyKey, requestHash string
 	if req.IdempotencyKey != "" {
-		transactionCache.RLock()
-		if _, exists := transactionCache.processed[req.IdempotencyKey]; exists {
-			transactionCache.RUnlock()
-			return nil, NewNMIError(ErrDuplicateTransaction, "duplicate transaction detected", "")
+		idempotencyKey = merchantIdempotencyKey(ctx, req.IdempotencyKey)
+		requestHash = idempotencyHash(req)
+		reserved, stored, err := c.idempotency.Reserve(ctx, idempotencyKey)
+		if err != nil {
+			metrics.RecordErrorMetrics(req.Type, "idempotency_error")
+			return nil, NewNMIError(ErrProcessingError, "idempotency store unavailable: "+err.Error(), "")
 		}
-		transactionCache.RUnlock()
+		if !reserved {
+			return replayPayment(stored, requestHash)
+		}
+		defer func() {
+			if !completed {
+				c.idempotency.Release(context.WithoutCancel(ctx), idempotencyKey)
+			}
+		}()
 	}
 
 	// Validate the payment request
@@ -222,51 +336,114 @@ func ProcessPayment(ctx context.Context, req PaymentRequest) (*PaymentResponse,
 		metrics.RecordErrorMetrics(req.Type, "validation_error")
 		return nil, err
 	}
+	fingerprint := c.CardFingerprint(req.CreditCard)
+	if err := c.screenCard(ctx, fingerprint); err != nil {
+		metrics.RecordErrorMetrics(req.Type, "card_blocked")
+		return nil, err
+	}
+	card := c.cardDetails(req.CreditCard)
+	if err := c.checkPrepaid(req.Type, card); err != nil {
+		metrics.RecordErrorMetrics(req.Type, "card_not_accepted")
+		return nil, err
+	}
+
+	// The surcharge is charged on top of the requested amount and itemized
+	// for NMI
+	amount := req.Amount
+	surcharge := surchargeFor(ctx, req)
+	if surcharge != nil {
+		amount = surcharge.TotalAmount
+	}
 
 	// Prepare form data for NMI API request
 	formData := url.Values{}
 	formData.Set("security_key", req.APIKey)
-	formData.Set("amount", req.Amount)
+	formData.Set("amount", amount.String())
 	formData.Set("type", req.Type)
+	if surcharge != nil {
+		formData.Set("surcharge", surcharge.Amount.String())
+	}
 
 	if req.OrderID != "" {
 		formData.Set("orderid", req.OrderID)
 	}
+	if req.OrderDescription != "" {
+		formData.Set("orderdescription", req.OrderDescription)
+	}
+	if req.PONumber != "" {
+		formData.Set("ponumber", req.PONumber)
+	}
+	applyMerchantDefaults(ctx, &req)
+	if req.Currency != "" {
+		formData.Set("currency", req.Currency)
+	}
+	if req.Descriptor != "" {
+		formData.Set("descriptor", req.Descriptor)
+	}
 
-	// Handle tokenized or vault transactions
-	if req.CustomerVaultID != "" {
+	// Handle wallet, tokenized or vault transactions
+	if req.WalletType != "" {
+		addWalletInfo(formData, req)
+	} else if req.PaymentToken != "" {
+		formData.Set("payment_token", req.PaymentToken)
+	} else if req.CustomerVaultID != "" {
 		formData.Set("customer_vault_id", req.CustomerVaultID)
-		metrics.LogDebug(fmt.Sprintf("Using customer vault ID: %s", req.CustomerVaultID))
+		metrics.LogDebug(ctx, fmt.Sprintf("Using customer vault ID: %s", req.CustomerVaultID))
 	} else {
 		formData.Set("ccnumber", req.CreditCard)
 		formData.Set("ccexp", req.ExpDate)
 		formData.Set("cvv", req.CVV)
 	}
 
-	// Send the request to NMI
-	resp, err := sendRequest(ctx, formData)
+	// NMI emails its receipt to the address sent with the sale
+	if req.CustomerReceipt != nil && *req.CustomerReceipt && req.Billing != nil {
+		formData.Set("customer_receipt", "true")
+		formData.Set("email", req.Billing.Email)
+	}
+
+	addThreeDSInfo(formData, req)
+	addLevel3Info(formData, req)
+
+	// Send the request to NMI. Once it may have been processed, the key is
+	// kept: a retry must not charge the card a second time.
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		metrics.RecordErrorMetrics(req.Type, "network_error")
+		if req.IdempotencyKey != "" && reachedGateway(err) {
+			c.completeIdempotency(ctx, idempotencyKey, idempotentResult{RequestHash: requestHash, Indeterminate: true})
+			completed = true
+		}
 		return nil, err
 	}
 
 	// Parse the NMI response
 	parsedResp, err := ParseNMIResponse(resp)
+	if parsedResp != nil {
+		recordGatewayResult(ctx, req.Type, CardBrand(req.CreditCard), parsedResp)
+	}
 	if err != nil {
 		metrics.RecordErrorMetrics(req.Type, "parse_error")
+		// A decline is the gateway's answer, and replayed like an approval
+		if req.IdempotencyKey != "" {
+			result := idempotentResult{RequestHash: requestHash, Indeterminate: true}
+			var nmiErr *NMIError
+			if parsedResp != nil && definitiveAnswer(parsedResp) && errors.As(err, &nmiErr) {
+				stored := *nmiErr
+				stored.Raw = pci.Scrub(stored.Raw)
+				result = idempotentResult{RequestHash: requestHash, Error: &stored}
+			}
+			c.completeIdempotency(ctx, idempotencyKey, result)
+			completed = true
+		}
 		return nil, err
 	}
 
-	// Record idempotency if applicable
-	if req.IdempotencyKey != "" {
-		transactionCache.Lock()
-		transactionCache.processed[req.IdempotencyKey] = true
-		transactionCache.Unlock()
-	}
+	recordActor(ctx, req.Type, parsedResp.TransactionID)
+	recordAmount(ctx, req.Type, amount.String())
 
 	// Return the successful payment response
-	return &PaymentResponse{
-		RawResponse:     resp,
+	paymentResp := &PaymentResponse{
+		RawResponse:     pci.Scrub(resp),
 		StatusCode:      200,
 		Response:        parsedResp.Response,
 		ResponseText:    parsedResp.ResponseText,
@@ -278,20 +455,92 @@ func ProcessPayment(ctx context.Context, req PaymentRequest) (*PaymentResponse,
 		Type:            parsedResp.Type,
 		ResponseCode:    parsedResp.ResponseCode,
 		CustomerVaultID: req.CustomerVaultID,
-	}, nil
+		ExtraFields:     c.passthroughFields(parsedResp.Values),
+		ThreeDSecure:    threeDSResult(req, parsedResp.Values),
+		Surcharge:       surcharge,
+		Card:            card,
+		CardFingerprint: fingerprint,
+	}
+
+	c.enforceVerification(ctx, req, amount, paymentResp)
+
+	// Echo the stored card details so receipts can show "Visa ending 4242"
+	if req.CustomerVaultID != "" {
+		if card, ok := lookupVaultCard(req.CustomerVaultID, resp); ok {
+			paymentResp.MaskedCard = card.MaskedCard
+			paymentResp.CardType = card.CardType
+			paymentResp.ExpiryDate = card.ExpiryDate
+		}
+	}
+
+	// Keep the response so a retry with the same idempotency key gets it back
+	if req.IdempotencyKey != "" {
+		response, _ := json.Marshal(paymentResp)
+		c.completeIdempotency(ctx, idempotencyKey, idempotentResult{RequestHash: requestHash, Response: response})
+		completed = true
+	}
+
+	return paymentResp, nil
+}
+
+// replayPayment returns the stored response, or decline, for an idempotency
+// key that was already used by the request hashing to requestHash. A request still in
+// flight, or one whose outcome is unknown, is reported as a duplicate,
+// since there is no response to replay, and a different request reusing
+// the key is a conflict.
+func replayPayment(stored []byte, requestHash string) (*PaymentResponse, error) {
+	if len(stored) == 0 {
+		return nil, NewNMIError(ErrDuplicateTransaction, "a request with this idempotency key is still being processed", "")
+	}
+
+	// Responses stored before request hashes were kept are bare, and
+	// replayed without the check
+	var result idempotentResult
+	if err := json.Unmarshal(stored, &result); err == nil && (result.Response != nil || result.Error != nil || result.Indeterminate) {
+		if result.RequestHash != requestHash {
+			return nil, NewNMIError(ErrConflict, "idempotency_key was already used for a different request", "")
+		}
+		if result.Indeterminate {
+			return nil, NewNMIError(ErrDuplicateTransaction, "an earlier request with this idempotency key may have reached the gateway; look the payment up before retrying", "")
+		}
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		stored = result.Response
+	}
+
+	var replay PaymentResponse
+	if err := json.Unmarshal(stored, &replay); err != nil {
+		return nil, NewNMIError(ErrDuplicateTransaction, "duplicate transaction detected", "")
+	}
+	replay.IdempotentReplay = true
+	return &replay, nil
 }
 
 // ProcessTokenization handles tokenization of card details
-func ProcessTokenization(ctx context.Context, req PaymentRequest) (*TokenizeResponse, error) {
-	if err := ValidatePaymentRequest(req); err != nil {
+// Any error returned is an *NMIError: validation failures use invalid_*
+// codes, gateway outages use network_error, and declines carry the NMI
+// response code and AVS/CVV results of the validation attempt.
+func (c *Client) ProcessTokenization(ctx context.Context, req PaymentRequest) (*TokenizeResponse, error) {
+	if err := ValidateTokenizationRequest(req); err != nil {
+		metrics.RecordVaultOperation("add", "validation_error")
+		return nil, err
+	}
+	fingerprint := c.CardFingerprint(req.CreditCard)
+	if err := c.screenCard(ctx, fingerprint); err != nil {
+		metrics.RecordVaultOperation("add", "blocked")
 		return nil, err
 	}
 
 	formData := url.Values{}
 	formData.Set("security_key", req.APIKey)
-	formData.Set("ccnumber", req.CreditCard)
-	formData.Set("ccexp", req.ExpDate)
-	formData.Set("cvv", req.CVV)
+	if req.PaymentToken != "" {
+		formData.Set("payment_token", req.PaymentToken)
+	} else {
+		formData.Set("ccnumber", req.CreditCard)
+		formData.Set("ccexp", req.ExpDate)
+		formData.Set("cvv", req.CVV)
+	}
 	formData.Set("amount", "1.00") // Dummy amount for tokenization
 	formData.Set("type", "sale")
 	formData.Set("customer_vault", "add_customer")
@@ -303,35 +552,62 @@ func ProcessTokenization(ctx context.Context, req PaymentRequest) (*TokenizeResp
 		addBillingInfo(formData, req.Billing)
 	}
 
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
+		metrics.RecordVaultOperation("add", "error")
 		return nil, err
 	}
 
 	parsedResp, err := ParseNMIResponse(resp)
 	if err != nil {
+		metrics.RecordVaultOperation("add", "declined")
 		return nil, err
 	}
+	metrics.RecordVaultOperation("add", "success")
+
+	masked := ExtractValue(resp, "cc_number")
+	if masked == "" {
+		masked = pci.MaskPAN(req.CreditCard)
+	}
+
+	card := VaultCard{
+		MaskedCard: masked,
+		CardType:   ExtractValue(resp, "card_type"),
+		ExpiryDate: req.ExpDate,
+	}
+	if details := c.cardDetails(req.CreditCard); details != nil {
+		card.bin = details.BIN
+	}
+	saveVaultCard(vaultID, card)
 
 	return &TokenizeResponse{
 		CustomerVaultID: vaultID,
 		Token:           vaultID,
-		Masked:          ExtractValue(resp, "cc_number"),
-		CardType:        ExtractValue(resp, "card_type"),
-		ExpiryDate:      req.ExpDate,
+		Masked:          card.MaskedCard,
+		CardType:        card.CardType,
+		ExpiryDate:      card.ExpiryDate,
 		Success:         parsedResp.Response == "1",
 		Message:         parsedResp.ResponseText,
+		ResponseCode:    parsedResp.ResponseCode,
+		AVSResponse:     parsedResp.AVSResponse,
+		CVVResponse:     parsedResp.CVVResponse,
+		CardFingerprint: fingerprint,
 	}, nil
 }
 
 // ProcessRefund handles refund transactions
-func ProcessRefund(ctx context.Context, req RefundRequest) (*RefundResponse, error) {
+func (c *Client) ProcessRefund(ctx context.Context, req RefundRequest) (*RefundResponse, error) {
 	lookupReq := LookupRequest{
 		APIKey:        req.APIKey,
 		TransactionID: req.TransactionID,
 	}
 
-	lookupResp, err := LookupTransaction(ctx, lookupReq)
+	// Hold the sale until the refund is recorded, so a concurrent partial
+	// refund sees it
+	unlock := c.refundLocks.lock(req.TransactionID)
+	defer unlock()
+
+	lookupResp, err := c.LookupTransaction(ctx, lookupReq)
 	if err != nil {
 		return nil, err
 	}
@@ -340,16 +616,35 @@ func ProcessRefund(ctx context.Context, req RefundRequest) (*RefundResponse, err
 		return nil, err
 	}
 
+	amount := req.Amount
+	if lookupResp.Amount != "" {
+		prior, err := c.refunds.List(ctx, req.TransactionID)
+		if err != nil {
+			return nil, NewNMIError(ErrInternal, "could not load prior refunds: "+err.Error(), "")
+		}
+		summary := summarizeRefunds(req.TransactionID, lookupResp.Amount, prior)
+		remaining := Amount(summary.RemainingAmount).Minor()
+		switch {
+		case remaining == 0:
+			return nil, NewNMIError(ErrInvalidRefund, "transaction has already been fully refunded", "")
+		case amount == "":
+			// A full refund after partial ones returns what is left
+			amount = summary.RemainingAmount
+		case Amount(amount).Minor() > remaining:
+			return nil, NewNMIError(ErrInvalidRefund, "refund amount "+amount+" exceeds the remaining refundable amount "+summary.RemainingAmount, "")
+		}
+	}
+
 	formData := url.Values{}
 	formData.Set("security_key", req.APIKey)
 	formData.Set("type", "refund")
 	formData.Set("transactionid", req.TransactionID)
 
-	if req.Amount != "" {
-		formData.Set("amount", req.Amount)
+	if amount != "" {
+		formData.Set("amount", amount)
 	}
 
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		return nil, err
 	}
@@ -359,8 +654,23 @@ func ProcessRefund(ctx context.Context, req RefundRequest) (*RefundResponse, err
 		return nil, err
 	}
 
+	recordActor(ctx, "refund", parsedResp.TransactionID)
+
+	if amount != "" {
+		refund := Refund{
+			TransactionID: req.TransactionID,
+			RefundID:      parsedResp.TransactionID,
+			Amount:        amount,
+			CreatedAt:     time.Now().UTC(),
+		}
+		if err := c.refunds.Record(ctx, refund); err != nil {
+			// The money has moved; the ledger only guards later refunds
+			metrics.LogError(ctx, fmt.Errorf("failed to record refund %s of transaction %s: %v", refund.RefundID, refund.TransactionID, err))
+		}
+	}
+
 	return &RefundResponse{
-		RawResponse:   resp,
+		RawResponse:   pci.Scrub(resp),
 		StatusCode:    200,
 		Response:      parsedResp.Response,
 		ResponseText:  parsedResp.ResponseText,
@@ -368,12 +678,13 @@ func ProcessRefund(ctx context.Context, req RefundRequest) (*RefundResponse, err
 		TransactionID: parsedResp.TransactionID,
 		Type:          parsedResp.Type,
 		ResponseCode:  parsedResp.ResponseCode,
-		Amount:        req.Amount,
+		Amount:        amount,
+		ExtraFields:   c.passthroughFields(parsedResp.Values),
 	}, nil
 }
 
 // VoidTransaction handles void transactions
-func VoidTransaction(ctx context.Context, req VoidRequest) (*VoidResponse, error) {
+func (c *Client) VoidTransaction(ctx context.Context, req VoidRequest) (*VoidResponse, error) {
 	if req.TransactionID == "" {
 		return nil, NewNMIError(ErrInvalidRequest, "transaction_id is required", "")
 	}
@@ -383,7 +694,7 @@ func VoidTransaction(ctx context.Context, req VoidRequest) (*VoidResponse, error
 	formData.Set("type", "void")
 	formData.Set("transactionid", req.TransactionID)
 
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		return nil, err
 	}
@@ -393,8 +704,10 @@ func VoidTransaction(ctx context.Context, req VoidRequest) (*VoidResponse, error
 		return nil, err
 	}
 
+	recordActor(ctx, "void", parsedResp.TransactionID)
+
 	return &VoidResponse{
-		RawResponse:   resp,
+		RawResponse:   pci.Scrub(resp),
 		StatusCode:    200,
 		Response:      parsedResp.Response,
 		ResponseText:  parsedResp.ResponseText,
@@ -402,64 +715,137 @@ func VoidTransaction(ctx context.Context, req VoidRequest) (*VoidResponse, error
 		TransactionID: parsedResp.TransactionID,
 		Type:          parsedResp.Type,
 		ResponseCode:  parsedResp.ResponseCode,
+		ExtraFields:   c.passthroughFields(parsedResp.Values),
 	}, nil
 }
 
-// LookupTransaction retrieves transaction details
-func LookupTransaction(ctx context.Context, req LookupRequest) (*LookupResponse, error) {
-	if req.TransactionID == "" {
-		return nil, NewNMIError(ErrInvalidRequest, "transaction_id is required", "")
+// LookupTransaction retrieves a transaction from NMI's Query API, summarizing
+// its original action and including the full record
+func (c *Client) LookupTransaction(ctx context.Context, req LookupRequest) (*LookupResponse, error) {
+	lookupResp, err := c.lookupTransaction(ctx, req)
+	if c.shadow.sampled(ShadowLookup) {
+		c.shadow.mirror(ctx, ShadowLookup, req.APIKey, lookupFingerprint(lookupResp), err,
+			func(ctx context.Context, shadow *Client, apiKey string) (map[string]string, error) {
+				mirrored := req
+				mirrored.APIKey = apiKey
+				resp, err := shadow.lookupTransaction(ctx, mirrored)
+				return lookupFingerprint(resp), err
+			})
 	}
+	return lookupResp, err
+}
 
-	formData := url.Values{}
-	formData.Set("security_key", req.APIKey)
-	formData.Set("transaction_id", req.TransactionID)
-	formData.Set("condition", "complete")
-	formData.Set("transaction_type", "cc")
-	formData.Set("action_type", "sale")
-
-	fmt.Printf("Lookup Form Data: %s\n", formData.Encode())
-
-	resp, err := sendRequest(ctx, formData)
+func (c *Client) lookupTransaction(ctx context.Context, req LookupRequest) (*LookupResponse, error) {
+	record, raw, err := c.GetTransaction(ctx, req.APIKey, req.TransactionID)
 	if err != nil {
 		return nil, err
 	}
+	return lookupSummary(record, raw), nil
+}
+
+// FindTransactions lists the transactions for an order, vault customer or
+// customer ID, newest first. The Query API cannot filter by customer ID, so
+// those matches are picked from each page of results and pages may come
+// back short; follow HasMore rather than counting.
+func (c *Client) FindTransactions(ctx context.Context, req LookupRequest) (*LookupResults, error) {
+	if req.TransactionID != "" {
+		return nil, NewNMIError(ErrInvalidRequest, "transaction_id cannot be combined with order_id, customer_vault_id or customer_id", "")
+	}
+	if req.OrderID == "" && req.CustomerVaultID == "" && req.CustomerID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "one of transaction_id, order_id, customer_vault_id or customer_id is required", "")
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultSearchLimit
+	}
 
-	parsedResp, err := ParseNMIResponse(resp)
+	search := TransactionSearch{
+		APIKey:          req.APIKey,
+		OrderID:         req.OrderID,
+		CustomerVaultID: req.CustomerVaultID,
+		TransactionType: req.TransactionType,
+		ActionType:      req.ActionType,
+		Page:            req.Page,
+		Limit:           req.Limit,
+	}
+	if req.Condition != "" {
+		search.Conditions = strings.Split(req.Condition, ",")
+	}
+	records, err := c.SearchTransactions(ctx, search)
 	if err != nil {
 		return nil, err
 	}
 
-	return &LookupResponse{
-		RawResponse:   resp,
+	results := &LookupResults{
+		Transactions: []LookupResponse{},
+		Page:         req.Page,
+		Limit:        req.Limit,
+		HasMore:      len(records) == req.Limit,
+	}
+	for i := range records {
+		if req.CustomerID != "" && records[i].CustomerID != req.CustomerID {
+			continue
+		}
+		results.Transactions = append(results.Transactions, *lookupSummary(&records[i], ""))
+	}
+	return results, nil
+}
+
+// lookupSummary describes a transaction by its original action, with the
+// full record and the raw Query API response it came from, if any
+func lookupSummary(record *TransactionRecord, raw string) *LookupResponse {
+	lookupResp := &LookupResponse{
+		RawResponse:   pci.Scrub(raw),
 		StatusCode:    200,
-		Response:      parsedResp.Response,
-		ResponseText:  parsedResp.ResponseText,
-		TransactionID: parsedResp.TransactionID,
-		Type:          parsedResp.Type,
-		Amount:        ExtractValue(resp, "amount"),
-		ResponseCode:  parsedResp.ResponseCode,
-	}, nil
+		Response:      "1",
+		TransactionID: record.TransactionID,
+		Amount:        record.Amount,
+		Record:        record,
+	}
+	if len(record.Actions) > 0 {
+		first := record.Actions[0]
+		lookupResp.Type = first.Type
+		lookupResp.ResponseText = first.ResponseText
+		lookupResp.ResponseCode = first.ResponseCode
+		lookupResp.DeclineReason = NormalizeResponseText(first.ResponseText, first.ResponseCode)
+		if lookupResp.DeclineReason != "" {
+			lookupResp.DeclineCategory = CategorizeDecline(first.ResponseCode, lookupResp.DeclineReason)
+		}
+	}
+	return lookupResp
 }
 
 // ProcessRecurringPayment sets up recurring payments
-func ProcessRecurringPayment(ctx context.Context, req RecurringPaymentRequest) (*RecurringResponse, error) {
-	// Log the incoming request
-	fmt.Printf("Incoming Recurring Payment Request: %+v\n", req)
-
-	// Ensure the plan_id exists in PlanStore
-	PlanStore.RLock()
-	defer PlanStore.RUnlock()
-	fmt.Printf("PlanStore Contents: %+v\n", PlanStore.Data)
-
-	plan, exists := PlanStore.Data[req.PlanID]
-	if !exists {
-		fmt.Printf("Plan ID not found: %s\n", req.PlanID)
+func (c *Client) ProcessRecurringPayment(ctx context.Context, req RecurringPaymentRequest) (*RecurringResponse, error) {
+	log := logctx.From(ctx).WithFields(logrus.Fields{
+		"plan_id":           req.PlanID,
+		"customer_vault_id": req.CustomerVaultID,
+	})
+	log.Debug("Creating recurring payment")
+
+	// Ensure the plan_id exists
+	plan, err := c.plans.Get(ctx, req.PlanID)
+	if errors.Is(err, ErrPlanNotFound) {
+		log.Warn("Recurring payment plan not found")
 		return nil, NewNMIError(ErrInvalidRequest, "plan_id does not exist", "")
 	}
+	if err != nil {
+		return nil, NewNMIError(ErrProcessingError, "failed to load plan: "+err.Error(), "")
+	}
+
+	log.WithField("plan_amount", plan.Amount).Debug("Resolved recurring payment plan")
+
+	start, err := planSubscriptionStart(req, plan, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-	// Log the retrieved plan
-	fmt.Printf("Retrieved Plan: %+v\n", plan)
+	if c.bins != nil && len(c.cfg.BINRejectPrepaid) > 0 {
+		card := c.cardDetails(c.vaultCardBIN(ctx, req.APIKey, req.CustomerVaultID))
+		if err := c.checkPrepaid("subscription", card); err != nil {
+			log.Warn("Prepaid card refused for subscription")
+			return nil, err
+		}
+	}
 
 	// Prepare form data
 	formData := url.Values{}
@@ -467,17 +853,22 @@ func ProcessRecurringPayment(ctx context.Context, req RecurringPaymentRequest) (
 	formData.Set("customer_vault_id", req.CustomerVaultID)
 	formData.Set("plan_id", plan.ID)
 	formData.Set("recurring", "add_subscription")
+	if !start.StartDate.IsZero() {
+		formData.Set("start_date", start.StartDate.Format(nmiDateLayout))
+	}
+	// A paid trial is a sale that also creates the subscription
+	if start.chargesTrial() {
+		formData.Set("type", "sale")
+		formData.Set("amount", start.TrialAmount.String())
+	}
 
 	// Add billing details
 	if req.Billing != nil {
 		addBillingInfo(formData, req.Billing)
 	}
 
-	// Log outgoing form data
-	fmt.Printf("Outgoing Form Data: %s\n", formData.Encode())
-
 	// Send request
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		return nil, err
 	}
@@ -487,18 +878,53 @@ func ProcessRecurringPayment(ctx context.Context, req RecurringPaymentRequest) (
 		return nil, err
 	}
 
-	return &RecurringResponse{
-		SubscriptionID:  parsedResp.TransactionID,
-		Status:          parsedResp.Response,
-		NextBilling:     ExtractValue(resp, "next_billing_date"),
+	subscriptionID := parsedResp.TransactionID
+	var trialTransactionID string
+	if start.chargesTrial() {
+		if parsedResp.Response != "1" {
+			return nil, ParseNMIErrorResponse(parsedResp.ResponseText, parsedResp.ResponseCode, resp)
+		}
+		trialTransactionID = parsedResp.TransactionID
+		if id := ExtractValue(resp, "subscription_id"); id != "" {
+			subscriptionID = id
+		}
+	}
+
+	nextBilling := ExtractValue(resp, "next_billing_date")
+	var startDate string
+	if !start.StartDate.IsZero() {
+		startDate = start.StartDate.Format("2006-01-02")
+		if nextBilling == "" {
+			nextBilling = start.StartDate.Format(nmiDateLayout)
+		}
+	}
+
+	recordActor(ctx, "add_subscription", subscriptionID)
+	merchant, _ := MerchantFromContext(ctx)
+	saveSubscription(Subscription{
+		ID:              subscriptionID,
+		CustomerVaultID: req.CustomerVaultID,
 		PlanID:          req.PlanID,
 		Amount:          req.Amount,
-		CustomerVaultID: req.CustomerVaultID,
+		BillingCycle:    req.BillingCycle,
+		NextBilling:     nextBilling,
+		MerchantID:      merchant.ID,
+	})
+
+	return &RecurringResponse{
+		SubscriptionID:     subscriptionID,
+		Status:             parsedResp.Response,
+		NextBilling:        nextBilling,
+		PlanID:             req.PlanID,
+		Amount:             req.Amount,
+		CustomerVaultID:    req.CustomerVaultID,
+		StartDate:          startDate,
+		TrialTransactionID: trialTransactionID,
 	}, nil
 }
 
 // UpdateRecurringPayment modifies an existing subscription
-func UpdateRecurringPayment(ctx context.Context, req RecurringPaymentRequest, subscriptionID string) (*RecurringResponse, error) {
+func (c *Client) UpdateRecurringPayment(ctx context.Context, req RecurringPaymentRequest, subscriptionID string) (*RecurringResponse, error) {
 	if subscriptionID == "" {
 		return nil, NewNMIError(ErrInvalidRequest, "subscription_id is required", "")
 	}
@@ -526,7 +952,7 @@ func UpdateRecurringPayment(ctx context.Context, req RecurringPaymentRequest, su
 		addBillingInfo(formData, req.Billing)
 	}
 
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		return nil, err
 	}
@@ -536,6 +962,9 @@ func UpdateRecurringPayment(ctx context.Context, req RecurringPaymentRequest, su
 		return nil, err
 	}
 
+	recordActor(ctx, "update_subscription", subscriptionID)
+	updateSubscription(subscriptionID, req)
+
 	return &RecurringResponse{
 		SubscriptionID:  subscriptionID,
 		Status:          parsedResp.Response,
@@ -547,7 +976,7 @@ func UpdateRecurringPayment(ctx context.Context, req RecurringPaymentRequest, su
 }
 
 // CancelRecurringPayment cancels an existing subscription
-func CancelRecurringPayment(ctx context.Context, apiKey, subscriptionID string) error {
+func (c *Client) CancelRecurringPayment(ctx context.Context, apiKey, subscriptionID string) error {
 	if subscriptionID == "" {
 		return NewNMIError(ErrInvalidRequest, "subscription_id is required", "")
 	}
@@ -557,7 +986,7 @@ func CancelRecurringPayment(ctx context.Context, apiKey, subscriptionID string)
 	formData.Set("subscription_id", subscriptionID)
 	formData.Set("recurring", "delete_subscription")
 
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		return err
 	}
@@ -571,13 +1000,45 @@ func CancelRecurringPayment(ctx context.Context, apiKey, subscriptionID string)
 		return ParseNMIErrorResponse(parsedResp.ResponseText, parsedResp.ResponseCode, resp)
 	}
 
+	recordActor(ctx, "delete_subscription", subscriptionID)
+	setSubscriptionStatus(subscriptionID, SubscriptionCancelled)
+
 	return nil
 }
 
-var PlanStore = struct {
-	sync.RWMutex
-	Data map[string]Plan
-}{Data: make(map[string]Plan)}
+// ScheduleSubscriptionCancellation lets a subscription run to the end of
+// its current billing period and marks it to be cancelled then, so the
+// customer is not charged again and nothing needs refunding. The
+// cancellation itself is made by whoever calls DueCancellations.
+func (c *Client) ScheduleSubscriptionCancellation(ctx context.Context, apiKey, subscriptionID string) (*Subscription, error) {
+	if subscriptionID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "subscription_id is required", "")
+	}
+
+	sub, ok := GetSubscription(subscriptionID)
+	switch {
+	case !ok:
+		return nil, NewNMIError(ErrInvalidRequest, "subscription was not created through this service; cancel it immediately instead", "")
+	case sub.Status == SubscriptionCancelled:
+		return nil, NewNMIError(ErrInvalidAction, "subscription is already cancelled", "")
+	}
+
+	now := time.Now()
+	end, found := periodEnd(sub, nil, now)
+	if !found {
+		payments, err := c.GetSubscriptionPayments(ctx, apiKey, subscriptionID)
+		if err != nil {
+			return nil, err
+		}
+		if end, found = periodEnd(sub, payments, now); !found {
+			return nil, NewNMIError(ErrInvalidAction, "current billing period could not be determined; cancel it immediately instead", "")
+		}
+	}
+
+	recordActor(ctx, "schedule_cancellation", subscriptionID)
+	sub, _ = scheduleCancellation(subscriptionID, end)
+	return &sub, nil
+}
 
 // HandleAddPlan Adds a new plan
 type AddPlanRequest struct {
@@ -595,38 +1056,41 @@ type AddPlanRequest struct {
 	} `json:"event_body"`
 }
 
-func HandleAddPlan() http.HandlerFunc {
+func HandleAddPlan(plans PlanRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req AddPlanRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			WriteErrorCode(w, r, ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
 		// Extract the plan details from the event body
 		plan := req.EventBody.Plan
 		if plan.ID == "" || plan.Name == "" || plan.Amount == "" {
-			http.Error(w, "Plan ID, Name, and Amount are required", http.StatusBadRequest)
+			WriteErrorCode(w, r, ErrInvalidRequest, "Plan ID, Name, and Amount are required")
 			return
 		}
 
-		// Check for duplicate plan ID
-		PlanStore.RLock()
-		_, exists := PlanStore.Data[plan.ID]
-		PlanStore.RUnlock()
-		if exists {
-			http.Error(w, "Plan ID already exists", http.StatusConflict)
+		// The repository rejects duplicate IDs atomically, so two concurrent
+		// adds cannot both succeed
+		plan, err := plans.Create(r.Context(), plan)
+		if errors.Is(err, ErrPlanExists) {
+			WriteErrorCode(w, r, ErrConflict, "Plan ID already exists")
+			return
+		}
+		// The gateway rejected the plan or could not be reached
+		var nmiErr *NMIError
+		if errors.As(err, &nmiErr) {
+			WriteError(w, r, err)
+			return
+		}
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to store plan")
+			WriteErrorCode(w, r, ErrInternal, "Failed to store plan")
 			return
 		}
 
-		// Add the plan to the PlanStore
-		PlanStore.Lock()
-		defer PlanStore.Unlock()
-		PlanStore.Data[plan.ID] = plan
-
-		// Log the incoming request and PlanStore state
-		fmt.Printf("Plan Added: %+v\n", plan)
-		fmt.Printf("PlanStore Data: %+v\n", PlanStore.Data)
+		logctx.From(r.Context()).WithField("plan_id", plan.ID).Info("Plan added")
 
 		// Respond with success
 		response := PlanResponse{
@@ -634,28 +1098,47 @@ func HandleAddPlan() http.HandlerFunc {
 			Message: "Plan added successfully",
 		}
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", planETag(plan))
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			fmt.Printf("Error encoding response: %v\n", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			logctx.From(r.Context()).WithError(err).Error("Failed to encode plan response")
+			WriteErrorCode(w, r, ErrInternal, "Failed to encode response")
 		}
 	}
 }
 
-// HandleUpdatePlan Updates current plan
-func HandleUpdatePlan() http.HandlerFunc {
+// HandleUpdatePlan Updates current plan. The caller must send the version it
+// last read, either as an If-Match header or in the body, and the update is
+// rejected with 409 if the plan changed since.
+func HandleUpdatePlan(plans PlanRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var plan Plan
 		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			WriteErrorCode(w, r, ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
-		PlanStore.Lock()
-		defer PlanStore.Unlock()
+		expectedVersion := plan.Version
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			version, err := strconv.Atoi(strings.Trim(ifMatch, `W/"`))
+			if err != nil {
+				WriteErrorCode(w, r, ErrInvalidRequest, "Invalid If-Match header")
+				return
+			}
+			expectedVersion = version
+		}
+		if expectedVersion == 0 {
+			WriteErrorCode(w, r, ErrPreconditionRequired, "If-Match header or version is required")
+			return
+		}
 
-		existingPlan, exists := PlanStore.Data[plan.ID]
-		if !exists {
-			http.Error(w, "Plan not found", http.StatusNotFound)
+		existingPlan, err := plans.Get(r.Context(), plan.ID)
+		if errors.Is(err, ErrPlanNotFound) {
+			WriteErrorCode(w, r, ErrNotFound, "Plan not found")
+			return
+		}
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to load plan")
+			WriteErrorCode(w, r, ErrInternal, "Failed to load plan")
 			return
 		}
 
@@ -666,9 +1149,30 @@ func HandleUpdatePlan() http.HandlerFunc {
 			existingPlan.Amount = plan.Amount
 		}
 
-		PlanStore.Data[plan.ID] = existingPlan
+		// The repository compares versions on write, so a change made
+		// between the read above and this update is still caught
+		existingPlan.Version = expectedVersion
+		existingPlan, err = plans.Update(r.Context(), existingPlan)
+		var nmiErr *NMIError
+		switch {
+		case errors.Is(err, ErrPlanNotFound):
+			WriteErrorCode(w, r, ErrNotFound, "Plan not found")
+			return
+		case errors.Is(err, ErrPlanVersionConflict):
+			w.Header().Set("ETag", planETag(existingPlan))
+			WriteErrorCode(w, r, ErrConflict, fmt.Sprintf("Plan was modified concurrently (current version %d)", existingPlan.Version))
+			return
+		case errors.As(err, &nmiErr):
+			WriteError(w, r, err)
+			return
+		case err != nil:
+			logctx.From(r.Context()).WithError(err).Error("Failed to update plan")
+			WriteErrorCode(w, r, ErrInternal, "Failed to update plan")
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", planETag(existingPlan))
 		json.NewEncoder(w).Encode(PlanResponse{
 			Plan:    existingPlan,
 			Message: "Plan updated successfully",
@@ -677,20 +1181,26 @@ func HandleUpdatePlan() http.HandlerFunc {
 }
 
 // HandleCancelPlan Cancels current plan
-func HandleCancelPlan() http.HandlerFunc {
+func HandleCancelPlan(plans PlanRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		planID := vars["id"]
 
-		PlanStore.Lock()
-		defer PlanStore.Unlock()
-
-		if _, exists := PlanStore.Data[planID]; !exists {
-			http.Error(w, "Plan not found", http.StatusNotFound)
+		err := plans.Delete(r.Context(), planID)
+		if errors.Is(err, ErrPlanNotFound) {
+			WriteErrorCode(w, r, ErrNotFound, "Plan not found")
+			return
+		}
+		var nmiErr *NMIError
+		if errors.As(err, &nmiErr) {
+			WriteError(w, r, err)
+			return
+		}
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to delete plan")
+			WriteErrorCode(w, r, ErrInternal, "Failed to delete plan")
 			return
 		}
-
-		delete(PlanStore.Data, planID)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
@@ -700,51 +1210,109 @@ func HandleCancelPlan() http.HandlerFunc {
 }
 
 // HandleListPlans
-func HandleListPlans() http.HandlerFunc {
+func HandleListPlans(plans PlanRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		PlanStore.RLock()
-		defer PlanStore.RUnlock()
+		list, err := plans.List(r.Context())
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to list plans")
+			WriteErrorCode(w, r, ErrInternal, "Failed to list plans")
+			return
+		}
+
+		// Keyed by plan ID, as the endpoint has always returned
+		byID := make(map[string]Plan, len(list))
+		for _, plan := range list {
+			byID[plan.ID] = plan
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(PlanStore.Data); err != nil {
-			http.Error(w, "Failed to encode plan data", http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(byID); err != nil {
+			WriteErrorCode(w, r, ErrInternal, "Failed to encode plan data")
 		}
 	}
 }
 
-func ProcessTerminalInit(ctx context.Context, req TerminalInitRequest) (*TerminalResponse, error) {
-	formData := url.Values{}
-	formData.Set("security_key", req.APIKey)
-	formData.Set("terminal_id", req.TerminalID)
-	formData.Set("type", "terminal_setup") // Changed from 'terminal' to 'terminal_setup'
-	formData.Set("location", req.Location)
-	formData.Set("merchant_id", req.MerchantID)
-
-	resp, err := sendRequest(ctx, formData)
+// ProcessTerminalInit registers a new terminal when a registration code is
+// given, named after its location, and otherwise looks up the registered
+// terminal. Either way it reports whether the terminal is connected.
+func (c *Client) ProcessTerminalInit(ctx context.Context, req TerminalInitRequest) (*TerminalResponse, error) {
+	var device *Device
+	var err error
+	switch {
+	case req.RegistrationCode != "":
+		device, err = c.RegisterDevice(ctx, req.APIKey, req.RegistrationCode, req.Location)
+	case req.TerminalID != "":
+		device, err = c.GetDevice(ctx, req.APIKey, req.TerminalID)
+	default:
+		return nil, NewNMIError(ErrInvalidRequest, "terminal_id or registration_code is required", "")
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return parseTerminalResponse(resp)
+	return deviceResponse(device), nil
 }
 
-func ProcessTerminalPayment(ctx context.Context, req TerminalPaymentRequest) (*TerminalResponse, error) {
+// ProcessTerminalPayment sends a payment to a terminal and waits for the
+// cardholder to finish it. A payment still in progress when the wait ends
+// is returned pending with its async_status_id.
+func (c *Client) ProcessTerminalPayment(ctx context.Context, req TerminalPaymentRequest) (*TerminalResponse, error) {
+	started, err := c.StartTerminalPayment(ctx, req)
+	if err != nil || started.Status != TerminalPaymentPending {
+		return started, err
+	}
+	return c.WaitForTerminalPayment(ctx, req.APIKey, started)
+}
+
+// StartTerminalPayment sends a payment to a terminal without waiting for
+// the cardholder. It returns the payment pending, or the gateway's answer
+// when the gateway refused it before it reached the terminal.
+func (c *Client) StartTerminalPayment(ctx context.Context, req TerminalPaymentRequest) (*TerminalResponse, error) {
+	if req.TerminalID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "terminal_id is required", "")
+	}
+	if req.Type == "" {
+		req.Type = "sale"
+	}
+	if req.Type != "sale" && req.Type != "auth" && req.Type != "credit" {
+		return nil, NewNMIError(ErrInvalidRequest, "type must be sale, auth or credit", "")
+	}
+	amount, err := ParseAmount(req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
 	formData := url.Values{}
 	formData.Set("security_key", req.APIKey)
-	formData.Set("terminal_id", req.TerminalID)
-	formData.Set("amount", req.Amount)
+	formData.Set("poi_device_id", req.TerminalID)
+	formData.Set("response_method", "asynchronous")
+	formData.Set("amount", amount.String())
 	formData.Set("type", req.Type)
 
 	if req.OrderID != "" {
 		formData.Set("orderid", req.OrderID)
 	}
 
-	resp, err := sendRequest(ctx, formData)
+	resp, err := c.sendRequest(ctx, formData)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseTerminalResponse(resp)
+	// Without an async status ID the gateway refused the payment before it
+	// reached the terminal
+	asyncStatusID := ExtractValue(resp, "async_status_guid")
+	if asyncStatusID == "" {
+		return parseTerminalResponse(resp)
+	}
+	recordActor(ctx, "terminal_"+req.Type, asyncStatusID)
+
+	return &TerminalResponse{
+		Status:        TerminalPaymentPending,
+		TerminalID:    req.TerminalID,
+		AsyncStatusID: asyncStatusID,
+		Amount:        amount.String(),
+		ResponseText:  "Waiting for the cardholder",
+	}, nil
 }
 
 func parseTerminalResponse(resp string) (*TerminalResponse, error) {
@@ -764,6 +1332,39 @@ func parseTerminalResponse(resp string) (*TerminalResponse, error) {
 	}, nil
 }
 
+// recordAmount feeds an approved amount into the ticket-size histogram for
+// the merchant in ctx
+func recordAmount(ctx context.Context, txType, amount string) {
+	if value, err := strconv.ParseFloat(amount, 64); err == nil {
+		metrics.RecordTransactionAmount(logctx.Merchant(ctx), txType, value)
+	}
+}
+
+// recordGatewayResult counts a payment's gateway result under its response
+// code and decline category, or approved, so approval rates can be watched
+// per merchant and card brand. Unknown brands and malformed codes share one
+// label value each to keep the series bounded.
+func recordGatewayResult(ctx context.Context, txType, brand string, parsed *NMIResponse) {
+	category := "approved"
+	if parsed.Response != "1" {
+		reason := NormalizeResponseText(parsed.ResponseText, parsed.ResponseCode)
+		category = string(CategorizeDecline(parsed.ResponseCode, reason))
+	}
+	code := parsed.ResponseCode
+	if len(code) != 3 || strings.Trim(code, "0123456789") != "" {
+		code = "other"
+	}
+	if brand == "" {
+		brand = "unknown"
+	}
+	metrics.RecordGatewayResult(logctx.Merchant(ctx), txType, code, category, brand)
+}
+
+// planETag formats a plan version as an HTTP entity tag
+func planETag(plan Plan) string {
+	return `"` + strconv.Itoa(plan.Version) + `"`
+}
+
 // Helper function to add billing information to form data
 func addBillingInfo(formData url.Values, billing *BillingInfo) {
 	if billing == nil {
@@ -789,32 +1390,3 @@ func generateUniqueVaultID() string {
 	}
 	return strconv.FormatInt(int64(b[0])<<56|int64(b[1])<<48|int64(b[2])<<40|int64(b[3])<<32|int64(b[4])<<24|int64(b[5])<<16|int64(b[6])<<8|int64(b[7]), 10)
 }
-
-// Helper function to send requests to NMI
-func sendRequest(ctx context.Context, formData url.Values) (string, error) {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	httpReq, err := http.NewRequestWithContext(ctx, "POST",
-		"https://secure.nmi.com/api/transact.php",
-		bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return "", NewNMIError(ErrProcessingError, "failed to create request", "")
-	}
-
-	httpReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		return "", NewNMIError(ErrNetworkError, "network error: "+err.Error(), "")
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", NewNMIError(ErrProcessingError, "failed to read response", "")
-	}
-
-	return string(body), nil
-}
@@ -1,9 +1,16 @@
 package api
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
+	"nmi-pay-int/config"
+
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidatePaymentRequest(t *testing.T) {
@@ -18,7 +25,7 @@ func TestValidatePaymentRequest(t *testing.T) {
             req: PaymentRequest{
                 Amount:     "10.99",
                 CreditCard: "4111111111111111",
-                ExpDate:    "1225",
+                ExpDate:    "1230",
                 CVV:       "123",
                 Type:      "sale",
             },
@@ -29,7 +36,7 @@ func TestValidatePaymentRequest(t *testing.T) {
             req: PaymentRequest{
                 Amount:     "10.9",
                 CreditCard: "4111111111111111",
-                ExpDate:    "1225",
+                ExpDate:    "1230",
                 CVV:       "123",
                 Type:      "sale",
             },
@@ -48,6 +55,36 @@ func TestValidatePaymentRequest(t *testing.T) {
             wantErr: true,
             errCode: ErrInvalidCard,
         },
+        {
+            name: "Collect.js Token Only",
+            req: PaymentRequest{
+                Amount:       "10.99",
+                PaymentToken: "3455zJms-7qA2K2-VdVrSu-Rv7WpvPuG7s8",
+                Type:         "sale",
+            },
+            wantErr: false,
+        },
+        {
+            name: "Collect.js Token With Card Number",
+            req: PaymentRequest{
+                Amount:       "10.99",
+                PaymentToken: "3455zJms-7qA2K2-VdVrSu-Rv7WpvPuG7s8",
+                CreditCard:   "4111111111111111",
+                Type:         "sale",
+            },
+            wantErr: true,
+            errCode: ErrInvalidRequest,
+        },
+        {
+            name: "Malformed Collect.js Token",
+            req: PaymentRequest{
+                Amount:       "10.99",
+                PaymentToken: "tok en",
+                Type:         "sale",
+            },
+            wantErr: true,
+            errCode: ErrInvalidRequest,
+        },
     }
 
     for _, tt := range tests {
@@ -63,4 +100,54 @@ func TestValidatePaymentRequest(t *testing.T) {
             }
         })
     }
-}
\ No newline at end of file
+}
+
+func TestCollectJSPaymentToken(t *testing.T) {
+    var form url.Values
+    gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        require.NoError(t, r.ParseForm())
+        form = r.PostForm
+        w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=5501&type=sale&response_code=100"))
+    }))
+    defer gateway.Close()
+
+    client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+    _, err := client.ProcessPayment(context.Background(), PaymentRequest{
+        Amount:       "10.99",
+        PaymentToken: "3455zJms-7qA2K2-VdVrSu-Rv7WpvPuG7s8",
+        Type:         "sale",
+    })
+    require.NoError(t, err)
+    assert.Equal(t, "3455zJms-7qA2K2-VdVrSu-Rv7WpvPuG7s8", form.Get("payment_token"))
+    assert.Empty(t, form.Get("ccnumber"))
+    assert.Empty(t, form.Get("cvv"))
+}
+
+func TestProcessPaymentCustomerReceipt(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=778&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	receipt := true
+	req := PaymentRequest{
+		Amount: "10.00", Type: "sale", CustomerVaultID: "123456789",
+		Billing: &BillingInfo{FirstName: "Ada", LastName: "Lovelace", Address1: "1 Main St", City: "New York", State: "NY", Zip: "10001", Country: "US", Email: "ada@example.com"},
+	}
+	_, err := client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+	assert.Empty(t, form.Get("customer_receipt"))
+	assert.Empty(t, form.Get("email"), "billing is not sent on sales")
+	assert.Empty(t, form.Get("address1"))
+
+	req.CustomerReceipt = &receipt
+	_, err = client.ProcessPayment(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "true", form.Get("customer_receipt"))
+	assert.Equal(t, "ada@example.com", form.Get("email"))
+	assert.Empty(t, form.Get("address1"))
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleUpdatePlanOptimisticLocking(t *testing.T) {
+	plans := NewMemoryPlanRepository()
+	_, err := plans.Create(context.Background(), Plan{ID: "lock-test", Name: "Basic", Amount: "10.00"})
+	require.NoError(t, err)
+
+	update := func(body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/plans/update", strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		HandleUpdatePlan(plans)(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		ifMatch    string
+		wantStatus int
+		wantETag   string
+	}{
+		{
+			name:       "Missing Version",
+			body:       `{"id":"lock-test","amount":"12.00"}`,
+			wantStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:       "Matching If-Match",
+			body:       `{"id":"lock-test","amount":"12.00"}`,
+			ifMatch:    `"1"`,
+			wantStatus: http.StatusOK,
+			wantETag:   `"2"`,
+		},
+		{
+			name:       "Stale Version Conflicts",
+			body:       `{"id":"lock-test","amount":"15.00","version":1}`,
+			wantStatus: http.StatusConflict,
+			wantETag:   `"2"`,
+		},
+		{
+			name:       "Current Version In Body",
+			body:       `{"id":"lock-test","name":"Plus","version":2}`,
+			wantStatus: http.StatusOK,
+			wantETag:   `"3"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := update(tt.body, tt.ifMatch)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantETag != "" {
+				assert.Equal(t, tt.wantETag, rec.Header().Get("ETag"))
+			}
+		})
+	}
+
+	plan, err := plans.Get(context.Background(), "lock-test")
+	require.NoError(t, err)
+	assert.Equal(t, "12.00", plan.Amount)
+	assert.Equal(t, "Plus", plan.Name)
+}
+
+func TestSQLPlanRepository(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	plans, err := NewSQLPlanRepository(ctx, database)
+	require.NoError(t, err)
+
+	created, err := plans.Create(ctx, Plan{ID: "gold", Name: "Gold", Amount: "20.00", MonthFrequency: "1", DayOfMonth: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, created.Version)
+
+	_, err = plans.Create(ctx, Plan{ID: "gold", Name: "Gold again", Amount: "25.00"})
+	assert.ErrorIs(t, err, ErrPlanExists)
+
+	created.Amount = "22.00"
+	updated, err := plans.Update(ctx, created)
+	require.NoError(t, err)
+	assert.Equal(t, 2, updated.Version)
+
+	// Writing from the stale copy must not overwrite the newer version
+	current, err := plans.Update(ctx, created)
+	assert.ErrorIs(t, err, ErrPlanVersionConflict)
+	assert.Equal(t, 2, current.Version)
+
+	stored, err := plans.Get(ctx, "gold")
+	require.NoError(t, err)
+	assert.Equal(t, "22.00", stored.Amount)
+	assert.Equal(t, "1", stored.DayOfMonth)
+
+	list, err := plans.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// Reopening migrates nothing and keeps the data
+	_, err = NewSQLPlanRepository(ctx, database)
+	require.NoError(t, err)
+
+	require.NoError(t, plans.Delete(ctx, "gold"))
+	assert.ErrorIs(t, plans.Delete(ctx, "gold"), ErrPlanNotFound)
+	_, err = plans.Get(ctx, "gold")
+	assert.ErrorIs(t, err, ErrPlanNotFound)
+	_, err = plans.Update(ctx, updated)
+	assert.ErrorIs(t, err, ErrPlanNotFound)
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	"sort"
+	"sync"
+
+	"nmi-pay-int/db"
+)
+
+// Plan repository errors
+var (
+	ErrPlanNotFound        = errors.New("plan not found")
+	ErrPlanExists          = errors.New("plan ID already exists")
+	ErrPlanVersionConflict = errors.New("plan was modified concurrently")
+)
+
+// PlanRepository stores subscription plans
+type PlanRepository interface {
+	Get(ctx context.Context, id string) (Plan, error)
+	// List returns all plans ordered by ID
+	List(ctx context.Context) ([]Plan, error)
+	// Create adds a new plan at version 1
+	Create(ctx context.Context, plan Plan) (Plan, error)
+	// Update replaces a plan if its stored version still equals
+	// plan.Version, and returns it with the version incremented
+	Update(ctx context.Context, plan Plan) (Plan, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// MemoryPlanRepository keeps plans in process. They are lost on restart and
+// not shared between instances.
+type MemoryPlanRepository struct {
+	mu    sync.RWMutex
+	plans map[string]Plan
+}
+
+// NewMemoryPlanRepository creates an empty in-memory repository
+func NewMemoryPlanRepository() *MemoryPlanRepository {
+	return &MemoryPlanRepository{plans: make(map[string]Plan)}
+}
+
+func (m *MemoryPlanRepository) Get(ctx context.Context, id string) (Plan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	plan, ok := m.plans[id]
+	if !ok {
+		return Plan{}, ErrPlanNotFound
+	}
+	return plan, nil
+}
+
+func (m *MemoryPlanRepository) List(ctx context.Context) ([]Plan, error) {
+	m.mu.RLock()
+	plans := make([]Plan, 0, len(m.plans))
+	for _, plan := range m.plans {
+		plans = append(plans, plan)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID < plans[j].ID })
+	return plans, nil
+}
+
+func (m *MemoryPlanRepository) Create(ctx context.Context, plan Plan) (Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.plans[plan.ID]; exists {
+		return Plan{}, ErrPlanExists
+	}
+	plan.Version = 1
+	m.plans[plan.ID] = plan
+	return plan, nil
+}
+
+func (m *MemoryPlanRepository) Update(ctx context.Context, plan Plan) (Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.plans[plan.ID]
+	if !exists {
+		return Plan{}, ErrPlanNotFound
+	}
+	if current.Version != plan.Version {
+		return current, ErrPlanVersionConflict
+	}
+	plan.Version++
+	m.plans[plan.ID] = plan
+	return plan, nil
+}
+
+func (m *MemoryPlanRepository) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.plans[id]; !exists {
+		return ErrPlanNotFound
+	}
+	delete(m.plans, id)
+	return nil
+}
+
+//go:embed migrations/plans/*.sql
+var planMigrationFiles embed.FS
+
+// SQLPlanRepository stores plans in Postgres or SQLite, so they survive
+// restarts and are shared by every instance using the database
+type SQLPlanRepository struct {
+	db *db.DB
+}
+
+// NewSQLPlanRepository migrates the plans schema and returns a repository
+func NewSQLPlanRepository(ctx context.Context, database *db.DB) (*SQLPlanRepository, error) {
+	migrations, err := fs.Sub(planMigrationFiles, "migrations/plans")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "plans", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLPlanRepository{db: database}, nil
+}
+
+const planColumns = `id, name, amount, day_frequency, payments, month_frequency, day_of_month, version`
+
+func scanPlan(row interface{ Scan(...any) error }) (Plan, error) {
+	var plan Plan
+	err := row.Scan(&plan.ID, &plan.Name, &plan.Amount, &plan.DayFrequency, &plan.Payments,
+		&plan.MonthFrequency, &plan.DayOfMonth, &plan.Version)
+	return plan, err
+}
+
+func (s *SQLPlanRepository) Get(ctx context.Context, id string) (Plan, error) {
+	plan, err := scanPlan(s.db.QueryRowContext(ctx,
+		s.db.Rebind(`SELECT `+planColumns+` FROM plans WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Plan{}, ErrPlanNotFound
+	}
+	return plan, err
+}
+
+func (s *SQLPlanRepository) List(ctx context.Context) ([]Plan, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+planColumns+` FROM plans ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, rows.Err()
+}
+
+func (s *SQLPlanRepository) Create(ctx context.Context, plan Plan) (Plan, error) {
+	plan.Version = 1
+	_, err := s.db.ExecContext(ctx, s.db.Rebind(`INSERT INTO plans (`+planColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		plan.ID, plan.Name, plan.Amount, plan.DayFrequency, plan.Payments, plan.MonthFrequency, plan.DayOfMonth, plan.Version)
+	if db.IsUniqueViolation(err) {
+		return Plan{}, ErrPlanExists
+	}
+	if err != nil {
+		return Plan{}, err
+	}
+	return plan, nil
+}
+
+func (s *SQLPlanRepository) Update(ctx context.Context, plan Plan) (Plan, error) {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(`UPDATE plans
+		SET name = ?, amount = ?, day_frequency = ?, payments = ?, month_frequency = ?, day_of_month = ?,
+			version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND version = ?`),
+		plan.Name, plan.Amount, plan.DayFrequency, plan.Payments, plan.MonthFrequency, plan.DayOfMonth,
+		plan.ID, plan.Version)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return Plan{}, err
+	} else if updated == 0 {
+		// Either the plan is gone or another writer bumped the version
+		current, err := s.Get(ctx, plan.ID)
+		if err != nil {
+			return Plan{}, err
+		}
+		return current, ErrPlanVersionConflict
+	}
+
+	plan.Version++
+	return plan, nil
+}
+
+func (s *SQLPlanRepository) Delete(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(`DELETE FROM plans WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrPlanNotFound
+	}
+	return nil
+}
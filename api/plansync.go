@@ -0,0 +1,267 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nmi-pay-int/logctx"
+)
+
+// Plan reconciliation actions
+const (
+	// PlanPushed is a local plan the gateway did not have
+	PlanPushed = "pushed"
+	// PlanUpdated is a gateway plan changed to match the local one
+	PlanUpdated = "updated"
+	// PlanImported is a gateway plan, such as one added in the NMI portal,
+	// copied into the local store
+	PlanImported = "imported"
+)
+
+// PlanChange is one action taken, or in a dry run planned, by ReconcilePlans
+type PlanChange struct {
+	PlanID string `json:"plan_id"`
+	Action string `json:"action"`
+}
+
+// PlanReconciliation reports what ReconcilePlans did
+type PlanReconciliation struct {
+	DryRun  bool         `json:"dry_run"`
+	Changes []PlanChange `json:"changes"`
+}
+
+// gatewayPlans keeps the gateway's plans in step with a local repository.
+// Every write goes to the gateway as well, on the merchant account of the
+// request context or else the default account, so NMI knows every plan a
+// subscription can be created on.
+type gatewayPlans struct {
+	PlanRepository
+	client *Client
+	apiKey string
+}
+
+// WithGatewayPlans sends plan creates, updates and deletes to the gateway's
+// Recurring API as well as to the plan repository. It wraps whichever
+// repository WithPlanRepository set, so it must come after it.
+func WithGatewayPlans(apiKey string) ClientOption {
+	return func(c *Client) {
+		c.plans = &gatewayPlans{PlanRepository: c.plans, client: c, apiKey: apiKey}
+	}
+}
+
+// key returns the security key of the merchant on ctx, or the default one
+func (g *gatewayPlans) key(ctx context.Context) string {
+	if merchant, ok := MerchantFromContext(ctx); ok && merchant.APIKey != "" {
+		return merchant.APIKey
+	}
+	return g.apiKey
+}
+
+// Create stores the plan, then adds it at the gateway. A plan the gateway
+// rejects is removed again so the two stay the same.
+func (g *gatewayPlans) Create(ctx context.Context, plan Plan) (Plan, error) {
+	if err := validateGatewayPlan(plan); err != nil {
+		return Plan{}, err
+	}
+
+	created, err := g.PlanRepository.Create(ctx, plan)
+	if err != nil {
+		return Plan{}, err
+	}
+	if err := g.client.sendPlan(ctx, g.key(ctx), "add_plan", created); err != nil {
+		if deleteErr := g.PlanRepository.Delete(ctx, created.ID); deleteErr != nil {
+			logctx.From(ctx).WithError(deleteErr).WithField("plan_id", created.ID).Error("Failed to remove plan the gateway rejected")
+		}
+		return Plan{}, err
+	}
+	return created, nil
+}
+
+// Update edits the plan at the gateway, then stores it. The version is
+// checked first so a stale update never reaches the gateway.
+func (g *gatewayPlans) Update(ctx context.Context, plan Plan) (Plan, error) {
+	current, err := g.PlanRepository.Get(ctx, plan.ID)
+	if err != nil {
+		return Plan{}, err
+	}
+	if current.Version != plan.Version {
+		return current, ErrPlanVersionConflict
+	}
+	if err := validateGatewayPlan(plan); err != nil {
+		return Plan{}, err
+	}
+
+	if err := g.client.sendPlan(ctx, g.key(ctx), "edit_plan", plan); err != nil {
+		return Plan{}, err
+	}
+	return g.PlanRepository.Update(ctx, plan)
+}
+
+// Delete removes the plan at the gateway, then locally. A plan the gateway
+// no longer has is still deleted locally.
+func (g *gatewayPlans) Delete(ctx context.Context, id string) error {
+	if _, err := g.PlanRepository.Get(ctx, id); err != nil {
+		return err
+	}
+
+	err := g.client.sendPlan(ctx, g.key(ctx), "delete_plan", Plan{ID: id})
+	var nmiErr *NMIError
+	if err != nil && !(errors.As(err, &nmiErr) && strings.Contains(strings.ToLower(nmiErr.Message), "not found")) {
+		return err
+	}
+	return g.PlanRepository.Delete(ctx, id)
+}
+
+// validateGatewayPlan checks a plan has the billing frequency NMI requires
+func validateGatewayPlan(plan Plan) error {
+	if plan.DayFrequency == "" && (plan.MonthFrequency == "" || plan.DayOfMonth == "") {
+		return NewNMIError(ErrInvalidRequest, "day_frequency, or month_frequency and day_of_month, are required", "")
+	}
+	return nil
+}
+
+// gatewayPlanFields returns the Recurring API fields describing a plan.
+// Amounts are normalized, and a payment count that is not a number, such
+// as "Until canceled", is sent as 0, which NMI reads the same way. Equal
+// plans therefore have equal fields.
+func gatewayPlanFields(plan Plan) url.Values {
+	fields := url.Values{}
+	fields.Set("plan_id", plan.ID)
+	fields.Set("plan_name", plan.Name)
+	fields.Set("plan_amount", plan.Amount)
+	if amount, err := ParseAmount(plan.Amount); err == nil {
+		fields.Set("plan_amount", amount.String())
+	}
+	fields.Set("plan_payments", "0")
+	if payments, err := strconv.Atoi(strings.TrimSpace(plan.Payments)); err == nil && payments > 0 {
+		fields.Set("plan_payments", strconv.Itoa(payments))
+	}
+	if plan.DayFrequency != "" {
+		fields.Set("day_frequency", plan.DayFrequency)
+	} else {
+		fields.Set("month_frequency", plan.MonthFrequency)
+		fields.Set("day_of_month", plan.DayOfMonth)
+	}
+	return fields
+}
+
+// sendPlan makes a Recurring API plan call: add_plan, edit_plan or
+// delete_plan
+func (c *Client) sendPlan(ctx context.Context, apiKey, action string, plan Plan) error {
+	formData := url.Values{}
+	if action != "delete_plan" {
+		formData = gatewayPlanFields(plan)
+	}
+	formData.Set("security_key", apiKey)
+	formData.Set("recurring", action)
+	if action == "edit_plan" {
+		formData.Set("current_plan_id", plan.ID)
+	} else {
+		formData.Set("plan_id", plan.ID)
+	}
+
+	resp, err := c.sendRequest(ctx, formData)
+	if err != nil {
+		return err
+	}
+
+	parsedResp, err := ParseNMIResponse(resp)
+	if err != nil {
+		return err
+	}
+	if parsedResp.Response != "1" {
+		return ParseNMIErrorResponse(parsedResp.ResponseText, parsedResp.ResponseCode, resp)
+	}
+
+	recordActor(ctx, action, plan.ID)
+	return nil
+}
+
+// GatewayPlans lists the plans NMI has on the merchant account, ordered by
+// ID
+func (c *Client) GatewayPlans(ctx context.Context, apiKey string) ([]Plan, error) {
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("report_type", "recurring_plans")
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]Plan, 0, len(parsed.Plans))
+	for _, p := range parsed.Plans {
+		plans = append(plans, p.plan())
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID < plans[j].ID })
+	return plans, nil
+}
+
+// ReconcilePlans makes the gateway's plans and the local ones agree. Local
+// plans are the source of truth: those the gateway lacks are added and those
+// it has differently are edited. Plans only the gateway has are imported, so
+// subscriptions can be created on them. Nothing is deleted on either side.
+// A dry run reports the changes without making them.
+func (c *Client) ReconcilePlans(ctx context.Context, apiKey string, dryRun bool) (*PlanReconciliation, error) {
+	local := c.plans
+	if synced, ok := local.(*gatewayPlans); ok {
+		local = synced.PlanRepository
+	}
+
+	stored, err := local.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := c.GatewayPlans(ctx, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	atGateway := make(map[string]Plan, len(remote))
+	for _, plan := range remote {
+		atGateway[plan.ID] = plan
+	}
+
+	report := &PlanReconciliation{DryRun: dryRun, Changes: []PlanChange{}}
+	for _, plan := range stored {
+		action := PlanPushed
+		if gateway, ok := atGateway[plan.ID]; ok {
+			delete(atGateway, plan.ID)
+			if gatewayPlanFields(gateway).Encode() == gatewayPlanFields(plan).Encode() {
+				continue
+			}
+			action = PlanUpdated
+		}
+
+		if !dryRun {
+			if err := validateGatewayPlan(plan); err != nil {
+				return report, NewNMIError(ErrInvalidRequest, "plan "+plan.ID+": "+err.(*NMIError).Message, "")
+			}
+			call := "add_plan"
+			if action == PlanUpdated {
+				call = "edit_plan"
+			}
+			if err := c.sendPlan(ctx, apiKey, call, plan); err != nil {
+				return report, err
+			}
+		}
+		report.Changes = append(report.Changes, PlanChange{PlanID: plan.ID, Action: action})
+	}
+
+	for _, plan := range remote {
+		if _, only := atGateway[plan.ID]; !only {
+			continue
+		}
+		if !dryRun {
+			if _, err := local.Create(ctx, plan); err != nil && !errors.Is(err, ErrPlanExists) {
+				return report, err
+			}
+		}
+		report.Changes = append(report.Changes, PlanChange{PlanID: plan.ID, Action: PlanImported})
+	}
+
+	return report, nil
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const recurringPlansFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<plan>
+		<plan_id>gold</plan_id>
+		<plan_name>Gold</plan_name>
+		<plan_amount>20.0</plan_amount>
+		<plan_payments>0</plan_payments>
+		<month_frequency>1</month_frequency>
+		<day_of_month>1</day_of_month>
+	</plan>
+	<plan>
+		<plan_id>silver</plan_id>
+		<plan_name>Silver</plan_name>
+		<plan_amount>15.00</plan_amount>
+		<plan_payments>0</plan_payments>
+		<day_frequency>30</day_frequency>
+	</plan>
+	<plan>
+		<plan_id>portal</plan_id>
+		<plan_name>Made in the portal</plan_name>
+		<plan_amount>5.00</plan_amount>
+		<plan_payments>12</plan_payments>
+		<day_frequency>7</day_frequency>
+	</plan>
+</nm_response>`
+
+// planGateway records Recurring API plan calls and answers the plans report
+type planGateway struct {
+	mu     sync.Mutex
+	calls  []url.Values
+	reject string
+}
+
+func (g *planGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.PostForm.Get("report_type") == "recurring_plans" {
+		w.Write([]byte(recurringPlansFixture))
+		return
+	}
+
+	g.mu.Lock()
+	g.calls = append(g.calls, r.PostForm)
+	g.mu.Unlock()
+	if r.PostForm.Get("recurring") == g.reject {
+		w.Write([]byte("response=3&responsetext=Plan Payments is invalid REFID:1&response_code=300"))
+		return
+	}
+	w.Write([]byte("response=1&responsetext=Plan Added&response_code=100"))
+}
+
+func TestGatewayPlans(t *testing.T) {
+	gateway := &planGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: server.URL, QueryURL: server.URL}, WithGatewayPlans("key"))
+	plans := client.Plans()
+	ctx := context.Background()
+
+	_, err := plans.Create(ctx, Plan{ID: "gold", Name: "Gold", Amount: "20.00"})
+	assert.ErrorContains(t, err, "day_frequency")
+	assert.Empty(t, gateway.calls)
+
+	plan, err := plans.Create(ctx, Plan{ID: "gold", Name: "Gold", Amount: "20.0", Payments: "Until canceled", MonthFrequency: "1", DayOfMonth: "1"})
+	require.NoError(t, err)
+	require.Len(t, gateway.calls, 1)
+	assert.Equal(t, "add_plan", gateway.calls[0].Get("recurring"))
+	assert.Equal(t, "20.00", gateway.calls[0].Get("plan_amount"))
+	assert.Equal(t, "0", gateway.calls[0].Get("plan_payments"))
+	assert.Equal(t, "key", gateway.calls[0].Get("security_key"))
+
+	plan.Amount = "25.00"
+	plan, err = plans.Update(ctx, plan)
+	require.NoError(t, err)
+	assert.Equal(t, "edit_plan", gateway.calls[1].Get("recurring"))
+	assert.Equal(t, "gold", gateway.calls[1].Get("current_plan_id"))
+
+	// A stale version never reaches the gateway
+	plan.Version = 1
+	_, err = plans.Update(ctx, plan)
+	assert.ErrorIs(t, err, ErrPlanVersionConflict)
+	assert.Len(t, gateway.calls, 2)
+
+	// A plan the gateway rejects is not kept
+	gateway.reject = "add_plan"
+	_, err = plans.Create(ctx, Plan{ID: "bad", Name: "Bad", Amount: "1.00", DayFrequency: "7"})
+	require.Error(t, err)
+	_, err = plans.Get(ctx, "bad")
+	assert.ErrorIs(t, err, ErrPlanNotFound)
+
+	require.NoError(t, plans.Delete(ctx, "gold"))
+	assert.Equal(t, "delete_plan", gateway.calls[len(gateway.calls)-1].Get("recurring"))
+	_, err = plans.Get(ctx, "gold")
+	assert.ErrorIs(t, err, ErrPlanNotFound)
+}
+
+func TestReconcilePlans(t *testing.T) {
+	gateway := &planGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	local := NewMemoryPlanRepository()
+	ctx := context.Background()
+	// gold matches the gateway once amounts are normalized; silver differs
+	local.Create(ctx, Plan{ID: "gold", Name: "Gold", Amount: "20.00", Payments: "Until canceled", MonthFrequency: "1", DayOfMonth: "1"})
+	local.Create(ctx, Plan{ID: "silver", Name: "Silver", Amount: "17.00", DayFrequency: "30"})
+	local.Create(ctx, Plan{ID: "bronze", Name: "Bronze", Amount: "9.00", DayFrequency: "30"})
+
+	client := NewClient(&config.Config{APIBaseURL: server.URL, QueryURL: server.URL},
+		WithPlanRepository(local), WithGatewayPlans("key"))
+
+	report, err := client.ReconcilePlans(ctx, "key", true)
+	require.NoError(t, err)
+	want := []PlanChange{
+		{PlanID: "bronze", Action: PlanPushed},
+		{PlanID: "silver", Action: PlanUpdated},
+		{PlanID: "portal", Action: PlanImported},
+	}
+	assert.Equal(t, want, report.Changes)
+	assert.Empty(t, gateway.calls)
+	_, err = local.Get(ctx, "portal")
+	assert.ErrorIs(t, err, ErrPlanNotFound)
+
+	report, err = client.ReconcilePlans(ctx, "key", false)
+	require.NoError(t, err)
+	assert.Equal(t, want, report.Changes)
+	require.Len(t, gateway.calls, 2)
+	assert.Equal(t, "add_plan", gateway.calls[0].Get("recurring"))
+	assert.Equal(t, "edit_plan", gateway.calls[1].Get("recurring"))
+	assert.Equal(t, "17.00", gateway.calls[1].Get("plan_amount"))
+
+	imported, err := local.Get(ctx, "portal")
+	require.NoError(t, err)
+	assert.Equal(t, "12", imported.Payments)
+	assert.True(t, strings.HasPrefix(imported.Name, "Made"))
+}
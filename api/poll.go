@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// Transaction conditions reported by the Query API that are not yet final
+var pendingConditions = map[string]bool{
+	"":            true, // not visible to the Query API yet
+	"pending":     true,
+	"in_progress": true,
+}
+
+// PollBackoff controls how often PollUntil retries
+type PollBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// DefaultPollBackoff starts at half a second and caps at five seconds
+var DefaultPollBackoff = PollBackoff{
+	Initial:    500 * time.Millisecond,
+	Max:        5 * time.Second,
+	Multiplier: 2,
+}
+
+// next returns the interval to wait after the given one
+func (b PollBackoff) next(interval time.Duration) time.Duration {
+	interval = time.Duration(float64(interval) * b.Multiplier)
+	if interval > b.Max {
+		return b.Max
+	}
+	return interval
+}
+
+// PollUntil calls check with capped exponential backoff until it reports done,
+// returns an error, or ctx ends. A cancelled or expired context is reported as
+// a deadline_exceeded NMIError.
+func PollUntil(ctx context.Context, backoff PollBackoff, check func(ctx context.Context) (bool, error)) error {
+	interval := backoff.Initial
+	for {
+		done, err := check(ctx)
+		if err != nil || done {
+			return err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return NewNMIError(ErrDeadlineExceeded, "stopped waiting: "+ctx.Err().Error(), "")
+		case <-timer.C:
+		}
+		interval = backoff.next(interval)
+	}
+}
+
+// TransactionState is a transaction's condition as reported by the Query API
+type TransactionState struct {
+	TransactionID string `json:"transaction_id"`
+	Condition     string `json:"condition"`
+	Final         bool   `json:"final"`
+	ResponseText  string `json:"response_text,omitempty"`
+	ResponseCode  string `json:"response_code,omitempty"`
+}
+
+// GetTransactionState queries NMI for a transaction's current condition
+func (c *Client) GetTransactionState(ctx context.Context, apiKey, transactionID string) (*TransactionState, error) {
+	if transactionID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "transaction_id is required", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("transaction_id", transactionID)
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &TransactionState{TransactionID: transactionID}
+	if len(parsed.Transactions) > 0 {
+		tx := parsed.Transactions[0]
+		state.Condition = tx.Condition
+		if len(tx.Actions) > 0 {
+			last := tx.Actions[len(tx.Actions)-1]
+			state.ResponseText = last.ResponseText
+			state.ResponseCode = last.ResponseCode
+		}
+	}
+	state.Final = !pendingConditions[state.Condition]
+
+	return state, nil
+}
+
+// WaitForTransaction polls NMI until the transaction reaches a final state or
+// ctx ends. When ctx ends first the last observed state is returned together
+// with a deadline_exceeded error.
+func (c *Client) WaitForTransaction(ctx context.Context, apiKey, transactionID string, backoff PollBackoff) (*TransactionState, error) {
+	state := &TransactionState{TransactionID: transactionID}
+
+	err := PollUntil(ctx, backoff, func(ctx context.Context) (bool, error) {
+		current, err := c.GetTransactionState(ctx, apiKey, transactionID)
+		if err != nil {
+			return false, err
+		}
+		state = current
+		return current.Final, nil
+	})
+
+	return state, err
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testBackoff = PollBackoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, Multiplier: 2}
+
+func TestPollBackoffCapped(t *testing.T) {
+	interval := testBackoff.Initial
+	for i := 0; i < 5; i++ {
+		interval = testBackoff.next(interval)
+	}
+	assert.Equal(t, testBackoff.Max, interval)
+}
+
+func TestPollUntil(t *testing.T) {
+	t.Run("Completes", func(t *testing.T) {
+		calls := 0
+		err := PollUntil(context.Background(), testBackoff, func(ctx context.Context) (bool, error) {
+			calls++
+			return calls == 3, nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("Context Ends", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		err := PollUntil(ctx, testBackoff, func(ctx context.Context) (bool, error) {
+			return false, nil
+		})
+		require.Error(t, err)
+		nmiErr, ok := err.(*NMIError)
+		require.True(t, ok)
+		assert.Equal(t, ErrDeadlineExceeded, nmiErr.Code)
+	})
+
+	t.Run("Check Error", func(t *testing.T) {
+		err := PollUntil(context.Background(), testBackoff, func(ctx context.Context) (bool, error) {
+			return false, NewNMIError(ErrNetworkError, "boom", "")
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+// Credential check states
+const (
+	CredentialsPending     = "pending"
+	CredentialsValid       = "valid"
+	CredentialsInvalid     = "invalid"
+	CredentialsUnreachable = "unreachable"
+)
+
+// CredentialStatus describes the outcome of the last security key check
+type CredentialStatus struct {
+	State     string    `json:"state"`
+	Message   string    `json:"message"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+var credentialStatus = struct {
+	sync.RWMutex
+	status CredentialStatus
+}{status: CredentialStatus{State: CredentialsPending, Message: "credential check has not run yet"}}
+
+// ValidateCredentials sends a cheap validate request with no card data. NMI
+// rejects it either way, but only rejects it with an authentication failure
+// when the security key itself is wrong.
+func (c *Client) ValidateCredentials(ctx context.Context, apiKey string) error {
+	if apiKey == "" {
+		return NewNMIError(ErrAuthenticationFailed, "security key is empty", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("type", "validate")
+
+	resp, err := c.sendRequest(ctx, formData)
+	if err != nil {
+		return err
+	}
+
+	_, err = ParseNMIResponse(resp)
+	var nmiErr *NMIError
+	if errors.As(err, &nmiErr) && nmiErr.Code == ErrAuthenticationFailed {
+		return nmiErr
+	}
+
+	return nil
+}
+
+// RunCredentialCheck validates apiKey and records the result for readiness.
+// It runs at startup and should be called again whenever the key rotates.
+func (c *Client) RunCredentialCheck(ctx context.Context, apiKey string) CredentialStatus {
+	status := CredentialStatus{
+		State:     CredentialsValid,
+		Message:   "NMI accepted the security key",
+		CheckedAt: time.Now(),
+	}
+
+	if err := c.ValidateCredentials(ctx, apiKey); err != nil {
+		var nmiErr *NMIError
+		if errors.As(err, &nmiErr) && nmiErr.Code == ErrAuthenticationFailed {
+			status.State = CredentialsInvalid
+			status.Message = "NMI rejected the security key: " + nmiErr.Message + " (check NMI_API_KEY and API_URL)"
+		} else {
+			status.State = CredentialsUnreachable
+			status.Message = "could not verify the security key: " + err.Error()
+		}
+		metrics.LogError(ctx, errors.New("pre-flight credential check failed: "+status.Message))
+	} else {
+		metrics.LogInfo(ctx, "Pre-flight credential check passed")
+	}
+
+	credentialStatus.Lock()
+	credentialStatus.status = status
+	credentialStatus.Unlock()
+
+	return status
+}
+
+// GetCredentialStatus returns the result of the last credential check
+func GetCredentialStatus() CredentialStatus {
+	credentialStatus.RLock()
+	defer credentialStatus.RUnlock()
+	return credentialStatus.status
+}
+
+// HandleReadiness reports whether the service can process payments, failing
+// with the credential check diagnostic until the security key is verified
+func HandleReadiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := GetCredentialStatus()
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.State != CredentialsValid {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ready":       status.State == CredentialsValid,
+			"credentials": status,
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// queryResponse is the XML document returned by NMI's Query API
+type queryResponse struct {
+	XMLName       xml.Name            `xml:"nm_response"`
+	Transactions  []queryTransaction  `xml:"transaction"`
+	Customers     []queryCustomer     `xml:"customer_vault>customer"`
+	Subscriptions []querySubscription `xml:"subscription"`
+	Plans         []queryPlan         `xml:"plan"`
+	Error         string              `xml:"error_response"`
+
+	raw string
+}
+
+type queryTransaction struct {
+	TransactionID     string        `xml:"transaction_id"`
+	TransactionType   string        `xml:"transaction_type"`
+	Condition         string        `xml:"condition"`
+	OrderID           string        `xml:"order_id"`
+	OrderDescription  string        `xml:"order_description"`
+	PONumber          string        `xml:"ponumber"`
+	AuthorizationCode string        `xml:"authorization_code"`
+	FirstName         string        `xml:"first_name"`
+	LastName          string        `xml:"last_name"`
+	Email             string        `xml:"email"`
+	CustomerID        string        `xml:"customerid"`
+	CCNumber          string        `xml:"cc_number"`
+	CCExp             string        `xml:"cc_exp"`
+	CCType            string        `xml:"cc_type"`
+	CCBin             string        `xml:"cc_bin"`
+	CheckAccount      string        `xml:"check_account"`
+	AVSResponse       string        `xml:"avs_response"`
+	CSCResponse       string        `xml:"csc_response"`
+	Currency          string        `xml:"currency"`
+	Actions           []queryAction `xml:"action"`
+}
+
+type queryAction struct {
+	Amount       string `xml:"amount"`
+	ActionType   string `xml:"action_type"`
+	Date         string `xml:"date"`
+	Success      string `xml:"success"`
+	Source       string `xml:"source"`
+	Username     string `xml:"username"`
+	ResponseText string `xml:"response_text"`
+	ResponseCode string `xml:"response_code"`
+	BatchID      string `xml:"batch_id"`
+}
+
+// queryPlan is a plan in a report_type=recurring_plans report, or the plan
+// of a subscription in a recurring report
+type queryPlan struct {
+	PlanID         string `xml:"plan_id"`
+	Name           string `xml:"plan_name"`
+	Amount         string `xml:"plan_amount"`
+	Payments       string `xml:"plan_payments"`
+	DayFrequency   string `xml:"day_frequency"`
+	MonthFrequency string `xml:"month_frequency"`
+	DayOfMonth     string `xml:"day_of_month"`
+}
+
+func (p queryPlan) plan() Plan {
+	return Plan{
+		ID:             p.PlanID,
+		Name:           p.Name,
+		Amount:         p.Amount,
+		DayFrequency:   p.DayFrequency,
+		Payments:       p.Payments,
+		MonthFrequency: p.MonthFrequency,
+		DayOfMonth:     p.DayOfMonth,
+	}
+}
+
+// querySubscription is a subscription in a report_type=recurring report
+type querySubscription struct {
+	SubscriptionID  string    `xml:"subscription_id"`
+	Plan            queryPlan `xml:"plan"`
+	CustomerVaultID string    `xml:"customer_vault_id"`
+	NextChargeDate  string    `xml:"next_charge_date"`
+}
+
+// queryDateLayout is the timestamp format used by the Query API
+const queryDateLayout = "20060102150405"
+
+// SubscriptionPayment is a single charge attempt made for a subscription
+type SubscriptionPayment struct {
+	TransactionID string    `json:"transaction_id"`
+	Date          time.Time `json:"date"`
+	Amount        string    `json:"amount"`
+	Result        string    `json:"result"` // approved or declined
+	ResponseText  string    `json:"response_text"`
+	ResponseCode  string    `json:"response_code"`
+	// DeclineReason and DeclineCategory are set for declined payments
+	DeclineReason   DeclineReason   `json:"decline_reason,omitempty"`
+	DeclineCategory DeclineCategory `json:"decline_category,omitempty"`
+}
+
+// sendQuery posts to NMI's Query API and decodes the XML response
+func (c *Client) sendQuery(ctx context.Context, formData url.Values) (*queryResponse, error) {
+	send := func(ctx context.Context) (string, error) {
+		return c.sendRequestTo(ctx, c.queryURL, formData)
+	}
+
+	resp, err := c.traceGateway(ctx, "nmi.query", formData, func(ctx context.Context) (string, error) {
+		if c.hedge != nil {
+			return c.hedge.do(ctx, send)
+		}
+		return send(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed queryResponse
+	if err := xml.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, NewNMIError(ErrProcessingError, fmt.Sprintf("failed to parse query response: %v", err), resp)
+	}
+
+	if parsed.Error != "" {
+		code := ErrProcessingError
+		if strings.Contains(strings.ToLower(parsed.Error), "authentication") {
+			code = ErrAuthenticationFailed
+		}
+		return nil, NewNMIError(code, strings.TrimSpace(parsed.Error), resp)
+	}
+	parsed.raw = resp
+
+	return &parsed, nil
+}
+
+// GetSubscriptionPayments lists every charge attempt NMI made for a
+// subscription, oldest first
+func (c *Client) GetSubscriptionPayments(ctx context.Context, apiKey, subscriptionID string) ([]SubscriptionPayment, error) {
+	if subscriptionID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "subscription_id is required", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("subscription_id", subscriptionID)
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		return nil, err
+	}
+
+	payments := []SubscriptionPayment{}
+	for _, tx := range parsed.Transactions {
+		for _, action := range tx.Actions {
+			if action.ActionType != "sale" && action.ActionType != "auth" {
+				continue
+			}
+
+			result := "declined"
+			var reason DeclineReason
+			var category DeclineCategory
+			if action.Success == "1" {
+				result = "approved"
+			} else {
+				reason = NormalizeResponseText(action.ResponseText, action.ResponseCode)
+				category = CategorizeDecline(action.ResponseCode, reason)
+			}
+
+			date, _ := time.Parse(queryDateLayout, action.Date)
+			payments = append(payments, SubscriptionPayment{
+				TransactionID:   tx.TransactionID,
+				Date:            date,
+				Amount:          action.Amount,
+				Result:          result,
+				ResponseText:    action.ResponseText,
+				ResponseCode:    action.ResponseCode,
+				DeclineReason:   reason,
+				DeclineCategory: category,
+			})
+		}
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].Date.Before(payments[j].Date)
+	})
+
+	return payments, nil
+}
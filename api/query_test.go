@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/fixtures"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSubscriptionPaymentsParsing(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		want        []SubscriptionPayment
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			fixture: "query/empty_report",
+			want:    []SubscriptionPayment{},
+		},
+		{
+			// Captures and refunds are not charge attempts; the attempts
+			// come back oldest first whatever the report's order
+			fixture: "query/subscription_payments_retried",
+			want: []SubscriptionPayment{
+				{
+					TransactionID: "10317700003", Date: time.Date(2025, 4, 1, 6, 0, 0, 0, time.UTC), Amount: "29.99",
+					Result: "declined", ResponseText: "Insufficient funds", ResponseCode: "202",
+					DeclineReason: DeclineInsufficientFunds, DeclineCategory: CategoryInsufficientFunds,
+				},
+				{
+					TransactionID: "10317700004", Date: time.Date(2025, 4, 2, 6, 0, 0, 0, time.UTC), Amount: "29.99",
+					Result: "approved", ResponseText: "SUCCESS", ResponseCode: "100",
+				},
+			},
+		},
+		{
+			fixture:     "query/error_authentication_failed",
+			wantCode:    ErrAuthenticationFailed,
+			wantMessage: "Authentication Failed",
+		},
+		{
+			fixture:     "query/error_invalid_date",
+			wantCode:    ErrProcessingError,
+			wantMessage: "Invalid Start Date format specified",
+		},
+		{
+			fixture:  "query/malformed_html",
+			wantCode: ErrProcessingError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			gateway := httptest.NewServer(fixtures.Handler(tt.fixture))
+			defer gateway.Close()
+			client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+			payments, err := client.GetSubscriptionPayments(context.Background(), "key", "4415586613")
+			if tt.wantCode == "" {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, payments)
+				return
+			}
+			var nmiErr *NMIError
+			require.ErrorAs(t, err, &nmiErr)
+			assert.Equal(t, tt.wantCode, nmiErr.Code)
+			if tt.wantMessage != "" {
+				assert.Equal(t, tt.wantMessage, nmiErr.Message)
+			}
+			assert.Equal(t, fixtures.Body(tt.fixture), nmiErr.Raw, "the gateway's body is kept for debugging")
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package api
+
+import "nmi-pay-int/pci"
+
+// Request types format themselves with card data and security keys masked,
+// so a request logged with %v or %+v does not leak the card it carries.
+// JSON encoding is left alone: the Go client sends these types as they are.
+
+func (r PaymentRequest) String() string          { return pci.Format(r) }
+func (r ACHRequest) String() string              { return pci.Format(r) }
+func (r CaptureRequest) String() string          { return pci.Format(r) }
+func (r RefundRequest) String() string           { return pci.Format(r) }
+func (r VoidRequest) String() string             { return pci.Format(r) }
+func (r LookupRequest) String() string           { return pci.Format(r) }
+func (r RecurringPaymentRequest) String() string { return pci.Format(r) }
+func (r VaultUpdateRequest) String() string      { return pci.Format(r) }
+func (r TerminalInitRequest) String() string     { return pci.Format(r) }
+func (r TerminalPaymentRequest) String() string  { return pci.Format(r) }
+func (r MigrationRequest) String() string        { return pci.Format(r) }
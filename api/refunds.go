@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"sync"
+	"time"
+
+	"nmi-pay-int/db"
+)
+
+// Refund is one approved refund against an earlier sale
+type Refund struct {
+	// TransactionID is the sale that was refunded
+	TransactionID string `json:"transaction_id"`
+	// RefundID is the gateway transaction ID of the refund itself
+	RefundID  string    `json:"refund_id"`
+	Amount    string    `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RefundSummary is a sale's refund history and what is left to refund
+type RefundSummary struct {
+	TransactionID   string   `json:"transaction_id"`
+	OriginalAmount  string   `json:"original_amount"`
+	RefundedAmount  string   `json:"refunded_amount"`
+	RemainingAmount string   `json:"remaining_amount"`
+	Refunds         []Refund `json:"refunds"`
+}
+
+// RefundLedger records the refunds made against each sale, so partial
+// refunds can be checked against what has already been returned
+type RefundLedger interface {
+	// List returns a sale's refunds, oldest first
+	List(ctx context.Context, transactionID string) ([]Refund, error)
+	Record(ctx context.Context, refund Refund) error
+}
+
+// MemoryRefundLedger keeps refunds in process. They are lost on restart and
+// not shared between instances.
+type MemoryRefundLedger struct {
+	mu      sync.RWMutex
+	refunds map[string][]Refund
+}
+
+// NewMemoryRefundLedger creates an empty in-memory ledger
+func NewMemoryRefundLedger() *MemoryRefundLedger {
+	return &MemoryRefundLedger{refunds: make(map[string][]Refund)}
+}
+
+func (m *MemoryRefundLedger) List(ctx context.Context, transactionID string) ([]Refund, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Refund{}, m.refunds[transactionID]...), nil
+}
+
+func (m *MemoryRefundLedger) Record(ctx context.Context, refund Refund) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refunds[refund.TransactionID] = append(m.refunds[refund.TransactionID], refund)
+	return nil
+}
+
+//go:embed migrations/refunds/*.sql
+var refundMigrationFiles embed.FS
+
+// SQLRefundLedger stores refunds in Postgres or SQLite, so every instance
+// sees the refunds the others made
+type SQLRefundLedger struct {
+	db *db.DB
+}
+
+// NewSQLRefundLedger migrates the refunds schema and returns a ledger
+func NewSQLRefundLedger(ctx context.Context, database *db.DB) (*SQLRefundLedger, error) {
+	migrations, err := fs.Sub(refundMigrationFiles, "migrations/refunds")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "refunds", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLRefundLedger{db: database}, nil
+}
+
+func (s *SQLRefundLedger) List(ctx context.Context, transactionID string) ([]Refund, error) {
+	rows, err := s.db.QueryContext(ctx, s.db.Rebind(`SELECT transaction_id, refund_id, amount, created_at
+		FROM refunds WHERE transaction_id = ? ORDER BY created_at, refund_id`), transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		var refund Refund
+		if err := rows.Scan(&refund.TransactionID, &refund.RefundID, &refund.Amount, &refund.CreatedAt); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
+}
+
+func (s *SQLRefundLedger) Record(ctx context.Context, refund Refund) error {
+	_, err := s.db.ExecContext(ctx, s.db.Rebind(`INSERT INTO refunds (transaction_id, refund_id, amount, created_at)
+		VALUES (?, ?, ?, ?)`),
+		refund.TransactionID, refund.RefundID, refund.Amount, refund.CreatedAt.UTC())
+	return err
+}
+
+// refundLocks serializes refunds of the same sale within this instance, so
+// two partial refunds cannot both pass the remaining-amount check
+type refundLocks struct {
+	mu    sync.Mutex
+	locks map[string]*refundLock
+}
+
+type refundLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newRefundLocks() *refundLocks {
+	return &refundLocks{locks: make(map[string]*refundLock)}
+}
+
+// lock blocks until the caller holds transactionID, and returns the unlock
+func (l *refundLocks) lock(transactionID string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[transactionID]
+	if !ok {
+		lock = &refundLock{}
+		l.locks[transactionID] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.waiters--; lock.waiters == 0 {
+			delete(l.locks, transactionID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// summarizeRefunds totals a sale's refunds against its original amount
+func summarizeRefunds(transactionID, originalAmount string, refunds []Refund) *RefundSummary {
+	var refunded int64
+	for _, refund := range refunds {
+		refunded += Amount(refund.Amount).Minor()
+	}
+	remaining := Amount(originalAmount).Minor() - refunded
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &RefundSummary{
+		TransactionID:   transactionID,
+		OriginalAmount:  originalAmount,
+		RefundedAmount:  formatMinor(refunded),
+		RemainingAmount: formatMinor(remaining),
+		Refunds:         refunds,
+	}
+}
+
+// Refunds returns a sale's refund history with its original, refunded and
+// remaining amounts. Only refunds made through this service are counted.
+func (c *Client) Refunds(ctx context.Context, apiKey, transactionID string) (*RefundSummary, error) {
+	if transactionID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "transaction_id is required", "")
+	}
+	lookupResp, err := c.LookupTransaction(ctx, LookupRequest{APIKey: apiKey, TransactionID: transactionID})
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := c.refunds.List(ctx, transactionID)
+	if err != nil {
+		return nil, NewNMIError(ErrInternal, "could not load refunds: "+err.Error(), "")
+	}
+	return summarizeRefunds(transactionID, lookupResp.Amount, refunds), nil
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartialRefunds(t *testing.T) {
+	var refunded []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("type") != "refund" {
+			// Query API lookup of the original sale
+			w.Write([]byte(strings.Replace(queryFixture, "<amount>10.99</amount>", "<amount>20.00</amount>", -1)))
+			return
+		}
+		refunded = append(refunded, r.PostForm.Get("amount"))
+		fmt.Fprintf(w, "response=1&responsetext=SUCCESS&transactionid=R%d&type=refund&response_code=100", len(refunded))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	ctx := context.Background()
+	sale := "10317410976"
+
+	_, err := client.ProcessRefund(ctx, RefundRequest{TransactionID: sale, Amount: "15.00"})
+	require.NoError(t, err)
+
+	_, err = client.ProcessRefund(ctx, RefundRequest{TransactionID: sale, Amount: "6.00"})
+	require.Error(t, err)
+	assert.Equal(t, ErrInvalidRefund, err.(*NMIError).Code)
+	assert.Contains(t, err.Error(), "5.00")
+
+	// Without an amount, only what is left is refunded
+	resp, err := client.ProcessRefund(ctx, RefundRequest{TransactionID: sale})
+	require.NoError(t, err)
+	assert.Equal(t, "5.00", resp.Amount)
+
+	_, err = client.ProcessRefund(ctx, RefundRequest{TransactionID: sale, Amount: "0.01"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fully refunded")
+	assert.Equal(t, []string{"15.00", "5.00"}, refunded)
+
+	summary, err := client.Refunds(ctx, "", sale)
+	require.NoError(t, err)
+	assert.Equal(t, "20.00", summary.OriginalAmount)
+	assert.Equal(t, "20.00", summary.RefundedAmount)
+	assert.Equal(t, "0.00", summary.RemainingAmount)
+	require.Len(t, summary.Refunds, 2)
+	assert.Equal(t, "R1", summary.Refunds[0].RefundID)
+	assert.Equal(t, "R2", summary.Refunds[1].RefundID)
+}
+
+func TestSQLRefundLedger(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	ledger, err := NewSQLRefundLedger(ctx, database)
+	require.NoError(t, err)
+
+	at := time.Date(2026, 10, 16, 14, 0, 0, 0, time.UTC)
+	require.NoError(t, ledger.Record(ctx, Refund{TransactionID: "100", RefundID: "201", Amount: "5.00", CreatedAt: at.Add(time.Hour)}))
+	require.NoError(t, ledger.Record(ctx, Refund{TransactionID: "100", RefundID: "200", Amount: "2.50", CreatedAt: at}))
+	require.NoError(t, ledger.Record(ctx, Refund{TransactionID: "101", RefundID: "202", Amount: "1.00", CreatedAt: at}))
+
+	refunds, err := ledger.List(ctx, "100")
+	require.NoError(t, err)
+	require.Len(t, refunds, 2)
+	assert.Equal(t, "200", refunds[0].RefundID)
+	assert.Equal(t, "5.00", refunds[1].Amount)
+	assert.True(t, at.Equal(refunds[0].CreatedAt))
+
+	// The same gateway refund is never recorded twice
+	assert.Error(t, ledger.Record(ctx, Refund{TransactionID: "100", RefundID: "200", Amount: "2.50", CreatedAt: at}))
+
+	summary := summarizeRefunds("100", "10.00", refunds)
+	assert.Equal(t, "7.50", summary.RefundedAmount)
+	assert.Equal(t, "2.50", summary.RemainingAmount)
+
+	empty, err := ledger.List(ctx, "missing")
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Search paging limits
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 1000
+)
+
+// TransactionRecord is a transaction as reported by NMI's Query API
+type TransactionRecord struct {
+	TransactionID     string              `json:"transaction_id"`
+	TransactionType   string              `json:"transaction_type"` // cc or ck
+	Condition         string              `json:"condition"`
+	Amount            string              `json:"amount"`
+	Currency          string              `json:"currency,omitempty"`
+	OrderID           string              `json:"order_id,omitempty"`
+	OrderDescription  string              `json:"order_description,omitempty"`
+	PONumber          string              `json:"ponumber,omitempty"`
+	AuthorizationCode string              `json:"authorization_code,omitempty"`
+	CustomerID        string              `json:"customer_id,omitempty"`
+	FirstName         string              `json:"first_name,omitempty"`
+	LastName          string              `json:"last_name,omitempty"`
+	Email             string              `json:"email,omitempty"`
+	Card              *CardDetails        `json:"card,omitempty"`
+	MaskedAccount     string              `json:"masked_account,omitempty"`
+	AVSResponse       string              `json:"avsresponse,omitempty"`
+	CVVResponse       string              `json:"cvvresponse,omitempty"`
+	SettlementBatchID string              `json:"settlement_batch_id,omitempty"`
+	Actions           []TransactionAction `json:"actions"`
+}
+
+// CardDetails are the masked card fields NMI reports for a transaction
+type CardDetails struct {
+	MaskedNumber string `json:"masked_number"`
+	Expiry       string `json:"expiry,omitempty"`
+	Type         string `json:"type,omitempty"`
+	BIN          string `json:"bin,omitempty"`
+}
+
+// TransactionAction is one step in a transaction's history (sale, settle,
+// refund, ...)
+type TransactionAction struct {
+	Type         string    `json:"type"`
+	Amount       string    `json:"amount"`
+	Date         time.Time `json:"date"`
+	Success      bool      `json:"success"`
+	Source       string    `json:"source,omitempty"`
+	Username     string    `json:"username,omitempty"`
+	ResponseText string    `json:"response_text,omitempty"`
+	ResponseCode string    `json:"response_code,omitempty"`
+	BatchID      string    `json:"batch_id,omitempty"`
+}
+
+// TransactionSearch filters a Query API search. Page is zero-based.
+type TransactionSearch struct {
+	APIKey          string
+	StartDate       time.Time
+	EndDate         time.Time
+	Conditions      []string // e.g. pending, pendingsettlement, complete, failed
+	TransactionType string   // cc or ck
+	ActionType      string   // e.g. sale, refund, settle
+	OrderID         string
+	CustomerVaultID string
+	Page            int
+	Limit           int
+}
+
+// SearchTransactions lists transactions matching the search, newest first
+func (c *Client) SearchTransactions(ctx context.Context, search TransactionSearch) ([]TransactionRecord, error) {
+	records, err := c.searchTransactions(ctx, search)
+	if c.shadow.sampled(ShadowSearch) {
+		c.shadow.mirror(ctx, ShadowSearch, search.APIKey, searchFingerprint(records), err,
+			func(ctx context.Context, shadow *Client, apiKey string) (map[string]string, error) {
+				mirrored := search
+				mirrored.APIKey = apiKey
+				records, err := shadow.searchTransactions(ctx, mirrored)
+				return searchFingerprint(records), err
+			})
+	}
+	return records, err
+}
+
+func (c *Client) searchTransactions(ctx context.Context, search TransactionSearch) ([]TransactionRecord, error) {
+	if search.Limit <= 0 {
+		search.Limit = DefaultSearchLimit
+	}
+	if search.Limit > MaxSearchLimit {
+		return nil, NewNMIError(ErrInvalidRequest, "limit cannot exceed "+strconv.Itoa(MaxSearchLimit), "")
+	}
+	if search.Page < 0 {
+		return nil, NewNMIError(ErrInvalidRequest, "page cannot be negative", "")
+	}
+	if !search.StartDate.IsZero() && !search.EndDate.IsZero() && search.EndDate.Before(search.StartDate) {
+		return nil, NewNMIError(ErrInvalidRequest, "end_date must not be before start_date", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", search.APIKey)
+	if !search.StartDate.IsZero() {
+		formData.Set("start_date", search.StartDate.Format(queryDateLayout))
+	}
+	if !search.EndDate.IsZero() {
+		formData.Set("end_date", search.EndDate.Format(queryDateLayout))
+	}
+	if len(search.Conditions) > 0 {
+		formData.Set("condition", strings.Join(search.Conditions, ","))
+	}
+	if search.TransactionType != "" {
+		formData.Set("transaction_type", search.TransactionType)
+	}
+	if search.ActionType != "" {
+		formData.Set("action_type", search.ActionType)
+	}
+	if search.OrderID != "" {
+		formData.Set("order_id", search.OrderID)
+	}
+	if search.CustomerVaultID != "" {
+		formData.Set("customer_vault_id", search.CustomerVaultID)
+	}
+	formData.Set("result_order", "reverse")
+	formData.Set("page_number", strconv.Itoa(search.Page))
+	formData.Set("result_limit", strconv.Itoa(search.Limit))
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]TransactionRecord, 0, len(parsed.Transactions))
+	for _, tx := range parsed.Transactions {
+		records = append(records, tx.record())
+	}
+	return records, nil
+}
+
+// GetTransaction fetches a single transaction by ID
+func (c *Client) GetTransaction(ctx context.Context, apiKey, transactionID string) (*TransactionRecord, string, error) {
+	if transactionID == "" {
+		return nil, "", NewNMIError(ErrInvalidRequest, "transaction_id is required", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("transaction_id", transactionID)
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(parsed.Transactions) == 0 {
+		return nil, "", NewNMIError(ErrInvalidRequest, "transaction "+transactionID+" not found", "")
+	}
+
+	record := parsed.Transactions[0].record()
+	return &record, parsed.raw, nil
+}
+
+// record converts a Query API transaction into its API representation
+func (tx queryTransaction) record() TransactionRecord {
+	record := TransactionRecord{
+		TransactionID:     tx.TransactionID,
+		TransactionType:   tx.TransactionType,
+		Condition:         tx.Condition,
+		Currency:          tx.Currency,
+		OrderID:           tx.OrderID,
+		OrderDescription:  tx.OrderDescription,
+		PONumber:          tx.PONumber,
+		AuthorizationCode: tx.AuthorizationCode,
+		CustomerID:        tx.CustomerID,
+		FirstName:         tx.FirstName,
+		LastName:          tx.LastName,
+		Email:             tx.Email,
+		MaskedAccount:     tx.CheckAccount,
+		AVSResponse:       tx.AVSResponse,
+		CVVResponse:       tx.CSCResponse,
+		Actions:           make([]TransactionAction, 0, len(tx.Actions)),
+	}
+
+	if tx.CCNumber != "" {
+		record.Card = &CardDetails{
+			MaskedNumber: tx.CCNumber,
+			Expiry:       tx.CCExp,
+			Type:         tx.CCType,
+			BIN:          tx.CCBin,
+		}
+	}
+
+	for _, a := range tx.Actions {
+		date, _ := time.Parse(queryDateLayout, a.Date)
+		record.Actions = append(record.Actions, TransactionAction{
+			Type:         a.ActionType,
+			Amount:       a.Amount,
+			Date:         date,
+			Success:      a.Success == "1",
+			Source:       a.Source,
+			Username:     a.Username,
+			ResponseText: a.ResponseText,
+			ResponseCode: a.ResponseCode,
+			BatchID:      a.BatchID,
+		})
+
+		switch a.ActionType {
+		case "sale", "auth", "credit":
+			if record.Amount == "" {
+				record.Amount = a.Amount
+			}
+		case "settle":
+			record.SettlementBatchID = a.BatchID
+		}
+	}
+
+	return record
+}
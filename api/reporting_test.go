@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const queryFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<transaction>
+		<transaction_id>10317410976</transaction_id>
+		<transaction_type>cc</transaction_type>
+		<condition>complete</condition>
+		<order_id>ORD-1</order_id>
+		<authorization_code>123456</authorization_code>
+		<cc_number>4xxxxxxxxxxx1111</cc_number>
+		<cc_exp>1230</cc_exp>
+		<cc_type>visa</cc_type>
+		<avs_response>Y</avs_response>
+		<csc_response>M</csc_response>
+		<action>
+			<amount>10.99</amount>
+			<action_type>sale</action_type>
+			<date>20250115182543</date>
+			<success>1</success>
+			<response_text>SUCCESS</response_text>
+			<response_code>100</response_code>
+		</action>
+		<action>
+			<amount>10.99</amount>
+			<action_type>settle</action_type>
+			<date>20250116020000</date>
+			<success>1</success>
+			<batch_id>4412</batch_id>
+		</action>
+	</transaction>
+</nm_response>`
+
+func TestSearchTransactions(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte(queryFixture))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	records, err := client.SearchTransactions(context.Background(), TransactionSearch{
+		StartDate:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:    time.Date(2025, 1, 31, 23, 59, 59, 0, time.UTC),
+		Conditions: []string{"complete", "pendingsettlement"},
+		Page:       2,
+		Limit:      25,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "20250101000000", form.Get("start_date"))
+	assert.Equal(t, "20250131235959", form.Get("end_date"))
+	assert.Equal(t, "complete,pendingsettlement", form.Get("condition"))
+	assert.Equal(t, "2", form.Get("page_number"))
+	assert.Equal(t, "25", form.Get("result_limit"))
+
+	require.Len(t, records, 1)
+	record := records[0]
+	assert.Equal(t, "10317410976", record.TransactionID)
+	assert.Equal(t, "10.99", record.Amount)
+	assert.Equal(t, "4412", record.SettlementBatchID)
+	require.NotNil(t, record.Card)
+	assert.Equal(t, "4xxxxxxxxxxx1111", record.Card.MaskedNumber)
+	assert.Equal(t, "M", record.CVVResponse)
+	require.Len(t, record.Actions, 2)
+	assert.True(t, record.Actions[0].Success)
+}
+
+func TestSearchTransactionsValidation(t *testing.T) {
+	client := NewClient(&config.Config{})
+
+	_, err := client.SearchTransactions(context.Background(), TransactionSearch{Limit: MaxSearchLimit + 1})
+	assert.Error(t, err)
+
+	_, err = client.SearchTransactions(context.Background(), TransactionSearch{
+		StartDate: time.Now(),
+		EndDate:   time.Now().Add(-time.Hour),
+	})
+	assert.Error(t, err)
+}
+
+func TestFindTransactions(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte(strings.Replace(queryFixture, "<order_id>", "<customerid>C-1</customerid><order_id>", 1)))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	ctx := context.Background()
+
+	results, err := client.FindTransactions(ctx, LookupRequest{OrderID: "ORD-1", Page: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "ORD-1", form.Get("order_id"))
+	assert.Equal(t, "1", form.Get("page_number"))
+	require.Len(t, results.Transactions, 1)
+	assert.Equal(t, "10317410976", results.Transactions[0].TransactionID)
+	assert.Equal(t, "sale", results.Transactions[0].Type)
+	assert.True(t, results.HasMore)
+
+	results, err = client.FindTransactions(ctx, LookupRequest{CustomerVaultID: "123456789"})
+	require.NoError(t, err)
+	assert.Equal(t, "123456789", form.Get("customer_vault_id"))
+	assert.Equal(t, DefaultSearchLimit, results.Limit)
+	assert.False(t, results.HasMore)
+
+	// Customer IDs are matched here, since the Query API cannot filter on them
+	results, err = client.FindTransactions(ctx, LookupRequest{CustomerID: "C-2"})
+	require.NoError(t, err)
+	assert.Empty(t, results.Transactions)
+	results, err = client.FindTransactions(ctx, LookupRequest{CustomerID: "C-1"})
+	require.NoError(t, err)
+	assert.Len(t, results.Transactions, 1)
+
+	_, err = client.FindTransactions(ctx, LookupRequest{})
+	assert.ErrorContains(t, err, "is required")
+	_, err = client.FindTransactions(ctx, LookupRequest{TransactionID: "1", OrderID: "ORD-1"})
+	assert.ErrorContains(t, err, "cannot be combined")
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sale batch job statuses
+const (
+	SaleBatchRunning   = "running"
+	SaleBatchCompleted = "completed"
+)
+
+// Per-sale batch results
+const (
+	SaleResultApproved = "approved"
+	SaleResultDeclined = "declined"
+	SaleResultFailed   = "failed"
+)
+
+const (
+	// DefaultSaleBatchWorkers is how many sales of a batch are sent to the
+	// gateway at once when BATCH_SALE_WORKERS is unset
+	DefaultSaleBatchWorkers = 8
+	// MaxSaleBatchSize bounds the sales in one batch
+	MaxSaleBatchSize = 10000
+)
+
+// SaleBatchRequest charges many sales in one call, such as a nightly rebill
+// file. Every sale needs an idempotency key so that resubmitting the batch
+// after a failure charges nobody twice; sales without one get
+// "<batch_id>-<line>" when BatchID is set.
+type SaleBatchRequest struct {
+	APIKey  string           `json:"api_key,omitempty"`
+	BatchID string           `json:"batch_id,omitempty"`
+	Sales   []PaymentRequest `json:"sales"`
+}
+
+// SaleBatchResult is the outcome of one sale, at its position in the batch
+type SaleBatchResult struct {
+	Index           int             `json:"index"`
+	IdempotencyKey  string          `json:"idempotency_key"`
+	Status          string          `json:"status"`
+	Amount          string          `json:"amount"`
+	TransactionID   string          `json:"transaction_id,omitempty"`
+	ResponseCode    string          `json:"response_code,omitempty"`
+	ResponseText    string          `json:"responsetext,omitempty"`
+	DeclineCategory DeclineCategory `json:"decline_category,omitempty"`
+	ErrorCode       string          `json:"error_code,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	// IdempotentReplay is set when the sale was charged by an earlier
+	// submission and this is its stored result
+	IdempotentReplay bool `json:"idempotent_replay,omitempty"`
+}
+
+// SaleBatchJob tracks the sales of a batch as they are charged
+type SaleBatchJob struct {
+	mu          sync.Mutex
+	ID          string
+	BatchID     string
+	Status      string
+	Results     []*SaleBatchResult
+	StartedAt   time.Time
+	CompletedAt *time.Time
+}
+
+// SaleBatchSummary is a point-in-time copy of a job safe to encode. Results
+// holds the sales finished so far, in batch order.
+type SaleBatchSummary struct {
+	ID             string            `json:"id"`
+	BatchID        string            `json:"batch_id,omitempty"`
+	Status         string            `json:"status"`
+	Total          int               `json:"total"`
+	Processed      int               `json:"processed"`
+	Approved       int               `json:"approved"`
+	Declined       int               `json:"declined"`
+	Failed         int               `json:"failed"`
+	ApprovedAmount string            `json:"approved_amount"`
+	Results        []SaleBatchResult `json:"results"`
+	StartedAt      time.Time         `json:"started_at"`
+	CompletedAt    *time.Time        `json:"completed_at,omitempty"`
+}
+
+// SaleBatchStore keeps sale batch jobs so their results can be fetched
+var SaleBatchStore = struct {
+	sync.RWMutex
+	Data map[string]*SaleBatchJob
+}{Data: make(map[string]*SaleBatchJob)}
+
+// StartSaleBatch validates the batch and charges its sales in the
+// background, workers at a time, returning the job to poll. approved is
+// called for each new approval, so the caller can log and announce it the
+// way single sales are.
+func (c *Client) StartSaleBatch(ctx context.Context, req SaleBatchRequest, workers int, approved func(PaymentRequest, *PaymentResponse)) (*SaleBatchJob, error) {
+	if len(req.Sales) == 0 {
+		return nil, NewNMIError(ErrInvalidRequest, "sales must not be empty", "")
+	}
+	if len(req.Sales) > MaxSaleBatchSize {
+		return nil, NewNMIError(ErrInvalidRequest, fmt.Sprintf("a batch holds at most %d sales", MaxSaleBatchSize), "")
+	}
+
+	sales := make([]PaymentRequest, len(req.Sales))
+	seen := make(map[string]int, len(req.Sales))
+	for i, sale := range req.Sales {
+		if sale.IdempotencyKey == "" {
+			if req.BatchID == "" {
+				return nil, NewNMIError(ErrInvalidRequest, fmt.Sprintf("sale %d has no idempotency_key and the batch has no batch_id", i), "")
+			}
+			sale.IdempotencyKey = req.BatchID + "-" + strconv.Itoa(i)
+		}
+		if first, dup := seen[sale.IdempotencyKey]; dup {
+			return nil, NewNMIError(ErrInvalidRequest, fmt.Sprintf("sales %d and %d share idempotency_key %q", first, i, sale.IdempotencyKey), "")
+		}
+		seen[sale.IdempotencyKey] = i
+		sale.APIKey = req.APIKey
+		sale.Type = "sale"
+		sales[i] = sale
+	}
+
+	if workers <= 0 {
+		workers = DefaultSaleBatchWorkers
+	}
+
+	job := &SaleBatchJob{
+		ID:        "bat_" + generateUniqueVaultID(),
+		BatchID:   req.BatchID,
+		Status:    SaleBatchRunning,
+		Results:   make([]*SaleBatchResult, len(sales)),
+		StartedAt: time.Now(),
+	}
+
+	SaleBatchStore.Lock()
+	SaleBatchStore.Data[job.ID] = job
+	SaleBatchStore.Unlock()
+
+	// The batch outlives the request that started it, but keeps its
+	// merchant and request ID for logs
+	go job.run(context.WithoutCancel(ctx), c, sales, workers, approved)
+
+	return job, nil
+}
+
+// run charges the sales through a pool of workers
+func (job *SaleBatchJob) run(ctx context.Context, c *Client, sales []PaymentRequest, workers int, approved func(PaymentRequest, *PaymentResponse)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(sales); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := c.chargeBatchSale(ctx, i, sales[i], approved)
+				job.mu.Lock()
+				job.Results[i] = result
+				job.mu.Unlock()
+			}
+		}()
+	}
+	for i := range sales {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	now := time.Now()
+	job.mu.Lock()
+	job.Status = SaleBatchCompleted
+	job.CompletedAt = &now
+	job.mu.Unlock()
+}
+
+// chargeBatchSale sends one sale of a batch and classifies the outcome
+func (c *Client) chargeBatchSale(ctx context.Context, index int, sale PaymentRequest, approved func(PaymentRequest, *PaymentResponse)) *SaleBatchResult {
+	result := &SaleBatchResult{
+		Index:          index,
+		IdempotencyKey: sale.IdempotencyKey,
+		Amount:         sale.Amount.String(),
+	}
+
+	resp, err := c.ProcessPayment(ctx, sale)
+	if err != nil {
+		result.Status = SaleResultFailed
+		result.Error = err.Error()
+		var nmiErr *NMIError
+		if errors.As(err, &nmiErr) {
+			result.ErrorCode = nmiErr.Code
+			result.ResponseCode = nmiErr.ResponseCode
+			result.DeclineCategory = nmiErr.DeclineCategory
+			if nmiErr.ResponseCode != "" {
+				result.Status = SaleResultDeclined
+			}
+		}
+		return result
+	}
+
+	result.Status = SaleResultApproved
+	result.TransactionID = resp.TransactionID
+	result.ResponseCode = resp.ResponseCode
+	result.ResponseText = resp.ResponseText
+	result.IdempotentReplay = resp.IdempotentReplay
+	if !resp.IdempotentReplay && approved != nil {
+		approved(sale, resp)
+	}
+	return result
+}
+
+// Summary returns a consistent copy of the job with its counts
+func (job *SaleBatchJob) Summary() SaleBatchSummary {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	summary := SaleBatchSummary{
+		ID:          job.ID,
+		BatchID:     job.BatchID,
+		Status:      job.Status,
+		Total:       len(job.Results),
+		StartedAt:   job.StartedAt,
+		CompletedAt: job.CompletedAt,
+		Results:     make([]SaleBatchResult, 0, len(job.Results)),
+	}
+	var approvedMinor int64
+	for _, result := range job.Results {
+		if result == nil {
+			continue
+		}
+		switch result.Status {
+		case SaleResultApproved:
+			summary.Approved++
+			approvedMinor += Amount(result.Amount).Minor()
+		case SaleResultDeclined:
+			summary.Declined++
+		case SaleResultFailed:
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, *result)
+	}
+	summary.Processed = len(summary.Results)
+	summary.ApprovedAmount = formatMinor(approvedMinor)
+
+	return summary
+}
+
+// GetSaleBatch returns a sale batch job by ID
+func GetSaleBatch(id string) (*SaleBatchJob, bool) {
+	SaleBatchStore.RLock()
+	defer SaleBatchStore.RUnlock()
+	job, exists := SaleBatchStore.Data[id]
+	return job, exists
+}
+
+// String describes the job for transaction logs
+func (job *SaleBatchJob) String() string {
+	return fmt.Sprintf("sale batch %s (batch_id=%s, %d sales)", job.ID, job.BatchID, len(job.Results))
+}
+
+// saleBatchColumns are the CSV columns a sale batch file may have, by the
+// JSON name of the PaymentRequest field they fill
+var saleBatchColumns = map[string]func(*PaymentRequest, string) error{
+	"amount": func(r *PaymentRequest, v string) (err error) {
+		r.Amount, err = ParseAmount(v)
+		return err
+	},
+	"customer_vault_id": func(r *PaymentRequest, v string) error { r.CustomerVaultID = v; return nil },
+	"credit_card":       func(r *PaymentRequest, v string) error { r.CreditCard = v; return nil },
+	"exp_date":          func(r *PaymentRequest, v string) error { r.ExpDate = v; return nil },
+	"cvv":               func(r *PaymentRequest, v string) error { r.CVV = v; return nil },
+	"order_id":          func(r *PaymentRequest, v string) error { r.OrderID = v; return nil },
+	"order_description": func(r *PaymentRequest, v string) error { r.OrderDescription = v; return nil },
+	"ponumber":          func(r *PaymentRequest, v string) error { r.PONumber = v; return nil },
+	"customer_id":       func(r *PaymentRequest, v string) error { r.CustomerID = v; return nil },
+	"currency":          func(r *PaymentRequest, v string) error { r.Currency = v; return nil },
+	"descriptor":        func(r *PaymentRequest, v string) error { r.Descriptor = v; return nil },
+	"idempotency_key":   func(r *PaymentRequest, v string) error { r.IdempotencyKey = v; return nil },
+	"plan_id":           func(r *PaymentRequest, v string) error { r.PlanID = v; return nil },
+	"recurring_payment": func(r *PaymentRequest, v string) (err error) {
+		if v != "" {
+			r.RecurringPayment, err = strconv.ParseBool(v)
+		}
+		return err
+	},
+}
+
+// ParseSaleBatchCSV reads a sale batch file. The header row names the
+// columns after the JSON fields of a sale (amount, customer_vault_id, order_id,
+// idempotency_key, ...); amount is required and unknown columns are
+// rejected so a misspelt one is not silently dropped.
+func ParseSaleBatchCSV(r io.Reader) ([]PaymentRequest, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, NewNMIError(ErrInvalidRequest, "could not read CSV header: "+err.Error(), "")
+	}
+	hasAmount := false
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := saleBatchColumns[name]; !ok {
+			return nil, NewNMIError(ErrInvalidRequest, fmt.Sprintf("unknown CSV column %q", name), "")
+		}
+		header[i] = name
+		hasAmount = hasAmount || name == "amount"
+	}
+	if !hasAmount {
+		return nil, NewNMIError(ErrInvalidRequest, "CSV must have an amount column", "")
+	}
+
+	var sales []PaymentRequest
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, NewNMIError(ErrInvalidRequest, "invalid CSV: "+err.Error(), "")
+		}
+		var sale PaymentRequest
+		for i, value := range record {
+			if err := saleBatchColumns[header[i]](&sale, strings.TrimSpace(value)); err != nil {
+				return nil, NewNMIError(ErrInvalidRequest, fmt.Sprintf("line %d, %s: %v", line, header[i], err), "")
+			}
+		}
+		sales = append(sales, sale)
+	}
+	return sales, nil
+}
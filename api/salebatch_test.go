@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitForSaleBatch(t *testing.T, job *SaleBatchJob) SaleBatchSummary {
+	var summary SaleBatchSummary
+	require.Eventually(t, func() bool {
+		summary = job.Summary()
+		return summary.Status == SaleBatchCompleted
+	}, 5*time.Second, 5*time.Millisecond)
+	return summary
+}
+
+func TestSaleBatch(t *testing.T) {
+	var charged int64
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("amount") == "2.00" {
+			w.Write([]byte("response=2&responsetext=DECLINE&response_code=202&type=sale"))
+			return
+		}
+		atomic.AddInt64(&charged, 1)
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=" + r.PostForm.Get("orderid") + "&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	req := SaleBatchRequest{
+		BatchID: "rebill-2026-10-16",
+		Sales: []PaymentRequest{
+			{Amount: "1.00", CustomerVaultID: "vault-0001", OrderID: "T1"},
+			{Amount: "2.00", CustomerVaultID: "vault-0002", OrderID: "T2"},
+			{Amount: "3.50", CustomerVaultID: "vault-0003", OrderID: "T3", IdempotencyKey: "own-key"},
+		},
+	}
+
+	var announced int64
+	onApproved := func(PaymentRequest, *PaymentResponse) { atomic.AddInt64(&announced, 1) }
+	job, err := client.StartSaleBatch(context.Background(), req, 2, onApproved)
+	require.NoError(t, err)
+
+	summary := waitForSaleBatch(t, job)
+	assert.Equal(t, 3, summary.Total)
+	assert.Equal(t, 2, summary.Approved)
+	assert.Equal(t, 1, summary.Declined)
+	assert.Equal(t, "4.50", summary.ApprovedAmount)
+	require.Len(t, summary.Results, 3)
+	assert.Equal(t, "rebill-2026-10-16-0", summary.Results[0].IdempotencyKey)
+	assert.Equal(t, "T1", summary.Results[0].TransactionID)
+	assert.Equal(t, SaleResultDeclined, summary.Results[1].Status)
+	assert.Equal(t, CategoryInsufficientFunds, summary.Results[1].DeclineCategory)
+	assert.Equal(t, "own-key", summary.Results[2].IdempotencyKey)
+
+	// Resubmitting the same file charges nobody again
+	job, err = client.StartSaleBatch(context.Background(), req, 2, onApproved)
+	require.NoError(t, err)
+	summary = waitForSaleBatch(t, job)
+	assert.Equal(t, 2, summary.Approved)
+	assert.True(t, summary.Results[0].IdempotentReplay)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&charged))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&announced))
+
+	stored, ok := GetSaleBatch(job.ID)
+	require.True(t, ok)
+	assert.Equal(t, job, stored)
+}
+
+func TestSaleBatchValidation(t *testing.T) {
+	client := NewClient(&config.Config{})
+
+	_, err := client.StartSaleBatch(context.Background(), SaleBatchRequest{}, 1, nil)
+	assert.ErrorContains(t, err, "must not be empty")
+
+	_, err = client.StartSaleBatch(context.Background(), SaleBatchRequest{
+		Sales: []PaymentRequest{{Amount: "1.00"}},
+	}, 1, nil)
+	assert.ErrorContains(t, err, "no idempotency_key")
+
+	_, err = client.StartSaleBatch(context.Background(), SaleBatchRequest{
+		Sales: []PaymentRequest{{Amount: "1.00", IdempotencyKey: "a"}, {Amount: "2.00", IdempotencyKey: "a"}},
+	}, 1, nil)
+	assert.ErrorContains(t, err, "share idempotency_key")
+}
+
+func TestParseSaleBatchCSV(t *testing.T) {
+	sales, err := ParseSaleBatchCSV(strings.NewReader("Amount,customer_vault_id,order_id,recurring_payment\n10.9,vault-1,A1,true\n5.00,vault-2,A2,\n"))
+	require.NoError(t, err)
+	require.Len(t, sales, 2)
+	assert.Equal(t, Amount("10.90"), sales[0].Amount)
+	assert.Equal(t, "vault-1", sales[0].CustomerVaultID)
+	assert.True(t, sales[0].RecurringPayment)
+	assert.Equal(t, "A2", sales[1].OrderID)
+
+	_, err = ParseSaleBatchCSV(strings.NewReader("amount,vault_id\n1.00,x\n"))
+	assert.ErrorContains(t, err, `unknown CSV column "vault_id"`)
+
+	_, err = ParseSaleBatchCSV(strings.NewReader("order_id\nx\n"))
+	assert.ErrorContains(t, err, "amount column")
+
+	_, err = ParseSaleBatchCSV(strings.NewReader("amount\n1099\n"))
+	assert.ErrorContains(t, err, "line 2, amount")
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// MaxSettlementReportDays bounds the date range of a settlement report, as
+// every day in it costs a run of Query API pages
+const MaxSettlementReportDays = 92
+
+// SettlementEntry is one transaction settled in a batch. Refunds and credits
+// are entries of type refund; everything else settles as a sale.
+type SettlementEntry struct {
+	TransactionID string    `json:"transaction_id"`
+	Type          string    `json:"type"`
+	Amount        string    `json:"amount"`
+	SettledAt     time.Time `json:"settled_at"`
+	OrderID       string    `json:"order_id,omitempty"`
+	CardType      string    `json:"card_type,omitempty"`
+	MaskedNumber  string    `json:"masked_number,omitempty"`
+}
+
+// SettlementTotals counts the settled sales and refunds of a batch or
+// report, and what they net to
+type SettlementTotals struct {
+	Count     int        `json:"count"`
+	Sales     BatchTotal `json:"sales"`
+	Refunds   BatchTotal `json:"refunds"`
+	NetAmount string     `json:"net_amount"`
+}
+
+// SettlementBatch is one settlement batch the gateway closed
+type SettlementBatch struct {
+	BatchID   string            `json:"batch_id"`
+	SettledAt time.Time         `json:"settled_at"`
+	Totals    SettlementTotals  `json:"totals"`
+	Entries   []SettlementEntry `json:"entries"`
+}
+
+// SettlementReport lists the batches settled between two dates, oldest
+// first, with their totals and transactions
+type SettlementReport struct {
+	StartDate time.Time         `json:"start_date"`
+	EndDate   time.Time         `json:"end_date"`
+	Totals    SettlementTotals  `json:"totals"`
+	Batches   []SettlementBatch `json:"batches"`
+}
+
+// settlementTally accumulates totals in cents
+type settlementTally struct {
+	count          int
+	sales, refunds BatchTotal
+	salesMinor     int64
+	refundsMinor   int64
+}
+
+func (t *settlementTally) add(entry SettlementEntry) {
+	t.count++
+	amount, _ := ParseAmount(entry.Amount)
+	if entry.Type == "refund" {
+		t.refunds.Count++
+		t.refundsMinor += amount.Minor()
+	} else {
+		t.sales.Count++
+		t.salesMinor += amount.Minor()
+	}
+}
+
+func (t *settlementTally) totals() SettlementTotals {
+	t.sales.Amount = formatMinor(t.salesMinor)
+	t.refunds.Amount = formatMinor(t.refundsMinor)
+	return SettlementTotals{
+		Count:     t.count,
+		Sales:     t.sales,
+		Refunds:   t.refunds,
+		NetAmount: formatMinor(t.salesMinor - t.refundsMinor),
+	}
+}
+
+// SettlementReport queries the gateway for the transactions settled between
+// start and end, inclusive, and groups them by settlement batch
+func (c *Client) SettlementReport(ctx context.Context, apiKey string, start, end time.Time) (*SettlementReport, error) {
+	if start.IsZero() || end.IsZero() {
+		return nil, NewNMIError(ErrInvalidRequest, "start_date and end_date are required", "")
+	}
+	if end.Before(start) {
+		return nil, NewNMIError(ErrInvalidRequest, "end_date must not be before start_date", "")
+	}
+	if end.Sub(start) > MaxSettlementReportDays*24*time.Hour {
+		return nil, NewNMIError(ErrInvalidRequest, "a settlement report covers at most 92 days", "")
+	}
+
+	batches := make(map[string]*SettlementBatch)
+	tallies := make(map[string]*settlementTally)
+	for page := 0; ; page++ {
+		records, err := c.SearchTransactions(ctx, TransactionSearch{
+			APIKey:     apiKey,
+			StartDate:  start,
+			EndDate:    end,
+			ActionType: "settle",
+			Page:       page,
+			Limit:      MaxSearchLimit,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			kind := "sale"
+			if len(record.Actions) > 0 && (record.Actions[0].Type == "refund" || record.Actions[0].Type == "credit") {
+				kind = "refund"
+			}
+			for _, action := range record.Actions {
+				// The search matches transactions with a settle action in
+				// range; their other settlements may fall outside it
+				if action.Type != "settle" || !action.Success || action.Date.Before(start) || action.Date.After(end) {
+					continue
+				}
+				entry := SettlementEntry{
+					TransactionID: record.TransactionID,
+					Type:          kind,
+					Amount:        action.Amount,
+					SettledAt:     action.Date,
+					OrderID:       record.OrderID,
+				}
+				if record.Card != nil {
+					entry.CardType = record.Card.Type
+					entry.MaskedNumber = record.Card.MaskedNumber
+				}
+
+				batch, ok := batches[action.BatchID]
+				if !ok {
+					batch = &SettlementBatch{BatchID: action.BatchID, SettledAt: action.Date}
+					batches[action.BatchID] = batch
+					tallies[action.BatchID] = &settlementTally{}
+				}
+				if action.Date.After(batch.SettledAt) {
+					batch.SettledAt = action.Date
+				}
+				batch.Entries = append(batch.Entries, entry)
+				tallies[action.BatchID].add(entry)
+			}
+		}
+
+		if len(records) < MaxSearchLimit {
+			break
+		}
+	}
+
+	report := &SettlementReport{StartDate: start, EndDate: end, Batches: make([]SettlementBatch, 0, len(batches))}
+	var overall settlementTally
+	for id, batch := range batches {
+		batch.Totals = tallies[id].totals()
+		sort.Slice(batch.Entries, func(i, j int) bool { return batch.Entries[i].TransactionID < batch.Entries[j].TransactionID })
+		for _, entry := range batch.Entries {
+			overall.add(entry)
+		}
+		report.Batches = append(report.Batches, *batch)
+	}
+	sort.Slice(report.Batches, func(i, j int) bool {
+		if !report.Batches[i].SettledAt.Equal(report.Batches[j].SettledAt) {
+			return report.Batches[i].SettledAt.Before(report.Batches[j].SettledAt)
+		}
+		return report.Batches[i].BatchID < report.Batches[j].BatchID
+	})
+	report.Totals = overall.totals()
+
+	return report, nil
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const settlementFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<transaction>
+		<transaction_id>1001</transaction_id>
+		<order_id>ORD-1</order_id>
+		<cc_number>4xxxxxxxxxxx1111</cc_number>
+		<cc_type>visa</cc_type>
+		<action><amount>20.00</amount><action_type>sale</action_type><date>20261001120000</date><success>1</success></action>
+		<action><amount>20.00</amount><action_type>settle</action_type><date>20261002020000</date><success>1</success><batch_id>4412</batch_id></action>
+	</transaction>
+	<transaction>
+		<transaction_id>1002</transaction_id>
+		<action><amount>5.00</amount><action_type>refund</action_type><date>20261001150000</date><success>1</success></action>
+		<action><amount>5.00</amount><action_type>settle</action_type><date>20261002020000</date><success>1</success><batch_id>4412</batch_id></action>
+	</transaction>
+	<transaction>
+		<transaction_id>1003</transaction_id>
+		<action><amount>7.25</amount><action_type>sale</action_type><date>20261002100000</date><success>1</success></action>
+		<action><amount>7.25</amount><action_type>settle</action_type><date>20261003020000</date><success>1</success><batch_id>4413</batch_id></action>
+	</transaction>
+	<transaction>
+		<transaction_id>1004</transaction_id>
+		<action><amount>9.00</amount><action_type>sale</action_type><date>20260930100000</date><success>1</success></action>
+		<action><amount>9.00</amount><action_type>settle</action_type><date>20260930230000</date><success>1</success><batch_id>4411</batch_id></action>
+	</transaction>
+</nm_response>`
+
+func TestSettlementReport(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte(settlementFixture))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 10, 3, 23, 59, 59, 0, time.UTC)
+
+	report, err := client.SettlementReport(context.Background(), "key", start, end)
+	require.NoError(t, err)
+	assert.Equal(t, "settle", form.Get("action_type"))
+	assert.Equal(t, "20261001000000", form.Get("start_date"))
+
+	// Batch 4411 settled before the range and is left out
+	require.Len(t, report.Batches, 2)
+	first := report.Batches[0]
+	assert.Equal(t, "4412", first.BatchID)
+	assert.Equal(t, SettlementTotals{
+		Count:     2,
+		Sales:     BatchTotal{Count: 1, Amount: "20.00"},
+		Refunds:   BatchTotal{Count: 1, Amount: "5.00"},
+		NetAmount: "15.00",
+	}, first.Totals)
+	require.Len(t, first.Entries, 2)
+	assert.Equal(t, "visa", first.Entries[0].CardType)
+	assert.Equal(t, "ORD-1", first.Entries[0].OrderID)
+	assert.Equal(t, "refund", first.Entries[1].Type)
+
+	assert.Equal(t, "4413", report.Batches[1].BatchID)
+	assert.Equal(t, 3, report.Totals.Count)
+	assert.Equal(t, "27.25", report.Totals.Sales.Amount)
+	assert.Equal(t, "22.25", report.Totals.NetAmount)
+}
+
+func TestSettlementReportRange(t *testing.T) {
+	client := NewClient(&config.Config{})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := client.SettlementReport(context.Background(), "", start, time.Time{})
+	assert.ErrorContains(t, err, "required")
+	_, err = client.SettlementReport(context.Background(), "", start, start.Add(-time.Hour))
+	assert.ErrorContains(t, err, "before start_date")
+	_, err = client.SettlementReport(context.Background(), "", start, start.AddDate(0, 4, 0))
+	assert.ErrorContains(t, err, "at most 92 days")
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Operations that can be mirrored to the shadow endpoint. Only reads are
+// shadowed, so a mirrored request can never move money.
+const (
+	ShadowLookup = "lookup"
+	ShadowSearch = "search"
+)
+
+const (
+	// shadowTimeout bounds a mirrored request, which outlives the live one
+	shadowTimeout = 10 * time.Second
+	// shadowMaxInFlight caps concurrent mirrored requests; samples beyond it
+	// are skipped rather than queued
+	shadowMaxInFlight = 16
+	// shadowMaxDiffs is how many differing fields a mismatch log lists
+	shadowMaxDiffs = 10
+)
+
+// shadow mirrors a sample of live reads to a secondary endpoint, compares
+// the two answers and logs where they differ. The live request neither
+// waits for nor sees the shadow's answer.
+type shadow struct {
+	client     *Client
+	apiKey     string
+	sampleRate float64
+	operations map[string]bool
+	slots      chan struct{}
+
+	// wg tracks mirrored requests still running
+	wg sync.WaitGroup
+}
+
+// newShadow builds the shadow for cfg. The shadow client is isolated from
+// the live breaker and throttle and never hedges.
+func newShadow(cfg *config.Config) *shadow {
+	shadowCfg := *cfg
+	shadowCfg.APIBaseURL = cfg.ShadowAPIURL
+	shadowCfg.QueryURL = cfg.ShadowQueryURL
+	shadowCfg.QueryHedgeLimit = 0
+	shadowCfg.ShadowSampleRate = 0
+	shadowCfg.IdempotencyStore = config.StoreMemory
+
+	client := NewClient(&shadowCfg)
+	client.breaker = NewCircuitBreaker(5, 30*time.Second)
+	client.breaker.silent = true
+	client.isolated = true
+
+	s := &shadow{
+		client:     client,
+		apiKey:     cfg.ShadowAPIKey,
+		sampleRate: cfg.ShadowSampleRate,
+		operations: make(map[string]bool),
+		slots:      make(chan struct{}, shadowMaxInFlight),
+	}
+	for _, op := range cfg.ShadowOperations {
+		s.operations[op] = true
+	}
+	return s
+}
+
+// sampled reports whether this call of op should be mirrored
+func (s *shadow) sampled(op string) bool {
+	return s != nil && s.operations[op] && rand.Float64() < s.sampleRate
+}
+
+// mirror runs call against the shadow client in the background and compares
+// its fingerprint with the live one. apiKey is the live caller's key, used
+// when no shadow credentials are configured.
+func (s *shadow) mirror(ctx context.Context, op, apiKey string, live map[string]string, liveErr error,
+	call func(ctx context.Context, c *Client, apiKey string) (map[string]string, error)) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		metrics.RecordShadowComparison(op, "skipped")
+		return
+	}
+	if s.apiKey != "" {
+		apiKey = s.apiKey
+	}
+
+	log := logctx.From(ctx).WithField("shadow_operation", op)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.slots }()
+		defer cancel()
+
+		start := time.Now()
+		mirrored, err := call(ctx, s.client, apiKey)
+		s.compare(log.WithField("shadow_duration", time.Since(start).String()), op, live, liveErr, mirrored, err)
+	}()
+}
+
+// compare logs and counts the outcome of one mirrored request
+func (s *shadow) compare(log *logrus.Entry, op string, live map[string]string, liveErr error, mirrored map[string]string, err error) {
+	switch {
+	case err != nil && liveErr == nil:
+		log.WithError(err).Warn("Shadow request failed")
+		metrics.RecordShadowComparison(op, "error")
+		return
+	case liveErr != nil || err != nil:
+		live, mirrored = errorFingerprint(liveErr), errorFingerprint(err)
+	}
+
+	diffs := diffFingerprints(live, mirrored)
+	if len(diffs) == 0 {
+		metrics.RecordShadowComparison(op, "match")
+		return
+	}
+	if len(diffs) > shadowMaxDiffs {
+		diffs = diffs[:shadowMaxDiffs]
+	}
+	log.WithField("shadow_diffs", diffs).Warn("Shadow response differs from live response")
+	metrics.RecordShadowComparison(op, "mismatch")
+}
+
+// wait blocks until mirrored requests have finished
+func (s *shadow) wait() {
+	s.wg.Wait()
+}
+
+// errorFingerprint reduces an error to what both sides should agree on
+func errorFingerprint(err error) map[string]string {
+	if err == nil {
+		return map[string]string{"error": ""}
+	}
+	if nmiErr, ok := err.(*NMIError); ok {
+		return map[string]string{"error": nmiErr.Code}
+	}
+	return map[string]string{"error": err.Error()}
+}
+
+// diffFingerprints lists each field whose value differs, as
+// "field: live != shadow", in field order
+func diffFingerprints(live, mirrored map[string]string) []string {
+	fields := make(map[string]bool, len(live))
+	for field := range live {
+		fields[field] = true
+	}
+	for field := range mirrored {
+		fields[field] = true
+	}
+
+	var diffs []string
+	for field := range fields {
+		if live[field] != mirrored[field] {
+			diffs = append(diffs, field+": "+strconv.Quote(live[field])+" != "+strconv.Quote(mirrored[field]))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// lookupFingerprint is the part of a lookup the shadow must reproduce. The
+// raw XML is left out since field order and whitespace may differ.
+func lookupFingerprint(resp *LookupResponse) map[string]string {
+	if resp == nil {
+		return nil
+	}
+	fp := map[string]string{
+		"transaction_id": resp.TransactionID,
+		"amount":         resp.Amount,
+		"type":           resp.Type,
+		"response_code":  resp.ResponseCode,
+	}
+	if resp.Record != nil {
+		recordFingerprint(fp, "", *resp.Record)
+	}
+	return fp
+}
+
+// searchFingerprint covers every record of a search page, in order
+func searchFingerprint(records []TransactionRecord) map[string]string {
+	fp := map[string]string{"count": strconv.Itoa(len(records))}
+	for i, record := range records {
+		prefix := "records[" + strconv.Itoa(i) + "]."
+		fp[prefix+"transaction_id"] = record.TransactionID
+		recordFingerprint(fp, prefix, record)
+	}
+	return fp
+}
+
+// recordFingerprint adds a record's state and action history to fp
+func recordFingerprint(fp map[string]string, prefix string, record TransactionRecord) {
+	fp[prefix+"condition"] = record.Condition
+	fp[prefix+"record_amount"] = record.Amount
+	fp[prefix+"actions"] = strconv.Itoa(len(record.Actions))
+	for i, action := range record.Actions {
+		p := prefix + "actions[" + strconv.Itoa(i) + "]."
+		fp[p+"type"] = action.Type
+		fp[p+"amount"] = action.Amount
+		fp[p+"success"] = strconv.FormatBool(action.Success)
+		fp[p+"response_code"] = action.ResponseCode
+	}
+}
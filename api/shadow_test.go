@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shadowClient builds a client whose every lookup is mirrored from live to
+// secondary
+func shadowClient(live, secondary *httptest.Server) *Client {
+	return NewClient(&config.Config{
+		APIBaseURL:       live.URL,
+		QueryURL:         live.URL,
+		ShadowSampleRate: 1,
+		ShadowOperations: []string{ShadowLookup},
+		ShadowAPIURL:     secondary.URL,
+		ShadowQueryURL:   secondary.URL,
+		ShadowAPIKey:     "test-key",
+	})
+}
+
+func fixtureServer(body string, keys chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if keys != nil {
+			keys <- r.PostForm.Get("security_key")
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestShadowLookupMatches(t *testing.T) {
+	live := fixtureServer(queryFixture, nil)
+	defer live.Close()
+	keys := make(chan string, 1)
+	secondary := fixtureServer(queryFixture, keys)
+	defer secondary.Close()
+
+	client := shadowClient(live, secondary)
+	matches := testutil.ToFloat64(metrics.ShadowComparisons.WithLabelValues(ShadowLookup, "match"))
+
+	resp, err := client.LookupTransaction(context.Background(), LookupRequest{APIKey: "live-key", TransactionID: "10317410976"})
+	require.NoError(t, err)
+	assert.Equal(t, "10317410976", resp.TransactionID)
+
+	client.shadow.wait()
+	assert.Equal(t, "test-key", <-keys)
+	assert.Equal(t, matches+1, testutil.ToFloat64(metrics.ShadowComparisons.WithLabelValues(ShadowLookup, "match")))
+}
+
+func TestShadowMismatchDoesNotAffectLiveResponse(t *testing.T) {
+	live := fixtureServer(queryFixture, nil)
+	defer live.Close()
+	secondary := fixtureServer(strings.Replace(queryFixture, "<condition>complete", "<condition>pendingsettlement", 1), nil)
+	defer secondary.Close()
+
+	client := shadowClient(live, secondary)
+	mismatches := testutil.ToFloat64(metrics.ShadowComparisons.WithLabelValues(ShadowLookup, "mismatch"))
+
+	resp, err := client.LookupTransaction(context.Background(), LookupRequest{TransactionID: "10317410976"})
+	require.NoError(t, err)
+	assert.Equal(t, "complete", resp.Record.Condition)
+
+	client.shadow.wait()
+	assert.Equal(t, mismatches+1, testutil.ToFloat64(metrics.ShadowComparisons.WithLabelValues(ShadowLookup, "mismatch")))
+}
+
+func TestShadowFailureIsIsolated(t *testing.T) {
+	live := fixtureServer(queryFixture, nil)
+	defer live.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer secondary.Close()
+
+	client := shadowClient(live, secondary)
+	failures := testutil.ToFloat64(metrics.ShadowComparisons.WithLabelValues(ShadowLookup, "error"))
+
+	for i := 0; i < 10; i++ {
+		_, err := client.LookupTransaction(context.Background(), LookupRequest{TransactionID: "10317410976"})
+		require.NoError(t, err)
+		client.shadow.wait()
+	}
+
+	assert.Equal(t, failures+10, testutil.ToFloat64(metrics.ShadowComparisons.WithLabelValues(ShadowLookup, "error")))
+	assert.Equal(t, BreakerClosed, GatewayBreaker.Status().State)
+	assert.Equal(t, BreakerOpen, client.shadow.client.breaker.Status().State)
+}
+
+func TestShadowSkipsUnselectedOperations(t *testing.T) {
+	s := &shadow{sampleRate: 1, operations: map[string]bool{ShadowLookup: true}}
+	assert.True(t, s.sampled(ShadowLookup))
+	assert.False(t, s.sampled(ShadowSearch))
+
+	var off *shadow
+	assert.False(t, off.sampled(ShadowLookup))
+}
+
+func TestDiffFingerprints(t *testing.T) {
+	diffs := diffFingerprints(
+		map[string]string{"amount": "10.00", "condition": "complete", "type": "sale"},
+		map[string]string{"amount": "10.00", "condition": "pending", "actions": "1"},
+	)
+	assert.Equal(t, []string{
+		`actions: "" != "1"`,
+		`condition: "complete" != "pending"`,
+		`type: "sale" != ""`,
+	}, diffs)
+}
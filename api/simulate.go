@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"nmi-pay-int/fixtures"
+)
+
+// simulatedAmounts maps the cents of a payment amount to the gateway
+// response it is answered with when SANDBOX_SIMULATION is on, so QA can
+// reach each decline path with an ordinary test card
+var simulatedAmounts = map[string]string{
+	"05": "transact/decline_200_declined",
+	"10": "transact/decline_200_avs_rejected",
+	"15": "transact/decline_200_cvv_rejected",
+	"20": "transact/decline_202_insufficient_funds",
+	"25": "transact/decline_203_over_limit",
+	"30": "transact/decline_223_expired_card",
+	"35": "transact/decline_240_call_issuer",
+	"40": "transact/decline_250_pick_up_card",
+	"45": "transact/decline_253_fraudulent_card",
+	"50": "transact/decline_261_stop_all_recurring",
+	"55": "transact/decline_264_retry_in_a_few_days",
+	"60": "transact/error_300_duplicate_transaction",
+	"65": "transact/error_400_processor_error",
+	"70": "transact/error_420_communication_error",
+	"75": "transact/error_461_unsupported_card_type",
+}
+
+// simulatedCards maps test card numbers to the response they get, whatever
+// the amount. They take precedence over simulatedAmounts.
+var simulatedCards = map[string]string{
+	"4000000000000002": "transact/decline_200_declined",
+	"4000000000009995": "transact/decline_202_insufficient_funds",
+	"4000000000000069": "transact/decline_223_expired_card",
+	"4000000000000127": "transact/decline_225_invalid_security_code",
+	"4000000000009987": "transact/decline_251_lost_card",
+	"4000000000009979": "transact/decline_252_stolen_card",
+	"4100000000000019": "transact/decline_253_fraudulent_card",
+	"4000000000000119": "transact/error_400_processor_error",
+}
+
+// simulatedTypes are the transaction types simulation answers. Captures,
+// refunds and voids reach the sandbox as usual.
+var simulatedTypes = map[string]bool{"sale": true, "auth": true, "validate": true, "credit": true}
+
+// simulatedTransport answers payments with a magic card number or amount
+// from the fixture corpus instead of sending them to the gateway. Everything
+// else passes through, and simulated answers take the same parsing, metrics
+// and history path as real ones.
+type simulatedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *simulatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return t.base.RoundTrip(req)
+	}
+	name := simulatedResponse(form)
+	if name == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	answer, err := url.ParseQuery(fixtures.Body(name))
+	if err != nil {
+		return nil, err
+	}
+	answer.Set("type", form.Get("type"))
+	answer.Set("orderid", form.Get("orderid"))
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       io.NopCloser(strings.NewReader(answer.Encode())),
+		Request:    req,
+	}, nil
+}
+
+// simulatedResponse names the fixture a payment form is answered with, or
+// returns "" when it should go to the gateway
+func simulatedResponse(form url.Values) string {
+	if !simulatedTypes[form.Get("type")] {
+		return ""
+	}
+	if name, ok := simulatedCards[form.Get("ccnumber")]; ok {
+		return name
+	}
+	amount := form.Get("amount")
+	if dot := strings.LastIndexByte(amount, '.'); dot >= 0 && len(amount)-dot == 3 {
+		return simulatedAmounts[amount[dot+1:]]
+	}
+	return ""
+}
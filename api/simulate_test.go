@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/fixtures"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandboxSimulation(t *testing.T) {
+	var forwarded int
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=42&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL, SandboxSimulation: true})
+	sale := func(amount, card string) (*PaymentResponse, error) {
+		return client.ProcessPayment(context.Background(), PaymentRequest{
+			Type: "sale", Amount: Amount(amount), CreditCard: card, ExpDate: "1230", CVV: "999", OrderID: "QA-1",
+		})
+	}
+
+	tests := []struct {
+		amount   string
+		card     string
+		code     string
+		category DeclineCategory
+	}{
+		{"10.05", "4111111111111111", "200", CategoryDoNotHonor},
+		{"10.10", "4111111111111111", "200", CategoryAVSFailure},
+		{"10.20", "4111111111111111", "202", CategoryInsufficientFunds},
+		{"10.70", "4111111111111111", "420", CategoryTryAgainLater},
+		{"10.00", "4000000000000069", "223", CategoryExpiredCard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount+"/"+tt.card, func(t *testing.T) {
+			_, err := sale(tt.amount, tt.card)
+			var nmiErr *NMIError
+			require.True(t, errors.As(err, &nmiErr), "got %v", err)
+			assert.Equal(t, tt.code, nmiErr.ResponseCode)
+			assert.Equal(t, tt.category, nmiErr.DeclineCategory)
+		})
+	}
+	assert.Zero(t, forwarded, "magic payments never reach the gateway")
+
+	resp, err := sale("10.00", "4111111111111111")
+	require.NoError(t, err)
+	assert.Equal(t, "42", resp.TransactionID)
+	assert.Equal(t, 1, forwarded)
+}
+
+func TestSimulatedResponse(t *testing.T) {
+	for _, table := range []map[string]string{simulatedAmounts, simulatedCards} {
+		for magic, name := range table {
+			_, ok := fixtures.Get(name)
+			assert.True(t, ok, "%s answers with missing fixture %s", magic, name)
+		}
+	}
+
+	assert.Equal(t, "transact/decline_200_declined", simulatedResponse(map[string][]string{"type": {"auth"}, "amount": {"1.05"}}))
+	assert.Empty(t, simulatedResponse(map[string][]string{"type": {"refund"}, "amount": {"1.05"}}), "refunds go to the sandbox")
+	assert.Empty(t, simulatedResponse(map[string][]string{"recurring": {"add_subscription"}, "amount": {"1.05"}}))
+	assert.Empty(t, simulatedResponse(map[string][]string{"type": {"sale"}, "amount": {"1.5"}}))
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+// Overall service states reported by the status endpoint
+const (
+	StatusOperational = "operational"
+	StatusDegraded    = "degraded"
+	StatusOutage      = "major_outage"
+)
+
+// statusWindows are the periods the status endpoint rolls health up over
+var statusWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// startedAt is when this process began observing the gateway
+var startedAt = time.Now()
+
+// StatusWindow is the service's health over one period
+type StatusWindow struct {
+	// Uptime is the fraction of the observed period the gateway was not
+	// cut off by the circuit breaker
+	Uptime float64 `json:"uptime"`
+	// ApprovalRate is the fraction of payment submissions accepted; it is
+	// omitted when there were none
+	ApprovalRate    *float64 `json:"approval_rate,omitempty"`
+	Payments        int      `json:"payments"`
+	Incidents       int      `json:"incidents"`
+	DowntimeSeconds int64    `json:"downtime_seconds"`
+}
+
+// ServiceStatus is the data behind a merchant-facing status page. It holds
+// no merchant or transaction detail, so it is safe to serve publicly.
+type ServiceStatus struct {
+	Status    string                  `json:"status"`
+	UpdatedAt time.Time               `json:"updated_at"`
+	Windows   map[string]StatusWindow `json:"windows"`
+	// Incidents are the gateway incidents of the longest window
+	Incidents []Incident `json:"incidents"`
+	// ObservedSince is when this instance started; windows reaching back
+	// further only cover the time since
+	ObservedSince time.Time `json:"observed_since"`
+}
+
+// GetServiceStatus rolls up the gateway breaker's incidents and payment
+// approvals over each status window
+func GetServiceStatus(now time.Time) ServiceStatus {
+	status := ServiceStatus{
+		Status:        currentStatus(),
+		UpdatedAt:     now,
+		Windows:       make(map[string]StatusWindow),
+		Incidents:     []Incident{},
+		ObservedSince: startedAt,
+	}
+
+	for _, window := range statusWindows {
+		since := now.Add(-window.duration)
+		if since.Before(startedAt) {
+			since = startedAt
+		}
+		incidents := GatewayBreaker.Incidents(since)
+
+		summary := StatusWindow{Uptime: 1, Incidents: len(incidents)}
+		downtime := downtime(incidents, since, now)
+		summary.DowntimeSeconds = int64(downtime.Seconds())
+		if observed := now.Sub(since); observed > 0 {
+			summary.Uptime = 1 - downtime.Seconds()/observed.Seconds()
+		}
+
+		payments, approvals := metrics.Usage.Totals(window.duration)
+		summary.Payments = payments
+		if payments > 0 {
+			rate := float64(approvals) / float64(payments)
+			summary.ApprovalRate = &rate
+		}
+
+		status.Windows[window.name] = summary
+		// Windows run shortest to longest, so the last has every incident
+		if incidents != nil {
+			status.Incidents = incidents
+		}
+	}
+	return status
+}
+
+// currentStatus is an outage while the breaker is open, and degraded while
+// it is trialling the gateway or NMI is throttling requests
+func currentStatus() string {
+	switch state := GatewayBreaker.Status().State; {
+	case state == BreakerOpen:
+		return StatusOutage
+	case state == BreakerHalfOpen, throttleRemaining() > 0:
+		return StatusDegraded
+	}
+	return StatusOperational
+}
+
+// downtime is the time between since and now covered by incidents
+func downtime(incidents []Incident, since, now time.Time) time.Duration {
+	var total time.Duration
+	for _, incident := range incidents {
+		start, end := incident.StartedAt, now
+		if incident.ResolvedAt != nil {
+			end = *incident.ResolvedAt
+		}
+		if start.Before(since) {
+			start = since
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+	}
+	return total
+}
+
+// HandleStatus serves the service status for public status pages. Any
+// origin may read it.
+func HandleStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=30")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(GetServiceStatus(time.Now()))
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakerIncidents(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	b := NewCircuitBreaker(1, time.Minute)
+	b.transitions = []breakerTransition{
+		{at: ago(9 * 24 * time.Hour), state: BreakerOpen},
+		{at: ago(8 * 24 * time.Hour), state: BreakerClosed},
+		{at: ago(3 * time.Hour), state: BreakerOpen},
+		{at: ago(3*time.Hour - time.Minute), state: BreakerHalfOpen},
+		{at: ago(3*time.Hour - 2*time.Minute), state: BreakerClosed},
+		{at: ago(10 * time.Minute), state: BreakerOpen, forced: true},
+	}
+
+	incidents := b.Incidents(ago(24 * time.Hour))
+	require.Len(t, incidents, 2)
+	// A half-open trial does not end an incident; only closing does
+	assert.Equal(t, ago(3*time.Hour), incidents[0].StartedAt)
+	require.NotNil(t, incidents[0].ResolvedAt)
+	assert.Equal(t, ago(3*time.Hour-2*time.Minute), *incidents[0].ResolvedAt)
+	assert.False(t, incidents[0].Manual)
+	assert.Nil(t, incidents[1].ResolvedAt)
+	assert.True(t, incidents[1].Manual)
+
+	assert.Equal(t, 12*time.Minute, downtime(incidents, ago(24*time.Hour), now))
+	// Time before the window does not count
+	assert.Equal(t, 10*time.Minute, downtime(incidents, ago(time.Hour), now))
+
+	// State changes past the history are dropped, except the last of them
+	pruned := pruneTransitions(b.transitions, now)
+	assert.Equal(t, ago(8*24*time.Hour), pruned[0].at)
+}
+
+func TestHandleStatus(t *testing.T) {
+	rec := httptest.NewRecorder()
+	HandleStatus()(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	var status ServiceStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Contains(t, []string{StatusOperational, StatusDegraded, StatusOutage}, status.Status)
+	assert.Contains(t, status.Windows, "24h")
+	assert.Contains(t, status.Windows, "7d")
+	assert.NotNil(t, status.Incidents)
+}
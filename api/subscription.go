@@ -0,0 +1,383 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription statuses
+const (
+	SubscriptionActive    = "active"
+	SubscriptionCancelled = "cancelled"
+	// SubscriptionPendingCancellation is a subscription that keeps its
+	// current billing period and is cancelled when it ends
+	SubscriptionPendingCancellation = "pending_cancellation"
+)
+
+// Subscription is the local record of a subscription created through this service
+type Subscription struct {
+	ID              string `json:"subscription_id"`
+	CustomerVaultID string `json:"customer_vault_id"`
+	PlanID          string `json:"plan_id"`
+	Amount          string `json:"amount,omitempty"`
+	BillingCycle    string `json:"billing_cycle,omitempty"`
+	Status          string `json:"status"`
+	NextBilling     string `json:"next_billing_date,omitempty"`
+	// MerchantID is the merchant account the subscription was created on
+	MerchantID string `json:"merchant_id,omitempty"`
+	// CancelAt is when a pending cancellation takes effect
+	CancelAt  *time.Time `json:"cancel_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// SubscriptionStore tracks subscriptions so they can be found by plan without
+// going through the NMI portal
+var SubscriptionStore = struct {
+	sync.RWMutex
+	Data map[string]Subscription
+}{Data: make(map[string]Subscription)}
+
+// saveSubscription records a newly created subscription
+func saveSubscription(sub Subscription) {
+	if sub.ID == "" {
+		return
+	}
+
+	now := time.Now()
+	sub.CreatedAt = now
+	sub.UpdatedAt = now
+	if sub.Status == "" {
+		sub.Status = SubscriptionActive
+	}
+
+	SubscriptionStore.Lock()
+	defer SubscriptionStore.Unlock()
+	SubscriptionStore.Data[sub.ID] = sub
+}
+
+// updateSubscription applies non-empty changes to a known subscription
+func updateSubscription(subscriptionID string, req RecurringPaymentRequest) {
+	SubscriptionStore.Lock()
+	defer SubscriptionStore.Unlock()
+
+	sub, exists := SubscriptionStore.Data[subscriptionID]
+	if !exists {
+		return
+	}
+
+	if req.PlanID != "" {
+		sub.PlanID = req.PlanID
+	}
+	if req.Amount != "" {
+		sub.Amount = req.Amount
+	}
+	if req.BillingCycle != "" {
+		sub.BillingCycle = req.BillingCycle
+	}
+	sub.UpdatedAt = time.Now()
+	SubscriptionStore.Data[subscriptionID] = sub
+}
+
+// GetSubscription returns the local record of a subscription
+func GetSubscription(subscriptionID string) (Subscription, bool) {
+	SubscriptionStore.RLock()
+	defer SubscriptionStore.RUnlock()
+	sub, ok := SubscriptionStore.Data[subscriptionID]
+	return sub, ok
+}
+
+// setSubscriptionStatus changes the status of a known subscription
+func setSubscriptionStatus(subscriptionID, status string) {
+	SubscriptionStore.Lock()
+	defer SubscriptionStore.Unlock()
+
+	sub, exists := SubscriptionStore.Data[subscriptionID]
+	if !exists {
+		return
+	}
+
+	sub.Status = status
+	sub.UpdatedAt = time.Now()
+	SubscriptionStore.Data[subscriptionID] = sub
+}
+
+// subscriptionsForPlan returns a merchant's active subscriptions on a plan
+func subscriptionsForPlan(merchantID, planID string) []Subscription {
+	SubscriptionStore.RLock()
+	defer SubscriptionStore.RUnlock()
+
+	var subs []Subscription
+	for _, sub := range SubscriptionStore.Data {
+		if sub.MerchantID == merchantID && sub.PlanID == planID && sub.Status == SubscriptionActive {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// scheduleCancellation marks a subscription to be cancelled at the given time
+func scheduleCancellation(subscriptionID string, at time.Time) (Subscription, bool) {
+	SubscriptionStore.Lock()
+	defer SubscriptionStore.Unlock()
+
+	sub, exists := SubscriptionStore.Data[subscriptionID]
+	if !exists {
+		return Subscription{}, false
+	}
+
+	sub.Status = SubscriptionPendingCancellation
+	sub.CancelAt = &at
+	sub.UpdatedAt = time.Now()
+	SubscriptionStore.Data[subscriptionID] = sub
+	return sub, true
+}
+
+// DueCancellations returns the subscriptions whose pending cancellation
+// takes effect at or before now, earliest first
+func DueCancellations(now time.Time) []Subscription {
+	SubscriptionStore.RLock()
+	defer SubscriptionStore.RUnlock()
+
+	var due []Subscription
+	for _, sub := range SubscriptionStore.Data {
+		if sub.Status == SubscriptionPendingCancellation && sub.CancelAt != nil && !sub.CancelAt.After(now) {
+			due = append(due, sub)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].CancelAt.Before(*due[j].CancelAt) })
+	return due
+}
+
+// nextBillingLayouts are the formats NMI has returned next_billing_date in
+var nextBillingLayouts = []string{"20060102", "2006-01-02", "01/02/2006"}
+
+// parseNextBilling parses a next_billing_date as midnight local time
+func parseNextBilling(value string) (time.Time, bool) {
+	for _, layout := range nextBillingLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(value), time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// advanceBillingCycle returns t moved forward by one billing cycle
+func advanceBillingCycle(t time.Time, cycle string) (time.Time, bool) {
+	switch strings.ToLower(cycle) {
+	case "daily":
+		return t.AddDate(0, 0, 1), true
+	case "weekly":
+		return t.AddDate(0, 0, 7), true
+	case "monthly":
+		return t.AddDate(0, 1, 0), true
+	case "quarterly":
+		return t.AddDate(0, 3, 0), true
+	case "yearly":
+		return t.AddDate(1, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+// periodEnd returns when a subscription's current billing period ends: the
+// next billing date NMI reported, or else one billing cycle on from its last
+// approved payment. The period ends as the next billing day begins, before
+// NMI can charge it.
+func periodEnd(sub Subscription, payments []SubscriptionPayment, now time.Time) (time.Time, bool) {
+	if next, ok := parseNextBilling(sub.NextBilling); ok && next.After(now) {
+		return next, true
+	}
+
+	var last time.Time
+	for _, payment := range payments {
+		if payment.Result == "approved" && payment.Date.After(last) {
+			last = payment.Date
+		}
+	}
+	if last.IsZero() {
+		return time.Time{}, false
+	}
+
+	end := time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.Local)
+	for !end.After(now) {
+		var ok bool
+		if end, ok = advanceBillingCycle(end, sub.BillingCycle); !ok {
+			return time.Time{}, false
+		}
+	}
+	return end, true
+}
+
+// SubscriptionFilter narrows a subscription listing. Empty fields match
+// every subscription.
+type SubscriptionFilter struct {
+	CustomerVaultID string
+	PlanID          string
+	Status          string
+}
+
+func (f SubscriptionFilter) matches(sub Subscription) bool {
+	return (f.CustomerVaultID == "" || sub.CustomerVaultID == f.CustomerVaultID) &&
+		(f.PlanID == "" || sub.PlanID == f.PlanID) &&
+		(f.Status == "" || sub.Status == f.Status)
+}
+
+// ListSubscriptions lists the merchant's subscriptions ordered by ID. NMI's
+// recurring report supplies the subscriptions the gateway still bills;
+// subscriptions created through this service add their status, pending
+// cancellation and creation time, and are reported cancelled once the
+// gateway no longer has them.
+func (c *Client) ListSubscriptions(ctx context.Context, apiKey string, filter SubscriptionFilter) ([]Subscription, error) {
+	switch filter.Status {
+	case "", SubscriptionActive, SubscriptionCancelled, SubscriptionPendingCancellation:
+	default:
+		return nil, NewNMIError(ErrInvalidRequest, "status must be active, pending_cancellation or cancelled", "")
+	}
+
+	remote, err := c.queryRecurring(ctx, apiKey, "")
+	if err != nil {
+		return nil, err
+	}
+
+	merchant, _ := MerchantFromContext(ctx)
+	byID := make(map[string]Subscription, len(remote))
+	for _, sub := range remote {
+		local, known := GetSubscription(sub.ID)
+		byID[sub.ID] = mergeSubscription(&sub, local, known)
+	}
+	SubscriptionStore.RLock()
+	for id, local := range SubscriptionStore.Data {
+		if _, listed := byID[id]; !listed && local.MerchantID == merchant.ID {
+			byID[id] = mergeSubscription(nil, local, true)
+		}
+	}
+	SubscriptionStore.RUnlock()
+
+	subs := []Subscription{}
+	for _, sub := range byID {
+		if filter.matches(sub) {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// FetchSubscription returns one subscription, combining the gateway's view
+// with the local record as ListSubscriptions does
+func (c *Client) FetchSubscription(ctx context.Context, apiKey, subscriptionID string) (*Subscription, error) {
+	if subscriptionID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "subscription_id is required", "")
+	}
+
+	remote, err := c.queryRecurring(ctx, apiKey, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	local, known := GetSubscription(subscriptionID)
+	for _, sub := range remote {
+		if sub.ID == subscriptionID {
+			merged := mergeSubscription(&sub, local, known)
+			return &merged, nil
+		}
+	}
+	if !known {
+		return nil, NewNMIError(ErrNotFound, "subscription not found", "")
+	}
+	merged := mergeSubscription(nil, local, true)
+	return &merged, nil
+}
+
+// queryRecurring fetches NMI's recurring report, for one subscription when
+// subscriptionID is set
+func (c *Client) queryRecurring(ctx context.Context, apiKey, subscriptionID string) ([]Subscription, error) {
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("report_type", "recurring")
+	if subscriptionID != "" {
+		formData.Set("subscription_id", subscriptionID)
+	}
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]Subscription, 0, len(parsed.Subscriptions))
+	for _, s := range parsed.Subscriptions {
+		subs = append(subs, Subscription{
+			ID:              s.SubscriptionID,
+			CustomerVaultID: s.CustomerVaultID,
+			PlanID:          s.Plan.PlanID,
+			Amount:          s.Plan.Amount,
+			BillingCycle:    billingCycleFor(s.Plan.DayFrequency, s.Plan.MonthFrequency),
+			Status:          SubscriptionActive,
+			NextBilling:     s.NextChargeDate,
+		})
+	}
+	return subs, nil
+}
+
+// billingCycleFor names the billing cycle of a plan's day or month
+// frequency, or returns "" for frequencies with no name
+func billingCycleFor(dayFrequency, monthFrequency string) string {
+	switch strings.TrimSpace(monthFrequency) {
+	case "1":
+		return "monthly"
+	case "3":
+		return "quarterly"
+	case "12":
+		return "yearly"
+	}
+	switch strings.TrimSpace(dayFrequency) {
+	case "1":
+		return "daily"
+	case "7":
+		return "weekly"
+	}
+	return ""
+}
+
+// mergeSubscription combines the gateway's record of a subscription, nil
+// when the gateway no longer has it, with the local record. The gateway's
+// plan, amount and next billing date win; the local record keeps what NMI
+// does not report.
+func mergeSubscription(remote *Subscription, local Subscription, known bool) Subscription {
+	if remote == nil {
+		if local.Status != SubscriptionCancelled {
+			// Deleted at the gateway, by the NMI portal or a due cancellation
+			local.Status = SubscriptionCancelled
+			local.CancelAt = nil
+		}
+		return local
+	}
+	if !known {
+		return *remote
+	}
+
+	merged := local
+	if remote.CustomerVaultID != "" {
+		merged.CustomerVaultID = remote.CustomerVaultID
+	}
+	if remote.PlanID != "" {
+		merged.PlanID = remote.PlanID
+	}
+	if remote.Amount != "" {
+		merged.Amount = remote.Amount
+	}
+	if remote.BillingCycle != "" {
+		merged.BillingCycle = remote.BillingCycle
+	}
+	if remote.NextBilling != "" {
+		merged.NextBilling = remote.NextBilling
+	}
+	if merged.Status != SubscriptionPendingCancellation {
+		merged.Status = SubscriptionActive
+	}
+	return merged
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/fixtures"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodEnd(t *testing.T) {
+	now := time.Date(2025, 3, 10, 15, 0, 0, 0, time.Local)
+	day := func(month time.Month, d int) time.Time { return time.Date(2025, month, d, 0, 0, 0, 0, time.Local) }
+	paid := func(month time.Month, d int, result string) SubscriptionPayment {
+		return SubscriptionPayment{Date: day(month, d).Add(6 * time.Hour), Result: result}
+	}
+
+	tests := []struct {
+		name     string
+		sub      Subscription
+		payments []SubscriptionPayment
+		want     time.Time
+		found    bool
+	}{
+		{"next billing date", Subscription{NextBilling: "20250401", BillingCycle: "monthly"}, nil, day(4, 1), true},
+		{"dashed next billing date", Subscription{NextBilling: "2025-03-15"}, nil, day(3, 15), true},
+		{"past next billing date falls back to payments", Subscription{NextBilling: "20250301", BillingCycle: "monthly"},
+			[]SubscriptionPayment{paid(3, 1, "approved")}, day(4, 1), true},
+		{"monthly from last approved payment", Subscription{BillingCycle: "monthly"},
+			[]SubscriptionPayment{paid(2, 1, "approved"), paid(3, 1, "declined")}, day(3, 1).AddDate(0, 1, 0), true},
+		{"weekly", Subscription{BillingCycle: "Weekly"}, []SubscriptionPayment{paid(3, 5, "approved")}, day(3, 12), true},
+		{"no approved payment", Subscription{BillingCycle: "monthly"}, []SubscriptionPayment{paid(3, 1, "declined")}, time.Time{}, false},
+		{"unknown cycle", Subscription{BillingCycle: "fortnightly"}, []SubscriptionPayment{paid(3, 1, "approved")}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := periodEnd(tt.sub, tt.payments, now)
+			assert.Equal(t, tt.found, found)
+			assert.True(t, tt.want.Equal(got), "got %s", got)
+		})
+	}
+}
+
+func TestScheduleSubscriptionCancellation(t *testing.T) {
+	gateway := httptest.NewServer(fixtures.Handler("query/subscription_payments"))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	ctx := context.Background()
+
+	saveSubscription(Subscription{ID: "4415586613", PlanID: "gold", BillingCycle: "monthly", MerchantID: "eu-store"})
+	defer func() {
+		SubscriptionStore.Lock()
+		delete(SubscriptionStore.Data, "4415586613")
+		SubscriptionStore.Unlock()
+	}()
+
+	now := time.Now()
+	sub, err := client.ScheduleSubscriptionCancellation(ctx, "key", "4415586613")
+	require.NoError(t, err)
+	assert.Equal(t, SubscriptionPendingCancellation, sub.Status)
+	require.NotNil(t, sub.CancelAt)
+	// The last approved payment was on the 1st, so the period ends on a 1st
+	assert.Equal(t, 1, sub.CancelAt.Day())
+	assert.True(t, sub.CancelAt.After(now))
+	assert.False(t, sub.CancelAt.After(now.AddDate(0, 1, 0)))
+
+	assert.Empty(t, DueCancellations(now))
+	due := DueCancellations(*sub.CancelAt)
+	require.Len(t, due, 1)
+	assert.Equal(t, "eu-store", due[0].MerchantID)
+
+	// Unknown and already cancelled subscriptions cannot be scheduled
+	_, err = client.ScheduleSubscriptionCancellation(ctx, "key", "missing")
+	assert.Error(t, err)
+	setSubscriptionStatus("4415586613", SubscriptionCancelled)
+	_, err = client.ScheduleSubscriptionCancellation(ctx, "key", "4415586613")
+	assert.Error(t, err)
+	assert.Empty(t, DueCancellations(*sub.CancelAt))
+}
+
+const recurringFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<subscription>
+		<subscription_id>5001</subscription_id>
+		<plan>
+			<plan_id>gold</plan_id>
+			<plan_amount>25.00</plan_amount>
+			<month_frequency>1</month_frequency>
+		</plan>
+		<customer_vault_id>vault-a</customer_vault_id>
+		<next_charge_date>20261101</next_charge_date>
+	</subscription>
+	<subscription>
+		<subscription_id>5002</subscription_id>
+		<plan>
+			<plan_id>silver</plan_id>
+			<plan_amount>10.00</plan_amount>
+			<day_frequency>7</day_frequency>
+		</plan>
+		<customer_vault_id>vault-b</customer_vault_id>
+		<next_charge_date>20261020</next_charge_date>
+	</subscription>
+</nm_response>`
+
+func TestListSubscriptions(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "recurring", r.PostForm.Get("report_type"))
+		if r.PostForm.Get("subscription_id") == "5003" {
+			w.Write([]byte("<nm_response></nm_response>"))
+			return
+		}
+		w.Write([]byte(recurringFixture))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	ctx := context.Background()
+
+	// 5001 is pending cancellation here; 5003 was deleted in the NMI portal
+	saveSubscription(Subscription{ID: "5001", PlanID: "bronze", CustomerVaultID: "vault-a"})
+	scheduleCancellation("5001", time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local))
+	saveSubscription(Subscription{ID: "5003", PlanID: "gold", CustomerVaultID: "vault-c"})
+	defer func() {
+		SubscriptionStore.Lock()
+		delete(SubscriptionStore.Data, "5001")
+		delete(SubscriptionStore.Data, "5003")
+		SubscriptionStore.Unlock()
+	}()
+
+	subs, err := client.ListSubscriptions(ctx, "key", SubscriptionFilter{})
+	require.NoError(t, err)
+	require.Len(t, subs, 3)
+	assert.Equal(t, "gold", subs[0].PlanID)
+	assert.Equal(t, SubscriptionPendingCancellation, subs[0].Status)
+	assert.NotNil(t, subs[0].CancelAt)
+	assert.Equal(t, "weekly", subs[1].BillingCycle)
+	assert.Equal(t, SubscriptionActive, subs[1].Status)
+	assert.Equal(t, SubscriptionCancelled, subs[2].Status)
+
+	subs, err = client.ListSubscriptions(ctx, "key", SubscriptionFilter{PlanID: "gold", Status: SubscriptionActive})
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+
+	subs, err = client.ListSubscriptions(ctx, "key", SubscriptionFilter{CustomerVaultID: "vault-b"})
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	assert.Equal(t, "5002", subs[0].ID)
+
+	_, err = client.ListSubscriptions(ctx, "key", SubscriptionFilter{Status: "paused"})
+	assert.Error(t, err)
+
+	sub, err := client.FetchSubscription(ctx, "key", "5003")
+	require.NoError(t, err)
+	assert.Equal(t, SubscriptionCancelled, sub.Status)
+
+	_, err = client.FetchSubscription(ctx, "key", "5004")
+	require.Error(t, err)
+	assert.Equal(t, ErrNotFound, err.(*NMIError).Code)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"nmi-pay-int/config"
+)
+
+// Surcharge is the card fee added to a sale, broken out of the amount
+// charged
+type Surcharge struct {
+	// BaseAmount is the sale before the surcharge, as requested
+	BaseAmount Amount `json:"base_amount"`
+	Amount     Amount `json:"amount"`
+	// TotalAmount is what the cardholder was charged
+	TotalAmount Amount `json:"total_amount"`
+}
+
+// CardBrand names the brand of a card number from its leading digits, or
+// returns "" when it is not one of the brands surcharge rules name
+func CardBrand(number string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+	prefix := func(n int) int {
+		if len(digits) < n {
+			return -1
+		}
+		value := 0
+		for _, d := range digits[:n] {
+			value = value*10 + int(d-'0')
+		}
+		return value
+	}
+
+	switch {
+	case strings.HasPrefix(digits, "4"):
+		return "visa"
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720:
+		return "mastercard"
+	case prefix(2) == 34, prefix(2) == 37:
+		return "amex"
+	case prefix(4) == 6011, prefix(3) >= 644 && prefix(3) <= 649, prefix(2) == 65:
+		return "discover"
+	}
+	return ""
+}
+
+// surchargeFor works out the surcharge the merchant on ctx adds to a sale or
+// authorization, or returns nil when none applies. Only rules for every
+// brand apply to tokens and vaulted cards, whose brand is not known here.
+// With prohibited states configured, a sale without a billing address is not
+// surcharged, since it may be billed in one of them.
+func surchargeFor(ctx context.Context, req PaymentRequest) *Surcharge {
+	merchant, ok := MerchantFromContext(ctx)
+	policy := merchant.Surcharge
+	if !ok || !policy.Enabled() || (req.Type != "sale" && req.Type != "auth") {
+		return nil
+	}
+
+	state := ""
+	if req.Billing != nil {
+		state = req.Billing.State
+	}
+	if policy.Prohibited(state) || (state == "" && len(policy.ProhibitedStates) > 0) {
+		return nil
+	}
+
+	rule, ok := matchSurchargeRule(policy, CardBrand(req.CreditCard))
+	if !ok {
+		return nil
+	}
+
+	base := req.Amount.Minor()
+	fee := int64(math.Round(float64(base)*rule.Percent/100)) + Amount(rule.Flat).Minor()
+	if limit := int64(float64(base) * policy.Cap() / 100); fee > limit {
+		fee = limit
+	}
+	if fee <= 0 {
+		return nil
+	}
+	return &Surcharge{
+		BaseAmount:  req.Amount,
+		Amount:      Amount(formatMinor(fee)),
+		TotalAmount: Amount(formatMinor(base + fee)),
+	}
+}
+
+// matchSurchargeRule returns the first rule for the brand; an empty brand
+// only matches rules for every brand
+func matchSurchargeRule(policy config.SurchargePolicy, brand string) (config.SurchargeRule, bool) {
+	for _, rule := range policy.Rules {
+		if len(rule.Brands) == 0 {
+			return rule, true
+		}
+		for _, ruleBrand := range rule.Brands {
+			if brand != "" && ruleBrand == brand {
+				return rule, true
+			}
+		}
+	}
+	return config.SurchargeRule{}, false
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCardBrand(t *testing.T) {
+	for number, brand := range map[string]string{
+		"4111111111111111":    "visa",
+		"5555 5555 5555 4444": "mastercard",
+		"2223003122003222":    "mastercard",
+		"378282246310005":     "amex",
+		"6011111111111117":    "discover",
+		"6445644564456445":    "discover",
+		"3530111333300000":    "",
+		"":                    "",
+	} {
+		assert.Equal(t, brand, CardBrand(number), number)
+	}
+}
+
+func TestSurchargeFor(t *testing.T) {
+	policy := config.SurchargePolicy{
+		Rules: []config.SurchargeRule{
+			{Brands: []string{"amex"}, Percent: 3.5},
+			{Brands: []string{"visa", "mastercard"}, Percent: 2.5},
+			{Flat: "0.50"},
+		},
+		ProhibitedStates: []string{"CT", "MA"},
+	}
+	billed := func(state string) *BillingInfo { return &BillingInfo{State: state} }
+
+	tests := []struct {
+		name string
+		req  PaymentRequest
+		want *Surcharge
+	}{
+		{name: "Percentage", req: PaymentRequest{Type: "sale", Amount: "100.00", CreditCard: "4111111111111111", Billing: billed("TX")},
+			want: &Surcharge{BaseAmount: "100.00", Amount: "2.50", TotalAmount: "102.50"}},
+		{name: "Rounded", req: PaymentRequest{Type: "auth", Amount: "10.99", CreditCard: "5555555555554444", Billing: billed("tx")},
+			want: &Surcharge{BaseAmount: "10.99", Amount: "0.27", TotalAmount: "11.26"}},
+		{name: "Capped", req: PaymentRequest{Type: "sale", Amount: "100.00", CreditCard: "378282246310005", Billing: billed("TX")},
+			want: &Surcharge{BaseAmount: "100.00", Amount: "3.00", TotalAmount: "103.00"}},
+		{name: "Unknown Brand Uses Flat Fee", req: PaymentRequest{Type: "sale", Amount: "40.00", CustomerVaultID: "123", Billing: billed("NY")},
+			want: &Surcharge{BaseAmount: "40.00", Amount: "0.50", TotalAmount: "40.50"}},
+		{name: "Flat Fee Capped", req: PaymentRequest{Type: "sale", Amount: "5.00", PaymentToken: "tok", Billing: billed("NY")},
+			want: &Surcharge{BaseAmount: "5.00", Amount: "0.15", TotalAmount: "5.15"}},
+		{name: "Prohibited State", req: PaymentRequest{Type: "sale", Amount: "100.00", CreditCard: "4111111111111111", Billing: billed("CT")}},
+		{name: "No Billing Address", req: PaymentRequest{Type: "sale", Amount: "100.00", CreditCard: "4111111111111111"}},
+		{name: "Refund", req: PaymentRequest{Type: "credit", Amount: "100.00", CreditCard: "4111111111111111", Billing: billed("TX")}},
+	}
+	ctx := WithMerchant(context.Background(), config.Merchant{ID: "m1", Surcharge: policy})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, surchargeFor(ctx, tt.req))
+		})
+	}
+
+	// Merchants without rules, and requests without a merchant, pay none
+	req := PaymentRequest{Type: "sale", Amount: "100.00", CreditCard: "4111111111111111", Billing: billed("TX")}
+	assert.Nil(t, surchargeFor(WithMerchant(context.Background(), config.Merchant{ID: "m2"}), req))
+	assert.Nil(t, surchargeFor(context.Background(), req))
+}
+
+func TestProcessPaymentAddsSurcharge(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=778&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	merchant := config.Merchant{ID: "m1", APIKey: "key", Surcharge: config.SurchargePolicy{Rules: []config.SurchargeRule{{Percent: 3}}}}
+	resp, err := client.ProcessPayment(WithMerchant(context.Background(), merchant), PaymentRequest{
+		APIKey: "key", Amount: "20.00", Type: "sale", CreditCard: "4111111111111111", ExpDate: "1230", CVV: "123",
+		Billing: &BillingInfo{FirstName: "Ada", LastName: "Lovelace", Address1: "1 Main St", City: "Austin", State: "TX", Zip: "78701"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "20.60", form.Get("amount"))
+	assert.Equal(t, "0.60", form.Get("surcharge"))
+	require.NotNil(t, resp.Surcharge)
+	assert.Equal(t, Amount("20.00"), resp.Surcharge.BaseAmount)
+	assert.Equal(t, Amount("20.60"), resp.Surcharge.TotalAmount)
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// Cardholder authentication outcomes reported by the merchant's MPI
+const (
+	CardholderAuthVerified  = "verified"
+	CardholderAuthAttempted = "attempted"
+)
+
+// ThreeDSResult summarizes the 3-D Secure data a payment was submitted with
+type ThreeDSResult struct {
+	Version string `json:"version,omitempty"`
+	ECI     string `json:"eci"`
+	// Authentication is "authenticated", "attempted" or "not_authenticated",
+	// derived from the ECI; the first two normally shift fraud liability to
+	// the issuer
+	Authentication string `json:"authentication"`
+	// CAVVResult is the issuer's CAVV verification code, when NMI returns one
+	CAVVResult string `json:"cavv_result,omitempty"`
+}
+
+var (
+	threeDSVersionPattern = regexp.MustCompile(`^[12]\.\d+(\.\d+)?$`)
+	cavvPattern           = regexp.MustCompile(`^[A-Za-z0-9+/=]{20,64}$`)
+)
+
+// eciAuthentication maps ECI values to their meaning. Visa, Amex and
+// Discover use 05/06/07; Mastercard uses 02/01/00.
+var eciAuthentication = map[string]string{
+	"05": "authenticated",
+	"02": "authenticated",
+	"06": "attempted",
+	"01": "attempted",
+	"07": "not_authenticated",
+	"00": "not_authenticated",
+}
+
+// hasThreeDS reports whether the request carries any 3-D Secure data
+func (req PaymentRequest) hasThreeDS() bool {
+	return req.CAVV != "" || req.XID != "" || req.ECI != "" || req.DirectoryServerID != "" ||
+		req.ThreeDSVersion != "" || req.CardholderAuth != ""
+}
+
+// validateThreeDS checks the authentication data from an external MPI. 3DS
+// 1.0 identifies the authentication with an XID, 2.x with the directory
+// server transaction ID.
+func validateThreeDS(req PaymentRequest) error {
+	if !req.hasThreeDS() {
+		return nil
+	}
+
+	if req.Type != "sale" && req.Type != "auth" {
+		return NewNMIError(ErrInvalidRequest, "3-D Secure data is only accepted on sale and auth transactions", "")
+	}
+	if _, ok := eciAuthentication[req.ECI]; !ok {
+		return NewNMIError(ErrInvalidRequest, "eci must be one of 00, 01, 02, 05, 06 or 07", "")
+	}
+	if req.CAVV == "" {
+		return NewNMIError(ErrInvalidRequest, "cavv is required with 3-D Secure data", "")
+	}
+	if !cavvPattern.MatchString(req.CAVV) {
+		return NewNMIError(ErrInvalidRequest, "cavv must be the base64 or hex value returned by the MPI", "")
+	}
+	if req.CardholderAuth != "" && req.CardholderAuth != CardholderAuthVerified && req.CardholderAuth != CardholderAuthAttempted {
+		return NewNMIError(ErrInvalidRequest, "cardholder_auth must be verified or attempted", "")
+	}
+
+	if req.ThreeDSVersion == "" {
+		return NewNMIError(ErrInvalidRequest, "three_ds_version is required with 3-D Secure data", "")
+	}
+	if !threeDSVersionPattern.MatchString(req.ThreeDSVersion) {
+		return NewNMIError(ErrInvalidRequest, "three_ds_version must look like 2.2.0", "")
+	}
+	if req.ThreeDSVersion[0] == '2' && req.DirectoryServerID == "" {
+		return NewNMIError(ErrInvalidRequest, "directory_server_id is required for 3-D Secure 2", "")
+	}
+	if req.ThreeDSVersion[0] == '1' && req.XID == "" {
+		return NewNMIError(ErrInvalidRequest, "xid is required for 3-D Secure 1", "")
+	}
+
+	return nil
+}
+
+// addThreeDSInfo forwards 3-D Secure data to NMI
+func addThreeDSInfo(formData url.Values, req PaymentRequest) {
+	fields := map[string]string{
+		"cavv":                req.CAVV,
+		"xid":                 req.XID,
+		"eci":                 req.ECI,
+		"directory_server_id": req.DirectoryServerID,
+		"three_ds_version":    req.ThreeDSVersion,
+		"cardholder_auth":     req.CardholderAuth,
+	}
+	for field, value := range fields {
+		if value != "" {
+			formData.Set(field, value)
+		}
+	}
+}
+
+// threeDSResult describes the 3-D Secure data a payment carried, or nil
+func threeDSResult(req PaymentRequest, values url.Values) *ThreeDSResult {
+	if !req.hasThreeDS() {
+		return nil
+	}
+	return &ThreeDSResult{
+		Version:        req.ThreeDSVersion,
+		ECI:            req.ECI,
+		Authentication: eciAuthentication[req.ECI],
+		CAVVResult:     values.Get("cavv_result"),
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func threeDSSale() PaymentRequest {
+	return PaymentRequest{
+		Amount:            "25.00",
+		CreditCard:        "4111111111111111",
+		ExpDate:           "1230",
+		CVV:               "123",
+		Type:              "sale",
+		CAVV:              "AAABCZIhcQAAAABZlyFxAAAAAAA=",
+		ECI:               "05",
+		DirectoryServerID: "c0f6bc7c-7c8f-4a3e-9a46-4d2e3f1a9b10",
+		ThreeDSVersion:    "2.2.0",
+		CardholderAuth:    CardholderAuthVerified,
+	}
+}
+
+func TestValidateThreeDS(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*PaymentRequest)
+		wantErr string
+	}{
+		{name: "Valid 3DS2", modify: func(r *PaymentRequest) {}},
+		{name: "No 3DS Data", modify: func(r *PaymentRequest) { *r = PaymentRequest{Type: "sale"} }},
+		{name: "Valid 3DS1", modify: func(r *PaymentRequest) {
+			r.ThreeDSVersion, r.DirectoryServerID, r.XID = "1.0.2", "", "MDAwMDAwMDAwMDAwMDAwMzIyNzY="
+		}},
+		{name: "Bad ECI", modify: func(r *PaymentRequest) { r.ECI = "09" }, wantErr: "eci must be"},
+		{name: "Missing CAVV", modify: func(r *PaymentRequest) { r.CAVV = "" }, wantErr: "cavv is required"},
+		{name: "Malformed CAVV", modify: func(r *PaymentRequest) { r.CAVV = "not a cavv" }, wantErr: "cavv must be"},
+		{name: "Missing Version", modify: func(r *PaymentRequest) { r.ThreeDSVersion = "" }, wantErr: "three_ds_version is required"},
+		{name: "3DS2 Without Directory Server ID", modify: func(r *PaymentRequest) { r.DirectoryServerID = "" }, wantErr: "directory_server_id is required"},
+		{name: "3DS1 Without XID", modify: func(r *PaymentRequest) { r.ThreeDSVersion = "1.0.2" }, wantErr: "xid is required"},
+		{name: "Bad Cardholder Auth", modify: func(r *PaymentRequest) { r.CardholderAuth = "yes" }, wantErr: "cardholder_auth must be"},
+		{name: "Refund Type", modify: func(r *PaymentRequest) { r.Type = "credit" }, wantErr: "only accepted on sale and auth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := threeDSSale()
+			tt.modify(&req)
+			err := validateThreeDS(req)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var nmiErr *NMIError
+			require.True(t, errors.As(err, &nmiErr))
+			assert.Equal(t, ErrInvalidRequest, nmiErr.Code)
+			assert.Contains(t, nmiErr.Message, tt.wantErr)
+		})
+	}
+}
+
+func TestProcessPaymentForwardsThreeDS(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&authcode=123456&transactionid=555&type=sale&response_code=100&cavv_result=2"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	resp, err := client.ProcessPayment(context.Background(), threeDSSale())
+	require.NoError(t, err)
+
+	assert.Equal(t, "AAABCZIhcQAAAABZlyFxAAAAAAA=", form.Get("cavv"))
+	assert.Equal(t, "05", form.Get("eci"))
+	assert.Equal(t, "2.2.0", form.Get("three_ds_version"))
+	assert.Equal(t, "c0f6bc7c-7c8f-4a3e-9a46-4d2e3f1a9b10", form.Get("directory_server_id"))
+	assert.Equal(t, "verified", form.Get("cardholder_auth"))
+	assert.False(t, form.Has("xid"))
+
+	require.NotNil(t, resp.ThreeDSecure)
+	assert.Equal(t, "authenticated", resp.ThreeDSecure.Authentication)
+	assert.Equal(t, "2", resp.ThreeDSecure.CAVVResult)
+}
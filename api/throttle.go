@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+// defaultThrottleBackoff is used when NMI throttles us without a Retry-After hint
+const defaultThrottleBackoff = 5 * time.Second
+
+// gatewayThrottle remembers when NMI last told us to back off so that
+// requests are rejected locally instead of adding to the gateway's load
+var gatewayThrottle = struct {
+	sync.RWMutex
+	until time.Time
+}{}
+
+// throttleRemaining returns how long outbound requests should still be held back
+func throttleRemaining() time.Duration {
+	gatewayThrottle.RLock()
+	defer gatewayThrottle.RUnlock()
+	return time.Until(gatewayThrottle.until)
+}
+
+// recordThrottle starts a backoff window and flags the throttle gauge
+func recordThrottle(backoff time.Duration) {
+	if backoff <= 0 {
+		backoff = defaultThrottleBackoff
+	}
+
+	gatewayThrottle.Lock()
+	gatewayThrottle.until = time.Now().Add(backoff)
+	gatewayThrottle.Unlock()
+
+	metrics.SetGatewayThrottled(true)
+	metrics.LogInfo(context.Background(), "NMI is throttling requests, backing off for "+backoff.String())
+}
+
+// clearThrottle resets the gauge once a request goes through
+func clearThrottle() {
+	if throttleRemaining() <= 0 {
+		metrics.SetGatewayThrottled(false)
+	}
+}
+
+// throttleTexts are the gateway's rate limit messages, lower-cased and
+// without trailing punctuation. Only whole messages match: declines such
+// as "Too many PIN tries" must not be mistaken for throttling.
+var throttleTexts = map[string]bool{
+	"rate limit exceeded": true,
+	"too many requests":   true,
+}
+
+// isThrottleResponse detects NMI throttling, either as an HTTP status or as
+// a gateway error whose text is a rate limit message
+func isThrottleResponse(statusCode int, body string) bool {
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	// Approvals and issuer declines are answers, whatever their text says
+	if response := ExtractValue(body, "response"); response == "1" || response == "2" {
+		return false
+	}
+	text := strings.ToLower(strings.TrimRight(strings.TrimSpace(ExtractValue(body, "responsetext")), ".!"))
+	return throttleTexts[text]
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// newThrottledError builds the error returned while NMI is throttling us
+func newThrottledError(retryAfter time.Duration, raw string) *NMIError {
+	err := NewNMIError(ErrGatewayThrottled, "gateway is throttling requests, retry later", raw)
+	err.RetryAfter = int(retryAfter.Round(time.Second).Seconds())
+	return err
+}
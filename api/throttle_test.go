@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsThrottleResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   bool
+	}{
+		{"http 429", http.StatusTooManyRequests, "", true},
+		{"rate limit error", http.StatusOK, "response=3&responsetext=Rate limit exceeded&response_code=300", true},
+		{"too many requests", http.StatusOK, "response=3&responsetext=Too Many Requests.&response_code=300", true},
+		{"decline mentioning too many", http.StatusOK, "response=2&responsetext=Too many PIN tries&response_code=206", false},
+		{"error mentioning too many", http.StatusOK, "response=3&responsetext=Too many line items&response_code=300", false},
+		{"declined with throttle text", http.StatusOK, "response=2&responsetext=Too many requests&response_code=200", false},
+		{"approval", http.StatusOK, "response=1&responsetext=SUCCESS&response_code=100", false},
+		{"empty body", http.StatusOK, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isThrottleResponse(tt.status, tt.body))
+		})
+	}
+}
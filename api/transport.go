@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+)
+
+// Connection pool defaults, used when the config leaves them unset. Every
+// gateway call goes to the same NMI host, so the per-host idle limit matters
+// most: Go's default of 2 forces new TLS handshakes under any real load.
+const (
+	DefaultGatewayMaxIdleConns    = 64
+	DefaultGatewayIdleConnTimeout = 90 * time.Second
+)
+
+// newGatewayTransport builds the pooled transport shared by every request a
+// Client sends, so keep-alive connections to NMI are reused. With
+// SANDBOX_SIMULATION it answers magic test payments itself.
+func newGatewayTransport(cfg *config.Config) http.RoundTripper {
+	maxIdle := cfg.GatewayMaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = DefaultGatewayMaxIdleConns
+	}
+	idleTimeout := cfg.GatewayIdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultGatewayIdleConnTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			metrics.GatewayOpenConnections.Inc()
+			return &countedConn{Conn: conn}, nil
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	traced := &tracedTransport{base: transport}
+	if cfg.SandboxSimulation {
+		return &simulatedTransport{base: traced}
+	}
+	return traced
+}
+
+// gatewayTimeout returns the configured cap on a single gateway call
+func gatewayTimeout(cfg *config.Config) time.Duration {
+	if timeout := cfg.Settings().GatewayTimeout; timeout > 0 {
+		return timeout
+	}
+	return MaxGatewayTimeout
+}
+
+// tracedTransport records whether each request reused a pooled connection
+type tracedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.RecordGatewayConnection(info.Reused)
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// countedConn keeps the open connection gauge accurate when the pool closes
+// a connection
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(metrics.GatewayOpenConnections.Dec)
+	return c.Conn.Close()
+}
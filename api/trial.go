@@ -0,0 +1,101 @@
+package api
+
+import (
+	"strconv"
+	"time"
+)
+
+// When a subscription without a trial is first charged
+const (
+	// FirstChargeImmediate charges the plan amount on the day the
+	// subscription is created
+	FirstChargeImmediate = "immediate"
+	// FirstChargeNextCycle charges it one billing cycle later
+	FirstChargeNextCycle = "next_cycle"
+)
+
+// MaxTrialDays bounds a subscription's trial period
+const MaxTrialDays = 365
+
+// nmiDateLayout is the date format of NMI's start_date parameter
+const nmiDateLayout = "20060102"
+
+// subscriptionStart is when a new subscription first bills its plan and
+// what is charged for its trial
+type subscriptionStart struct {
+	// StartDate is the first day the plan is charged; zero leaves it to
+	// NMI, which charges on the day the subscription is created
+	StartDate time.Time
+	// TrialAmount is charged when the subscription is created; empty or
+	// zero for a free trial or no trial
+	TrialAmount Amount
+	// TrialDays is the length of the trial, zero without one
+	TrialDays int
+}
+
+// chargesTrial reports whether a trial amount is due up front
+func (s subscriptionStart) chargesTrial() bool {
+	return s.TrialAmount.Minor() > 0
+}
+
+// planSubscriptionStart checks the trial and start settings of req are
+// consistent and works out when the plan is first charged. A trial delays
+// the first charge by TrialDays and cannot be combined with first_charge or
+// start_date, which choose that day themselves.
+func planSubscriptionStart(req RecurringPaymentRequest, plan Plan, now time.Time) (subscriptionStart, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	if req.TrialDays < 0 || req.TrialDays > MaxTrialDays {
+		return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "trial_days must be between 0 and "+strconv.Itoa(MaxTrialDays), "")
+	}
+	if req.TrialAmount != "" && req.TrialDays == 0 {
+		return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "trial_amount requires trial_days", "")
+	}
+	switch req.FirstCharge {
+	case "", FirstChargeImmediate, FirstChargeNextCycle:
+	default:
+		return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "first_charge must be immediate or next_cycle", "")
+	}
+
+	if req.TrialDays > 0 {
+		if req.FirstCharge != "" {
+			return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "first_charge cannot be combined with a trial; the plan is first charged when the trial ends", "")
+		}
+		if req.StartDate != "" {
+			return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "start_date cannot be combined with a trial; the plan is first charged when the trial ends", "")
+		}
+		amount, err := ParseAmount(req.TrialAmount)
+		if err != nil {
+			return subscriptionStart{}, err
+		}
+		return subscriptionStart{StartDate: today.AddDate(0, 0, req.TrialDays), TrialAmount: amount, TrialDays: req.TrialDays}, nil
+	}
+
+	if req.StartDate != "" {
+		if req.FirstCharge != "" {
+			return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "first_charge cannot be combined with start_date", "")
+		}
+		if err := validateStartDate(req.StartDate); err != nil {
+			return subscriptionStart{}, err
+		}
+		start, _ := time.ParseInLocation("01/02/2006", req.StartDate, now.Location())
+		if start.Before(today) {
+			return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "start_date must not be in the past", "")
+		}
+		return subscriptionStart{StartDate: start}, nil
+	}
+
+	switch req.FirstCharge {
+	case FirstChargeImmediate:
+		return subscriptionStart{StartDate: today}, nil
+	case FirstChargeNextCycle:
+		if days, err := strconv.Atoi(plan.DayFrequency); err == nil && days > 0 {
+			return subscriptionStart{StartDate: today.AddDate(0, 0, days)}, nil
+		}
+		if months, err := strconv.Atoi(plan.MonthFrequency); err == nil && months > 0 {
+			return subscriptionStart{StartDate: today.AddDate(0, months, 0)}, nil
+		}
+		return subscriptionStart{}, NewNMIError(ErrInvalidRequest, "first_charge next_cycle needs a plan with a day_frequency or month_frequency", "")
+	}
+	return subscriptionStart{}, nil
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanSubscriptionStart(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 30, 0, 0, time.Local)
+	day := func(month time.Month, d int) time.Time { return time.Date(2026, month, d, 0, 0, 0, 0, time.Local) }
+	monthly := Plan{ID: "gold", MonthFrequency: "1", DayOfMonth: "16"}
+
+	tests := []struct {
+		name    string
+		req     RecurringPaymentRequest
+		plan    Plan
+		want    subscriptionStart
+		wantErr string
+	}{
+		{"nmi default", RecurringPaymentRequest{}, monthly, subscriptionStart{}, ""},
+		{"free trial", RecurringPaymentRequest{TrialDays: 14}, monthly,
+			subscriptionStart{StartDate: day(10, 30), TrialDays: 14}, ""},
+		{"ambiguous trial amount", RecurringPaymentRequest{TrialDays: 7, TrialAmount: "1"}, monthly,
+			subscriptionStart{}, "ambiguous amount"},
+		{"paid trial with cents", RecurringPaymentRequest{TrialDays: 7, TrialAmount: "1.00"}, monthly,
+			subscriptionStart{StartDate: day(10, 23), TrialAmount: "1.00", TrialDays: 7}, ""},
+		{"immediate", RecurringPaymentRequest{FirstCharge: FirstChargeImmediate}, monthly,
+			subscriptionStart{StartDate: day(10, 16)}, ""},
+		{"next monthly cycle", RecurringPaymentRequest{FirstCharge: FirstChargeNextCycle}, monthly,
+			subscriptionStart{StartDate: day(11, 16)}, ""},
+		{"next daily cycle", RecurringPaymentRequest{FirstCharge: FirstChargeNextCycle}, Plan{DayFrequency: "30"},
+			subscriptionStart{StartDate: day(11, 15)}, ""},
+		{"start date", RecurringPaymentRequest{StartDate: "12/01/2026"}, monthly,
+			subscriptionStart{StartDate: day(12, 1)}, ""},
+
+		{"trial amount without days", RecurringPaymentRequest{TrialAmount: "1.00"}, monthly, subscriptionStart{}, "requires trial_days"},
+		{"negative trial", RecurringPaymentRequest{TrialDays: -1}, monthly, subscriptionStart{}, "between 0 and 365"},
+		{"trial and first charge", RecurringPaymentRequest{TrialDays: 7, FirstCharge: FirstChargeImmediate}, monthly, subscriptionStart{}, "first_charge cannot"},
+		{"trial and start date", RecurringPaymentRequest{TrialDays: 7, StartDate: "12/01/2026"}, monthly, subscriptionStart{}, "start_date cannot"},
+		{"start date and first charge", RecurringPaymentRequest{StartDate: "12/01/2026", FirstCharge: FirstChargeNextCycle}, monthly, subscriptionStart{}, "cannot be combined with start_date"},
+		{"past start date", RecurringPaymentRequest{StartDate: "10/15/2026"}, monthly, subscriptionStart{}, "in the past"},
+		{"unknown first charge", RecurringPaymentRequest{FirstCharge: "later"}, monthly, subscriptionStart{}, "immediate or next_cycle"},
+		{"next cycle without frequency", RecurringPaymentRequest{FirstCharge: FirstChargeNextCycle}, Plan{}, subscriptionStart{}, "day_frequency or month_frequency"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planSubscriptionStart(tt.req, tt.plan, now)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, tt.want.StartDate.Equal(got.StartDate), "got %s", got.StartDate)
+			assert.Equal(t, tt.want.TrialAmount, got.TrialAmount)
+			assert.Equal(t, tt.want.TrialDays, got.TrialDays)
+		})
+	}
+}
+
+func TestPaidTrialSubscription(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=9001&subscription_id=7001&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	ctx := context.Background()
+	_, err := client.Plans().Create(ctx, Plan{ID: "trial-plan", Name: "Trial", Amount: "30.00", MonthFrequency: "1", DayOfMonth: "1"})
+	require.NoError(t, err)
+
+	resp, err := client.ProcessRecurringPayment(ctx, RecurringPaymentRequest{
+		CustomerVaultID: "vault-0001",
+		PlanID:          "trial-plan",
+		TrialDays:       14,
+		TrialAmount:     "1.00",
+	})
+	require.NoError(t, err)
+	defer func() {
+		SubscriptionStore.Lock()
+		delete(SubscriptionStore.Data, "7001")
+		SubscriptionStore.Unlock()
+	}()
+
+	startDate := time.Now().AddDate(0, 0, 14)
+	assert.Equal(t, "sale", form.Get("type"))
+	assert.Equal(t, "1.00", form.Get("amount"))
+	assert.Equal(t, "add_subscription", form.Get("recurring"))
+	assert.Equal(t, startDate.Format("20060102"), form.Get("start_date"))
+
+	assert.Equal(t, "7001", resp.SubscriptionID)
+	assert.Equal(t, "9001", resp.TrialTransactionID)
+	assert.Equal(t, startDate.Format("2006-01-02"), resp.StartDate)
+	sub, ok := GetSubscription("7001")
+	require.True(t, ok)
+	assert.Equal(t, startDate.Format("20060102"), sub.NextBilling)
+}
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,40 +11,45 @@ import (
 func ValidatePaymentRequest(req PaymentRequest) error {
 	// Validate amount
 	if req.Amount == "" {
-		return fmt.Errorf("amount is required")
+		return NewNMIError(ErrInvalidAmount, "amount is required", "")
 	}
-	if err := validateAmount(req.Amount); err != nil {
+	if err := validateAmount(req.Amount.String()); err != nil {
 		return err
 	}
 
 	// Validate type
 	if req.Type == "" {
-		return fmt.Errorf("type is required")
+		return NewNMIError(ErrInvalidRequest, "type is required", "")
 	}
 	if err := validateTransactionType(req.Type); err != nil {
 		return err
 	}
 
-	// If not using customer vault, validate card details
-	if req.CustomerVaultID == "" {
-		if req.CreditCard == "" || req.ExpDate == "" || req.CVV == "" {
-			return fmt.Errorf("either customer_vault_id or credit_card, exp_date, and cvv are required")
+	// If not using a wallet, Collect.js token or customer vault, validate
+	// card details
+	if req.PaymentToken != "" {
+		if req.WalletType != "" || req.CustomerVaultID != "" {
+			return NewNMIError(ErrInvalidRequest, "payment_token cannot be combined with wallet_type or customer_vault_id", "")
 		}
-
-		// Validate each card detail
-		if err := validateCreditCard(req.CreditCard); err != nil {
+		if err := validatePaymentToken(req); err != nil {
 			return err
 		}
-		if err := validateExpirationDate(req.ExpDate); err != nil {
+	} else if req.WalletType != "" {
+		if err := validateWallet(req); err != nil {
 			return err
 		}
-		if err := validateCVV(req.CVV); err != nil {
+	} else if req.CustomerVaultID == "" {
+		if req.CreditCard == "" || req.ExpDate == "" || req.CVV == "" {
+			return NewNMIError(ErrInvalidRequest, "either customer_vault_id, payment_token or credit_card, exp_date, and cvv are required", "")
+		}
+
+		if err := validateCardDetails(req); err != nil {
 			return err
 		}
 	} else {
 		// Validate customer vault ID
 		if len(req.CustomerVaultID) < 8 {
-			return fmt.Errorf("customer_vault_id must be at least 8 characters")
+			return NewNMIError(ErrInvalidRequest, "customer_vault_id must be at least 8 characters", "")
 		}
 	}
 
@@ -56,9 +60,77 @@ func ValidatePaymentRequest(req PaymentRequest) error {
 		}
 	}
 
+	// Gateway receipts are emailed, so an address is required
+	if req.CustomerReceipt != nil && *req.CustomerReceipt {
+		if req.Billing == nil || req.Billing.Email == "" {
+			return NewNMIError(ErrInvalidRequest, "billing.email is required when customer_receipt is enabled", "")
+		}
+	}
+
+	if err := validateLevel3(req); err != nil {
+		return err
+	}
+
+	// A wallet's cryptogram travels in cavv/eci and was checked above
+	if req.WalletType != "" {
+		return nil
+	}
+	return validateThreeDS(req)
+}
+
+// ValidateTokenizationRequest validates the card details to store in the
+// customer vault. Amount and type are not needed since the service picks them.
+func ValidateTokenizationRequest(req PaymentRequest) error {
+	if req.PaymentToken != "" {
+		if err := validatePaymentToken(req); err != nil {
+			return err
+		}
+	} else {
+		if req.CreditCard == "" || req.ExpDate == "" || req.CVV == "" {
+			return NewNMIError(ErrInvalidRequest, "payment_token or credit_card, exp_date, and cvv are required", "")
+		}
+
+		if err := validateCardDetails(req); err != nil {
+			return err
+		}
+	}
+
+	if req.Billing != nil {
+		if err := validateBillingInfo(req.Billing); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// paymentTokenPattern matches a Collect.js payment token, such as
+// 3455zJms-7qA2K2-VdVrSu-Rv7WpvPuG7s8
+var paymentTokenPattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+
+// validatePaymentToken checks a Collect.js token is well formed and is not
+// sent alongside the card fields it replaces
+func validatePaymentToken(req PaymentRequest) error {
+	if req.CreditCard != "" || req.ExpDate != "" || req.CVV != "" {
+		return NewNMIError(ErrInvalidRequest, "card fields must be omitted when a payment_token is given", "")
+	}
+	if len(req.PaymentToken) > 64 || !paymentTokenPattern.MatchString(req.PaymentToken) {
+		return NewNMIError(ErrInvalidRequest, "payment_token is not a Collect.js payment token", "")
+	}
+	return nil
+}
+
+// validateCardDetails validates each raw card field
+func validateCardDetails(req PaymentRequest) error {
+	if err := ValidateCardNumber(req.CreditCard); err != nil {
+		return err
+	}
+	if err := validateExpirationDate(req.ExpDate); err != nil {
+		return err
+	}
+	return validateCVV(req.CVV)
+}
+
 // ValidateRefundRequest validates refund request parameters
 func ValidateRefundRequest(req RefundRequest, originalAmount string) error {
 	if req.TransactionID == "" {
@@ -90,6 +162,111 @@ func ValidateRefundRequest(req RefundRequest, originalAmount string) error {
 	return nil
 }
 
+// ValidateCaptureRequest validates a capture against the authorized amount,
+// when it is known
+func ValidateCaptureRequest(req CaptureRequest, authorizedAmount string) error {
+	if req.TransactionID == "" {
+		return NewNMIError(ErrInvalidRequest, "transaction_id is required", "")
+	}
+
+	if req.Amount != "" {
+		if err := validateAmount(req.Amount); err != nil {
+			return err
+		}
+
+		if authorizedAmount != "" {
+			captureAmt, _ := strconv.ParseFloat(req.Amount, 64)
+			authorizedAmt, _ := strconv.ParseFloat(authorizedAmount, 64)
+			if captureAmt > authorizedAmt {
+				return NewNMIError(ErrInvalidAmount, "capture amount cannot exceed authorized amount", "")
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateACHRequest validates eCheck transaction parameters
+func ValidateACHRequest(req ACHRequest) error {
+	if req.Amount == "" {
+		return NewNMIError(ErrInvalidAmount, "amount is required", "")
+	}
+	if err := validateAmount(req.Amount); err != nil {
+		return err
+	}
+
+	if req.Type != "sale" && req.Type != "credit" {
+		return NewNMIError(ErrInvalidRequest, "type must be sale or credit for ACH", "")
+	}
+
+	if req.CheckName == "" {
+		return NewNMIError(ErrInvalidRequest, "checkname is required", "")
+	}
+	if err := validateRoutingNumber(req.CheckABA); err != nil {
+		return err
+	}
+	if !regexp.MustCompile(`^\d{4,17}$`).MatchString(req.CheckAccount) {
+		return NewNMIError(ErrInvalidRequest, "checkaccount must be 4 to 17 digits", "")
+	}
+
+	if req.AccountHolderType != "business" && req.AccountHolderType != "personal" {
+		return NewNMIError(ErrInvalidRequest, "account_holder_type must be business or personal", "")
+	}
+	if req.AccountType != "checking" && req.AccountType != "savings" {
+		return NewNMIError(ErrInvalidRequest, "account_type must be checking or savings", "")
+	}
+
+	if err := validateSECCode(req.SECCode, req.AccountHolderType); err != nil {
+		return err
+	}
+
+	if req.Billing != nil {
+		if err := validateBillingInfo(req.Billing); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateRoutingNumber checks an ABA routing number's length and checksum
+func validateRoutingNumber(aba string) error {
+	if !regexp.MustCompile(`^\d{9}$`).MatchString(aba) {
+		return NewNMIError(ErrInvalidRequest, "checkaba must be a 9 digit routing number", "")
+	}
+
+	weights := []int{3, 7, 1}
+	sum := 0
+	for i, r := range aba {
+		sum += int(r-'0') * weights[i%3]
+	}
+	if sum%10 != 0 {
+		return NewNMIError(ErrInvalidRequest, "checkaba is not a valid routing number", "")
+	}
+
+	return nil
+}
+
+// validateSECCode checks the NACHA Standard Entry Class code. CCD entries
+// debit business accounts, so they require a business account holder.
+func validateSECCode(secCode, accountHolderType string) error {
+	validCodes := map[string]bool{
+		"PPD": true,
+		"WEB": true,
+		"TEL": true,
+		"CCD": true,
+	}
+
+	if !validCodes[secCode] {
+		return NewNMIError(ErrInvalidRequest, "sec_code must be one of PPD, WEB, TEL, CCD", "")
+	}
+	if secCode == "CCD" && accountHolderType != "business" {
+		return NewNMIError(ErrInvalidRequest, "sec_code CCD requires a business account_holder_type", "")
+	}
+
+	return nil
+}
+
 // ValidateRecurringRequest validates recurring payment request parameters
 func ValidateRecurringRequest(req RecurringPaymentRequest) error {
 	if req.CustomerVaultID == "" {
@@ -146,7 +323,9 @@ func validateAmount(amount string) error {
 	return nil
 }
 
-func validateCreditCard(number string) error {
+// ValidateCardNumber checks a card number's length and Luhn check digit,
+// ignoring spaces and hyphens
+func ValidateCardNumber(number string) error {
 	// Remove any spaces or hyphens
 	number = regexp.MustCompile(`[\s-]`).ReplaceAllString(number, "")
 
@@ -0,0 +1,350 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/pci"
+)
+
+// VaultCard holds the display details of a card stored in the customer vault
+type VaultCard struct {
+	MaskedCard string `json:"masked_card"`
+	CardType   string `json:"card_type"`
+	ExpiryDate string `json:"expiry_date"`
+	// bin is kept for BIN_REJECT_PREPAID checks on subscriptions
+	bin string
+}
+
+// vaultCards remembers the display details captured at tokenization time so
+// that later vault charges can echo them back without exposing the PAN
+var vaultCards = struct {
+	sync.RWMutex
+	data map[string]VaultCard
+}{data: make(map[string]VaultCard)}
+
+// saveVaultCard records the display details for a vault ID
+func saveVaultCard(vaultID string, card VaultCard) {
+	if vaultID == "" {
+		return
+	}
+
+	vaultCards.Lock()
+	defer vaultCards.Unlock()
+	vaultCards.data[vaultID] = card
+}
+
+// lookupVaultCard returns the display details for a vault ID, preferring any
+// card fields NMI echoed in the gateway response over the local record
+func lookupVaultCard(vaultID, rawResponse string) (VaultCard, bool) {
+	vaultCards.RLock()
+	card, exists := vaultCards.data[vaultID]
+	vaultCards.RUnlock()
+
+	if masked := ExtractValue(rawResponse, "cc_number"); masked != "" {
+		card.MaskedCard = masked
+		exists = true
+	}
+	if cardType := ExtractValue(rawResponse, "card_type"); cardType != "" {
+		card.CardType = cardType
+	}
+	if expiry := ExtractValue(rawResponse, "cc_exp"); expiry != "" {
+		card.ExpiryDate = expiry
+	}
+
+	return card, exists
+}
+
+// forgetVaultCard drops the display details for a deleted vault ID
+func forgetVaultCard(vaultID string) {
+	vaultCards.Lock()
+	defer vaultCards.Unlock()
+	delete(vaultCards.data, vaultID)
+}
+
+// VaultCustomer is a customer vault record as reported by the Query API
+type VaultCustomer struct {
+	CustomerVaultID string      `json:"customer_vault_id"`
+	Billing         BillingInfo `json:"billing"`
+	MaskedCard      string      `json:"masked_card,omitempty"`
+	CardType        string      `json:"card_type,omitempty"`
+	ExpiryDate      string      `json:"expiry_date,omitempty"`
+	MaskedAccount   string      `json:"masked_account,omitempty"`
+	Created         time.Time   `json:"created"`
+	Updated         time.Time   `json:"updated"`
+	// Metadata holds the record's merchant defined fields, keyed by number
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// VaultExportPageSize is how many vault records an export fetches per
+// Query API call
+const VaultExportPageSize = 1000
+
+// VaultUpdateRequest changes a vault record. A new card needs both number
+// and expiry; an expiry alone updates a reissued card. Billing, when given,
+// replaces the stored billing details.
+type VaultUpdateRequest struct {
+	APIKey          string       `json:"api_key,omitempty"`
+	CustomerVaultID string       `json:"-"`
+	CreditCard      string       `json:"credit_card,omitempty"`
+	ExpDate         string       `json:"exp_date,omitempty"`
+	Billing         *BillingInfo `json:"billing,omitempty"`
+}
+
+// VaultResponse is the gateway's answer to a vault update or delete
+type VaultResponse struct {
+	CustomerVaultID string `json:"customer_vault_id"`
+	Success         bool   `json:"success"`
+	Message         string `json:"message"`
+	ResponseCode    string `json:"response_code,omitempty"`
+}
+
+// queryCustomer is a record in a customer_vault Query API report
+type queryCustomer struct {
+	ID           string `xml:"customer_vault_id"`
+	FirstName    string `xml:"first_name"`
+	LastName     string `xml:"last_name"`
+	Address1     string `xml:"address_1"`
+	City         string `xml:"city"`
+	State        string `xml:"state"`
+	PostalCode   string `xml:"postal_code"`
+	Country      string `xml:"country"`
+	Email        string `xml:"email"`
+	Phone        string `xml:"phone"`
+	CCNumber     string `xml:"cc_number"`
+	CCExp        string `xml:"cc_exp"`
+	CCType       string `xml:"cc_type"`
+	CCBin        string `xml:"cc_bin"`
+	CheckAccount string `xml:"check_account"`
+	Created      string `xml:"created"`
+	Updated      string `xml:"updated"`
+	// Other holds the fields not named above, among them the merchant
+	// defined fields
+	Other []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// merchantFieldPrefix starts the Query API name of a merchant defined field
+const merchantFieldPrefix = "merchant_defined_field_"
+
+// customer converts a Query API record, making sure no full card or account
+// number gets through even if the report was to include one
+func (q queryCustomer) customer() VaultCustomer {
+	created, _ := time.Parse(queryDateLayout, q.Created)
+	updated, _ := time.Parse(queryDateLayout, q.Updated)
+	customer := VaultCustomer{
+		CustomerVaultID: q.ID,
+		Billing: BillingInfo{
+			FirstName: q.FirstName,
+			LastName:  q.LastName,
+			Address1:  q.Address1,
+			City:      q.City,
+			State:     q.State,
+			Zip:       q.PostalCode,
+			Country:   q.Country,
+			Email:     q.Email,
+			Phone:     q.Phone,
+		},
+		MaskedCard:    ensureMasked(q.CCNumber),
+		CardType:      q.CCType,
+		ExpiryDate:    q.CCExp,
+		MaskedAccount: ensureMasked(q.CheckAccount),
+		Created:       created,
+		Updated:       updated,
+	}
+	for _, field := range q.Other {
+		number, ok := strings.CutPrefix(field.XMLName.Local, merchantFieldPrefix)
+		if !ok || field.Value == "" {
+			continue
+		}
+		if customer.Metadata == nil {
+			customer.Metadata = make(map[string]string)
+		}
+		customer.Metadata[number] = field.Value
+	}
+	return customer
+}
+
+// GetVaultCustomer retrieves a vault record through the Query API
+func (c *Client) GetVaultCustomer(ctx context.Context, apiKey, vaultID string) (*VaultCustomer, error) {
+	if vaultID == "" {
+		return nil, NewNMIError(ErrInvalidRequest, "customer_vault_id is required", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("report_type", "customer_vault")
+	formData.Set("customer_vault_id", vaultID)
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		metrics.RecordVaultOperation("get", "error")
+		return nil, err
+	}
+	if len(parsed.Customers) == 0 {
+		metrics.RecordVaultOperation("get", "not_found")
+		return nil, NewNMIError(ErrVaultCustomerNotFound, "customer vault record "+vaultID+" not found", "")
+	}
+	metrics.RecordVaultOperation("get", "success")
+
+	customer := parsed.Customers[0].customer()
+	return &customer, nil
+}
+
+// ListVaultCustomers returns one page of vault records. Page is zero-based
+// and limit at most VaultExportPageSize.
+func (c *Client) ListVaultCustomers(ctx context.Context, apiKey string, page, limit int) ([]VaultCustomer, error) {
+	if limit <= 0 || limit > VaultExportPageSize {
+		limit = VaultExportPageSize
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("report_type", "customer_vault")
+	formData.Set("page_number", strconv.Itoa(page))
+	formData.Set("result_limit", strconv.Itoa(limit))
+
+	parsed, err := c.sendQuery(ctx, formData)
+	if err != nil {
+		metrics.RecordVaultOperation("list", "error")
+		return nil, err
+	}
+	metrics.RecordVaultOperation("list", "success")
+
+	customers := make([]VaultCustomer, 0, len(parsed.Customers))
+	for _, cust := range parsed.Customers {
+		customers = append(customers, cust.customer())
+	}
+	return customers, nil
+}
+
+// UpdateVaultCustomer changes the card or billing details of a vault record
+func (c *Client) UpdateVaultCustomer(ctx context.Context, req VaultUpdateRequest) (*VaultResponse, error) {
+	if err := validateVaultUpdate(req); err != nil {
+		metrics.RecordVaultOperation("update", "validation_error")
+		return nil, err
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", req.APIKey)
+	formData.Set("customer_vault", "update_customer")
+	formData.Set("customer_vault_id", req.CustomerVaultID)
+	if req.CreditCard != "" {
+		formData.Set("ccnumber", req.CreditCard)
+	}
+	if req.ExpDate != "" {
+		formData.Set("ccexp", req.ExpDate)
+	}
+	addBillingInfo(formData, req.Billing)
+
+	resp, err := c.vaultRequest(ctx, "update", req.CustomerVaultID, formData)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.CreditCard != "" {
+		saveVaultCard(req.CustomerVaultID, VaultCard{MaskedCard: pci.MaskPAN(req.CreditCard), ExpiryDate: req.ExpDate})
+	} else if req.ExpDate != "" {
+		vaultCards.Lock()
+		if card, ok := vaultCards.data[req.CustomerVaultID]; ok {
+			card.ExpiryDate = req.ExpDate
+			vaultCards.data[req.CustomerVaultID] = card
+		}
+		vaultCards.Unlock()
+	}
+	return resp, nil
+}
+
+// DeleteVaultCustomer removes a vault record. Subscriptions billed to it
+// stop being able to charge.
+func (c *Client) DeleteVaultCustomer(ctx context.Context, apiKey, vaultID string) (*VaultResponse, error) {
+	if vaultID == "" {
+		metrics.RecordVaultOperation("delete", "validation_error")
+		return nil, NewNMIError(ErrInvalidRequest, "customer_vault_id is required", "")
+	}
+
+	formData := url.Values{}
+	formData.Set("security_key", apiKey)
+	formData.Set("customer_vault", "delete_customer")
+	formData.Set("customer_vault_id", vaultID)
+
+	resp, err := c.vaultRequest(ctx, "delete", vaultID, formData)
+	if err != nil {
+		return nil, err
+	}
+	forgetVaultCard(vaultID)
+	return resp, nil
+}
+
+// vaultRequest sends a customer vault change and records its outcome
+func (c *Client) vaultRequest(ctx context.Context, operation, vaultID string, formData url.Values) (*VaultResponse, error) {
+	resp, err := c.sendRequest(ctx, formData)
+	if err != nil {
+		metrics.RecordVaultOperation(operation, "error")
+		return nil, err
+	}
+
+	parsedResp, err := ParseNMIResponse(resp)
+	if err != nil {
+		metrics.RecordVaultOperation(operation, "rejected")
+		return nil, err
+	}
+	metrics.RecordVaultOperation(operation, "success")
+
+	return &VaultResponse{
+		CustomerVaultID: vaultID,
+		Success:         true,
+		Message:         parsedResp.ResponseText,
+		ResponseCode:    parsedResp.ResponseCode,
+	}, nil
+}
+
+// validateVaultUpdate checks that an update changes something valid
+func validateVaultUpdate(req VaultUpdateRequest) error {
+	if req.CustomerVaultID == "" {
+		return NewNMIError(ErrInvalidRequest, "customer_vault_id is required", "")
+	}
+	if req.CreditCard == "" && req.ExpDate == "" && req.Billing == nil {
+		return NewNMIError(ErrInvalidRequest, "nothing to update: send credit_card and exp_date, exp_date, or billing", "")
+	}
+	if req.CreditCard != "" {
+		if req.ExpDate == "" {
+			return NewNMIError(ErrInvalidRequest, "exp_date is required with a new credit_card", "")
+		}
+		if err := ValidateCardNumber(req.CreditCard); err != nil {
+			return err
+		}
+	}
+	if req.ExpDate != "" {
+		if err := validateExpirationDate(req.ExpDate); err != nil {
+			return err
+		}
+	}
+	if req.Billing != nil {
+		return validateBillingInfo(req.Billing)
+	}
+	return nil
+}
+
+// ensureMasked passes through a number the gateway already masked, showing
+// at most the first six and last four digits, and masks anything else
+func ensureMasked(number string) string {
+	digits := 0
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	if digits <= 4 || (digits <= 10 && strings.ContainsAny(number, "xX*")) {
+		return number
+	}
+	return pci.MaskPAN(number)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const vaultCustomerFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<nm_response>
+	<customer_vault>
+		<customer id="5508470413134828416">
+			<first_name>John</first_name>
+			<last_name>Doe</last_name>
+			<address_1>123 Test St</address_1>
+			<city>TestCity</city>
+			<state>TX</state>
+			<postal_code>12345</postal_code>
+			<country>US</country>
+			<email>test@example.com</email>
+			<cc_number>4xxxxxxxxxxx1111</cc_number>
+			<cc_exp>1230</cc_exp>
+			<cc_type>visa</cc_type>
+			<customer_vault_id>5508470413134828416</customer_vault_id>
+			<created>20261001120000</created>
+			<updated>20261015093000</updated>
+		</customer>
+	</customer_vault>
+</nm_response>`
+
+func vaultGateway(t *testing.T, body string) (*Client, *url.Values) {
+	t.Helper()
+	form := &url.Values{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		*form = r.PostForm
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(gateway.Close)
+	return NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL}), form
+}
+
+func TestGetVaultCustomer(t *testing.T) {
+	client, form := vaultGateway(t, vaultCustomerFixture)
+
+	customer, err := client.GetVaultCustomer(context.Background(), "key", "5508470413134828416")
+	require.NoError(t, err)
+
+	assert.Equal(t, "customer_vault", form.Get("report_type"))
+	assert.Equal(t, "5508470413134828416", form.Get("customer_vault_id"))
+	assert.Equal(t, "5508470413134828416", customer.CustomerVaultID)
+	assert.Equal(t, "Doe", customer.Billing.LastName)
+	assert.Equal(t, "123 Test St", customer.Billing.Address1)
+	assert.Equal(t, "12345", customer.Billing.Zip)
+	assert.Equal(t, "4xxxxxxxxxxx1111", customer.MaskedCard)
+	assert.Equal(t, "visa", customer.CardType)
+	assert.Equal(t, time.Date(2026, 10, 15, 9, 30, 0, 0, time.UTC), customer.Updated)
+}
+
+func TestGetVaultCustomerNotFound(t *testing.T) {
+	client, _ := vaultGateway(t, `<nm_response><customer_vault></customer_vault></nm_response>`)
+	before := testutil.ToFloat64(metrics.VaultOperations.WithLabelValues("get", "not_found"))
+
+	_, err := client.GetVaultCustomer(context.Background(), "key", "missing")
+	var nmiErr *NMIError
+	require.True(t, errors.As(err, &nmiErr))
+	assert.Equal(t, ErrVaultCustomerNotFound, nmiErr.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.VaultOperations.WithLabelValues("get", "not_found")))
+}
+
+func TestUpdateVaultCustomer(t *testing.T) {
+	client, form := vaultGateway(t, "response=1&responsetext=Customer Update Successful&response_code=100&customer_vault_id=12345678")
+	before := testutil.ToFloat64(metrics.VaultOperations.WithLabelValues("update", "success"))
+
+	resp, err := client.UpdateVaultCustomer(context.Background(), VaultUpdateRequest{
+		APIKey: "key", CustomerVaultID: "12345678", CreditCard: "4111111111111111", ExpDate: "1230",
+	})
+	require.NoError(t, err)
+
+	assert.True(t, resp.Success)
+	assert.Equal(t, "update_customer", form.Get("customer_vault"))
+	assert.Equal(t, "12345678", form.Get("customer_vault_id"))
+	assert.Equal(t, "4111111111111111", form.Get("ccnumber"))
+	assert.False(t, form.Has("type"))
+	assert.False(t, form.Has("first_name"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.VaultOperations.WithLabelValues("update", "success")))
+
+	card, ok := lookupVaultCard("12345678", "")
+	require.True(t, ok)
+	assert.Equal(t, "************1111", card.MaskedCard)
+
+	// A reissued card only needs the new expiry
+	_, err = client.UpdateVaultCustomer(context.Background(), VaultUpdateRequest{APIKey: "key", CustomerVaultID: "12345678", ExpDate: "1231"})
+	require.NoError(t, err)
+	assert.False(t, form.Has("ccnumber"))
+	card, _ = lookupVaultCard("12345678", "")
+	assert.Equal(t, "1231", card.ExpiryDate)
+}
+
+func TestValidateVaultUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     VaultUpdateRequest
+		wantErr string
+	}{
+		{"Nothing To Update", VaultUpdateRequest{CustomerVaultID: "12345678"}, "nothing to update"},
+		{"Card Without Expiry", VaultUpdateRequest{CustomerVaultID: "12345678", CreditCard: "4111111111111111"}, "exp_date is required"},
+		{"Incomplete Billing", VaultUpdateRequest{CustomerVaultID: "12345678", Billing: &BillingInfo{FirstName: "John"}}, "first_name and last_name"},
+		{"Missing ID", VaultUpdateRequest{ExpDate: "1230"}, "customer_vault_id is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVaultUpdate(tt.req)
+			var nmiErr *NMIError
+			require.True(t, errors.As(err, &nmiErr))
+			assert.Contains(t, nmiErr.Message, tt.wantErr)
+		})
+	}
+}
+
+func TestDeleteVaultCustomer(t *testing.T) {
+	client, form := vaultGateway(t, "response=1&responsetext=Customer Deleted&response_code=100")
+	saveVaultCard("87654321", VaultCard{MaskedCard: "************4242"})
+
+	resp, err := client.DeleteVaultCustomer(context.Background(), "key", "87654321")
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, "delete_customer", form.Get("customer_vault"))
+	assert.Equal(t, "87654321", form.Get("customer_vault_id"))
+
+	_, ok := lookupVaultCard("87654321", "")
+	assert.False(t, ok)
+}
+
+func TestDeleteVaultCustomerRejected(t *testing.T) {
+	client, _ := vaultGateway(t, "response=3&responsetext=Invalid Customer Vault Id REFID:1&response_code=300")
+	before := testutil.ToFloat64(metrics.VaultOperations.WithLabelValues("delete", "rejected"))
+
+	_, err := client.DeleteVaultCustomer(context.Background(), "key", "87654321")
+	assert.Error(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.VaultOperations.WithLabelValues("delete", "rejected")))
+}
+
+func TestListVaultCustomers(t *testing.T) {
+	client, form := vaultGateway(t, `<nm_response><customer_vault>
+		<customer id="1">
+			<customer_vault_id>1</customer_vault_id>
+			<first_name>Ann</first_name>
+			<cc_number>411111xxxxxx1111</cc_number>
+			<check_account>123456789012</check_account>
+			<merchant_defined_field_1>crm-42</merchant_defined_field_1>
+			<merchant_defined_field_2></merchant_defined_field_2>
+		</customer>
+		<customer id="2">
+			<customer_vault_id>2</customer_vault_id>
+			<cc_number>4111111111111111</cc_number>
+		</customer>
+	</customer_vault></nm_response>`)
+
+	customers, err := client.ListVaultCustomers(context.Background(), "key", 3, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "customer_vault", form.Get("report_type"))
+	assert.Empty(t, form.Get("customer_vault_id"))
+	assert.Equal(t, "3", form.Get("page_number"))
+	assert.Equal(t, "1000", form.Get("result_limit"))
+
+	require.Len(t, customers, 2)
+	assert.Equal(t, "Ann", customers[0].Billing.FirstName)
+	assert.Equal(t, "411111xxxxxx1111", customers[0].MaskedCard)
+	assert.Equal(t, map[string]string{"1": "crm-42"}, customers[0].Metadata)
+	// Full numbers are masked even if the gateway were to return them
+	assert.Equal(t, "********9012", customers[0].MaskedAccount)
+	assert.Equal(t, "************1111", customers[1].MaskedCard)
+}
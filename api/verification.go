@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Verification policy decisions
+const (
+	VerificationPassed     = "passed"
+	VerificationVoided     = "voided"
+	VerificationFlagged    = "flagged"
+	VerificationVoidFailed = "void_failed"
+)
+
+// VerificationDecision is what the merchant's AVS/CVV policy made of an
+// approved payment
+type VerificationDecision struct {
+	Decision string `json:"decision"`
+	// Rule and Reason name the violated rule and the result it rejected
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// VoidTransactionID is the gateway's ID for the void
+	VoidTransactionID string `json:"void_transaction_id,omitempty"`
+}
+
+// verificationViolation returns the first rule of policy the AVS and CVV
+// results violate at amount, and why
+func verificationViolation(policy config.VerificationPolicy, amount Amount, avs, cvv string) (config.VerificationRule, string, bool) {
+	for _, rule := range policy.Rules {
+		if rule.AmountOver != "" && amount.Minor() <= Amount(rule.AmountOver).Minor() {
+			continue
+		}
+		switch {
+		case avs != "" && containsCode(rule.AVS, avs):
+			return rule, fmt.Sprintf("AVS result %s", avs), true
+		case cvv != "" && containsCode(rule.CVV, cvv):
+			return rule, fmt.Sprintf("CVV result %s", cvv), true
+		case rule.RequireCVVMatch && cvv != CVVMatch:
+			if cvv == "" {
+				return rule, "no CVV result", true
+			}
+			return rule, fmt.Sprintf("CVV result %s", cvv), true
+		}
+	}
+	return config.VerificationRule{}, "", false
+}
+
+func containsCode(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceVerification checks an approved sale or authorization against the
+// AVS/CVV policy of the merchant on ctx, voiding it on a violation unless
+// the policy only reports. A voided payment is answered as a decline, so
+// clients that only read response do not fulfil it; raw_response keeps the
+// approval. A failed void leaves the payment approved.
+func (c *Client) enforceVerification(ctx context.Context, req PaymentRequest, amount Amount, resp *PaymentResponse) {
+	merchant, ok := MerchantFromContext(ctx)
+	policy := merchant.Verification
+	if !ok || !policy.Enabled() || (req.Type != "sale" && req.Type != "auth") {
+		return
+	}
+
+	rule, reason, violated := verificationViolation(policy, amount, resp.AVSResponse, resp.CVVResponse)
+	if !violated {
+		resp.Verification = &VerificationDecision{Decision: VerificationPassed}
+		metrics.RecordVerificationDecision(logctx.Merchant(ctx), VerificationPassed, "")
+		return
+	}
+
+	decision := &VerificationDecision{Decision: VerificationFlagged, Rule: rule.Name, Reason: reason}
+	if !policy.ReportOnly {
+		void, err := c.VoidTransaction(ctx, VoidRequest{APIKey: req.APIKey, TransactionID: resp.TransactionID})
+		if err != nil {
+			decision.Decision = VerificationVoidFailed
+			metrics.LogError(ctx, fmt.Errorf("failed to void transaction %s for verification rule %q: %v", resp.TransactionID, rule.Name, err))
+		} else {
+			decision.Decision = VerificationVoided
+			decision.VoidTransactionID = void.TransactionID
+			resp.Response = "2"
+			resp.ResponseText = "Voided by verification policy: " + reason
+		}
+	}
+	resp.Verification = decision
+
+	logctx.From(ctx).WithFields(logrus.Fields{
+		"transaction_id": resp.TransactionID,
+		"decision":       decision.Decision,
+		"rule":           rule.Name,
+		"reason":         reason,
+	}).Warn("Verification policy violated")
+	metrics.RecordVerificationDecision(logctx.Merchant(ctx), decision.Decision, rule.Name)
+}
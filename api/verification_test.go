@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationViolation(t *testing.T) {
+	policy := config.VerificationPolicy{Rules: []config.VerificationRule{
+		{Name: "avs-no-match", AVS: []string{"N"}},
+		{Name: "cvv-over-100", RequireCVVMatch: true, AmountOver: "100.00"},
+		{Name: "cvv-no-match", CVV: []string{"N"}},
+	}}
+
+	tests := []struct {
+		name     string
+		amount   Amount
+		avs, cvv string
+		rule     string
+		reason   string
+	}{
+		{name: "Matches", amount: "250.00", avs: "Y", cvv: "M"},
+		{name: "AVS No Match", amount: "10.00", avs: "N", cvv: "M", rule: "avs-no-match", reason: "AVS result N"},
+		{name: "CVV Not Processed Over Limit", amount: "100.01", avs: "Y", cvv: "P", rule: "cvv-over-100", reason: "CVV result P"},
+		{name: "No CVV Over Limit", amount: "500.00", avs: "Y", rule: "cvv-over-100", reason: "no CVV result"},
+		{name: "CVV Not Processed At Limit", amount: "100.00", avs: "Y", cvv: "P"},
+		{name: "CVV No Match", amount: "5.00", avs: "Z", cvv: "N", rule: "cvv-no-match", reason: "CVV result N"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, reason, violated := verificationViolation(policy, tt.amount, tt.avs, tt.cvv)
+			assert.Equal(t, tt.rule != "", violated)
+			assert.Equal(t, tt.rule, rule.Name)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+func TestProcessPaymentVoidsPolicyViolations(t *testing.T) {
+	var voided []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("type") == "void" {
+			voided = append(voided, r.PostForm.Get("transactionid"))
+			w.Write([]byte("response=1&responsetext=Transaction Void Successful&transactionid=901&type=void&response_code=100"))
+			return
+		}
+		w.Write([]byte("response=1&responsetext=SUCCESS&authcode=123456&transactionid=900&avsresponse=N&cvvresponse=M&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+	req := PaymentRequest{APIKey: "key", Amount: "20.00", Type: "sale", CreditCard: "4111111111111111", ExpDate: "1230", CVV: "123"}
+	policy := config.VerificationPolicy{Rules: []config.VerificationRule{{Name: "avs-no-match", AVS: []string{"N"}}}}
+
+	resp, err := client.ProcessPayment(WithMerchant(context.Background(), config.Merchant{ID: "m1", Verification: policy}), req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"900"}, voided)
+	assert.Equal(t, "2", resp.Response)
+	assert.Equal(t, &VerificationDecision{Decision: VerificationVoided, Rule: "avs-no-match", Reason: "AVS result N", VoidTransactionID: "901"}, resp.Verification)
+	assert.Contains(t, resp.RawResponse, "response=1")
+
+	// Report-only policies flag the payment and leave it approved
+	policy.ReportOnly = true
+	resp, err = client.ProcessPayment(WithMerchant(context.Background(), config.Merchant{ID: "m1", Verification: policy}), req)
+	require.NoError(t, err)
+	assert.Len(t, voided, 1)
+	assert.Equal(t, "1", resp.Response)
+	assert.Equal(t, VerificationFlagged, resp.Verification.Decision)
+
+	// Merchants without a policy get no decision
+	resp, err = client.ProcessPayment(WithMerchant(context.Background(), config.Merchant{ID: "m2"}), req)
+	require.NoError(t, err)
+	assert.Nil(t, resp.Verification)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// Supported wallet types
+const (
+	WalletApplePay  = "apple_pay"
+	WalletGooglePay = "google_pay"
+)
+
+// walletParams names the NMI fields for each wallet: the field carrying the
+// encrypted payment token, and the flag marking card fields as a token the
+// merchant decrypted itself
+var walletParams = map[string]struct {
+	payload   string
+	decrypted string
+}{
+	WalletApplePay:  {payload: "applepay_payment_data", decrypted: "decrypted_applepay_data"},
+	WalletGooglePay: {payload: "googlepay_payment_data", decrypted: "decrypted_googlepay_data"},
+}
+
+// walletPayload returns the encrypted token for the request's wallet type.
+// Wallet SDKs hand the token over either as a JSON object or as a string of
+// JSON, so both are accepted and sent to NMI as the JSON text.
+func (req PaymentRequest) walletPayload() string {
+	raw := req.ApplePayPaymentData
+	if req.WalletType == WalletGooglePay {
+		raw = req.GooglePayToken
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return strings.TrimSpace(text)
+	}
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "null" {
+		return ""
+	}
+	return trimmed
+}
+
+// validateWallet checks a wallet payment. An encrypted token replaces the
+// card fields entirely; a token the merchant decrypted arrives as
+// credit_card and exp_date plus the cryptogram in cavv and eci. Wallets never
+// carry a CVV.
+func validateWallet(req PaymentRequest) error {
+	if _, ok := walletParams[req.WalletType]; !ok {
+		return NewNMIError(ErrInvalidRequest, "wallet_type must be apple_pay or google_pay", "")
+	}
+	if req.CustomerVaultID != "" {
+		return NewNMIError(ErrInvalidRequest, "customer_vault_id cannot be combined with a wallet payment", "")
+	}
+	if (req.WalletType == WalletApplePay && len(req.GooglePayToken) > 0) ||
+		(req.WalletType == WalletGooglePay && len(req.ApplePayPaymentData) > 0) {
+		return NewNMIError(ErrInvalidRequest, "wallet payload does not match wallet_type", "")
+	}
+
+	if req.walletPayload() != "" {
+		if req.CreditCard != "" || req.ExpDate != "" || req.CVV != "" {
+			return NewNMIError(ErrInvalidRequest, "card fields must be omitted when a wallet payload is given", "")
+		}
+		return nil
+	}
+
+	// Decrypted token
+	if req.CreditCard == "" || req.ExpDate == "" {
+		if req.WalletType == WalletApplePay {
+			return NewNMIError(ErrInvalidRequest, "apple_pay_payment_data, or a decrypted credit_card and exp_date, is required", "")
+		}
+		return NewNMIError(ErrInvalidRequest, "google_pay_token, or a decrypted credit_card and exp_date, is required", "")
+	}
+	if err := ValidateCardNumber(req.CreditCard); err != nil {
+		return err
+	}
+	if err := validateExpirationDate(req.ExpDate); err != nil {
+		return err
+	}
+	if req.WalletType == WalletApplePay && req.CAVV == "" {
+		return NewNMIError(ErrInvalidRequest, "cavv (the online payment cryptogram) is required for decrypted Apple Pay tokens", "")
+	}
+	if req.ECI != "" {
+		if _, ok := eciAuthentication[req.ECI]; !ok {
+			return NewNMIError(ErrInvalidRequest, "eci must be one of 00, 01, 02, 05, 06 or 07", "")
+		}
+	}
+	return nil
+}
+
+// addWalletInfo maps a wallet payment onto NMI's fields. The cryptogram of a
+// decrypted token is sent by addThreeDSInfo along with the ECI.
+func addWalletInfo(formData url.Values, req PaymentRequest) {
+	params := walletParams[req.WalletType]
+	if payload := req.walletPayload(); payload != "" {
+		formData.Set(params.payload, payload)
+		return
+	}
+
+	formData.Set("ccnumber", req.CreditCard)
+	formData.Set("ccexp", req.ExpDate)
+	formData.Set(params.decrypted, "1")
+}
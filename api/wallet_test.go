@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const applePayToken = `{"version":"EC_v1","data":"3+f4oOTwPa6f1UZ6tG==","signature":"MIAGCSqGSIb3DQEH","header":{"ephemeralPublicKey":"MFkwEwYHKoZIzj0CAQ==","publicKeyHash":"LbsUwAT6w1JV9tFXocU813TCHks=","transactionId":"d3b28af9"}}`
+
+func TestValidateWalletPayments(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     PaymentRequest
+		wantErr string
+	}{
+		{
+			name: "Encrypted Apple Pay",
+			req:  PaymentRequest{WalletType: WalletApplePay, ApplePayPaymentData: json.RawMessage(applePayToken)},
+		},
+		{
+			name: "Encrypted Google Pay As String",
+			req:  PaymentRequest{WalletType: WalletGooglePay, GooglePayToken: json.RawMessage(`"{\"signature\":\"MEQCIF\",\"protocolVersion\":\"ECv2\"}"`)},
+		},
+		{
+			name: "Decrypted Apple Pay",
+			req:  PaymentRequest{WalletType: WalletApplePay, CreditCard: "4111111111111111", ExpDate: "1230", CAVV: "AgAAAAAABk4DWZ4C28yUQAAAAAA=", ECI: "05"},
+		},
+		{
+			name: "Decrypted Google Pay Without Cryptogram",
+			req:  PaymentRequest{WalletType: WalletGooglePay, CreditCard: "4111111111111111", ExpDate: "1230"},
+		},
+		{
+			name:    "Unknown Wallet",
+			req:     PaymentRequest{WalletType: "samsung_pay"},
+			wantErr: "wallet_type must be",
+		},
+		{
+			name:    "Payload With Card Fields",
+			req:     PaymentRequest{WalletType: WalletApplePay, ApplePayPaymentData: json.RawMessage(applePayToken), CreditCard: "4111111111111111"},
+			wantErr: "card fields must be omitted",
+		},
+		{
+			name:    "Mismatched Payload",
+			req:     PaymentRequest{WalletType: WalletGooglePay, ApplePayPaymentData: json.RawMessage(applePayToken)},
+			wantErr: "does not match wallet_type",
+		},
+		{
+			name:    "Missing Payload",
+			req:     PaymentRequest{WalletType: WalletApplePay},
+			wantErr: "apple_pay_payment_data",
+		},
+		{
+			name:    "Decrypted Apple Pay Without Cryptogram",
+			req:     PaymentRequest{WalletType: WalletApplePay, CreditCard: "4111111111111111", ExpDate: "1230"},
+			wantErr: "cavv",
+		},
+		{
+			name:    "With Vault",
+			req:     PaymentRequest{WalletType: WalletApplePay, ApplePayPaymentData: json.RawMessage(applePayToken), CustomerVaultID: "123456789"},
+			wantErr: "customer_vault_id cannot be combined",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Amount = "10.00"
+			tt.req.Type = "sale"
+			err := ValidatePaymentRequest(tt.req)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var nmiErr *NMIError
+			require.True(t, errors.As(err, &nmiErr))
+			assert.Contains(t, nmiErr.Message, tt.wantErr)
+		})
+	}
+}
+
+func TestProcessPaymentMapsWalletFields(t *testing.T) {
+	var form url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=777&type=sale&response_code=100"))
+	}))
+	defer gateway.Close()
+	client := NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	_, err := client.ProcessPayment(context.Background(), PaymentRequest{
+		Amount: "10.00", Type: "sale", WalletType: WalletApplePay, ApplePayPaymentData: json.RawMessage(applePayToken),
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, applePayToken, form.Get("applepay_payment_data"))
+	assert.False(t, form.Has("ccnumber"))
+	assert.False(t, form.Has("cvv"))
+
+	_, err = client.ProcessPayment(context.Background(), PaymentRequest{
+		Amount: "10.00", Type: "sale", WalletType: WalletGooglePay, CreditCard: "4111111111111111", ExpDate: "1230",
+		CAVV: "AgAAAAAABk4DWZ4C28yUQAAAAAA=", ECI: "05",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "4111111111111111", form.Get("ccnumber"))
+	assert.Equal(t, "1", form.Get("decrypted_googlepay_data"))
+	assert.Equal(t, "AgAAAAAABk4DWZ4C28yUQAAAAAA=", form.Get("cavv"))
+	assert.Equal(t, "05", form.Get("eci"))
+	assert.False(t, form.Has("googlepay_payment_data"))
+}
@@ -0,0 +1,187 @@
+// Package bins identifies cards by their bank identification number (BIN),
+// the leading digits of the card number, using a table kept on local disk.
+package bins
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Card levels
+const (
+	LevelCredit  = "credit"
+	LevelDebit   = "debit"
+	LevelPrepaid = "prepaid"
+)
+
+// Lengths of the prefixes a table may list. Card brands moved from six to
+// eight digit BINs, so tables mix both.
+const (
+	MinPrefix = 6
+	MaxPrefix = 8
+)
+
+// Card is what the table knows about a BIN. Fields the table leaves empty
+// are unknown.
+type Card struct {
+	// BIN is the first six digits of the card number
+	BIN     string `json:"bin"`
+	Brand   string `json:"brand,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Country string `json:"country,omitempty"`
+	Issuer  string `json:"issuer,omitempty"`
+}
+
+// Table looks BINs up in a CSV file of bin,brand,level,country,issuer rows,
+// with an optional header row and # comments. Refresh rereads the file.
+type Table struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]Card
+	version string
+}
+
+// Open reads the table at path
+func Open(path string) (*Table, error) {
+	t := &Table{path: path}
+	if _, err := t.Refresh(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Len returns the number of BINs in the table
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.entries)
+}
+
+// Lookup returns the longest listed prefix of number. Separators in number
+// are ignored.
+func (t *Table) Lookup(number string) (Card, bool) {
+	digits := Digits(number)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for n := MaxPrefix; n >= MinPrefix; n-- {
+		if len(digits) < n {
+			continue
+		}
+		if card, ok := t.entries[digits[:n]]; ok {
+			card.BIN = digits[:MinPrefix]
+			return card, true
+		}
+	}
+	return Card{}, false
+}
+
+// Refresh rereads the file if its size or modification time changed,
+// reporting whether it did. A file that fails to parse leaves the table as
+// it was.
+func (t *Table) Refresh() (bool, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false, err
+	}
+	version := fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+	t.mu.RLock()
+	unchanged := version == t.version
+	t.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	entries, err := parse(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", t.path, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries, t.version = entries, version
+	return true, nil
+}
+
+// Watch refreshes the table every interval until ctx is done, passing each
+// check's outcome to onRefresh
+func (t *Table) Watch(ctx context.Context, interval time.Duration, onRefresh func(changed bool, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		onRefresh(t.Refresh())
+	}
+}
+
+// Digits returns the digits of a card number
+func Digits(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+}
+
+// parse reads table rows, checking each so a bad export is refused whole
+func parse(r io.Reader) (map[string]Card, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	entries := make(map[string]Card)
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if line == 1 && strings.EqualFold(row[0], "bin") {
+			continue
+		}
+
+		field := func(i int) string {
+			if i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		bin := field(0)
+		card := Card{
+			Brand:   strings.ToLower(field(1)),
+			Level:   strings.ToLower(field(2)),
+			Country: strings.ToUpper(field(3)),
+			Issuer:  field(4),
+		}
+		switch {
+		case len(bin) < MinPrefix || len(bin) > MaxPrefix || Digits(bin) != bin:
+			return nil, fmt.Errorf("line %d: bin %q is not %d to %d digits", line, bin, MinPrefix, MaxPrefix)
+		case card.Level != "" && card.Level != LevelCredit && card.Level != LevelDebit && card.Level != LevelPrepaid:
+			return nil, fmt.Errorf("line %d: level %q is not credit, debit or prepaid", line, card.Level)
+		case card.Country != "" && len(card.Country) != 2:
+			return nil, fmt.Errorf("line %d: country %q is not a two-letter code", line, card.Country)
+		}
+		entries[bin] = card
+	}
+}
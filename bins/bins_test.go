@@ -0,0 +1,85 @@
+package bins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const table = `bin,brand,level,country,issuer
+# Test cards
+411111,visa,credit,US,Test Bank
+41111122,visa,prepaid,us,Gift Cards Inc
+555555,mastercard,debit,GB,
+`
+
+func writeTable(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bins.csv")
+	writeTable(t, path, table)
+	bins, err := Open(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, bins.Len())
+
+	card, ok := bins.Lookup("4111 1111 1111 1111")
+	require.True(t, ok)
+	assert.Equal(t, Card{BIN: "411111", Brand: "visa", Level: LevelCredit, Country: "US", Issuer: "Test Bank"}, card)
+
+	card, ok = bins.Lookup("4111112233334444")
+	require.True(t, ok, "the eight digit prefix wins")
+	assert.Equal(t, Card{BIN: "411111", Brand: "visa", Level: LevelPrepaid, Country: "US", Issuer: "Gift Cards Inc"}, card)
+
+	_, ok = bins.Lookup("4242424242424242")
+	assert.False(t, ok)
+	_, ok = bins.Lookup("41111")
+	assert.False(t, ok)
+}
+
+func TestRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bins.csv")
+	writeTable(t, path, table)
+	bins, err := Open(path)
+	require.NoError(t, err)
+
+	changed, err := bins.Refresh()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	writeTable(t, path, "424242,visa,debit,CA\n")
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	changed, err = bins.Refresh()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	card, ok := bins.Lookup("4242424242424242")
+	require.True(t, ok)
+	assert.Equal(t, LevelDebit, card.Level)
+
+	// A broken export keeps the table in use
+	writeTable(t, path, "424242,visa,charge,CA\n")
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	_, err = bins.Refresh()
+	assert.ErrorContains(t, err, `line 1: level "charge" is not credit, debit or prepaid`)
+	_, ok = bins.Lookup("4242424242424242")
+	assert.True(t, ok)
+}
+
+func TestOpenRejectsBadRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bins.csv")
+	for content, message := range map[string]string{
+		"4111,visa,credit,US\n":        `line 1: bin "4111" is not 6 to 8 digits`,
+		"411111,visa,credit,USA\n":     `line 1: country "USA" is not a two-letter code`,
+		"bin\n41111x,visa,credit,US\n": `line 2: bin "41111x"`,
+	} {
+		writeTable(t, path, content)
+		_, err := Open(path)
+		assert.ErrorContains(t, err, message)
+	}
+}
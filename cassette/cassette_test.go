@@ -0,0 +1,104 @@
+package cassette
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func post(t *testing.T, rt http.RoundTripper, target string, form url.Values) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return rt.RoundTrip(req)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "response=1&responsetext=SUCCESS&transactionid=42&type="+r.PostForm.Get("type")+"&response_code=100")
+	}))
+	defer gateway.Close()
+
+	path := filepath.Join(t.TempDir(), "cassettes", "sale.json")
+	sale := url.Values{
+		"security_key": {"sandbox-key-6457"},
+		"type":         {"sale"},
+		"amount":       {"10.00"},
+		"ccnumber":     {"4111111111111111"},
+		"ccexp":        {"1230"},
+		"cvv":          {"999"},
+	}
+
+	recorder, err := Open(path, ModeRecord, nil)
+	require.NoError(t, err)
+	resp, err := post(t, recorder, gateway.URL+"/api/transact.php", sale)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "transactionid=42")
+	require.NoError(t, recorder.Save())
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, secret := range []string{"4111111111111111", "sandbox-key-6457", "999", "1230"} {
+		assert.NotContains(t, string(saved), secret)
+	}
+	assert.Contains(t, string(saved), "************1111")
+
+	gateway.Close()
+	player, err := Open(path, ModeReplay, nil)
+	require.NoError(t, err)
+	resp, err = post(t, player, "https://gateway.invalid/api/transact.php", sale)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "response=1&responsetext=SUCCESS&transactionid=42&type=sale&response_code=100", string(body))
+	assert.Empty(t, player.Unplayed())
+
+	// Each interaction answers once
+	_, err = post(t, player, "https://gateway.invalid/api/transact.php", sale)
+	assert.True(t, errors.Is(err, ErrNoInteraction))
+}
+
+func TestReplayMatchesForm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "refund.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+  {
+    "request": {"method": "POST", "path": "/api/transact.php", "form": {"type": ["refund"], "transactionid": ["7"], "orderid": ["A"]}},
+    "response": {"status": 200, "body": "response=1&transactionid=8"}
+  }
+]`), 0644))
+
+	player, err := Open(path, ModeReplay, nil)
+	require.NoError(t, err)
+	_, err = post(t, player, "https://gateway.invalid/api/transact.php", url.Values{"type": {"refund"}, "transactionid": {"9"}, "orderid": {"A"}})
+	assert.ErrorContains(t, err, `type="refund"`)
+
+	player.Ignore("orderid")
+	resp, err := post(t, player, "https://gateway.invalid/api/transact.php", url.Values{"type": {"refund"}, "transactionid": {"7"}, "orderid": {"B"}})
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "response=1&transactionid=8", string(body))
+}
+
+func TestScrubBody(t *testing.T) {
+	xml := "<transaction><cc_number>4111111111111111</cc_number><cc_exp>1230</cc_exp><order_id>ORD-1</order_id></transaction>"
+	assert.Equal(t, "<transaction><cc_number>************1111</cc_number><cc_exp>****</cc_exp><order_id>ORD-1</order_id></transaction>", scrubBody(xml))
+}
+
+func TestOpenMissingCassette(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing.json"), ModeReplay, nil)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
@@ -0,0 +1,239 @@
+// Package client is a typed Go client for the payment service's REST API,
+// for services that would otherwise hand-roll HTTP calls to it. Requests and
+// responses are the api package's own types, so the two cannot drift apart.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds a single attempt when no HTTP client is given
+	DefaultTimeout = 30 * time.Second
+	// DefaultMaxRetries is how many times a retryable request is repeated
+	DefaultMaxRetries = 2
+	// DefaultRetryBackoff is the wait before the first retry; it doubles on
+	// each further attempt
+	DefaultRetryBackoff = 250 * time.Millisecond
+
+	// maxRetryWait caps the wait between attempts, including Retry-After hints
+	maxRetryWait = 10 * time.Second
+)
+
+// Client calls the payment service. It is safe for concurrent use.
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	maxRetries   int
+	retryBackoff time.Duration
+	headers      http.Header
+	// signingSecret, when set, signs each request in SignatureHeader
+	signingSecret string
+}
+
+// Option customizes a Client built by New
+type Option func(*Client)
+
+// WithHTTPClient sends requests through hc, e.g. one with custom TLS or
+// tracing transport
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries changes how often and how soon retryable requests are
+// repeated. A maxRetries of 0 disables retries.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithHeader adds a header to every request, such as the X-Form-Token a
+// browser-facing deployment requires on sales
+func WithHeader(key, value string) Option {
+	return func(c *Client) {
+		c.headers.Add(key, value)
+	}
+}
+
+// WithAPIKey authenticates every request with a key from the service's
+// AUTH_API_KEYS
+func WithAPIKey(key string) Option {
+	return WithHeader("X-API-Key", key)
+}
+
+// WithBearerToken authenticates every request with a JWT accepted by the
+// service's AUTH_JWT_SECRET
+func WithBearerToken(token string) Option {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// New returns a client for the service at baseURL, e.g.
+// "http://payments.internal:8080"
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		httpClient:   &http.Client{Timeout: DefaultTimeout},
+		maxRetries:   DefaultMaxRetries,
+		retryBackoff: DefaultRetryBackoff,
+		headers:      make(http.Header),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// call is one API request
+type call struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	header http.Header
+	// retryable marks requests that are safe to repeat: reads, and writes
+	// the service deduplicates
+	retryable bool
+}
+
+// do sends req and decodes a successful JSON answer into out, retrying
+// transport failures, throttling and gateway outages when the call allows it
+func (c *Client) do(ctx context.Context, req call, out interface{}) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return fmt.Errorf("encode %s %s request: %w", req.method, req.path, err)
+		}
+	}
+
+	wait := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, req, body, out)
+		if err == nil || !req.retryable || attempt >= c.maxRetries || !retryable(err) {
+			return err
+		}
+
+		if hint := retryAfter(err); hint > wait {
+			wait = hint
+		}
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// send makes a single attempt
+func (c *Client) send(ctx context.Context, req call, body []byte, out interface{}) error {
+	target := c.baseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, target, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range c.headers {
+		httpReq.Header[key] = values
+	}
+	for key, values := range req.header {
+		httpReq.Header[key] = values
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.signingSecret != "" {
+		httpReq.Header.Set(SignatureHeader, Signature(c.signingSecret, time.Now(), body))
+	}
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return &transportError{err: err}
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &transportError{err: err}
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return newError(resp, payload)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return errNotModified
+	}
+	if out == nil || len(bytes.TrimSpace(payload)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(payload, out); err != nil {
+		return fmt.Errorf("decode %s %s response: %w", req.method, req.path, err)
+	}
+	return nil
+}
+
+// errNotModified reports a 304 answer to a conditional request
+var errNotModified = errors.New("not modified")
+
+// transportError is a request that got no HTTP answer
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// retryable reports whether err is worth another attempt
+func retryable(err error) bool {
+	var transport *transportError
+	if errors.As(err, &transport) {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return false
+}
+
+// retryAfter returns the wait the service asked for, if any
+func retryAfter(err error) time.Duration {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return time.Duration(apiErr.RetryAfter) * time.Second
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header in seconds
+func parseRetryAfter(value string) int {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/webhooks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return New(srv.URL+"/", WithRetries(2, time.Millisecond))
+}
+
+func TestSale(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/payments/sale", r.URL.Path)
+		var req api.PaymentRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, api.Amount("10.00"), req.Amount)
+		json.NewEncoder(w).Encode(api.PaymentResponse{TransactionID: "9001", ResponseText: "SUCCESS"})
+	})
+
+	resp, err := c.Sale(context.Background(), api.PaymentRequest{Amount: "10.00", CreditCard: "4111111111111111"})
+	require.NoError(t, err)
+	assert.Equal(t, "9001", resp.TransactionID)
+}
+
+func TestStructuredError(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(api.NMIError{Code: api.ErrProcessingError, Message: "DECLINE", ResponseCode: "200", DeclineCategory: api.CategoryDoNotHonor, RequestID: "req-1"})
+	})
+
+	_, err := c.Sale(context.Background(), api.PaymentRequest{Amount: "10.00", IdempotencyKey: "k1"})
+	var apiErr *Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.True(t, apiErr.Declined())
+	assert.Equal(t, api.ErrProcessingError, apiErr.Code)
+	assert.Equal(t, "200", apiErr.ResponseCode)
+	assert.Equal(t, "req-1", apiErr.RequestID)
+	assert.True(t, apiErr.DeclineCategory.Retryable())
+	assert.EqualValues(t, 1, calls, "declines are not retried")
+}
+
+func TestPlainTextError(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-2")
+		http.Error(w, "Plan not found", http.StatusNotFound)
+	})
+
+	err := c.CancelPlan(context.Background(), "gold")
+	var apiErr *Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, "Plan not found", apiErr.Message)
+	assert.Equal(t, "req-2", apiErr.RequestID)
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(api.NMIError{Code: api.ErrNetworkError, Message: "gateway down"})
+			return
+		}
+		json.NewEncoder(w).Encode(api.LookupResponse{TransactionID: r.URL.Query().Get("transaction_id")})
+	})
+
+	// Reads are retried until the attempts run out
+	resp, err := c.Lookup(context.Background(), "9001")
+	require.NoError(t, err)
+	assert.Equal(t, "9001", resp.TransactionID)
+	assert.EqualValues(t, 3, calls)
+
+	// A sale without an idempotency key is never repeated
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Sale(context.Background(), api.PaymentRequest{Amount: "10.00"})
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, calls)
+
+	// With one it is
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Sale(context.Background(), api.PaymentRequest{Amount: "10.00", IdempotencyKey: "order-1"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, calls)
+}
+
+func TestUpdatePlanSendsVersion(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `"3"`, r.Header.Get("If-Match"))
+		json.NewEncoder(w).Encode(api.PlanResponse{Plan: api.Plan{ID: "gold", Version: 4}})
+	})
+
+	plan, err := c.UpdatePlan(context.Background(), api.Plan{ID: "gold", Amount: "20.00", Version: 3})
+	require.NoError(t, err)
+	assert.Equal(t, 4, plan.Version)
+}
+
+func TestTerminalConfigNotModified(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "7", r.URL.Query().Get("config_version"))
+		w.WriteHeader(http.StatusNotModified)
+	})
+
+	sync, err := c.TerminalConfig(context.Background(), "T1", 7)
+	assert.NoError(t, err)
+	assert.Nil(t, sync)
+}
+
+func TestRequestSigning(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, webhooks.Verify("secret", r.Header.Get(SignatureHeader), body, time.Minute))
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(api.PaymentResponse{TransactionID: "9001"})
+	}))
+	defer srv.Close()
+
+	// Retries are signed too
+	c := New(srv.URL, WithRetries(1, time.Millisecond), WithRequestSigning("secret"))
+	_, err := c.Sale(context.Background(), api.PaymentRequest{Amount: "10.00", IdempotencyKey: "k1"})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, calls)
+}
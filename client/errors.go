@@ -0,0 +1,83 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"nmi-pay-int/api"
+)
+
+// Error is a failed API call. Payment endpoints answer with the service's
+// structured NMIError, whose fields are copied here; other endpoints answer
+// with plain text, which becomes Message.
+type Error struct {
+	// StatusCode is the HTTP status of the answer
+	StatusCode int `json:"-"`
+
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+	Raw     string `json:"raw,omitempty"`
+
+	// Gateway results for declined transactions
+	ResponseCode string `json:"response_code,omitempty"`
+	AVSResponse  string `json:"avsresponse,omitempty"`
+	CVVResponse  string `json:"cvvresponse,omitempty"`
+	// DeclineReason is the service's stable name for why the gateway
+	// refused the transaction; branch on it rather than on Message
+	DeclineReason api.DeclineReason `json:"decline_reason,omitempty"`
+	// DeclineCategory groups the refusal by what to do about it; its
+	// Retryable method says whether the same card may be tried again later
+	DeclineCategory api.DeclineCategory `json:"decline_category,omitempty"`
+
+	// RetryAfter is the number of seconds to wait before retrying, from the
+	// error body or the Retry-After header
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// RequestID is the service's ID for the failed request, from the error
+	// body or the X-Request-ID header; quote it when reporting a problem
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("payment service: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("payment service: %d: %s", e.StatusCode, e.Message)
+}
+
+// Declined reports whether the gateway declined the transaction, as opposed
+// to the request being invalid or the service failing
+func (e *Error) Declined() bool {
+	return e.StatusCode == http.StatusPaymentRequired
+}
+
+// Temporary reports whether the same request may succeed later: the service
+// or gateway was throttling, unavailable or timed out
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newError builds the Error for a failed response
+func newError(resp *http.Response, body []byte) *Error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if json.Unmarshal(body, apiErr) != nil || apiErr.Code == "" {
+		*apiErr = Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	if apiErr.RetryAfter == 0 {
+		apiErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return apiErr
+}
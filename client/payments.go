@@ -0,0 +1,279 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/store"
+)
+
+// Sale charges a card, vault token or wallet. It is retried only when the
+// request carries an idempotency key, so a retry cannot charge twice.
+func (c *Client) Sale(ctx context.Context, req api.PaymentRequest) (*api.PaymentResponse, error) {
+	var resp api.PaymentResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/sale", body: req, retryable: req.IdempotencyKey != ""}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Authorize places a hold for a later Capture. Like Sale, it is retried
+// only with an idempotency key.
+func (c *Client) Authorize(ctx context.Context, req api.PaymentRequest) (*api.PaymentResponse, error) {
+	var resp api.PaymentResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/authorize", body: req, retryable: req.IdempotencyKey != ""}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Capture settles an authorization, fully or partially
+func (c *Client) Capture(ctx context.Context, req api.CaptureRequest) (*api.CaptureResponse, error) {
+	var resp api.CaptureResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/capture", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Refund returns all or part of a settled transaction
+func (c *Client) Refund(ctx context.Context, req api.RefundRequest) (*api.RefundResponse, error) {
+	var resp api.RefundResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/refund", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Void cancels a transaction that has not settled
+func (c *Client) Void(ctx context.Context, req api.VoidRequest) (*api.VoidResponse, error) {
+	var resp api.VoidResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/void", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Tokenize stores a card in the customer vault
+func (c *Client) Tokenize(ctx context.Context, req api.PaymentRequest) (*api.TokenizeResponse, error) {
+	var resp api.TokenizeResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/tokenize", body: req, retryable: req.IdempotencyKey != ""}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ACH debits or credits a bank account
+func (c *Client) ACH(ctx context.Context, req api.ACHRequest) (*api.ACHResponse, error) {
+	var resp api.ACHResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/ach", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// StartSaleBatch submits a batch of sales, which the service charges in the
+// background; poll SaleBatch with the returned ID for the results.
+// Resubmitting a batch is safe, since every sale carries an idempotency key.
+func (c *Client) StartSaleBatch(ctx context.Context, req api.SaleBatchRequest) (*api.SaleBatchSummary, error) {
+	var resp api.SaleBatchSummary
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/batch", body: req, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SaleBatch fetches a sale batch's counts and per-sale results
+func (c *Client) SaleBatch(ctx context.Context, id string) (*api.SaleBatchSummary, error) {
+	var resp api.SaleBatchSummary
+	path := "/payments/batch/" + url.PathEscape(id)
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Lookup fetches a transaction by gateway ID
+func (c *Client) Lookup(ctx context.Context, transactionID string) (*api.LookupResponse, error) {
+	var resp api.LookupResponse
+	query := url.Values{"transaction_id": {transactionID}}
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/payments/lookup", query: query, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FindTransactions looks up the transactions for an order, vault customer
+// or customer ID, a page at a time. APIKey and TransactionID are ignored.
+func (c *Client) FindTransactions(ctx context.Context, lookup api.LookupRequest) (*api.LookupResults, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"order_id":          lookup.OrderID,
+		"customer_vault_id": lookup.CustomerVaultID,
+		"customer_id":       lookup.CustomerID,
+		"condition":         lookup.Condition,
+		"transaction_type":  lookup.TransactionType,
+		"action_type":       lookup.ActionType,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if lookup.Page > 0 {
+		query.Set("page", strconv.Itoa(lookup.Page))
+	}
+	if lookup.Limit > 0 {
+		query.Set("limit", strconv.Itoa(lookup.Limit))
+	}
+
+	var resp api.LookupResults
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/payments/lookup", query: query, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// WaitForTransaction blocks until the transaction reaches a final state or
+// timeout elapses, returning the last observed state either way; check
+// Final. A zero timeout uses the service default.
+func (c *Client) WaitForTransaction(ctx context.Context, transactionID string, timeout time.Duration) (*api.TransactionState, error) {
+	var resp api.TransactionState
+	var query url.Values
+	if timeout > 0 {
+		query = url.Values{"timeout": {timeout.String()}}
+	}
+	path := "/payments/" + url.PathEscape(transactionID) + "/wait"
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, query: query, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Refunds lists the refunds made against a sale and the amount still
+// refundable
+func (c *Client) Refunds(ctx context.Context, transactionID string) (*api.RefundSummary, error) {
+	var resp api.RefundSummary
+	path := "/payments/" + url.PathEscape(transactionID) + "/refunds"
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SearchResult is one page of a transaction search
+type SearchResult struct {
+	Transactions []api.TransactionRecord `json:"transactions"`
+	Page         int                     `json:"page"`
+	Limit        int                     `json:"limit"`
+	HasMore      bool                    `json:"has_more"`
+}
+
+// SearchTransactions lists transactions matching search, newest first.
+// APIKey is ignored; the service uses its own.
+func (c *Client) SearchTransactions(ctx context.Context, search api.TransactionSearch) (*SearchResult, error) {
+	query := url.Values{}
+	if !search.StartDate.IsZero() {
+		query.Set("start_date", search.StartDate.Format(time.RFC3339))
+	}
+	if !search.EndDate.IsZero() {
+		query.Set("end_date", search.EndDate.Format(time.RFC3339))
+	}
+	if len(search.Conditions) > 0 {
+		query.Set("condition", strings.Join(search.Conditions, ","))
+	}
+	if search.TransactionType != "" {
+		query.Set("transaction_type", search.TransactionType)
+	}
+	if search.ActionType != "" {
+		query.Set("action_type", search.ActionType)
+	}
+	if search.OrderID != "" {
+		query.Set("order_id", search.OrderID)
+	}
+	if search.CustomerVaultID != "" {
+		query.Set("customer_vault_id", search.CustomerVaultID)
+	}
+	if search.Page > 0 {
+		query.Set("page", strconv.Itoa(search.Page))
+	}
+	if search.Limit > 0 {
+		query.Set("limit", strconv.Itoa(search.Limit))
+	}
+
+	var resp SearchResult
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/transactions/search", query: query, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Transactions lists the transactions the service has processed, newest
+// first. Pass the returned NextCursor as filter.Cursor for the next page;
+// filter.MerchantID is ignored in favour of the caller's merchant.
+func (c *Client) Transactions(ctx context.Context, filter store.Filter) (*store.Page, error) {
+	query := url.Values{}
+	if len(filter.Types) > 0 {
+		query.Set("type", strings.Join(filter.Types, ","))
+	}
+	if len(filter.Statuses) > 0 {
+		query.Set("status", strings.Join(filter.Statuses, ","))
+	}
+	if !filter.From.IsZero() {
+		query.Set("start_date", filter.From.Format(time.RFC3339))
+	}
+	if !filter.To.IsZero() {
+		// The service treats end_date as inclusive; Filter.To is exclusive
+		query.Set("end_date", filter.To.Add(-time.Nanosecond).Format(time.RFC3339Nano))
+	}
+	if filter.MinAmount != "" {
+		query.Set("min_amount", filter.MinAmount.String())
+	}
+	if filter.MaxAmount != "" {
+		query.Set("max_amount", filter.MaxAmount.String())
+	}
+	if filter.Cursor != "" {
+		query.Set("cursor", filter.Cursor)
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	var resp store.Page
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/transactions", query: query, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetVaultCustomer fetches a customer vault record, with masked card data
+func (c *Client) GetVaultCustomer(ctx context.Context, vaultID string) (*api.VaultCustomer, error) {
+	var resp api.VaultCustomer
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/vault/customers/" + url.PathEscape(vaultID), retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateVaultCustomer changes the card or billing details of a vault record
+func (c *Client) UpdateVaultCustomer(ctx context.Context, req api.VaultUpdateRequest) (*api.VaultResponse, error) {
+	var resp api.VaultResponse
+	path := "/vault/customers/" + url.PathEscape(req.CustomerVaultID)
+	if err := c.do(ctx, call{method: http.MethodPut, path: path, body: req, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteVaultCustomer removes a vault record
+func (c *Client) DeleteVaultCustomer(ctx context.Context, vaultID string) (*api.VaultResponse, error) {
+	var resp api.VaultResponse
+	if err := c.do(ctx, call{method: http.MethodDelete, path: "/vault/customers/" + url.PathEscape(vaultID), retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
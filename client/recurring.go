@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"nmi-pay-int/api"
+)
+
+// CreateSubscription subscribes a vault customer to a plan
+func (c *Client) CreateSubscription(ctx context.Context, req api.RecurringPaymentRequest) (*api.RecurringResponse, error) {
+	var resp api.RecurringResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/payments/recurring/create", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateSubscription changes a subscription's plan, amount or billing
+func (c *Client) UpdateSubscription(ctx context.Context, subscriptionID string, req api.RecurringPaymentRequest) (*api.RecurringResponse, error) {
+	var resp api.RecurringResponse
+	path := "/payments/recurring/update/" + url.PathEscape(subscriptionID)
+	if err := c.do(ctx, call{method: http.MethodPut, path: path, body: req, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelSubscription stops a subscription's future billing
+func (c *Client) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	path := "/payments/recurring/cancel/" + url.PathEscape(subscriptionID)
+	return c.do(ctx, call{method: http.MethodDelete, path: path, retryable: true}, nil)
+}
+
+// CancelSubscriptionAtPeriodEnd lets a subscription finish its current
+// billing period and cancels it then. The returned subscription carries
+// the CancelAt time.
+func (c *Client) CancelSubscriptionAtPeriodEnd(ctx context.Context, subscriptionID string) (*api.Subscription, error) {
+	var resp api.Subscription
+	path := "/payments/recurring/cancel/" + url.PathEscape(subscriptionID) + "?cancel_at_period_end=true"
+	if err := c.do(ctx, call{method: http.MethodDelete, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SubscriptionPayments lists the payments a subscription has made
+func (c *Client) SubscriptionPayments(ctx context.Context, subscriptionID string) ([]api.SubscriptionPayment, error) {
+	var resp struct {
+		Payments []api.SubscriptionPayment `json:"payments"`
+	}
+	path := "/payments/recurring/" + url.PathEscape(subscriptionID) + "/payments"
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Payments, nil
+}
+
+// ListSubscriptions lists subscriptions; the filter's empty fields match
+// every subscription
+func (c *Client) ListSubscriptions(ctx context.Context, filter api.SubscriptionFilter) ([]api.Subscription, error) {
+	query := url.Values{}
+	if filter.CustomerVaultID != "" {
+		query.Set("customer_vault_id", filter.CustomerVaultID)
+	}
+	if filter.PlanID != "" {
+		query.Set("plan_id", filter.PlanID)
+	}
+	if filter.Status != "" {
+		query.Set("status", filter.Status)
+	}
+	path := "/payments/recurring"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var resp struct {
+		Subscriptions []api.Subscription `json:"subscriptions"`
+	}
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Subscriptions, nil
+}
+
+// Subscription returns one subscription
+func (c *Client) Subscription(ctx context.Context, subscriptionID string) (*api.Subscription, error) {
+	var resp api.Subscription
+	path := "/payments/recurring/" + url.PathEscape(subscriptionID)
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AddPlan creates a plan. ID, Name and Amount are required; the stored plan
+// is returned with its version.
+func (c *Client) AddPlan(ctx context.Context, plan api.Plan) (*api.Plan, error) {
+	var req api.AddPlanRequest
+	req.EventType = "recurring.plan.add"
+	req.EventBody.Plan = plan
+
+	var resp api.PlanResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/plans/add", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Plan, nil
+}
+
+// UpdatePlan changes a plan's name or amount. plan.Version must be the
+// version last read; a plan changed since fails with a 409 Error.
+func (c *Client) UpdatePlan(ctx context.Context, plan api.Plan) (*api.Plan, error) {
+	header := http.Header{"If-Match": {strconv.Quote(strconv.Itoa(plan.Version))}}
+
+	var resp api.PlanResponse
+	if err := c.do(ctx, call{method: http.MethodPut, path: "/plans/update", body: plan, header: header}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Plan, nil
+}
+
+// CancelPlan deletes a plan
+func (c *Client) CancelPlan(ctx context.Context, planID string) error {
+	return c.do(ctx, call{method: http.MethodDelete, path: "/plans/cancel/" + url.PathEscape(planID)}, nil)
+}
+
+// ReconcilePlans makes the gateway's plans match the service's. A dry run
+// reports the changes without making them.
+func (c *Client) ReconcilePlans(ctx context.Context, dryRun bool) (*api.PlanReconciliation, error) {
+	var resp api.PlanReconciliation
+	path := "/plans/reconcile?dry_run=" + strconv.FormatBool(dryRun)
+	if err := c.do(ctx, call{method: http.MethodPost, path: path, retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListPlans returns every plan, keyed by plan ID
+func (c *Client) ListPlans(ctx context.Context) (map[string]api.Plan, error) {
+	var resp map[string]api.Plan
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/plans/list", retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
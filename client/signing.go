@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/webhooks"
+)
+
+// SignatureHeader is the header the service reads request signatures from
+const SignatureHeader = "X-Signature"
+
+// WithRequestSigning signs every request with a secret from the service's
+// REQUEST_SIGNING_SECRETS. Each attempt, retries included, is signed with
+// the current time.
+func WithRequestSigning(secret string) Option {
+	return func(c *Client) {
+		c.signingSecret = secret
+	}
+}
+
+// Signature returns the SignatureHeader value for body sent at the given
+// time, for callers building requests without a Client
+func Signature(secret string, at time.Time, body []byte) string {
+	return webhooks.SignatureHeaderValue(secret, at, body)
+}
+
+// SignRequest sets the SignatureHeader on req, reading and restoring its
+// body. Sign just before sending; the service rejects old signatures.
+func SignRequest(req *http.Request, secret string) error {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	req.Header.Set(SignatureHeader, Signature(secret, time.Now(), body))
+	return nil
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/terminal"
+)
+
+// TerminalInitResponse is the gateway's answer to a terminal init plus,
+// for terminals mapped to a merchant, the device's configuration
+type TerminalInitResponse struct {
+	api.TerminalResponse
+	Device *terminal.DeviceSync `json:"device,omitempty"`
+}
+
+// InitTerminal registers a terminal. Send the config version the device
+// last applied to receive the current configuration when it is stale.
+func (c *Client) InitTerminal(ctx context.Context, req api.TerminalInitRequest) (*TerminalInitResponse, error) {
+	var resp TerminalInitResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/terminal/init", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TerminalPayment sends a card-present payment to a terminal. It returns
+// without waiting for the cardholder, usually with a pending session to
+// follow with TerminalPaymentSession.
+func (c *Client) TerminalPayment(ctx context.Context, req api.TerminalPaymentRequest) (*terminal.PaymentSession, error) {
+	var resp terminal.PaymentSession
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/terminal/payment", body: req}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TerminalPaymentSession reports the progress of a payment sent to a
+// terminal, by the session ID TerminalPayment returned
+func (c *Client) TerminalPaymentSession(ctx context.Context, sessionID string) (*terminal.PaymentSession, error) {
+	var resp terminal.PaymentSession
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/terminal/payment/" + url.PathEscape(sessionID), retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TerminalStatus reports whether a terminal is connected
+func (c *Client) TerminalStatus(ctx context.Context, terminalID string) (*api.TerminalResponse, error) {
+	var resp api.TerminalResponse
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/terminal/status/" + url.PathEscape(terminalID), retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelTerminalTransaction cancels the payment prompt a terminal is showing
+func (c *Client) CancelTerminalTransaction(ctx context.Context, terminalID string) (*api.TerminalResponse, error) {
+	var resp api.TerminalResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/terminal/cancel/" + url.PathEscape(terminalID)}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListTerminals lists the terminals registered to the merchant, with their
+// last heartbeat
+func (c *Client) ListTerminals(ctx context.Context) ([]terminal.Terminal, error) {
+	var resp struct {
+		Terminals []terminal.Terminal `json:"terminals"`
+	}
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/terminal/list", retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Terminals, nil
+}
+
+// Terminal fetches one of the merchant's registered terminals
+func (c *Client) Terminal(ctx context.Context, terminalID string) (*terminal.Terminal, error) {
+	var resp terminal.Terminal
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/terminal/" + url.PathEscape(terminalID), retryable: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TerminalConfig fetches a mapped terminal's device configuration. It
+// returns nil when configVersion, the version the device last applied, is
+// still current.
+func (c *Client) TerminalConfig(ctx context.Context, terminalID string, configVersion int) (*terminal.DeviceSync, error) {
+	var resp terminal.DeviceSync
+	query := url.Values{"config_version": {strconv.Itoa(configVersion)}}
+	err := c.do(ctx, call{method: http.MethodGet, path: "/terminal/config/" + url.PathEscape(terminalID), query: query, retryable: true}, &resp)
+	if errors.Is(err, errNotModified) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,265 @@
+// Package webhooks receives the payment service's webhook deliveries. Its
+// Handler verifies each delivery's signature, decodes the event into the
+// api type the service sent, and answers so that failed deliveries are
+// redelivered and completed ones are not.
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"nmi-pay-int/api"
+	service "nmi-pay-int/webhooks"
+)
+
+// Event types, as registered with the service
+const (
+	EventPaymentSale          = service.EventPaymentSale
+	EventPaymentRefund        = service.EventPaymentRefund
+	EventPaymentVoid          = service.EventPaymentVoid
+	EventSubscriptionCreated  = service.EventSubscriptionCreated
+	EventSubscriptionUpdated  = service.EventSubscriptionUpdated
+	EventSubscriptionCanceled = service.EventSubscriptionCanceled
+	EventBatchClosed          = service.EventBatchClosed
+	EventChargebackCreated    = service.EventChargebackCreated
+)
+
+const (
+	// DefaultTolerance is how far a delivery's signature timestamp may be
+	// from now. Older deliveries are rejected as possible replays.
+	DefaultTolerance = 5 * time.Minute
+	// DefaultDedupSize is how many recently handled event IDs are
+	// remembered to acknowledge redeliveries without handling them again
+	DefaultDedupSize = 1024
+
+	// maxBodySize bounds a delivery body
+	maxBodySize = 1 << 20
+)
+
+// Event is a verified delivery. Data holds the payload decoded by type:
+//
+//	payment.sale           *api.PaymentResponse
+//	payment.refund         *api.RefundResponse
+//	payment.void           *api.VoidResponse
+//	subscription.created   *api.RecurringResponse
+//	subscription.updated   *api.RecurringResponse
+//	subscription.canceled  *SubscriptionCanceled
+//	batch.closed           *api.BatchSummary
+//	chargeback.created     *api.Chargeback
+//
+// Event types this package does not know leave Data nil; Raw always holds
+// the payload as sent.
+type Event struct {
+	ID   string
+	Type string
+	// MerchantID is the merchant account the event happened on
+	MerchantID string
+	CreatedAt  time.Time
+	Data       interface{}
+	Raw        json.RawMessage
+}
+
+// SubscriptionCanceled is the payload of subscription.canceled
+type SubscriptionCanceled struct {
+	SubscriptionID string `json:"subscription_id"`
+}
+
+// Option customizes a Handler
+type Option func(*handler)
+
+// WithTolerance changes how old a delivery may be. Zero disables the check,
+// which also disables replay protection.
+func WithTolerance(tolerance time.Duration) Option {
+	return func(h *handler) {
+		h.tolerance = tolerance
+	}
+}
+
+// WithDedupSize changes how many handled event IDs are remembered. Zero
+// hands every delivery to the callback, redeliveries included.
+func WithDedupSize(size int) Option {
+	return func(h *handler) {
+		h.dedupSize = size
+	}
+}
+
+// Handler returns an http.Handler for the URL registered as a webhook
+// endpoint. secret is the endpoint's signing secret. fn is called once per
+// verified event:
+//
+//   - fn returning nil acknowledges the event with 200
+//   - fn returning an error answers 500, and the service redelivers the
+//     event with backoff until its retries run out and it is dead-lettered
+//   - a delivery with a bad signature gets 401 and never reaches fn
+//   - a redelivery of an event fn already accepted, which happens when the
+//     acknowledgment is lost, is acknowledged again without calling fn
+//
+// Deduplication is per process and best effort, so fn should still be
+// idempotent across restarts and replicas, keyed on Event.ID.
+func Handler(secret string, fn func(Event) error, opts ...Option) http.Handler {
+	h := &handler{
+		secret:    secret,
+		fn:        fn,
+		tolerance: DefaultTolerance,
+		dedupSize: DefaultDedupSize,
+		inFlight:  make(map[string]bool),
+		done:      make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+type handler struct {
+	secret    string
+	fn        func(Event) error
+	tolerance time.Duration
+	dedupSize int
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+	// done and order hold the most recently handled event IDs, oldest first
+	done  map[string]bool
+	order []string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := service.Verify(h.secret, r.Header.Get(service.SignatureHeader), body, h.tolerance); err != nil {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event, err := decode(body)
+	if err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	switch h.claim(event.ID) {
+	case claimDone:
+		w.WriteHeader(http.StatusOK)
+		return
+	case claimBusy:
+		// The same event is being handled by an earlier delivery; have
+		// the service try again rather than run it twice at once
+		http.Error(w, "Event already in progress", http.StatusConflict)
+		return
+	}
+
+	err = h.fn(*event)
+	h.release(event.ID, err == nil)
+	if err != nil {
+		http.Error(w, "Event not processed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Claim results
+const (
+	claimNew = iota
+	claimDone
+	claimBusy
+)
+
+// claim marks an event as being handled, unless it already was or is
+func (h *handler) claim(id string) int {
+	if h.dedupSize <= 0 || id == "" {
+		return claimNew
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done[id] {
+		return claimDone
+	}
+	if h.inFlight[id] {
+		return claimBusy
+	}
+	h.inFlight[id] = true
+	return claimNew
+}
+
+// release ends handling of an event, remembering it when it succeeded
+func (h *handler) release(id string, handled bool) {
+	if h.dedupSize <= 0 || id == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.inFlight, id)
+	if !handled {
+		return
+	}
+	h.done[id] = true
+	h.order = append(h.order, id)
+	if len(h.order) > h.dedupSize {
+		delete(h.done, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// errMissingID rejects events without an ID, which cannot be deduplicated
+var errMissingID = errors.New("event has no id")
+
+// decode parses a delivery body into an Event with a typed payload
+func decode(body []byte) (*Event, error) {
+	var envelope struct {
+		ID         string          `json:"id"`
+		Type       string          `json:"type"`
+		MerchantID string          `json:"merchant_id"`
+		CreatedAt  time.Time       `json:"created_at"`
+		Data       json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.ID == "" {
+		return nil, errMissingID
+	}
+
+	event := &Event{
+		ID:         envelope.ID,
+		Type:       envelope.Type,
+		MerchantID: envelope.MerchantID,
+		CreatedAt:  envelope.CreatedAt,
+		Raw:        envelope.Data,
+	}
+	switch envelope.Type {
+	case EventPaymentSale:
+		event.Data = &api.PaymentResponse{}
+	case EventPaymentRefund:
+		event.Data = &api.RefundResponse{}
+	case EventPaymentVoid:
+		event.Data = &api.VoidResponse{}
+	case EventSubscriptionCreated, EventSubscriptionUpdated:
+		event.Data = &api.RecurringResponse{}
+	case EventSubscriptionCanceled:
+		event.Data = &SubscriptionCanceled{}
+	case EventBatchClosed:
+		event.Data = &api.BatchSummary{}
+	case EventChargebackCreated:
+		event.Data = &api.Chargeback{}
+	default:
+		return event, nil
+	}
+	if err := json.Unmarshal(envelope.Data, event.Data); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
@@ -0,0 +1,119 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	service "nmi-pay-int/webhooks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deliver(t *testing.T, h http.Handler, secret string, signedAt time.Time, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/hooks", bytes.NewBufferString(body))
+	req.Header.Set(service.SignatureHeader, service.SignatureHeaderValue(secret, signedAt, []byte(body)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestHandlerFromManager(t *testing.T) {
+	var calls int32
+	received := make(chan Event, 1)
+	// The endpoint's secret is only known once it is registered
+	var h http.Handler
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	manager := service.NewManager(service.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	manager.SetHTTPClient(srv.Client())
+	endpoint, err := manager.Register("default", srv.URL, []string{service.EventPaymentSale})
+	require.NoError(t, err)
+
+	// The first attempt fails, so the service redelivers
+	h = Handler(endpoint.Secret, func(e Event) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("database unavailable")
+		}
+		received <- e
+		return nil
+	})
+	manager.Publish("default", service.EventPaymentSale, api.PaymentResponse{TransactionID: "9001", ResponseText: "SUCCESS"})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, EventPaymentSale, event.Type)
+		assert.NotEmpty(t, event.ID)
+		payment, ok := event.Data.(*api.PaymentResponse)
+		require.True(t, ok)
+		assert.Equal(t, "9001", payment.TransactionID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	require.NoError(t, manager.Close(context.Background()))
+	assert.EqualValues(t, 2, calls)
+	assert.Empty(t, manager.DeadLetters("default"))
+}
+
+func TestHandlerRejectsBadSignatures(t *testing.T) {
+	var calls int32
+	h := Handler("secret", func(Event) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	body := `{"id":"evt_1","type":"payment.void","data":{"transactionid":"9001"}}`
+
+	assert.Equal(t, http.StatusUnauthorized, deliver(t, h, "other-secret", time.Now(), body))
+	assert.Equal(t, http.StatusUnauthorized, deliver(t, h, "secret", time.Now().Add(-time.Hour), body), "replayed delivery")
+
+	req := httptest.NewRequest(http.MethodPost, "/hooks", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "unsigned delivery")
+
+	assert.Zero(t, calls)
+}
+
+func TestHandlerAcknowledgesRedeliveries(t *testing.T) {
+	var calls int32
+	h := Handler("secret", func(Event) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	body := `{"id":"evt_1","type":"subscription.canceled","data":{"subscription_id":"sub_1"}}`
+
+	assert.Equal(t, http.StatusOK, deliver(t, h, "secret", time.Now(), body))
+	assert.Equal(t, http.StatusOK, deliver(t, h, "secret", time.Now(), body))
+	assert.EqualValues(t, 1, calls)
+}
+
+func TestHandlerDecodesByType(t *testing.T) {
+	var got Event
+	h := Handler("secret", func(e Event) error {
+		got = e
+		return nil
+	})
+
+	require.Equal(t, http.StatusOK, deliver(t, h, "secret", time.Now(),
+		`{"id":"evt_1","type":"subscription.canceled","data":{"subscription_id":"sub_1"}}`))
+	assert.Equal(t, &SubscriptionCanceled{SubscriptionID: "sub_1"}, got.Data)
+
+	// Unknown types still reach the callback, undecoded
+	require.Equal(t, http.StatusOK, deliver(t, h, "secret", time.Now(),
+		`{"id":"evt_2","type":"payment.chargeback","data":{"case_id":"c1"}}`))
+	assert.Nil(t, got.Data)
+	assert.JSONEq(t, `{"case_id":"c1"}`, string(got.Raw))
+
+	assert.Equal(t, http.StatusBadRequest, deliver(t, h, "secret", time.Now(), `{"type":"payment.sale"}`))
+}
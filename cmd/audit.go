@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/logctx"
+)
+
+// Page sizes of /audit
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type auditResponse struct {
+	Records []api.AuditRecord `json:"records"`
+	// NextSeq is the from_seq of the following page, 0 on the last one
+	NextSeq int64 `json:"next_seq,omitempty"`
+}
+
+// handleListAudit pages through the request's merchant's audit records in
+// sequence order, from ?from_seq= (default 1), ?limit= at a time
+func handleListAudit(client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := api.AuditQuery{MerchantID: contextMerchantID(r.Context()), FromSeq: 1, Limit: defaultAuditLimit}
+		if raw := r.URL.Query().Get("from_seq"); raw != "" {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || value < 1 {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "from_seq must be a positive integer")
+				return
+			}
+			query.FromSeq = value
+		}
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil || value < 1 || value > maxAuditLimit {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "limit must be between 1 and 1000")
+				return
+			}
+			query.Limit = value
+		}
+
+		records, err := client.AuditLog().Read(r.Context(), query)
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to read audit log")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to read audit log")
+			return
+		}
+
+		resp := auditResponse{Records: records}
+		if len(records) == query.Limit {
+			resp.NextSeq = records[len(records)-1].Seq + 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleVerifyAudit recomputes the hash chain over every merchant's
+// records and reports where it breaks, if anywhere
+func handleVerifyAudit(client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := api.VerifyAuditLog(r.Context(), client.AuditLog())
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to verify audit log")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to read audit log")
+			return
+		}
+		if !result.Valid {
+			logctx.From(r.Context()).WithField("broken_at", result.BrokenAt).Error("Audit log hash chain is broken")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditHandlers(t *testing.T) {
+	client := api.NewClient(&config.Config{})
+	for _, merchant := range []string{config.DefaultMerchantID, "other", config.DefaultMerchantID, config.DefaultMerchantID} {
+		_, err := client.AuditLog().Append(context.Background(), api.AuditRecord{MerchantID: merchant, Operation: "sale"})
+		require.NoError(t, err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/audit", handleListAudit(client)).Methods("GET")
+	r.HandleFunc("/audit/verify", handleVerifyAudit(client)).Methods("GET")
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := get("/audit?limit=2")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page auditResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Records, 2)
+	assert.Equal(t, int64(3), page.Records[1].Seq, "other merchants' records are left out")
+	assert.Equal(t, int64(4), page.NextSeq)
+
+	rec = get("/audit?from_seq=4")
+	page = auditResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Records, 1)
+	assert.Zero(t, page.NextSeq)
+
+	assert.Equal(t, http.StatusBadRequest, get("/audit?from_seq=0").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/audit?limit=5000").Code)
+
+	rec = get("/audit/verify")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result api.AuditVerification
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+	assert.True(t, result.Valid)
+	assert.Equal(t, int64(4), result.Records)
+}
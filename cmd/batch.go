@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/webhooks"
+
+	"github.com/gorilla/mux"
+)
+
+// scheduledCloseTimeout bounds a scheduled batch close, which has no
+// request timeout around it
+const scheduledCloseTimeout = 5 * time.Minute
+
+// batchCloseRequest optionally names the day to close; today by default
+type batchCloseRequest struct {
+	Date string `json:"date,omitempty"`
+}
+
+// handleBatchClose is the single end-of-day action: it closes the batch,
+// builds the day's summary and announces it with a batch.closed event
+func handleBatchClose(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req batchCloseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		day := time.Now()
+		if req.Date != "" {
+			var err error
+			if day, err = time.Parse("2006-01-02", req.Date); err != nil {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "date must be YYYY-MM-DD")
+				return
+			}
+		}
+
+		summary, err := closeBatch(r.Context(), cfg, client, hooks, day)
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+// closeBatch closes the batch for day and publishes the summary
+func closeBatch(ctx context.Context, cfg *config.Config, client *api.Client, hooks *webhooks.Manager, day time.Time) (*api.BatchSummary, error) {
+	summary, err := client.CloseBatch(ctx, merchantKey(ctx, cfg), day)
+	if err != nil {
+		return nil, err
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("BATCH CLOSED: Date=%s, Sales=%d (%s), Refunds=%d (%s), Voids=%d, Net=%s",
+		summary.Date, summary.Sales.Count, summary.Sales.Amount, summary.Refunds.Count, summary.Refunds.Amount,
+		summary.Voids.Count, summary.NetAmount))
+	hooks.Publish(contextMerchantID(ctx), webhooks.EventBatchClosed, summary)
+	return summary, nil
+}
+
+// scheduleBatchClose closes the batch every day at cfg.BatchCloseTime until
+// stop is closed
+func scheduleBatchClose(cfg *config.Config, client *api.Client, hooks *webhooks.Manager, stop <-chan struct{}) {
+	for {
+		next := nextBatchClose(time.Now(), cfg.BatchCloseTime)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(api.WithActor(context.Background(), api.ActorScheduler), scheduledCloseTimeout)
+		if _, err := closeBatch(ctx, cfg, client, hooks, next); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("scheduled batch close for %s failed: %v", next.Format("2006-01-02"), err))
+		}
+		cancel()
+	}
+}
+
+// nextBatchClose returns the first time after now that the local clock
+// reads at ("HH:MM")
+func nextBatchClose(now time.Time, at string) time.Time {
+	clock, _ := time.Parse("15:04", at)
+	next := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// handleStartSaleBatch charges a batch of sales in the background and
+// answers 202 with the job to poll. The batch is either JSON or, with a
+// text/csv body, a file of sales whose batch_id comes from the query.
+func handleStartSaleBatch(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.SaleBatchRequest
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+			sales, err := api.ParseSaleBatchCSV(r.Body)
+			if err != nil {
+				api.WriteError(w, r, err)
+				return
+			}
+			req.BatchID = r.URL.Query().Get("batch_id")
+			req.Sales = sales
+		} else if !decodeSaleBatch(w, r, &req) {
+			return
+		}
+
+		req.APIKey = merchantKey(r.Context(), cfg)
+		ctx := context.WithoutCancel(r.Context())
+		job, err := client.StartSaleBatch(ctx, req, cfg.SaleBatchWorkers, func(sale api.PaymentRequest, resp *api.PaymentResponse) {
+			LogTransaction(ctx, fmt.Sprintf("SALE: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+			SaveTransaction(ctx, resp.TransactionID, "sale", resp.ResponseText, sale.Amount.String(), sale.OrderDescription, sale.PONumber)
+			hooks.Publish(contextMerchantID(ctx), webhooks.EventPaymentSale, resp)
+		})
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.Summary())
+
+		LogTransaction(r.Context(), fmt.Sprintf("SALE BATCH STARTED: %s", job))
+	}
+}
+
+// decodeSaleBatch reads a JSON batch, reporting amounts that do not parse
+// the way a single sale does
+func decodeSaleBatch(w http.ResponseWriter, r *http.Request, req *api.SaleBatchRequest) bool {
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err == nil {
+		return true
+	}
+
+	var nmiErr *api.NMIError
+	if errors.As(err, &nmiErr) {
+		api.WriteError(w, r, nmiErr)
+	} else {
+		api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+	}
+	return false
+}
+
+// handleGetSaleBatch returns a sale batch's counts and the results so far
+func handleGetSaleBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, exists := api.GetSaleBatch(mux.Vars(r)["id"])
+		if !exists {
+			api.WriteErrorCode(w, r, api.ErrNotFound, "Sale batch not found")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.Summary())
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextBatchClose(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2026, 10, 16, hour, min, 0, 0, time.Local)
+	}
+
+	assert.Equal(t, at(23, 30), nextBatchClose(at(9, 0), "23:30"))
+	// At or past the close time, the next close is tomorrow
+	assert.Equal(t, at(23, 30).AddDate(0, 0, 1), nextBatchClose(at(23, 30), "23:30"))
+	assert.Equal(t, at(0, 15).AddDate(0, 0, 1), nextBatchClose(at(23, 45), "00:15"))
+}
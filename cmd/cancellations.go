@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/webhooks"
+)
+
+// cancellationInterval is how often subscriptions scheduled to cancel at
+// the end of their billing period are checked
+const cancellationInterval = time.Minute
+
+// scheduleCancellations cancels subscriptions whose billing period has
+// ended until stop is closed
+func scheduleCancellations(cfg *config.Config, client *api.Client, hooks *webhooks.Manager, stop <-chan struct{}) {
+	ticker := time.NewTicker(cancellationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			cancelDueSubscriptions(cfg, client, hooks, now)
+		}
+	}
+}
+
+// cancelDueSubscriptions cancels every subscription due by now on the
+// merchant account it was created on. A failed cancellation stays pending
+// and is tried again next time.
+func cancelDueSubscriptions(cfg *config.Config, client *api.Client, hooks *webhooks.Manager, now time.Time) {
+	for _, sub := range api.DueCancellations(now) {
+		merchant, ok := cfg.Merchant(sub.MerchantID)
+		if !ok {
+			metrics.LogError(context.Background(), fmt.Errorf("scheduled cancellation of subscription %s: unknown merchant %q", sub.ID, sub.MerchantID))
+			continue
+		}
+
+		ctx := api.WithActor(api.WithMerchant(context.Background(), merchant), api.ActorScheduler)
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := client.CancelRecurringPayment(ctx, merchant.APIKey, sub.ID)
+		cancel()
+		if err != nil {
+			metrics.LogError(context.Background(), fmt.Errorf("scheduled cancellation of subscription %s failed: %v", sub.ID, err))
+			continue
+		}
+
+		LogTransaction(ctx, fmt.Sprintf("CANCEL RECURRING: Subscription ID=%s, At period end=%s", sub.ID, sub.CancelAt.Format(time.RFC3339)))
+		hooks.Publish(sub.MerchantID, webhooks.EventSubscriptionCanceled, map[string]string{"subscription_id": sub.ID})
+	}
+}
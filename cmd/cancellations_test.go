@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/webhooks"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelDueSubscriptionsActsAsScheduler(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response=1&responsetext=Subscription Deleted&response_code=100"))
+	}))
+	defer gateway.Close()
+
+	now := time.Now()
+	cancelAt := now.Add(-time.Minute)
+	api.SubscriptionStore.Lock()
+	api.SubscriptionStore.Data["due-1"] = api.Subscription{ID: "due-1", MerchantID: config.DefaultMerchantID, Status: api.SubscriptionPendingCancellation, CancelAt: &cancelAt}
+	api.SubscriptionStore.Unlock()
+	defer func() {
+		api.SubscriptionStore.Lock()
+		delete(api.SubscriptionStore.Data, "due-1")
+		api.SubscriptionStore.Unlock()
+	}()
+
+	cfg := &config.Config{APIKey: "key", APIBaseURL: gateway.URL, QueryURL: gateway.URL}
+	scheduled := metrics.ActorOperations.WithLabelValues(api.ActorScheduler, "delete_subscription")
+	before := testutil.ToFloat64(scheduled)
+	cancelDueSubscriptions(cfg, api.NewClient(cfg), webhooks.NewManager(webhooks.DefaultRetryPolicy), now)
+	assert.Equal(t, before+1, testutil.ToFloat64(scheduled))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/logctx"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// cardListRequest puts a card on one of the merchant's lists, named by the
+// fingerprint a payment reported or by its number
+type cardListRequest struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	CardNumber  string `json:"card_number,omitempty"`
+	List        string `json:"list"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type cardListResponse struct {
+	Cards []api.CardListEntry `json:"cards"`
+}
+
+// handleAddCardListEntry blocks or allows a card for the request's
+// merchant. A card number is fingerprinted here and never stored.
+func handleAddCardListEntry(client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req cardListRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+		if req.List != api.CardListBlock && req.List != api.CardListAllow {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "list must be block or allow")
+			return
+		}
+		fingerprint := req.Fingerprint
+		switch {
+		case (fingerprint == "") == (req.CardNumber == ""):
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "set either fingerprint or card_number")
+			return
+		case req.CardNumber != "":
+			if err := api.ValidateCardNumber(req.CardNumber); err != nil {
+				api.WriteError(w, r, err)
+				return
+			}
+			fingerprint = client.CardFingerprint(req.CardNumber)
+		}
+
+		entry := api.CardListEntry{
+			MerchantID:  contextMerchantID(r.Context()),
+			Fingerprint: fingerprint,
+			List:        req.List,
+			Reason:      req.Reason,
+			CreatedAt:   time.Now().UTC(),
+		}
+		if err := client.CardLists().Put(r.Context(), entry); err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to store card list entry")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to store card list entry")
+			return
+		}
+
+		logctx.From(r.Context()).WithFields(logrus.Fields{
+			"fingerprint": entry.Fingerprint,
+			"list":        entry.List,
+			"audit":       true,
+		}).Info("Card list entry stored")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// handleListCardListEntries lists the request's merchant's cards, on the
+// list named by ?list= or on both
+func handleListCardListEntries(client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := r.URL.Query().Get("list")
+		if list != "" && list != api.CardListBlock && list != api.CardListAllow {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "list must be block or allow")
+			return
+		}
+
+		entries, err := client.CardLists().List(r.Context(), contextMerchantID(r.Context()), list)
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to list card list entries")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load card lists")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cardListResponse{Cards: entries})
+	}
+}
+
+// handleDeleteCardListEntry takes a card off the request's merchant's lists
+func handleDeleteCardListEntry(client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fingerprint := mux.Vars(r)["fingerprint"]
+		err := client.CardLists().Delete(r.Context(), contextMerchantID(r.Context()), fingerprint)
+		if errors.Is(err, api.ErrCardListEntryNotFound) {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		} else if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to delete card list entry")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to delete card list entry")
+			return
+		}
+
+		logctx.From(r.Context()).WithFields(logrus.Fields{
+			"fingerprint": fingerprint,
+			"audit":       true,
+		}).Info("Card list entry deleted")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/middleware"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCardListHandlers(t *testing.T) {
+	client := api.NewClient(&config.Config{CardFingerprintSalt: "0123456789abcdef"})
+	r := mux.NewRouter()
+	r.HandleFunc("/cards/lists", handleListCardListEntries(client)).Methods("GET")
+	r.HandleFunc("/cards/lists", handleAddCardListEntry(client)).Methods("POST")
+	r.HandleFunc("/cards/lists/{fingerprint}", handleDeleteCardListEntry(client)).Methods("DELETE")
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := send("POST", "/cards/lists", `{"card_number": "4111 1111 1111 1111", "list": "block", "reason": "stolen card"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var entry api.CardListEntry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entry))
+	assert.Equal(t, client.CardFingerprint("4111111111111111"), entry.Fingerprint)
+	assert.Equal(t, config.DefaultMerchantID, entry.MerchantID)
+	assert.NotContains(t, rec.Body.String(), "4111111111111111")
+
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/cards/lists", `{"card_number": "4111111111111112", "list": "block"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/cards/lists", `{"fingerprint": "abc", "list": "deny"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/cards/lists", `{"list": "allow"}`).Code)
+
+	rec = send("GET", "/cards/lists?list=block", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var listed cardListResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&listed))
+	require.Len(t, listed.Cards, 1)
+	assert.Equal(t, "stolen card", listed.Cards[0].Reason)
+
+	assert.Equal(t, http.StatusNoContent, send("DELETE", "/cards/lists/"+entry.Fingerprint, "").Code)
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/cards/lists/"+entry.Fingerprint, "").Code)
+}
+
+func TestCardListsUseCallerMerchant(t *testing.T) {
+	cfg := &config.Config{
+		CardFingerprintSalt: "0123456789abcdef",
+		Merchants:           []config.Merchant{{ID: "wholesale", APIKey: "wholesale-key", Callers: []string{"wholesale-portal"}}},
+	}
+	client := api.NewClient(cfg)
+	resolver := middleware.NewMerchantResolver(cfg)
+	send := func(handler http.HandlerFunc, method, merchant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/cards/lists", strings.NewReader(body))
+		req = req.WithContext(logctx.WithFields(context.Background(), logrus.Fields{logctx.FieldCaller: "wholesale-portal"}))
+		req.Header.Set(middleware.MerchantHeader, merchant)
+		rec := httptest.NewRecorder()
+		resolver.Middleware(handler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(handleAddCardListEntry(client), "POST", "", `{"fingerprint": "abc", "list": "block"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var entry api.CardListEntry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entry))
+	assert.Equal(t, "wholesale", entry.MerchantID)
+
+	// A bound caller cannot manage another merchant's lists
+	assert.Equal(t, http.StatusForbidden, send(handleAddCardListEntry(client), "POST", config.DefaultMerchantID, `{"fingerprint": "def", "list": "allow"}`).Code)
+	assert.Equal(t, http.StatusForbidden, send(handleListCardListEntries(client), "GET", config.DefaultMerchantID, "").Code)
+	entries, err := client.CardLists().List(context.Background(), config.DefaultMerchantID, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
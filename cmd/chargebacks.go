@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/webhooks"
+)
+
+// defaultDisputeWindow is how far back /disputes looks without a start_date
+const defaultDisputeWindow = 30 * 24 * time.Hour
+
+// handleListDisputes lists chargebacks between start_date and end_date
+// (YYYY-MM-DD or RFC 3339), by default over the last 30 days
+func handleListDisputes(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		end, err := parseSearchDate(query.Get("end_date"), true)
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "end_date must be YYYY-MM-DD or RFC 3339")
+			return
+		}
+		if end.IsZero() {
+			end = time.Now().UTC()
+		}
+		start, err := parseSearchDate(query.Get("start_date"), false)
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "start_date must be YYYY-MM-DD or RFC 3339")
+			return
+		}
+		if start.IsZero() {
+			start = end.Add(-defaultDisputeWindow)
+		}
+
+		chargebacks, err := client.GetChargebacks(r.Context(), merchantKey(r.Context(), cfg), start, end)
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"start_date":  start,
+			"end_date":    end,
+			"chargebacks": chargebacks,
+		})
+	}
+}
+
+// chargebackWatcher announces chargebacks as they appear in the gateway's
+// reports. Each poll searches from the previous one, less an overlap for
+// chargebacks NMI records late, and skips the ones already announced.
+type chargebackWatcher struct {
+	cfg    *config.Config
+	client *api.Client
+	hooks  *webhooks.Manager
+
+	mu sync.Mutex
+	// since is where each merchant's next search starts
+	since map[string]time.Time
+	// announced holds the IDs of chargebacks already published, with when
+	// they were received, until they fall out of the overlap
+	announced map[string]time.Time
+}
+
+func newChargebackWatcher(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) *chargebackWatcher {
+	return &chargebackWatcher{
+		cfg:       cfg,
+		client:    client,
+		hooks:     hooks,
+		since:     make(map[string]time.Time),
+		announced: make(map[string]time.Time),
+	}
+}
+
+// scheduleChargebackPolls polls every merchant account for new chargebacks
+// each cfg.ChargebackPollInterval until stop is closed
+func scheduleChargebackPolls(cfg *config.Config, client *api.Client, hooks *webhooks.Manager, stop <-chan struct{}) {
+	watcher := newChargebackWatcher(cfg, client, hooks)
+	ticker := time.NewTicker(cfg.ChargebackPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			watcher.poll(now)
+		}
+	}
+}
+
+// poll checks each merchant account and publishes chargeback.created for
+// every chargeback not announced before. A failed search is retried from
+// the same point next time.
+func (cw *chargebackWatcher) poll(now time.Time) {
+	merchants := cw.cfg.MerchantAccounts()
+	overlap := 2 * cw.cfg.ChargebackPollInterval
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for _, merchant := range merchants {
+		since, ok := cw.since[merchant.ID]
+		if !ok {
+			// The first search after startup covers one interval
+			since = now.Add(-cw.cfg.ChargebackPollInterval)
+		}
+
+		ctx := api.WithActor(api.WithMerchant(context.Background(), merchant), api.ActorReconciliation)
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		chargebacks, err := cw.client.GetChargebacks(ctx, merchant.APIKey, since.Add(-overlap), now)
+		cancel()
+		if err != nil {
+			metrics.LogError(context.Background(), fmt.Errorf("chargeback poll for merchant %s failed: %v", merchant.ID, err))
+			continue
+		}
+		cw.since[merchant.ID] = now
+
+		for _, chargeback := range chargebacks {
+			key := merchant.ID + "/" + chargeback.ID
+			if _, done := cw.announced[key]; done {
+				continue
+			}
+			cw.announced[key] = chargeback.ReceivedAt
+			LogTransaction(ctx, fmt.Sprintf("CHARGEBACK: Transaction ID=%s, Amount=%s, Reason=%s", chargeback.TransactionID, chargeback.Amount, chargeback.Reason))
+			cw.hooks.Publish(merchant.ID, webhooks.EventChargebackCreated, chargeback)
+		}
+	}
+
+	// Forget chargebacks too old for any search to return again
+	for key, received := range cw.announced {
+		if received.Before(now.Add(-2 * overlap)) {
+			delete(cw.announced, key)
+		}
+	}
+}
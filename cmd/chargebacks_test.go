@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/eventlog"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/middleware"
+	"nmi-pay-int/webhooks"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChargebackWatcherAnnouncesOnce(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<nm_response><transaction><transaction_id>2001</transaction_id>
+			<action><amount>15.00</amount><action_type>chargeback</action_type><date>20261016114500</date><success>1</success></action>
+			</transaction></nm_response>`))
+	}))
+	defer gateway.Close()
+
+	cfg := &config.Config{APIKey: "key", APIBaseURL: gateway.URL, QueryURL: gateway.URL, ChargebackPollInterval: 15 * time.Minute}
+	hooks := webhooks.NewManager(webhooks.DefaultRetryPolicy)
+	events := eventlog.NewMemoryLog(10)
+	hooks.RecordTo(events)
+
+	watcher := newChargebackWatcher(cfg, api.NewClient(cfg), hooks)
+	watcher.poll(now)
+	// The next poll overlaps the first and finds the same chargeback
+	watcher.poll(now.Add(cfg.ChargebackPollInterval))
+
+	recorded, err := events.Read(context.Background(), 1, 10)
+	require.NoError(t, err)
+	require.Len(t, recorded, 1)
+	assert.Equal(t, webhooks.EventChargebackCreated, recorded[0].Type)
+	assert.Contains(t, string(recorded[0].Data), `"transaction_id":"2001"`)
+}
+
+func TestListDisputesUsesCallerMerchant(t *testing.T) {
+	var keys []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.FormValue("security_key"))
+		w.Write([]byte(`<nm_response></nm_response>`))
+	}))
+	defer gateway.Close()
+
+	cfg := &config.Config{
+		APIKey: "default-key", APIBaseURL: gateway.URL, QueryURL: gateway.URL,
+		Merchants: []config.Merchant{{ID: "wholesale", APIKey: "wholesale-key", Callers: []string{"wholesale-portal"}}},
+	}
+	handler := middleware.NewMerchantResolver(cfg).Middleware(handleListDisputes(cfg, api.NewClient(cfg)))
+	disputes := func(merchant string) int {
+		req := httptest.NewRequest(http.MethodGet, "/disputes", nil)
+		req = req.WithContext(logctx.WithFields(context.Background(), logrus.Fields{logctx.FieldCaller: "wholesale-portal"}))
+		req.Header.Set(middleware.MerchantHeader, merchant)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, disputes(""))
+	assert.Equal(t, http.StatusForbidden, disputes("default"))
+	assert.Equal(t, []string{"wholesale-key"}, keys)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/bins"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// cliTimeout bounds a single command's gateway calls
+const cliTimeout = time.Minute
+
+// newRootCommand builds the command line. Without a subcommand the server
+// starts when MODE=serve, as container deployments expect.
+func newRootCommand(out io.Writer) *cobra.Command {
+	root := &cobra.Command{
+		Use:           "payment-service",
+		Short:         "NMI payment integration service and operations CLI",
+		Version:       version,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if os.Getenv("MODE") == "serve" {
+				startMicroservice()
+				return nil
+			}
+			return cmd.Help()
+		},
+	}
+	root.SetOut(out)
+	root.PersistentFlags().String("merchant", "", "merchant account from MERCHANTS_FILE to charge; the default account when omitted")
+	root.PersistentFlags().StringVar(&config.CommandLine.File, "config", "", "YAML or JSON settings file; CONFIG_FILE when omitted")
+	root.PersistentFlags().StringArrayVar(&config.CommandLine.Flags, "set", nil, "override a setting, e.g. --set RATE_LIMIT_PER_MINUTE=300; may be repeated")
+
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Run the HTTP (and, with GRPC_PORT, gRPC) API",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				startMicroservice()
+			},
+		},
+		newSaleCommand(),
+		newRefundCommand(),
+		newVoidCommand(),
+		newLookupCommand(),
+		newTokenizeCommand(),
+		&cobra.Command{
+			Use:                "plans",
+			Short:              "Export or apply the plan catalog",
+			Long:               plansUsage,
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runPlansCommand(args, cmd.OutOrStdout())
+			},
+		},
+	)
+	return root
+}
+
+// cardFlags are the flags shared by commands that take card details. Set
+// flags override the request read with --file.
+type cardFlags struct {
+	file           string
+	amount         string
+	card           string
+	exp            string
+	cvv            string
+	token          string
+	vaultID        string
+	orderID        string
+	description    string
+	idempotencyKey string
+}
+
+func (f *cardFlags) register(cmd *cobra.Command, withAmount bool) {
+	cmd.Flags().StringVarP(&f.file, "file", "f", "", `JSON request body to send ("-" for stdin)`)
+	if withAmount {
+		cmd.Flags().StringVar(&f.amount, "amount", "", "dollar amount, e.g. 10.99")
+	}
+	cmd.Flags().StringVar(&f.card, "card", "", "card number")
+	cmd.Flags().StringVar(&f.exp, "exp", "", "card expiry, MMYY")
+	cmd.Flags().StringVar(&f.cvv, "cvv", "", "card security code")
+	cmd.Flags().StringVar(&f.token, "token", "", "payment token from Collect.js")
+	cmd.Flags().StringVar(&f.vaultID, "vault-id", "", "customer vault ID to charge")
+	cmd.Flags().StringVar(&f.orderID, "order-id", "", "merchant order ID")
+	cmd.Flags().StringVar(&f.description, "description", "", "order description")
+	cmd.Flags().StringVar(&f.idempotencyKey, "idempotency-key", "", "key making a repeated run charge only once")
+}
+
+// request builds the payment request from --file and the flags
+func (f *cardFlags) request(stdin io.Reader) (api.PaymentRequest, error) {
+	var req api.PaymentRequest
+	if err := readRequestFile(f.file, stdin, &req); err != nil {
+		return req, err
+	}
+	if f.amount != "" {
+		amount, err := api.ParseAmount(f.amount)
+		if err != nil {
+			return req, err
+		}
+		req.Amount = amount
+	}
+	setIfGiven(&req.CreditCard, f.card)
+	setIfGiven(&req.ExpDate, f.exp)
+	setIfGiven(&req.CVV, f.cvv)
+	setIfGiven(&req.Token, f.token)
+	setIfGiven(&req.CustomerVaultID, f.vaultID)
+	setIfGiven(&req.OrderID, f.orderID)
+	setIfGiven(&req.OrderDescription, f.description)
+	setIfGiven(&req.IdempotencyKey, f.idempotencyKey)
+	return req, nil
+}
+
+func newSaleCommand() *cobra.Command {
+	var flags cardFlags
+	var authOnly bool
+	cmd := &cobra.Command{
+		Use:   "sale",
+		Short: "Charge a card, token or vault customer",
+		Example: `  payment-service sale --amount 10.99 --card 4111111111111111 --exp 1230 --cvv 123
+  payment-service sale -f sale.json --idempotency-key order-5521`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req, err := flags.request(cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+			if req.Type == "" {
+				req.Type = "sale"
+			}
+			if authOnly {
+				req.Type = "auth"
+			}
+
+			return runCLI(cmd, func(ctx context.Context, cfg *config.Config, client *api.Client) (interface{}, error) {
+				req.APIKey = merchantKey(ctx, cfg)
+				resp, err := client.ProcessPayment(ctx, req)
+				if err != nil {
+					return nil, err
+				}
+				LogTransaction(ctx, fmt.Sprintf("SALE: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+				SaveTransaction(ctx, resp.TransactionID, req.Type, resp.ResponseText, req.Amount.String(), req.OrderDescription, req.PONumber)
+				return resp, nil
+			})
+		},
+	}
+	flags.register(cmd, true)
+	cmd.Flags().BoolVar(&authOnly, "auth", false, "authorize only; capture later")
+	return cmd
+}
+
+func newTokenizeCommand() *cobra.Command {
+	var flags cardFlags
+	cmd := &cobra.Command{
+		Use:   "tokenize",
+		Short: "Store a card in the customer vault",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req, err := flags.request(cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+
+			return runCLI(cmd, func(ctx context.Context, cfg *config.Config, client *api.Client) (interface{}, error) {
+				req.APIKey = merchantKey(ctx, cfg)
+				resp, err := client.ProcessTokenization(ctx, req)
+				if err != nil {
+					return nil, err
+				}
+				LogTransaction(ctx, fmt.Sprintf("TOKENIZE: Customer Vault ID=%s, Response=SUCCESS", resp.CustomerVaultID))
+				return resp, nil
+			})
+		},
+	}
+	flags.register(cmd, false)
+	return cmd
+}
+
+func newRefundCommand() *cobra.Command {
+	var file, transactionID, amount string
+	cmd := &cobra.Command{
+		Use:   "refund",
+		Short: "Refund all or part of a settled transaction",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var req api.RefundRequest
+			if err := readRequestFile(file, cmd.InOrStdin(), &req); err != nil {
+				return err
+			}
+			setIfGiven(&req.TransactionID, transactionID)
+			setIfGiven(&req.Amount, amount)
+			if req.TransactionID == "" {
+				return fmt.Errorf("--transaction-id is required")
+			}
+
+			return runCLI(cmd, func(ctx context.Context, cfg *config.Config, client *api.Client) (interface{}, error) {
+				req.APIKey = merchantKey(ctx, cfg)
+				resp, err := client.ProcessRefund(ctx, req)
+				if err != nil {
+					return nil, err
+				}
+				LogTransaction(ctx, fmt.Sprintf("REFUND: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+				SaveTransaction(ctx, resp.TransactionID, "refund", resp.ResponseText, req.Amount, "", "")
+				return resp, nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", `JSON request body to send ("-" for stdin)`)
+	cmd.Flags().StringVar(&transactionID, "transaction-id", "", "transaction to refund")
+	cmd.Flags().StringVar(&amount, "amount", "", "amount to refund; the full amount when omitted")
+	return cmd
+}
+
+func newVoidCommand() *cobra.Command {
+	var file, transactionID string
+	cmd := &cobra.Command{
+		Use:   "void",
+		Short: "Void a transaction that has not settled",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var req api.VoidRequest
+			if err := readRequestFile(file, cmd.InOrStdin(), &req); err != nil {
+				return err
+			}
+			setIfGiven(&req.TransactionID, transactionID)
+			if req.TransactionID == "" {
+				return fmt.Errorf("--transaction-id is required")
+			}
+
+			return runCLI(cmd, func(ctx context.Context, cfg *config.Config, client *api.Client) (interface{}, error) {
+				req.APIKey = merchantKey(ctx, cfg)
+				resp, err := client.VoidTransaction(ctx, req)
+				if err != nil {
+					return nil, err
+				}
+				LogTransaction(ctx, fmt.Sprintf("VOID: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+				SaveTransaction(ctx, resp.TransactionID, "void", resp.ResponseText, "0.00", "", "")
+				return resp, nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", `JSON request body to send ("-" for stdin)`)
+	cmd.Flags().StringVar(&transactionID, "transaction-id", "", "transaction to void")
+	return cmd
+}
+
+func newLookupCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "lookup TRANSACTION_ID",
+		Short: "Show a transaction's state and action history",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCLI(cmd, func(ctx context.Context, cfg *config.Config, client *api.Client) (interface{}, error) {
+				return client.LookupTransaction(ctx, api.LookupRequest{APIKey: merchantKey(ctx, cfg), TransactionID: args[0]})
+			})
+		},
+	}
+}
+
+// runCLI runs one gateway operation as the CLI actor and prints its result
+// as JSON. Gateway errors are printed the same way, so scripts can read the
+// decline details, and also returned for the exit status.
+func runCLI(cmd *cobra.Command, run func(ctx context.Context, cfg *config.Config, client *api.Client) (interface{}, error)) error {
+	cfg := config.LoadConfig()
+	var opts []api.ClientOption
+	if cfg.BINTableFile != "" {
+		table, err := bins.Open(cfg.BINTableFile)
+		if err != nil {
+			return fmt.Errorf("failed to read BIN_TABLE_FILE: %v", err)
+		}
+		opts = append(opts, api.WithBINTable(table))
+	}
+	// Charges and refunds made here go in the same audit log as the server's
+	if cfg.DatabaseURL != "" {
+		persisted, err := openPersistence(cfg.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("failed to open DATABASE_URL: %v", err)
+		}
+		defer persisted.db.Close()
+		opts = append(opts, api.WithAuditLog(persisted.audit))
+	}
+	client := api.NewClient(cfg, opts...)
+
+	// Write out the transactions and push the metrics this run recorded
+	// before exiting
+	useTransactionRecorder(context.Background(), cfg)
+	defer func() {
+		if err := transactions.Flush(context.Background()); err != nil {
+			metrics.LogError(context.Background(), err)
+		}
+		if err := metrics.PushMetrics(cfg.PushGatewayURL, "nmi_payment_cli"); err != nil {
+			metrics.LogError(context.Background(), err)
+		}
+	}()
+
+	merchantID, _ := cmd.Flags().GetString("merchant")
+	merchant, ok := cfg.Merchant(merchantID)
+	if !ok {
+		return fmt.Errorf("unknown merchant %q", merchantID)
+	}
+
+	ctx, cancel := context.WithTimeout(api.WithActor(cmd.Context(), api.ActorCLI), cliTimeout)
+	defer cancel()
+	ctx = api.WithMerchant(ctx, merchant)
+	ctx = logctx.WithFields(ctx, logrus.Fields{logctx.FieldMerchant: merchant.ID})
+
+	result, err := run(ctx, cfg, client)
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	encoder.SetIndent("", "  ")
+	if nmiErr, ok := err.(*api.NMIError); ok {
+		encoder.Encode(nmiErr)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(result)
+}
+
+// readRequestFile decodes a JSON request from path, or from stdin when path
+// is "-". An empty path leaves v unchanged.
+func readRequestFile(path string, stdin io.Reader, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	r := stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("invalid request file %s: %w", path, err)
+	}
+	return nil
+}
+
+// setIfGiven overrides *field with a flag value that was set
+func setIfGiven(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nmi-pay-int/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runCLICommand runs the command line against a fake gateway answering
+// every call with gatewayResponse. It returns the output and the form the
+// gateway received.
+func runCLICommand(t *testing.T, gatewayResponse string, stdin string, args ...string) (string, url.Values, error) {
+	var received url.Values
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r.PostForm
+		w.Write([]byte(gatewayResponse))
+	}))
+	t.Cleanup(gateway.Close)
+	t.Setenv("NMI_API_KEY", "key")
+	t.Setenv("API_URL", gateway.URL)
+	t.Setenv("API_QUERY_URL", gateway.URL)
+
+	var out bytes.Buffer
+	root := newRootCommand(&out)
+	root.SetIn(strings.NewReader(stdin))
+	root.SetArgs(args)
+	err := root.Execute()
+	return out.String(), received, err
+}
+
+func TestCLISale(t *testing.T) {
+	out, form, err := runCLICommand(t, "response=1&responsetext=SUCCESS&transactionid=9001&type=sale&response_code=100", "",
+		"sale", "--amount", "10.99", "--card", "4111111111111111", "--exp", "1230", "--cvv", "123", "--order-id", "A-1")
+	require.NoError(t, err)
+
+	assert.Equal(t, "sale", form.Get("type"))
+	assert.Equal(t, "10.99", form.Get("amount"))
+	assert.Equal(t, "A-1", form.Get("orderid"))
+
+	var resp api.PaymentResponse
+	require.NoError(t, json.Unmarshal([]byte(out), &resp))
+	assert.Equal(t, "9001", resp.TransactionID)
+}
+
+func TestCLISaleFlagsOverrideFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sale.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"amount":"5.00","credit_card":"4111111111111111","exp_date":"1230","cvv":"123","order_id":"from-file"}`), 0o600))
+
+	_, form, err := runCLICommand(t, "response=1&responsetext=SUCCESS&transactionid=9001&type=auth&response_code=100", "",
+		"sale", "-f", path, "--amount", "7.25", "--auth")
+	require.NoError(t, err)
+
+	assert.Equal(t, "auth", form.Get("type"))
+	assert.Equal(t, "7.25", form.Get("amount"))
+	assert.Equal(t, "from-file", form.Get("orderid"))
+}
+
+func TestCLIVoidFromStdin(t *testing.T) {
+	_, form, err := runCLICommand(t, "response=1&responsetext=SUCCESS&transactionid=9001&type=void&response_code=100",
+		`{"transaction_id":"9001"}`, "void", "-f", "-")
+	require.NoError(t, err)
+
+	assert.Equal(t, "void", form.Get("type"))
+	assert.Equal(t, "9001", form.Get("transactionid"))
+}
+
+func TestCLIRequiresTransactionID(t *testing.T) {
+	_, form, err := runCLICommand(t, "response=1", "", "void")
+	assert.EqualError(t, err, "--transaction-id is required")
+	assert.Nil(t, form, "nothing should reach the gateway")
+}
+
+func TestCLIDeclinePrintsError(t *testing.T) {
+	out, _, err := runCLICommand(t, "response=2&responsetext=DECLINE&transactionid=9003&type=sale&response_code=200", "",
+		"sale", "--amount", "1.00", "--card", "4111111111111111", "--exp", "1230", "--cvv", "123")
+	require.Error(t, err)
+
+	var nmiErr api.NMIError
+	require.NoError(t, json.Unmarshal([]byte(out), &nmiErr))
+	assert.Equal(t, "200", nmiErr.ResponseCode)
+}
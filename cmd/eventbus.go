@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/eventbus"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/middleware"
+	"nmi-pay-int/store"
+	"nmi-pay-int/webhooks"
+)
+
+// busEventTypes maps webhook events to the lifecycle events they publish.
+// Payments are not listed: the transaction recorder publishes them, since
+// it sees declines and webhooks do not.
+var busEventTypes = map[string]string{
+	webhooks.EventSubscriptionCreated:      eventbus.EventSubscriptionCreated,
+	webhooks.EventSubscriptionUpdated:      eventbus.EventSubscriptionUpdated,
+	webhooks.EventSubscriptionCanceled:     eventbus.EventSubscriptionCancelled,
+	webhooks.EventChargebackCreated:        eventbus.EventChargebackCreated,
+	webhooks.EventBatchClosed:              eventbus.EventBatchClosed,
+	webhooks.EventTerminalPaymentCompleted: eventbus.EventTerminalPaymentDone,
+}
+
+// newEventProducer returns the producer for the configured broker, or nil
+// when none is
+func newEventProducer(cfg *config.Config) (eventbus.Producer, error) {
+	credentials := eventbus.AWSCredentials{
+		AccessKeyID:     cfg.AWS.AccessKeyID,
+		SecretAccessKey: cfg.AWS.SecretAccessKey,
+		SessionToken:    cfg.AWS.SessionToken,
+	}
+	switch {
+	case cfg.KafkaRESTURL != "":
+		return eventbus.NewKafkaProducer(cfg.KafkaRESTURL, cfg.KafkaUsername, cfg.KafkaPassword), nil
+	case cfg.SNSTopicARN != "":
+		return eventbus.NewSNSProducer(cfg.SNSTopicARN, credentials, cfg.AWS.EndpointURL)
+	case cfg.SQSQueueURL != "":
+		return eventbus.NewSQSProducer(cfg.SQSQueueURL, cfg.AWS.Region, credentials)
+	}
+	return nil, nil
+}
+
+// lifecycleBus hands lifecycle events to the live streams on hub and, when
+// a broker is configured, to publisher
+type lifecycleBus struct {
+	hub       *eventbus.Hub
+	publisher *eventbus.Publisher
+}
+
+// Publish broadcasts the event and queues it for the broker. An error
+// means the broker will not get it; the streams already have.
+func (b *lifecycleBus) Publish(ctx context.Context, event eventbus.Event) error {
+	b.hub.Broadcast(event)
+	if b.publisher == nil {
+		return nil
+	}
+	return b.publisher.Publish(ctx, event)
+}
+
+// Close stops the relay to the broker, if there is one
+func (b *lifecycleBus) Close(ctx context.Context) error {
+	if b.publisher == nil {
+		return nil
+	}
+	return b.publisher.Close(ctx)
+}
+
+// startEventBus publishes the webhook events listed in busEventTypes, under
+// the same event IDs, to hub and, when producer is set, through outbox to
+// the broker
+func startEventBus(cfg *config.Config, producer eventbus.Producer, outbox eventbus.Outbox, hooks *webhooks.Manager, hub *eventbus.Hub) *lifecycleBus {
+	bus := &lifecycleBus{hub: hub}
+	if producer != nil {
+		bus.publisher = eventbus.NewPublisher(outbox, producer, cfg.EventTopicPrefix, cfg.EventRelayInterval)
+	}
+
+	hooks.Observe(func(event webhooks.Event) {
+		eventType, ok := busEventTypes[event.Type]
+		if !ok {
+			return
+		}
+		ctx := context.Background()
+		lifecycle, err := eventbus.NewEvent(event.ID, eventType, event.MerchantID, "", event.Data)
+		if err == nil {
+			err = bus.Publish(ctx, lifecycle)
+		}
+		if err != nil {
+			metrics.LogError(ctx, fmt.Errorf("failed to queue lifecycle event %s %s: %v", eventType, event.ID, err))
+		}
+	})
+	return bus
+}
+
+// eventBusSink is a transaction recorder sink publishing each transaction
+// as a lifecycle event, keyed by transaction ID
+type eventBusSink struct {
+	bus *lifecycleBus
+}
+
+func (s eventBusSink) Name() string { return "eventbus" }
+
+func (s eventBusSink) Write(ctx context.Context, batch []store.Transaction) error {
+	var errs []error
+	for _, t := range batch {
+		event, err := eventbus.NewEvent("", eventbus.TransactionEventType(t), t.MerchantID, t.TransactionID, t)
+		if err == nil {
+			err = s.bus.Publish(ctx, event)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Timing of /events/stream: the reconnection delay suggested to
+// EventSource clients, and how often an idle stream sends a comment so
+// proxies keep it open
+const (
+	eventStreamRetry     = time.Second
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// handleEventStream streams lifecycle events as server-sent events while
+// they are published, filtered by ?type= (comma-separated types or
+// subjects) and ?merchant=. A caller bound to a merchant only sees that
+// merchant's events; with authentication enabled, any other caller needs
+// the all_merchants scope. Each event's id is its place in the hub, so a
+// client reconnecting with Last-Event-ID gets what it missed if the hub
+// still remembers it. The route has no handler timeout: the stream runs
+// until the client disconnects.
+func handleEventStream(cfg *config.Config, hub *eventbus.Hub) http.HandlerFunc {
+	authEnabled := middleware.NewAuthenticator(cfg).Enabled()
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := eventbus.Filter{MerchantID: r.URL.Query().Get("merchant")}
+		for _, t := range strings.Split(r.URL.Query().Get("type"), ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				filter.Types = append(filter.Types, t)
+			}
+		}
+		if bound, ok := cfg.MerchantForCaller(logctx.Caller(r.Context())); ok {
+			if filter.MerchantID != "" && filter.MerchantID != bound.ID {
+				api.WriteErrorCode(w, r, api.ErrForbidden, "merchant not allowed for this caller")
+				return
+			}
+			filter.MerchantID = bound.ID
+		} else if authEnabled && !middleware.HasScope(r.Context(), middleware.ScopeAllMerchants) {
+			api.WriteErrorCode(w, r, api.ErrForbidden, "credentials lack the "+middleware.ScopeAllMerchants+" scope")
+			return
+		}
+
+		var after int64
+		if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || value < 0 {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Last-Event-ID must be an event id from this stream")
+				return
+			}
+			after = value
+		}
+
+		sub := hub.Subscribe(filter, after)
+		defer sub.Close()
+		metrics.EventStreams.Inc()
+		defer metrics.EventStreams.Dec()
+
+		// The server's write timeout would cut the stream off
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		keepAlive := time.NewTicker(eventStreamKeepAlive)
+		defer keepAlive.Stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher, _ := w.(http.Flusher)
+		fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry.Milliseconds())
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		for {
+			select {
+			case live, ok := <-sub.Events():
+				if !ok {
+					// Dropped for falling behind; the client resumes from its last id
+					return
+				}
+				data, err := json.Marshal(live.Event)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", live.Seq, live.Event.Type, data); err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
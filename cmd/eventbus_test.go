@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/eventbus"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/middleware"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventStream(t *testing.T) {
+	cfg := &config.Config{Merchants: []config.Merchant{{ID: "m1", Callers: []string{"dashboard"}}}}
+	hub := eventbus.NewHub(eventbus.DefaultHubHistory)
+	hub.Broadcast(eventbus.Event{ID: "e1", Type: "sale.succeeded", MerchantID: "m1"})
+	hub.Broadcast(eventbus.Event{ID: "e2", Type: "sale.succeeded", MerchantID: "m2"})
+	hub.Broadcast(eventbus.Event{ID: "e3", Type: "sale.declined", MerchantID: "m1"})
+	hub.Broadcast(eventbus.Event{ID: "e4", Type: eventbus.EventBatchClosed, MerchantID: "m1"})
+
+	// The stream ends with the request, so each one replays what the hub
+	// remembers after Last-Event-ID and returns
+	stream := func(path, caller, lastEventID string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer time.AfterFunc(50*time.Millisecond, cancel).Stop()
+		if caller != "" {
+			ctx = logctx.WithFields(ctx, logrus.Fields{logctx.FieldCaller: caller})
+		}
+		req := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		rec := httptest.NewRecorder()
+		handleEventStream(cfg, hub)(rec, req)
+		return rec
+	}
+
+	rec := stream("/events/stream?type=sale&merchant=m1", "", "0")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	assert.True(t, strings.HasPrefix(body, "retry: 1000\n\n"))
+	assert.NotContains(t, body, "id: 1\n", "only events after Last-Event-ID are replayed")
+
+	rec = stream("/events/stream?type=sale&merchant=m1", "", "")
+	assert.Equal(t, "retry: 1000\n\n", rec.Body.String(), "without Last-Event-ID nothing is replayed")
+
+	rec = stream("/events/stream?type=sale.declined,%20batch", "", "1")
+	body = rec.Body.String()
+	assert.Contains(t, body, "id: 3\nevent: sale.declined\ndata: {\"id\":\"e3\"")
+	assert.Contains(t, body, "id: 4\nevent: batch.closed\n")
+	assert.NotContains(t, body, "id: 2\n")
+
+	// A caller bound to a merchant only sees that merchant's events
+	rec = stream("/events/stream", "dashboard", "1")
+	body = rec.Body.String()
+	assert.NotContains(t, body, "\"e2\"")
+	assert.Contains(t, body, "\"e3\"")
+	rec = stream("/events/stream?merchant=m2", "dashboard", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.JSONEq(t, `{"code":"forbidden","message":"merchant not allowed for this caller"}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, stream("/events/stream", "", "abc").Code)
+	assert.Zero(t, hub.Subscribers())
+}
+
+func TestEventStreamRequiresAllMerchantsScope(t *testing.T) {
+	cfg := &config.Config{
+		AuthAPIKeys:   []config.APIKey{{Name: "billing", Key: "k-billing"}, {Name: "ops", Key: "k-ops"}},
+		AuthAdminKeys: []string{"ops"},
+	}
+	hub := eventbus.NewHub(eventbus.DefaultHubHistory)
+	hub.Broadcast(eventbus.Event{ID: "e0", Type: "sale.succeeded", MerchantID: "m1"})
+	hub.Broadcast(eventbus.Event{ID: "e1", Type: "sale.succeeded", MerchantID: "m1"})
+	hub.Broadcast(eventbus.Event{ID: "e2", Type: "sale.succeeded", MerchantID: "m2"})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/events/stream", handleEventStream(cfg, hub))
+	r.Use(middleware.NewAuthenticator(cfg).Middleware)
+	stream := func(key string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer time.AfterFunc(50*time.Millisecond, cancel).Stop()
+		req := httptest.NewRequest("GET", "/events/stream", nil).WithContext(ctx)
+		req.Header.Set("X-API-Key", key)
+		req.Header.Set("Last-Event-ID", "1")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A caller bound to no merchant would see every merchant's events
+	rec := stream("k-billing")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.JSONEq(t, `{"code":"forbidden","message":"credentials lack the all_merchants scope"}`, rec.Body.String())
+
+	rec = stream("k-ops")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"e1"`)
+	assert.Contains(t, rec.Body.String(), `"e2"`)
+}
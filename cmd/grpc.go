@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	paymentsv1 "nmi-pay-int/proto/payments/v1"
+	"nmi-pay-int/webhooks"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcErrorDomain identifies this service in gRPC error details
+const grpcErrorDomain = "nmi-pay-int"
+
+// paymentServer serves the gRPC API on the same client, logging and webhooks
+// as the REST handlers
+type paymentServer struct {
+	paymentsv1.UnimplementedPaymentServiceServer
+
+	cfg    *config.Config
+	client *api.Client
+	hooks  *webhooks.Manager
+}
+
+func newPaymentServer(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) *paymentServer {
+	return &paymentServer{cfg: cfg, client: client, hooks: hooks}
+}
+
+func (s *paymentServer) Sale(ctx context.Context, in *paymentsv1.PaymentRequest) (*paymentsv1.PaymentResponse, error) {
+	amount, err := api.ParseAmount(in.Amount)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	req := api.PaymentRequest{
+		APIKey:           merchantKey(ctx, s.cfg),
+		Type:             in.Type,
+		Amount:           amount,
+		CreditCard:       in.CreditCard,
+		ExpDate:          in.ExpDate,
+		CVV:              in.Cvv,
+		Token:            in.Token,
+		CustomerVaultID:  in.CustomerVaultId,
+		OrderID:          in.OrderId,
+		OrderDescription: in.OrderDescription,
+		PONumber:         in.Ponumber,
+		CustomerID:       in.CustomerId,
+		IdempotencyKey:   in.IdempotencyKey,
+		Billing:          billingFromProto(in.Billing),
+		CustomerReceipt:  in.CustomerReceipt,
+	}
+	if req.Type == "" {
+		req.Type = "sale"
+	}
+	if req.CustomerReceipt == nil && req.Billing != nil && req.Billing.Email != "" {
+		req.CustomerReceipt = &s.cfg.CustomerReceipt
+	}
+
+	var resp *api.PaymentResponse
+	if req.Type == "auth" {
+		resp, err = s.client.AuthorizeTransaction(ctx, req)
+	} else {
+		resp, err = s.client.ProcessPayment(ctx, req)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if !resp.IdempotentReplay {
+		LogTransaction(ctx, fmt.Sprintf("GRPC %s: Transaction ID=%s, Response=%s", req.Type, resp.TransactionID, resp.ResponseText))
+		SaveTransaction(ctx, resp.TransactionID, req.Type, resp.ResponseText, req.Amount.String(), req.OrderDescription, req.PONumber)
+		if req.Type == "sale" {
+			s.hooks.Publish(contextMerchantID(ctx), webhooks.EventPaymentSale, resp)
+		}
+	}
+
+	return &paymentsv1.PaymentResponse{
+		Response:         resp.Response,
+		ResponseText:     resp.ResponseText,
+		AuthCode:         resp.AuthCode,
+		TransactionId:    resp.TransactionID,
+		AvsResponse:      resp.AVSResponse,
+		CvvResponse:      resp.CVVResponse,
+		OrderId:          resp.OrderID,
+		Type:             resp.Type,
+		ResponseCode:     resp.ResponseCode,
+		CustomerVaultId:  resp.CustomerVaultID,
+		MaskedCard:       resp.MaskedCard,
+		CardType:         resp.CardType,
+		ExpiryDate:       resp.ExpiryDate,
+		ExtraFields:      resp.ExtraFields,
+		IdempotentReplay: resp.IdempotentReplay,
+	}, nil
+}
+
+func (s *paymentServer) Refund(ctx context.Context, in *paymentsv1.RefundRequest) (*paymentsv1.TransactionResponse, error) {
+	resp, err := s.client.ProcessRefund(ctx, api.RefundRequest{
+		APIKey:        merchantKey(ctx, s.cfg),
+		TransactionID: in.TransactionId,
+		Amount:        in.Amount,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC REFUND: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+	SaveTransaction(ctx, resp.TransactionID, "refund", resp.ResponseText, in.Amount, "", "")
+	s.hooks.Publish(contextMerchantID(ctx), webhooks.EventPaymentRefund, resp)
+
+	return &paymentsv1.TransactionResponse{
+		Response:      resp.Response,
+		ResponseText:  resp.ResponseText,
+		AuthCode:      resp.AuthCode,
+		TransactionId: resp.TransactionID,
+		Type:          resp.Type,
+		ResponseCode:  resp.ResponseCode,
+		Amount:        resp.Amount,
+		ExtraFields:   resp.ExtraFields,
+	}, nil
+}
+
+func (s *paymentServer) Void(ctx context.Context, in *paymentsv1.VoidRequest) (*paymentsv1.TransactionResponse, error) {
+	resp, err := s.client.VoidTransaction(ctx, api.VoidRequest{
+		APIKey:        merchantKey(ctx, s.cfg),
+		TransactionID: in.TransactionId,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC VOID: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+	SaveTransaction(ctx, resp.TransactionID, "void", resp.ResponseText, "0.00", "", "")
+	s.hooks.Publish(contextMerchantID(ctx), webhooks.EventPaymentVoid, resp)
+
+	return &paymentsv1.TransactionResponse{
+		Response:      resp.Response,
+		ResponseText:  resp.ResponseText,
+		AuthCode:      resp.AuthCode,
+		TransactionId: resp.TransactionID,
+		Type:          resp.Type,
+		ResponseCode:  resp.ResponseCode,
+		ExtraFields:   resp.ExtraFields,
+	}, nil
+}
+
+func (s *paymentServer) Lookup(ctx context.Context, in *paymentsv1.LookupRequest) (*paymentsv1.LookupResponse, error) {
+	if in.TransactionId == "" {
+		return nil, status.Error(codes.InvalidArgument, "transaction_id is required")
+	}
+
+	resp, err := s.client.LookupTransaction(ctx, api.LookupRequest{
+		APIKey:        merchantKey(ctx, s.cfg),
+		TransactionID: in.TransactionId,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	out := &paymentsv1.LookupResponse{
+		TransactionId: resp.TransactionID,
+		Type:          resp.Type,
+		Amount:        resp.Amount,
+		ResponseText:  resp.ResponseText,
+		ResponseCode:  resp.ResponseCode,
+	}
+	if record := resp.Record; record != nil {
+		out.Condition = record.Condition
+		out.OrderId = record.OrderID
+		out.AuthorizationCode = record.AuthorizationCode
+		if record.Card != nil {
+			out.MaskedCard = record.Card.MaskedNumber
+			out.CardType = record.Card.Type
+		}
+		for _, action := range record.Actions {
+			out.Actions = append(out.Actions, &paymentsv1.TransactionAction{
+				Type:         action.Type,
+				Amount:       action.Amount,
+				Date:         timestamp(action.Date),
+				Success:      action.Success,
+				ResponseText: action.ResponseText,
+				ResponseCode: action.ResponseCode,
+				BatchId:      action.BatchID,
+			})
+		}
+	}
+	return out, nil
+}
+
+func (s *paymentServer) TokenizeCard(ctx context.Context, in *paymentsv1.TokenizeRequest) (*paymentsv1.TokenizeResponse, error) {
+	resp, err := s.client.ProcessTokenization(ctx, api.PaymentRequest{
+		APIKey:     merchantKey(ctx, s.cfg),
+		CreditCard: in.CreditCard,
+		ExpDate:    in.ExpDate,
+		CVV:        in.Cvv,
+		Billing:    billingFromProto(in.Billing),
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC TOKENIZE: Customer Vault ID=%s, Response=SUCCESS", resp.CustomerVaultID))
+
+	return &paymentsv1.TokenizeResponse{
+		CustomerVaultId: resp.CustomerVaultID,
+		MaskedCard:      resp.Masked,
+		CardType:        resp.CardType,
+		ExpiryDate:      resp.ExpiryDate,
+		Success:         resp.Success,
+		Message:         resp.Message,
+		ResponseCode:    resp.ResponseCode,
+	}, nil
+}
+
+func (s *paymentServer) GetVaultCustomer(ctx context.Context, in *paymentsv1.VaultCustomerRequest) (*paymentsv1.VaultCustomer, error) {
+	customer, err := s.client.GetVaultCustomer(ctx, merchantKey(ctx, s.cfg), in.CustomerVaultId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	billing := customer.Billing
+	return &paymentsv1.VaultCustomer{
+		CustomerVaultId: customer.CustomerVaultID,
+		Billing:         billingToProto(&billing),
+		MaskedCard:      customer.MaskedCard,
+		CardType:        customer.CardType,
+		ExpiryDate:      customer.ExpiryDate,
+		MaskedAccount:   customer.MaskedAccount,
+		Created:         timestamp(customer.Created),
+		Updated:         timestamp(customer.Updated),
+	}, nil
+}
+
+func (s *paymentServer) UpdateVaultCustomer(ctx context.Context, in *paymentsv1.UpdateVaultCustomerRequest) (*paymentsv1.VaultResponse, error) {
+	resp, err := s.client.UpdateVaultCustomer(ctx, api.VaultUpdateRequest{
+		APIKey:          merchantKey(ctx, s.cfg),
+		CustomerVaultID: in.CustomerVaultId,
+		CreditCard:      in.CreditCard,
+		ExpDate:         in.ExpDate,
+		Billing:         billingFromProto(in.Billing),
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC VAULT UPDATE: Customer Vault ID=%s, Response=%s", resp.CustomerVaultID, resp.Message))
+	return vaultResponseToProto(resp), nil
+}
+
+func (s *paymentServer) DeleteVaultCustomer(ctx context.Context, in *paymentsv1.VaultCustomerRequest) (*paymentsv1.VaultResponse, error) {
+	resp, err := s.client.DeleteVaultCustomer(ctx, merchantKey(ctx, s.cfg), in.CustomerVaultId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC VAULT DELETE: Customer Vault ID=%s, Response=%s", resp.CustomerVaultID, resp.Message))
+	return vaultResponseToProto(resp), nil
+}
+
+func (s *paymentServer) CreateSubscription(ctx context.Context, in *paymentsv1.SubscriptionRequest) (*paymentsv1.Subscription, error) {
+	resp, err := s.client.ProcessRecurringPayment(ctx, recurringFromProto(merchantKey(ctx, s.cfg), in))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC RECURRING: Subscription ID=%s, Plan=%s, Response=%s", resp.SubscriptionID, in.PlanId, resp.Status))
+	s.hooks.Publish(contextMerchantID(ctx), webhooks.EventSubscriptionCreated, resp)
+	return subscriptionToProto(resp), nil
+}
+
+func (s *paymentServer) UpdateSubscription(ctx context.Context, in *paymentsv1.SubscriptionRequest) (*paymentsv1.Subscription, error) {
+	if in.SubscriptionId == "" {
+		return nil, status.Error(codes.InvalidArgument, "subscription_id is required")
+	}
+
+	resp, err := s.client.UpdateRecurringPayment(ctx, recurringFromProto(merchantKey(ctx, s.cfg), in), in.SubscriptionId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC UPDATE RECURRING: Subscription ID=%s", in.SubscriptionId))
+	s.hooks.Publish(contextMerchantID(ctx), webhooks.EventSubscriptionUpdated, resp)
+	return subscriptionToProto(resp), nil
+}
+
+func (s *paymentServer) CancelSubscription(ctx context.Context, in *paymentsv1.CancelSubscriptionRequest) (*paymentsv1.CancelSubscriptionResponse, error) {
+	if in.SubscriptionId == "" {
+		return nil, status.Error(codes.InvalidArgument, "subscription_id is required")
+	}
+
+	if err := s.client.CancelRecurringPayment(ctx, merchantKey(ctx, s.cfg), in.SubscriptionId); err != nil {
+		return nil, grpcError(err)
+	}
+
+	LogTransaction(ctx, fmt.Sprintf("GRPC CANCEL RECURRING: Subscription ID=%s", in.SubscriptionId))
+	s.hooks.Publish(contextMerchantID(ctx), webhooks.EventSubscriptionCanceled, map[string]string{"subscription_id": in.SubscriptionId})
+	return &paymentsv1.CancelSubscriptionResponse{SubscriptionId: in.SubscriptionId, Status: "cancelled"}, nil
+}
+
+// grpcError maps an NMIError onto the gRPC code matching the HTTP status
+// api.HTTPStatus gives it: bad input is InvalidArgument, a decline
+// FailedPrecondition, a duplicate AlreadyExists and a gateway outage
+// Unavailable. The NMI error code and gateway results travel in an
+// ErrorInfo detail.
+func grpcError(err error) error {
+	var nmiErr *api.NMIError
+	if !errors.As(err, &nmiErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	code := codes.InvalidArgument
+	switch api.HTTPStatus(nmiErr) {
+	case http.StatusPaymentRequired, http.StatusPreconditionRequired:
+		code = codes.FailedPrecondition
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	case http.StatusBadGateway:
+		code = codes.Unavailable
+	case http.StatusInternalServerError:
+		code = codes.Internal
+	}
+
+	info := &errdetails.ErrorInfo{
+		Reason:   nmiErr.Code,
+		Domain:   grpcErrorDomain,
+		Metadata: map[string]string{},
+	}
+	for key, value := range map[string]string{
+		"response_code":    nmiErr.ResponseCode,
+		"avsresponse":      nmiErr.AVSResponse,
+		"cvvresponse":      nmiErr.CVVResponse,
+		"decline_reason":   string(nmiErr.DeclineReason),
+		"decline_category": string(nmiErr.DeclineCategory),
+	} {
+		if value != "" {
+			info.Metadata[key] = value
+		}
+	}
+	if nmiErr.RetryAfter > 0 {
+		info.Metadata["retry_after"] = strconv.Itoa(nmiErr.RetryAfter)
+	}
+
+	st, detailErr := status.New(code, nmiErr.Message).WithDetails(info)
+	if detailErr != nil {
+		return status.Error(code, nmiErr.Message)
+	}
+	return st.Err()
+}
+
+func billingFromProto(in *paymentsv1.BillingInfo) *api.BillingInfo {
+	if in == nil {
+		return nil
+	}
+	return &api.BillingInfo{
+		FirstName: in.FirstName,
+		LastName:  in.LastName,
+		Address1:  in.Address1,
+		City:      in.City,
+		State:     in.State,
+		Zip:       in.Zip,
+		Country:   in.Country,
+		Email:     in.Email,
+		Phone:     in.Phone,
+	}
+}
+
+func billingToProto(in *api.BillingInfo) *paymentsv1.BillingInfo {
+	return &paymentsv1.BillingInfo{
+		FirstName: in.FirstName,
+		LastName:  in.LastName,
+		Address1:  in.Address1,
+		City:      in.City,
+		State:     in.State,
+		Zip:       in.Zip,
+		Country:   in.Country,
+		Email:     in.Email,
+		Phone:     in.Phone,
+	}
+}
+
+func vaultResponseToProto(resp *api.VaultResponse) *paymentsv1.VaultResponse {
+	return &paymentsv1.VaultResponse{
+		CustomerVaultId: resp.CustomerVaultID,
+		Success:         resp.Success,
+		Message:         resp.Message,
+		ResponseCode:    resp.ResponseCode,
+	}
+}
+
+func recurringFromProto(apiKey string, in *paymentsv1.SubscriptionRequest) api.RecurringPaymentRequest {
+	return api.RecurringPaymentRequest{
+		APIKey:          apiKey,
+		CustomerVaultID: in.CustomerVaultId,
+		PlanID:          in.PlanId,
+		Amount:          in.Amount,
+		BillingCycle:    in.BillingCycle,
+		StartDate:       in.StartDate,
+		Billing:         billingFromProto(in.Billing),
+	}
+}
+
+func subscriptionToProto(resp *api.RecurringResponse) *paymentsv1.Subscription {
+	return &paymentsv1.Subscription{
+		SubscriptionId:  resp.SubscriptionID,
+		Status:          resp.Status,
+		NextBillingDate: resp.NextBilling,
+		PlanId:          resp.PlanID,
+		Amount:          resp.Amount,
+		CustomerVaultId: resp.CustomerVaultID,
+	}
+}
+
+// timestamp converts t, leaving zero times unset
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
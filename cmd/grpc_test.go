@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/middleware"
+	paymentsv1 "nmi-pay-int/proto/payments/v1"
+	"nmi-pay-int/webhooks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startGRPC serves the gRPC API against a fake gateway answering every call
+// with gatewayResponse and returns a connected client
+func startGRPC(t *testing.T, gatewayResponse string) paymentsv1.PaymentServiceClient {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(gatewayResponse))
+	}))
+	t.Cleanup(gateway.Close)
+
+	cfg := &config.Config{
+		APIKey:         "key",
+		APIBaseURL:     gateway.URL,
+		QueryURL:       gateway.URL,
+		GRPCAuthTokens: []config.APIKey{{Name: "grpc", Key: "secret"}},
+		// The limiter allows no burst, so back-to-back test calls need headroom
+		RateLimitPerMinute: 1 << 30,
+	}
+	hooks := webhooks.NewManager(webhooks.DefaultRetryPolicy)
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(middleware.Chain(cfg).UnaryInterceptors()...))
+	paymentsv1.RegisterPaymentServiceServer(srv, newPaymentServer(cfg, api.NewClient(cfg), hooks))
+
+	ln := bufconn.Listen(1 << 20)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return paymentsv1.NewPaymentServiceClient(conn)
+}
+
+func authorized() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+}
+
+func TestGRPCSale(t *testing.T) {
+	client := startGRPC(t, "response=1&responsetext=SUCCESS&authcode=123456&transactionid=9001&type=sale&response_code=100")
+
+	var header metadata.MD
+	resp, err := client.Sale(authorized(), &paymentsv1.PaymentRequest{
+		Amount:     "10.5",
+		CreditCard: "4111111111111111",
+		ExpDate:    "1230",
+		Cvv:        "123",
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "9001", resp.TransactionId)
+	assert.Equal(t, "SUCCESS", resp.ResponseText)
+	assert.NotEmpty(t, header.Get("x-request-id"))
+}
+
+func TestGRPCRequiresToken(t *testing.T) {
+	client := startGRPC(t, "response=1")
+
+	_, err := client.Void(context.Background(), &paymentsv1.VoidRequest{TransactionId: "9001"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong")
+	_, err = client.Void(ctx, &paymentsv1.VoidRequest{TransactionId: "9001"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGRPCMapsGatewayErrors(t *testing.T) {
+	client := startGRPC(t, "response=2&responsetext=DECLINE&transactionid=9002&type=sale&response_code=200")
+
+	_, err := client.Sale(authorized(), &paymentsv1.PaymentRequest{
+		Amount:     "10.00",
+		CreditCard: "4111111111111111",
+		ExpDate:    "1230",
+		Cvv:        "123",
+	})
+	st := status.Convert(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Len(t, st.Details(), 1)
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	assert.Equal(t, "200", info.Metadata["response_code"])
+
+	_, err = client.Sale(authorized(), &paymentsv1.PaymentRequest{Amount: "ten"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
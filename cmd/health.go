@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+	"nmi-pay-int/health"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readinessChecks builds the dependency checks behind /readyz. NMI must be
+// reachable and accept the security key, and the database must answer when
+// DATABASE_URL is set. Redis is only reported: idempotency keys and rate
+// limits fall back to memory while it is down.
+func readinessChecks(cfg *config.Config, client *api.Client, database *db.DB) *health.Checker {
+	checker := health.NewChecker(health.DefaultCacheTTL)
+	checker.Require("nmi", health.Dial(cfg.APIBaseURL))
+	checker.Require("nmi_credentials", func(ctx context.Context) error {
+		status := api.GetCredentialStatus()
+		if status.State != api.CredentialsValid {
+			// Retry a startup check that failed or has not finished, so an
+			// NMI outage at boot does not keep the service unready for good
+			status = client.RunCredentialCheck(ctx, cfg.Settings().APIKey)
+		}
+		if status.State != api.CredentialsValid {
+			return errors.New(status.Message)
+		}
+		return nil
+	})
+
+	if database != nil {
+		checker.Require("database", database.PingContext)
+	}
+
+	if cfg.IdempotencyStore == config.StoreRedis || cfg.RateLimitStore == config.StoreRedis {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			checker.Optional("redis", func(context.Context) error { return err })
+		} else {
+			rdb := redis.NewClient(opts)
+			checker.Optional("redis", func(ctx context.Context) error { return rdb.Ping(ctx).Err() })
+		}
+	}
+	return checker
+}
@@ -3,93 +3,205 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"nmi-pay-int/api"
+	"nmi-pay-int/bins"
 	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+	"nmi-pay-int/downloads"
+	"nmi-pay-int/eventbus"
+	"nmi-pay-int/eventlog"
+	"nmi-pay-int/fees"
+	"nmi-pay-int/health"
+	"nmi-pay-int/listener"
+	"nmi-pay-int/logctx"
 	"nmi-pay-int/metrics"
 	"nmi-pay-int/middleware"
+	paymentsv1 "nmi-pay-int/proto/payments/v1"
+	"nmi-pay-int/store"
+	"nmi-pay-int/terminal"
+	"nmi-pay-int/tracing"
+	"nmi-pay-int/webhooks"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 // LogTransaction logs transaction details to a text file
-func LogTransaction(logMessage string) {
+func LogTransaction(ctx context.Context, logMessage string) {
 	logFile, err := os.OpenFile("logs/transactions.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
-		metrics.LogError(fmt.Errorf("failed to open log file: %v", err))
+		metrics.LogError(ctx, fmt.Errorf("failed to open log file: %v", err))
 		return
 	}
 	defer logFile.Close()
-	metrics.LogInfo(logMessage)
+	metrics.LogInfo(ctx, logMessage)
 }
 
-// SaveTransaction saves transaction details to a CSV file
-func SaveTransaction(transactionID, transactionType, responseText, amount string) {
-	csvFile, err := os.OpenFile("logs/transactions.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+// SaveTransaction records an approved transaction to the CSV export, the
+// transaction history and any other configured sinks. It only queues the
+// transaction; a background writer does the I/O.
+func SaveTransaction(ctx context.Context, transactionID, transactionType, responseText, amount, orderDescription, poNumber string) {
+	recordTransaction(ctx, store.Transaction{
+		TransactionID:    transactionID,
+		Type:             transactionType,
+		Status:           store.StatusApproved,
+		ResponseText:     responseText,
+		Amount:           historyAmount(amount),
+		OrderDescription: orderDescription,
+		PONumber:         poNumber,
+	})
+}
+
+// serveTransactionsCSV streams the transaction CSV export as an attachment
+func serveTransactionsCSV(w http.ResponseWriter, r *http.Request) error {
+	csvFile, err := os.Open(transactionsCSV)
 	if err != nil {
-		metrics.LogError(fmt.Errorf("failed to open CSV file: %v", err))
-		return
+		return err
 	}
 	defer csvFile.Close()
 
-	writer := csv.NewWriter(csvFile)
-	defer writer.Flush()
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="transactions.csv"`)
+	_, err = io.Copy(w, csvFile)
+	return err
+}
 
-	// Write headers if file is empty
-	fileInfo, _ := csvFile.Stat()
-	if fileInfo.Size() == 0 {
-		writer.Write([]string{"Timestamp", "Transaction ID", "Type", "Response", "Amount"})
-	}
+// The write timeout stays above middleware.DefaultHandlerTimeout so a timeout
+// response can still be written. Gateway calls inside a handler get the
+// remaining handler budget minus a safety margin (see api.GatewayBudget).
+const writeTimeout = 30 * time.Second
 
-	writer.Write([]string{
-		time.Now().Format("2006-01-02 15:04:05"),
-		transactionID,
-		transactionType,
-		responseText,
-		amount,
-	})
-}
+// Bounds for GET /payments/{id}/wait, kept inside the handler timeout
+const (
+	defaultWaitTimeout = 10 * time.Second
+	maxWaitTimeout     = 20 * time.Second
+)
 
 func main() {
 	// Initialize logger
 	metrics.InitLogger()
 
-	mode := os.Getenv("MODE")
-	if mode == "serve" {
-		startMicroservice()
-	} else {
-		runStandaloneDemo()
+	if err := newRootCommand(os.Stdout).Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
 func startMicroservice() {
-	fmt.Println("Starting microservice...")
 	cfg := config.LoadConfig()
 
-	// Initialize router
-	r := mux.NewRouter()
-	fmt.Println("Router initialized...")
+	// Export spans before anything that might create one
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		fmt.Printf("Tracing unavailable: %v\n", err)
+		metrics.LogError(context.Background(), fmt.Errorf("failed to set up tracing: %v", err))
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	var clientOpts []api.ClientOption
+	var events eventlog.Log = eventlog.NewMemoryLog(eventlog.DefaultMemoryLogSize)
+	var feeLedger fees.Ledger = fees.NewMemoryLedger()
+	var terminals terminal.Store = terminal.NewMemoryStore()
+	var registry terminal.Registry = terminal.NewMemoryRegistry()
+	var outbox eventbus.Outbox = eventbus.NewMemoryOutbox()
+	var database *db.DB
+	if cfg.DatabaseURL != "" {
+		persisted, err := openPersistence(cfg.DatabaseURL)
+		if err != nil {
+			fmt.Printf("Database unavailable: %v\n", err)
+			metrics.LogError(context.Background(), fmt.Errorf("failed to open database: %v", err))
+			return
+		}
+		defer persisted.db.Close()
+		clientOpts = append(clientOpts, api.WithPlanRepository(persisted.plans), api.WithRefundLedger(persisted.refunds),
+			api.WithCardLists(persisted.cardLists), api.WithAuditLog(persisted.audit))
+		events = persisted.events
+		feeLedger = persisted.fees
+		terminals = persisted.terminals
+		registry = persisted.registry
+		history = persisted.transactions
+		outbox = persisted.outbox
+		database = persisted.db
+	}
+	if cfg.SyncPlansToGateway {
+		clientOpts = append(clientOpts, api.WithGatewayPlans(cfg.APIKey))
+	}
+	var binTable *bins.Table
+	if cfg.BINTableFile != "" {
+		table, err := bins.Open(cfg.BINTableFile)
+		if err != nil {
+			fmt.Printf("BIN table unavailable: %v\n", err)
+			metrics.LogError(context.Background(), fmt.Errorf("failed to read BIN_TABLE_FILE: %v", err))
+			return
+		}
+		binTable = table
+		clientOpts = append(clientOpts, api.WithBINTable(table))
+	}
+	client := api.NewClient(cfg, clientOpts...)
+
+	if len(cfg.AmountBuckets) > 0 {
+		if err := metrics.ConfigureAmountBuckets(cfg.AmountBuckets); err != nil {
+			metrics.LogError(context.Background(), fmt.Errorf("invalid amount histogram buckets, using defaults: %v", err))
+		}
+	}
+
+	signer := downloads.NewSigner(cfg.LinkSigningSecret)
+	signer.Register("exports/transactions.csv", serveTransactionsCSV)
+
+	retry := webhooks.DefaultRetryPolicy
+	if cfg.WebhookMaxAttempts > 0 {
+		retry.MaxAttempts = cfg.WebhookMaxAttempts
+	}
+	hooks := webhooks.NewManager(retry)
+	hooks.RecordTo(events)
 
-	// Create middleware instances
-	securityMiddleware := middleware.NewSecurityMiddleware(100)
+	// Lifecycle events go to /events/stream, and to Kafka, SNS or SQS through
+	// the outbox when a broker is configured; payments reach them through
+	// the transaction recorder
+	producer, err := newEventProducer(cfg)
+	if err != nil {
+		fmt.Printf("Event broker misconfigured: %v\n", err)
+		metrics.LogError(context.Background(), fmt.Errorf("failed to configure event broker: %v", err))
+		return
+	}
+	liveEvents := eventbus.NewHub(eventbus.DefaultHubHistory)
+	lifecycle := startEventBus(cfg, producer, outbox, hooks, liveEvents)
+	useTransactionRecorder(context.Background(), cfg, eventBusSink{bus: lifecycle})
+
+	// Terminal payments run in the background; their results are polled,
+	// streamed or delivered as a webhook
+	sessions := terminal.NewSessions(client, registry, func(session terminal.PaymentSession) {
+		LogTransaction(context.Background(), fmt.Sprintf("TERMINAL PAYMENT: Session ID=%s, Terminal ID=%s, Status=%s", session.ID, session.TerminalID, session.Status))
+		hooks.Publish(session.MerchantID, webhooks.EventTerminalPaymentCompleted, session)
+	})
 
-	// Apply middleware to all routes
-	r.Use(middleware.LoggingMiddleware)
-	r.Use(securityMiddleware.RateLimiter)
-	r.Use(middleware.TimeoutMiddleware(30 * time.Second))
-	r.Use(middleware.MetricsMiddleware)
+	// Initialize router
+	r := mux.NewRouter()
 
-	fmt.Println("Middleware applied...")
+	// Apply the middleware stack to all routes
+	stack := middleware.Chain(cfg)
+	if !stack.AuthEnabled() && !cfg.AuthDisabled {
+		fmt.Println("AUTH_API_KEYS or AUTH_JWT_SECRET is required; set AUTH_DISABLED=true to serve the protected routes without authentication")
+		metrics.LogError(context.Background(), fmt.Errorf("refusing to start without authentication: AUTH_API_KEYS, AUTH_JWT_SECRET and AUTH_DISABLED are unset"))
+		return
+	}
+	rateLimit := stack.RateLimit
+	handler := stack.Handler(r)
 
 	// Add test endpoint
 	r.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
@@ -98,66 +210,238 @@ func startMicroservice() {
 	}).Methods("GET")
 
 	// Payment endpoints
-	r.HandleFunc("/payments/tokenize", handleTokenize(cfg)).Methods("POST")
-	r.HandleFunc("/payments/sale", handleSale(cfg)).Methods("POST")
-	r.HandleFunc("/payments/refund", handleRefund(cfg)).Methods("POST")
-	r.HandleFunc("/payments/void", handleVoid(cfg)).Methods("POST")
-	r.HandleFunc("/payments/lookup", handleLookup(cfg)).Methods("GET")
+	r.HandleFunc("/payments/tokenize", handleTokenize(cfg, client)).Methods("POST")
+	r.HandleFunc("/vault/customers/{id}", handleGetVaultCustomer(cfg, client)).Methods("GET")
+	r.HandleFunc("/vault/customers/{id}", handleUpdateVaultCustomer(cfg, client)).Methods("PUT")
+	r.HandleFunc("/vault/customers/{id}", handleDeleteVaultCustomer(cfg, client)).Methods("DELETE")
+	if cfg.FormTokens {
+		formTokens := middleware.NewFormTokens()
+		r.HandleFunc("/payments/token", formTokens.HandleMint()).Methods("GET")
+		r.Handle("/payments/sale", formTokens.Require(handleSale(cfg, client, hooks))).Methods("POST")
+	} else {
+		r.HandleFunc("/payments/sale", handleSale(cfg, client, hooks)).Methods("POST")
+	}
+	r.HandleFunc("/payments/refund", handleRefund(cfg, client, hooks)).Methods("POST")
+	r.HandleFunc("/payments/void", handleVoid(cfg, client, hooks)).Methods("POST")
+	r.HandleFunc("/payments/authorize", handleAuthorize(cfg, client)).Methods("POST")
+	r.HandleFunc("/payments/capture", handleCapture(cfg, client)).Methods("POST")
+	r.HandleFunc("/payments/ach", handleACH(cfg, client)).Methods("POST")
+	r.HandleFunc("/payments/batch", handleStartSaleBatch(cfg, client, hooks)).Methods("POST")
+	r.HandleFunc("/payments/batch/{id}", handleGetSaleBatch()).Methods("GET")
+	r.HandleFunc("/payments/lookup", handleLookup(cfg, client)).Methods("GET")
+	r.HandleFunc("/payments/{id}/wait", handleWaitForTransaction(cfg, client)).Methods("GET")
+	r.HandleFunc("/payments/{id}/refunds", handleListRefunds(cfg, client)).Methods("GET")
+
+	// Card blocklist and allowlist endpoints, for the request's merchant
+	if cfg.CardFingerprintSalt != "" {
+		r.HandleFunc("/cards/lists", handleListCardListEntries(client)).Methods("GET")
+		r.HandleFunc("/cards/lists", handleAddCardListEntry(client)).Methods("POST")
+		r.HandleFunc("/cards/lists/{fingerprint}", handleDeleteCardListEntry(client)).Methods("DELETE")
+	}
+
+	// Audit log endpoints, served only behind authentication
+	if stack.AuthEnabled() {
+		r.HandleFunc("/audit", handleListAudit(client)).Methods("GET")
+		r.HandleFunc("/audit/verify", handleVerifyAudit(client)).Methods("GET")
+	}
+
+	// Transaction reporting endpoint
+	r.HandleFunc("/transactions/search", handleSearchTransactions(cfg, client)).Methods("GET")
+	r.HandleFunc("/transactions", handleListTransactions()).Methods("GET")
+	r.HandleFunc("/reports/fees", fees.HandleReport(feeLedger)).Methods("GET")
+	r.HandleFunc("/reports/settlements", handleSettlementReport(cfg, client)).Methods("GET")
+	r.HandleFunc("/disputes", handleListDisputes(cfg, client)).Methods("GET")
+	r.HandleFunc("/reports/fees/import", fees.HandleImport(feeLedger)).Methods("POST")
 
 	// Recurring payment endpoints
-	r.HandleFunc("/payments/recurring/create", handleCreateRecurring(cfg)).Methods("POST")
-	r.HandleFunc("/payments/recurring/update/{subscription_id}", handleUpdateRecurring(cfg)).Methods("PUT")
-	r.HandleFunc("/payments/recurring/cancel/{subscription_id}", handleCancelRecurring(cfg)).Methods("DELETE")
+	r.HandleFunc("/payments/recurring/create", handleCreateRecurring(cfg, client, hooks)).Methods("POST")
+	r.HandleFunc("/payments/recurring/update/{subscription_id}", handleUpdateRecurring(cfg, client, hooks)).Methods("PUT")
+	r.HandleFunc("/payments/recurring/cancel/{subscription_id}", handleCancelRecurring(cfg, client, hooks)).Methods("DELETE")
+	r.HandleFunc("/payments/recurring/{subscription_id}/payments", handleSubscriptionPayments(cfg, client)).Methods("GET")
+	r.HandleFunc("/payments/recurring", handleListSubscriptions(cfg, client)).Methods("GET")
+	r.HandleFunc("/payments/recurring/{subscription_id}", handleGetSubscription(cfg, client)).Methods("GET")
 
 	// Plan event endpoint
-	r.HandleFunc("/plans/add", api.HandleAddPlan()).Methods("POST")
-	r.HandleFunc("/plans/update", api.HandleUpdatePlan()).Methods("PUT")
-	r.HandleFunc("/plans/cancel/{id}", api.HandleCancelPlan()).Methods("DELETE")
-	r.HandleFunc("/plans/list", api.HandleListPlans()).Methods("GET")
+	r.HandleFunc("/plans/add", api.HandleAddPlan(client.Plans())).Methods("POST")
+	r.HandleFunc("/plans/update", api.HandleUpdatePlan(client.Plans())).Methods("PUT")
+	r.HandleFunc("/plans/cancel/{id}", api.HandleCancelPlan(client.Plans())).Methods("DELETE")
+	r.HandleFunc("/plans/list", api.HandleListPlans(client.Plans())).Methods("GET")
+	r.HandleFunc("/plans/reconcile", handleReconcilePlans(cfg, client)).Methods("POST")
+
+	// Admin endpoints
+	r.HandleFunc("/admin/gateway/breaker", api.HandleBreakerStatus()).Methods("GET")
+	r.HandleFunc("/admin/gateway/breaker", api.HandleBreakerAction()).Methods("POST")
+	r.HandleFunc("/admin/subscriptions/migrate", handleStartMigration(cfg, client)).Methods("POST")
+	r.HandleFunc("/admin/subscriptions/migrations/{id}", handleGetMigration()).Methods("GET")
+	r.HandleFunc("/admin/subscriptions/migrations/{id}/cancel", handleCancelMigration()).Methods("POST")
+	r.HandleFunc("/admin/links", downloads.HandleCreateLink(signer)).Methods("POST")
+	r.HandleFunc("/admin/batch/close", handleBatchClose(cfg, client, hooks)).Methods("POST")
+	r.HandleFunc("/admin/vault/export", handleVaultExport(cfg, client)).Methods("GET")
+	r.HandleFunc("/admin/terminals", terminal.HandleList(terminals)).Methods("GET")
+	r.HandleFunc("/admin/terminals/{terminal_id}", terminal.HandlePut(terminals)).Methods("PUT")
+	r.HandleFunc("/admin/terminals/{terminal_id}", terminal.HandleDelete(terminals)).Methods("DELETE")
+	r.HandleFunc("/admin/routes", handleRoutes(r, rateLimit, cfg.FormTokens, stack.AuthEnabled())).Methods("GET")
+
+	// API specification and interactive documentation
+	r.HandleFunc("/openapi.json", handleOpenAPI(r)).Methods("GET")
+	r.HandleFunc("/docs", handleSwaggerUI).Methods("GET")
+
+	// Webhook endpoints
+	r.HandleFunc("/webhooks", webhooks.HandleCreate(hooks)).Methods("POST")
+	r.HandleFunc("/webhooks", webhooks.HandleList(hooks)).Methods("GET")
+	r.HandleFunc("/webhooks/dead-letters", webhooks.HandleDeadLetters(hooks)).Methods("GET")
+	r.HandleFunc("/webhooks/dead-letters/{id}/redeliver", webhooks.HandleRedeliver(hooks)).Methods("POST")
+	r.HandleFunc("/webhooks/{id}", webhooks.HandleGet(hooks)).Methods("GET")
+	r.HandleFunc("/webhooks/{id}", webhooks.HandleUpdate(hooks)).Methods("PUT")
+	r.HandleFunc("/webhooks/{id}", webhooks.HandleDelete(hooks)).Methods("DELETE")
+
+	// Replayable event log, and live lifecycle events
+	r.HandleFunc("/events/export", eventlog.HandleExport(events)).Methods("GET")
+	r.HandleFunc("/events/stream", handleEventStream(cfg, liveEvents)).Methods("GET")
+
+	// Signed download links, usable without API credentials
+	r.HandleFunc("/downloads/{resource:.+}", downloads.HandleDownload(signer)).Methods("GET")
+
+	// Metrics endpoint, either on its own internal port or on the main router
+	var metricsSrv *http.Server
+	if cfg.MetricsPort != "" {
+		metricsSrv = metrics.StartMetricsServer(":" + cfg.MetricsPort)
+		fmt.Printf("Metrics exposed on port %s\n", cfg.MetricsPort)
+	} else {
+		r.Handle("/metrics", promhttp.Handler())
+	}
 
-	// Metrics endpoint
-	r.Handle("/metrics", promhttp.Handler())
+	// Usage statistics endpoint
+	r.HandleFunc("/stats/usage", metrics.HandleUsageStats()).Methods("GET")
 
 	// Health check endpoint
 	r.HandleFunc("/health", handleHealth).Methods("GET")
+	r.HandleFunc("/ready", api.HandleReadiness()).Methods("GET")
+	r.HandleFunc("/healthz", health.HandleLiveness()).Methods("GET")
+	r.HandleFunc("/readyz", readinessChecks(cfg, client, database).HandleReadiness()).Methods("GET")
+	r.HandleFunc("/status", api.HandleStatus()).Methods("GET")
 
 	// Terminal endpoints
-	r.HandleFunc("/terminal/init", handleTerminalInit(cfg)).Methods("POST")
-	r.HandleFunc("/terminal/payment", handleTerminalPayment(cfg)).Methods("POST")
-	r.HandleFunc("/terminal/status/{terminal_id}", handleTerminalStatus()).Methods("GET")
-	r.HandleFunc("/terminal/cancel/{terminal_id}", handleTerminalCancel()).Methods("POST")
-
-	// Print all registered routes
-	fmt.Println("\nRegistered Routes:")
-	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
-		pathTemplate, _ := route.GetPathTemplate()
-		methods, _ := route.GetMethods()
-		fmt.Printf("Route: %-30s Methods: %v\n", pathTemplate, methods)
-		return nil
-	})
+	r.HandleFunc("/terminal/init", handleTerminalInit(cfg, client, terminals, registry)).Methods("POST")
+	r.HandleFunc("/terminal/config/{terminal_id}", terminal.HandleConfig(terminals)).Methods("GET")
+	r.HandleFunc("/terminal/payment", handleTerminalPayment(cfg, sessions)).Methods("POST")
+	r.HandleFunc("/terminal/payment/{payment_session_id}", handleTerminalPaymentSession(sessions)).Methods("GET")
+	r.HandleFunc("/terminal/payment/{payment_session_id}/events", handleTerminalPaymentEvents(sessions)).Methods("GET")
+	r.HandleFunc("/terminal/status/{terminal_id}", handleTerminalStatus(cfg, client, registry)).Methods("GET")
+	r.HandleFunc("/terminal/cancel/{terminal_id}", handleTerminalCancel(cfg, client, registry)).Methods("POST")
+	r.HandleFunc("/terminal/list", handleListTerminals(registry)).Methods("GET")
+	r.HandleFunc("/terminal/{terminal_id}", handleGetTerminal(registry)).Methods("GET")
+
+	manifest := buildRouteManifest(r, rateLimit, cfg.FormTokens, stack.AuthEnabled())
+	log := metrics.GetLogger()
+	if !stack.AuthEnabled() {
+		log.Warn("AUTH_DISABLED is set: payment, vault, admin, webhook, event, report, dispute, transaction and card list routes accept unauthenticated requests")
+	}
+	for _, route := range manifest.Routes {
+		log.WithFields(logrus.Fields{
+			"path":    route.Path,
+			"methods": route.Methods,
+		}).Debug("Route registered")
+	}
 
 	// Create server with timeouts
 	srv := &http.Server{
 		Addr:         ":8080",
-		Handler:      r, // Make sure router is set as handler
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Verify the NMI security key before taking traffic
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		status := client.RunCredentialCheck(ctx, cfg.Settings().APIKey)
+		fmt.Printf("Credential check: %s (%s)\n", status.State, status.Message)
+	}()
+
+	// Close the day's batch on schedule, if configured
+	stopBatchClose := make(chan struct{})
+	if cfg.BatchCloseTime != "" {
+		go scheduleBatchClose(cfg, client, hooks, stopBatchClose)
+	}
+
+	// Cancel subscriptions whose final billing period has ended
+	stopCancellations := make(chan struct{})
+	go scheduleCancellations(cfg, client, hooks, stopCancellations)
+
+	// Announce new chargebacks, if polling is configured
+	stopChargebacks := make(chan struct{})
+	if cfg.ChargebackPollInterval > 0 {
+		go scheduleChargebackPolls(cfg, client, hooks, stopChargebacks)
+	}
+
+	// Refresh registered terminals' status and the online terminals gauge
+	stopHeartbeats := make(chan struct{})
+	if cfg.TerminalHeartbeatInterval > 0 {
+		go scheduleTerminalHeartbeats(cfg, client, registry, stopHeartbeats)
+	}
+
 	// Error channel for server errors
 	errChan := make(chan error, 1)
 
-	// Start server
-	fmt.Printf("\nServer starting on port %s...\n", srv.Addr)
+	// gRPC API for internal callers, behind the same middleware as REST
+	var grpcSrv *grpc.Server
+	if cfg.GRPCPort != "" {
+		grpcLn, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			fmt.Printf("gRPC server failed: %v\n", err)
+			metrics.LogError(context.Background(), fmt.Errorf("gRPC server failed to listen: %v", err))
+			return
+		}
+		grpcSrv = grpc.NewServer(grpc.ChainUnaryInterceptor(stack.UnaryInterceptors()...))
+		paymentsv1.RegisterPaymentServiceServer(grpcSrv, newPaymentServer(cfg, client, hooks))
+		go func() {
+			fmt.Printf("gRPC API listening on port %s\n", cfg.GRPCPort)
+			if err := grpcSrv.Serve(grpcLn); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
+	// Start server on an inherited or port-sharing listener so a restarted
+	// binary can take over without refusing connections
+	log.WithFields(logrus.Fields{
+		"version":           version,
+		"addr":              srv.Addr,
+		"routes":            len(manifest.Routes),
+		"rate_limit":        rateLimit,
+		"idempotency_store": cfg.IdempotencyStore,
+		"metrics_port":      cfg.MetricsPort,
+		"grpc_port":         cfg.GRPCPort,
+		"form_tokens":       cfg.FormTokens,
+		"auth":              stack.AuthEnabled(),
+		"reuse_port":        cfg.ReusePort,
+		"debug":             cfg.DebugMode,
+	}).Info("Server starting")
+	ln, err := listener.Listen(srv.Addr, cfg.ReusePort)
+	if err != nil {
+		fmt.Printf("Server failed: %v\n", err)
+		metrics.LogError(context.Background(), fmt.Errorf("server failed to listen: %v", err))
+		return
+	}
 	go func() {
 		fmt.Println("Server is listening...")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			fmt.Printf("Server error: %v\n", err)
 			errChan <- err
 		}
 	}()
 
+	// Pick up rotated keys and new limits without a restart
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	watchConfig(reloadCtx, cfg, client, stack)
+	if binTable != nil {
+		go watchBINTable(reloadCtx, binTable, cfg.BINTableRefreshInterval)
+	}
+
 	// Wait for either shutdown signal or server error
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -165,23 +449,60 @@ func startMicroservice() {
 	select {
 	case err := <-errChan:
 		fmt.Printf("Server failed: %v\n", err)
-		metrics.LogError(fmt.Errorf("server failed: %v", err))
+		metrics.LogError(context.Background(), fmt.Errorf("server failed: %v", err))
 	case <-quit:
 		fmt.Println("Shutdown signal received...")
-		metrics.LogInfo("Shutting down server...")
+		metrics.LogInfo(context.Background(), "Shutting down server...")
+		close(stopBatchClose)
+		close(stopCancellations)
+		close(stopChargebacks)
+		close(stopHeartbeats)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
 		if err := srv.Shutdown(ctx); err != nil {
 			fmt.Printf("Server forced to shutdown: %v\n", err)
-			metrics.LogError(fmt.Errorf("server forced to shutdown: %v", err))
+			metrics.LogError(ctx, fmt.Errorf("server forced to shutdown: %v", err))
+		}
+
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(ctx)
+		}
+
+		if grpcSrv != nil {
+			grpcSrv.GracefulStop()
+		}
+
+		if err := transactions.Close(ctx); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("transactions still unrecorded at shutdown: %v", err))
+		}
+
+		if err := lifecycle.Close(ctx); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("event relay still running at shutdown: %v", err))
+		}
+
+		if err := hooks.Close(ctx); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("webhook deliveries still in flight at shutdown: %v", err))
+		}
+
+		if err := shutdownTracing(ctx); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("failed to flush traces at shutdown: %v", err))
 		}
 
 		fmt.Println("Server shutdown complete")
 	}
 }
 
+// merchantKey returns the security key of the merchant account the request
+// was routed to, falling back to the default account
+func merchantKey(ctx context.Context, cfg *config.Config) string {
+	if merchant, ok := api.MerchantFromContext(ctx); ok {
+		return merchant.APIKey
+	}
+	return cfg.Settings().APIKey
+}
+
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -190,199 +511,388 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func handleTokenize(cfg *config.Config) http.HandlerFunc {
+func handleTokenize(cfg *config.Config, client *api.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req api.PaymentRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		if !decodePaymentRequest(w, r, &req) {
 			return
 		}
 
-		req.APIKey = cfg.APIKey
-		resp, err := api.ProcessTokenization(r.Context(), req)
+		req.APIKey = merchantKey(r.Context(), cfg)
+		resp, err := client.ProcessTokenization(r.Context(), req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			api.WriteError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("TOKENIZE: Customer Vault ID=%s, Response=SUCCESS", resp.CustomerVaultID))
+		LogTransaction(r.Context(), fmt.Sprintf("TOKENIZE: Customer Vault ID=%s, Response=SUCCESS", resp.CustomerVaultID))
+	}
+}
+
+// decodePaymentRequest decodes a sale, auth or tokenize body. An amount that
+// cannot be normalized is reported as a structured invalid-amount error
+// rather than a generic bad payload.
+func decodePaymentRequest(w http.ResponseWriter, r *http.Request, req *api.PaymentRequest) bool {
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err == nil {
+		return true
 	}
+
+	var nmiErr *api.NMIError
+	if errors.As(err, &nmiErr) {
+		api.WriteError(w, r, nmiErr)
+	} else {
+		api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+	}
+	return false
 }
 
-func handleSale(cfg *config.Config) http.HandlerFunc {
+func handleSale(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, _ := io.ReadAll(r.Body)
 		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
 		var req api.PaymentRequest
+		if !decodePaymentRequest(w, r, &req) {
+			return
+		}
+
+		req.APIKey = merchantKey(r.Context(), cfg)
+		// Apply the merchant's receipt default when there is an address to send to
+		if req.CustomerReceipt == nil && req.Billing != nil && req.Billing.Email != "" {
+			req.CustomerReceipt = &cfg.CustomerReceipt
+		}
+
+		resp, err := client.ProcessPayment(r.Context(), req)
+		if err != nil {
+			SaveDeclinedTransaction(r.Context(), "sale", req.Amount.String(), req.OrderDescription, req.PONumber, err)
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+		// A replay was already logged, saved and announced the first time
+		if resp.IdempotentReplay {
+			return
+		}
+
+		LogTransaction(r.Context(), fmt.Sprintf("SALE: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+		SaveTransaction(r.Context(), resp.TransactionID, "sale", resp.ResponseText, req.Amount.String(), req.OrderDescription, req.PONumber)
+		hooks.Publish(contextMerchantID(r.Context()), webhooks.EventPaymentSale, resp)
+	}
+}
+
+func handleAuthorize(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.PaymentRequest
+		if !decodePaymentRequest(w, r, &req) {
+			return
+		}
+
+		req.APIKey = merchantKey(r.Context(), cfg)
+		resp, err := client.AuthorizeTransaction(r.Context(), req)
+		if err != nil {
+			SaveDeclinedTransaction(r.Context(), "auth", req.Amount.String(), req.OrderDescription, req.PONumber, err)
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+		if resp.IdempotentReplay {
+			return
+		}
+
+		LogTransaction(r.Context(), fmt.Sprintf("AUTH: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+		SaveTransaction(r.Context(), resp.TransactionID, "auth", resp.ResponseText, req.Amount.String(), req.OrderDescription, req.PONumber)
+	}
+}
+
+func handleCapture(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.CaptureRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
-		req.APIKey = cfg.APIKey
-		resp, err := api.ProcessPayment(r.Context(), req)
+		req.APIKey = merchantKey(r.Context(), cfg)
+		resp, err := client.CaptureTransaction(r.Context(), req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			api.WriteError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("SALE: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
-		SaveTransaction(resp.TransactionID, "sale", resp.ResponseText, req.Amount)
+		LogTransaction(r.Context(), fmt.Sprintf("CAPTURE: Transaction ID=%s, Amount=%s, Response=%s", resp.TransactionID, resp.Amount, resp.ResponseText))
+		SaveTransaction(r.Context(), resp.TransactionID, "capture", resp.ResponseText, resp.Amount, "", "")
 	}
 }
 
-func handleRefund(cfg *config.Config) http.HandlerFunc {
+func handleACH(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.ACHRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		req.APIKey = merchantKey(r.Context(), cfg)
+		resp, err := client.ProcessACH(r.Context(), req)
+		if err != nil {
+			SaveDeclinedTransaction(r.Context(), "ach_"+req.Type, req.Amount, req.OrderDescription, "", err)
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+		LogTransaction(r.Context(), fmt.Sprintf("ACH: Transaction ID=%s, Account=%s, Response=%s", resp.TransactionID, resp.MaskedAccount, resp.ResponseText))
+		SaveTransaction(r.Context(), resp.TransactionID, "ach_"+req.Type, resp.ResponseText, req.Amount, req.OrderDescription, "")
+	}
+}
+
+func handleRefund(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req api.RefundRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
-		req.APIKey = cfg.APIKey
-		resp, err := api.ProcessRefund(r.Context(), req)
+		req.APIKey = merchantKey(r.Context(), cfg)
+		resp, err := client.ProcessRefund(r.Context(), req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			api.WriteError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("REFUND: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
-		SaveTransaction(resp.TransactionID, "refund", resp.ResponseText, req.Amount)
+		LogTransaction(r.Context(), fmt.Sprintf("REFUND: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+		SaveTransaction(r.Context(), resp.TransactionID, "refund", resp.ResponseText, req.Amount, "", "")
+		hooks.Publish(contextMerchantID(r.Context()), webhooks.EventPaymentRefund, resp)
 	}
 }
 
-func handleVoid(cfg *config.Config) http.HandlerFunc {
+// handleListRefunds lists the refunds made through this service against a
+// sale, with the amount still refundable
+func handleListRefunds(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summary, err := client.Refunds(r.Context(), merchantKey(r.Context(), cfg), mux.Vars(r)["id"])
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+func handleVoid(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req api.VoidRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
-		req.APIKey = cfg.APIKey
-		resp, err := api.VoidTransaction(r.Context(), req)
+		req.APIKey = merchantKey(r.Context(), cfg)
+		resp, err := client.VoidTransaction(r.Context(), req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			api.WriteError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("VOID: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
-		SaveTransaction(resp.TransactionID, "void", resp.ResponseText, "0.00")
+		LogTransaction(r.Context(), fmt.Sprintf("VOID: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+		SaveTransaction(r.Context(), resp.TransactionID, "void", resp.ResponseText, "0.00", "", "")
+		hooks.Publish(contextMerchantID(r.Context()), webhooks.EventPaymentVoid, resp)
 	}
 }
 
-func handleLookup(cfg *config.Config) http.HandlerFunc {
+func handleLookup(cfg *config.Config, client *api.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		transactionID := r.URL.Query().Get("transaction_id")
+		query := r.URL.Query()
+		transactionID := query.Get("transaction_id")
 		if transactionID == "" {
-			http.Error(w, "Transaction ID is required", http.StatusBadRequest)
+			handleFindTransactions(cfg, client, w, r)
 			return
 		}
 
 		req := api.LookupRequest{
-			APIKey:        cfg.APIKey,
+			APIKey:        merchantKey(r.Context(), cfg),
 			TransactionID: transactionID,
 		}
+		if query.Get("order_id") != "" || query.Get("customer_vault_id") != "" || query.Get("customer_id") != "" {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "transaction_id cannot be combined with order_id, customer_vault_id or customer_id")
+			return
+		}
 
-		fmt.Printf("Lookup Request: %+v\n", req) // Debug log
+		log := logctx.From(r.Context()).WithField("transaction_id", transactionID)
+		log.Debug("Looking up transaction")
 
-		resp, err := api.LookupTransaction(r.Context(), req)
+		resp, err := client.LookupTransaction(r.Context(), req)
 		if err != nil {
-			metrics.LogError(fmt.Errorf("lookup Error: %v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			metrics.LogError(r.Context(), fmt.Errorf("lookup Error: %v", err))
+			api.WriteError(w, r, err)
 			return
 		}
 
-		fmt.Printf("Lookup Response: %+v\n", resp) // Debug log
+		log.WithField("response_text", resp.ResponseText).Debug("Transaction lookup complete")
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("LOOKUP: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
+		LogTransaction(r.Context(), fmt.Sprintf("LOOKUP: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
 	}
 }
 
-func handleCreateRecurring(cfg *config.Config) http.HandlerFunc {
+// handleFindTransactions answers a lookup by order_id, customer_vault_id or
+// customer_id with a page of matching transactions
+func handleFindTransactions(cfg *config.Config, client *api.Client, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := api.LookupRequest{
+		APIKey:          merchantKey(r.Context(), cfg),
+		OrderID:         query.Get("order_id"),
+		CustomerVaultID: query.Get("customer_vault_id"),
+		CustomerID:      query.Get("customer_id"),
+		Condition:       query.Get("condition"),
+		TransactionType: query.Get("transaction_type"),
+		ActionType:      query.Get("action_type"),
+	}
+
+	var err error
+	if page := query.Get("page"); page != "" {
+		if req.Page, err = strconv.Atoi(page); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "page must be a number")
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if req.Limit, err = strconv.Atoi(limit); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "limit must be a number")
+			return
+		}
+	}
+
+	results, err := client.FindTransactions(r.Context(), req)
+	if err != nil {
+		api.WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func handleCreateRecurring(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req api.RecurringPaymentRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
-		req.APIKey = cfg.APIKey
-		fmt.Printf("Received Create Recurring Request: %+v\n", req) // Debug log
+		req.APIKey = merchantKey(r.Context(), cfg)
 
-		resp, err := api.ProcessRecurringPayment(r.Context(), req)
+		resp, err := client.ProcessRecurringPayment(r.Context(), req)
 		if err != nil {
-			metrics.LogError(fmt.Errorf("recurring Payment Error: %v", err))
-			http.Error(w, fmt.Sprintf("Error: %v", err.Error()), http.StatusInternalServerError)
+			metrics.LogError(r.Context(), fmt.Errorf("recurring Payment Error: %v", err))
+			api.WriteError(w, r, err)
 			return
 		}
 
-		fmt.Printf("Recurring Payment Response: %+v\n", resp) // Debug log
+		logctx.From(r.Context()).WithField("subscription_id", resp.SubscriptionID).Debug("Recurring payment created")
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("RECURRING: Subscription ID=%s, Plan=%s, Response=%s", resp.SubscriptionID, req.PlanID, resp.Status))
+		LogTransaction(r.Context(), fmt.Sprintf("RECURRING: Subscription ID=%s, Plan=%s, Response=%s", resp.SubscriptionID, req.PlanID, resp.Status))
+		hooks.Publish(contextMerchantID(r.Context()), webhooks.EventSubscriptionCreated, resp)
 	}
 }
 
-func handleUpdateRecurring(cfg *config.Config) http.HandlerFunc {
+func handleUpdateRecurring(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		subscriptionID := vars["subscription_id"]
 
 		if subscriptionID == "" {
-			http.Error(w, "subscription_id is required", http.StatusBadRequest)
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "subscription_id is required")
 			return
 		}
 
 		var req api.RecurringPaymentRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
 			return
 		}
 
-		req.APIKey = cfg.APIKey
-		fmt.Printf("Updating Subscription ID: %s\n", subscriptionID) // Debug log
+		req.APIKey = merchantKey(r.Context(), cfg)
+		logctx.From(r.Context()).WithField("subscription_id", subscriptionID).Debug("Updating subscription")
 
-		resp, err := api.UpdateRecurringPayment(r.Context(), req, subscriptionID)
+		resp, err := client.UpdateRecurringPayment(r.Context(), req, subscriptionID)
 		if err != nil {
-			metrics.LogError(fmt.Errorf("update Recurring Payment Error: %v", err))
-			http.Error(w, fmt.Sprintf("Error: %v", err.Error()), http.StatusInternalServerError)
+			metrics.LogError(r.Context(), fmt.Errorf("update Recurring Payment Error: %v", err))
+			api.WriteError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 
-		LogTransaction(fmt.Sprintf("UPDATE RECURRING: Subscription ID=%s", subscriptionID))
+		LogTransaction(r.Context(), fmt.Sprintf("UPDATE RECURRING: Subscription ID=%s", subscriptionID))
+		hooks.Publish(contextMerchantID(r.Context()), webhooks.EventSubscriptionUpdated, resp)
 	}
 }
 
-func handleCancelRecurring(cfg *config.Config) http.HandlerFunc {
+func handleCancelRecurring(cfg *config.Config, client *api.Client, hooks *webhooks.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		subscriptionID := vars["subscription_id"]
 
-		err := api.CancelRecurringPayment(r.Context(), cfg.APIKey, subscriptionID)
+		atPeriodEnd := false
+		if raw := r.URL.Query().Get("cancel_at_period_end"); raw != "" {
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "cancel_at_period_end must be true or false")
+				return
+			}
+			atPeriodEnd = parsed
+		}
+
+		if atPeriodEnd {
+			sub, err := client.ScheduleSubscriptionCancellation(r.Context(), merchantKey(r.Context(), cfg), subscriptionID)
+			if err != nil {
+				api.WriteError(w, r, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sub)
+
+			LogTransaction(r.Context(), fmt.Sprintf("SCHEDULE CANCEL RECURRING: Subscription ID=%s, Cancel at=%s", subscriptionID, sub.CancelAt.Format(time.RFC3339)))
+			hooks.Publish(contextMerchantID(r.Context()), webhooks.EventSubscriptionUpdated, sub)
+			return
+		}
+
+		err := client.CancelRecurringPayment(r.Context(), merchantKey(r.Context(), cfg), subscriptionID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			api.WriteError(w, r, err)
 			return
 		}
 
@@ -392,102 +902,374 @@ func handleCancelRecurring(cfg *config.Config) http.HandlerFunc {
 			"message": "Subscription cancelled successfully",
 		})
 
-		LogTransaction(fmt.Sprintf("CANCEL RECURRING: Subscription ID=%s", subscriptionID))
+		LogTransaction(r.Context(), fmt.Sprintf("CANCEL RECURRING: Subscription ID=%s", subscriptionID))
+		hooks.Publish(contextMerchantID(r.Context()), webhooks.EventSubscriptionCanceled, map[string]string{"subscription_id": subscriptionID})
+	}
+}
+
+// handleWaitForTransaction blocks until a transaction reaches a final state or
+// the timeout query parameter (seconds or a Go duration) elapses. A timeout
+// returns 202 with the last observed state.
+func handleWaitForTransaction(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transactionID := mux.Vars(r)["id"]
+
+		timeout := defaultWaitTimeout
+		if raw := r.URL.Query().Get("timeout"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil {
+				seconds, convErr := strconv.Atoi(raw)
+				if convErr != nil || seconds <= 0 {
+					api.WriteErrorCode(w, r, api.ErrInvalidRequest, "timeout must be a number of seconds or a duration such as 15s")
+					return
+				}
+				parsed = time.Duration(seconds) * time.Second
+			}
+			timeout = parsed
+		}
+		if timeout > maxWaitTimeout {
+			timeout = maxWaitTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		state, err := client.WaitForTransaction(ctx, merchantKey(ctx, cfg), transactionID, api.DefaultPollBackoff)
+		status := http.StatusOK
+		if err != nil {
+			nmiErr, ok := err.(*api.NMIError)
+			if !ok || nmiErr.Code != api.ErrDeadlineExceeded {
+				metrics.LogError(r.Context(), fmt.Errorf("wait for transaction error: %v", err))
+				api.WriteError(w, r, err)
+				return
+			}
+			status = http.StatusAccepted
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(state)
 	}
 }
 
-func handleUpdatePlan() http.HandlerFunc {
+// handleSearchTransactions searches NMI's Query API. Dates accept YYYY-MM-DD
+// or RFC 3339, condition accepts a comma-separated list, and page is zero-based.
+func handleSearchTransactions(cfg *config.Config, client *api.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var plan api.Plan
-		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
-			http.Error(w, "invalid request payload", http.StatusBadRequest)
+		query := r.URL.Query()
+		search := api.TransactionSearch{
+			APIKey:          merchantKey(r.Context(), cfg),
+			TransactionType: query.Get("transaction_type"),
+			ActionType:      query.Get("action_type"),
+			OrderID:         query.Get("order_id"),
+			CustomerVaultID: query.Get("customer_vault_id"),
+		}
+
+		var err error
+		if search.StartDate, err = parseSearchDate(query.Get("start_date"), false); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "start_date must be YYYY-MM-DD or RFC 3339")
+			return
+		}
+		if search.EndDate, err = parseSearchDate(query.Get("end_date"), true); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "end_date must be YYYY-MM-DD or RFC 3339")
 			return
 		}
+		if condition := query.Get("condition"); condition != "" {
+			search.Conditions = strings.Split(condition, ",")
+		}
+		if page := query.Get("page"); page != "" {
+			if search.Page, err = strconv.Atoi(page); err != nil {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "page must be a number")
+				return
+			}
+		}
+		if limit := query.Get("limit"); limit != "" {
+			if search.Limit, err = strconv.Atoi(limit); err != nil {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "limit must be a number")
+				return
+			}
+		}
+		if search.Limit == 0 {
+			search.Limit = api.DefaultSearchLimit
+		}
 
-		// Use api.PlanStore to manage the plan update
-		api.PlanStore.Lock()
-		defer api.PlanStore.Unlock()
+		records, err := client.SearchTransactions(r.Context(), search)
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
 
-		existingPlan, exists := api.PlanStore.Data[plan.ID]
-		if !exists {
-			http.Error(w, "plan not found", http.StatusNotFound)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"transactions": records,
+			"page":         search.Page,
+			"limit":        search.Limit,
+			"has_more":     len(records) == search.Limit,
+		})
+	}
+}
+
+// parseSearchDate parses a search bound. A bare end date covers the whole day.
+func parseSearchDate(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t, nil
+}
+
+func handleSubscriptionPayments(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		subscriptionID := vars["subscription_id"]
+
+		payments, err := client.GetSubscriptionPayments(r.Context(), merchantKey(r.Context(), cfg), subscriptionID)
+		if err != nil {
+			metrics.LogError(r.Context(), fmt.Errorf("subscription payments error: %v", err))
+			api.WriteError(w, r, err)
 			return
 		}
 
-		// Update fields only if they are non-empty
-		if plan.Name != "" {
-			existingPlan.Name = plan.Name
+		resp := map[string]interface{}{
+			"subscription_id": subscriptionID,
+			"payments":        payments,
+		}
+		// Subscriptions created here also report whether they are ending
+		if sub, ok := api.GetSubscription(subscriptionID); ok {
+			resp["status"] = sub.Status
+			if sub.CancelAt != nil {
+				resp["cancel_at"] = sub.CancelAt
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleReconcilePlans brings the gateway's plans and the local ones into
+// agreement; dry_run=true only reports what would change
+func handleReconcilePlans(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+		report, err := client.ReconcilePlans(r.Context(), merchantKey(r.Context(), cfg), dryRun)
+		if err != nil {
+			metrics.LogError(r.Context(), fmt.Errorf("plan reconciliation error: %v", err))
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+		if !dryRun && len(report.Changes) > 0 {
+			LogTransaction(r.Context(), fmt.Sprintf("PLANS RECONCILED: %d changes", len(report.Changes)))
 		}
-		if plan.Amount != "" {
-			existingPlan.Amount = plan.Amount
+	}
+}
+
+// handleListSubscriptions lists subscriptions, optionally only those of a
+// customer_vault_id, plan_id or status
+func handleListSubscriptions(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := api.SubscriptionFilter{
+			CustomerVaultID: query.Get("customer_vault_id"),
+			PlanID:          query.Get("plan_id"),
+			Status:          query.Get("status"),
 		}
 
-		// Save the updated plan
-		api.PlanStore.Data[plan.ID] = existingPlan
+		subs, err := client.ListSubscriptions(r.Context(), merchantKey(r.Context(), cfg), filter)
+		if err != nil {
+			metrics.LogError(r.Context(), fmt.Errorf("list subscriptions error: %v", err))
+			api.WriteError(w, r, err)
+			return
+		}
 
-		// Respond with the updated plan
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(api.PlanResponse{
-			Plan:    existingPlan,
-			Message: "Plan updated successfully",
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"subscriptions": subs,
 		})
 	}
 }
 
-func handleTerminalInit(cfg *config.Config) http.HandlerFunc {
+func handleGetSubscription(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := mux.Vars(r)["subscription_id"]
+
+		sub, err := client.FetchSubscription(r.Context(), merchantKey(r.Context(), cfg), subscriptionID)
+		if err != nil {
+			metrics.LogError(r.Context(), fmt.Errorf("get subscription error: %v", err))
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sub)
+	}
+}
+
+func handleStartMigration(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.MigrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		req.APIKey = merchantKey(r.Context(), cfg)
+		req.MerchantID = contextMerchantID(r.Context())
+		job, err := client.StartSubscriptionMigration(req)
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.Summary())
+
+		LogTransaction(r.Context(), fmt.Sprintf("PLAN MIGRATION STARTED: %s", job))
+	}
+}
+
+func handleGetMigration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		job, exists := api.GetMigration(contextMerchantID(r.Context()), vars["id"])
+		if !exists {
+			api.WriteErrorCode(w, r, api.ErrNotFound, "Migration not found")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.Summary())
+	}
+}
+
+// handleCancelMigration stops a running migration before its next gateway
+// update. The job reports cancelled once the update in flight, if any, has
+// finished.
+func handleCancelMigration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, exists := api.GetMigration(contextMerchantID(r.Context()), mux.Vars(r)["id"])
+		if !exists {
+			api.WriteErrorCode(w, r, api.ErrNotFound, "Migration not found")
+			return
+		}
+		job.Cancel()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.Summary())
+
+		LogTransaction(r.Context(), fmt.Sprintf("PLAN MIGRATION CANCELLED: %s", job))
+	}
+}
+
+// terminalInitResponse adds the device's assignment and configuration to
+// the gateway's answer for mapped terminals
+type terminalInitResponse struct {
+	*api.TerminalResponse
+	Device *terminal.DeviceSync `json:"device,omitempty"`
+}
+
+func handleTerminalInit(cfg *config.Config, client *api.Client, terminals terminal.Store, registry terminal.Registry) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         var req api.TerminalInitRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            http.Error(w, "Invalid request payload", http.StatusBadRequest)
+            api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+            return
+        }
+
+        // A mapped terminal always initializes for its assigned merchant
+        var device *terminal.DeviceSync
+        mapping, err := terminals.Get(r.Context(), req.TerminalID)
+        switch {
+        case err == nil:
+            if req.MerchantID != "" && req.MerchantID != mapping.MerchantID {
+                api.WriteErrorCode(w, r, api.ErrConflict, fmt.Sprintf("Terminal %s is assigned to merchant %s", req.TerminalID, mapping.MerchantID))
+                return
+            }
+            req.MerchantID = mapping.MerchantID
+            device = terminal.Sync(mapping, req.ConfigVersion)
+        case !errors.Is(err, terminal.ErrNotFound):
+            metrics.LogError(r.Context(), fmt.Errorf("failed to load terminal mapping: %v", err))
+            api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load terminal mapping")
             return
         }
 
-        req.APIKey = cfg.APIKey
-        resp, err := api.ProcessTerminalInit(r.Context(), req)
+        req.APIKey = merchantKey(r.Context(), cfg)
+        resp, err := client.ProcessTerminalInit(r.Context(), req)
         if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+            api.WriteError(w, r, err)
             return
         }
+        recordTerminal(r.Context(), registry, resp.Terminal)
 
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(resp)
+        json.NewEncoder(w).Encode(terminalInitResponse{TerminalResponse: resp, Device: device})
     }
 }
 
-func handleTerminalPayment(cfg *config.Config) http.HandlerFunc {
+func handleTerminalPayment(cfg *config.Config, sessions *terminal.Sessions) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         var req api.TerminalPaymentRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            http.Error(w, "Invalid request payload", http.StatusBadRequest)
+            api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
             return
         }
 
-        req.APIKey = cfg.APIKey
-        resp, err := api.ProcessTerminalPayment(r.Context(), req)
+        req.APIKey = merchantKey(r.Context(), cfg)
+        session, err := sessions.Start(r.Context(), contextMerchantID(r.Context()), req)
         if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+            api.WriteError(w, r, err)
             return
         }
 
+        // The cardholder is still at the terminal; the result is polled
+        // from /terminal/payment/{payment_session_id}, streamed from its
+        // events or sent as a terminal_payment.completed webhook
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(resp)
+        if !session.Finished() {
+            w.WriteHeader(http.StatusAccepted)
+        }
+        json.NewEncoder(w).Encode(session)
     }
 }
 
-func handleTerminalStatus() http.HandlerFunc {
+func handleTerminalStatus(cfg *config.Config, client *api.Client, registry terminal.Registry) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         vars := mux.Vars(r)
         terminalID := vars["terminal_id"]
 
         if terminalID == "" {
-            http.Error(w, "terminal_id is required", http.StatusBadRequest)
+            api.WriteErrorCode(w, r, api.ErrInvalidRequest, "terminal_id is required")
             return
         }
 
+        device, err := client.GetDevice(r.Context(), merchantKey(r.Context(), cfg), terminalID)
+        if err != nil {
+            api.WriteError(w, r, err)
+            return
+        }
+        recordTerminal(r.Context(), registry, device)
         status := &api.TerminalResponse{
-            Status:       "success",
-            ResponseText: fmt.Sprintf("Terminal %s is active", terminalID),
-            Success:      true,
+            Status:       device.Status,
+            TerminalID:   device.ID,
+            ResponseText: fmt.Sprintf("Terminal %s is %s", terminalID, device.Status),
+            Success:      device.Status != api.DeviceOffline,
+            Terminal:     device,
         }
 
         w.Header().Set("Content-Type", "application/json")
@@ -495,19 +1277,27 @@ func handleTerminalStatus() http.HandlerFunc {
     }
 }
 
-func handleTerminalCancel() http.HandlerFunc {
+func handleTerminalCancel(cfg *config.Config, client *api.Client, registry terminal.Registry) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         vars := mux.Vars(r)
         terminalID := vars["terminal_id"]
 
         if terminalID == "" {
-            http.Error(w, "terminal_id is required", http.StatusBadRequest)
+            api.WriteErrorCode(w, r, api.ErrInvalidRequest, "terminal_id is required")
             return
         }
 
+        if err := client.CancelDevicePrompt(r.Context(), merchantKey(r.Context(), cfg), terminalID); err != nil {
+            api.WriteError(w, r, err)
+            return
+        }
+        if err := registry.SetTransaction(r.Context(), terminalID, ""); err != nil && !errors.Is(err, terminal.ErrNotRegistered) {
+            metrics.LogError(r.Context(), fmt.Errorf("failed to clear payment on terminal %s: %v", terminalID, err))
+        }
         response := &api.TerminalResponse{
-            Status:       "success",
-            ResponseText: fmt.Sprintf("Transaction cancelled for terminal %s", terminalID),
+            Status:       api.TerminalPaymentCancelled,
+            TerminalID:   terminalID,
+            ResponseText: fmt.Sprintf("Prompt cancelled on terminal %s", terminalID),
             Success:      true,
         }
 
@@ -516,27 +1306,60 @@ func handleTerminalCancel() http.HandlerFunc {
     }
 }
 
-// Standalone mode for testing
-func runStandaloneDemo() {
-	cfg := config.LoadConfig()
+// persistence holds the database-backed stores used when DATABASE_URL is set
+type persistence struct {
+	db        *db.DB
+	plans     *api.SQLPlanRepository
+	refunds   *api.SQLRefundLedger
+	cardLists *api.SQLCardLists
+	audit     *api.SQLAuditLog
+	events    *eventlog.SQLLog
+	fees      *fees.SQLLedger
+	terminals *terminal.SQLStore
+	registry  *terminal.SQLRegistry
+	// transactions is the history behind /transactions
+	transactions *store.SQLStore
+	outbox       *eventbus.SQLOutbox
+}
 
-	// Perform a sale transaction
-	paymentReq := api.PaymentRequest{
-		APIKey:     cfg.APIKey,
-		Amount:     "10.99",
-		CreditCard: "4111111111111111",
-		ExpDate:    "1225",
-		CVV:        "123",
-		Type:       "sale",
-	}
+// openPersistence connects to the database and migrates each store's schema
+func openPersistence(url string) (*persistence, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	resp, err := api.ProcessPayment(context.Background(), paymentReq)
+	database, err := db.Open(ctx, url)
 	if err != nil {
-		metrics.LogError(fmt.Errorf("failed to process payment: %v", err))
-		return
+		return nil, err
 	}
-
-	fmt.Printf("Sale Response: %+v\n", resp)
-	LogTransaction(fmt.Sprintf("SALE: Transaction ID=%s, Response=%s", resp.TransactionID, resp.ResponseText))
-	SaveTransaction(resp.TransactionID, "sale", resp.ResponseText, paymentReq.Amount)
+	persisted := &persistence{db: database}
+	if persisted.plans, err = api.NewSQLPlanRepository(ctx, database); err == nil {
+		persisted.refunds, err = api.NewSQLRefundLedger(ctx, database)
+	}
+	if err == nil {
+		persisted.cardLists, err = api.NewSQLCardLists(ctx, database)
+	}
+	if err == nil {
+		persisted.audit, err = api.NewSQLAuditLog(ctx, database)
+	}
+	if err == nil {
+		persisted.events, err = eventlog.NewSQLLog(ctx, database)
+	}
+	if err == nil {
+		persisted.fees, err = fees.NewSQLLedger(ctx, database)
+	}
+	if err == nil {
+		persisted.terminals, err = terminal.NewSQLStore(ctx, database)
+	}
+	if err == nil {
+		persisted.registry = terminal.NewSQLRegistry(database)
+		persisted.transactions, err = store.NewSQLStore(ctx, database)
+	}
+	if err == nil {
+		persisted.outbox, err = eventbus.NewSQLOutbox(ctx, database)
+	}
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	return persisted, nil
 }
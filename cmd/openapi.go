@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/downloads"
+	"nmi-pay-int/openapi"
+	"nmi-pay-int/store"
+	"nmi-pay-int/terminal"
+	"nmi-pay-int/webhooks"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOperation documents one route. Request and response are zero values of
+// the types the handler decodes and encodes; the schemas are generated from
+// them.
+type apiOperation struct {
+	method   string
+	path     string
+	id       string
+	tag      string
+	summary  string
+	query    []openapi.Parameter
+	request  interface{}
+	response interface{}
+	// status is the success status code, 200 when zero
+	status int
+	// paymentErrors marks handlers that report gateway failures with
+	// api.WriteError
+	paymentErrors bool
+}
+
+// Inline response shapes of handlers that encode maps
+type (
+	searchResponse struct {
+		Transactions []api.TransactionRecord `json:"transactions"`
+		Page         int                     `json:"page"`
+		Limit        int                     `json:"limit"`
+		HasMore      bool                    `json:"has_more"`
+	}
+	subscriptionPaymentsResponse struct {
+		SubscriptionID string                    `json:"subscription_id"`
+		Payments       []api.SubscriptionPayment `json:"payments"`
+		// Status and CancelAt are known for subscriptions created here
+		Status   string     `json:"status,omitempty"`
+		CancelAt *time.Time `json:"cancel_at,omitempty"`
+	}
+	// lookupResponse is a single transaction for transaction_id lookups
+	// and a page of them otherwise
+	lookupResponse struct {
+		*api.LookupResponse
+		*api.LookupResults
+	}
+	subscriptionsResponse struct {
+		Subscriptions []api.Subscription `json:"subscriptions"`
+	}
+	disputesResponse struct {
+		StartDate   time.Time        `json:"start_date"`
+		EndDate     time.Time        `json:"end_date"`
+		Chargebacks []api.Chargeback `json:"chargebacks"`
+	}
+	terminalsResponse struct {
+		Terminals []terminal.Terminal `json:"terminals"`
+	}
+	statusResponse struct {
+		Status  string `json:"status"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func queryParam(name, description string, required bool) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "query", Description: description, Required: required, Schema: &openapi.Schema{Type: "string"}}
+}
+
+// apiOperations documents the client-facing routes. Routes missing here
+// still appear in the spec, without schemas.
+var apiOperations = []apiOperation{
+	{method: "POST", path: "/payments/sale", id: "sale", tag: "payments", summary: "Charge a card, vault token or wallet",
+		request: api.PaymentRequest{}, response: api.PaymentResponse{}, paymentErrors: true},
+	{method: "POST", path: "/payments/authorize", id: "authorize", tag: "payments", summary: "Authorize a payment for later capture",
+		request: api.PaymentRequest{}, response: api.PaymentResponse{}, paymentErrors: true},
+	{method: "POST", path: "/payments/capture", id: "capture", tag: "payments", summary: "Capture an authorization, fully or partially",
+		request: api.CaptureRequest{}, response: api.CaptureResponse{}, paymentErrors: true},
+	{method: "POST", path: "/payments/ach", id: "ach", tag: "payments", summary: "Debit or credit a bank account",
+		request: api.ACHRequest{}, response: api.ACHResponse{}, paymentErrors: true},
+	{method: "POST", path: "/payments/batch", id: "startSaleBatch", tag: "payments", summary: "Charge a batch of sales in the background",
+		request: api.SaleBatchRequest{}, response: api.SaleBatchSummary{}, status: http.StatusAccepted},
+	{method: "GET", path: "/payments/batch/{id}", id: "getSaleBatch", tag: "payments", summary: "Get a sale batch's progress and per-sale results",
+		response: api.SaleBatchSummary{}},
+	{method: "POST", path: "/payments/refund", id: "refund", tag: "payments", summary: "Refund a settled transaction",
+		request: api.RefundRequest{}, response: api.RefundResponse{}},
+	{method: "POST", path: "/payments/void", id: "void", tag: "payments", summary: "Void an unsettled transaction",
+		request: api.VoidRequest{}, response: api.VoidResponse{}},
+	{method: "POST", path: "/payments/tokenize", id: "tokenize", tag: "payments", summary: "Store a card in the customer vault",
+		request: api.PaymentRequest{}, response: api.TokenizeResponse{}, paymentErrors: true},
+	{method: "GET", path: "/payments/lookup", id: "lookup", tag: "payments", summary: "Look up a transaction, or the transactions for an order or customer",
+		query: []openapi.Parameter{
+			queryParam("transaction_id", "Gateway transaction ID; answered with the one transaction", false),
+			queryParam("order_id", "Without transaction_id: answered with a page of transactions", false),
+			queryParam("customer_vault_id", "Without transaction_id: answered with a page of transactions", false),
+			queryParam("customer_id", "Without transaction_id: answered with a page of transactions", false),
+			queryParam("page", "Zero-based page number", false),
+			queryParam("limit", "Page size, default "+strconv.Itoa(api.DefaultSearchLimit), false),
+		},
+		response: lookupResponse{}},
+	{method: "GET", path: "/payments/{id}/wait", id: "waitForTransaction", tag: "payments", summary: "Wait for a transaction to reach a final state",
+		query:    []openapi.Parameter{queryParam("timeout", "Seconds or a Go duration, at most 20s; a timeout answers 202 with the last state", false)},
+		response: api.TransactionState{}},
+	{method: "GET", path: "/payments/{id}/refunds", id: "listRefunds", tag: "payments", summary: "List a transaction's refunds and the amount left to refund",
+		response: api.RefundSummary{}, paymentErrors: true},
+	{method: "GET", path: "/transactions/search", id: "searchTransactions", tag: "payments", summary: "Search transactions",
+		query: []openapi.Parameter{
+			queryParam("start_date", "YYYY-MM-DD or RFC 3339", false),
+			queryParam("end_date", "YYYY-MM-DD or RFC 3339; a bare date covers the whole day", false),
+			queryParam("condition", "Comma-separated transaction conditions", false),
+			queryParam("transaction_type", "", false),
+			queryParam("action_type", "", false),
+			queryParam("order_id", "", false),
+			queryParam("customer_vault_id", "", false),
+			queryParam("page", "Zero-based page number", false),
+			queryParam("limit", "Page size, default "+strconv.Itoa(api.DefaultSearchLimit), false),
+		},
+		response: searchResponse{}, paymentErrors: true},
+	{method: "GET", path: "/transactions", id: "listTransactions", tag: "payments", summary: "List transactions processed by this service, newest first",
+		query: []openapi.Parameter{
+			queryParam("type", "Comma-separated types: sale, auth, capture, refund, void, ach_sale, ...", false),
+			queryParam("status", "Comma-separated statuses: approved, declined, error", false),
+			queryParam("start_date", "YYYY-MM-DD or RFC 3339", false),
+			queryParam("end_date", "YYYY-MM-DD or RFC 3339; a bare date covers the whole day", false),
+			queryParam("min_amount", "Inclusive, e.g. 10.00", false),
+			queryParam("max_amount", "Inclusive, e.g. 250.00", false),
+			queryParam("cursor", "next_cursor from the previous page", false),
+			queryParam("limit", "Page size, default "+strconv.Itoa(store.DefaultLimit)+", at most "+strconv.Itoa(store.MaxLimit), false),
+		},
+		response: store.Page{}},
+	{method: "GET", path: "/reports/settlements", id: "settlementReport", tag: "reports", summary: "Report settled batches with totals and transactions",
+		query: []openapi.Parameter{
+			queryParam("start_date", "YYYY-MM-DD or RFC 3339", true),
+			queryParam("end_date", "YYYY-MM-DD or RFC 3339; a bare date covers the whole day", true),
+			queryParam("format", "json (default) or csv, one row per settled transaction", false),
+		},
+		response: api.SettlementReport{}, paymentErrors: true},
+	{method: "GET", path: "/disputes", id: "listDisputes", tag: "reports", summary: "List chargebacks raised against transactions",
+		query: []openapi.Parameter{
+			queryParam("start_date", "YYYY-MM-DD or RFC 3339; 30 days before end_date by default", false),
+			queryParam("end_date", "YYYY-MM-DD or RFC 3339; now by default", false),
+		},
+		response: disputesResponse{}, paymentErrors: true},
+
+	{method: "POST", path: "/cards/lists", id: "addCardListEntry", tag: "cards", summary: "Block or allow a card by fingerprint or number",
+		request: cardListRequest{}, response: api.CardListEntry{}, status: http.StatusCreated},
+	{method: "GET", path: "/cards/lists", id: "listCardListEntries", tag: "cards", summary: "List the merchant's blocked and allowed cards",
+		query: []openapi.Parameter{
+			queryParam("list", "block or allow; both when omitted", false),
+		},
+		response: cardListResponse{}},
+	{method: "DELETE", path: "/cards/lists/{fingerprint}", id: "deleteCardListEntry", tag: "cards", summary: "Take a card off the merchant's lists",
+		status: http.StatusNoContent},
+
+	{method: "GET", path: "/audit", id: "listAuditRecords", tag: "audit", summary: "List the merchant's audit records of money-moving calls",
+		query: []openapi.Parameter{
+			queryParam("from_seq", "First sequence number to return, default 1", false),
+			queryParam("limit", "Page size, default 100, at most 1000", false),
+		},
+		response: auditResponse{}},
+	{method: "GET", path: "/audit/verify", id: "verifyAuditLog", tag: "audit", summary: "Check the audit log's hash chain",
+		response: api.AuditVerification{}},
+
+	{method: "GET", path: "/vault/customers/{id}", id: "getVaultCustomer", tag: "vault", summary: "Get a vault record",
+		response: api.VaultCustomer{}, paymentErrors: true},
+	{method: "PUT", path: "/vault/customers/{id}", id: "updateVaultCustomer", tag: "vault", summary: "Update a vault record",
+		request: api.VaultUpdateRequest{}, response: api.VaultResponse{}, paymentErrors: true},
+	{method: "DELETE", path: "/vault/customers/{id}", id: "deleteVaultCustomer", tag: "vault", summary: "Delete a vault record",
+		response: api.VaultResponse{}, paymentErrors: true},
+
+	{method: "POST", path: "/payments/recurring/create", id: "createSubscription", tag: "recurring", summary: "Subscribe a vault customer to a plan",
+		request: api.RecurringPaymentRequest{}, response: api.RecurringResponse{}},
+	{method: "PUT", path: "/payments/recurring/update/{subscription_id}", id: "updateSubscription", tag: "recurring", summary: "Update a subscription",
+		request: api.RecurringPaymentRequest{}, response: api.RecurringResponse{}},
+	{method: "DELETE", path: "/payments/recurring/cancel/{subscription_id}", id: "cancelSubscription", tag: "recurring", summary: "Cancel a subscription",
+		query: []openapi.Parameter{
+			queryParam("cancel_at_period_end", "true to cancel when the current billing period ends; the scheduled subscription is returned instead", false),
+		},
+		response: statusResponse{}},
+	{method: "GET", path: "/payments/recurring/{subscription_id}/payments", id: "listSubscriptionPayments", tag: "recurring", summary: "List a subscription's payments",
+		response: subscriptionPaymentsResponse{}},
+	{method: "GET", path: "/payments/recurring", id: "listSubscriptions", tag: "recurring", summary: "List subscriptions",
+		query: []openapi.Parameter{
+			queryParam("customer_vault_id", "Only this vault customer's subscriptions", false),
+			queryParam("plan_id", "Only subscriptions on this plan", false),
+			queryParam("status", "active, pending_cancellation or cancelled", false),
+		},
+		response: subscriptionsResponse{}, paymentErrors: true},
+	{method: "GET", path: "/payments/recurring/{subscription_id}", id: "getSubscription", tag: "recurring", summary: "Get a subscription",
+		response: api.Subscription{}, paymentErrors: true},
+
+	{method: "POST", path: "/plans/add", id: "addPlan", tag: "plans", summary: "Add a plan",
+		request: api.AddPlanRequest{}, response: api.PlanResponse{}},
+	{method: "PUT", path: "/plans/update", id: "updatePlan", tag: "plans", summary: "Update a plan; send If-Match to avoid lost updates",
+		request: api.Plan{}, response: api.PlanResponse{}},
+	{method: "DELETE", path: "/plans/cancel/{id}", id: "cancelPlan", tag: "plans", summary: "Cancel a plan",
+		response: statusResponse{}},
+	{method: "GET", path: "/plans/list", id: "listPlans", tag: "plans", summary: "List plans keyed by plan ID",
+		response: map[string]api.Plan{}},
+	{method: "POST", path: "/plans/reconcile", id: "reconcilePlans", tag: "plans", summary: "Make the gateway's plans match the local ones",
+		query: []openapi.Parameter{
+			queryParam("dry_run", "true to report the changes without making them", false),
+		},
+		response: api.PlanReconciliation{}, paymentErrors: true},
+
+	{method: "POST", path: "/terminal/init", id: "initTerminal", tag: "terminal", summary: "Register a terminal and sync its configuration",
+		request: api.TerminalInitRequest{}, response: terminalInitResponse{}},
+	{method: "POST", path: "/terminal/payment", id: "terminalPayment", tag: "terminal", summary: "Start a card-present payment session",
+		request: api.TerminalPaymentRequest{}, response: terminal.PaymentSession{}, status: http.StatusAccepted, paymentErrors: true},
+	{method: "GET", path: "/terminal/payment/{payment_session_id}", id: "getTerminalPayment", tag: "terminal", summary: "Get a terminal payment session and its result",
+		response: terminal.PaymentSession{}},
+	{method: "GET", path: "/terminal/status/{terminal_id}", id: "getTerminalStatus", tag: "terminal", summary: "Report whether a terminal is connected",
+		response: api.TerminalResponse{}},
+	{method: "POST", path: "/terminal/cancel/{terminal_id}", id: "cancelTerminalPrompt", tag: "terminal", summary: "Cancel the payment prompt a terminal is showing",
+		response: api.TerminalResponse{}},
+	{method: "GET", path: "/terminal/list", id: "listTerminals", tag: "terminal", summary: "List the merchant's registered terminals",
+		response: terminalsResponse{}},
+	{method: "GET", path: "/terminal/{terminal_id}", id: "getTerminal", tag: "terminal", summary: "Get a registered terminal and its last heartbeat",
+		response: terminal.Terminal{}},
+	{method: "GET", path: "/terminal/config/{terminal_id}", id: "getTerminalConfig", tag: "terminal", summary: "Get a terminal's device configuration",
+		response: terminal.DeviceSync{}},
+
+	{method: "POST", path: "/webhooks", id: "createWebhook", tag: "webhooks", summary: "Register a webhook endpoint",
+		request: webhooks.EndpointRequest{}, response: webhooks.Endpoint{}, status: http.StatusCreated},
+	{method: "GET", path: "/webhooks", id: "listWebhooks", tag: "webhooks", summary: "List webhook endpoints",
+		response: []webhooks.Endpoint{}},
+	{method: "GET", path: "/webhooks/{id}", id: "getWebhook", tag: "webhooks", summary: "Get a webhook endpoint",
+		response: webhooks.Endpoint{}},
+	{method: "PUT", path: "/webhooks/{id}", id: "updateWebhook", tag: "webhooks", summary: "Update a webhook endpoint",
+		request: webhooks.EndpointRequest{}, response: webhooks.Endpoint{}},
+	{method: "DELETE", path: "/webhooks/{id}", id: "deleteWebhook", tag: "webhooks", summary: "Delete a webhook endpoint",
+		status: http.StatusNoContent},
+	{method: "GET", path: "/webhooks/dead-letters", id: "listDeadLetters", tag: "webhooks", summary: "List deliveries that exhausted their retries",
+		response: []webhooks.DeadLetter{}},
+
+	{method: "POST", path: "/admin/links", id: "createDownloadLink", tag: "admin", summary: "Mint a signed download link",
+		request: downloads.LinkRequest{}, response: downloads.LinkResponse{}},
+	{method: "POST", path: "/admin/subscriptions/migrate", id: "startPlanMigration", tag: "admin", summary: "Move subscriptions between plans",
+		request: api.MigrationRequest{}, response: api.MigrationSummary{}, status: http.StatusAccepted},
+	{method: "GET", path: "/admin/subscriptions/migrations/{id}", id: "getPlanMigration", tag: "admin", summary: "Get a plan migration's progress",
+		response: api.MigrationSummary{}},
+	{method: "POST", path: "/admin/subscriptions/migrations/{id}/cancel", id: "cancelPlanMigration", tag: "admin", summary: "Stop a running plan migration",
+		response: api.MigrationSummary{}, status: http.StatusAccepted},
+	{method: "POST", path: "/admin/batch/close", id: "closeBatch", tag: "admin", summary: "Close the day's batch",
+		request: batchCloseRequest{}, response: api.BatchSummary{}},
+	{method: "PUT", path: "/admin/terminals/{terminal_id}", id: "putTerminalMapping", tag: "admin", summary: "Map a terminal to a merchant and lane",
+		request: terminal.Mapping{}, response: terminal.Mapping{}},
+}
+
+// describeSchemas declares what reflection cannot see: custom JSON encodings
+// and the fields handlers reject requests without
+func describeSchemas(s *openapi.Schemas) {
+	s.Override(api.Amount(""), openapi.Schema{
+		Type:        "string",
+		Pattern:     `^\d+\.\d+$`,
+		Example:     "10.99",
+		Description: "Dollar amount with a decimal point; a JSON number is accepted too",
+	})
+	var reasons []string
+	for _, reason := range api.DeclineReasons {
+		reasons = append(reasons, string(reason))
+	}
+	s.Override(api.DeclineReason(""), openapi.Schema{
+		Type:        "string",
+		Enum:        reasons,
+		Description: "Normalized reason the gateway refused the transaction",
+	})
+	var categories []string
+	for _, category := range api.DeclineCategories {
+		categories = append(categories, string(category))
+	}
+	s.Override(api.DeclineCategory(""), openapi.Schema{
+		Type:        "string",
+		Enum:        categories,
+		Description: "What to do about a refusal; insufficient_funds, limit_exceeded, do_not_honor, try_again_later and processor_error may be retried later",
+	})
+	s.Require(api.RefundRequest{}, "transaction_id")
+	s.Require(api.VoidRequest{}, "transaction_id")
+	s.Require(cardListRequest{}, "list")
+	s.Require(api.CaptureRequest{}, "transaction_id")
+	s.Require(api.ACHRequest{}, "amount", "checkname", "checkaba", "checkaccount")
+	s.Require(api.MigrationRequest{}, "from_plan_id", "to_plan_id")
+	s.Require(webhooks.EndpointRequest{}, "url")
+	s.Require(downloads.LinkRequest{}, "resource")
+}
+
+// pathParamPattern matches mux path variables, with or without a pattern
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+// buildOpenAPI documents every route registered on r, using apiOperations
+// for the schemas of the routes it covers
+func buildOpenAPI(r *mux.Router) *openapi.Document {
+	schemas := openapi.NewSchemas()
+	describeSchemas(schemas)
+	nmiError := schemas.Ref(api.NMIError{})
+
+	documented := make(map[string]apiOperation, len(apiOperations))
+	for _, op := range apiOperations {
+		documented[op.method+" "+op.path] = op
+	}
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "NMI Payment Integration",
+			Description: "Payments, customer vault, recurring billing and terminal operations on the NMI gateway.",
+			Version:     version,
+		},
+		Paths: make(map[string]openapi.PathItem),
+	}
+	tags := make(map[string]bool)
+
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+
+		path := pathParamPattern.ReplaceAllString(template, "{$1}")
+		item := doc.Paths[path]
+		if item == nil {
+			item = make(openapi.PathItem)
+			doc.Paths[path] = item
+		}
+
+		for _, method := range methods {
+			op, ok := documented[method+" "+template]
+			if !ok {
+				op = apiOperation{method: method, path: template, tag: routeTag(template)}
+			}
+			tags[op.tag] = true
+			item[strings.ToLower(method)] = describeOperation(op, path, schemas, nmiError)
+		}
+		return nil
+	})
+
+	for tag := range tags {
+		doc.Tags = append(doc.Tags, openapi.Tag{Name: tag})
+	}
+	sort.Slice(doc.Tags, func(i, j int) bool { return doc.Tags[i].Name < doc.Tags[j].Name })
+	doc.Components.Schemas = schemas.Components()
+	return doc
+}
+
+// describeOperation turns an apiOperation into its OpenAPI form
+func describeOperation(op apiOperation, path string, schemas *openapi.Schemas, nmiError *openapi.Schema) *openapi.Operation {
+	operation := &openapi.Operation{
+		OperationID: op.id,
+		Summary:     op.summary,
+		Tags:        []string{op.tag},
+		Responses:   make(map[string]openapi.Response),
+	}
+
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		operation.Parameters = append(operation.Parameters, openapi.Parameter{
+			Name: match[1], In: "path", Required: true, Schema: &openapi.Schema{Type: "string"},
+		})
+	}
+	operation.Parameters = append(operation.Parameters, op.query...)
+
+	errorContent := map[string]openapi.MediaType{"application/json": {Schema: nmiError}}
+	if op.request != nil {
+		operation.RequestBody = &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{"application/json": {Schema: schemas.Ref(op.request)}},
+		}
+		operation.Responses["400"] = openapi.Response{Description: "Invalid request payload", Content: errorContent}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := openapi.Response{Description: http.StatusText(status)}
+	if op.response != nil {
+		success.Content = map[string]openapi.MediaType{"application/json": {Schema: schemas.Ref(op.response)}}
+	}
+	operation.Responses[strconv.Itoa(status)] = success
+
+	if op.paymentErrors {
+		operation.Responses["400"] = openapi.Response{Description: "Invalid payment details", Content: errorContent}
+		operation.Responses["401"] = openapi.Response{Description: "Merchant credentials rejected by the gateway", Content: errorContent}
+		operation.Responses["402"] = openapi.Response{Description: "Declined by the gateway", Content: errorContent}
+		operation.Responses["409"] = openapi.Response{Description: "Duplicate transaction", Content: errorContent}
+		operation.Responses["502"] = openapi.Response{Description: "Gateway unavailable", Content: errorContent}
+		operation.Responses["504"] = openapi.Response{Description: "Gateway did not answer in time", Content: errorContent}
+	}
+	return operation
+}
+
+// routeTag groups an undocumented route by its first path segment
+func routeTag(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if segment == "" {
+		return "default"
+	}
+	return segment
+}
+
+// handleOpenAPI serves the specification for the routes registered on r
+func handleOpenAPI(r *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildOpenAPI(r))
+	}
+}
+
+// swaggerUIPage renders /openapi.json with Swagger UI from a CDN
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>NMI Payment Integration API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// handleSwaggerUI serves the interactive API documentation
+func handleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/openapi"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	r := mux.NewRouter()
+	r.HandleFunc("/payments/sale", noop).Methods("POST")
+	r.HandleFunc("/payments/recurring/update/{subscription_id}", noop).Methods("PUT")
+	r.HandleFunc("/downloads/{resource:.+}", noop).Methods("GET")
+	r.HandleFunc("/openapi.json", handleOpenAPI(r)).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var doc openapi.Document
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&doc))
+	assert.Equal(t, openapi.Version, doc.OpenAPI)
+
+	sale := doc.Paths["/payments/sale"]["post"]
+	require.NotNil(t, sale)
+	assert.Equal(t, "#/components/schemas/PaymentRequest", sale.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Contains(t, sale.Responses, "402")
+
+	payment := doc.Components.Schemas["PaymentRequest"]
+	require.NotNil(t, payment)
+	assert.Equal(t, `^\d+\.\d+$`, payment.Properties["amount"].Pattern)
+	assert.Equal(t, "#/components/schemas/BillingInfo", payment.Properties["billing"].Ref)
+	assert.NotContains(t, payment.Properties, "APIKey")
+
+	update := doc.Paths["/payments/recurring/update/{subscription_id}"]["put"]
+	require.NotNil(t, update)
+	assert.Equal(t, "#/components/schemas/RecurringPaymentRequest", update.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, "subscription_id", update.Parameters[0].Name)
+
+	// Undocumented routes are still listed, with mux patterns stripped
+	download := doc.Paths["/downloads/{resource}"]["get"]
+	require.NotNil(t, download)
+	assert.Equal(t, "resource", download.Parameters[0].Name)
+	assert.Equal(t, []string{"downloads"}, download.Tags)
+}
+
+// Operation IDs become method names in generated SDKs, so they must be unique
+func TestOpenAPIOperationsAreUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, op := range apiOperations {
+		key := op.method + " " + op.path
+		assert.False(t, seen[key], "duplicate operation %s", key)
+		assert.False(t, ids[op.id], "duplicate operation ID %s", op.id)
+		seen[key], ids[op.id] = true, true
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+const plansUsage = `usage:
+  plans export [-o plans.yaml]
+  plans apply -f plans.yaml [--prune] [--dry-run]
+
+Plans are read from and written to the database at DATABASE_URL. Unless
+PLAN_GATEWAY_SYNC=false, apply also creates, updates and deletes them at
+the gateway.`
+
+// planCatalog is the YAML document exported and applied by the plans
+// command, so a plan catalog can be version-controlled and promoted between
+// environments
+type planCatalog struct {
+	Plans []planSpec `yaml:"plans"`
+}
+
+// planSpec is a plan definition without its version, which belongs to each
+// environment's database
+type planSpec struct {
+	ID             string `yaml:"id"`
+	Name           string `yaml:"name"`
+	Amount         string `yaml:"amount"`
+	DayFrequency   string `yaml:"day_frequency,omitempty"`
+	Payments       string `yaml:"payments,omitempty"`
+	MonthFrequency string `yaml:"month_frequency,omitempty"`
+	DayOfMonth     string `yaml:"day_of_month,omitempty"`
+}
+
+func (s planSpec) plan() api.Plan {
+	return api.Plan{
+		ID:             s.ID,
+		Name:           s.Name,
+		Amount:         s.Amount,
+		DayFrequency:   s.DayFrequency,
+		Payments:       s.Payments,
+		MonthFrequency: s.MonthFrequency,
+		DayOfMonth:     s.DayOfMonth,
+	}
+}
+
+func specFor(plan api.Plan) planSpec {
+	return planSpec{
+		ID:             plan.ID,
+		Name:           plan.Name,
+		Amount:         plan.Amount,
+		DayFrequency:   plan.DayFrequency,
+		Payments:       plan.Payments,
+		MonthFrequency: plan.MonthFrequency,
+		DayOfMonth:     plan.DayOfMonth,
+	}
+}
+
+// Actions reported by applyPlans
+const (
+	planCreated   = "created"
+	planUpdated   = "updated"
+	planUnchanged = "unchanged"
+	planDeleted   = "deleted"
+)
+
+// planChange is one action taken (or, in a dry run, planned) by applyPlans
+type planChange struct {
+	ID     string
+	Action string
+}
+
+// runPlansCommand implements the plans export and plans apply subcommands
+func runPlansCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(plansUsage)
+	}
+
+	flags := flag.NewFlagSet("plans "+args[0], flag.ContinueOnError)
+	output := flags.String("o", "", "write the catalog to this file instead of stdout")
+	file := flags.String("f", "", "catalog file to apply")
+	prune := flags.Bool("prune", false, "delete plans missing from the catalog")
+	dryRun := flags.Bool("dry-run", false, "report changes without making them")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg := config.LoadConfig()
+	if cfg.DatabaseURL == "" {
+		return errors.New("DATABASE_URL is required: plans kept in memory belong to a single running server")
+	}
+	store, err := openPersistence(cfg.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer store.db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	switch args[0] {
+	case "export":
+		w := out
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return exportPlans(ctx, store.plans, w)
+
+	case "apply":
+		if *file == "" {
+			return errors.New("plans apply: -f is required")
+		}
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		var catalog planCatalog
+		if err := yaml.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("parsing %s: %w", *file, err)
+		}
+
+		opts := []api.ClientOption{api.WithPlanRepository(store.plans), api.WithAuditLog(store.audit)}
+		if cfg.SyncPlansToGateway {
+			opts = append(opts, api.WithGatewayPlans(cfg.APIKey))
+		}
+		plans := api.NewClient(cfg, opts...).Plans()
+		changes, err := applyPlans(api.WithActor(ctx, api.ActorCLI), plans, catalog, *prune, *dryRun)
+		for _, change := range changes {
+			fmt.Fprintf(out, "%-9s %s\n", change.Action, change.ID)
+		}
+		if err == nil && *dryRun {
+			fmt.Fprintln(out, "dry run: no changes made")
+		}
+		return err
+
+	default:
+		return errors.New(plansUsage)
+	}
+}
+
+// exportPlans writes every plan as a YAML catalog, ordered by ID
+func exportPlans(ctx context.Context, plans api.PlanRepository, w io.Writer) error {
+	list, err := plans.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	catalog := planCatalog{Plans: make([]planSpec, 0, len(list))}
+	for _, plan := range list {
+		catalog.Plans = append(catalog.Plans, specFor(plan))
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(catalog); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// applyPlans makes the stored plans match the catalog. Applying the same
+// catalog twice changes nothing the second time. Plans missing from the
+// catalog are kept unless prune is set.
+func applyPlans(ctx context.Context, plans api.PlanRepository, catalog planCatalog, prune, dryRun bool) ([]planChange, error) {
+	wanted := make(map[string]bool, len(catalog.Plans))
+	for i, spec := range catalog.Plans {
+		if spec.ID == "" || spec.Name == "" || spec.Amount == "" {
+			return nil, fmt.Errorf("plan %d: id, name and amount are required", i+1)
+		}
+		if wanted[spec.ID] {
+			return nil, fmt.Errorf("plan %s: defined more than once", spec.ID)
+		}
+		amount, err := api.ParseAmount(spec.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("plan %s: %w", spec.ID, err)
+		}
+		catalog.Plans[i].Amount = amount.String()
+		wanted[spec.ID] = true
+	}
+
+	existing, err := plans.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]api.Plan, len(existing))
+	for _, plan := range existing {
+		current[plan.ID] = plan
+	}
+
+	var changes []planChange
+	for _, spec := range catalog.Plans {
+		plan, exists := current[spec.ID]
+		switch {
+		case !exists:
+			if !dryRun {
+				if _, err := plans.Create(ctx, spec.plan()); err != nil {
+					return changes, fmt.Errorf("creating plan %s: %w", spec.ID, err)
+				}
+			}
+			changes = append(changes, planChange{ID: spec.ID, Action: planCreated})
+
+		case specFor(plan) != spec:
+			if !dryRun {
+				update := spec.plan()
+				update.Version = plan.Version
+				if _, err := plans.Update(ctx, update); err != nil {
+					return changes, fmt.Errorf("updating plan %s: %w", spec.ID, err)
+				}
+			}
+			changes = append(changes, planChange{ID: spec.ID, Action: planUpdated})
+
+		default:
+			changes = append(changes, planChange{ID: spec.ID, Action: planUnchanged})
+		}
+	}
+
+	if prune {
+		var stale []string
+		for id := range current {
+			if !wanted[id] {
+				stale = append(stale, id)
+			}
+		}
+		sort.Strings(stale)
+		for _, id := range stale {
+			if !dryRun {
+				if err := plans.Delete(ctx, id); err != nil {
+					return changes, fmt.Errorf("deleting plan %s: %w", id, err)
+				}
+			}
+			changes = append(changes, planChange{ID: id, Action: planDeleted})
+		}
+	}
+
+	return changes, nil
+}
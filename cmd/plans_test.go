@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"nmi-pay-int/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const catalogYAML = `
+plans:
+  - id: gold
+    name: Gold
+    amount: "20"
+    month_frequency: "1"
+    day_of_month: "1"
+  - id: silver
+    name: Silver
+    amount: "10.00"
+    month_frequency: "1"
+    day_of_month: "15"
+`
+
+func TestApplyPlansIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	plans := api.NewMemoryPlanRepository()
+	_, err := plans.Create(ctx, api.Plan{ID: "bronze", Name: "Bronze", Amount: "5.00"})
+	require.NoError(t, err)
+
+	var catalog planCatalog
+	require.NoError(t, yaml.Unmarshal([]byte(catalogYAML), &catalog))
+	catalog.Plans[0].Amount = "20.00"
+
+	changes, err := applyPlans(ctx, plans, catalog, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, []planChange{{"gold", planCreated}, {"silver", planCreated}}, changes)
+
+	changes, err = applyPlans(ctx, plans, catalog, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, []planChange{{"gold", planUnchanged}, {"silver", planUnchanged}}, changes)
+
+	catalog.Plans[1].Amount = "12.50"
+	changes, err = applyPlans(ctx, plans, catalog, true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []planChange{{"gold", planUnchanged}, {"silver", planUpdated}, {"bronze", planDeleted}}, changes)
+	silver, err := plans.Get(ctx, "silver")
+	require.NoError(t, err)
+	assert.Equal(t, "10.00", silver.Amount, "dry run must not change plans")
+
+	_, err = applyPlans(ctx, plans, catalog, true, false)
+	require.NoError(t, err)
+	silver, err = plans.Get(ctx, "silver")
+	require.NoError(t, err)
+	assert.Equal(t, "12.50", silver.Amount)
+	assert.Equal(t, 2, silver.Version)
+	_, err = plans.Get(ctx, "bronze")
+	assert.ErrorIs(t, err, api.ErrPlanNotFound)
+}
+
+func TestApplyPlansValidatesCatalog(t *testing.T) {
+	plans := api.NewMemoryPlanRepository()
+
+	_, err := applyPlans(context.Background(), plans, planCatalog{Plans: []planSpec{{ID: "gold", Name: "Gold"}}}, false, false)
+	assert.ErrorContains(t, err, "amount are required")
+
+	_, err = applyPlans(context.Background(), plans, planCatalog{Plans: []planSpec{{ID: "gold", Name: "Gold", Amount: "1099"}}}, false, false)
+	assert.Error(t, err)
+
+	dup := planSpec{ID: "gold", Name: "Gold", Amount: "10.00"}
+	_, err = applyPlans(context.Background(), plans, planCatalog{Plans: []planSpec{dup, dup}}, false, false)
+	assert.ErrorContains(t, err, "more than once")
+}
+
+func TestExportPlansRoundTrips(t *testing.T) {
+	ctx := context.Background()
+	source := api.NewMemoryPlanRepository()
+	var catalog planCatalog
+	require.NoError(t, yaml.Unmarshal([]byte(catalogYAML), &catalog))
+	catalog.Plans[0].Amount = "20.00"
+	_, err := applyPlans(ctx, source, catalog, false, false)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, exportPlans(ctx, source, &out))
+	assert.NotContains(t, out.String(), "version")
+
+	var exported planCatalog
+	require.NoError(t, yaml.Unmarshal(out.Bytes(), &exported))
+	assert.Equal(t, catalog, exported)
+}
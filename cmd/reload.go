@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/bins"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/middleware"
+)
+
+// watchConfig reloads cfg on SIGHUP and, when CONFIG_WATCH_INTERVAL is set,
+// whenever .env or MERCHANTS_FILE changes, until ctx is done. With
+// SECRETS_BACKEND the security key is refreshed from the backend as well. Security keys,
+// merchants and the gateway timeout are read from cfg on every request; the
+// rate limit and log level are pushed to stack and the logger here.
+func watchConfig(ctx context.Context, cfg *config.Config, client *api.Client, stack *middleware.Stack) {
+	reloaded := applyReload(cfg, client, stack)
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				reloaded(cfg.Reload())
+			}
+		}
+	}()
+
+	if cfg.ConfigWatchInterval > 0 {
+		go cfg.Watch(ctx, cfg.ConfigWatchInterval, reloaded)
+	}
+	if cfg.SecretsBackend != "" {
+		go cfg.RefreshSecrets(ctx, applySecretRefresh(cfg, client))
+	}
+}
+
+// watchBINTable rereads BIN_TABLE_FILE every interval once it changes,
+// keeping the loaded table when the new file is invalid
+func watchBINTable(ctx context.Context, table *bins.Table, interval time.Duration) {
+	table.Watch(ctx, interval, func(changed bool, err error) {
+		switch {
+		case err != nil:
+			metrics.BINTableRefreshes.WithLabelValues("failed").Inc()
+			metrics.LogError(ctx, fmt.Errorf("could not refresh BIN_TABLE_FILE, keeping the loaded table: %v", err))
+		case changed:
+			metrics.BINTableRefreshes.WithLabelValues("reloaded").Inc()
+			metrics.LogInfo(ctx, fmt.Sprintf("BIN table reloaded with %d BINs", table.Len()))
+		}
+	})
+}
+
+// applySecretRefresh returns the callback that reports a read of the
+// security key from the secrets backend, verifying a rotated key like a
+// reloaded one
+func applySecretRefresh(cfg *config.Config, client *api.Client) func(bool, error) {
+	return func(changed bool, err error) {
+		ctx := context.Background()
+		switch {
+		case err != nil:
+			metrics.SecretRefreshes.WithLabelValues(cfg.SecretsBackend, "failed").Inc()
+			metrics.LogError(ctx, fmt.Errorf("could not refresh NMI_API_KEY from %s, keeping the current key: %v", cfg.SecretsBackend, err))
+		case changed:
+			metrics.SecretRefreshes.WithLabelValues(cfg.SecretsBackend, "rotated").Inc()
+			metrics.LogInfo(ctx, "NMI_API_KEY rotated by "+cfg.SecretsBackend)
+			go func() {
+				checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				defer cancel()
+				client.RunCredentialCheck(checkCtx, cfg.Settings().APIKey)
+			}()
+		default:
+			metrics.SecretRefreshes.WithLabelValues(cfg.SecretsBackend, "unchanged").Inc()
+		}
+	}
+}
+
+// applyReload returns the callback that puts a reload's settings into
+// effect and logs which settings changed, never their values. A new
+// security key is verified again so readiness reflects it.
+func applyReload(cfg *config.Config, client *api.Client, stack *middleware.Stack) func([]string, error) {
+	return func(changed []string, err error) {
+		ctx := context.Background()
+		if err != nil {
+			metrics.ConfigReloads.WithLabelValues("rejected").Inc()
+			metrics.LogError(ctx, fmt.Errorf("configuration reload rejected, keeping current settings: %v", err))
+			return
+		}
+
+		settings := cfg.Settings()
+		stack.SetRateLimit(settings.RateLimitPerMinute)
+		metrics.SetDebug(settings.DebugMode)
+
+		metrics.ConfigReloads.WithLabelValues("applied").Inc()
+		if slices.Contains(changed, "NMI_API_KEY") {
+			go func() {
+				checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				defer cancel()
+				client.RunCredentialCheck(checkCtx, settings.APIKey)
+			}()
+		}
+		if len(changed) == 0 {
+			metrics.LogInfo(ctx, "Configuration reloaded, nothing changed")
+			return
+		}
+		metrics.LogInfo(ctx, "Configuration reloaded, changed "+strings.Join(changed, ", "))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"nmi-pay-int/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// RouteInfo describes one route in the /admin/routes manifest
+type RouteInfo struct {
+	Path      string   `json:"path"`
+	Methods   []string `json:"methods"`
+	AuthScope string   `json:"auth_scope"`
+	RateLimit string   `json:"rate_limit"`
+}
+
+// RouteManifest is the deployed API surface, stable enough to diff between
+// versions
+type RouteManifest struct {
+	Version string      `json:"version"`
+	Routes  []RouteInfo `json:"routes"`
+}
+
+// buildRouteManifest lists every route registered on r, sorted by path
+func buildRouteManifest(r *mux.Router, rateLimit string, formTokens, auth bool) RouteManifest {
+	manifest := RouteManifest{Version: version, Routes: []RouteInfo{}}
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		if methods == nil {
+			methods = []string{"ANY"}
+		}
+
+		manifest.Routes = append(manifest.Routes, RouteInfo{
+			Path:      path,
+			Methods:   methods,
+			AuthScope: routeAuthScope(path, formTokens, auth),
+			RateLimit: rateLimit,
+		})
+		return nil
+	})
+
+	sort.SliceStable(manifest.Routes, func(i, j int) bool {
+		a, b := manifest.Routes[i], manifest.Routes[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return strings.Join(a.Methods, ",") < strings.Join(b.Methods, ",")
+	})
+	return manifest
+}
+
+// routeAuthScope reports what a caller must present to use a route: with
+// authentication enabled, a credential for the protected routes' scope;
+// signed links for downloads; and, when enabled, browser form tokens on
+// sales. Other routes are expected to sit behind a private network
+// or gateway.
+func routeAuthScope(path string, formTokens, auth bool) string {
+	var scopes []string
+	if scope := middleware.RequiredScope(path); auth && scope != "" {
+		scopes = append(scopes, scope)
+	}
+	switch {
+	case strings.HasPrefix(path, "/downloads/"):
+		scopes = append(scopes, "signed_link")
+	case path == "/payments/sale" && formTokens:
+		scopes = append(scopes, "form_token")
+	}
+	if len(scopes) == 0 {
+		return "none"
+	}
+	return strings.Join(scopes, "+")
+}
+
+// handleRoutes serves the route manifest
+func handleRoutes(r *mux.Router, rateLimit string, formTokens, auth bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildRouteManifest(r, rateLimit, formTokens, auth))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteManifest(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	r := mux.NewRouter()
+	r.HandleFunc("/payments/sale", noop).Methods("POST")
+	r.HandleFunc("/downloads/{resource:.+}", noop).Methods("GET")
+	r.HandleFunc("/admin/routes", handleRoutes(r, "100/min per instance", true, false)).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var manifest RouteManifest
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&manifest))
+	assert.Equal(t, "dev", manifest.Version)
+	assert.Equal(t, []RouteInfo{
+		{Path: "/admin/routes", Methods: []string{"GET"}, AuthScope: "none", RateLimit: "100/min per instance"},
+		{Path: "/downloads/{resource:.+}", Methods: []string{"GET"}, AuthScope: "signed_link", RateLimit: "100/min per instance"},
+		{Path: "/payments/sale", Methods: []string{"POST"}, AuthScope: "form_token", RateLimit: "100/min per instance"},
+	}, manifest.Routes)
+}
+
+func TestRouteAuthScope(t *testing.T) {
+	assert.Equal(t, "none", routeAuthScope("/payments/refund", false, false))
+	assert.Equal(t, "payments", routeAuthScope("/payments/refund", false, true))
+	assert.Equal(t, "payments+form_token", routeAuthScope("/payments/sale", true, true))
+	assert.Equal(t, "terminal", routeAuthScope("/terminal/init", false, true))
+	assert.Equal(t, "reports", routeAuthScope("/reports/settlements", false, true))
+	assert.Equal(t, "admin", routeAuthScope("/reports/fees/import", false, true))
+	assert.Equal(t, "reports", routeAuthScope("/disputes", false, true))
+	assert.Equal(t, "payments", routeAuthScope("/transactions", false, true))
+	assert.Equal(t, "payments", routeAuthScope("/transactions/search", false, true))
+	assert.Equal(t, "cards", routeAuthScope("/cards/lists/{fingerprint}", false, true))
+	assert.Equal(t, "signed_link", routeAuthScope("/downloads/{resource:.+}", false, true))
+	assert.Equal(t, "none", routeAuthScope("/health", false, true))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+)
+
+// settlementColumns is the CSV header of a settlement report
+var settlementColumns = []string{
+	"batch_id", "batch_settled_at", "transaction_id", "type", "amount", "settled_at", "order_id", "card_type", "masked_number",
+}
+
+// handleSettlementReport reports the batches settled between start_date and
+// end_date (YYYY-MM-DD or RFC 3339; both required) as JSON, or with
+// ?format=csv as one row per settled transaction for finance to import
+func handleSettlementReport(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "format must be json or csv")
+			return
+		}
+
+		start, err := parseSearchDate(query.Get("start_date"), false)
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "start_date must be YYYY-MM-DD or RFC 3339")
+			return
+		}
+		end, err := parseSearchDate(query.Get("end_date"), true)
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "end_date must be YYYY-MM-DD or RFC 3339")
+			return
+		}
+
+		report, err := client.SettlementReport(r.Context(), merchantKey(r.Context(), cfg), start, end)
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="settlements-%s-%s.csv"`,
+			start.Format("20060102"), end.Format("20060102")))
+		writer := csv.NewWriter(w)
+		writer.Write(settlementColumns)
+		for _, batch := range report.Batches {
+			for _, entry := range batch.Entries {
+				writer.Write([]string{
+					batch.BatchID, batch.SettledAt.Format(time.RFC3339), entry.TransactionID, entry.Type, entry.Amount,
+					entry.SettledAt.Format(time.RFC3339), entry.OrderID, entry.CardType, entry.MaskedNumber,
+				})
+			}
+		}
+		writer.Flush()
+	}
+}
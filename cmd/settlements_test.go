@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/middleware"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettlementReportUsesCallerMerchant(t *testing.T) {
+	var keys []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.FormValue("security_key"))
+		w.Write([]byte(`<nm_response></nm_response>`))
+	}))
+	defer gateway.Close()
+
+	cfg := &config.Config{
+		APIKey: "default-key", APIBaseURL: gateway.URL, QueryURL: gateway.URL,
+		Merchants: []config.Merchant{{ID: "wholesale", APIKey: "wholesale-key", Callers: []string{"wholesale-portal"}}},
+	}
+	handler := middleware.NewMerchantResolver(cfg).Middleware(handleSettlementReport(cfg, api.NewClient(cfg)))
+	report := func(caller, merchant string) int {
+		req := httptest.NewRequest(http.MethodGet, "/reports/settlements?start_date=2026-10-01&end_date=2026-10-15", nil)
+		req = req.WithContext(logctx.WithFields(context.Background(), logrus.Fields{logctx.FieldCaller: caller}))
+		req.Header.Set(middleware.MerchantHeader, merchant)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, report("wholesale-portal", ""))
+	// A bound caller cannot read another merchant's settlements
+	assert.Equal(t, http.StatusForbidden, report("wholesale-portal", "default"))
+	assert.Equal(t, []string{"wholesale-key"}, keys)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/terminal"
+
+	"github.com/gorilla/mux"
+)
+
+// contextMerchantID names the merchant account a request acts for
+func contextMerchantID(ctx context.Context) string {
+	if merchant, ok := api.MerchantFromContext(ctx); ok {
+		return merchant.ID
+	}
+	return config.DefaultMerchantID
+}
+
+// recordTerminal registers, or refreshes, a device the gateway just
+// reported on. The gateway call has already succeeded, so a registry
+// failure is logged rather than failing the request.
+func recordTerminal(ctx context.Context, registry terminal.Registry, device *api.Device) {
+	if device == nil || device.ID == "" {
+		return
+	}
+	if _, err := registry.Record(ctx, terminal.FromDevice(contextMerchantID(ctx), device, time.Now())); err != nil {
+		metrics.LogError(ctx, fmt.Errorf("failed to record terminal %s: %v", device.ID, err))
+	}
+}
+
+// handleListTerminals lists the terminals registered to the request's
+// merchant
+func handleListTerminals(registry terminal.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		terminals, err := registry.List(r.Context(), contextMerchantID(r.Context()))
+		if err != nil {
+			metrics.LogError(r.Context(), fmt.Errorf("failed to list terminals: %v", err))
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load terminals")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]terminal.Terminal{"terminals": terminals})
+	}
+}
+
+// handleGetTerminal returns one of the merchant's registered terminals.
+// Another merchant's terminal is reported as not found.
+func handleGetTerminal(registry terminal.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := registry.Get(r.Context(), mux.Vars(r)["terminal_id"])
+		if err == nil && t.MerchantID != contextMerchantID(r.Context()) {
+			err = terminal.ErrNotRegistered
+		}
+		if errors.Is(err, terminal.ErrNotRegistered) {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		} else if err != nil {
+			metrics.LogError(r.Context(), fmt.Errorf("failed to load terminal: %v", err))
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load terminal")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// handleTerminalPaymentSession returns one of the merchant's terminal
+// payment sessions
+func handleTerminalPaymentSession(sessions *terminal.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessions.Get(contextMerchantID(r.Context()), mux.Vars(r)["payment_session_id"])
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+// sessionStreamRetry is the reconnection delay suggested to EventSource
+// clients whose stream ended before the session finished
+const sessionStreamRetry = time.Second
+
+// handleTerminalPaymentEvents streams a payment session as server-sent
+// events: the session now and again each time it changes, ending once it
+// has finished. Requests are time limited, so a stream for a cardholder
+// who takes longer ends early and the client reconnects for the rest.
+func handleTerminalPaymentEvents(sessions *terminal.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merchantID, id := contextMerchantID(r.Context()), mux.Vars(r)["payment_session_id"]
+		session, changed, err := sessions.Watch(merchantID, id)
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), api.GatewayBudget(r.Context()))
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher, _ := w.(http.Flusher)
+		fmt.Fprintf(w, "retry: %d\n\n", sessionStreamRetry.Milliseconds())
+
+		for {
+			data, err := json.Marshal(session)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: session\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if session.Finished() {
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+			if session, changed, err = sessions.Watch(merchantID, id); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// scheduleTerminalHeartbeats checks every registered terminal at the
+// gateway each cfg.TerminalHeartbeatInterval until stop is closed
+func scheduleTerminalHeartbeats(cfg *config.Config, client *api.Client, registry terminal.Registry, stop <-chan struct{}) {
+	checkTerminals(cfg, client, registry, time.Now())
+
+	ticker := time.NewTicker(cfg.TerminalHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			checkTerminals(cfg, client, registry, now)
+		}
+	}
+}
+
+// checkTerminals refreshes each terminal's status from the gateway, using
+// its merchant's key, and updates the online terminals gauge. A terminal
+// the gateway no longer knows is marked offline. A terminal that cannot be
+// checked keeps its last heartbeat, which goes stale after two intervals.
+func checkTerminals(cfg *config.Config, client *api.Client, registry terminal.Registry, now time.Time) {
+	merchants := make(map[string]config.Merchant)
+	for _, merchant := range cfg.MerchantAccounts() {
+		merchants[merchant.ID] = merchant
+	}
+
+	terminals, err := registry.List(context.Background(), "")
+	if err != nil {
+		metrics.LogError(context.Background(), fmt.Errorf("terminal heartbeat failed to list terminals: %v", err))
+		return
+	}
+
+	online := make(map[string]int)
+	for _, t := range terminals {
+		if merchant, ok := merchants[t.MerchantID]; ok {
+			if checked, err := checkTerminal(client, registry, merchant, t.ID, now); err != nil {
+				metrics.LogError(context.Background(), fmt.Errorf("terminal heartbeat for %s failed: %v", t.ID, err))
+			} else {
+				t = checked
+			}
+		}
+
+		// Merchants whose terminals are all offline are reported as 0
+		count := online[t.MerchantID]
+		if t.Online(now, 2*cfg.TerminalHeartbeatInterval) {
+			count++
+		}
+		online[t.MerchantID] = count
+	}
+	metrics.SetTerminalsOnline(online)
+}
+
+// checkTerminal asks the gateway for one terminal's status and records it
+func checkTerminal(client *api.Client, registry terminal.Registry, merchant config.Merchant, terminalID string, now time.Time) (terminal.Terminal, error) {
+	ctx := api.WithActor(api.WithMerchant(context.Background(), merchant), api.ActorScheduler)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	device, err := client.GetDevice(ctx, merchant.APIKey, terminalID)
+	var nmiErr *api.NMIError
+	if errors.As(err, &nmiErr) && nmiErr.Code == api.ErrNotFound {
+		device, err = &api.Device{ID: terminalID, Status: api.DeviceOffline}, nil
+	}
+	if err != nil {
+		return terminal.Terminal{}, err
+	}
+	return registry.Record(ctx, terminal.FromDevice(merchant.ID, device, now))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/terminal"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTerminals(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/devices/dev-1":
+			w.Write([]byte(`{"poiDeviceId":"dev-1","firmwareVersion":"2.2.0","connectionStatus":"online"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Device not found"}`))
+		}
+	}))
+	defer gateway.Close()
+
+	cfg := &config.Config{APIKey: "key", DeviceAPIURL: gateway.URL, TerminalHeartbeatInterval: time.Minute}
+	registry := terminal.NewMemoryRegistry()
+	ctx := context.Background()
+	then := time.Now().Add(-time.Hour)
+	registry.Record(ctx, terminal.Terminal{ID: "dev-1", MerchantID: config.DefaultMerchantID, Status: api.DeviceOffline, LastSeen: then})
+	registry.Record(ctx, terminal.Terminal{ID: "dev-2", MerchantID: config.DefaultMerchantID, Status: api.DeviceOnline, LastSeen: then})
+
+	checkTerminals(cfg, api.NewClient(cfg), registry, time.Now())
+
+	refreshed, err := registry.Get(ctx, "dev-1")
+	require.NoError(t, err)
+	assert.Equal(t, api.DeviceOnline, refreshed.Status)
+	assert.Equal(t, "2.2.0", refreshed.FirmwareVersion)
+	assert.True(t, refreshed.LastSeen.After(then))
+
+	removed, err := registry.Get(ctx, "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, api.DeviceOffline, removed.Status)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.TerminalsOnline.WithLabelValues(config.DefaultMerchantID)))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/recorder"
+	"nmi-pay-int/store"
+)
+
+// transactionsCSV is the CSV export of approved transactions
+const transactionsCSV = "logs/transactions.csv"
+
+var (
+	// history keeps processed transactions for the /transactions endpoint.
+	// serve swaps in the database store when DATABASE_URL is set.
+	history store.Store = store.NewMemoryStore(store.DefaultMemorySize)
+	// transactions writes processed transactions to their sinks in the
+	// background; serve and the CLI replace it with the configured sinks
+	transactions = recorder.New(recorder.DefaultBufferSize, recorder.NewCSVSink(transactionsCSV), recorder.NewStoreSink(history))
+)
+
+// useTransactionRecorder replaces the recorder with one writing to cfg's
+// sinks and any extra ones, after flushing the one it replaces
+func useTransactionRecorder(ctx context.Context, cfg *config.Config, extra ...recorder.Sink) {
+	var sinks []recorder.Sink
+	for _, sink := range cfg.TransactionSinks {
+		switch sink {
+		case config.SinkCSV:
+			sinks = append(sinks, recorder.NewCSVSink(transactionsCSV))
+		case config.SinkJSONL:
+			sinks = append(sinks, recorder.NewJSONLSink("logs/transactions.jsonl"))
+		case config.SinkDatabase:
+			sinks = append(sinks, recorder.NewStoreSink(history))
+		}
+	}
+	sinks = append(sinks, extra...)
+
+	previous := transactions
+	transactions = recorder.New(cfg.TransactionBufferSize, sinks...)
+	if err := previous.Close(ctx); err != nil {
+		metrics.LogError(ctx, fmt.Errorf("failed to flush transaction recorder: %v", err))
+	}
+}
+
+// recordTransaction queues a transaction for the merchant on ctx. The
+// gateway has already answered, so a failure is logged rather than
+// returned.
+func recordTransaction(ctx context.Context, t store.Transaction) {
+	t.MerchantID = contextMerchantID(ctx)
+	if err := transactions.Record(t); err != nil {
+		metrics.LogError(ctx, fmt.Errorf("failed to record transaction %s: %v", t.TransactionID, err))
+	}
+}
+
+// SaveDeclinedTransaction records a sale, authorization or ACH payment the
+// gateway refused. Only refusals carrying a gateway result are kept;
+// requests rejected before reaching the gateway are not transactions.
+func SaveDeclinedTransaction(ctx context.Context, transactionType, amount, orderDescription, poNumber string, err error) {
+	var nmiErr *api.NMIError
+	if !errors.As(err, &nmiErr) || nmiErr.ResponseCode == "" {
+		return
+	}
+	status := store.StatusError
+	if strings.HasPrefix(nmiErr.ResponseCode, "2") {
+		status = store.StatusDeclined
+	}
+	recordTransaction(ctx, store.Transaction{
+		Type:             transactionType,
+		Status:           status,
+		ResponseText:     nmiErr.Message,
+		Amount:           historyAmount(amount),
+		OrderDescription: orderDescription,
+		PONumber:         poNumber,
+	})
+}
+
+// historyAmount normalizes an amount for the history, leaving out one that
+// does not parse
+func historyAmount(raw string) api.Amount {
+	amount, err := api.ParseAmount(raw)
+	if err != nil {
+		return ""
+	}
+	return amount
+}
+
+func handleListTransactions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := transactionFilter(r)
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, err.Error())
+			return
+		}
+		filter.MerchantID = contextMerchantID(r.Context())
+
+		page, err := history.List(r.Context(), filter)
+		if errors.Is(err, store.ErrInvalidCursor) || errors.Is(err, store.ErrInvalidLimit) {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, err.Error())
+			return
+		}
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// transactionFilter reads the /transactions query parameters. end_date is
+// inclusive: a bare date covers the whole day.
+func transactionFilter(r *http.Request) (store.Filter, error) {
+	query := r.URL.Query()
+	filter := store.Filter{
+		Types:    splitList(query.Get("type")),
+		Statuses: splitList(query.Get("status")),
+		Cursor:   query.Get("cursor"),
+	}
+
+	var err error
+	if filter.From, err = parseSearchDate(query.Get("start_date"), false); err != nil {
+		return filter, fmt.Errorf("invalid start_date %q", query.Get("start_date"))
+	}
+	end := query.Get("end_date")
+	if filter.To, err = parseSearchDate(end, false); err != nil {
+		return filter, fmt.Errorf("invalid end_date %q", end)
+	}
+	if _, err := time.Parse("2006-01-02", end); err == nil {
+		filter.To = filter.To.AddDate(0, 0, 1)
+	} else if !filter.To.IsZero() {
+		filter.To = filter.To.Add(time.Nanosecond)
+	}
+
+	if filter.MinAmount, err = api.ParseAmount(query.Get("min_amount")); err != nil {
+		return filter, err
+	}
+	if filter.MaxAmount, err = api.ParseAmount(query.Get("max_amount")); err != nil {
+		return filter, err
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	return filter, nil
+}
+
+// splitList splits a comma-separated query parameter, dropping blanks
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
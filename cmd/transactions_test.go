@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/middleware"
+	"nmi-pay-int/recorder"
+	"nmi-pay-int/store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/transactions?type=sale,+auth&status=declined&start_date=2026-10-01&end_date=2026-10-15&min_amount=5.00&max_amount=20.5&limit=10&cursor=42", nil)
+	filter, err := transactionFilter(r)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sale", "auth"}, filter.Types)
+	assert.Equal(t, []string{"declined"}, filter.Statuses)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), filter.From)
+	assert.Equal(t, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), filter.To)
+	assert.Equal(t, api.Amount("5.00"), filter.MinAmount)
+	assert.Equal(t, api.Amount("20.50"), filter.MaxAmount)
+	assert.Equal(t, 10, filter.Limit)
+	assert.Equal(t, "42", filter.Cursor)
+
+	for _, query := range []string{"min_amount=5", "end_date=yesterday", "limit=many"} {
+		_, err := transactionFilter(httptest.NewRequest("GET", "/transactions?"+query, nil))
+		assert.Error(t, err, query)
+	}
+}
+
+func TestListTransactions(t *testing.T) {
+	previousHistory, previousRecorder := history, transactions
+	history = store.NewMemoryStore(10)
+	transactions = recorder.New(10, recorder.NewStoreSink(history))
+	defer func() { history, transactions = previousHistory, previousRecorder }()
+
+	ctx := context.Background()
+	SaveTransaction(ctx, "101", "sale", "SUCCESS", "10.00", "", "")
+	SaveDeclinedTransaction(ctx, "sale", "20.00", "", "", api.ParseNMIErrorResponse("DECLINE", "200", ""))
+	SaveDeclinedTransaction(ctx, "sale", "20.00", "", "", api.NewNMIError(api.ErrInvalidRequest, "bad", ""))
+	other := api.WithMerchant(ctx, config.Merchant{ID: "other"})
+	SaveTransaction(other, "102", "sale", "SUCCESS", "30.00", "", "")
+	require.NoError(t, transactions.Close(ctx))
+
+	w := httptest.NewRecorder()
+	handleListTransactions().ServeHTTP(w, httptest.NewRequest("GET", "/transactions?type=sale", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var page store.Page
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	require.Len(t, page.Transactions, 2)
+	assert.Equal(t, store.StatusDeclined, page.Transactions[0].Status)
+	assert.Equal(t, api.Amount("20.00"), page.Transactions[0].Amount)
+	assert.Equal(t, "101", page.Transactions[1].TransactionID)
+	assert.Equal(t, config.DefaultMerchantID, page.Transactions[1].MerchantID)
+
+	w = httptest.NewRecorder()
+	handleListTransactions().ServeHTTP(w, httptest.NewRequest("GET", "/transactions?cursor=x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListTransactionsUsesCallerMerchant(t *testing.T) {
+	previousHistory, previousRecorder := history, transactions
+	history = store.NewMemoryStore(10)
+	transactions = recorder.New(10, recorder.NewStoreSink(history))
+	defer func() { history, transactions = previousHistory, previousRecorder }()
+
+	ctx := context.Background()
+	SaveTransaction(ctx, "101", "sale", "SUCCESS", "10.00", "", "")
+	SaveTransaction(api.WithMerchant(ctx, config.Merchant{ID: "wholesale"}), "102", "sale", "SUCCESS", "30.00", "", "")
+	require.NoError(t, transactions.Close(ctx))
+
+	cfg := &config.Config{
+		APIKey:    "default-key",
+		Merchants: []config.Merchant{{ID: "wholesale", APIKey: "wholesale-key", Callers: []string{"wholesale-portal"}}},
+	}
+	handler := middleware.NewMerchantResolver(cfg).Middleware(handleListTransactions())
+	list := func(merchant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+		req = req.WithContext(logctx.WithFields(ctx, logrus.Fields{logctx.FieldCaller: "wholesale-portal"}))
+		req.Header.Set(middleware.MerchantHeader, merchant)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := list("")
+	require.Equal(t, http.StatusOK, w.Code)
+	var page store.Page
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	require.Len(t, page.Transactions, 1)
+	assert.Equal(t, "102", page.Transactions[0].TransactionID)
+
+	// A bound caller cannot list another merchant's transactions
+	assert.Equal(t, http.StatusForbidden, list(config.DefaultMerchantID).Code)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+
+	"github.com/gorilla/mux"
+)
+
+func handleGetVaultCustomer(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customer, err := client.GetVaultCustomer(r.Context(), merchantKey(r.Context(), cfg), mux.Vars(r)["id"])
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customer)
+	}
+}
+
+func handleUpdateVaultCustomer(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.VaultUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		req.APIKey = merchantKey(r.Context(), cfg)
+		req.CustomerVaultID = mux.Vars(r)["id"]
+		resp, err := client.UpdateVaultCustomer(r.Context(), req)
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+		LogTransaction(r.Context(), fmt.Sprintf("VAULT UPDATE: Customer Vault ID=%s, Response=%s", resp.CustomerVaultID, resp.Message))
+	}
+}
+
+func handleDeleteVaultCustomer(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := client.DeleteVaultCustomer(r.Context(), merchantKey(r.Context(), cfg), mux.Vars(r)["id"])
+		if err != nil {
+			api.WriteError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+		LogTransaction(r.Context(), fmt.Sprintf("VAULT DELETE: Customer Vault ID=%s, Response=%s", resp.CustomerVaultID, resp.Message))
+	}
+}
+
+// vaultExportColumns is the CSV header of a vault export
+var vaultExportColumns = []string{
+	"customer_vault_id", "first_name", "last_name", "email", "phone", "address1", "city", "state", "zip", "country",
+	"masked_card", "card_type", "expiry_date", "masked_account", "created", "updated", "metadata",
+}
+
+// handleVaultExport streams every vault record as CSV (the default) or JSON
+// lines (?format=jsonl), one Query API page at a time. Records carry masked
+// card and account numbers only.
+func handleVaultExport(cfg *config.Config, client *api.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "jsonl" {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "format must be csv or jsonl")
+			return
+		}
+
+		var csvWriter *csv.Writer
+		encoder := json.NewEncoder(w)
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			csvWriter = csv.NewWriter(w)
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="vault-customers-%s.%s"`, time.Now().Format("20060102"), format))
+		flusher, _ := w.(http.Flusher)
+
+		exported := 0
+		for page := 0; ; page++ {
+			customers, err := client.ListVaultCustomers(r.Context(), merchantKey(r.Context(), cfg), page, api.VaultExportPageSize)
+			if err != nil {
+				// Once rows are sent the status can no longer change; the
+				// consumer sees a truncated file
+				logctx.From(r.Context()).WithError(err).WithField("exported", exported).Error("Vault export failed")
+				if exported == 0 {
+					w.Header().Del("Content-Disposition")
+					api.WriteError(w, r, err)
+				}
+				return
+			}
+
+			if csvWriter != nil && page == 0 {
+				csvWriter.Write(vaultExportColumns)
+			}
+			for _, customer := range customers {
+				if csvWriter != nil {
+					csvWriter.Write(vaultExportRow(customer))
+				} else if err := encoder.Encode(customer); err != nil {
+					return
+				}
+				exported++
+			}
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if len(customers) < api.VaultExportPageSize {
+				break
+			}
+		}
+
+		LogTransaction(r.Context(), fmt.Sprintf("VAULT EXPORT: Format=%s, Records=%d", format, exported))
+	}
+}
+
+// vaultExportRow flattens a vault record into vaultExportColumns order
+func vaultExportRow(c api.VaultCustomer) []string {
+	metadata := ""
+	if len(c.Metadata) > 0 {
+		encoded, _ := json.Marshal(c.Metadata)
+		metadata = string(encoded)
+	}
+	return []string{
+		c.CustomerVaultID, c.Billing.FirstName, c.Billing.LastName, c.Billing.Email, c.Billing.Phone,
+		c.Billing.Address1, c.Billing.City, c.Billing.State, c.Billing.Zip, c.Billing.Country,
+		c.MaskedCard, c.CardType, c.ExpiryDate, c.MaskedAccount,
+		exportTime(c.Created), exportTime(c.Updated), metadata,
+	}
+}
+
+// exportTime formats t as RFC 3339, leaving unknown times blank
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const vaultExportFixture = `<nm_response><customer_vault>
+	<customer id="1">
+		<customer_vault_id>1</customer_vault_id>
+		<first_name>Ann</first_name>
+		<last_name>Lee</last_name>
+		<email>ann@example.com</email>
+		<cc_number>4xxxxxxxxxxx1111</cc_number>
+		<cc_exp>1230</cc_exp>
+		<cc_type>visa</cc_type>
+		<created>20261001120000</created>
+		<merchant_defined_field_3>gold</merchant_defined_field_3>
+	</customer>
+</customer_vault></nm_response>`
+
+func exportVault(t *testing.T, query string) *httptest.ResponseRecorder {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(vaultExportFixture))
+	}))
+	t.Cleanup(gateway.Close)
+	cfg := &config.Config{APIKey: "key", APIBaseURL: gateway.URL, QueryURL: gateway.URL}
+
+	rec := httptest.NewRecorder()
+	handleVaultExport(cfg, api.NewClient(cfg))(rec, httptest.NewRequest(http.MethodGet, "/admin/vault/export"+query, nil))
+	return rec
+}
+
+func TestVaultExportCSV(t *testing.T) {
+	rec := exportVault(t, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, vaultExportColumns, rows[0])
+	assert.Equal(t, []string{
+		"1", "Ann", "Lee", "ann@example.com", "", "", "", "", "", "",
+		"4xxxxxxxxxxx1111", "visa", "1230", "", "2026-10-01T12:00:00Z", "", `{"3":"gold"}`,
+	}, rows[1])
+}
+
+func TestVaultExportJSONL(t *testing.T) {
+	rec := exportVault(t, "?format=jsonl")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"customer_vault_id":"1"`)
+	assert.Contains(t, lines[0], `"masked_card":"4xxxxxxxxxxx1111"`)
+	assert.Contains(t, lines[0], `"metadata":{"3":"gold"}`)
+
+	assert.Equal(t, http.StatusBadRequest, exportVault(t, "?format=xml").Code)
+}
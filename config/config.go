@@ -1,65 +1,676 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"nmi-pay-int/secrets"
 
 	"github.com/joho/godotenv"
 )
 
+// Backends for state that can be kept per process or shared through Redis
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+)
+
+// Transaction recorder sinks for TRANSACTION_SINKS
+const (
+	SinkCSV      = "csv"
+	SinkJSONL    = "jsonl"
+	SinkDatabase = "database"
+)
+
+// productionHost serves NMI's live gateway, the default API_URL
+const productionHost = "secure.nmi.com"
+
+// DefaultRateLimitPerMinute is the API-wide rate limit unless
+// RATE_LIMIT_PER_MINUTE overrides it
+const DefaultRateLimitPerMinute = 100
+
+// AWSConfig holds the standard AWS_* credentials and endpoint settings
+type AWSConfig struct {
+	Region          string `env:"AWS_REGION"`
+	AccessKeyID     string `env:"AWS_ACCESS_KEY_ID"`
+	SecretAccessKey string `env:"AWS_SECRET_ACCESS_KEY"`
+	SessionToken    string `env:"AWS_SESSION_TOKEN"`
+	// EndpointURL overrides the SNS endpoint, e.g. for LocalStack
+	EndpointURL string `env:"AWS_ENDPOINT_URL"`
+}
+
 // Config holds all configuration values
 type Config struct {
-	APIKey     string
-	APIBaseURL string
-	DebugMode  bool
-	Port       string
+	APIKey     string `env:"NMI_API_KEY" required:"true"`
+	APIBaseURL string `env:"API_URL" default:"https://secure.nmi.com/api/transact.php" required:"true"`
+	DebugMode  bool   `env:"DEBUG_MODE"`
+	Port       string `env:"PORT" default:"8080"`
+
+	// QueryURL is NMI's Query API endpoint. It defaults to query.php next to
+	// APIBaseURL so sandbox and proxy setups only need API_URL.
+	QueryURL string `env:"API_QUERY_URL"`
+
+	// DeviceAPIURL is the base URL of NMI's payment device API, which
+	// registers card-present terminals and reports their status. It defaults
+	// to the v2 API next to APIBaseURL.
+	DeviceAPIURL string `env:"API_DEVICE_URL"`
+
+	// MetricsPort, when set, serves /metrics on a dedicated internal port
+	// instead of the public router.
+	MetricsPort string `env:"METRICS_PORT"`
+	// PushGatewayURL, when set, pushes metrics to a Prometheus push-gateway
+	// at the end of short-lived CLI runs.
+	PushGatewayURL string `env:"PUSHGATEWAY_URL"`
+
+	// CustomerReceipt is the merchant default for NMI-sent customer receipts
+	CustomerReceipt bool `env:"CUSTOMER_RECEIPT"`
+
+	// ReusePort binds the HTTP listener with SO_REUSEPORT so a new binary can
+	// start on the same port before the old one drains.
+	ReusePort bool `env:"REUSE_PORT"`
+
+	// LinkSigningSecret signs shareable download links. When empty a random
+	// secret is used and links stop working after a restart.
+	LinkSigningSecret string `env:"LINK_SIGNING_SECRET"`
+
+	// ResponseFieldAllowlist names extra NMI response fields (for example
+	// processor_id or batch_id) to copy into API responses.
+	ResponseFieldAllowlist []string `env:"RESPONSE_FIELD_ALLOWLIST"`
+
+	// FormTokens requires browser-origin sale submissions to carry a
+	// one-time token from GET /payments/token.
+	FormTokens bool `env:"FORM_TOKENS"`
+
+	// AmountBuckets overrides the transaction amount histogram buckets
+	AmountBuckets []float64 `env:"AMOUNT_HISTOGRAM_BUCKETS"`
+
+	// WebhookMaxAttempts is how many times a webhook delivery is tried before
+	// it is moved to the dead letters. Zero uses the default.
+	WebhookMaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" min:"1"`
+
+	// IdempotencyStore selects where idempotency keys are kept: "memory"
+	// (per process) or "redis" (shared by replicas, survives restarts).
+	IdempotencyStore string `env:"IDEMPOTENCY_STORE" default:"memory"`
+	// RateLimitPerMinute is the API-wide request rate limit
+	RateLimitPerMinute int `env:"RATE_LIMIT_PER_MINUTE" default:"100" min:"1"`
+	// CORSEnabled adds permissive CORS headers and answers preflights
+	CORSEnabled bool `env:"CORS_ENABLED"`
+
+	// RateLimitStore selects where the request rate limit is counted:
+	// "memory" (per process) or "redis" (one limit across replicas). Both
+	// Redis-backed features fall back to memory while Redis is unreachable.
+	RateLimitStore string `env:"RATE_LIMIT_STORE" default:"memory"`
+	// RedisURL locates the Redis server, e.g. redis://localhost:6379/0
+	RedisURL string `env:"REDIS_URL"`
+	// IdempotencyTTL is how long an idempotency key is remembered
+	IdempotencyTTL time.Duration `env:"IDEMPOTENCY_TTL" min:"1ms"`
+	// IdempotencyMaxKeys bounds the in-memory store; the least recently used
+	// keys are evicted beyond it
+	IdempotencyMaxKeys int `env:"IDEMPOTENCY_MAX_KEYS" min:"1"`
+
+	// GatewayTimeout caps a single NMI call. Zero uses the default.
+	GatewayTimeout time.Duration `env:"GATEWAY_TIMEOUT" min:"1ms"`
+	// GatewayMaxIdleConns is how many keep-alive connections to NMI are kept
+	// open between requests. Zero uses the default.
+	GatewayMaxIdleConns int `env:"GATEWAY_MAX_IDLE_CONNS" min:"1"`
+	// GatewayIdleConnTimeout closes pooled connections idle for this long.
+	// Zero uses the default.
+	GatewayIdleConnTimeout time.Duration `env:"GATEWAY_IDLE_CONN_TIMEOUT" min:"1ms"`
+
+	// QueryHedgeLimit enables hedged Query API reads (lookups, searches,
+	// status polls): a slow read is sent again after the recent P95 latency
+	// and the first answer wins. It caps how many hedges may be in flight;
+	// zero disables hedging.
+	QueryHedgeLimit int `env:"QUERY_HEDGE_LIMIT" min:"0"`
+
+	// DatabaseURL persists plans, the event log, fee data and terminal
+	// mappings in Postgres (postgres://...) or SQLite (sqlite:path/to/file.db).
+	// Empty keeps them in memory.
+	DatabaseURL string `env:"DATABASE_URL"`
+
+	// TransactionSinks are where processed transactions are recorded: the
+	// CSV export, a JSON Lines file and the /transactions history
+	TransactionSinks []string `env:"TRANSACTION_SINKS" default:"csv,database"`
+	// TransactionBufferSize is how many transactions may wait for the
+	// background recorder before requests block on it
+	TransactionBufferSize int `env:"TRANSACTION_BUFFER_SIZE" min:"1"`
+
+	// KafkaRESTURL, when set, publishes lifecycle events to Kafka through
+	// this REST proxy. KafkaUsername and KafkaPassword authenticate to it.
+	KafkaRESTURL  string `env:"KAFKA_REST_URL"`
+	KafkaUsername string `env:"KAFKA_USERNAME"`
+	KafkaPassword string `env:"KAFKA_PASSWORD"`
+	// EventTopicPrefix followed by an event's subject names its topic
+	EventTopicPrefix string `env:"EVENT_TOPIC_PREFIX"`
+	// EventRelayInterval is how often events left in the outbox are
+	// retried, whichever broker they go to
+	EventRelayInterval time.Duration `env:"EVENT_RELAY_INTERVAL" min:"1s"`
+	// SNSTopicARN or SQSQueueURL, when set instead of KafkaRESTURL, publish
+	// lifecycle events to that SNS topic or SQS queue, signed with the
+	// AWS_* credentials
+	SNSTopicARN string `env:"SNS_TOPIC_ARN"`
+	SQSQueueURL string `env:"SQS_QUEUE_URL"`
+	AWS         AWSConfig
+
+	// AdminIPAllowlist, RefundIPAllowlist and BatchIPAllowlist restrict
+	// their route groups to the given networks. An empty list leaves the
+	// group open.
+	AdminIPAllowlist  []netip.Prefix `env:"ADMIN_IP_ALLOWLIST"`
+	RefundIPAllowlist []netip.Prefix `env:"REFUND_IP_ALLOWLIST"`
+	BatchIPAllowlist  []netip.Prefix `env:"BATCH_IP_ALLOWLIST"`
+	// TrustedProxies are load balancers whose X-Forwarded-For header is
+	// believed when working out the client address for the allowlists and
+	// authentication lockouts
+	TrustedProxies []netip.Prefix `env:"TRUSTED_PROXIES"`
+
+	// BatchCloseTime, when set, closes the day's batch automatically at
+	// this local time ("HH:MM")
+	BatchCloseTime string `env:"BATCH_CLOSE_TIME"`
+	// SaleBatchWorkers is how many sales of a /payments/batch upload are
+	// sent to the gateway at once
+	SaleBatchWorkers int `env:"BATCH_SALE_WORKERS" min:"1"`
+	// ChargebackPollInterval, when set, checks the gateway for new
+	// chargebacks this often and announces them with chargeback.created
+	ChargebackPollInterval time.Duration `env:"CHARGEBACK_POLL_INTERVAL" min:"1m"`
+	// TerminalHeartbeatInterval is how often registered terminals are
+	// checked at the gateway to refresh their status and the online
+	// terminals gauge. Zero turns the checks off.
+	TerminalHeartbeatInterval time.Duration `env:"TERMINAL_HEARTBEAT_INTERVAL" default:"1m"`
+	// SyncPlansToGateway creates, updates and deletes plans at the gateway
+	// as well as locally
+	SyncPlansToGateway bool `env:"PLAN_GATEWAY_SYNC" default:"true"`
+
+	// ShadowSampleRate is the fraction (0-1) of ShadowOperations mirrored to
+	// ShadowAPIURL and ShadowQueryURL so their answers can be compared with
+	// the live ones. Zero turns shadow traffic off.
+	ShadowSampleRate float64  `env:"SHADOW_SAMPLE_RATE" min:"0" max:"1"`
+	ShadowOperations []string `env:"SHADOW_OPERATIONS" default:"lookup" oneof:"lookup search"`
+	ShadowAPIURL     string   `env:"SHADOW_API_URL"`
+	ShadowQueryURL   string   `env:"SHADOW_QUERY_URL"`
+	// ShadowAPIKey replaces the caller's key on mirrored requests, e.g. with
+	// test credentials. Empty sends the caller's key.
+	ShadowAPIKey string `env:"SHADOW_API_KEY"`
+
+	// RouteConcurrency caps simultaneous requests per route, so heavy
+	// exports and imports cannot crowd out payments
+	RouteConcurrency []RouteLimit `env:"ROUTE_CONCURRENCY" want:"/route=max[:queue]"`
+
+	// LoadShedMaxInFlight and LoadShedP99Target switch on load shedding:
+	// while more requests than LoadShedMaxInFlight are running, or payment
+	// requests' P99 latency is above LoadShedP99Target, requests to
+	// LoadShedRoutes are turned away. Zero disables either signal.
+	LoadShedMaxInFlight int           `env:"LOAD_SHED_MAX_IN_FLIGHT" min:"0"`
+	LoadShedP99Target   time.Duration `env:"LOAD_SHED_P99_TARGET" min:"0s"`
+	// LoadShedRoutes are the route prefixes that may be shed, such as
+	// lookups and reports
+	LoadShedRoutes []string `env:"LOAD_SHED_ROUTES"`
+
+	// TracingEndpoint is the OTLP/HTTP collector spans are exported to, from
+	// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT.
+	// Tracing is off while it is empty; the exporter reads the remaining
+	// OTEL_* variables itself.
+	TracingEndpoint string `env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT"`
+
+	// GRPCPort, when set, serves the gRPC API on this port next to REST
+	GRPCPort string `env:"GRPC_PORT"`
+	// GRPCAuthTokens are the bearer tokens gRPC callers must present,
+	// "name:token" or a bare token; required when GRPCPort is set. The name
+	// is the caller, which MERCHANTS_FILE can bind to a merchant.
+	GRPCAuthTokens []APIKey `env:"GRPC_AUTH_TOKENS"`
+
+	// AuthAPIKeys and AuthJWTSecret protect the route groups that
+	// middleware.RequiredScope names a scope for. The service refuses to
+	// start with neither set unless AuthDisabled is set.
+	AuthAPIKeys   []APIKey `env:"AUTH_API_KEYS"`
+	AuthJWTSecret string   `env:"AUTH_JWT_SECRET"`
+	// AuthDisabled deliberately leaves those routes open to anyone who can
+	// reach the port, for local development
+	AuthDisabled bool `env:"AUTH_DISABLED"`
+	// AuthJWTIssuer and AuthJWTAudience, when set, must match the token's
+	// iss and aud claims
+	AuthJWTIssuer   string `env:"AUTH_JWT_ISSUER"`
+	AuthJWTAudience string `env:"AUTH_JWT_AUDIENCE"`
+	// AuthAuditKeys names the AUTH_API_KEYS entries that may read the audit
+	// log; other keys are refused there, and JWTs need the audit scope
+	AuthAuditKeys []string `env:"AUTH_AUDIT_KEYS"`
+	// AuthAdminKeys names the AUTH_API_KEYS entries that may use the admin
+	// routes; JWTs need the admin scope
+	AuthAdminKeys []string `env:"AUTH_ADMIN_KEYS"`
+	// AuthMaxFailures invalid API keys or tokens from one client address
+	// within AuthLockout lock that address out of the protected routes for
+	// AuthLockout. Zero disables lockouts.
+	AuthMaxFailures int           `env:"AUTH_MAX_FAILURES" default:"10" min:"0"`
+	AuthLockout     time.Duration `env:"AUTH_LOCKOUT" default:"15m" min:"1s"`
+	// RequestSigningSecrets are the shared secrets requests to the protected
+	// routes must be signed with in X-Signature. A secret with a caller
+	// applies to that authenticated caller; one without applies to every
+	// other request.
+	RequestSigningSecrets []SigningSecret `env:"REQUEST_SIGNING_SECRETS"`
+	// RequestSignatureTolerance is how far a signature's timestamp may be
+	// from now before the request is rejected as a possible replay
+	RequestSignatureTolerance time.Duration `env:"REQUEST_SIGNATURE_TOLERANCE" default:"5m" min:"1ms"`
+	// ResponseRedactions maps an authenticated caller to the JSON fields
+	// removed from every response it receives, for clients that must not
+	// see gateway detail
+	ResponseRedactions map[string][]string `env:"RESPONSE_REDACTIONS" want:"caller=field+field"`
+
+	// Merchants are the NMI accounts besides the default one, loaded from
+	// MERCHANTS_FILE. Requests pick one with X-Merchant-ID or through the
+	// caller they authenticated as.
+	Merchants []Merchant
+	// Surcharge is the default account's surcharge policy, from the top
+	// level of MERCHANTS_FILE
+	Surcharge SurchargePolicy
+	// Verification is the default account's AVS and CVV policy, from the
+	// top level of MERCHANTS_FILE
+	Verification VerificationPolicy
+	// MerchantsFile is the MERCHANTS_FILE path Merchants were read from
+	MerchantsFile string `env:"MERCHANTS_FILE"`
+
+	// SandboxSimulation answers payments with magic amounts or test card
+	// numbers with a canned decline instead of sending them to NMI. It is
+	// refused with the production API_URL.
+	SandboxSimulation bool `env:"SANDBOX_SIMULATION"`
+
+	// BINTableFile is a CSV of card BINs with their brand, level and
+	// issuing country, reread every BINTableRefreshInterval once changed
+	BINTableFile            string        `env:"BIN_TABLE_FILE"`
+	BINTableRefreshInterval time.Duration `env:"BIN_TABLE_REFRESH_INTERVAL" default:"1m" min:"1s"`
+	// BINRejectPrepaid lists the payments prepaid cards are refused for:
+	// sale, auth or subscription
+	BINRejectPrepaid []string `env:"BIN_REJECT_PREPAID" oneof:"sale auth subscription"`
+
+	// CardFingerprintSalt keys the card fingerprints merchants block and
+	// allow cards by. Changing it orphans every listed fingerprint.
+	CardFingerprintSalt string `env:"CARD_FINGERPRINT_SALT"`
+
+	// SecretsBackend, when set, reads NMI_API_KEY from AWS Secrets Manager
+	// ("aws"), GCP Secret Manager ("gcp") or HashiCorp Vault ("vault")
+	// instead of the environment. SecretsID names the secret and
+	// SecretsField the JSON field holding the key, when it has fields.
+	SecretsBackend string `env:"SECRETS_BACKEND" oneof:"aws gcp vault"`
+	SecretsID      string `env:"SECRETS_ID"`
+	SecretsField   string `env:"SECRETS_FIELD"`
+	// SecretsRefreshInterval is how often the key is read again, so a
+	// rotation reaches the service without a restart
+	SecretsRefreshInterval time.Duration `env:"SECRETS_REFRESH_INTERVAL" default:"5m" min:"10s"`
+	// GCPAccessToken authenticates to GCP Secret Manager. Empty asks the
+	// metadata server for the instance's service account token.
+	GCPAccessToken string `env:"GCP_ACCESS_TOKEN"`
+	// VaultAddr and VaultToken reach Vault
+	VaultAddr  string `env:"VAULT_ADDR"`
+	VaultToken string `env:"VAULT_TOKEN"`
+	// secretProvider reads the key while SecretsBackend is set
+	secretProvider secrets.Provider
+
+	// ConfigWatchInterval, when set, is how often .env and MERCHANTS_FILE
+	// are checked for changes to reload. SIGHUP reloads them regardless.
+	ConfigWatchInterval time.Duration `env:"CONFIG_WATCH_INTERVAL" min:"1s"`
+}
+
+// APIKey is a static key accepted in X-API-Key. Name identifies the caller
+// in logs without exposing the key.
+type APIKey struct {
+	Name string
+	Key  string
+}
+
+// SigningSecret is a request signing secret, for Caller or, when Caller is
+// empty, for everyone
+type SigningSecret struct {
+	Caller string
+	Secret string
+}
+
+// DefaultLoadShedRoutes are the routes shed under load when
+// LOAD_SHED_ROUTES is unset: reads and reports that can be retried later
+// without losing a sale
+var DefaultLoadShedRoutes = []string{
+	"/payments/lookup",
+	"/payments/{id}/wait",
+	"/payments/{id}/refunds",
+	"/payments/recurring/{subscription_id}",
+	"/transactions/",
+	"/reports/",
+	"/disputes",
+	"/events/",
+	"/stats/",
+	"/admin/vault/export",
+}
+
+// DefaultRequestSignatureTolerance bounds signature age when
+// REQUEST_SIGNATURE_TOLERANCE is unset
+const DefaultRequestSignatureTolerance = 5 * time.Minute
+
+// RouteLimit caps concurrent requests to the routes whose path template
+// starts with Prefix. Up to MaxQueue more wait for a slot; the rest are
+// turned away.
+type RouteLimit struct {
+	Prefix        string
+	MaxConcurrent int
+	MaxQueue      int
 }
 
-// LoadConfig loads configuration from environment variables
+// LoadConfig loads the configuration from CommandLine, the environment and
+// .env, exiting with every problem found when it is invalid
 func LoadConfig() *Config {
+	config, err := Load(CommandLine)
+	if err != nil {
+		log.Fatalf("Configuration error: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	return config
+}
+
+// Load reads the configuration from command-line flags, the environment
+// (after loading .env) and a settings file, in that order of precedence,
+// filling in defaults. It reports every invalid or missing setting at once.
+func Load(sources Sources) (*Config, error) {
+	for _, name := range reloadableVars {
+		_, inherited[name] = os.LookupEnv(name)
+	}
+
 	// Load .env file if it exists
-	err := godotenv.Load()
+	err := godotenv.Load(envFile)
 	if err != nil {
 		log.Printf("Warning: .env file not found: %v", err)
 	}
 
-	// Set default values
-	config := &Config{
-		Port: "8080",
+	flags, err := parseFlags(sources.Flags)
+	if err != nil {
+		return nil, err
+	}
+	if sources.File == "" {
+		sources.File = os.Getenv("CONFIG_FILE")
+	}
+	file, err := readSettingsFile(sources.File)
+	if err != nil {
+		return nil, err
+	}
+	reloading.Lock()
+	settingsPath, flagSettings = sources.File, flags
+	reloading.Unlock()
+
+	lookup := layered(fromMap(flags), os.LookupEnv, fromMap(file))
+	config := &Config{}
+	errs := decode(config, lookup, nil)
+	config.deriveDefaults(lookup)
+	if config.SecretsBackend != "" && len(errs) == 0 {
+		if config.APIKey != "" {
+			errs = append(errs, fmt.Errorf("set NMI_API_KEY or SECRETS_BACKEND, not both"))
+		} else if err := config.loadSecret(context.Background()); err != nil {
+			errs = append(errs, fmt.Errorf("NMI_API_KEY could not be read from %s: %v", config.SecretsBackend, err))
+		}
+	}
+	if config.MerchantsFile != "" {
+		merchants, err := loadMerchants(config.MerchantsFile, getenvFunc(lookup))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid MERCHANTS_FILE: %v", err))
+		} else {
+			config.Merchants, config.Surcharge, config.Verification = merchants.Merchants, merchants.Surcharge, merchants.Verification
+		}
+	}
+	errs = append(errs, config.Validate())
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
+	return config, nil
+}
 
-	// Load from environment variables
-	if apiKey := os.Getenv("NMI_API_KEY"); apiKey != "" {
-		config.APIKey = apiKey
-	} else {
-		log.Fatal("NMI_API_KEY environment variable is required")
+// deriveDefaults fills in the settings whose defaults depend on others
+func (c *Config) deriveDefaults(lookup lookupFunc) {
+	if c.QueryURL == "" {
+		c.QueryURL = defaultQueryURL(c.APIBaseURL)
+	}
+	if c.DeviceAPIURL == "" {
+		c.DeviceAPIURL = defaultDeviceURL(c.APIBaseURL)
+	}
+	if c.ShadowQueryURL == "" {
+		c.ShadowQueryURL = defaultQueryURL(c.ShadowAPIURL)
+	}
+	if len(c.LoadShedRoutes) == 0 {
+		c.LoadShedRoutes = DefaultLoadShedRoutes
 	}
+	// An empty EVENT_TOPIC_PREFIX is a choice, so only an unset one gets
+	// the default
+	if _, ok := lookup("EVENT_TOPIC_PREFIX"); !ok {
+		c.EventTopicPrefix = "payments."
+	}
+}
 
-	if apiURL := os.Getenv("API_URL"); apiURL != "" {
-		config.APIBaseURL = apiURL
-	} else {
-		config.APIBaseURL = "https://secure.nmi.com/api/transact.php"
+// defaultQueryURL derives the Query API endpoint from the transaction
+// endpoint. URLs that do not end in transact.php are assumed to be a proxy or
+// mock serving both APIs, so they are used as-is.
+func defaultQueryURL(apiURL string) string {
+	if strings.HasSuffix(apiURL, "/transact.php") {
+		return strings.TrimSuffix(apiURL, "transact.php") + "query.php"
 	}
+	return apiURL
+}
 
-	config.DebugMode, _ = strconv.ParseBool(os.Getenv("DEBUG_MODE"))
+// defaultDeviceURL derives the payment device API's base URL from the
+// transaction endpoint, following the same rule as defaultQueryURL
+func defaultDeviceURL(apiURL string) string {
+	if strings.HasSuffix(apiURL, "/transact.php") {
+		return strings.TrimSuffix(apiURL, "transact.php") + "v2"
+	}
+	return apiURL
+}
 
-	// Validate required configurations
-	if err := config.validate(); err != nil {
-		log.Fatalf("Configuration error: %v", err)
+// splitList parses a comma-separated environment value, dropping blanks
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	return config
+// parsePrefix parses a CIDR such as 10.0.0.0/8, or a bare address as a
+// single-host prefix
+func parsePrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// parseAPIKey parses "name:key", or a bare key logged as "api_key"
+func parseAPIKey(value string) APIKey {
+	if name, key, ok := strings.Cut(value, ":"); ok && name != "" && key != "" {
+		return APIKey{Name: name, Key: key}
+	}
+	return APIKey{Name: "api_key", Key: value}
+}
+
+// parseSigningSecret parses "caller:secret", or a bare secret for every
+// caller
+func parseSigningSecret(value string) SigningSecret {
+	if caller, secret, ok := strings.Cut(value, ":"); ok && caller != "" && secret != "" {
+		return SigningSecret{Caller: caller, Secret: secret}
+	}
+	return SigningSecret{Secret: value}
+}
+
+// parseRouteLimit parses "/route=max" or "/route=max:queue"
+func parseRouteLimit(value string) (RouteLimit, error) {
+	prefix, limits, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return RouteLimit{}, fmt.Errorf("missing route")
+	}
+	maxConcurrent, maxQueue, _ := strings.Cut(limits, ":")
+
+	limit := RouteLimit{Prefix: prefix}
+	var err error
+	if limit.MaxConcurrent, err = strconv.Atoi(maxConcurrent); err != nil || limit.MaxConcurrent < 1 {
+		return RouteLimit{}, fmt.Errorf("invalid concurrency %q", maxConcurrent)
+	}
+	if maxQueue != "" {
+		if limit.MaxQueue, err = strconv.Atoi(maxQueue); err != nil || limit.MaxQueue < 0 {
+			return RouteLimit{}, fmt.Errorf("invalid queue depth %q", maxQueue)
+		}
+	}
+	return limit, nil
 }
 
-// validate checks if all required configuration values are present
-func (c *Config) validate() error {
-	if c.APIKey == "" {
-		return fmt.Errorf("NMI_API_KEY is required")
+// parseRedaction parses "caller=field+field"
+func parseRedaction(value string) (string, []string, error) {
+	caller, list, ok := strings.Cut(value, "=")
+	if !ok || caller == "" {
+		return "", nil, fmt.Errorf("missing caller")
 	}
-	if c.APIBaseURL == "" {
-		return fmt.Errorf("API_URL is required")
+	var fields []string
+	for _, field := range strings.Split(list, "+") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("no fields")
+	}
+	return caller, fields, nil
+}
+
+// Validate checks the configuration as a whole: required settings and
+// settings that depend on each other. It reports every problem, joined.
+func (c *Config) Validate() error {
+	errs := missingRequired(c)
+	if c.SandboxSimulation {
+		if u, err := url.Parse(c.APIBaseURL); err != nil || u.Hostname() == productionHost {
+			errs = append(errs, fmt.Errorf("SANDBOX_SIMULATION cannot be used with the production API_URL"))
+		}
+	}
+	errs = append(errs, c.validateStore("IDEMPOTENCY_STORE", c.IdempotencyStore))
+	errs = append(errs, c.validateStore("RATE_LIMIT_STORE", c.RateLimitStore))
+	brokers := 0
+	for _, setting := range []string{c.KafkaRESTURL, c.SNSTopicARN, c.SQSQueueURL} {
+		if setting != "" {
+			brokers++
+		}
+	}
+	if brokers > 1 {
+		errs = append(errs, fmt.Errorf("set only one of KAFKA_REST_URL, SNS_TOPIC_ARN and SQS_QUEUE_URL"))
+	}
+	if (c.SNSTopicARN != "" || c.SQSQueueURL != "") && (c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "") {
+		errs = append(errs, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required with SNS_TOPIC_ARN or SQS_QUEUE_URL"))
+	}
+	for _, sink := range c.TransactionSinks {
+		if sink != SinkCSV && sink != SinkJSONL && sink != SinkDatabase {
+			errs = append(errs, fmt.Errorf("TRANSACTION_SINKS entry %q must be %q, %q or %q", sink, SinkCSV, SinkJSONL, SinkDatabase))
+		}
+	}
+	if c.BatchCloseTime != "" {
+		if _, err := time.Parse("15:04", c.BatchCloseTime); err != nil {
+			errs = append(errs, fmt.Errorf("invalid BATCH_CLOSE_TIME value %q, want HH:MM", c.BatchCloseTime))
+		}
+	}
+	if c.TerminalHeartbeatInterval < 0 || (c.TerminalHeartbeatInterval > 0 && c.TerminalHeartbeatInterval < 10*time.Second) {
+		errs = append(errs, fmt.Errorf("invalid TERMINAL_HEARTBEAT_INTERVAL value %q, want 0 or a duration of at least 10s", c.TerminalHeartbeatInterval))
+	}
+	if c.CardFingerprintSalt != "" && len(c.CardFingerprintSalt) < 16 {
+		errs = append(errs, fmt.Errorf("CARD_FINGERPRINT_SALT must be at least 16 characters"))
+	}
+	if len(c.BINRejectPrepaid) > 0 && c.BINTableFile == "" {
+		errs = append(errs, fmt.Errorf("BIN_TABLE_FILE is required with BIN_REJECT_PREPAID"))
+	}
+	if c.SecretsBackend != "" {
+		if c.SecretsID == "" {
+			errs = append(errs, fmt.Errorf("SECRETS_ID is required when SECRETS_BACKEND is set"))
+		}
+		if c.SecretsBackend == secrets.BackendVault && (c.VaultAddr == "" || c.VaultToken == "") {
+			errs = append(errs, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required with SECRETS_BACKEND=vault"))
+		}
+		if c.SecretsBackend == secrets.BackendAWS && (c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "") {
+			errs = append(errs, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required with SECRETS_BACKEND=aws"))
+		}
+	}
+	if c.ShadowSampleRate > 0 && c.ShadowAPIURL == "" {
+		errs = append(errs, fmt.Errorf("SHADOW_API_URL is required when SHADOW_SAMPLE_RATE is set"))
+	}
+	for _, route := range c.LoadShedRoutes {
+		if !strings.HasPrefix(route, "/") {
+			errs = append(errs, fmt.Errorf("invalid LOAD_SHED_ROUTES value %q", route))
+		}
+	}
+	if c.TracingEndpoint != "" {
+		if u, err := url.Parse(c.TracingEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT value %q", c.TracingEndpoint))
+		}
+	}
+	if c.GRPCPort != "" && len(c.GRPCAuthTokens) == 0 {
+		errs = append(errs, fmt.Errorf("GRPC_AUTH_TOKENS is required when GRPC_PORT is set"))
+	}
+	if c.AuthDisabled && (len(c.AuthAPIKeys) > 0 || c.AuthJWTSecret != "") {
+		errs = append(errs, fmt.Errorf("AUTH_DISABLED cannot be set with AUTH_API_KEYS or AUTH_JWT_SECRET"))
+	}
+	if c.AuthJWTSecret != "" && len(c.AuthJWTSecret) < 32 {
+		errs = append(errs, fmt.Errorf("AUTH_JWT_SECRET must be at least 32 characters"))
+	}
+	for _, name := range c.AuthAuditKeys {
+		if !c.hasAPIKey(name) {
+			errs = append(errs, fmt.Errorf("AUTH_AUDIT_KEYS names %q, which is not in AUTH_API_KEYS", name))
+		}
+	}
+	for _, name := range c.AuthAdminKeys {
+		if !c.hasAPIKey(name) {
+			errs = append(errs, fmt.Errorf("AUTH_ADMIN_KEYS names %q, which is not in AUTH_API_KEYS", name))
+		}
+	}
+	for _, secret := range c.RequestSigningSecrets {
+		if len(secret.Secret) < 32 {
+			errs = append(errs, fmt.Errorf("REQUEST_SIGNING_SECRETS entries must be at least 32 characters"))
+			break
+		}
+	}
+	for _, secret := range c.RequestSigningSecrets {
+		if secret.Caller != "" && len(c.AuthAPIKeys) == 0 && c.AuthJWTSecret == "" {
+			errs = append(errs, fmt.Errorf("REQUEST_SIGNING_SECRETS entries for a caller need AUTH_API_KEYS or AUTH_JWT_SECRET to identify it"))
+			break
+		}
+	}
+	if len(c.ResponseRedactions) > 0 && len(c.AuthAPIKeys) == 0 && c.AuthJWTSecret == "" {
+		errs = append(errs, fmt.Errorf("RESPONSE_REDACTIONS needs AUTH_API_KEYS or AUTH_JWT_SECRET to identify callers"))
+	}
+	return errors.Join(errs...)
+}
+
+// hasAPIKey reports whether an AUTH_API_KEYS entry is called name
+func (c *Config) hasAPIKey(name string) bool {
+	for _, key := range c.AuthAPIKeys {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateStore checks a memory/redis backend setting
+func (c *Config) validateStore(name, value string) error {
+	switch value {
+	case StoreMemory:
+	case StoreRedis:
+		if c.RedisURL == "" {
+			return fmt.Errorf("REDIS_URL is required when %s=redis", name)
+		}
+	default:
+		return fmt.Errorf("%s must be %q or %q", name, StoreMemory, StoreRedis)
 	}
 	return nil
 }
@@ -0,0 +1,381 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileVersion is the settings file layout Load reads. A file declaring
+// another version is refused rather than half understood.
+const FileVersion = 1
+
+// Sources are where Load reads settings besides the environment and .env.
+// Flags win over the environment, which wins over the file; a setting none
+// of them provides keeps its default.
+type Sources struct {
+	// File is a YAML or JSON settings file. CONFIG_FILE names it when empty.
+	File string
+	// Flags are NAME=value settings from the command line, named like the
+	// environment variables
+	Flags []string
+}
+
+// CommandLine holds the sources given to the command line, which
+// LoadConfig reads
+var CommandLine Sources
+
+// settingsFile is the layout of a settings file:
+//
+//	version: 1
+//	settings:
+//	  API_URL: https://sandbox.example.com/api/transact.php
+//	  RATE_LIMIT_PER_MINUTE: 300
+//	  TRANSACTION_SINKS: [csv, jsonl]
+type settingsFile struct {
+	Version  int                  `yaml:"version"`
+	Settings map[string]yaml.Node `yaml:"settings"`
+}
+
+// lookupFunc finds a setting by its environment variable name
+type lookupFunc func(name string) (string, bool)
+
+// Struct tags read by decode and Validate:
+//
+//	env       the variables a field is read from; the first one set wins
+//	default   the value used when none of them is set or the value is empty
+//	min, max  bounds for numbers and durations
+//	oneof     the values a string, or each item of a list, may take
+//	want      the expected format, quoted in the error for a bad value
+//	required  Validate reports the field while it is empty
+//
+// Lists are comma separated. Fields without an env tag are skipped, apart
+// from structs such as AWS, whose own fields are decoded.
+
+// itemParsers parse one item of a list setting, by item type
+var itemParsers = map[reflect.Type]func(string) (interface{}, error){
+	reflect.TypeOf(""): func(s string) (interface{}, error) { return s, nil },
+	reflect.TypeOf(float64(0)): func(s string) (interface{}, error) {
+		return strconv.ParseFloat(s, 64)
+	},
+	reflect.TypeOf(netip.Prefix{}): func(s string) (interface{}, error) { return parsePrefix(s) },
+	reflect.TypeOf(RouteLimit{}):   func(s string) (interface{}, error) { return parseRouteLimit(s) },
+	reflect.TypeOf(APIKey{}):       func(s string) (interface{}, error) { return parseAPIKey(s), nil },
+	reflect.TypeOf(SigningSecret{}): func(s string) (interface{}, error) {
+		return parseSigningSecret(s), nil
+	},
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decode sets the tagged fields of the struct v points to from lookup. With
+// only, fields read from other variables are left alone. Every bad value is
+// reported, not just the first.
+func decode(v interface{}, lookup lookupFunc, only []string) []error {
+	var errs []error
+	eachField(reflect.ValueOf(v).Elem(), func(field reflect.StructField, value reflect.Value) {
+		names := envNames(field)
+		if len(only) > 0 && !containsAny(only, names) {
+			return
+		}
+		raw, name, set := "", names[0], false
+		for _, candidate := range names {
+			if value, ok := lookup(candidate); ok && value != "" {
+				raw, name, set = value, candidate, true
+				break
+			}
+		}
+		if !set {
+			raw = field.Tag.Get("default")
+			if raw == "" {
+				return
+			}
+		}
+		if err := decodeValue(value, field, raw, set); err != nil {
+			msg := fmt.Sprintf("invalid %s value %s", name, err)
+			if want := field.Tag.Get("want"); want != "" {
+				msg += ", want " + want
+			}
+			errs = append(errs, errors.New(msg))
+		}
+	})
+	return errs
+}
+
+// eachField calls fn for every field of struct v with an env tag
+func eachField(v reflect.Value, fn func(reflect.StructField, reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Tag.Get("env") == "" {
+			if field.Type.Kind() == reflect.Struct {
+				eachField(v.Field(i), fn)
+			}
+			continue
+		}
+		fn(field, v.Field(i))
+	}
+}
+
+// envNames returns the variables a field is read from
+func envNames(field reflect.StructField) []string {
+	return strings.Split(field.Tag.Get("env"), ",")
+}
+
+func containsAny(list, names []string) bool {
+	for _, name := range names {
+		for _, item := range list {
+			if item == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeValue parses raw into value. Bounds are checked only for values
+// that were set, since defaults are known to be in range. The error starts
+// with the offending value.
+func decodeValue(value reflect.Value, field reflect.StructField, raw string, set bool) error {
+	switch {
+	case value.Type() == durationType:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q", raw)
+		}
+		if set {
+			if err := checkDuration(field, parsed); err != nil {
+				return fmt.Errorf("%q, %v", raw, err)
+			}
+		}
+		value.SetInt(int64(parsed))
+
+	case value.Kind() == reflect.String:
+		if err := checkOneOf(field, raw); err != nil {
+			return fmt.Errorf("%q, %v", raw, err)
+		}
+		value.SetString(raw)
+
+	case value.Kind() == reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q", raw)
+		}
+		value.SetBool(parsed)
+
+	case value.Kind() == reflect.Int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q", raw)
+		}
+		if set {
+			if err := checkNumber(field, float64(parsed)); err != nil {
+				return fmt.Errorf("%q, %v", raw, err)
+			}
+		}
+		value.SetInt(int64(parsed))
+
+	case value.Kind() == reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q", raw)
+		}
+		if set {
+			if err := checkNumber(field, parsed); err != nil {
+				return fmt.Errorf("%q, %v", raw, err)
+			}
+		}
+		value.SetFloat(parsed)
+
+	case value.Kind() == reflect.Slice:
+		parse, ok := itemParsers[value.Type().Elem()]
+		if !ok {
+			return fmt.Errorf("%q: unsupported type %s", raw, value.Type())
+		}
+		items := reflect.MakeSlice(value.Type(), 0, 0)
+		for _, item := range splitList(raw) {
+			parsed, err := parse(item)
+			if err != nil {
+				return fmt.Errorf("%q", item)
+			}
+			if err := checkOneOf(field, item); err != nil {
+				return fmt.Errorf("%q, %v", item, err)
+			}
+			items = reflect.Append(items, reflect.ValueOf(parsed))
+		}
+		value.Set(items)
+
+	case value.Type() == reflect.TypeOf(map[string][]string{}):
+		redactions := make(map[string][]string)
+		for _, item := range splitList(raw) {
+			caller, fields, err := parseRedaction(item)
+			if err != nil {
+				return fmt.Errorf("%q", item)
+			}
+			redactions[caller] = append(redactions[caller], fields...)
+		}
+		value.Set(reflect.ValueOf(redactions))
+
+	default:
+		return fmt.Errorf("%q: unsupported type %s", raw, value.Type())
+	}
+	return nil
+}
+
+func checkNumber(field reflect.StructField, value float64) error {
+	if bound := field.Tag.Get("min"); bound != "" {
+		if min, _ := strconv.ParseFloat(bound, 64); value < min {
+			return fmt.Errorf("want at least %s", bound)
+		}
+	}
+	if bound := field.Tag.Get("max"); bound != "" {
+		if max, _ := strconv.ParseFloat(bound, 64); value > max {
+			return fmt.Errorf("want at most %s", bound)
+		}
+	}
+	return nil
+}
+
+func checkDuration(field reflect.StructField, value time.Duration) error {
+	if bound := field.Tag.Get("min"); bound != "" {
+		if min, _ := time.ParseDuration(bound); value < min {
+			return fmt.Errorf("want a duration of at least %s", bound)
+		}
+	}
+	return nil
+}
+
+func checkOneOf(field reflect.StructField, value string) error {
+	allowed := field.Tag.Get("oneof")
+	if allowed == "" {
+		return nil
+	}
+	for _, option := range strings.Fields(allowed) {
+		if value == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("want one of %s", strings.Join(strings.Fields(allowed), ", "))
+}
+
+// missingRequired names the required settings v leaves empty
+func missingRequired(v interface{}) []error {
+	var errs []error
+	eachField(reflect.ValueOf(v).Elem(), func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			errs = append(errs, fmt.Errorf("%s is required", envNames(field)[0]))
+		}
+	})
+	return errs
+}
+
+// settingNames lists every variable Config is read from
+func settingNames() map[string]bool {
+	names := make(map[string]bool)
+	eachField(reflect.ValueOf(&Config{}).Elem(), func(field reflect.StructField, _ reflect.Value) {
+		for _, name := range envNames(field) {
+			names[name] = true
+		}
+	})
+	return names
+}
+
+// parseFlags reads NAME=value command-line settings
+func parseFlags(flags []string) (map[string]string, error) {
+	known := settingNames()
+	values := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		name, value, ok := strings.Cut(flag, "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid setting %q, want NAME=value", flag)
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown setting %s", name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// readSettingsFile reads the settings in a YAML or JSON file, keyed by
+// their environment variable names. A list becomes a comma-separated value.
+// An empty path has no settings.
+func readSettingsFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML, so one decoder reads both
+	var file settingsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Version != FileVersion {
+		return nil, fmt.Errorf("%s: version %d is not supported, want %d", path, file.Version, FileVersion)
+	}
+
+	known := settingNames()
+	values := make(map[string]string, len(file.Settings))
+	var errs []error
+	for key, node := range file.Settings {
+		name := strings.ToUpper(key)
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", path, key))
+			continue
+		}
+		switch node.Kind {
+		case yaml.ScalarNode:
+			values[name] = node.Value
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(node.Content))
+			for _, item := range node.Content {
+				items = append(items, item.Value)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			errs = append(errs, fmt.Errorf("%s: %s must be a value or a list", path, key))
+		}
+	}
+	return values, errors.Join(errs...)
+}
+
+// layered looks a setting up in each source in turn
+func layered(sources ...lookupFunc) lookupFunc {
+	return func(name string) (string, bool) {
+		for _, source := range sources {
+			if value, ok := source(name); ok {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// fromMap looks settings up in values
+func fromMap(values map[string]string) lookupFunc {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+// getenvFunc adapts lookup to os.Getenv's signature
+func getenvFunc(lookup lookupFunc) func(string) string {
+	return func(name string) string {
+		value, _ := lookup(name)
+		return value
+	}
+}
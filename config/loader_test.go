@@ -0,0 +1,119 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// load runs Load with an empty .env, undoing what it records for reloads
+func load(t *testing.T, sources Sources) (*Config, error) {
+	t.Helper()
+	useEnvFile(t, "")
+	t.Cleanup(func() {
+		settingsPath, flagSettings = "", nil
+		for name := range inherited {
+			delete(inherited, name)
+		}
+	})
+	return Load(sources)
+}
+
+func writeSettings(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeSettings(t, "settings.yaml", `version: 1
+settings:
+  API_URL: https://sandbox.example.com/api/transact.php
+  rate_limit_per_minute: 200
+  GATEWAY_TIMEOUT: 5s
+  TRANSACTION_SINKS: [csv, jsonl]
+`)
+	t.Setenv("NMI_API_KEY", "env-key")
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "300")
+
+	cfg, err := load(t, Sources{File: file, Flags: []string{"RATE_LIMIT_PER_MINUTE=400"}})
+	require.NoError(t, err)
+	assert.Equal(t, "env-key", cfg.APIKey)
+	assert.Equal(t, 400, cfg.RateLimitPerMinute)
+	assert.Equal(t, "https://sandbox.example.com/api/transact.php", cfg.APIBaseURL)
+	assert.Equal(t, "https://sandbox.example.com/api/query.php", cfg.QueryURL)
+	assert.Equal(t, 5*time.Second, cfg.GatewayTimeout)
+	assert.Equal(t, []string{SinkCSV, SinkJSONL}, cfg.TransactionSinks)
+
+	// Defaults
+	assert.Equal(t, "8080", cfg.Port)
+	assert.Equal(t, StoreMemory, cfg.IdempotencyStore)
+	assert.Equal(t, time.Minute, cfg.TerminalHeartbeatInterval)
+	assert.Equal(t, DefaultRequestSignatureTolerance, cfg.RequestSignatureTolerance)
+	assert.True(t, cfg.SyncPlansToGateway)
+	assert.Equal(t, "payments.", cfg.EventTopicPrefix)
+	assert.Equal(t, []string{"lookup"}, cfg.ShadowOperations)
+	assert.Equal(t, DefaultLoadShedRoutes, cfg.LoadShedRoutes)
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	t.Setenv("NMI_API_KEY", "")
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "0")
+	t.Setenv("SHADOW_OPERATIONS", "lookup,delete")
+	t.Setenv("ADMIN_IP_ALLOWLIST", "10.0.0.0/8,intranet")
+	t.Setenv("GRPC_PORT", "9090")
+	t.Setenv("AUTH_DISABLED", "true")
+	t.Setenv("AUTH_API_KEYS", "ops:k1")
+
+	_, err := load(t, Sources{})
+	require.Error(t, err)
+	for _, problem := range []string{
+		"NMI_API_KEY is required",
+		`invalid RATE_LIMIT_PER_MINUTE value "0", want at least 1`,
+		`invalid SHADOW_OPERATIONS value "delete", want one of lookup, search`,
+		`invalid ADMIN_IP_ALLOWLIST value "intranet"`,
+		"GRPC_AUTH_TOKENS is required when GRPC_PORT is set",
+		"AUTH_DISABLED cannot be set with AUTH_API_KEYS or AUTH_JWT_SECRET",
+	} {
+		assert.ErrorContains(t, err, problem)
+	}
+}
+
+func TestLoadJSONSettingsFile(t *testing.T) {
+	t.Setenv("NMI_API_KEY", "env-key")
+	file := writeSettings(t, "settings.json", `{"version": 1, "settings": {"DEBUG_MODE": true, "AUTH_API_KEYS": ["ops:k1", "k2"]}}`)
+
+	cfg, err := load(t, Sources{File: file})
+	require.NoError(t, err)
+	assert.True(t, cfg.DebugMode)
+	assert.Equal(t, []APIKey{{Name: "ops", Key: "k1"}, {Name: "api_key", Key: "k2"}}, cfg.AuthAPIKeys)
+}
+
+func TestLoadRejectsUnknownSettings(t *testing.T) {
+	t.Setenv("NMI_API_KEY", "env-key")
+
+	_, err := load(t, Sources{File: writeSettings(t, "v2.yaml", "version: 2\nsettings: {}\n")})
+	assert.ErrorContains(t, err, "version 2 is not supported")
+
+	_, err = load(t, Sources{File: writeSettings(t, "typo.yaml", "version: 1\nsettings:\n  RATE_LIMIT: 5\n")})
+	assert.ErrorContains(t, err, "unknown setting RATE_LIMIT")
+
+	_, err = load(t, Sources{Flags: []string{"RATE_LIMIT=5"}})
+	assert.ErrorContains(t, err, "unknown setting RATE_LIMIT")
+}
+
+func TestReloadKeepsFlags(t *testing.T) {
+	t.Setenv("NMI_API_KEY", "env-key")
+	cfg, err := load(t, Sources{Flags: []string{"RATE_LIMIT_PER_MINUTE=250"}})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(envFile, []byte("RATE_LIMIT_PER_MINUTE=30\n"), 0600))
+	_, err = cfg.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, 250, cfg.Settings().RateLimitPerMinute)
+}
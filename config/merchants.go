@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultMerchantID names the merchant account configured by NMI_API_KEY.
+// Requests that identify no other merchant are charged to it.
+const DefaultMerchantID = "default"
+
+// Merchant is one NMI merchant account the service can charge
+type Merchant struct {
+	ID     string `yaml:"id"`
+	APIKey string `yaml:"api_key"`
+	// Descriptor and Currency are sent on sales and authorizations that do
+	// not set their own
+	Descriptor string `yaml:"descriptor"`
+	Currency   string `yaml:"currency"`
+	// Callers are the authenticated caller names (API key and gRPC token
+	// names, or JWT subjects) that act for this merchant and no other
+	Callers []string `yaml:"callers"`
+	// Surcharge is the card fee added to the merchant's sales
+	Surcharge SurchargePolicy `yaml:"surcharge"`
+	// Verification is the AVS and CVV results the merchant accepts
+	Verification VerificationPolicy `yaml:"verification"`
+}
+
+// merchantsFile is the layout of MERCHANTS_FILE
+type merchantsFile struct {
+	// Surcharge is the default account's surcharge policy
+	Surcharge SurchargePolicy `yaml:"surcharge"`
+	// Verification is the default account's AVS and CVV policy
+	Verification VerificationPolicy `yaml:"verification"`
+	Merchants    []Merchant         `yaml:"merchants"`
+}
+
+// loadMerchants reads the merchant accounts from a YAML file. ${VAR}
+// references are expanded with getenv, so security keys can stay out of the
+// file.
+func loadMerchants(path string, getenv func(string) string) (*merchantsFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file merchantsFile
+	if err := yaml.Unmarshal([]byte(os.Expand(string(data), getenv)), &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := file.Surcharge.normalize(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := file.Verification.normalize(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	seen := map[string]bool{DefaultMerchantID: true}
+	callers := make(map[string]string)
+	for i := range file.Merchants {
+		m := &file.Merchants[i]
+		switch {
+		case m.ID == "":
+			return nil, fmt.Errorf("%s: merchant %d has no id", path, i+1)
+		case seen[m.ID]:
+			return nil, fmt.Errorf("%s: merchant id %q is reserved or repeated", path, m.ID)
+		case m.APIKey == "":
+			return nil, fmt.Errorf("%s: merchant %q has no api_key", path, m.ID)
+		case m.Currency != "" && len(m.Currency) != 3:
+			return nil, fmt.Errorf("%s: merchant %q currency %q is not an ISO 4217 code", path, m.ID, m.Currency)
+		}
+		if err := m.Surcharge.normalize(); err != nil {
+			return nil, fmt.Errorf("%s: merchant %q %w", path, m.ID, err)
+		}
+		if err := m.Verification.normalize(); err != nil {
+			return nil, fmt.Errorf("%s: merchant %q %w", path, m.ID, err)
+		}
+		seen[m.ID] = true
+		m.Currency = strings.ToUpper(m.Currency)
+		for _, caller := range m.Callers {
+			if other, ok := callers[caller]; ok {
+				return nil, fmt.Errorf("%s: caller %q belongs to both %q and %q", path, caller, other, m.ID)
+			}
+			callers[caller] = m.ID
+		}
+	}
+	return &file, nil
+}
+
+// Merchant returns the merchant account with the given ID. The default
+// account is built from NMI_API_KEY.
+func (c *Config) Merchant(id string) (Merchant, bool) {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	if id == "" || id == DefaultMerchantID {
+		return c.defaultMerchant(), true
+	}
+	for _, m := range c.Merchants {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Merchant{}, false
+}
+
+// MerchantForCaller returns the merchant an authenticated caller is bound to
+func (c *Config) MerchantForCaller(caller string) (Merchant, bool) {
+	if caller == "" {
+		return Merchant{}, false
+	}
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	for _, m := range c.Merchants {
+		for _, bound := range m.Callers {
+			if bound == caller {
+				return m, true
+			}
+		}
+	}
+	return Merchant{}, false
+}
+
+// MerchantAccounts returns every merchant account, the default one first
+func (c *Config) MerchantAccounts() []Merchant {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	accounts := []Merchant{c.defaultMerchant()}
+	return append(accounts, c.Merchants...)
+}
+
+// defaultMerchant builds the default account; callers hold reloadMu
+func (c *Config) defaultMerchant() Merchant {
+	return Merchant{ID: DefaultMerchantID, APIKey: c.APIKey, Surcharge: c.Surcharge, Verification: c.Verification}
+}
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// envFile is the dotenv file read at startup and on every reload
+var envFile = ".env"
+
+var (
+	// reloadMu guards the fields Reload replaces while the service runs. It
+	// is shared by every Config because configs are copied by value.
+	reloadMu sync.RWMutex
+	// reloading serializes reloads from SIGHUP and the file watcher
+	reloading sync.Mutex
+)
+
+// reloadableVars are the environment variables Reload re-reads
+var reloadableVars = []string{"NMI_API_KEY", "DEBUG_MODE", "RATE_LIMIT_PER_MINUTE", "GATEWAY_TIMEOUT", "MERCHANTS_FILE"}
+
+// inherited records which reloadable variables the process environment set
+// before .env was loaded. Those keep winning over .env on reload, as they
+// did at startup.
+var inherited = map[string]bool{}
+
+// settingsPath and flagSettings are the settings file and command-line
+// settings Load read, which reloads read again. Flags keep winning, since
+// the command line cannot change while the process runs.
+var (
+	settingsPath string
+	flagSettings map[string]string
+)
+
+// Settings is the part of the configuration Reload can change without a
+// restart
+type Settings struct {
+	APIKey             string
+	DebugMode          bool
+	RateLimitPerMinute int
+	GatewayTimeout     time.Duration
+	MerchantsFile      string
+	Merchants          []Merchant
+	Surcharge          SurchargePolicy
+	Verification       VerificationPolicy
+}
+
+// readSettings parses the reloadable settings with the same tags Load
+// uses, looking variables up with lookup
+func readSettings(lookup lookupFunc) (Settings, error) {
+	var c Config
+	if err := errors.Join(decode(&c, lookup, reloadableVars)...); err != nil {
+		return Settings{}, err
+	}
+
+	s := Settings{
+		APIKey:             c.APIKey,
+		DebugMode:          c.DebugMode,
+		RateLimitPerMinute: c.RateLimitPerMinute,
+		GatewayTimeout:     c.GatewayTimeout,
+		MerchantsFile:      c.MerchantsFile,
+	}
+	if s.MerchantsFile != "" {
+		file, err := loadMerchants(s.MerchantsFile, getenvFunc(lookup))
+		if err != nil {
+			return s, fmt.Errorf("invalid MERCHANTS_FILE: %v", err)
+		}
+		s.Merchants, s.Surcharge, s.Verification = file.Merchants, file.Surcharge, file.Verification
+	}
+	return s, nil
+}
+
+// Settings returns the reloadable settings in effect. Code running while
+// the service serves traffic reads them here rather than from the fields.
+func (c *Config) Settings() Settings {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return Settings{
+		APIKey:             c.APIKey,
+		DebugMode:          c.DebugMode,
+		RateLimitPerMinute: c.RateLimitPerMinute,
+		GatewayTimeout:     c.GatewayTimeout,
+		MerchantsFile:      c.MerchantsFile,
+		Merchants:          c.Merchants,
+		Surcharge:          c.Surcharge,
+		Verification:       c.Verification,
+	}
+}
+
+// apply replaces the reloadable fields with s
+func (c *Config) apply(s Settings) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c.APIKey = s.APIKey
+	c.DebugMode = s.DebugMode
+	c.RateLimitPerMinute = s.RateLimitPerMinute
+	c.GatewayTimeout = s.GatewayTimeout
+	c.MerchantsFile = s.MerchantsFile
+	c.Merchants = s.Merchants
+	c.Surcharge = s.Surcharge
+	c.Verification = s.Verification
+}
+
+// Reload re-reads NMI_API_KEY, DEBUG_MODE, RATE_LIMIT_PER_MINUTE,
+// GATEWAY_TIMEOUT and MERCHANTS_FILE from .env, the settings file and the
+// merchants file and swaps them in. It returns the variables whose settings changed. When
+// anything is invalid, the running settings are kept and the error
+// returned. A variable removed from .env keeps its last value.
+func (c *Config) Reload() ([]string, error) {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	dotenv, err := godotenv.Read(envFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	file, err := readSettingsFile(settingsPath)
+	if err != nil {
+		return nil, err
+	}
+	next, err := readSettings(layered(
+		fromMap(flagSettings),
+		func(name string) (string, bool) {
+			value, ok := dotenv[name]
+			return value, ok && !inherited[name]
+		},
+		os.LookupEnv,
+		fromMap(file),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	current := c.Settings()
+	if c.SecretsBackend != "" {
+		// RefreshSecrets owns the key
+		next.APIKey = current.APIKey
+	} else if next.APIKey == "" {
+		return nil, fmt.Errorf("NMI_API_KEY is required")
+	}
+	var changed []string
+	if next.APIKey != current.APIKey {
+		changed = append(changed, "NMI_API_KEY")
+	}
+	if next.DebugMode != current.DebugMode {
+		changed = append(changed, "DEBUG_MODE")
+	}
+	if next.RateLimitPerMinute != current.RateLimitPerMinute {
+		changed = append(changed, "RATE_LIMIT_PER_MINUTE")
+	}
+	if next.GatewayTimeout != current.GatewayTimeout {
+		changed = append(changed, "GATEWAY_TIMEOUT")
+	}
+	if next.MerchantsFile != current.MerchantsFile || !reflect.DeepEqual(next.Merchants, current.Merchants) ||
+		!reflect.DeepEqual(next.Surcharge, current.Surcharge) || !reflect.DeepEqual(next.Verification, current.Verification) {
+		changed = append(changed, "MERCHANTS_FILE")
+	}
+	c.apply(next)
+	return changed, nil
+}
+
+// Watch reloads the settings whenever .env, the settings file or the
+// merchants file is modified, checking every interval until ctx is done, and passes each
+// reload's outcome to onReload
+func (c *Config) Watch(ctx context.Context, interval time.Duration, onReload func(changed []string, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := c.watchedVersion()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if version := c.watchedVersion(); version != last {
+			last = version
+			onReload(c.Reload())
+		}
+	}
+}
+
+// watchedVersion summarizes the size and modification time of the watched
+// files, so any edit to them changes it
+func (c *Config) watchedVersion() string {
+	var version string
+	reloading.Lock()
+	paths := []string{envFile, settingsPath, c.Settings().MerchantsFile}
+	reloading.Unlock()
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			version += fmt.Sprintf("%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return version
+}
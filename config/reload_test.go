@@ -0,0 +1,90 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useEnvFile points reloads at a dotenv file in a temporary directory
+func useEnvFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	previous := envFile
+	envFile = path
+	t.Cleanup(func() { envFile = previous })
+	return path
+}
+
+func TestReload(t *testing.T) {
+	path := useEnvFile(t, "NMI_API_KEY=new-key\nRATE_LIMIT_PER_MINUTE=30\nGATEWAY_TIMEOUT=5s\nDEBUG_MODE=true\n")
+	cfg := &Config{APIKey: "old-key", RateLimitPerMinute: 100}
+
+	changed, err := cfg.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"NMI_API_KEY", "DEBUG_MODE", "RATE_LIMIT_PER_MINUTE", "GATEWAY_TIMEOUT"}, changed)
+	settings := cfg.Settings()
+	assert.Equal(t, "new-key", settings.APIKey)
+	assert.Equal(t, 30, settings.RateLimitPerMinute)
+	assert.Equal(t, 5*time.Second, settings.GatewayTimeout)
+	assert.True(t, settings.DebugMode)
+	merchant, _ := cfg.Merchant(DefaultMerchantID)
+	assert.Equal(t, "new-key", merchant.APIKey)
+
+	// An invalid value keeps everything as it was
+	require.NoError(t, os.WriteFile(path, []byte("NMI_API_KEY=newer-key\nRATE_LIMIT_PER_MINUTE=lots\n"), 0600))
+	_, err = cfg.Reload()
+	assert.ErrorContains(t, err, "RATE_LIMIT_PER_MINUTE")
+	assert.Equal(t, "new-key", cfg.Settings().APIKey)
+}
+
+func TestReloadKeepsInheritedEnvironment(t *testing.T) {
+	useEnvFile(t, "NMI_API_KEY=file-key\n")
+	t.Setenv("NMI_API_KEY", "process-key")
+	inherited["NMI_API_KEY"] = true
+	t.Cleanup(func() { delete(inherited, "NMI_API_KEY") })
+
+	cfg := &Config{APIKey: "process-key", RateLimitPerMinute: DefaultRateLimitPerMinute}
+	changed, err := cfg.Reload()
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Equal(t, "process-key", cfg.Settings().APIKey)
+}
+
+func TestWatchReloadsMerchantsFile(t *testing.T) {
+	merchants := filepath.Join(t.TempDir(), "merchants.yaml")
+	require.NoError(t, os.WriteFile(merchants, []byte("merchants:\n  - id: acme\n    api_key: ${ACME_KEY}\n"), 0600))
+	useEnvFile(t, "NMI_API_KEY=key\nACME_KEY=acme-1\nMERCHANTS_FILE="+merchants+"\n")
+
+	cfg := &Config{}
+	_, err := cfg.Reload()
+	require.NoError(t, err)
+	acme, ok := cfg.Merchant("acme")
+	require.True(t, ok)
+	assert.Equal(t, "acme-1", acme.APIKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan []string, 1)
+	go cfg.Watch(ctx, 10*time.Millisecond, func(changed []string, err error) {
+		assert.NoError(t, err)
+		reloads <- changed
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, os.WriteFile(merchants, []byte("merchants:\n  - id: acme\n    api_key: acme-2\n    descriptor: ACME\n"), 0600))
+	select {
+	case changed := <-reloads:
+		assert.Equal(t, []string{"MERCHANTS_FILE"}, changed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("merchants file change was not picked up")
+	}
+	acme, _ = cfg.Merchant("acme")
+	assert.Equal(t, "acme-2", acme.APIKey)
+}
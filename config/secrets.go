@@ -0,0 +1,98 @@
+package config
+
+import (
+	"context"
+	"time"
+
+	"nmi-pay-int/awsauth"
+	"nmi-pay-int/secrets"
+)
+
+// secretAttempts is how many times startup tries the secrets backend, so a
+// brief outage delays a deploy rather than failing it
+const secretAttempts = 3
+
+// secretRetryDelay is the wait before the second attempt, doubling after;
+// tests shorten it
+var secretRetryDelay = time.Second
+
+// loadSecret reads NMI_API_KEY from the secrets backend, retrying while it
+// is unavailable
+func (c *Config) loadSecret(ctx context.Context) error {
+	provider, err := secrets.New(secrets.Options{
+		Backend:     c.SecretsBackend,
+		ID:          c.SecretsID,
+		Field:       c.SecretsField,
+		AWSRegion:   c.AWS.Region,
+		AWSEndpoint: c.AWS.EndpointURL,
+		AWSCredentials: awsauth.Credentials{
+			AccessKeyID:     c.AWS.AccessKeyID,
+			SecretAccessKey: c.AWS.SecretAccessKey,
+			SessionToken:    c.AWS.SessionToken,
+		},
+		GCPAccessToken: c.GCPAccessToken,
+		VaultAddr:      c.VaultAddr,
+		VaultToken:     c.VaultToken,
+	})
+	if err != nil {
+		return err
+	}
+	c.secretProvider = provider
+
+	delay := secretRetryDelay
+	for attempt := 1; ; attempt++ {
+		key, err := provider.Fetch(ctx)
+		if err == nil {
+			c.APIKey = key
+			return nil
+		}
+		if attempt == secretAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// RefreshSecrets reads NMI_API_KEY from the secrets backend every
+// SecretsRefreshInterval until ctx is done, passing onRefresh whether the
+// key changed. When a read fails the key already in use stays in effect, so
+// a backend outage does not stop payments.
+func (c *Config) RefreshSecrets(ctx context.Context, onRefresh func(changed bool, err error)) {
+	if c.secretProvider == nil {
+		return
+	}
+	ticker := time.NewTicker(c.SecretsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		onRefresh(c.refreshSecret(ctx))
+	}
+}
+
+// refreshSecret reads the key once and swaps it in
+func (c *Config) refreshSecret(ctx context.Context) (bool, error) {
+	key, err := c.secretProvider.Fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Hold off reloads, which copy the current key back
+	reloading.Lock()
+	defer reloading.Unlock()
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if key == c.APIKey {
+		return false, nil
+	}
+	c.APIKey = key
+	return true, nil
+}
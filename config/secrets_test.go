@@ -0,0 +1,73 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadReadsKeyFromSecretsBackend(t *testing.T) {
+	secretRetryDelay = time.Millisecond
+	t.Cleanup(func() { secretRetryDelay = time.Second })
+
+	var calls atomic.Int32
+	var key atomic.Value
+	key.Store("key-1")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first read fails, as if Vault were restarting
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if key.Load() == "" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"api_key":"` + key.Load().(string) + `"},"metadata":{}}}`))
+	}))
+	defer vault.Close()
+
+	t.Setenv("NMI_API_KEY", "")
+	t.Setenv("SECRETS_BACKEND", "vault")
+	t.Setenv("SECRETS_ID", "secret/data/nmi")
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "s.token")
+
+	cfg, err := load(t, Sources{})
+	require.NoError(t, err)
+	assert.Equal(t, "key-1", cfg.Settings().APIKey)
+
+	// A rotation is picked up
+	key.Store("key-2")
+	changed, err := cfg.refreshSecret(context.Background())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "key-2", cfg.Settings().APIKey)
+
+	// An outage keeps the key in use
+	key.Store("")
+	_, err = cfg.refreshSecret(context.Background())
+	assert.ErrorContains(t, err, "502")
+	assert.Equal(t, "key-2", cfg.Settings().APIKey)
+
+	// Reloading .env leaves the key to the backend
+	_, err = cfg.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, "key-2", cfg.Settings().APIKey)
+}
+
+func TestLoadRefusesKeyInEnvWithSecretsBackend(t *testing.T) {
+	t.Setenv("NMI_API_KEY", "env-key")
+	t.Setenv("SECRETS_BACKEND", "vault")
+	t.Setenv("SECRETS_ID", "secret/data/nmi")
+
+	_, err := load(t, Sources{})
+	assert.ErrorContains(t, err, "set NMI_API_KEY or SECRETS_BACKEND, not both")
+	assert.ErrorContains(t, err, "VAULT_ADDR and VAULT_TOKEN are required")
+}
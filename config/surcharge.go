@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultSurchargeCap is the largest surcharge, as a percentage of the sale,
+// card brand rules allow in the US
+const DefaultSurchargeCap = 3.0
+
+// SurchargeRule is a card fee passed on to the cardholder: a percentage of
+// the sale, a flat fee, or both. A flat-only rule is a convenience fee.
+type SurchargeRule struct {
+	// Brands limits the rule to cards of these brands (visa, mastercard,
+	// amex, discover); empty applies it to every card
+	Brands  []string `yaml:"brands"`
+	Percent float64  `yaml:"percent"`
+	// Flat is a dollar amount such as "0.50"
+	Flat string `yaml:"flat"`
+}
+
+// SurchargePolicy is how a merchant passes card fees on. Sales use the
+// first rule matching the card's brand.
+type SurchargePolicy struct {
+	Rules []SurchargeRule `yaml:"rules"`
+	// ProhibitedStates are the two-letter codes of states where cardholders
+	// may not be surcharged
+	ProhibitedStates []string `yaml:"prohibited_states"`
+	// MaxPercent caps the surcharge as a percentage of the sale; zero uses
+	// DefaultSurchargeCap
+	MaxPercent float64 `yaml:"max_percent"`
+}
+
+var flatFeePattern = regexp.MustCompile(`^\d+\.\d{2}$`)
+
+// Enabled reports whether the policy surcharges anything
+func (p SurchargePolicy) Enabled() bool {
+	return len(p.Rules) > 0
+}
+
+// Cap returns the surcharge cap as a percentage of the sale
+func (p SurchargePolicy) Cap() float64 {
+	if p.MaxPercent == 0 {
+		return DefaultSurchargeCap
+	}
+	return p.MaxPercent
+}
+
+// Prohibited reports whether cardholders billed in state may not be
+// surcharged
+func (p SurchargePolicy) Prohibited(state string) bool {
+	for _, prohibited := range p.ProhibitedStates {
+		if strings.EqualFold(prohibited, strings.TrimSpace(state)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize checks the policy and lower-cases brands and upper-cases states
+func (p *SurchargePolicy) normalize() error {
+	if p.MaxPercent < 0 || p.MaxPercent > 100 {
+		return fmt.Errorf("surcharge max_percent %v is not a percentage", p.MaxPercent)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		switch {
+		case rule.Percent < 0 || rule.Percent > p.Cap():
+			return fmt.Errorf("surcharge rule %d percent %v is outside 0 to %v", i+1, rule.Percent, p.Cap())
+		case rule.Flat != "" && !flatFeePattern.MatchString(rule.Flat):
+			return fmt.Errorf("surcharge rule %d flat %q is not a dollar amount such as 0.50", i+1, rule.Flat)
+		case rule.Percent == 0 && rule.Flat == "":
+			return fmt.Errorf("surcharge rule %d has neither percent nor flat", i+1)
+		}
+		for j, brand := range rule.Brands {
+			rule.Brands[j] = strings.ToLower(strings.TrimSpace(brand))
+		}
+	}
+	for i, state := range p.ProhibitedStates {
+		state = strings.ToUpper(strings.TrimSpace(state))
+		if len(state) != 2 {
+			return fmt.Errorf("surcharge prohibited state %q is not a two-letter code", state)
+		}
+		p.ProhibitedStates[i] = state
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerificationRule voids an approved sale or authorization whose AVS or CVV
+// result the merchant will not accept
+type VerificationRule struct {
+	// Name identifies the rule in responses, logs and metrics; empty names
+	// it by position, such as "rule 2"
+	Name string `yaml:"name"`
+	// AVS and CVV are the result codes that violate the rule, such as N
+	AVS []string `yaml:"avs"`
+	CVV []string `yaml:"cvv"`
+	// RequireCVVMatch violates the rule for every CVV result but M,
+	// including payments sent without a CVV
+	RequireCVVMatch bool `yaml:"require_cvv_match"`
+	// AmountOver limits the rule to amounts above a dollar amount such as
+	// "100.00"
+	AmountOver string `yaml:"amount_over"`
+}
+
+// VerificationPolicy is the AVS and CVV results a merchant accepts on
+// approved payments. Payments are checked against the rules in order.
+type VerificationPolicy struct {
+	Rules []VerificationRule `yaml:"rules"`
+	// ReportOnly reports violations without voiding, to try rules out
+	ReportOnly bool `yaml:"report_only"`
+}
+
+// Enabled reports whether the policy checks anything
+func (p VerificationPolicy) Enabled() bool {
+	return len(p.Rules) > 0
+}
+
+// normalize checks the policy, names unnamed rules and upper-cases codes
+func (p *VerificationPolicy) normalize() error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		switch {
+		case len(rule.AVS) == 0 && len(rule.CVV) == 0 && !rule.RequireCVVMatch:
+			return fmt.Errorf("verification rule %q checks neither avs nor cvv", rule.Name)
+		case rule.AmountOver != "" && !flatFeePattern.MatchString(rule.AmountOver):
+			return fmt.Errorf("verification rule %q amount_over %q is not a dollar amount such as 100.00", rule.Name, rule.AmountOver)
+		}
+		for j, code := range rule.AVS {
+			rule.AVS[j] = strings.ToUpper(strings.TrimSpace(code))
+		}
+		for j, code := range rule.CVV {
+			rule.CVV[j] = strings.ToUpper(strings.TrimSpace(code))
+		}
+	}
+	return nil
+}
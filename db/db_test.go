@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebind(t *testing.T) {
+	pg := &DB{Dialect: Postgres}
+	assert.Equal(t, "SELECT * FROM t WHERE a = $1 AND b = $2", pg.Rebind("SELECT * FROM t WHERE a = ? AND b = ?"))
+
+	lite := &DB{Dialect: SQLite}
+	assert.Equal(t, "SELECT * FROM t WHERE a = ?", lite.Rebind("SELECT * FROM t WHERE a = ?"))
+}
+
+func TestOpenRejectsUnknownScheme(t *testing.T) {
+	_, err := Open(context.Background(), "mysql://localhost/payments")
+	assert.ErrorIs(t, err, ErrUnsupportedURL)
+}
+
+func TestMigrateAppliesEachVersionOnce(t *testing.T) {
+	ctx := context.Background()
+	database, err := Open(ctx, "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	migrations := fstest.MapFS{
+		"0001_create.sql": {Data: []byte("CREATE TABLE items (id TEXT PRIMARY KEY);")},
+		"0002_seed.sql":   {Data: []byte("INSERT INTO items (id) VALUES ('a'); INSERT INTO items (id) VALUES ('b');")},
+	}
+	require.NoError(t, database.Migrate(ctx, "items", migrations))
+	// A second run would fail on the duplicate inserts if it reapplied them
+	require.NoError(t, database.Migrate(ctx, "items", migrations))
+
+	var count int
+	require.NoError(t, database.QueryRow("SELECT COUNT(*) FROM items").Scan(&count))
+	assert.Equal(t, 2, count)
+
+	_, err = database.Exec("INSERT INTO items (id) VALUES ('a')")
+	assert.True(t, IsUniqueViolation(err))
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrate applies the component's migrations that have not run yet. Files in
+// migrations are named NNNN_description.sql and applied in order, each in its
+// own transaction. Versions are tracked per component in schema_migrations,
+// so every package can own its tables and migrations independently.
+func (d *DB) Migrate(ctx context.Context, component string, migrations fs.FS) error {
+	if _, err := d.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		component  TEXT    NOT NULL,
+		version    INTEGER NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (component, version)
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	files, err := fs.Glob(migrations, "*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	applied := make(map[int]bool)
+	rows, err := d.QueryContext(ctx, d.Rebind(`SELECT version FROM schema_migrations WHERE component = ?`), component)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		version, err := strconv.Atoi(strings.SplitN(file, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s: name must start with a version number", file)
+		}
+		if applied[version] {
+			continue
+		}
+
+		script, err := fs.ReadFile(migrations, file)
+		if err != nil {
+			return err
+		}
+		if err := d.apply(ctx, component, version, string(script)); err != nil {
+			return fmt.Errorf("migration %s/%s: %w", component, file, err)
+		}
+	}
+	return nil
+}
+
+func (d *DB) apply(ctx context.Context, component string, version int, script string) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range strings.Split(script, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, d.Rebind(`INSERT INTO schema_migrations (component, version) VALUES (?, ?)`), component, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,105 @@
+package downloads
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/logctx"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTTL applies when a link request does not give one
+const defaultTTL = 24 * time.Hour
+
+// LinkRequest asks for a signed link to a registered resource
+type LinkRequest struct {
+	Resource   string `json:"resource"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+// LinkResponse is a shareable signed link
+type LinkResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// HandleCreateLink mints a signed link for a resource
+func HandleCreateLink(s *Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LinkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		ttl := defaultTTL
+		if req.TTLSeconds > 0 {
+			ttl = time.Duration(req.TTLSeconds) * time.Second
+		}
+		if ttl > MaxTTL {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "ttl_seconds exceeds the maximum of 7 days")
+			return
+		}
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		query, err := s.Sign(req.Resource, expires)
+		if errors.Is(err, ErrUnknownResource) {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		} else if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to sign link")
+			return
+		}
+
+		logctx.From(r.Context()).WithFields(logrus.Fields{
+			"resource":   req.Resource,
+			"expires_at": expires,
+		}).Info("Signed download link issued")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LinkResponse{
+			URL:       "/downloads/" + req.Resource + "?" + query.Encode(),
+			ExpiresAt: expires,
+		})
+	}
+}
+
+// HandleDownload serves a resource for a valid, unused signed link and
+// records every attempt in the audit log
+func HandleDownload(s *Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resource := mux.Vars(r)["resource"]
+		log := logctx.From(r.Context()).WithFields(logrus.Fields{
+			"resource":    resource,
+			"nonce":       r.URL.Query().Get("nonce"),
+			"remote_addr": r.RemoteAddr,
+			"user_agent":  r.UserAgent(),
+		})
+
+		res, err := s.Redeem(resource, r.URL.Query())
+		if err != nil {
+			log.WithError(err).Warn("Signed download rejected")
+			status := http.StatusForbidden
+			switch {
+			case errors.Is(err, ErrLinkExpired), errors.Is(err, ErrLinkUsed):
+				status = http.StatusGone
+			case errors.Is(err, ErrUnknownResource):
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := res(w, r); err != nil {
+			log.WithError(err).Error("Signed download failed")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to serve download")
+			return
+		}
+		log.Info("Signed download served")
+	}
+}
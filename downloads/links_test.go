@@ -0,0 +1,59 @@
+package downloads
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func noopResource(w http.ResponseWriter, r *http.Request) error { return nil }
+
+func TestSignAndRedeem(t *testing.T) {
+	s := NewSigner("test-secret")
+	s.Register("exports/transactions.csv", noopResource)
+
+	query, err := s.Sign("exports/transactions.csv", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+
+	_, err = s.Redeem("exports/transactions.csv", query)
+	require.NoError(t, err)
+
+	// Links are single use
+	_, err = s.Redeem("exports/transactions.csv", query)
+	assert.ErrorIs(t, err, ErrLinkUsed)
+}
+
+func TestRedeemRejectsTampering(t *testing.T) {
+	s := NewSigner("test-secret")
+	s.Register("exports/a.csv", noopResource)
+	s.Register("exports/b.csv", noopResource)
+
+	query, err := s.Sign("exports/a.csv", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+
+	_, err = s.Redeem("exports/b.csv", query)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	query.Set("expires", "9999999999")
+	_, err = s.Redeem("exports/a.csv", query)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestRedeemExpired(t *testing.T) {
+	s := NewSigner("test-secret")
+	s.Register("exports/a.csv", noopResource)
+
+	query, err := s.Sign("exports/a.csv", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+
+	_, err = s.Redeem("exports/a.csv", query)
+	assert.ErrorIs(t, err, ErrLinkExpired)
+}
+
+func TestSignUnknownResource(t *testing.T) {
+	_, err := NewSigner("").Sign("missing", time.Now().Add(time.Minute))
+	assert.ErrorIs(t, err, ErrUnknownResource)
+}
@@ -0,0 +1,110 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"nmi-pay-int/awsauth"
+)
+
+// AWSCredentials sign requests to SNS and SQS. SessionToken is set for
+// temporary credentials.
+type AWSCredentials = awsauth.Credentials
+
+// maxAWSBatch is the most entries SNS PublishBatch and SQS SendMessageBatch
+// accept in one call
+const maxAWSBatch = 10
+
+// awsClient calls an AWS query API (form-encoded POSTs, XML responses)
+// signed with Signature Version 4
+type awsClient struct {
+	endpoint    string
+	region      string
+	service     string
+	credentials AWSCredentials
+	httpClient  *http.Client
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func newAWSClient(endpoint, region, service string, credentials AWSCredentials) *awsClient {
+	return &awsClient{
+		endpoint:    endpoint,
+		region:      region,
+		service:     service,
+		credentials: credentials,
+		httpClient:  &http.Client{Timeout: produceTimeout},
+		now:         time.Now,
+	}
+}
+
+// awsError is the body of a failed query API call
+type awsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// call posts form to the endpoint and decodes the XML answer into result
+func (c *awsClient) call(ctx context.Context, form url.Values, result interface{}) error {
+	body := form.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.sign(req, body)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure awsError
+		if xml.Unmarshal(respBody, &failure) == nil && failure.Code != "" {
+			return fmt.Errorf("%s %s failed: %s: %s", c.service, form.Get("Action"), failure.Code, failure.Message)
+		}
+		return fmt.Errorf("%s %s returned %d", c.service, form.Get("Action"), resp.StatusCode)
+	}
+	return xml.Unmarshal(respBody, result)
+}
+
+// sign adds the Signature Version 4 headers for the request
+func (c *awsClient) sign(req *http.Request, body string) {
+	awsauth.Sign(req, body, c.region, c.service, c.credentials, c.now())
+}
+
+// awsBatchFailure is an entry a batch call refused
+type awsBatchFailure struct {
+	ID      string `xml:"Id"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// batchError reports the first refused entry of a batch
+func batchError(service string, failed []awsBatchFailure) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s refused %d of the batch: %s: %s", service, len(failed), failed[0].Code, failed[0].Message)
+}
+
+// chunks splits events into batches of at most maxAWSBatch
+func chunks(events []Event) [][]Event {
+	var batches [][]Event
+	for len(events) > maxAWSBatch {
+		batches = append(batches, events[:maxAWSBatch])
+		events = events[maxAWSBatch:]
+	}
+	return append(batches, events)
+}
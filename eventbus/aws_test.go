@@ -0,0 +1,92 @@
+package eventbus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// awsServer answers batch calls with reply, keeping the last form posted
+func awsServer(t *testing.T, reply string, form *url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+		require.NoError(t, r.ParseForm())
+		*form = r.PostForm
+		if strings.HasPrefix(reply, "<ErrorResponse") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		w.Write([]byte(reply))
+	}))
+}
+
+var testCredentials = AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}
+
+func TestSNSProducer(t *testing.T) {
+	var form url.Values
+	server := awsServer(t, `<PublishBatchResponse><PublishBatchResult><Successful><member><Id>0</Id></member></Successful><Failed/></PublishBatchResult></PublishBatchResponse>`, &form)
+	defer server.Close()
+
+	producer, err := NewSNSProducer("arn:aws:sns:us-east-2:123456789012:payments.fifo", testCredentials, server.URL)
+	require.NoError(t, err)
+	event, err := NewEvent("evt_1", "sale.succeeded", "m1", "txn-9", map[string]string{"amount": "10.00"})
+	require.NoError(t, err)
+	require.NoError(t, producer.Produce(context.Background(), "payments.sale", []Event{event}))
+
+	assert.Equal(t, "PublishBatch", form.Get("Action"))
+	assert.Equal(t, "arn:aws:sns:us-east-2:123456789012:payments.fifo", form.Get("TopicArn"))
+	assert.Contains(t, form.Get("PublishBatchRequestEntries.member.1.Message"), `"schema_version":1`)
+	assert.Equal(t, "sale.succeeded", form.Get("PublishBatchRequestEntries.member.1.MessageAttributes.entry.1.Value.StringValue"))
+	assert.Equal(t, "payments.sale", form.Get("PublishBatchRequestEntries.member.1.MessageAttributes.entry.2.Value.StringValue"))
+	assert.Equal(t, "txn-9", form.Get("PublishBatchRequestEntries.member.1.MessageGroupId"))
+	assert.Equal(t, "evt_1", form.Get("PublishBatchRequestEntries.member.1.MessageDeduplicationId"))
+
+	_, err = NewSNSProducer("payments", testCredentials, "")
+	assert.Error(t, err)
+}
+
+func TestSQSProducer(t *testing.T) {
+	var form url.Values
+	server := awsServer(t, `<SendMessageBatchResponse><SendMessageBatchResult>`+
+		`<BatchResultErrorEntry><Id>3</Id><Code>InvalidParameterValue</Code><Message>too big</Message><SenderFault>true</SenderFault></BatchResultErrorEntry>`+
+		`</SendMessageBatchResult></SendMessageBatchResponse>`, &form)
+	defer server.Close()
+
+	producer, err := NewSQSProducer(server.URL+"/000000000000/payments", "us-east-1", testCredentials)
+	require.NoError(t, err)
+	var events []Event
+	for i := 0; i < 12; i++ {
+		event, err := NewEvent("", "refund.created", "m1", "", nil)
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+	assert.ErrorContains(t, producer.Produce(context.Background(), "payments.refund", events), "too big")
+	assert.Equal(t, "SendMessageBatch", form.Get("Action"))
+	assert.NotEmpty(t, form.Get("SendMessageBatchRequestEntry.10.MessageBody"))
+	assert.Empty(t, form.Get("SendMessageBatchRequestEntry.11.MessageBody"), "batches hold at most ten messages")
+	assert.Empty(t, form.Get("SendMessageBatchRequestEntry.1.MessageGroupId"))
+
+	aws, err := NewSQSProducer("https://sqs.eu-west-1.amazonaws.com/123456789012/payments", "", testCredentials)
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", aws.client.region)
+	_, err = NewSQSProducer("http://localhost:4566/000000000000/payments", "", testCredentials)
+	assert.Error(t, err)
+}
+
+func TestAWSErrorResponse(t *testing.T) {
+	var form url.Values
+	server := awsServer(t, `<ErrorResponse><Error><Type>Sender</Type><Code>AuthorizationError</Code><Message>not authorized</Message></Error></ErrorResponse>`, &form)
+	defer server.Close()
+
+	producer, err := NewSNSProducer("arn:aws:sns:us-east-1:123456789012:payments", testCredentials, server.URL)
+	require.NoError(t, err)
+	event, err := NewEvent("", "batch.closed", "", "", nil)
+	require.NoError(t, err)
+	assert.ErrorContains(t, producer.Produce(context.Background(), "payments.batch", []Event{event}), "AuthorizationError: not authorized")
+}
@@ -0,0 +1,136 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"nmi-pay-int/db"
+	"nmi-pay-int/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProducer records produced events and fails while down is set
+type fakeProducer struct {
+	mu     sync.Mutex
+	down   bool
+	topics map[string][]string
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, topic string, events []Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return errors.New("broker unavailable")
+	}
+	if p.topics == nil {
+		p.topics = make(map[string][]string)
+	}
+	for _, event := range events {
+		p.topics[topic] = append(p.topics[topic], event.Type)
+	}
+	return nil
+}
+
+func testOutbox(t *testing.T, outbox Outbox) {
+	ctx := context.Background()
+	producer := &fakeProducer{down: true}
+	publisher := &Publisher{outbox: outbox, producer: producer, topicPrefix: "payments."}
+
+	for _, eventType := range []string{"sale.succeeded", "refund.created", "sale.declined"} {
+		event, err := NewEvent("", eventType, "m1", "", map[string]string{"transaction_id": "1"})
+		require.NoError(t, err)
+		require.NoError(t, publisher.Publish(ctx, event))
+	}
+
+	// While the broker is down everything stays in the outbox
+	sent, err := publisher.Relay(ctx)
+	assert.Error(t, err)
+	assert.Zero(t, sent)
+	pending, err := outbox.Pending(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	assert.Equal(t, "m1", pending[0].MerchantID)
+	assert.Equal(t, pending[0].ID, pending[0].Key)
+	assert.Equal(t, SchemaVersion, pending[0].SchemaVersion)
+	assert.JSONEq(t, `{"transaction_id":"1"}`, string(pending[0].Data))
+
+	producer.down = false
+	sent, err = publisher.Relay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, []string{"sale.succeeded", "sale.declined"}, producer.topics["payments.sale"])
+	assert.Equal(t, []string{"refund.created"}, producer.topics["payments.refund"])
+
+	pending, err = outbox.Pending(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestMemoryOutbox(t *testing.T) {
+	testOutbox(t, NewMemoryOutbox())
+}
+
+func TestSQLOutbox(t *testing.T) {
+	database, err := db.Open(context.Background(), "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	outbox, err := NewSQLOutbox(context.Background(), database)
+	require.NoError(t, err)
+	testOutbox(t, outbox)
+}
+
+func TestTransactionEventType(t *testing.T) {
+	for want, tx := range map[string]store.Transaction{
+		"sale.succeeded":     {Type: "sale", Status: store.StatusApproved},
+		"sale.declined":      {Type: "sale", Status: store.StatusDeclined},
+		"auth.failed":        {Type: "auth", Status: store.StatusError},
+		"refund.created":     {Type: "refund", Status: store.StatusApproved},
+		"void.created":       {Type: "void", Status: store.StatusApproved},
+		"ach_sale.succeeded": {Type: "ach_sale", Status: store.StatusApproved},
+	} {
+		assert.Equal(t, want, TransactionEventType(tx))
+	}
+}
+
+func TestKafkaProducer(t *testing.T) {
+	var body struct {
+		Records []struct {
+			Key   string `json:"key"`
+			Value Event  `json:"value"`
+		} `json:"records"`
+	}
+	refuse := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/payments.sale", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "svc:secret", user+":"+pass)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if refuse {
+			w.Write([]byte(`{"offsets":[{"partition":null,"offset":null,"error_code":50301,"error":"topic not found"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":42}]}`))
+	}))
+	defer proxy.Close()
+
+	producer := NewKafkaProducer(proxy.URL+"/", "svc", "secret")
+	event, err := NewEvent("evt_1", "sale.succeeded", "m1", "txn-9", map[string]string{"amount": "10.00"})
+	require.NoError(t, err)
+	require.NoError(t, producer.Produce(context.Background(), "payments.sale", []Event{event}))
+	require.Len(t, body.Records, 1)
+	assert.Equal(t, "txn-9", body.Records[0].Key)
+	assert.Equal(t, "evt_1", body.Records[0].Value.ID)
+	assert.Equal(t, SchemaVersion, body.Records[0].Value.SchemaVersion)
+
+	refuse = true
+	assert.ErrorContains(t, producer.Produce(context.Background(), "payments.sale", []Event{event}), "topic not found")
+}
@@ -0,0 +1,97 @@
+// Package eventbus publishes payment lifecycle events to Kafka, SNS or SQS.
+// Events are written to an outbox first and relayed to the broker in the
+// background, so a broker outage delays events instead of losing them or
+// failing payments.
+package eventbus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"nmi-pay-int/store"
+)
+
+// SchemaVersion is the version of the event envelope and payloads. It is
+// raised when a field is removed or changes meaning; added fields keep it.
+const SchemaVersion = 1
+
+// Event types
+const (
+	EventSubscriptionCreated   = "subscription.created"
+	EventSubscriptionUpdated   = "subscription.updated"
+	EventSubscriptionCancelled = "subscription.cancelled"
+	EventChargebackCreated     = "chargeback.created"
+	EventBatchClosed           = "batch.closed"
+	EventTerminalPaymentDone   = "terminal_payment.completed"
+)
+
+// Event is the message published to the broker
+type Event struct {
+	// Seq orders events in the outbox
+	Seq           int64  `json:"-"`
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	SchemaVersion int    `json:"schema_version"`
+	// MerchantID is the account the event belongs to, when known
+	MerchantID string    `json:"merchant_id,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// Key partitions the event, keeping events about one transaction or
+	// subscription in order; it defaults to the event ID
+	Key  string          `json:"-"`
+	Data json.RawMessage `json:"data"`
+}
+
+// NewEvent builds an event, with a generated ID when id is empty
+func NewEvent(id, eventType, merchantID, key string, data interface{}) (Event, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	if id == "" {
+		id = "evt_" + randomHex(12)
+	}
+	if key == "" {
+		key = id
+	}
+	return Event{
+		ID:            id,
+		Type:          eventType,
+		SchemaVersion: SchemaVersion,
+		MerchantID:    merchantID,
+		OccurredAt:    time.Now().UTC(),
+		Key:           key,
+		Data:          payload,
+	}, nil
+}
+
+// TransactionEventType names the event for a processed transaction: an
+// approved refund or void is "refund.created" or "void.created", other
+// approvals "<type>.succeeded", and refusals "<type>.declined" or
+// "<type>.failed".
+func TransactionEventType(t store.Transaction) string {
+	switch {
+	case t.Status == store.StatusDeclined:
+		return t.Type + ".declined"
+	case t.Status == store.StatusError:
+		return t.Type + ".failed"
+	case t.Type == "refund", t.Type == "void":
+		return t.Type + ".created"
+	}
+	return t.Type + ".succeeded"
+}
+
+// Topic returns the topic an event type is published to: the prefix
+// followed by the type's subject, such as "payments.sale"
+func Topic(prefix, eventType string) string {
+	subject, _, _ := strings.Cut(eventType, ".")
+	return prefix + subject
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
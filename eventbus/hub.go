@@ -0,0 +1,149 @@
+package eventbus
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultHubHistory is how many recent events a Hub keeps for subscribers
+// resuming after a disconnect
+const DefaultHubHistory = 1000
+
+// subscriptionBuffer is how many live events may wait for a subscriber
+// before it is dropped as too slow
+const subscriptionBuffer = 64
+
+// LiveEvent is an event as broadcast by a Hub, numbered in broadcast order
+type LiveEvent struct {
+	Seq   int64
+	Event Event
+}
+
+// Filter selects events. A type matches exactly, as in "sale.declined", or
+// by subject, as "sale" matches every sale event. Empty fields match every
+// event.
+type Filter struct {
+	Types      []string
+	MerchantID string
+}
+
+// Match reports whether event passes the filter
+func (f Filter) Match(event Event) bool {
+	if f.MerchantID != "" && event.MerchantID != f.MerchantID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	subject, _, _ := strings.Cut(event.Type, ".")
+	for _, t := range f.Types {
+		if t == event.Type || t == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// Hub fans lifecycle events out to in-process subscribers, such as live
+// streams, as they are published. It keeps no more than a short history
+// and never blocks the publisher: a subscriber that falls behind is
+// dropped and has to subscribe again.
+type Hub struct {
+	mu      sync.Mutex
+	seq     int64
+	history []LiveEvent
+	size    int
+	subs    map[*Subscription]struct{}
+}
+
+// NewHub creates a hub remembering the last history events
+func NewHub(history int) *Hub {
+	if history < 1 {
+		history = DefaultHubHistory
+	}
+	return &Hub{size: history, subs: make(map[*Subscription]struct{})}
+}
+
+// Broadcast numbers event and hands it to every matching subscriber
+func (h *Hub) Broadcast(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	live := LiveEvent{Seq: h.seq, Event: event}
+	h.history = append(h.history, live)
+	if len(h.history) > h.size {
+		h.history = append([]LiveEvent(nil), h.history[len(h.history)-h.size:]...)
+	}
+
+	for sub := range h.subs {
+		if !sub.filter.Match(event) {
+			continue
+		}
+		select {
+		case sub.events <- live:
+		default:
+			h.drop(sub)
+		}
+	}
+}
+
+// Subscribe starts delivering events matching filter. With afterSeq above
+// zero, remembered events numbered after it are delivered first, so a
+// subscriber reconnecting with the last Seq it saw misses nothing still in
+// the history.
+func (h *Hub) Subscribe(filter Filter, afterSeq int64) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []LiveEvent
+	if afterSeq > 0 {
+		for _, live := range h.history {
+			if live.Seq > afterSeq && filter.Match(live.Event) {
+				replay = append(replay, live)
+			}
+		}
+	}
+
+	sub := &Subscription{hub: h, filter: filter, events: make(chan LiveEvent, len(replay)+subscriptionBuffer)}
+	for _, live := range replay {
+		sub.events <- live
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// Subscribers returns how many subscriptions are open
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// drop ends a subscription; callers hold h.mu
+func (h *Hub) drop(sub *Subscription) {
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// Subscription receives a Hub's events until it is closed
+type Subscription struct {
+	hub    *Hub
+	filter Filter
+	events chan LiveEvent
+}
+
+// Events delivers the subscription's events in order. It is closed by
+// Close, or by the hub when the subscriber fell too far behind.
+func (s *Subscription) Events() <-chan LiveEvent {
+	return s.events
+}
+
+// Close stops delivery
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s)
+}
@@ -0,0 +1,69 @@
+package eventbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	sale := Event{Type: "sale.declined", MerchantID: "m1"}
+	assert.True(t, Filter{}.Match(sale))
+	assert.True(t, Filter{Types: []string{"sale"}}.Match(sale))
+	assert.True(t, Filter{Types: []string{"refund.created", "sale.declined"}, MerchantID: "m1"}.Match(sale))
+	assert.False(t, Filter{Types: []string{"sale.succeeded"}}.Match(sale))
+	assert.False(t, Filter{Types: []string{"sal"}}.Match(sale))
+	assert.False(t, Filter{MerchantID: "m2"}.Match(sale))
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub(3)
+	sales := hub.Subscribe(Filter{Types: []string{"sale"}}, 0)
+	all := hub.Subscribe(Filter{}, 0)
+	assert.Equal(t, 2, hub.Subscribers())
+
+	hub.Broadcast(Event{ID: "e1", Type: "sale.succeeded"})
+	hub.Broadcast(Event{ID: "e2", Type: "refund.created"})
+	hub.Broadcast(Event{ID: "e3", Type: "sale.declined"})
+
+	got := <-sales.Events()
+	assert.Equal(t, LiveEvent{Seq: 1, Event: Event{ID: "e1", Type: "sale.succeeded"}}, got)
+	assert.Equal(t, "e3", (<-sales.Events()).Event.ID)
+	for _, id := range []string{"e1", "e2", "e3"} {
+		assert.Equal(t, id, (<-all.Events()).Event.ID)
+	}
+
+	sales.Close()
+	_, open := <-sales.Events()
+	assert.False(t, open)
+	sales.Close()
+	assert.Equal(t, 1, hub.Subscribers())
+
+	// Resuming replays what the history still holds after the last seen
+	hub.Broadcast(Event{ID: "e4", Type: "sale.succeeded"})
+	resumed := hub.Subscribe(Filter{Types: []string{"sale"}}, 1)
+	assert.Equal(t, int64(3), (<-resumed.Events()).Seq)
+	assert.Equal(t, int64(4), (<-resumed.Events()).Seq)
+	hub.Broadcast(Event{ID: "e5", Type: "sale.succeeded"})
+	assert.Equal(t, "e5", (<-resumed.Events()).Event.ID)
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub(DefaultHubHistory)
+	slow := hub.Subscribe(Filter{}, 0)
+	for i := 0; i <= subscriptionBuffer; i++ {
+		hub.Broadcast(Event{Type: "sale.succeeded"})
+	}
+	assert.Zero(t, hub.Subscribers())
+
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	require.Equal(t, subscriptionBuffer, received)
+
+	// The dropped subscriber resumes from the last event it got
+	resumed := hub.Subscribe(Filter{}, int64(received))
+	assert.Equal(t, int64(received+1), (<-resumed.Events()).Seq)
+}
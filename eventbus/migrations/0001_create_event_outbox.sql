@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS event_outbox (
+    seq            BIGINT PRIMARY KEY,
+    id             TEXT NOT NULL,
+    type           TEXT NOT NULL,
+    schema_version INTEGER NOT NULL,
+    merchant_id    TEXT NOT NULL,
+    occurred_at    TIMESTAMP NOT NULL,
+    event_key      TEXT NOT NULL,
+    data           TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS event_outbox_id ON event_outbox (id);
@@ -0,0 +1,69 @@
+package eventbus
+
+import (
+	"context"
+	"sync"
+)
+
+// Outbox holds events until the broker has acknowledged them
+type Outbox interface {
+	// Add stores an event, assigning its Seq
+	Add(ctx context.Context, event Event) (Event, error)
+	// Pending returns up to limit unsent events, oldest first
+	Pending(ctx context.Context, limit int) ([]Event, error)
+	// Remove drops the events with these IDs once the broker has
+	// acknowledged them
+	Remove(ctx context.Context, ids []string) error
+}
+
+// MemoryOutbox keeps unsent events in process, so they survive a broker
+// outage but not a restart; set DATABASE_URL for a durable outbox.
+type MemoryOutbox struct {
+	mu      sync.Mutex
+	events  []Event
+	nextSeq int64
+}
+
+// NewMemoryOutbox creates an empty in-memory outbox
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{nextSeq: 1}
+}
+
+func (o *MemoryOutbox) Add(ctx context.Context, event Event) (Event, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	event.Seq = o.nextSeq
+	o.nextSeq++
+	o.events = append(o.events, event)
+	return event, nil
+}
+
+func (o *MemoryOutbox) Pending(ctx context.Context, limit int) ([]Event, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	end := len(o.events)
+	if limit > 0 && limit < end {
+		end = limit
+	}
+	return append([]Event(nil), o.events[:end]...), nil
+}
+
+func (o *MemoryOutbox) Remove(ctx context.Context, ids []string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	sent := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		sent[id] = true
+	}
+	kept := o.events[:0]
+	for _, event := range o.events {
+		if !sent[event.ID] {
+			kept = append(kept, event)
+		}
+	}
+	o.events = kept
+	return nil
+}
@@ -0,0 +1,159 @@
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+// DefaultRelayInterval is how often the outbox is retried while the broker
+// is unavailable
+const DefaultRelayInterval = 5 * time.Second
+
+// relayBatch bounds how many events one pass of the relay reads
+const relayBatch = 100
+
+// produceTimeout bounds a single request to the broker
+const produceTimeout = 10 * time.Second
+
+// Producer sends events to a broker. topic is the event's logical topic
+// (see Topic): Kafka publishes to it, while SNS and SQS, with one topic or
+// queue, carry it as a message attribute. A nil error means the broker has
+// acknowledged every event.
+type Producer interface {
+	Produce(ctx context.Context, topic string, events []Event) error
+}
+
+// Publisher adds events to the outbox and relays them to the broker in the
+// background. Delivery is at least once: an event is removed from the
+// outbox only after the broker acknowledged it, so consumers should ignore
+// IDs they have already seen.
+type Publisher struct {
+	outbox      Outbox
+	producer    Producer
+	topicPrefix string
+	interval    time.Duration
+
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPublisher starts relaying outbox events to topics named topicPrefix
+// plus the event's subject, retrying every interval while the broker is
+// down
+func NewPublisher(outbox Outbox, producer Producer, topicPrefix string, interval time.Duration) *Publisher {
+	if interval <= 0 {
+		interval = DefaultRelayInterval
+	}
+	p := &Publisher{
+		outbox:      outbox,
+		producer:    producer,
+		topicPrefix: topicPrefix,
+		interval:    interval,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish stores the event in the outbox and wakes the relay. An error
+// means the event was not stored.
+func (p *Publisher) Publish(ctx context.Context, event Event) error {
+	if _, err := p.outbox.Add(ctx, event); err != nil {
+		return err
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops the relay after a last attempt to empty the outbox, waiting
+// for it or for ctx to end. Events still unsent stay in the outbox.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() { close(p.done) })
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	relay := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.interval+produceTimeout)
+		defer cancel()
+		if _, err := p.Relay(ctx); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("lifecycle events left in the outbox: %v", err))
+		}
+	}
+	for {
+		select {
+		case <-p.wake:
+			relay()
+		case <-ticker.C:
+			relay()
+		case <-p.done:
+			relay()
+			return
+		}
+	}
+}
+
+// Relay sends pending events until the outbox is empty or the broker fails,
+// returning how many were sent. Events keep their outbox order within each
+// topic.
+func (p *Publisher) Relay(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		events, err := p.outbox.Pending(ctx, relayBatch)
+		if err != nil || len(events) == 0 {
+			return sent, err
+		}
+
+		var topics []string
+		byTopic := make(map[string][]Event)
+		for _, event := range events {
+			topic := Topic(p.topicPrefix, event.Type)
+			if _, ok := byTopic[topic]; !ok {
+				topics = append(topics, topic)
+			}
+			byTopic[topic] = append(byTopic[topic], event)
+		}
+
+		var acknowledged []string
+		var produceErr error
+		for _, topic := range topics {
+			if err := p.producer.Produce(ctx, topic, byTopic[topic]); err != nil {
+				metrics.EventsPublished.WithLabelValues(topic, "failed").Add(float64(len(byTopic[topic])))
+				produceErr = err
+				continue
+			}
+			metrics.EventsPublished.WithLabelValues(topic, "published").Add(float64(len(byTopic[topic])))
+			for _, event := range byTopic[topic] {
+				acknowledged = append(acknowledged, event.ID)
+			}
+		}
+
+		if err := p.outbox.Remove(ctx, acknowledged); err != nil {
+			return sent, err
+		}
+		sent += len(acknowledged)
+		if produceErr != nil || len(events) < relayBatch {
+			return sent, produceErr
+		}
+	}
+}
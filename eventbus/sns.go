@@ -0,0 +1,82 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SNSProducer publishes events to one SNS topic. Each message carries
+// event_type and topic attributes, so subscriptions can filter on them.
+type SNSProducer struct {
+	topicARN string
+	fifo     bool
+	client   *awsClient
+}
+
+// NewSNSProducer creates a producer for the topic. The region is taken from
+// the ARN; endpoint overrides the regional SNS endpoint, e.g. for
+// LocalStack.
+func NewSNSProducer(topicARN string, credentials AWSCredentials, endpoint string) (*SNSProducer, error) {
+	parts := strings.Split(topicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return nil, fmt.Errorf("invalid SNS topic ARN %q", topicARN)
+	}
+	region := parts[3]
+	if endpoint == "" {
+		endpoint = "https://sns." + region + ".amazonaws.com/"
+	}
+	return &SNSProducer{
+		topicARN: topicARN,
+		fifo:     strings.HasSuffix(topicARN, ".fifo"),
+		client:   newAWSClient(endpoint, region, "sns", credentials),
+	}, nil
+}
+
+type snsPublishBatchResponse struct {
+	Failed []awsBatchFailure `xml:"PublishBatchResult>Failed>member"`
+}
+
+func (p *SNSProducer) Produce(ctx context.Context, topic string, events []Event) error {
+	for _, batch := range chunks(events) {
+		form := url.Values{
+			"Action":   {"PublishBatch"},
+			"Version":  {"2010-03-31"},
+			"TopicArn": {p.topicARN},
+		}
+		for i, event := range batch {
+			body, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			entry := "PublishBatchRequestEntries.member." + strconv.Itoa(i+1) + "."
+			form.Set(entry+"Id", strconv.Itoa(i))
+			form.Set(entry+"Message", string(body))
+			setAttribute(form, entry+"MessageAttributes.entry.1.", "event_type", event.Type)
+			setAttribute(form, entry+"MessageAttributes.entry.2.", "topic", topic)
+			if p.fifo {
+				form.Set(entry+"MessageGroupId", event.Key)
+				form.Set(entry+"MessageDeduplicationId", event.ID)
+			}
+		}
+
+		var result snsPublishBatchResponse
+		if err := p.client.call(ctx, form, &result); err != nil {
+			return err
+		}
+		if err := batchError("sns", result.Failed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAttribute adds a string message attribute to a batch entry
+func setAttribute(form url.Values, prefix, name, value string) {
+	form.Set(prefix+"Name", name)
+	form.Set(prefix+"Value.DataType", "String")
+	form.Set(prefix+"Value.StringValue", value)
+}
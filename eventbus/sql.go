@@ -0,0 +1,112 @@
+package eventbus
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+	"strings"
+
+	"nmi-pay-int/db"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// addAttempts bounds retries when concurrent writers race for the same
+// sequence number
+const addAttempts = 5
+
+// errSeqTaken is returned when another instance claimed the sequence number
+var errSeqTaken = errors.New("outbox sequence number already taken")
+
+// SQLOutbox keeps unsent events in Postgres or SQLite
+type SQLOutbox struct {
+	db *db.DB
+}
+
+// NewSQLOutbox migrates the outbox schema and returns an outbox
+func NewSQLOutbox(ctx context.Context, database *db.DB) (*SQLOutbox, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "eventbus", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLOutbox{db: database}, nil
+}
+
+// Add takes the next sequence number inside a transaction; replicas adding
+// at the same moment collide on the primary key and the loser retries
+func (o *SQLOutbox) Add(ctx context.Context, event Event) (Event, error) {
+	var err error
+	for attempt := 0; attempt < addAttempts; attempt++ {
+		if event, err = o.add(ctx, event); !errors.Is(err, errSeqTaken) {
+			return event, err
+		}
+	}
+	return Event{}, err
+}
+
+func (o *SQLOutbox) add(ctx context.Context, event Event) (Event, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Event{}, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) + 1 FROM event_outbox`).Scan(&event.Seq); err != nil {
+		return Event{}, err
+	}
+	_, err = tx.ExecContext(ctx, o.db.Rebind(`INSERT INTO event_outbox (seq, id, type, schema_version, merchant_id, occurred_at, event_key, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		event.Seq, event.ID, event.Type, event.SchemaVersion, event.MerchantID, event.OccurredAt.UTC(), event.Key, string(event.Data))
+	if db.IsUniqueViolation(err) {
+		return Event{}, errSeqTaken
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	return event, tx.Commit()
+}
+
+func (o *SQLOutbox) Pending(ctx context.Context, limit int) ([]Event, error) {
+	query := `SELECT seq, id, type, schema_version, merchant_id, occurred_at, event_key, data FROM event_outbox ORDER BY seq`
+	var args []any
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := o.db.QueryContext(ctx, o.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var data string
+		if err := rows.Scan(&event.Seq, &event.ID, &event.Type, &event.SchemaVersion, &event.MerchantID,
+			&event.OccurredAt, &event.Key, &data); err != nil {
+			return nil, err
+		}
+		event.OccurredAt = event.OccurredAt.UTC()
+		event.Data = []byte(data)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (o *SQLOutbox) Remove(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders, args := make([]string, len(ids)), make([]any, len(ids))
+	for i, id := range ids {
+		placeholders[i], args[i] = "?", id
+	}
+	_, err := o.db.ExecContext(ctx, o.db.Rebind(`DELETE FROM event_outbox WHERE id IN (`+strings.Join(placeholders, ", ")+`)`), args...)
+	return err
+}
@@ -0,0 +1,76 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SQSProducer sends events to one SQS queue, each message carrying
+// event_type and topic attributes
+type SQSProducer struct {
+	queueURL string
+	fifo     bool
+	client   *awsClient
+}
+
+// NewSQSProducer creates a producer for the queue. The region is taken
+// from an AWS queue URL (https://sqs.<region>.amazonaws.com/...); other
+// URLs, such as LocalStack's, need region.
+func NewSQSProducer(queueURL, region string, credentials AWSCredentials) (*SQSProducer, error) {
+	parsed, err := url.Parse(queueURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid SQS queue URL %q", queueURL)
+	}
+	if host := strings.Split(parsed.Hostname(), "."); len(host) > 2 && host[0] == "sqs" {
+		region = host[1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no AWS region for SQS queue %q", queueURL)
+	}
+	return &SQSProducer{
+		queueURL: queueURL,
+		fifo:     strings.HasSuffix(parsed.Path, ".fifo"),
+		client:   newAWSClient(queueURL, region, "sqs", credentials),
+	}, nil
+}
+
+type sqsSendMessageBatchResponse struct {
+	Failed []awsBatchFailure `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+}
+
+func (p *SQSProducer) Produce(ctx context.Context, topic string, events []Event) error {
+	for _, batch := range chunks(events) {
+		form := url.Values{
+			"Action":  {"SendMessageBatch"},
+			"Version": {"2012-11-05"},
+		}
+		for i, event := range batch {
+			body, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			entry := "SendMessageBatchRequestEntry." + strconv.Itoa(i+1) + "."
+			form.Set(entry+"Id", strconv.Itoa(i))
+			form.Set(entry+"MessageBody", string(body))
+			setAttribute(form, entry+"MessageAttribute.1.", "event_type", event.Type)
+			setAttribute(form, entry+"MessageAttribute.2.", "topic", topic)
+			if p.fifo {
+				form.Set(entry+"MessageGroupId", event.Key)
+				form.Set(entry+"MessageDeduplicationId", event.ID)
+			}
+		}
+
+		var result sqsSendMessageBatchResponse
+		if err := p.client.call(ctx, form, &result); err != nil {
+			return err
+		}
+		if err := batchError("sqs", result.Failed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Package eventlog keeps an ordered, replayable record of the transaction
+// and subscription events the service publishes, so downstream consumers can
+// backfill or recover after an outage by reading from a sequence number.
+package eventlog
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryLogSize is how many events the in-memory log retains
+const DefaultMemoryLogSize = 10000
+
+// Event is a published event with its position in the log
+type Event struct {
+	Seq  int64  `json:"seq"`
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// MerchantID is the merchant account the event happened on. Events
+	// recorded before merchants were kept have none.
+	MerchantID string          `json:"merchant_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Log is an append-only event log. Sequence numbers start at 1 and increase
+// by one per event.
+type Log interface {
+	// Append assigns the event the next sequence number and stores it
+	Append(ctx context.Context, event Event) (Event, error)
+	// Read returns up to limit events with Seq >= fromSeq, in order
+	Read(ctx context.Context, fromSeq int64, limit int) ([]Event, error)
+}
+
+// MemoryLog keeps the most recent events in process. Older events are
+// dropped beyond its size and everything is lost on restart, so it only
+// suits development; set DATABASE_URL for a durable log.
+type MemoryLog struct {
+	mu      sync.RWMutex
+	events  []Event
+	nextSeq int64
+	size    int
+}
+
+// NewMemoryLog creates an in-memory log retaining up to size events
+func NewMemoryLog(size int) *MemoryLog {
+	if size < 1 {
+		size = DefaultMemoryLogSize
+	}
+	return &MemoryLog{nextSeq: 1, size: size}
+}
+
+func (l *MemoryLog) Append(ctx context.Context, event Event) (Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	event.Seq = l.nextSeq
+	l.nextSeq++
+	l.events = append(l.events, event)
+	if len(l.events) > l.size {
+		l.events = append([]Event(nil), l.events[len(l.events)-l.size:]...)
+	}
+	return event, nil
+}
+
+func (l *MemoryLog) Read(ctx context.Context, fromSeq int64, limit int) ([]Event, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start := sort.Search(len(l.events), func(i int) bool { return l.events[i].Seq >= fromSeq })
+	end := len(l.events)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return append([]Event(nil), l.events[start:end]...), nil
+}
@@ -0,0 +1,136 @@
+package eventlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendEvents(t *testing.T, log Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := log.Append(context.Background(), Event{
+			ID:         fmt.Sprintf("evt_%d", i),
+			Type:       "payment.sale",
+			MerchantID: config.DefaultMerchantID,
+			CreatedAt:  time.Now().UTC(),
+			Data:       json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+		})
+		require.NoError(t, err)
+	}
+}
+
+func testLog(t *testing.T, log Log) {
+	appendEvents(t, log, 5)
+
+	events, err := log.Read(context.Background(), 1, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 5)
+	for i, event := range events {
+		assert.Equal(t, int64(i+1), event.Seq)
+		assert.Equal(t, fmt.Sprintf("evt_%d", i), event.ID)
+		assert.Equal(t, config.DefaultMerchantID, event.MerchantID)
+		assert.JSONEq(t, fmt.Sprintf(`{"n":%d}`, i), string(event.Data))
+	}
+
+	events, err = log.Read(context.Background(), 3, 2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(3), events[0].Seq)
+	assert.Equal(t, int64(4), events[1].Seq)
+
+	events, err = log.Read(context.Background(), 6, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestMemoryLog(t *testing.T) {
+	testLog(t, NewMemoryLog(0))
+}
+
+func TestMemoryLogDropsOldestBeyondSize(t *testing.T) {
+	log := NewMemoryLog(3)
+	appendEvents(t, log, 5)
+
+	events, err := log.Read(context.Background(), 1, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, int64(3), events[0].Seq)
+}
+
+func TestSQLLog(t *testing.T) {
+	database, err := db.Open(context.Background(), "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	log, err := NewSQLLog(context.Background(), database)
+	require.NoError(t, err)
+	testLog(t, log)
+}
+
+func TestHandleExportStreamsFromSeq(t *testing.T) {
+	log := NewMemoryLog(0)
+	appendEvents(t, log, exportPageSize+10)
+
+	rec := httptest.NewRecorder()
+	HandleExport(log)(rec, httptest.NewRequest("GET", "/events/export?from_seq=5", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var seqs []int64
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		seqs = append(seqs, event.Seq)
+	}
+	require.Len(t, seqs, exportPageSize+6)
+	assert.Equal(t, int64(5), seqs[0])
+	assert.Equal(t, int64(exportPageSize+10), seqs[len(seqs)-1])
+
+	rec = httptest.NewRecorder()
+	HandleExport(log)(rec, httptest.NewRequest("GET", "/events/export?from_seq=0", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleExportOnlyMerchantEvents(t *testing.T) {
+	log := NewMemoryLog(0)
+	for i, merchant := range []string{"m1", "m2", "m1", ""} {
+		_, err := log.Append(context.Background(), Event{
+			ID:         fmt.Sprintf("evt_%d", i),
+			Type:       "payment.sale",
+			MerchantID: merchant,
+			CreatedAt:  time.Now().UTC(),
+			Data:       json.RawMessage(`{}`),
+		})
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest("GET", "/events/export", nil)
+	req = req.WithContext(api.WithMerchant(req.Context(), config.Merchant{ID: "m1"}))
+	rec := httptest.NewRecorder()
+	HandleExport(log)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var seqs []int64
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, "m1", event.MerchantID)
+		seqs = append(seqs, event.Seq)
+	}
+	assert.Equal(t, []int64{1, 3}, seqs)
+}
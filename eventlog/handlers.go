@@ -0,0 +1,74 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+)
+
+// exportPageSize is how many events are read from the log per page while
+// streaming an export
+const exportPageSize = 500
+
+// HandleExport streams the events of the request's merchant as
+// newline-delimited JSON, one event per line in sequence order, starting at
+// the from_seq query parameter (default 1). Other merchants' events are
+// skipped, leaving gaps in seq. The stream ends once it has caught up;
+// consumers resume from the last seq they stored plus one.
+func HandleExport(log Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merchantID := config.DefaultMerchantID
+		if merchant, ok := api.MerchantFromContext(r.Context()); ok {
+			merchantID = merchant.ID
+		}
+
+		fromSeq := int64(1)
+		if raw := r.URL.Query().Get("from_seq"); raw != "" {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || value < 1 {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "from_seq must be a positive integer")
+				return
+			}
+			fromSeq = value
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		written := false
+
+		for {
+			page, err := log.Read(r.Context(), fromSeq, exportPageSize)
+			if err != nil {
+				// Once events are sent the status can no longer change; the
+				// consumer sees a truncated stream and resumes from its last seq
+				logctx.From(r.Context()).WithError(err).Error("Failed to read event log")
+				if !written {
+					api.WriteErrorCode(w, r, api.ErrInternal, "Failed to read event log")
+				}
+				return
+			}
+
+			for _, event := range page {
+				fromSeq = event.Seq + 1
+				if event.MerchantID != merchantID {
+					continue
+				}
+				if err := encoder.Encode(event); err != nil {
+					return
+				}
+				written = true
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if len(page) < exportPageSize {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS events (
+    seq        BIGINT PRIMARY KEY,
+    id         TEXT NOT NULL,
+    type       TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       TEXT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE events ADD COLUMN merchant_id TEXT NOT NULL DEFAULT '';
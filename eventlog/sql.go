@@ -0,0 +1,98 @@
+package eventlog
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+
+	"nmi-pay-int/db"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// appendAttempts bounds retries when concurrent writers race for the same
+// sequence number
+const appendAttempts = 5
+
+// errSeqTaken is returned when another instance claimed the sequence number
+var errSeqTaken = errors.New("event sequence number already taken")
+
+// SQLLog stores events in Postgres or SQLite
+type SQLLog struct {
+	db *db.DB
+}
+
+// NewSQLLog migrates the events schema and returns a log
+func NewSQLLog(ctx context.Context, database *db.DB) (*SQLLog, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "eventlog", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLLog{db: database}, nil
+}
+
+// Append takes the next sequence number inside a transaction. Replicas
+// appending at the same moment collide on the primary key, and the loser
+// retries with the following number, so the log stays gapless and ordered.
+func (l *SQLLog) Append(ctx context.Context, event Event) (Event, error) {
+	var err error
+	for attempt := 0; attempt < appendAttempts; attempt++ {
+		if event, err = l.append(ctx, event); !errors.Is(err, errSeqTaken) {
+			return event, err
+		}
+	}
+	return Event{}, err
+}
+
+func (l *SQLLog) append(ctx context.Context, event Event) (Event, error) {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Event{}, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) + 1 FROM events`).Scan(&event.Seq); err != nil {
+		return Event{}, err
+	}
+	_, err = tx.ExecContext(ctx, l.db.Rebind(`INSERT INTO events (seq, id, type, merchant_id, created_at, data) VALUES (?, ?, ?, ?, ?, ?)`),
+		event.Seq, event.ID, event.Type, event.MerchantID, event.CreatedAt.UTC(), string(event.Data))
+	if db.IsUniqueViolation(err) {
+		return Event{}, errSeqTaken
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	return event, tx.Commit()
+}
+
+func (l *SQLLog) Read(ctx context.Context, fromSeq int64, limit int) ([]Event, error) {
+	query := `SELECT seq, id, type, merchant_id, created_at, data FROM events WHERE seq >= ? ORDER BY seq`
+	args := []any{fromSeq}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := l.db.QueryContext(ctx, l.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var data string
+		if err := rows.Scan(&event.Seq, &event.ID, &event.Type, &event.MerchantID, &event.CreatedAt, &data); err != nil {
+			return nil, err
+		}
+		event.Data = []byte(data)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,82 @@
+// Package fallback tracks the health of soft dependencies such as Redis so
+// callers can switch to a local implementation instead of failing requests.
+package fallback
+
+import (
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRetryAfter is how long a failed dependency is bypassed before it is
+// tried again
+const DefaultRetryAfter = 10 * time.Second
+
+// Dependency records whether a soft dependency is currently usable. After a
+// failure it reports unavailable for a retry interval, so requests do not each
+// wait on a dead server, then lets the next call probe it again.
+type Dependency struct {
+	name       string
+	retryAfter time.Duration
+
+	mu        sync.Mutex
+	degraded  bool
+	downUntil time.Time
+}
+
+// NewDependency creates a tracker, reported in metrics and logs under name
+func NewDependency(name string, retryAfter time.Duration) *Dependency {
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	metrics.SetDependencyDegraded(name, false)
+	return &Dependency{name: name, retryAfter: retryAfter}
+}
+
+// Available reports whether the dependency should be tried
+func (d *Dependency) Available() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !time.Now().Before(d.downUntil)
+}
+
+// Degraded reports whether the last call to the dependency failed
+func (d *Dependency) Degraded() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.degraded
+}
+
+// Failed records a failed call and starts the retry interval
+func (d *Dependency) Failed(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.downUntil = time.Now().Add(d.retryAfter)
+	if d.degraded {
+		return
+	}
+	d.degraded = true
+	metrics.SetDependencyDegraded(d.name, true)
+	metrics.GetLogger().WithFields(logrus.Fields{
+		"dependency":  d.name,
+		"retry_after": d.retryAfter.String(),
+	}).WithError(err).Warn("Dependency unavailable, falling back to local implementation")
+}
+
+// Succeeded records a successful call, ending degraded mode
+func (d *Dependency) Succeeded() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.degraded {
+		return
+	}
+	d.degraded = false
+	d.downUntil = time.Time{}
+	metrics.SetDependencyDegraded(d.name, false)
+	metrics.GetLogger().WithField("dependency", d.name).Info("Dependency recovered")
+}
@@ -0,0 +1,30 @@
+package fallback
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nmi-pay-int/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyBypassedUntilRetry(t *testing.T) {
+	dep := NewDependency("test_dependency", 20*time.Millisecond)
+	gauge := metrics.DependencyDegraded.WithLabelValues("test_dependency")
+	assert.True(t, dep.Available())
+
+	dep.Failed(errors.New("connection refused"))
+	assert.False(t, dep.Available(), "a failed dependency is skipped")
+	assert.True(t, dep.Degraded())
+	assert.Equal(t, 1.0, testutil.ToFloat64(gauge))
+
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, dep.Available(), "it is probed again after the retry interval")
+
+	dep.Succeeded()
+	assert.False(t, dep.Degraded())
+	assert.Equal(t, 0.0, testutil.ToFloat64(gauge))
+}
@@ -0,0 +1,96 @@
+// Package fees imports per-transaction fee and interchange data from
+// processor settlement reports and summarizes effective rates by merchant
+// and card brand, so interchange qualification can be checked against what
+// was actually charged.
+package fees
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is the fees charged on one settled transaction. Amounts are in
+// dollars; fees keep the fractional cents processors report.
+type Entry struct {
+	TransactionID       string    `json:"transaction_id"`
+	MerchantID          string    `json:"merchant_id"`
+	CardBrand           string    `json:"card_brand"`
+	InterchangeCategory string    `json:"interchange_category,omitempty"`
+	Amount              float64   `json:"amount"`
+	InterchangeFee      float64   `json:"interchange_fee"`
+	AssessmentFee       float64   `json:"assessment_fee"`
+	ProcessorFee        float64   `json:"processor_fee"`
+	SettledAt           time.Time `json:"settled_at"`
+}
+
+// TotalFee is everything the merchant paid on the transaction
+func (e Entry) TotalFee() float64 {
+	return e.InterchangeFee + e.AssessmentFee + e.ProcessorFee
+}
+
+// Filter selects entries settled in [From, To) for an optional merchant.
+// Zero times leave that end open.
+type Filter struct {
+	From       time.Time
+	To         time.Time
+	MerchantID string
+}
+
+func (f Filter) matches(e Entry) bool {
+	if !f.From.IsZero() && e.SettledAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.SettledAt.Before(f.To) {
+		return false
+	}
+	return f.MerchantID == "" || e.MerchantID == f.MerchantID
+}
+
+// Ledger stores fee entries keyed by transaction ID, so re-importing a
+// settlement report replaces its entries instead of double counting them
+type Ledger interface {
+	Upsert(ctx context.Context, entries []Entry) error
+	// List returns matching entries ordered by settlement time
+	List(ctx context.Context, filter Filter) ([]Entry, error)
+}
+
+// MemoryLedger keeps fee entries in process
+type MemoryLedger struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+// NewMemoryLedger creates an empty in-memory ledger
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{entries: make(map[string]Entry)}
+}
+
+func (l *MemoryLedger) Upsert(ctx context.Context, entries []Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range entries {
+		l.entries[entry.TransactionID] = entry
+	}
+	return nil
+}
+
+func (l *MemoryLedger) List(ctx context.Context, filter Filter) ([]Entry, error) {
+	l.mu.RLock()
+	entries := []Entry{}
+	for _, entry := range l.entries {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].SettledAt.Equal(entries[j].SettledAt) {
+			return entries[i].SettledAt.Before(entries[j].SettledAt)
+		}
+		return entries[i].TransactionID < entries[j].TransactionID
+	})
+	return entries, nil
+}
@@ -0,0 +1,100 @@
+package fees
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const settlementReport = `Transaction ID,MID,Card Type,Interchange Program,Amount,Interchange,Assessments,Markup,Settlement Date
+1001,m1,Visa,CPS Retail,100.00,1.51,0.14,0.10,2026-10-01
+1002,m1,Visa,Standard,100.00,2.70,0.14,0.10,2026-10-01
+1003,m1,Mastercard,Merit III,50.00,0.95,0.07,0.05,2026-10-02
+1004,m2,Visa,CPS Retail,200.00,3.02,0.28,0.20,2026-10-03
+`
+
+func TestParseSettlementCSV(t *testing.T) {
+	entries, err := ParseSettlementCSV(strings.NewReader(settlementReport))
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	assert.Equal(t, Entry{
+		TransactionID:       "1002",
+		MerchantID:          "m1",
+		CardBrand:           "visa",
+		InterchangeCategory: "Standard",
+		Amount:              100,
+		InterchangeFee:      2.70,
+		AssessmentFee:       0.14,
+		ProcessorFee:        0.10,
+		SettledAt:           time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+	}, entries[1])
+
+	_, err = ParseSettlementCSV(strings.NewReader("transaction_id,amount\n1,2.00\n"))
+	assert.ErrorContains(t, err, "missing the merchant_id column")
+
+	_, err = ParseSettlementCSV(strings.NewReader(strings.Replace(settlementReport, "2.70", "two", 1)))
+	assert.ErrorContains(t, err, "line 3")
+}
+
+func TestSummarize(t *testing.T) {
+	entries, err := ParseSettlementCSV(strings.NewReader(settlementReport))
+	require.NoError(t, err)
+
+	report := Summarize(entries)
+	require.Len(t, report.Brands, 3)
+
+	visa := report.Brands[1]
+	assert.Equal(t, "m1", visa.MerchantID)
+	assert.Equal(t, "visa", visa.CardBrand)
+	assert.Equal(t, 2, visa.Transactions)
+	assert.Equal(t, 4.21, visa.InterchangeFees)
+	assert.Equal(t, 2.105, visa.InterchangeRate)
+	assert.Equal(t, 2.345, visa.EffectiveRate)
+	require.Len(t, visa.Categories, 2)
+	assert.Equal(t, "CPS Retail", visa.Categories[0].Category)
+	assert.Equal(t, 2.7, visa.Categories[1].InterchangeRate)
+
+	assert.Equal(t, 4, report.Totals.Transactions)
+	assert.Equal(t, 450.0, report.Totals.Volume)
+}
+
+func TestSQLLedgerUpsertAndFilter(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	ledger, err := NewSQLLedger(ctx, database)
+	require.NoError(t, err)
+
+	entries, err := ParseSettlementCSV(strings.NewReader(settlementReport))
+	require.NoError(t, err)
+	require.NoError(t, ledger.Upsert(ctx, entries))
+	// Importing the same report again replaces rather than duplicates
+	require.NoError(t, ledger.Upsert(ctx, entries))
+
+	all, err := ledger.List(ctx, Filter{})
+	require.NoError(t, err)
+	assert.Equal(t, entries, all)
+
+	filtered, err := ledger.List(ctx, Filter{
+		From:       time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC),
+		MerchantID: "m1",
+	})
+	require.NoError(t, err)
+	assert.Len(t, filtered, 3)
+
+	memory := NewMemoryLedger()
+	require.NoError(t, memory.Upsert(ctx, entries))
+	fromMemory, err := memory.List(ctx, Filter{MerchantID: "m2"})
+	require.NoError(t, err)
+	assert.Len(t, fromMemory, 1)
+}
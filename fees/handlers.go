@@ -0,0 +1,70 @@
+package fees
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/logctx"
+)
+
+// maxReportSize bounds an uploaded settlement report
+const maxReportSize = 32 << 20
+
+// HandleImport loads a settlement fee report sent as the CSV request body
+func HandleImport(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := ParseSettlementCSV(http.MaxBytesReader(w, r.Body, maxReportSize))
+		if err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid settlement report: "+err.Error())
+			return
+		}
+
+		if err := ledger.Upsert(r.Context(), entries); err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to store fee entries")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to store fee entries")
+			return
+		}
+
+		logctx.From(r.Context()).WithField("entries", len(entries)).Info("Settlement fee report imported")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"imported": len(entries)})
+	}
+}
+
+// HandleReport summarizes fees for transactions settled between the from
+// and to dates (inclusive, YYYY-MM-DD), optionally for one merchant_id
+func HandleReport(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := Filter{MerchantID: query.Get("merchant_id")}
+
+		if from := query.Get("from"); from != "" {
+			date, err := time.Parse("2006-01-02", from)
+			if err != nil {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "from must be a date (YYYY-MM-DD)")
+				return
+			}
+			filter.From = date
+		}
+		if to := query.Get("to"); to != "" {
+			date, err := time.Parse("2006-01-02", to)
+			if err != nil {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "to must be a date (YYYY-MM-DD)")
+				return
+			}
+			filter.To = date.AddDate(0, 0, 1)
+		}
+
+		entries, err := ledger.List(r.Context(), filter)
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to list fee entries")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load fee entries")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Summarize(entries))
+	}
+}
@@ -0,0 +1,143 @@
+package fees
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// columnAliases maps the header names processors use in settlement fee
+// reports to Entry fields. Headers are matched case-insensitively with
+// spaces treated as underscores.
+var columnAliases = map[string]string{
+	"transaction_id":       "transaction_id",
+	"transactionid":        "transaction_id",
+	"merchant_id":          "merchant_id",
+	"mid":                  "merchant_id",
+	"card_brand":           "card_brand",
+	"card_type":            "card_brand",
+	"interchange_category": "interchange_category",
+	"interchange_program":  "interchange_category",
+	"amount":               "amount",
+	"settled_amount":       "amount",
+	"interchange_fee":      "interchange_fee",
+	"interchange":          "interchange_fee",
+	"assessment_fee":       "assessment_fee",
+	"assessments":          "assessment_fee",
+	"processor_fee":        "processor_fee",
+	"markup":               "processor_fee",
+	"settled_at":           "settled_at",
+	"settlement_date":      "settled_at",
+}
+
+// requiredColumns must be present in every settlement report
+var requiredColumns = []string{"transaction_id", "merchant_id", "card_brand", "amount", "interchange_fee", "settled_at"}
+
+// ParseSettlementCSV reads the per-transaction rows of a settlement fee
+// report. The first row is the header; assessment_fee, processor_fee and
+// interchange_category are optional. Dates may be YYYY-MM-DD or RFC 3339.
+func ParseSettlementCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("settlement report is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+		if field, ok := columnAliases[name]; ok {
+			columns[field] = i
+		}
+	}
+	for _, field := range requiredColumns {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("settlement report is missing the %s column", field)
+		}
+	}
+
+	var entries []Entry
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := parseRow(record, columns)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func parseRow(record []string, columns map[string]int) (Entry, error) {
+	value := func(field string) string {
+		if i, ok := columns[field]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	money := func(field string) (float64, error) {
+		raw := strings.TrimPrefix(value(field), "$")
+		if raw == "" {
+			return 0, nil
+		}
+		amount, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", field, raw)
+		}
+		return amount, nil
+	}
+
+	entry := Entry{
+		TransactionID:       value("transaction_id"),
+		MerchantID:          value("merchant_id"),
+		CardBrand:           strings.ToLower(value("card_brand")),
+		InterchangeCategory: value("interchange_category"),
+	}
+	if entry.TransactionID == "" || entry.MerchantID == "" || entry.CardBrand == "" {
+		return Entry{}, errors.New("transaction_id, merchant_id and card_brand are required")
+	}
+
+	var err error
+	if entry.Amount, err = money("amount"); err != nil {
+		return Entry{}, err
+	}
+	if entry.InterchangeFee, err = money("interchange_fee"); err != nil {
+		return Entry{}, err
+	}
+	if entry.AssessmentFee, err = money("assessment_fee"); err != nil {
+		return Entry{}, err
+	}
+	if entry.ProcessorFee, err = money("processor_fee"); err != nil {
+		return Entry{}, err
+	}
+	if entry.SettledAt, err = parseDate(value("settled_at")); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+// parseDate accepts a calendar date or an RFC 3339 timestamp
+func parseDate(raw string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid settled_at %q: use YYYY-MM-DD or RFC 3339", raw)
+}
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS fee_entries (
+    transaction_id       TEXT PRIMARY KEY,
+    merchant_id          TEXT NOT NULL,
+    card_brand           TEXT NOT NULL,
+    interchange_category TEXT NOT NULL DEFAULT '',
+    amount               DOUBLE PRECISION NOT NULL,
+    interchange_fee      DOUBLE PRECISION NOT NULL,
+    assessment_fee       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    processor_fee        DOUBLE PRECISION NOT NULL DEFAULT 0,
+    settled_at           TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fee_entries_settled_at ON fee_entries (settled_at);
@@ -0,0 +1,122 @@
+package fees
+
+import (
+	"math"
+	"sort"
+)
+
+// Totals are summed fees for a set of transactions. Rates are percentages of
+// volume, so 2.1 means 2.1%.
+type Totals struct {
+	Transactions    int     `json:"transactions"`
+	Volume          float64 `json:"volume"`
+	InterchangeFees float64 `json:"interchange_fees"`
+	AssessmentFees  float64 `json:"assessment_fees"`
+	ProcessorFees   float64 `json:"processor_fees"`
+	TotalFees       float64 `json:"total_fees"`
+	InterchangeRate float64 `json:"interchange_rate"`
+	EffectiveRate   float64 `json:"effective_rate"`
+}
+
+// CategoryTotals breaks a brand's interchange down by the category each
+// transaction qualified for. A large share in downgrade categories (for
+// example "standard" instead of "card present") points to misclassification.
+type CategoryTotals struct {
+	Category string `json:"category"`
+	Totals
+}
+
+// BrandReport is one merchant's fees on one card brand
+type BrandReport struct {
+	MerchantID string           `json:"merchant_id"`
+	CardBrand  string           `json:"card_brand"`
+	Categories []CategoryTotals `json:"categories"`
+	Totals
+}
+
+// Report is the response of GET /reports/fees
+type Report struct {
+	Brands []BrandReport `json:"brands"`
+	Totals Totals        `json:"totals"`
+}
+
+func (t *Totals) add(e Entry) {
+	t.Transactions++
+	t.Volume += e.Amount
+	t.InterchangeFees += e.InterchangeFee
+	t.AssessmentFees += e.AssessmentFee
+	t.ProcessorFees += e.ProcessorFee
+	t.TotalFees += e.TotalFee()
+}
+
+// finish rounds the sums to cents and computes the rates
+func (t *Totals) finish() {
+	if t.Volume != 0 {
+		t.InterchangeRate = round(t.InterchangeFees/t.Volume*100, 4)
+		t.EffectiveRate = round(t.TotalFees/t.Volume*100, 4)
+	}
+	t.Volume = round(t.Volume, 2)
+	t.InterchangeFees = round(t.InterchangeFees, 2)
+	t.AssessmentFees = round(t.AssessmentFees, 2)
+	t.ProcessorFees = round(t.ProcessorFees, 2)
+	t.TotalFees = round(t.TotalFees, 2)
+}
+
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
+
+// Summarize groups entries by merchant and card brand, then by interchange
+// category. Refunds carry negative amounts and fees and net out.
+func Summarize(entries []Entry) Report {
+	type brandKey struct{ merchant, brand string }
+	brands := make(map[brandKey]*BrandReport)
+	categories := make(map[brandKey]map[string]*CategoryTotals)
+
+	report := Report{Brands: []BrandReport{}}
+	for _, e := range entries {
+		key := brandKey{e.MerchantID, e.CardBrand}
+		brand, ok := brands[key]
+		if !ok {
+			brand = &BrandReport{MerchantID: e.MerchantID, CardBrand: e.CardBrand}
+			brands[key] = brand
+			categories[key] = make(map[string]*CategoryTotals)
+		}
+		brand.add(e)
+		report.Totals.add(e)
+
+		category, ok := categories[key][e.InterchangeCategory]
+		if !ok {
+			category = &CategoryTotals{Category: e.InterchangeCategory}
+			categories[key][e.InterchangeCategory] = category
+		}
+		category.add(e)
+	}
+
+	for key, brand := range brands {
+		brand.finish()
+		brand.Categories = []CategoryTotals{}
+		for _, category := range categories[key] {
+			category.finish()
+			brand.Categories = append(brand.Categories, *category)
+		}
+		sort.Slice(brand.Categories, func(i, j int) bool {
+			a, b := brand.Categories[i], brand.Categories[j]
+			if a.Volume != b.Volume {
+				return a.Volume > b.Volume
+			}
+			return a.Category < b.Category
+		})
+		report.Brands = append(report.Brands, *brand)
+	}
+	sort.Slice(report.Brands, func(i, j int) bool {
+		if report.Brands[i].MerchantID != report.Brands[j].MerchantID {
+			return report.Brands[i].MerchantID < report.Brands[j].MerchantID
+		}
+		return report.Brands[i].CardBrand < report.Brands[j].CardBrand
+	})
+	report.Totals.finish()
+
+	return report
+}
@@ -0,0 +1,107 @@
+package fees
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"strings"
+
+	"nmi-pay-int/db"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// SQLLedger stores fee entries in Postgres or SQLite
+type SQLLedger struct {
+	db *db.DB
+}
+
+// NewSQLLedger migrates the fee schema and returns a ledger
+func NewSQLLedger(ctx context.Context, database *db.DB) (*SQLLedger, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "fees", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLLedger{db: database}, nil
+}
+
+// Upsert writes a whole import in one transaction so a failed report leaves
+// no partial data behind
+func (l *SQLLedger) Upsert(ctx context.Context, entries []Entry) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// ON CONFLICT ... DO UPDATE is understood by both Postgres and SQLite
+	stmt, err := tx.PrepareContext(ctx, l.db.Rebind(`INSERT INTO fee_entries
+		(transaction_id, merchant_id, card_brand, interchange_category, amount, interchange_fee, assessment_fee, processor_fee, settled_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (transaction_id) DO UPDATE SET
+			merchant_id = excluded.merchant_id,
+			card_brand = excluded.card_brand,
+			interchange_category = excluded.interchange_category,
+			amount = excluded.amount,
+			interchange_fee = excluded.interchange_fee,
+			assessment_fee = excluded.assessment_fee,
+			processor_fee = excluded.processor_fee,
+			settled_at = excluded.settled_at`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, e.TransactionID, e.MerchantID, e.CardBrand, e.InterchangeCategory,
+			e.Amount, e.InterchangeFee, e.AssessmentFee, e.ProcessorFee, e.SettledAt.UTC()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (l *SQLLedger) List(ctx context.Context, filter Filter) ([]Entry, error) {
+	var where []string
+	var args []any
+	if !filter.From.IsZero() {
+		where = append(where, "settled_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "settled_at < ?")
+		args = append(args, filter.To.UTC())
+	}
+	if filter.MerchantID != "" {
+		where = append(where, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+
+	query := `SELECT transaction_id, merchant_id, card_brand, interchange_category, amount,
+		interchange_fee, assessment_fee, processor_fee, settled_at FROM fee_entries`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY settled_at, transaction_id"
+
+	rows, err := l.db.QueryContext(ctx, l.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.TransactionID, &e.MerchantID, &e.CardBrand, &e.InterchangeCategory, &e.Amount,
+			&e.InterchangeFee, &e.AssessmentFee, &e.ProcessorFee, &e.SettledAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
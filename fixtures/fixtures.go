@@ -0,0 +1,121 @@
+// Package fixtures is a corpus of sanitized NMI gateway responses: approvals,
+// every documented decline and error code, customer vault and recurring
+// billing results, Query API reports, and malformed bodies a proxy or an
+// outage can produce. The service's parser tests run against it, and SDK
+// users can serve the same responses to their own code:
+//
+//	gateway := httptest.NewServer(fixtures.Handler("transact/decline_202_insufficient_funds"))
+//	defer gateway.Close()
+//	client := api.NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+//
+// Card numbers, security keys and customer details are test values.
+package fixtures
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Fixture kinds, named after the gateway endpoint that returns them
+const (
+	// KindTransact responses come from the Payment API (transact.php) and
+	// are form encoded
+	KindTransact = "transact"
+	// KindQuery responses come from the Query API (query.php) and are XML
+	KindQuery = "query"
+)
+
+//go:embed transact/*.txt query/*.xml
+var files embed.FS
+
+// Fixture is one recorded gateway response
+type Fixture struct {
+	// Name is the kind and file name without extension, e.g.
+	// "transact/approved_sale"
+	Name string
+	Kind string
+	Body string
+}
+
+var corpus = load()
+
+func load() []Fixture {
+	var all []Fixture
+	err := fs.WalkDir(files, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := files.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		// The gateway ends lines with \n; keep bodies identical however
+		// the checkout converted line endings
+		all = append(all, Fixture{
+			Name: strings.TrimSuffix(p, path.Ext(p)),
+			Kind: path.Dir(p),
+			Body: strings.ReplaceAll(string(body), "\r\n", "\n"),
+		})
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("fixtures: %v", err))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// All returns every fixture, ordered by name
+func All() []Fixture {
+	return append([]Fixture(nil), corpus...)
+}
+
+// OfKind returns the fixtures of one kind, ordered by name
+func OfKind(kind string) []Fixture {
+	var matched []Fixture
+	for _, f := range corpus {
+		if f.Kind == kind {
+			matched = append(matched, f)
+		}
+	}
+	return matched
+}
+
+// Get returns the fixture with the given name
+func Get(name string) (Fixture, bool) {
+	for _, f := range corpus {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Fixture{}, false
+}
+
+// Body returns a fixture's response body. It panics on an unknown name,
+// which in a test is a typo.
+func Body(name string) string {
+	f, ok := Get(name)
+	if !ok {
+		panic("fixtures: unknown fixture " + name)
+	}
+	return f.Body
+}
+
+// Handler answers every request with the named fixture, as the gateway
+// would. It panics on an unknown name.
+func Handler(name string) http.Handler {
+	body := Body(name)
+	contentType := "text/plain; charset=utf-8"
+	if strings.HasPrefix(name, KindQuery+"/") {
+		contentType = "text/xml; charset=utf-8"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	})
+}
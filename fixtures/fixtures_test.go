@@ -0,0 +1,40 @@
+package fixtures
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorpus(t *testing.T) {
+	all := All()
+	require.NotEmpty(t, all)
+	assert.Equal(t, len(all), len(OfKind(KindTransact))+len(OfKind(KindQuery)))
+
+	sale, ok := Get("transact/approved_sale")
+	require.True(t, ok)
+	assert.Equal(t, KindTransact, sale.Kind)
+	assert.True(t, strings.HasPrefix(sale.Body, "response=1&"))
+	assert.NotContains(t, Body("query/transaction_settled_sale"), "\r")
+
+	_, ok = Get("approved_sale")
+	assert.False(t, ok, "names include the kind")
+	assert.Panics(t, func() { Body("transact/no_such_fixture") })
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(Handler("query/empty_report"))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/x-www-form-urlencoded", strings.NewReader("report_type=customer_vault"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, Body("query/empty_report"), string(body))
+	assert.Equal(t, "text/xml; charset=utf-8", resp.Header.Get("Content-Type"))
+}
@@ -0,0 +1,213 @@
+// Package health answers liveness and readiness probes. Liveness only says
+// the process is serving; readiness runs a check per dependency and fails
+// while any required one is down.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+const (
+	// DefaultCacheTTL is how long a check result is reused, so frequent
+	// probes from several sources cost one check per dependency per interval
+	DefaultCacheTTL = 10 * time.Second
+
+	// checkTimeout bounds a single dependency check
+	checkTimeout = 2 * time.Second
+)
+
+// Dependency check states
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Check reports whether a dependency is usable
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one dependency check
+type Result struct {
+	Status string `json:"status"`
+	// Required dependencies make the service unready while they are down;
+	// the others have a fallback and are only reported
+	Required  bool      `json:"required"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the readiness of the service and each of its dependencies
+type Report struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type dependency struct {
+	check    Check
+	required bool
+}
+
+// Checker runs the readiness checks, caching each result for a TTL
+type Checker struct {
+	ttl time.Duration
+
+	mu           sync.Mutex
+	dependencies map[string]dependency
+	results      map[string]Result
+}
+
+// NewChecker creates a checker reusing results for ttl, or DefaultCacheTTL
+// when ttl is zero
+func NewChecker(ttl time.Duration) *Checker {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Checker{
+		ttl:          ttl,
+		dependencies: make(map[string]dependency),
+		results:      make(map[string]Result),
+	}
+}
+
+// Require adds a dependency the service cannot serve payments without
+func (c *Checker) Require(name string, check Check) {
+	c.add(name, dependency{check: check, required: true})
+}
+
+// Optional adds a dependency with a fallback, reported without affecting
+// readiness
+func (c *Checker) Optional(name string, check Check) {
+	c.add(name, dependency{check: check})
+}
+
+func (c *Checker) add(name string, dep dependency) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dependencies[name] = dep
+	delete(c.results, name)
+}
+
+// Check runs every check whose cached result has expired, in parallel, and
+// reports the outcome. Concurrent callers wait for the same run rather than
+// each checking again.
+func (c *Checker) Check(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A probe that hangs up must not leave a failure cached for everyone else
+	ctx = context.WithoutCancel(ctx)
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	var freshMu sync.Mutex
+	fresh := make(map[string]Result)
+	for name, dep := range c.dependencies {
+		if cached, ok := c.results[name]; ok && now.Sub(cached.CheckedAt) < c.ttl {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, dep dependency) {
+			defer wg.Done()
+			result := run(ctx, dep)
+			metrics.SetDependencyUp(name, result.Status == StatusUp)
+			freshMu.Lock()
+			fresh[name] = result
+			freshMu.Unlock()
+		}(name, dep)
+	}
+	wg.Wait()
+	for name, result := range fresh {
+		c.results[name] = result
+	}
+
+	report := Report{Ready: true, Checks: make(map[string]Result, len(c.results))}
+	for name, result := range c.results {
+		report.Checks[name] = result
+		if result.Required && result.Status != StatusUp {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+// run performs one check within checkTimeout
+func run(ctx context.Context, dep dependency) Result {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := dep.check(ctx)
+	result := Result{
+		Status:    StatusUp,
+		Required:  dep.required,
+		LatencyMS: time.Since(start).Milliseconds(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// HandleReadiness serves the readiness report, with 503 while a required
+// dependency is down
+func (c *Checker) HandleReadiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// HandleLiveness reports that the process is up and serving requests. It
+// checks no dependency, so an outage elsewhere does not get the process
+// restarted.
+func HandleLiveness() http.HandlerFunc {
+	started := time.Now()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "ok",
+			"uptime_seconds": int64(time.Since(started).Seconds()),
+		})
+	}
+}
+
+// Dial returns a check that opens and closes a TCP connection to the host of
+// rawURL, on the scheme's default port unless the URL names one
+func Dial(rawURL string) Check {
+	return func(ctx context.Context) error {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		port := parsed.Port()
+		if port == "" {
+			port = "443"
+			if parsed.Scheme == "http" {
+				port = "80"
+			}
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(parsed.Hostname(), port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
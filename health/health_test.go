@@ -0,0 +1,91 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	var redisDown, databaseDown atomic.Bool
+	checker := NewChecker(time.Nanosecond)
+	checker.Require("database", func(context.Context) error {
+		if databaseDown.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	checker.Optional("redis", func(context.Context) error {
+		if redisDown.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	handler := checker.HandleReadiness()
+
+	probe := func() (int, Report) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report Report
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+		return rec.Code, report
+	}
+
+	code, report := probe()
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Ready)
+	assert.Equal(t, StatusUp, report.Checks["database"].Status)
+	assert.True(t, report.Checks["database"].Required)
+
+	// An optional dependency is reported but keeps the service ready
+	redisDown.Store(true)
+	code, report = probe()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusDown, report.Checks["redis"].Status)
+	assert.Equal(t, "connection refused", report.Checks["redis"].Error)
+
+	databaseDown.Store(true)
+	code, report = probe()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Ready)
+	assert.Equal(t, StatusDown, report.Checks["database"].Status)
+}
+
+func TestCheckCachesResults(t *testing.T) {
+	var calls atomic.Int32
+	checker := NewChecker(time.Hour)
+	checker.Require("nmi", func(context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		assert.True(t, checker.Check(ctx).Ready, "a cancelled probe does not fail the checks")
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestDial(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	assert.NoError(t, Dial(server.URL+"/api/transact.php")(context.Background()))
+
+	server.Close()
+	assert.Error(t, Dial(server.URL)(context.Background()))
+}
+
+func TestLiveness(t *testing.T) {
+	rec := httptest.NewRecorder()
+	HandleLiveness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"ok"`)
+}
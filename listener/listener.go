@@ -0,0 +1,59 @@
+// Package listener opens the service's HTTP listener in a way that lets a new
+// binary take over the port while the old one drains its in-flight requests.
+//
+// Two takeover styles are supported:
+//   - systemd-style socket activation: when LISTEN_FDS is set for this process
+//     the inherited socket (fd 3) is used instead of binding a new one, so the
+//     socket outlives any single process.
+//   - SO_REUSEPORT: the new process binds the same address alongside the old
+//     one; the old process is then sent SIGTERM and drains via Shutdown.
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// Listen returns a TCP listener for addr, preferring an inherited socket and
+// otherwise binding with SO_REUSEPORT when reusePort is set
+func Listen(addr string, reusePort bool) (net.Listener, error) {
+	if ln, err := inherited(); ln != nil || err != nil {
+		return ln, err
+	}
+
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// inherited returns the socket passed by a supervisor, if any
+func inherited() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	// Unset so child processes do not try to reuse the descriptors
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	f := os.NewFile(uintptr(listenFDsStart), "listener")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	return ln, nil
+}
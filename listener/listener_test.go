@@ -0,0 +1,24 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package listener
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := Listen("127.0.0.1:0", true)
+	require.NoError(t, err)
+	defer first.Close()
+
+	// A second process taking over the port binds the same address
+	second, err := Listen(first.Addr().String(), true)
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Without SO_REUSEPORT the address is still taken
+	_, err = Listen(first.Addr().String(), false)
+	require.Error(t, err)
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package listener
+
+import "syscall"
+
+// reusePortControl is a no-op where SO_REUSEPORT is unavailable; restarts on
+// these platforms need socket activation instead
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
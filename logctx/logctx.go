@@ -0,0 +1,60 @@
+// Package logctx carries a request-scoped logrus entry on the context so that
+// code deep in a request can log with the request's identifying fields.
+package logctx
+
+import (
+	"context"
+
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+type contextKey struct{}
+
+// Field names attached to request-scoped log entries
+const (
+	FieldRequestID = "request_id"
+	FieldMerchant  = "merchant"
+	FieldAPIKey    = "api_key"
+	FieldRoute     = "route"
+	FieldCaller    = "caller"
+	FieldTraceID   = "trace_id"
+)
+
+// WithEntry returns a copy of ctx carrying the given log entry
+func WithEntry(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// WithFields adds fields to the entry already on ctx
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return WithEntry(ctx, From(ctx).WithFields(fields))
+}
+
+// From returns the log entry on ctx, or a bare entry on the service logger
+// when the context was not created by the logging middleware
+func From(ctx context.Context) *logrus.Entry {
+	if ctx != nil {
+		if entry, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+			return entry
+		}
+	}
+	return logrus.NewEntry(metrics.GetLogger())
+}
+
+// Merchant returns the merchant attached by the logging middleware, or
+// "default" for single-merchant deployments and background work
+func Merchant(ctx context.Context) string {
+	if merchant, ok := From(ctx).Data[FieldMerchant].(string); ok && merchant != "" {
+		return merchant
+	}
+	return "default"
+}
+
+// Caller returns the authenticated caller attached by the authentication
+// middleware, or "" for unauthenticated requests and background work
+func Caller(ctx context.Context) string {
+	caller, _ := From(ctx).Data[FieldCaller].(string)
+	return caller
+}
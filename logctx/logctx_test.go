@@ -0,0 +1,24 @@
+package logctx
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromWithoutEntry(t *testing.T) {
+	entry := From(context.Background())
+	assert.NotNil(t, entry)
+	assert.Empty(t, entry.Data)
+}
+
+func TestWithFieldsAccumulates(t *testing.T) {
+	ctx := WithFields(context.Background(), logrus.Fields{FieldRequestID: "req-1"})
+	ctx = WithFields(ctx, logrus.Fields{FieldRoute: "/payments/sale"})
+
+	entry := From(ctx)
+	assert.Equal(t, "req-1", entry.Data[FieldRequestID])
+	assert.Equal(t, "/payments/sale", entry.Data[FieldRoute])
+}
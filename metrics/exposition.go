@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// NewMetricsServer creates an HTTP server exposing /metrics on a dedicated
+// internal address, keeping it off the public payment router
+func NewMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// StartMetricsServer starts the internal metrics server in the background
+func StartMetricsServer(addr string) *http.Server {
+	srv := NewMetricsServer(addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			LogError(context.Background(), fmt.Errorf("metrics server failed: %v", err))
+		}
+	}()
+	return srv
+}
+
+// PushMetrics publishes all registered metrics to a Prometheus push-gateway.
+// Short-lived CLI runs call this before exiting so their telemetry is not lost.
+func PushMetrics(gatewayURL, job string) error {
+	if gatewayURL == "" {
+		return nil
+	}
+
+	err := push.New(gatewayURL, job).
+		Gatherer(prometheus.DefaultGatherer).
+		Push()
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	return nil
+}
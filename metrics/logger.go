@@ -1,12 +1,24 @@
 package metrics
 
 import (
+	"context"
 	"os"
 
+	"nmi-pay-int/pci"
+	"nmi-pay-int/requestid"
+
 	"github.com/sirupsen/logrus"
 )
 
-var log = logrus.New()
+var log = newLogger()
+
+// newLogger returns a logger that masks card data and keys in everything it
+// writes
+func newLogger() *logrus.Logger {
+	l := logrus.New()
+	l.AddHook(pci.Hook{})
+	return l
+}
 
 // InitLogger configures the global logger
 func InitLogger() {
@@ -22,26 +34,39 @@ func InitLogger() {
 	}
 
 	// Set log level based on DEBUG_MODE
-	if os.Getenv("DEBUG_MODE") == "true" {
+	SetDebug(os.Getenv("DEBUG_MODE") == "true")
+}
+
+// SetDebug switches debug logging on or off
+func SetDebug(enabled bool) {
+	if enabled {
 		log.SetLevel(logrus.DebugLevel)
 	} else {
 		log.SetLevel(logrus.InfoLevel)
 	}
 }
 
+// entry returns a log entry tagged with the request ID on ctx, if any
+func entry(ctx context.Context) *logrus.Entry {
+	if id := requestid.From(ctx); id != "" {
+		return log.WithField("request_id", id)
+	}
+	return logrus.NewEntry(log)
+}
+
 // LogInfo logs info level messages
-func LogInfo(msg string) {
-	log.Info(msg)
+func LogInfo(ctx context.Context, msg string) {
+	entry(ctx).Info(msg)
 }
 
 // LogError logs error level messages
-func LogError(err error) {
-	log.Error(err)
+func LogError(ctx context.Context, err error) {
+	entry(ctx).Error(err)
 }
 
 // LogDebug logs debug level messages
-func LogDebug(msg string) {
-	log.Debug(msg)
+func LogDebug(ctx context.Context, msg string) {
+	entry(ctx).Debug(msg)
 }
 
 // RecordTransaction records transaction metrics
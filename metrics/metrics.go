@@ -1,28 +1,87 @@
 package metrics
 
 import (
+	"errors"
+	"sort"
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
+// DefaultAmountBuckets are the ticket-size buckets, in dollars, used unless
+// AMOUNT_HISTOGRAM_BUCKETS overrides them. The small buckets are deliberately
+// fine-grained since card testing shows up as a spike of tiny amounts.
+var DefaultAmountBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
 var (
 	// Transaction metrics
 	TransactionCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "nmi_transactions_total",
-			Help: "Total number of transactions processed",
+			Help: "Total number of transactions processed, by merchant, type and status",
 		},
-		[]string{"type", "status"},
+		[]string{"merchant", "type", "status"},
 	)
 
 	TransactionDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "nmi_transaction_duration_seconds",
 			Help:    "Transaction processing duration in seconds",
-			Buckets: prometheus.DefBuckets,
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
 		},
 		[]string{"type"},
 	)
 
+	// Time spent waiting on NMI alone, apart from our handlers and middleware
+	GatewayRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nmi_gateway_request_duration_seconds",
+			Help:    "Duration of calls to the NMI gateway in seconds, by transaction type and outcome",
+			Buckets: []float64{.025, .05, .1, .25, .5, 1, 2, 3, 5, 10, 20},
+		},
+		[]string{"type", "outcome"},
+	)
+
+	// Gateway results of payments, for approval-rate alerting
+	GatewayResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_gateway_results_total",
+			Help: "Total number of payment results from the gateway, by merchant, type, NMI response code, decline category (approved for approvals) and card brand",
+		},
+		[]string{"merchant", "type", "response_code", "category", "card_brand"},
+	)
+
+	// AVS/CVV policy outcomes of approved payments
+	VerificationDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_verification_decisions_total",
+			Help: "Total number of AVS/CVV policy decisions on approved payments, by merchant, decision (passed, voided, flagged, void_failed) and rule",
+		},
+		[]string{"merchant", "decision", "rule"},
+	)
+
+	// Payments whose card is on a merchant's blocklist or allowlist
+	CardListHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_card_list_hits_total",
+			Help: "Total number of payments with a card on a merchant's card list, by merchant and list (block, allow)",
+		},
+		[]string{"merchant", "list"},
+	)
+
+	// Audit log appends for money-moving calls
+	AuditRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_audit_records_total",
+			Help: "Total number of audit records written for money-moving calls, by result (appended, failed)",
+		},
+		[]string{"result"},
+	)
+
+	// Transaction amounts, for fraud baselining of ticket sizes
+	TransactionAmount = newTransactionAmount(DefaultAmountBuckets)
+
 	// Error metrics
 	ErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -74,6 +133,251 @@ var (
 		},
 		[]string{"operation", "status"},
 	)
+
+	// Operations by issuing identity (external API caller or internal job)
+	ActorOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_actor_operations_total",
+			Help: "Total number of gateway operations by issuing actor",
+		},
+		[]string{"actor", "operation"},
+	)
+
+	// Outbound webhook deliveries (delivered, retry, dead_letter)
+	WebhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_webhook_deliveries_total",
+			Help: "Total number of webhook delivery outcomes by event type",
+		},
+		[]string{"event", "status"},
+	)
+
+	// Soft dependencies running on a local fallback (1 = degraded)
+	DependencyDegraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nmi_dependency_degraded",
+			Help: "Whether a soft dependency is unavailable and a local fallback is in use (1 = degraded)",
+		},
+		[]string{"dependency"},
+	)
+
+	// Readiness check outcomes (1 = up)
+	DependencyUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nmi_dependency_up",
+			Help: "Whether the last readiness check of a dependency succeeded (1 = up)",
+		},
+		[]string{"dependency"},
+	)
+
+	// Gateway throttling (1 while NMI is asking us to back off)
+	GatewayThrottled = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_gateway_throttled",
+			Help: "Whether NMI is currently throttling requests (1 = throttled)",
+		},
+	)
+
+	// Gateway connections handed to requests, by whether they came from the
+	// keep-alive pool
+	GatewayConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_gateway_connections_total",
+			Help: "Total number of gateway connections used by requests, by whether they were reused",
+		},
+		[]string{"reused"},
+	)
+
+	// Gateway connections currently open, idle or in use
+	GatewayOpenConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_gateway_open_connections",
+			Help: "Number of open connections to the NMI gateway",
+		},
+	)
+
+	// Hedged Query API reads (won, lost, skipped)
+	QueryHedges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_query_hedges_total",
+			Help: "Total number of hedged Query API requests by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	// Requests rejected by a route group's IP allowlist
+	AllowlistViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_ip_allowlist_violations_total",
+			Help: "Total number of requests rejected by an IP allowlist, by route group",
+		},
+		[]string{"group"},
+	)
+
+	// Mirrored shadow requests (match, mismatch, error, skipped)
+	ShadowComparisons = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_shadow_comparisons_total",
+			Help: "Total number of shadow requests compared with the live response, by operation and result",
+		},
+		[]string{"operation", "result"},
+	)
+
+	// gRPC calls by method and status code
+	GRPCRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_grpc_requests_total",
+			Help: "Total number of gRPC calls by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+
+	// gRPC call duration by method
+	GRPCDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nmi_grpc_request_duration_seconds",
+			Help:    "gRPC call duration in seconds",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"method"},
+	)
+
+	// Requests holding a concurrency slot, by limited route
+	RouteInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nmi_route_in_flight",
+			Help: "Number of requests holding a concurrency slot, by limited route",
+		},
+		[]string{"route"},
+	)
+
+	// Requests waiting for a concurrency slot, by limited route
+	RouteQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nmi_route_queue_depth",
+			Help: "Number of requests waiting for a concurrency slot, by limited route",
+		},
+		[]string{"route"},
+	)
+
+	// Requests rejected by authentication, by required scope and reason
+	AuthFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_auth_failures_total",
+			Help: "Total number of requests rejected by authentication, by required scope and reason",
+		},
+		[]string{"scope", "reason"},
+	)
+
+	// Requests shed by a route concurrency limit (queue_full, queue_timeout)
+	RouteRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_route_rejections_total",
+			Help: "Total number of requests rejected by a route concurrency limit, by route and reason",
+		},
+		[]string{"route", "reason"},
+	)
+
+	// Non-critical requests shed under load (in_flight, latency)
+	LoadShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_load_shed_total",
+			Help: "Total number of non-critical requests shed under load, by route and reason",
+		},
+		[]string{"route", "reason"},
+	)
+
+	// Whether latency-based load shedding is on, and the latency driving it
+	LoadShedActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_load_shed_active",
+			Help: "1 while non-critical requests are being shed because payment latency is too high",
+		},
+	)
+
+	CriticalLatencyP99 = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_critical_latency_p99_seconds",
+			Help: "P99 latency of payment-path requests over the load shedding window",
+		},
+	)
+
+	// Gateway circuit breaker state (0 = closed, 1 = half-open, 2 = open)
+	BreakerState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_gateway_breaker_state",
+			Help: "Gateway circuit breaker state (0 = closed, 1 = half-open, 2 = open)",
+		},
+	)
+
+	// Registered terminals connected at their last heartbeat
+	TerminalsOnline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nmi_terminals_online",
+			Help: "Registered payment terminals online at their last heartbeat, by merchant",
+		},
+		[]string{"merchant"},
+	)
+
+	// Transactions waiting for the background recorder, and its failed writes
+	RecorderQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_recorder_queue_depth",
+			Help: "Processed transactions queued for the transaction recorder's sinks",
+		},
+	)
+
+	RecorderWriteErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_recorder_write_errors_total",
+			Help: "Total number of transaction batches a recorder sink failed to write, by sink",
+		},
+		[]string{"sink"},
+	)
+
+	// Lifecycle events relayed from the outbox to Kafka, SNS or SQS
+	EventsPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_events_published_total",
+			Help: "Total number of lifecycle events sent to the event broker, by topic and result (published, failed)",
+		},
+		[]string{"topic", "result"},
+	)
+
+	// Open /events/stream connections
+	EventStreams = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "nmi_event_streams",
+			Help: "Number of open live event streams",
+		},
+	)
+
+	// Configuration reloads on SIGHUP or a watched file change
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_config_reloads_total",
+			Help: "Total number of configuration reloads, by result (applied, rejected)",
+		},
+		[]string{"result"},
+	)
+
+	// Reads of NMI_API_KEY from the secrets backend after startup
+	SecretRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_secret_refreshes_total",
+			Help: "Total number of security key refreshes from the secrets backend, by backend and result (unchanged, rotated, failed)",
+		},
+		[]string{"backend", "result"},
+	)
+
+	// Rereads of BIN_TABLE_FILE after it changed
+	BINTableRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nmi_bin_table_refreshes_total",
+			Help: "Total number of BIN table rereads after the file changed, by result (reloaded, failed)",
+		},
+		[]string{"result"},
+	)
 )
 
 func init() {
@@ -81,21 +385,112 @@ func init() {
 	prometheus.MustRegister(
 		TransactionCounter,
 		TransactionDuration,
+		GatewayRequestDuration,
+		GatewayResults,
+		VerificationDecisions,
+		CardListHits,
+		AuditRecords,
+		TransactionAmount,
 		ErrorCounter,
 		RequestsInFlight,
 		RequestDuration,
 		ResponseStatus,
 		VaultOperations,
 		RecurringPayments,
+		BreakerState,
+		ActorOperations,
+		GatewayThrottled,
+		WebhookDeliveries,
+		DependencyDegraded,
+		DependencyUp,
+		GatewayConnections,
+		GatewayOpenConnections,
+		QueryHedges,
+		AllowlistViolations,
+		ShadowComparisons,
+		GRPCRequests,
+		GRPCDuration,
+		RouteInFlight,
+		RouteQueueDepth,
+		RouteRejections,
+		AuthFailures,
+		LoadShed,
+		LoadShedActive,
+		CriticalLatencyP99,
+		TerminalsOnline,
+		RecorderQueueDepth,
+		RecorderWriteErrors,
+		EventsPublished,
+		EventStreams,
+		ConfigReloads,
+		SecretRefreshes,
+		BINTableRefreshes,
 	)
 }
 
 // RecordTransactionMetrics records metrics for a transaction
-func RecordTransactionMetrics(txType, status string, duration float64) {
-	TransactionCounter.WithLabelValues(txType, status).Inc()
+func RecordTransactionMetrics(merchant, txType, status string, duration float64) {
+	TransactionCounter.WithLabelValues(merchant, txType, status).Inc()
 	TransactionDuration.WithLabelValues(txType).Observe(duration)
 }
 
+// RecordGatewayResult counts one payment result from the gateway
+func RecordGatewayResult(merchant, txType, responseCode, category, cardBrand string) {
+	GatewayResults.WithLabelValues(merchant, txType, responseCode, category, cardBrand).Inc()
+}
+
+// RecordVerificationDecision counts an AVS/CVV policy decision; rule is
+// empty for payments that passed
+func RecordVerificationDecision(merchant, decision, rule string) {
+	VerificationDecisions.WithLabelValues(merchant, decision, rule).Inc()
+}
+
+// RecordCardListHit counts a payment with a card on a merchant's list
+func RecordCardListHit(merchant, list string) {
+	CardListHits.WithLabelValues(merchant, list).Inc()
+}
+
+// RecordAuditRecord counts an audit record appended, or lost to a failure
+func RecordAuditRecord(result string) {
+	AuditRecords.WithLabelValues(result).Inc()
+}
+
+// RecordTransactionAmount records the amount of an approved transaction
+func RecordTransactionAmount(merchant, txType string, amount float64) {
+	TransactionAmount.WithLabelValues(merchant, txType).Observe(amount)
+}
+
+// ConfigureAmountBuckets replaces the amount histogram with one using the
+// given buckets. Call it at startup, before any amounts are recorded.
+func ConfigureAmountBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return errors.New("at least one amount bucket is required")
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		return errors.New("amount buckets must be in increasing order")
+	}
+
+	replacement := newTransactionAmount(buckets)
+	prometheus.Unregister(TransactionAmount)
+	if err := prometheus.Register(replacement); err != nil {
+		prometheus.MustRegister(TransactionAmount)
+		return err
+	}
+	TransactionAmount = replacement
+	return nil
+}
+
+func newTransactionAmount(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nmi_transaction_amount_dollars",
+			Help:    "Approved transaction amounts by merchant and type",
+			Buckets: buckets,
+		},
+		[]string{"merchant", "type"},
+	)
+}
+
 // RecordErrorMetrics records error metrics
 func RecordErrorMetrics(txType, errorType string) {
 	ErrorCounter.WithLabelValues(txType, errorType).Inc()
@@ -126,3 +521,134 @@ func RecordVaultOperation(operation, status string) {
 func RecordRecurringPayment(operation, status string) {
 	RecurringPayments.WithLabelValues(operation, status).Inc()
 }
+
+// RecordActorOperation records a gateway operation against the identity that
+// issued it, both as a metric and in the transaction log
+func RecordActorOperation(actor, operation, transactionID string) {
+	ActorOperations.WithLabelValues(actor, operation).Inc()
+	log.WithFields(logrus.Fields{
+		"actor":          actor,
+		"operation":      operation,
+		"transaction_id": transactionID,
+	}).Info("Gateway operation issued")
+}
+
+// RecordWebhookDelivery records the outcome of a webhook delivery attempt
+func RecordWebhookDelivery(event, status string) {
+	WebhookDeliveries.WithLabelValues(event, status).Inc()
+}
+
+// SetDependencyDegraded records whether a soft dependency is on its fallback
+func SetDependencyDegraded(dependency string, degraded bool) {
+	if degraded {
+		DependencyDegraded.WithLabelValues(dependency).Set(1)
+	} else {
+		DependencyDegraded.WithLabelValues(dependency).Set(0)
+	}
+}
+
+// SetDependencyUp records the outcome of a dependency's readiness check
+func SetDependencyUp(dependency string, up bool) {
+	if up {
+		DependencyUp.WithLabelValues(dependency).Set(1)
+	} else {
+		DependencyUp.WithLabelValues(dependency).Set(0)
+	}
+}
+
+// RecordGatewayLatency records how long one gateway call took
+func RecordGatewayLatency(txType, outcome string, duration float64) {
+	GatewayRequestDuration.WithLabelValues(txType, outcome).Observe(duration)
+}
+
+// RecordGatewayConnection records whether a gateway request reused a pooled
+// connection
+func RecordGatewayConnection(reused bool) {
+	GatewayConnections.WithLabelValues(strconv.FormatBool(reused)).Inc()
+}
+
+// RecordQueryHedge records the outcome of a hedged Query API read
+func RecordQueryHedge(outcome string) {
+	QueryHedges.WithLabelValues(outcome).Inc()
+}
+
+// RecordAllowlistViolation records a request rejected by a route group's IP
+// allowlist
+func RecordAllowlistViolation(group string) {
+	AllowlistViolations.WithLabelValues(group).Inc()
+}
+
+// RecordShadowComparison records how a shadow request compared with the live
+// response
+func RecordShadowComparison(operation, result string) {
+	ShadowComparisons.WithLabelValues(operation, result).Inc()
+}
+
+// RecordGRPCRequest records a gRPC call's status code and duration
+func RecordGRPCRequest(method, code string, duration float64) {
+	GRPCRequests.WithLabelValues(method, code).Inc()
+	GRPCDuration.WithLabelValues(method).Observe(duration)
+}
+
+// RecordRouteSaturation records a limited route's slots in use and queue
+func RecordRouteSaturation(route string, inFlight, queued int) {
+	RouteInFlight.WithLabelValues(route).Set(float64(inFlight))
+	RouteQueueDepth.WithLabelValues(route).Set(float64(queued))
+}
+
+// RecordRouteRejection counts a request shed by a route concurrency limit
+func RecordRouteRejection(route, reason string) {
+	RouteRejections.WithLabelValues(route, reason).Inc()
+}
+
+// RecordLoadShed counts a non-critical request shed under load
+func RecordLoadShed(route, reason string) {
+	LoadShed.WithLabelValues(route, reason).Inc()
+}
+
+// SetLoadShedding records the payment-path P99 latency and whether it has
+// switched load shedding on
+func SetLoadShedding(p99 float64, active bool) {
+	CriticalLatencyP99.Set(p99)
+	if active {
+		LoadShedActive.Set(1)
+	} else {
+		LoadShedActive.Set(0)
+	}
+}
+
+// RecordAuthFailure counts a request rejected for missing, invalid or
+// under-scoped credentials
+func RecordAuthFailure(scope, reason string) {
+	AuthFailures.WithLabelValues(scope, reason).Inc()
+}
+
+// SetBreakerState records the gateway circuit breaker state
+func SetBreakerState(state string) {
+	switch state {
+	case "open":
+		BreakerState.Set(2)
+	case "half_open":
+		BreakerState.Set(1)
+	default:
+		BreakerState.Set(0)
+	}
+}
+
+// SetTerminalsOnline records how many terminals each merchant has online.
+// Merchants missing from online drop out of the gauge.
+func SetTerminalsOnline(online map[string]int) {
+	TerminalsOnline.Reset()
+	for merchant, count := range online {
+		TerminalsOnline.WithLabelValues(merchant).Set(float64(count))
+	}
+}
+
+// SetGatewayThrottled records whether NMI is currently throttling requests
+func SetGatewayThrottled(throttled bool) {
+	if throttled {
+		GatewayThrottled.Set(1)
+	} else {
+		GatewayThrottled.Set(0)
+	}
+}
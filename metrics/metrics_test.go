@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureAmountBuckets(t *testing.T) {
+	assert.Error(t, ConfigureAmountBuckets(nil))
+	assert.Error(t, ConfigureAmountBuckets([]float64{10, 5}))
+
+	require.NoError(t, ConfigureAmountBuckets([]float64{1, 10, 100}))
+	defer ConfigureAmountBuckets(DefaultAmountBuckets)
+
+	RecordTransactionAmount("m1", "sale", 0.5)
+	RecordTransactionAmount("m1", "sale", 42)
+	assert.Equal(t, 1, testutil.CollectAndCount(TransactionAmount))
+}
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// usageBucketSize is the resolution of the usage statistics
+	usageBucketSize = 5 * time.Minute
+	// usageRetention is how far back usage statistics are kept
+	usageRetention = 7 * 24 * time.Hour
+	// usageMaxCallers bounds the callers tracked; the least recently seen
+	// one is forgotten to make room
+	usageMaxCallers = 1000
+)
+
+// AnonymousCaller labels requests that were not authenticated
+const AnonymousCaller = "anonymous"
+
+// UsageWindows are the selectable reporting windows for usage statistics
+var UsageWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// usageBucket aggregates calls for one caller over one bucket interval
+type usageBucket struct {
+	start     time.Time
+	calls     int
+	payments  int
+	approvals int
+	latency   time.Duration
+	errors    map[string]int
+}
+
+// UsageStats summarizes a caller's API usage over a window
+type UsageStats struct {
+	Caller         string         `json:"caller"`
+	Window         string         `json:"window"`
+	Calls          int            `json:"calls"`
+	Payments       int            `json:"payments"`
+	ApprovalRate   float64        `json:"approval_rate"`
+	AverageLatency float64        `json:"average_latency_ms"`
+	Errors         map[string]int `json:"errors"`
+}
+
+// UsageTracker keeps per-caller request statistics in time buckets
+type UsageTracker struct {
+	mu      sync.Mutex
+	buckets map[string][]*usageBucket
+}
+
+// Usage is the process-wide usage tracker fed by the usage middleware
+var Usage = NewUsageTracker()
+
+// NewUsageTracker creates an empty usage tracker
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{buckets: make(map[string][]*usageBucket)}
+}
+
+// Record adds a completed request for an authenticated caller, or
+// AnonymousCaller. Payment submissions count towards the approval rate,
+// and any 4xx/5xx status is counted as an error.
+func (u *UsageTracker) Record(caller, method, route string, statusCode int, latency time.Duration) {
+	now := time.Now()
+	start := now.Truncate(usageBucketSize)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	buckets, known := u.buckets[caller]
+	if !known && len(u.buckets) >= usageMaxCallers {
+		u.evictOldest()
+	}
+	if len(buckets) == 0 || !buckets[len(buckets)-1].start.Equal(start) {
+		buckets = append(pruneBuckets(buckets, now), &usageBucket{start: start, errors: make(map[string]int)})
+	}
+	bucket := buckets[len(buckets)-1]
+	u.buckets[caller] = buckets
+
+	bucket.calls++
+	bucket.latency += latency
+	if isPaymentSubmission(method, route) {
+		bucket.payments++
+		if statusCode < 400 {
+			bucket.approvals++
+		}
+	}
+	if statusCode >= 400 {
+		bucket.errors[http.StatusText(statusCode)]++
+	}
+}
+
+// Stats summarizes every caller's usage over the given window
+func (u *UsageTracker) Stats(window string) []UsageStats {
+	since := time.Now().Add(-UsageWindows[window])
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	stats := []UsageStats{}
+	for caller, buckets := range u.buckets {
+		s := UsageStats{Caller: caller, Window: window, Errors: make(map[string]int)}
+		var approvals int
+		var latency time.Duration
+		for _, b := range buckets {
+			if b.start.Add(usageBucketSize).Before(since) {
+				continue
+			}
+			s.Calls += b.calls
+			s.Payments += b.payments
+			approvals += b.approvals
+			latency += b.latency
+			for errType, count := range b.errors {
+				s.Errors[errType] += count
+			}
+		}
+		if s.Calls == 0 {
+			continue
+		}
+		if s.Payments > 0 {
+			s.ApprovalRate = float64(approvals) / float64(s.Payments)
+		}
+		s.AverageLatency = float64(latency.Milliseconds()) / float64(s.Calls)
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Caller < stats[j].Caller })
+	return stats
+}
+
+// Totals returns the payment submissions and approvals of every caller
+// over the given window
+func (u *UsageTracker) Totals(window time.Duration) (payments, approvals int) {
+	since := time.Now().Add(-window)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, buckets := range u.buckets {
+		for _, b := range buckets {
+			if b.start.Add(usageBucketSize).Before(since) {
+				continue
+			}
+			payments += b.payments
+			approvals += b.approvals
+		}
+	}
+	return payments, approvals
+}
+
+// HandleUsageStats serves usage statistics for the window given in the
+// window query parameter (1h, 24h or 7d; defaults to 24h)
+func HandleUsageStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window := r.URL.Query().Get("window")
+		if window == "" {
+			window = "24h"
+		}
+		if _, ok := UsageWindows[window]; !ok {
+			http.Error(w, "window must be one of 1h, 24h, 7d", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"window": window,
+			"usage":  Usage.Stats(window),
+		})
+	}
+}
+
+// evictOldest forgets the caller seen least recently. u.mu must be held.
+func (u *UsageTracker) evictOldest() {
+	var oldest string
+	var oldestStart time.Time
+	for caller, buckets := range u.buckets {
+		var last time.Time
+		if len(buckets) > 0 {
+			last = buckets[len(buckets)-1].start
+		}
+		if oldest == "" || last.Before(oldestStart) {
+			oldest, oldestStart = caller, last
+		}
+	}
+	delete(u.buckets, oldest)
+}
+
+// pruneBuckets drops buckets older than the retention period
+func pruneBuckets(buckets []*usageBucket, now time.Time) []*usageBucket {
+	cutoff := now.Add(-usageRetention)
+	i := 0
+	for i < len(buckets) && buckets[i].start.Before(cutoff) {
+		i++
+	}
+	return buckets[i:]
+}
+
+// isPaymentSubmission reports whether a request submits a payment operation
+func isPaymentSubmission(method, route string) bool {
+	return method == http.MethodPost && strings.HasPrefix(route, "/payments/")
+}
+
+// MaskAPIKey keeps only the last four characters of a caller's key
+func MaskAPIKey(apiKey string) string {
+	if apiKey == AnonymousCaller || len(apiKey) <= 4 {
+		return apiKey
+	}
+	return strings.Repeat("*", len(apiKey)-4) + apiKey[len(apiKey)-4:]
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageTrackerStats(t *testing.T) {
+	u := NewUsageTracker()
+	u.Record("billing", "POST", "/payments/sale", http.StatusOK, 100*time.Millisecond)
+	u.Record("billing", "POST", "/payments/sale", http.StatusInternalServerError, 300*time.Millisecond)
+	u.Record("billing", "GET", "/payments/lookup", http.StatusOK, 200*time.Millisecond)
+	u.Record(AnonymousCaller, "GET", "/health", http.StatusOK, time.Millisecond)
+
+	stats := u.Stats("1h")
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, AnonymousCaller, stats[0].Caller)
+	assert.Equal(t, 1, stats[0].Calls)
+
+	keyStats := stats[1]
+	assert.Equal(t, "billing", keyStats.Caller)
+	assert.Equal(t, 3, keyStats.Calls)
+	assert.Equal(t, 2, keyStats.Payments)
+	assert.Equal(t, 0.5, keyStats.ApprovalRate)
+	assert.Equal(t, 200.0, keyStats.AverageLatency)
+	assert.Equal(t, map[string]int{"Internal Server Error": 1}, keyStats.Errors)
+}
+
+func TestUsageTrackerCapsCallers(t *testing.T) {
+	u := NewUsageTracker()
+	for i := 0; i < usageMaxCallers; i++ {
+		u.Record(fmt.Sprintf("caller-%d", i), "GET", "/payments/lookup", http.StatusOK, time.Millisecond)
+	}
+	// Make caller-0 the least recently seen
+	u.buckets["caller-0"][0].start = u.buckets["caller-0"][0].start.Add(-time.Hour)
+
+	u.Record("newcomer", "GET", "/payments/lookup", http.StatusOK, time.Millisecond)
+	assert.Len(t, u.buckets, usageMaxCallers)
+	assert.NotContains(t, u.buckets, "caller-0")
+	assert.Contains(t, u.buckets, "newcomer")
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func allowlistRouter(a *IPAllowlist) *mux.Router {
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/admin/routes", ok)
+	r.HandleFunc("/admin/batch/close", ok)
+	r.HandleFunc("/payments/refund", ok)
+	r.HandleFunc("/payments/sale", ok)
+	r.Use(a.Middleware)
+	return r
+}
+
+func allowlistRequest(t *testing.T, handler http.Handler, path, remote, forwarded string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	req.RemoteAddr = remote
+	if forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestIPAllowlistByRouteGroup(t *testing.T) {
+	a := NewIPAllowlist(map[string][]netip.Prefix{
+		GroupAdmin:   {netip.MustParsePrefix("10.0.0.0/8")},
+		GroupRefunds: {netip.MustParsePrefix("192.168.1.5/32")},
+		GroupBatch:   {netip.MustParsePrefix("10.1.0.0/16")},
+	}, nil)
+	r := allowlistRouter(a)
+
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/admin/routes", "10.2.3.4:5000", ""))
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/admin/routes", "203.0.113.9:5000", ""))
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/payments/refund", "192.168.1.5:5000", ""))
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/payments/refund", "10.2.3.4:5000", ""))
+
+	// Batch routes under /admin must pass both the admin and batch lists
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/admin/batch/close", "10.1.0.7:5000", ""))
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/admin/batch/close", "10.2.3.4:5000", ""))
+
+	// Routes outside every group are unaffected
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/payments/sale", "203.0.113.9:5000", ""))
+
+	// IPv4-mapped IPv6 peers match IPv4 networks
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/admin/routes", "[::ffff:10.2.3.4]:5000", ""))
+}
+
+func TestIPAllowlistOpenGroups(t *testing.T) {
+	a := NewIPAllowlist(map[string][]netip.Prefix{
+		GroupAdmin:   {netip.MustParsePrefix("10.0.0.0/8")},
+		GroupRefunds: nil,
+	}, nil)
+	r := allowlistRouter(a)
+
+	assert.True(t, a.Enabled())
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/payments/refund", "203.0.113.9:5000", ""))
+	assert.False(t, NewIPAllowlist(nil, nil).Enabled())
+}
+
+func TestIPAllowlistTrustedProxies(t *testing.T) {
+	a := NewIPAllowlist(map[string][]netip.Prefix{
+		GroupAdmin: {netip.MustParsePrefix("10.0.0.0/8")},
+	}, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")})
+	r := allowlistRouter(a)
+
+	// The client address is taken from X-Forwarded-For behind a trusted proxy
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/admin/routes", "172.16.0.2:443", "10.2.3.4"))
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/admin/routes", "172.16.0.2:443", "203.0.113.9"))
+
+	// A client cannot forge its way in by prepending an allowed address
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/admin/routes", "172.16.0.2:443", "10.2.3.4, 203.0.113.9"))
+
+	// Chained trusted proxies are skipped
+	assert.Equal(t, http.StatusOK, allowlistRequest(t, r, "/admin/routes", "172.16.0.2:443", "10.2.3.4, 172.16.0.9"))
+
+	// The header is ignored from untrusted peers
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/admin/routes", "203.0.113.9:5000", "10.2.3.4"))
+
+	// A trusted proxy that does not say who the client is is refused
+	assert.Equal(t, http.StatusForbidden, allowlistRequest(t, r, "/admin/routes", "172.16.0.2:443", ""))
+}
+
+func TestIPAllowlistViolationIsAudited(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	a := NewIPAllowlist(map[string][]netip.Prefix{
+		GroupRefunds: {netip.MustParsePrefix("10.0.0.0/8")},
+	}, nil)
+	r := allowlistRouter(a)
+	before := testutil.ToFloat64(metrics.AllowlistViolations.WithLabelValues(GroupRefunds))
+
+	req := httptest.NewRequest(http.MethodPost, "/payments/refund", nil)
+	req.RemoteAddr = "203.0.113.9:5000"
+	req = req.WithContext(logctx.WithEntry(req.Context(), logrus.NewEntry(logger)))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, buf.String(), `"msg":"IP allowlist violation"`)
+	assert.Contains(t, buf.String(), `"route_group":"refunds"`)
+	assert.Contains(t, buf.String(), `"client_ip":"203.0.113.9"`)
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.AllowlistViolations.WithLabelValues(GroupRefunds)))
+}
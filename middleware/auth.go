@@ -0,0 +1,369 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Scopes a bearer token must carry to reach each protected route group
+const (
+	ScopePayments = "payments"
+	ScopePlans    = "plans"
+	ScopeTerminal = "terminal"
+	ScopeAudit    = "audit"
+	ScopeVault    = "vault"
+	ScopeAdmin    = "admin"
+	ScopeWebhooks = "webhooks"
+	ScopeEvents   = "events"
+	ScopeReports  = "reports"
+	ScopeCards    = "cards"
+
+	// ScopeAllMerchants guards no route: handlers that act across
+	// merchants check it with HasScope
+	ScopeAllMerchants = "all_merchants"
+)
+
+// protectedRoutes maps route path prefixes to the scope they require
+var protectedRoutes = []struct {
+	prefix string
+	scope  string
+}{
+	{"/payments/", ScopePayments},
+	{"/plans/", ScopePlans},
+	{"/terminal/", ScopeTerminal},
+	{"/audit", ScopeAudit},
+	{"/vault/", ScopeVault},
+	{"/admin/", ScopeAdmin},
+	{"/stats/", ScopeAdmin},
+	{"/reports/fees/import", ScopeAdmin},
+	{"/reports/", ScopeReports},
+	{"/disputes", ScopeReports},
+	{"/transactions", ScopePayments},
+	{"/cards/", ScopeCards},
+	{"/webhooks", ScopeWebhooks},
+	{"/events/", ScopeEvents},
+}
+
+// jwtLeeway absorbs clock skew between the token issuer and this service
+const jwtLeeway = 30 * time.Second
+
+// Authenticator requires callers of the protected routes to present one of
+// the configured API keys in X-API-Key, or an HS256 JWT as
+// "Authorization: Bearer <token>". API keys reach every protected route but
+// the audit log and the admin routes, which only keys named in
+// AUTH_AUDIT_KEYS and AUTH_ADMIN_KEYS may use, and only admin keys hold
+// ScopeAllMerchants; a JWT holds the scopes listed in its "scope" claim.
+type Authenticator struct {
+	// keys maps each API key to the caller name logged for it
+	keys map[string]string
+	// restricted maps the scopes API keys do not hold by default to the
+	// names of the keys granted them
+	restricted map[string]map[string]bool
+	secret     []byte
+	issuer     string
+	audience   string
+	// failures locks out addresses that keep presenting invalid credentials
+	failures *authFailureLimiter
+}
+
+// NewAuthenticator builds an authenticator from the AUTH_* settings
+func NewAuthenticator(cfg *config.Config) *Authenticator {
+	a := &Authenticator{
+		keys: make(map[string]string),
+		restricted: map[string]map[string]bool{
+			ScopeAudit:        make(map[string]bool),
+			ScopeAdmin:        make(map[string]bool),
+			ScopeAllMerchants: make(map[string]bool),
+		},
+		secret:   []byte(cfg.AuthJWTSecret),
+		issuer:   cfg.AuthJWTIssuer,
+		audience: cfg.AuthJWTAudience,
+		failures: newAuthFailureLimiter(cfg.AuthMaxFailures, cfg.AuthLockout, cfg.TrustedProxies),
+	}
+	for _, key := range cfg.AuthAPIKeys {
+		a.keys[key.Key] = key.Name
+	}
+	for _, name := range cfg.AuthAuditKeys {
+		a.restricted[ScopeAudit][name] = true
+	}
+	for _, name := range cfg.AuthAdminKeys {
+		a.restricted[ScopeAdmin][name] = true
+		a.restricted[ScopeAllMerchants][name] = true
+	}
+	return a
+}
+
+// Enabled reports whether any credential is configured. Without one the
+// protected routes stay open.
+func (a *Authenticator) Enabled() bool {
+	return len(a.keys) > 0 || len(a.secret) > 0
+}
+
+// Middleware rejects requests to protected routes without valid credentials
+// with 401, and JWTs lacking the route's scope with 403. A client address
+// that presents AUTH_MAX_FAILURES invalid keys or tokens is refused with 429
+// for AUTH_LOCKOUT, whatever it presents meanwhile.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || !a.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, _ := route.GetPathTemplate()
+		scope := RequiredScope(path)
+		if scope == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client, now := a.failures.client(r), time.Now()
+		if remaining, locked := a.failures.lockedOut(client, now); locked {
+			logctx.From(r.Context()).WithFields(logrus.Fields{
+				"client_ip": client,
+				"scope":     scope,
+			}).Warn("Request rejected while the client is locked out")
+			metrics.RecordAuthFailure(scope, "locked_out")
+			lockedErr := api.NewNMIError(api.ErrRateLimited, "too many failed authentication attempts", "")
+			lockedErr.RetryAfter = int(math.Ceil(remaining.Seconds()))
+			api.WriteError(w, r, lockedErr)
+			return
+		}
+
+		creds, status, reason := a.authenticate(r, scope)
+		if status != 0 {
+			logctx.From(r.Context()).WithFields(logrus.Fields{
+				"reason": reason,
+				"scope":  scope,
+			}).Warn("Request rejected by authentication")
+			metrics.RecordAuthFailure(scope, reason)
+			// Only guesses count towards a lockout: an expired token or a
+			// missing scope comes from a caller that holds real credentials
+			if (reason == "invalid_api_key" || reason == "invalid_token") && a.failures.fail(client, now) {
+				logctx.From(r.Context()).WithFields(logrus.Fields{
+					"audit":     true,
+					"client_ip": client,
+				}).Warn("Client locked out after repeated authentication failures")
+			}
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nmi-payment"`)
+				api.WriteErrorCode(w, r, api.ErrUnauthorized, "missing or invalid credentials")
+			} else {
+				api.WriteErrorCode(w, r, api.ErrForbidden, "credentials lack the "+scope+" scope")
+			}
+			return
+		}
+		a.failures.succeed(client)
+
+		ctx := logctx.WithFields(r.Context(), logrus.Fields{logctx.FieldCaller: creds.caller})
+		ctx = context.WithValue(ctx, scopesKey{}, creds.holds)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type scopesKey struct{}
+
+// HasScope reports whether the credentials a request authenticated with
+// hold scope. It is false when the request was not authenticated, including
+// when authentication is disabled.
+func HasScope(ctx context.Context, scope string) bool {
+	holds, ok := ctx.Value(scopesKey{}).(func(string) bool)
+	return ok && holds(scope)
+}
+
+// credentials are the caller a request authenticated as and the scopes it
+// holds
+type credentials struct {
+	caller string
+	holds  func(scope string) bool
+}
+
+// authenticate checks the request's credentials for scope. It returns
+// them, or the status and metric reason to reject with.
+func (a *Authenticator) authenticate(r *http.Request, scope string) (credentials, int, string) {
+	var creds credentials
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		name, ok := a.lookupKey(key)
+		if !ok {
+			return creds, http.StatusUnauthorized, "invalid_api_key"
+		}
+		creds = credentials{caller: name, holds: func(scope string) bool {
+			granted, ok := a.restricted[scope]
+			return !ok || granted[name]
+		}}
+	} else {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return creds, http.StatusUnauthorized, "missing_credentials"
+		}
+		if len(a.secret) == 0 {
+			return creds, http.StatusUnauthorized, "invalid_token"
+		}
+		claims, err := a.verifyJWT(token, time.Now())
+		if errors.Is(err, errTokenExpired) {
+			return creds, http.StatusUnauthorized, "expired_token"
+		}
+		if err != nil {
+			return creds, http.StatusUnauthorized, "invalid_token"
+		}
+		creds = credentials{caller: claims.Subject, holds: claims.hasScope}
+	}
+
+	if !creds.holds(scope) {
+		return credentials{}, http.StatusForbidden, "insufficient_scope"
+	}
+	return creds, 0, ""
+}
+
+// lookupKey compares key against every configured key in constant time
+func (a *Authenticator) lookupKey(key string) (string, bool) {
+	name, found := "", false
+	for want, wantName := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1 {
+			name, found = wantName, true
+		}
+	}
+	return name, found
+}
+
+// RequiredScope returns the scope a route path template requires when
+// authentication is enabled, or "" for routes left open
+func RequiredScope(path string) string {
+	for _, route := range protectedRoutes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.scope
+		}
+	}
+	return ""
+}
+
+// jwtClaims are the registered claims checked on bearer tokens, plus the
+// OAuth-style space-separated scope list
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+}
+
+func (c *jwtClaims) hasScope(scope string) bool {
+	for _, granted := range strings.Fields(c.Scope) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// audience is the "aud" claim, which may be a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+	errTokenClaims    = errors.New("token claims rejected")
+)
+
+// verifyJWT checks an HS256 token's signature and its exp, nbf, iss and
+// aud claims. Tokens must carry an expiry.
+func (a *Authenticator) verifyJWT(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	// Only HS256 is accepted; trusting the header's alg would let a caller
+	// pick "none"
+	if header.Alg != "HS256" {
+		return nil, errTokenSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errTokenSignature
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errTokenMalformed
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errTokenClaims
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errTokenClaims
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, errTokenClaims
+	}
+	if a.audience != "" && !containsString(claims.Audience, a.audience) {
+		return nil, errTokenClaims
+	}
+	return &claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func containsString(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
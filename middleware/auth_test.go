@@ -0,0 +1,303 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func signJWT(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authRouter serves the protected and open routes, echoing the caller the
+// authenticator attached to the log context
+func authRouter(a *Authenticator) *mux.Router {
+	r := mux.NewRouter()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := logctx.From(r.Context()).Data[logctx.FieldCaller].(string)
+		w.Write([]byte(caller))
+	}
+	r.HandleFunc("/payments/sale", echo)
+	r.HandleFunc("/plans/list", echo)
+	r.HandleFunc("/terminal/status/{terminal_id}", echo)
+	r.HandleFunc("/audit", echo)
+	r.HandleFunc("/vault/customers/{id}", echo)
+	r.HandleFunc("/admin/batch/close", echo)
+	r.HandleFunc("/stats/usage", echo)
+	r.HandleFunc("/reports/fees/import", echo)
+	r.HandleFunc("/webhooks", echo)
+	r.HandleFunc("/events/export", echo)
+	r.HandleFunc("/health", echo)
+	r.Use(a.Middleware)
+	return r
+}
+
+func authRequest(handler http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthenticatorAPIKeys(t *testing.T) {
+	r := authRouter(NewAuthenticator(&config.Config{
+		AuthAPIKeys: []config.APIKey{{Name: "billing", Key: "k-billing"}},
+	}))
+
+	rec := authRequest(r, "/payments/sale", http.Header{"X-Api-Key": {"k-billing"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "billing", rec.Body.String())
+	assert.Equal(t, http.StatusOK, authRequest(r, "/terminal/status/T1", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+
+	before := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues(ScopePayments, "invalid_api_key"))
+	rec = authRequest(r, "/payments/sale", http.Header{"X-Api-Key": {"wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"code":"unauthorized","message":"missing or invalid credentials"}`, rec.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.AuthFailures.WithLabelValues(ScopePayments, "invalid_api_key")))
+
+	assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/plans/list", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/vault/customers/C1", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/webhooks", nil).Code)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/webhooks", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/events/export", nil).Code)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/events/export", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+	// Routes outside the protected groups stay open
+	assert.Equal(t, http.StatusOK, authRequest(r, "/health", nil).Code)
+}
+
+func TestAuthenticatorAuditScope(t *testing.T) {
+	r := authRouter(NewAuthenticator(&config.Config{
+		AuthAPIKeys: []config.APIKey{
+			{Name: "billing", Key: "k-billing"},
+			{Name: "compliance", Key: "k-compliance"},
+		},
+		AuthAuditKeys: []string{"compliance"},
+		AuthJWTSecret: testJWTSecret,
+	}))
+
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/audit", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+	rec := authRequest(r, "/audit", http.Header{"X-Api-Key": {"k-compliance"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "compliance", rec.Body.String())
+	// Audit keys still reach the other routes
+	assert.Equal(t, http.StatusOK, authRequest(r, "/payments/sale", http.Header{"X-Api-Key": {"k-compliance"}}).Code)
+
+	token := func(scope string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + signJWT(t, testJWTSecret, map[string]interface{}{
+			"sub":   "auditor",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": scope,
+		})}}
+	}
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/audit", token("payments plans")).Code)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/audit", token("audit")).Code)
+}
+
+func TestAuthenticatorAdminScope(t *testing.T) {
+	r := authRouter(NewAuthenticator(&config.Config{
+		AuthAPIKeys: []config.APIKey{
+			{Name: "billing", Key: "k-billing"},
+			{Name: "ops", Key: "k-ops"},
+		},
+		AuthAdminKeys: []string{"ops"},
+		AuthJWTSecret: testJWTSecret,
+	}))
+
+	assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/admin/batch/close", nil).Code)
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/admin/batch/close", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/admin/batch/close", http.Header{"X-Api-Key": {"k-ops"}}).Code)
+	// Usage statistics name every caller, so they are admin-only too
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/stats/usage", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/stats/usage", http.Header{"X-Api-Key": {"k-ops"}}).Code)
+	// Importing fees rewrites every merchant's ledger
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/reports/fees/import", http.Header{"X-Api-Key": {"k-billing"}}).Code)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/reports/fees/import", http.Header{"X-Api-Key": {"k-ops"}}).Code)
+	// Admin keys are not auditors
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/audit", http.Header{"X-Api-Key": {"k-ops"}}).Code)
+
+	token := signJWT(t, testJWTSecret, map[string]interface{}{
+		"sub":   "ops-console",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "admin",
+	})
+	assert.Equal(t, http.StatusOK, authRequest(r, "/admin/batch/close", http.Header{"Authorization": {"Bearer " + token}}).Code)
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/vault/customers/C1", http.Header{"Authorization": {"Bearer " + token}}).Code)
+}
+
+func TestAuthenticatorJWT(t *testing.T) {
+	r := authRouter(NewAuthenticator(&config.Config{
+		AuthJWTSecret:   testJWTSecret,
+		AuthJWTIssuer:   "https://auth.example.com",
+		AuthJWTAudience: "nmi-payment",
+	}))
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "checkout-service",
+			"iss":   "https://auth.example.com",
+			"aud":   []string{"nmi-payment"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "payments plans",
+		}
+		for key, value := range overrides {
+			c[key] = value
+		}
+		return c
+	}
+
+	rec := authRequest(r, "/payments/sale", bearer(signJWT(t, testJWTSecret, claims(nil))))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "checkout-service", rec.Body.String())
+	assert.Equal(t, http.StatusOK, authRequest(r, "/plans/list", bearer(signJWT(t, testJWTSecret, claims(nil)))).Code)
+
+	// A valid token without the route's scope is forbidden, not unauthorized
+	assert.Equal(t, http.StatusForbidden, authRequest(r, "/terminal/status/T1", bearer(signJWT(t, testJWTSecret, claims(nil)))).Code)
+
+	tests := map[string]string{
+		"wrong secret": signJWT(t, "another-secret-another-secret-000", claims(nil)),
+		"expired":      signJWT(t, testJWTSecret, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"no expiry":    signJWT(t, testJWTSecret, claims(map[string]interface{}{"exp": 0})),
+		"not yet":      signJWT(t, testJWTSecret, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"wrong issuer": signJWT(t, testJWTSecret, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"wrong aud":    signJWT(t, testJWTSecret, claims(map[string]interface{}{"aud": "other"})),
+		"alg none":     base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + ".e30.",
+		"garbage":      "not-a-token",
+	}
+	for name, token := range tests {
+		assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/payments/sale", bearer(token)).Code, name)
+	}
+}
+
+func TestAuthenticatorLocksOutRepeatedFailures(t *testing.T) {
+	r := authRouter(NewAuthenticator(&config.Config{
+		AuthAPIKeys:     []config.APIKey{{Name: "billing", Key: "k-billing"}},
+		AuthJWTSecret:   testJWTSecret,
+		AuthMaxFailures: 3,
+		AuthLockout:     time.Minute,
+	}))
+	good := http.Header{"X-Api-Key": {"k-billing"}}
+	bad := http.Header{"X-Api-Key": {"wrong"}}
+
+	// Authenticating clears earlier failures
+	authRequest(r, "/payments/sale", bad)
+	authRequest(r, "/payments/sale", bad)
+	assert.Equal(t, http.StatusOK, authRequest(r, "/payments/sale", good).Code)
+	// Expired tokens and missing credentials are not guesses
+	expired := signJWT(t, testJWTSecret, map[string]interface{}{"sub": "dashboard", "exp": time.Now().Add(-time.Hour).Unix(), "scope": "payments"})
+	for i := 0; i < 3; i++ {
+		authRequest(r, "/payments/sale", http.Header{"Authorization": {"Bearer " + expired}})
+		authRequest(r, "/payments/sale", nil)
+	}
+	assert.Equal(t, http.StatusOK, authRequest(r, "/payments/sale", good).Code)
+
+	authRequest(r, "/payments/sale", bad)
+	authRequest(r, "/payments/sale", http.Header{"Authorization": {"Bearer not-a-token"}})
+	assert.Equal(t, http.StatusUnauthorized, authRequest(r, "/payments/sale", bad).Code)
+
+	before := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues(ScopePayments, "locked_out"))
+	rec := authRequest(r, "/payments/sale", good)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"code":"rate_limited","message":"too many failed authentication attempts","retry_after":60}`, rec.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.AuthFailures.WithLabelValues(ScopePayments, "locked_out")))
+	// Open routes and other addresses are unaffected
+	assert.Equal(t, http.StatusOK, authRequest(r, "/health", nil).Code)
+	req := httptest.NewRequest(http.MethodGet, "/payments/sale", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	req.Header.Set("X-Api-Key", "k-billing")
+	other := httptest.NewRecorder()
+	r.ServeHTTP(other, req)
+	assert.Equal(t, http.StatusOK, other.Code)
+}
+
+func TestAuthFailureLimiterWindow(t *testing.T) {
+	l := newAuthFailureLimiter(2, time.Minute, nil)
+	start := time.Now()
+
+	assert.False(t, l.fail("192.0.2.1", start))
+	// A failure after the window has passed starts a new one
+	assert.False(t, l.fail("192.0.2.1", start.Add(time.Minute)))
+	assert.True(t, l.fail("192.0.2.1", start.Add(90*time.Second)))
+
+	remaining, locked := l.lockedOut("192.0.2.1", start.Add(2*time.Minute))
+	assert.True(t, locked)
+	assert.Equal(t, 30*time.Second, remaining)
+	_, locked = l.lockedOut("192.0.2.1", start.Add(150*time.Second))
+	assert.False(t, locked)
+
+	for i := 0; i < authMaxTrackedClients+10; i++ {
+		l.fail(fmt.Sprintf("client-%d", i), start)
+	}
+	assert.LessOrEqual(t, len(l.clients), authMaxTrackedClients)
+}
+
+func TestAuthenticatorDisabled(t *testing.T) {
+	a := NewAuthenticator(&config.Config{})
+	assert.False(t, a.Enabled())
+	assert.Equal(t, http.StatusOK, authRequest(authRouter(a), "/payments/sale", nil).Code)
+}
+
+func TestAuthenticatorHasScope(t *testing.T) {
+	a := NewAuthenticator(&config.Config{
+		AuthAPIKeys: []config.APIKey{
+			{Name: "billing", Key: "k-billing"},
+			{Name: "ops", Key: "k-ops"},
+		},
+		AuthAdminKeys: []string{"ops"},
+		AuthJWTSecret: testJWTSecret,
+	})
+	r := mux.NewRouter()
+	r.HandleFunc("/events/stream", func(w http.ResponseWriter, r *http.Request) {
+		if HasScope(r.Context(), ScopeAllMerchants) {
+			w.Write([]byte(ScopeAllMerchants))
+		}
+	})
+	r.Use(a.Middleware)
+
+	assert.Empty(t, authRequest(r, "/events/stream", http.Header{"X-Api-Key": {"k-billing"}}).Body.String())
+	// Admin keys may act across merchants
+	assert.Equal(t, ScopeAllMerchants, authRequest(r, "/events/stream", http.Header{"X-Api-Key": {"k-ops"}}).Body.String())
+
+	token := func(scope string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + signJWT(t, testJWTSecret, map[string]interface{}{
+			"sub":   "dashboard",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": scope,
+		})}}
+	}
+	assert.Empty(t, authRequest(r, "/events/stream", token("events admin")).Body.String())
+	assert.Equal(t, ScopeAllMerchants, authRequest(r, "/events/stream", token("events all_merchants")).Body.String())
+	assert.False(t, HasScope(httptest.NewRequest(http.MethodGet, "/", nil).Context(), ScopeEvents))
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultHandlerTimeout bounds each request. It stays below the server write
+// timeout so a timeout response can still be written.
+const DefaultHandlerTimeout = 25 * time.Second
+
+// Stack is the service's middleware, assembled from configuration by Chain
+type Stack struct {
+	// RateLimit describes the enforced limit, e.g. "100/min per instance"
+	RateLimit string
+
+	security    *SecurityMiddleware
+	shedder     *LoadShedder
+	allowlist   *IPAllowlist
+	auth        *Authenticator
+	signatures  *RequestVerifier
+	redactor    *ResponseRedactor
+	merchants   *MerchantResolver
+	concurrency *ConcurrencyLimiter
+	timeout     time.Duration
+	cors        bool
+
+	// grpcTokens are the bearer tokens accepted on gRPC calls, with the
+	// caller each one names
+	grpcTokens []config.APIKey
+}
+
+// Chain assembles the middleware stack the service runs with, so embedders
+// and tests get the same tracing, rate limiting, timeouts, panic recovery,
+// metrics, usage tracking, log context, load shedding, IP allowlists,
+// authentication, request signatures, response redaction, merchant routing,
+// route concurrency limits, request IDs, request logging and CORS as the
+// binary. The same stack supplies the gRPC interceptors.
+func Chain(cfg *config.Config) *Stack {
+	perMinute := cfg.RateLimitPerMinute
+	if perMinute <= 0 {
+		perMinute = config.DefaultRateLimitPerMinute
+	}
+
+	stack := &Stack{
+		RateLimit: fmt.Sprintf("%d/min per instance", perMinute),
+		security:  NewSecurityMiddleware(float64(perMinute)),
+		shedder:   NewLoadShedder(cfg),
+		allowlist: NewIPAllowlist(map[string][]netip.Prefix{
+			GroupAdmin:   cfg.AdminIPAllowlist,
+			GroupRefunds: cfg.RefundIPAllowlist,
+			GroupBatch:   cfg.BatchIPAllowlist,
+		}, cfg.TrustedProxies),
+		auth:        NewAuthenticator(cfg),
+		signatures:  NewRequestVerifier(cfg),
+		redactor:    NewResponseRedactor(cfg.ResponseRedactions),
+		merchants:   NewMerchantResolver(cfg),
+		concurrency: NewConcurrencyLimiter(cfg.RouteConcurrency),
+		timeout:     DefaultHandlerTimeout,
+		cors:        cfg.CORSEnabled,
+		grpcTokens:  cfg.GRPCAuthTokens,
+	}
+
+	if cfg.RateLimitStore == config.StoreRedis {
+		if opts, err := redis.ParseURL(cfg.RedisURL); err != nil {
+			metrics.LogError(context.Background(), fmt.Errorf("invalid REDIS_URL, rate limiting per process: %v", err))
+		} else {
+			stack.security = NewSharedSecurityMiddleware(float64(perMinute), redis.NewClient(opts))
+			stack.RateLimit = fmt.Sprintf("%d/min shared", perMinute)
+		}
+	}
+
+	return stack
+}
+
+// SetRateLimit changes the API-wide rate limit without rebuilding the stack.
+// RateLimit keeps describing the limit the stack started with.
+func (s *Stack) SetRateLimit(perMinute int) {
+	if perMinute <= 0 {
+		perMinute = config.DefaultRateLimitPerMinute
+	}
+	s.security.SetLimit(float64(perMinute))
+}
+
+// AuthEnabled reports whether the protected routes require credentials
+func (s *Stack) AuthEnabled() bool {
+	return s.auth.Enabled()
+}
+
+// Handler installs the per-route middleware on r and wraps r in the
+// middleware that must also see unmatched requests and CORS preflights.
+// Call it once per router.
+func (s *Stack) Handler(r *mux.Router) http.Handler {
+	r.Use(
+		TracingMiddleware,
+		s.security.RateLimiter,
+		TimeoutMiddleware(s.timeout),
+		RecoveryMiddleware,
+		MetricsMiddleware,
+		LogContextMiddleware,
+		s.shedder.Middleware,
+		s.allowlist.Middleware,
+		s.auth.Middleware,
+		UsageMiddleware,
+		s.signatures.Middleware,
+		s.redactor.Middleware,
+		s.merchants.Middleware,
+		s.concurrency.Middleware,
+	)
+
+	var handler http.Handler = r
+	if s.cors {
+		handler = CORSMiddleware(handler)
+	}
+	return RequestIDMiddleware(LoggingMiddleware(handler))
+}
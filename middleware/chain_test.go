@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/requestid"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainMatchesProductionStack(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") }).Methods("GET")
+
+	stack := Chain(&config.Config{RateLimitPerMinute: 60, CORSEnabled: true, RateLimitStore: config.StoreMemory})
+	assert.Equal(t, "60/min per instance", stack.RateLimit)
+	handler := stack.Handler(r)
+
+	// CORS preflights are answered before route matching
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/ok", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// A panicking handler becomes a 500 instead of crashing the server
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Len(t, rec.Header().Get("X-Request-ID"), 36, "every response carries a request ID")
+
+	// The limiter allows a burst of one, so an immediate second request is rejected
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ok", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestid.From(r.Context())
+	}))
+
+	// A caller's own ID is kept
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "checkout-8812")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "checkout-8812", seen)
+	assert.Equal(t, "checkout-8812", rec.Header().Get("X-Request-ID"))
+
+	// One unsafe to log is replaced
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "forged\nline")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.True(t, requestid.Valid(seen))
+	assert.NotEqual(t, "forged\nline", seen)
+	assert.Equal(t, seen, rec.Header().Get("X-Request-ID"))
+}
+
+func TestTimeoutMiddlewareSkipsStreams(t *testing.T) {
+	deadline := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); ok {
+			w.Write([]byte("deadline"))
+		}
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/events/stream", deadline)
+	r.HandleFunc("/events/export", deadline)
+	r.Use(TimeoutMiddleware(time.Minute))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events/export", nil))
+	assert.Equal(t, "deadline", rec.Body.String())
+
+	// Streams run until the client disconnects
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events/stream", nil))
+	assert.Empty(t, rec.Body.String())
+}
+
+func TestUsageRecordsAuthenticatedCaller(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/payments/lookup", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	handler := Chain(&config.Config{
+		RateLimitPerMinute: 6000,
+		RateLimitStore:     config.StoreMemory,
+		AuthAPIKeys:        []config.APIKey{{Name: "usage-billing", Key: "k-usage-billing"}},
+	}).Handler(r)
+
+	for _, key := range []string{"k-usage-billing", "random-usage-key"} {
+		req := httptest.NewRequest(http.MethodGet, "/payments/lookup", nil)
+		req.Header.Set("X-API-Key", key)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	callers := map[string]bool{}
+	for _, stats := range metrics.Usage.Stats("1h") {
+		callers[stats.Caller] = true
+	}
+	assert.True(t, callers["usage-billing"])
+	// Rejected credentials are not callers
+	assert.False(t, callers["random-usage-key"])
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// concurrencyRetryAfter is the Retry-After, in seconds, sent with a shed
+// request. Slots free up as soon as a request finishes, so retrying soon is
+// reasonable.
+const concurrencyRetryAfter = 1
+
+// routeLimit bounds the requests in flight on the routes under one prefix
+type routeLimit struct {
+	prefix   string
+	slots    chan struct{}
+	maxQueue int
+
+	mu     sync.Mutex
+	queued int
+}
+
+// ConcurrencyLimiter sheds requests to a limited route once its slots are
+// taken and its queue is full, so a burst of heavy requests on one route
+// cannot starve the others
+type ConcurrencyLimiter struct {
+	// limits is ordered by descending prefix length so the most specific
+	// prefix wins
+	limits []*routeLimit
+}
+
+// NewConcurrencyLimiter builds a limiter enforcing limits
+func NewConcurrencyLimiter(limits []config.RouteLimit) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{}
+	for _, limit := range limits {
+		l.limits = append(l.limits, &routeLimit{
+			prefix:   limit.Prefix,
+			slots:    make(chan struct{}, limit.MaxConcurrent),
+			maxQueue: limit.MaxQueue,
+		})
+	}
+	sort.SliceStable(l.limits, func(i, j int) bool {
+		return len(l.limits[i].prefix) > len(l.limits[j].prefix)
+	})
+	return l
+}
+
+// limitFor returns the limit covering a route path template, or nil
+func (l *ConcurrencyLimiter) limitFor(path string) *routeLimit {
+	for _, limit := range l.limits {
+		if strings.HasPrefix(path, limit.prefix) {
+			return limit
+		}
+	}
+	return nil
+}
+
+// Middleware holds a slot of the matched route's limit for the duration of
+// the request. Without a free slot the request waits in the queue until one
+// frees up or its context ends; with the queue full it is rejected at once.
+// Rejections are 503 with Retry-After.
+func (l *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || len(l.limits) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, _ := route.GetPathTemplate()
+		limit := l.limitFor(path)
+		if limit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reason := limit.acquire(r); reason != "" {
+			logctx.From(r.Context()).WithFields(logrus.Fields{
+				"route_limit": limit.prefix,
+				"reason":      reason,
+			}).Warn("Request shed by route concurrency limit")
+			metrics.RecordRouteRejection(limit.prefix, reason)
+			w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+			http.Error(w, "Service busy, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+		defer limit.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes a slot, queueing if allowed. It returns the rejection
+// reason, or "" once the slot is held.
+func (rl *routeLimit) acquire(r *http.Request) string {
+	select {
+	case rl.slots <- struct{}{}:
+		rl.report()
+		return ""
+	default:
+	}
+
+	rl.mu.Lock()
+	if rl.queued >= rl.maxQueue {
+		rl.mu.Unlock()
+		return "queue_full"
+	}
+	rl.queued++
+	rl.mu.Unlock()
+	rl.report()
+
+	defer func() {
+		rl.mu.Lock()
+		rl.queued--
+		rl.mu.Unlock()
+		rl.report()
+	}()
+
+	select {
+	case rl.slots <- struct{}{}:
+		return ""
+	case <-r.Context().Done():
+		return "queue_timeout"
+	}
+}
+
+func (rl *routeLimit) release() {
+	<-rl.slots
+	rl.report()
+}
+
+// report publishes the saturation gauges
+func (rl *routeLimit) report() {
+	rl.mu.Lock()
+	queued := rl.queued
+	rl.mu.Unlock()
+	metrics.RecordRouteSaturation(rl.prefix, len(rl.slots), queued)
+}
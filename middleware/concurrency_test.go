@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}
+
+	limiter := NewConcurrencyLimiter([]config.RouteLimit{
+		{Prefix: "/admin/", MaxConcurrent: 5},
+		{Prefix: "/admin/vault/export", MaxConcurrent: 1, MaxQueue: 1},
+	})
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/vault/export", slow)
+	r.HandleFunc("/payments/sale", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(limiter.Middleware)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// The first export holds the only slot and the second waits in the queue
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serve("/admin/vault/export").Code
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+	require.Eventually(t, func() bool {
+		limit := limiter.limitFor("/admin/vault/export")
+		limit.mu.Lock()
+		defer limit.mu.Unlock()
+		return limit.queued == 1
+	}, time.Second, time.Millisecond)
+
+	// A third is shed at once, while unlimited routes are unaffected
+	rec := serve("/admin/vault/export")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve("/payments/sale").Code)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	limiter := NewConcurrencyLimiter([]config.RouteLimit{{Prefix: "/reports/", MaxConcurrent: 1, MaxQueue: 5}})
+	r := mux.NewRouter()
+	r.HandleFunc("/reports/fees", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	r.Use(limiter.Middleware)
+
+	go r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/reports/fees", nil))
+	<-started
+
+	// A queued request gives up when its deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/fees", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
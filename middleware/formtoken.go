@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+)
+
+// FormTokenHeader carries the one-time token on browser submissions
+const FormTokenHeader = "X-Form-Token"
+
+// formTokenTTL is how long a minted token stays valid
+const formTokenTTL = 30 * time.Minute
+
+// FormTokens mints one-time tokens that browser clients must present when
+// submitting a payment, so a back-button resubmit cannot charge twice
+type FormTokens struct {
+	mu     sync.Mutex
+	tokens map[string]formToken
+}
+
+type formToken struct {
+	expires time.Time
+	used    bool
+}
+
+// NewFormTokens creates an empty token store
+func NewFormTokens() *FormTokens {
+	return &FormTokens{tokens: make(map[string]formToken)}
+}
+
+// Mint issues a new token
+func (f *FormTokens) Mint() (string, time.Time, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(formTokenTTL)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune()
+	f.tokens[token] = formToken{expires: expires}
+
+	return token, expires, nil
+}
+
+// consume marks a token used, returning the status to reject with when it
+// cannot be used
+func (f *FormTokens) consume(token string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, exists := f.tokens[token]
+	switch {
+	case !exists || time.Now().After(t.expires):
+		return http.StatusForbidden
+	case t.used:
+		return http.StatusConflict
+	}
+
+	t.used = true
+	f.tokens[token] = t
+	return http.StatusOK
+}
+
+// prune drops expired tokens; used tokens are kept until expiry so a replay
+// is reported as a duplicate rather than an unknown token
+func (f *FormTokens) prune() {
+	now := time.Now()
+	for token, t := range f.tokens {
+		if now.After(t.expires) {
+			delete(f.tokens, token)
+		}
+	}
+}
+
+// HandleMint serves a fresh token for a payment form
+func (f *FormTokens) HandleMint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, expires, err := f.Mint()
+		if err != nil {
+			http.Error(w, "Failed to create form token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"form_token": token,
+			"expires_at": expires,
+		})
+	}
+}
+
+// Require rejects browser-origin submissions without a valid, unused form
+// token. Server-to-server callers are unaffected.
+func (f *FormTokens) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isBrowserRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(FormTokenHeader)
+		if token == "" {
+			http.Error(w, "Form token required", http.StatusForbidden)
+			metrics.RecordErrorMetrics("form_token", "missing")
+			return
+		}
+
+		switch f.consume(token) {
+		case http.StatusForbidden:
+			http.Error(w, "Invalid or expired form token", http.StatusForbidden)
+			metrics.RecordErrorMetrics("form_token", "invalid")
+			return
+		case http.StatusConflict:
+			http.Error(w, "Form already submitted", http.StatusConflict)
+			metrics.RecordErrorMetrics("form_token", "reused")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBrowserRequest reports whether the request came from a browser, which
+// sends Origin or Fetch Metadata headers that other clients do not
+func isBrowserRequest(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Mode") != ""
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormTokensRequire(t *testing.T) {
+	tokens := NewFormTokens()
+	handler := tokens.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	submit := func(origin, token string) int {
+		req := httptest.NewRequest("POST", "/payments/sale", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if token != "" {
+			req.Header.Set(FormTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Server-to-server callers do not need a token
+	assert.Equal(t, http.StatusOK, submit("", ""))
+
+	assert.Equal(t, http.StatusForbidden, submit("https://shop.example.com", ""))
+	assert.Equal(t, http.StatusForbidden, submit("https://shop.example.com", "unknown"))
+
+	token, _, err := tokens.Mint()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, submit("https://shop.example.com", token))
+	assert.Equal(t, http.StatusConflict, submit("https://shop.example.com", token))
+}
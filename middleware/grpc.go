@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/requestid"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryInterceptors gives gRPC calls the treatment REST routes get from
+// Handler: panic recovery, metrics, log context, rate limiting and the
+// handler timeout, plus bearer token authentication and merchant routing.
+// Install them with grpc.ChainUnaryInterceptor.
+func (s *Stack) UnaryInterceptors() []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{
+		recoveryInterceptor,
+		metricsInterceptor,
+		logContextInterceptor,
+		s.rateLimitInterceptor,
+		s.authInterceptor,
+		s.merchants.UnaryInterceptor,
+		s.timeoutInterceptor,
+	}
+}
+
+// recoveryInterceptor turns a handler panic into an Internal error
+func recoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logctx.From(ctx).WithFields(logrus.Fields{
+				"panic": fmt.Sprint(p),
+				"stack": string(debug.Stack()),
+			}).Error("gRPC handler panicked")
+			metrics.RecordErrorMetrics("panic", "handler_panic")
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// metricsInterceptor records each call by method and status code
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	metrics.IncrementRequestsInFlight()
+	defer metrics.DecrementRequestsInFlight()
+
+	resp, err := handler(ctx, req)
+	metrics.RecordGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start).Seconds())
+	return resp, err
+}
+
+// logContextInterceptor tags the call's log entry with its request ID and
+// method. The request ID comes from x-request-id metadata when the caller
+// sends a usable one.
+func logContextInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := firstMetadata(ctx, "x-request-id")
+	if !requestid.Valid(requestID) {
+		requestID = requestid.New()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+
+	ctx = requestid.With(ctx, requestID)
+	ctx = logctx.WithFields(ctx, logrus.Fields{
+		logctx.FieldRequestID: requestID,
+		logctx.FieldRoute:     info.FullMethod,
+	})
+	return handler(ctx, req)
+}
+
+// rateLimitInterceptor applies the same limit as the REST API, so the two
+// surfaces share one budget
+func (s *Stack) rateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !s.security.allow(ctx) {
+		metrics.RecordErrorMetrics("rate_limit", "too_many_requests")
+		return nil, status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	return handler(ctx, req)
+}
+
+// authInterceptor requires "authorization: Bearer <token>" metadata naming
+// one of the configured gRPC tokens, and logs the token's name as the caller
+func (s *Stack) authInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	token, ok := strings.CutPrefix(firstMetadata(ctx, "authorization"), "Bearer ")
+	caller, valid := s.grpcCaller(token)
+	if !ok || !valid {
+		logctx.From(ctx).Warn("gRPC call rejected: missing or invalid token")
+		metrics.RecordErrorMetrics("auth", "invalid_token")
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+	ctx = logctx.WithFields(ctx, logrus.Fields{logctx.FieldCaller: caller})
+	return handler(ctx, req)
+}
+
+// grpcCaller returns the name of the gRPC token matching token. Every token
+// is compared, so the time taken does not reveal which one matched.
+func (s *Stack) grpcCaller(token string) (string, bool) {
+	caller, valid := "", false
+	for _, want := range s.grpcTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want.Key)) == 1 {
+			caller, valid = want.Name, true
+		}
+	}
+	return caller, token != "" && valid
+}
+
+// timeoutInterceptor caps the call at the handler timeout; a shorter
+// deadline set by the caller still wins
+func (s *Stack) timeoutInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return handler(ctx, req)
+}
+
+// firstMetadata returns the first value of an incoming metadata key
+func firstMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// callThrough runs handler behind the stack's interceptors, chained in order
+func callThrough(s *Stack, ctx context.Context, handler grpc.UnaryHandler) (interface{}, error) {
+	interceptors := s.UnaryInterceptors()
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Call"}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler(ctx, nil)
+}
+
+func TestUnaryInterceptors(t *testing.T) {
+	stack := Chain(&config.Config{RateLimitPerMinute: 1 << 30, GRPCAuthTokens: []config.APIKey{{Name: "a", Key: "one"}, {Name: "b", Key: "two"}}})
+	stack.timeout = 50 * time.Millisecond
+	authed := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer two"))
+
+	// Any configured token is accepted
+	resp, err := callThrough(stack, authed, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+
+	_, err = callThrough(stack, context.Background(), func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("handler called without a token")
+		return nil, nil
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// The handler timeout applies
+	_, err = callThrough(stack, authed, func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// A panic becomes Internal instead of crashing the server
+	_, err = callThrough(stack, authed, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestUnaryInterceptorsMerchantBinding(t *testing.T) {
+	stack := Chain(&config.Config{
+		RateLimitPerMinute: 1 << 30,
+		GRPCAuthTokens:     []config.APIKey{{Name: "storefront", Key: "one"}, {Name: "ops", Key: "two"}},
+		Merchants:          []config.Merchant{{ID: "m1", APIKey: "k1", Callers: []string{"storefront"}}, {ID: "m2", APIKey: "k2"}},
+	})
+	call := func(token, merchant string) (string, error) {
+		md := metadata.Pairs("authorization", "Bearer "+token)
+		if merchant != "" {
+			md.Append("x-merchant-id", merchant)
+		}
+		resp, err := callThrough(stack, metadata.NewIncomingContext(context.Background(), md), func(ctx context.Context, req interface{}) (interface{}, error) {
+			m, _ := api.MerchantFromContext(ctx)
+			return m.ID, nil
+		})
+		id, _ := resp.(string)
+		return id, err
+	}
+
+	// A bound token always acts for its merchant
+	id, err := call("one", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "m1", id)
+	_, err = call("one", "m2")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Other tokens pick one
+	id, err = call("two", "m2")
+	assert.NoError(t, err)
+	assert.Equal(t, "m2", id)
+	_, err = call("two", "nope")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUnaryInterceptorsRateLimit(t *testing.T) {
+	stack := Chain(&config.Config{RateLimitPerMinute: 1, GRPCAuthTokens: []config.APIKey{{Name: "a", Key: "one"}}})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer one"))
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	_, err := callThrough(stack, ctx, ok)
+	assert.NoError(t, err)
+	_, err = callThrough(stack, ctx, ok)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
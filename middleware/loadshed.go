@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// latencyWindow is how far back payment latencies count toward the P99
+	latencyWindow = 10 * time.Second
+	// latencySamples bounds the latencies kept for the P99
+	latencySamples = 1024
+	// minLatencySamples is the fewest latencies in the window that can
+	// switch shedding on, so a handful of slow requests on a quiet
+	// instance do not
+	minLatencySamples = 20
+	// latencyRecompute is how often the P99 is recomputed
+	latencyRecompute = 500 * time.Millisecond
+	// latencyRecovery is the fraction of the target the P99 must fall
+	// below before shedding stops, so it does not flap around the target
+	latencyRecovery = 0.8
+
+	// loadShedRetryAfter is the Retry-After, in seconds, sent with a shed
+	// request. Load takes longer to drain than a route slot, so callers
+	// are asked to wait a little longer than for route limits.
+	loadShedRetryAfter = 2
+)
+
+// criticalPrefixes are the payment-path routes whose latency load shedding
+// protects. Sheddable routes under them are excluded.
+var criticalPrefixes = []string{"/payments/", "/terminal/"}
+
+// latencySample is a payment request's duration and when it finished
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// LoadShedder turns away non-critical requests while the service is
+// overloaded, so lookups and reports give way to live sales instead of
+// every route slowing down together. It is overloaded while more requests
+// than the limit are in flight, or while the P99 latency of payment-path
+// requests is above the target.
+type LoadShedder struct {
+	maxInFlight int64
+	target      time.Duration
+	routes      []string
+
+	inFlight int64
+
+	mu       sync.Mutex
+	samples  []latencySample
+	next     int
+	computed time.Time
+	p99      time.Duration
+	shedding bool
+}
+
+// NewLoadShedder builds a shedder from the LOAD_SHED_* settings
+func NewLoadShedder(cfg *config.Config) *LoadShedder {
+	return &LoadShedder{
+		maxInFlight: int64(cfg.LoadShedMaxInFlight),
+		target:      cfg.LoadShedP99Target,
+		routes:      cfg.LoadShedRoutes,
+		samples:     make([]latencySample, 0, latencySamples),
+	}
+}
+
+// Enabled reports whether either overload signal is configured
+func (l *LoadShedder) Enabled() bool {
+	return l.maxInFlight > 0 || l.target > 0
+}
+
+// Middleware rejects requests to sheddable routes with 503 and Retry-After
+// while the service is overloaded, and tracks the load of everything else
+func (l *LoadShedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || !l.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, _ := route.GetPathTemplate()
+
+		sheddable := l.sheddable(path)
+		if sheddable {
+			if reason := l.overloaded(time.Now()); reason != "" {
+				logctx.From(r.Context()).WithFields(logrus.Fields{
+					"reason":    reason,
+					"in_flight": atomic.LoadInt64(&l.inFlight),
+				}).Warn("Request shed under load")
+				metrics.RecordLoadShed(path, reason)
+				w.Header().Set("Retry-After", strconv.Itoa(loadShedRetryAfter))
+				http.Error(w, "Service busy, retry shortly", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		atomic.AddInt64(&l.inFlight, 1)
+		defer atomic.AddInt64(&l.inFlight, -1)
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		if !sheddable && l.target > 0 && critical(path) {
+			l.observe(start, time.Since(start))
+		}
+	})
+}
+
+// sheddable reports whether a route path template may be shed
+func (l *LoadShedder) sheddable(path string) bool {
+	for _, prefix := range l.routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// critical reports whether a route is on the payment path
+func critical(path string) bool {
+	for _, prefix := range criticalPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// overloaded returns why requests should be shed now, or ""
+func (l *LoadShedder) overloaded(now time.Time) string {
+	if l.maxInFlight > 0 && atomic.LoadInt64(&l.inFlight) >= l.maxInFlight {
+		return "in_flight"
+	}
+	if l.target > 0 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.refresh(now)
+		if l.shedding {
+			return "latency"
+		}
+	}
+	return ""
+}
+
+// observe records a payment request's latency
+func (l *LoadShedder) observe(start time.Time, duration time.Duration) {
+	sample := latencySample{at: start.Add(duration), duration: duration}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, sample)
+	} else {
+		l.samples[l.next] = sample
+		l.next = (l.next + 1) % latencySamples
+	}
+	l.refresh(sample.at)
+}
+
+// refresh recomputes the P99 over the window, at most every
+// latencyRecompute, and switches shedding on above the target and off
+// once it has recovered. Callers hold l.mu.
+func (l *LoadShedder) refresh(now time.Time) {
+	if now.Sub(l.computed) < latencyRecompute {
+		return
+	}
+	l.computed = now
+
+	var recent []time.Duration
+	for _, sample := range l.samples {
+		if now.Sub(sample.at) <= latencyWindow {
+			recent = append(recent, sample.duration)
+		}
+	}
+
+	if len(recent) < minLatencySamples {
+		// Too little payment traffic to judge; nothing needs protecting
+		l.p99, l.shedding = 0, false
+	} else {
+		sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+		l.p99 = recent[int(math.Ceil(0.99*float64(len(recent))))-1]
+		switch {
+		case l.p99 > l.target:
+			l.shedding = true
+		case float64(l.p99) < latencyRecovery*float64(l.target):
+			l.shedding = false
+		}
+	}
+	metrics.SetLoadShedding(l.p99.Seconds(), l.shedding)
+}
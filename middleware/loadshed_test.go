@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nmi-pay-int/config"
+	"nmi-pay-int/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedderInFlight(t *testing.T) {
+	l := NewLoadShedder(&config.Config{LoadShedMaxInFlight: 1, LoadShedRoutes: config.DefaultLoadShedRoutes})
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/payments/sale", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	r.HandleFunc("/payments/lookup", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(l.Middleware)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/payments/sale", nil))
+	}()
+	<-started
+
+	before := testutil.ToFloat64(metrics.LoadShed.WithLabelValues("/payments/lookup", "in_flight"))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/payments/lookup", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.LoadShed.WithLabelValues("/payments/lookup", "in_flight")))
+
+	close(release)
+	<-done
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/payments/lookup", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// fillLatencies records n payment latencies finishing at once, without
+// the recomputation observe may trigger part way through
+func fillLatencies(l *LoadShedder, at time.Time, duration time.Duration, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < n; i++ {
+		l.samples = append(l.samples, latencySample{at: at, duration: duration})
+	}
+}
+
+func TestLoadShedderLatency(t *testing.T) {
+	l := NewLoadShedder(&config.Config{LoadShedP99Target: 100 * time.Millisecond})
+	start := time.Now()
+
+	// A few slow payments on a quiet instance are not enough
+	fillLatencies(l, start, time.Second, minLatencySamples-1)
+	assert.Empty(t, l.overloaded(start.Add(time.Second)))
+
+	fillLatencies(l, start.Add(time.Second), 300*time.Millisecond, 100)
+	assert.Equal(t, "latency", l.overloaded(start.Add(2*time.Second)))
+
+	// Once the slow samples age out, latency just under the target is not
+	// yet a recovery
+	later := start.Add(15 * time.Second)
+	fillLatencies(l, later, 90*time.Millisecond, 100)
+	assert.Equal(t, "latency", l.overloaded(later))
+
+	// Latency well below the target is
+	later = later.Add(15 * time.Second)
+	fillLatencies(l, later, 20*time.Millisecond, 100)
+	assert.Empty(t, l.overloaded(later))
+
+	// observe feeds the same window
+	for i := 0; i < 50; i++ {
+		l.observe(later, 400*time.Millisecond)
+	}
+	assert.Equal(t, "latency", l.overloaded(later.Add(time.Second)))
+}
+
+func TestLoadShedderDisabled(t *testing.T) {
+	l := NewLoadShedder(&config.Config{LoadShedRoutes: config.DefaultLoadShedRoutes})
+	assert.False(t, l.Enabled())
+	assert.True(t, l.sheddable("/payments/{id}/wait"))
+	assert.False(t, l.sheddable("/payments/sale"))
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// authMaxTrackedClients caps the client addresses whose failures are
+// remembered, so a spray of forged sources cannot grow the table unbounded
+const authMaxTrackedClients = 10000
+
+// defaultAuthLockout is used when a failure limit is set without a lockout
+const defaultAuthLockout = 15 * time.Minute
+
+// authFailureLimiter locks a client address out of the protected routes
+// after too many invalid credentials, so API keys and JWT secrets cannot be
+// guessed at the speed of the rate limit. Counts are per process.
+type authFailureLimiter struct {
+	max     int
+	lockout time.Duration
+	trusted []netip.Prefix
+
+	mu      sync.Mutex
+	clients map[string]*authFailures
+}
+
+// authFailures are one client's failures within the current window
+type authFailures struct {
+	count int
+	// start is the first failure of the window, which lasts one lockout
+	start time.Time
+	// until is when the client's lockout ends; zero while it is not locked
+	// out
+	until time.Time
+}
+
+// newAuthFailureLimiter locks a client out for lockout after max failures
+// within lockout. A max of zero disables the limiter.
+func newAuthFailureLimiter(max int, lockout time.Duration, trustedProxies []netip.Prefix) *authFailureLimiter {
+	if lockout <= 0 {
+		lockout = defaultAuthLockout
+	}
+	return &authFailureLimiter{
+		max:     max,
+		lockout: lockout,
+		trusted: trustedProxies,
+		clients: make(map[string]*authFailures),
+	}
+}
+
+// client identifies the address a request came from, believing
+// X-Forwarded-For only from trusted proxies
+func (l *authFailureLimiter) client(r *http.Request) string {
+	if addr, ok := clientAddr(r, l.trusted); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// lockedOut reports whether client is locked out at now, and for how much
+// longer
+func (l *authFailureLimiter) lockedOut(client string, now time.Time) (time.Duration, bool) {
+	if l.max <= 0 {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures, ok := l.clients[client]
+	if !ok || !now.Before(failures.until) {
+		return 0, false
+	}
+	return failures.until.Sub(now), true
+}
+
+// fail counts a failure by client and reports whether it locked the client
+// out
+func (l *authFailureLimiter) fail(client string, now time.Time) bool {
+	if l.max <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= authMaxTrackedClients {
+			l.evict(now)
+		}
+		failures = &authFailures{}
+		l.clients[client] = failures
+	}
+	if now.Sub(failures.start) >= l.lockout {
+		*failures = authFailures{start: now}
+	}
+	failures.count++
+	if failures.count < l.max {
+		return false
+	}
+	failures.until = now.Add(l.lockout)
+	return true
+}
+
+// succeed forgets client's failures once it authenticates
+func (l *authFailureLimiter) succeed(client string) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	delete(l.clients, client)
+	l.mu.Unlock()
+}
+
+// evict drops the clients whose window and lockout have passed, or failing
+// that the one whose window started first. Callers hold mu.
+func (l *authFailureLimiter) evict(now time.Time) {
+	oldest := ""
+	for client, failures := range l.clients {
+		if now.Sub(failures.start) >= l.lockout && !now.Before(failures.until) {
+			delete(l.clients, client)
+			continue
+		}
+		if oldest == "" || failures.start.Before(l.clients[oldest].start) {
+			oldest = client
+		}
+	}
+	if len(l.clients) >= authMaxTrackedClients {
+		delete(l.clients, oldest)
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MerchantHeader selects the merchant account a request is for
+const MerchantHeader = "X-Merchant-ID"
+
+// MerchantResolver decides which merchant account each request is charged
+// to. A caller bound to a merchant in MERCHANTS_FILE always uses it; any
+// other caller picks one with X-Merchant-ID, and without the header gets the
+// default account.
+type MerchantResolver struct {
+	cfg *config.Config
+}
+
+// NewMerchantResolver resolves merchants from cfg
+func NewMerchantResolver(cfg *config.Config) *MerchantResolver {
+	return &MerchantResolver{cfg: cfg}
+}
+
+// resolve returns the merchant for a caller requesting one by ID, or the
+// rejection reason
+func (m *MerchantResolver) resolve(caller, requested string) (config.Merchant, string) {
+	if bound, ok := m.cfg.MerchantForCaller(caller); ok {
+		if requested != "" && requested != bound.ID {
+			return config.Merchant{}, "merchant_mismatch"
+		}
+		return bound, ""
+	}
+	merchant, ok := m.cfg.Merchant(requested)
+	if !ok {
+		return config.Merchant{}, "unknown_merchant"
+	}
+	return merchant, ""
+}
+
+// Middleware attaches the resolved merchant to the request context and log
+// entry. Unknown merchants get 400; a bound caller naming another merchant
+// gets 403.
+func (m *MerchantResolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logctx.From(r.Context())
+		caller, _ := log.Data[logctx.FieldCaller].(string)
+		requested := r.Header.Get(MerchantHeader)
+
+		merchant, reason := m.resolve(caller, requested)
+		if reason != "" {
+			log.WithFields(logrus.Fields{
+				"reason":             reason,
+				"requested_merchant": requested,
+			}).Warn("Request rejected by merchant routing")
+			metrics.RecordErrorMetrics("merchant", reason)
+			if reason == "merchant_mismatch" {
+				api.WriteErrorCode(w, r, api.ErrForbidden, "merchant not allowed for this caller")
+			} else {
+				api.WriteErrorCode(w, r, api.ErrInvalidRequest, "unknown merchant")
+			}
+			return
+		}
+
+		ctx := api.WithMerchant(r.Context(), merchant)
+		ctx = logctx.WithFields(ctx, logrus.Fields{logctx.FieldMerchant: merchant.ID})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UnaryInterceptor resolves the merchant of a gRPC call as Middleware does
+// for HTTP: a caller bound to a merchant gets it, and naming another in
+// x-merchant-id metadata is PermissionDenied; other callers choose with the
+// metadata.
+func (m *MerchantResolver) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requested := firstMetadata(ctx, "x-merchant-id")
+	merchant, reason := m.resolve(logctx.Caller(ctx), requested)
+	if reason != "" {
+		logctx.From(ctx).WithFields(logrus.Fields{
+			"reason":             reason,
+			"requested_merchant": requested,
+		}).Warn("gRPC call rejected by merchant routing")
+		metrics.RecordErrorMetrics("merchant", reason)
+		if reason == "merchant_mismatch" {
+			return nil, status.Error(codes.PermissionDenied, "merchant not allowed for this caller")
+		}
+		return nil, status.Error(codes.InvalidArgument, "unknown merchant")
+	}
+	ctx = api.WithMerchant(ctx, merchant)
+	ctx = logctx.WithFields(ctx, logrus.Fields{logctx.FieldMerchant: merchant.ID})
+	return handler(ctx, req)
+}
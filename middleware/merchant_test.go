@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerchantResolver(t *testing.T) {
+	cfg := &config.Config{
+		APIKey: "default-key",
+		Merchants: []config.Merchant{
+			{ID: "eu-store", APIKey: "eu-key", Currency: "EUR"},
+			{ID: "wholesale", APIKey: "wholesale-key", Callers: []string{"wholesale-portal"}},
+		},
+	}
+	// The handler echoes the security key of the merchant it was routed to
+	handler := NewMerchantResolver(cfg).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchant, _ := api.MerchantFromContext(r.Context())
+		w.Write([]byte(merchant.APIKey + " " + logctx.Merchant(r.Context())))
+	}))
+	request := func(caller, merchant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/payments/sale", nil)
+		if caller != "" {
+			req = req.WithContext(logctx.WithFields(context.Background(), logrus.Fields{logctx.FieldCaller: caller}))
+		}
+		if merchant != "" {
+			req.Header.Set(MerchantHeader, merchant)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		caller   string
+		merchant string
+		wantCode int
+		wantBody string
+	}{
+		{name: "Default", wantCode: http.StatusOK, wantBody: "default-key default"},
+		{name: "Header", merchant: "eu-store", wantCode: http.StatusOK, wantBody: "eu-key eu-store"},
+		{name: "Bound Caller", caller: "wholesale-portal", wantCode: http.StatusOK, wantBody: "wholesale-key wholesale"},
+		{name: "Bound Caller Naming Own Merchant", caller: "wholesale-portal", merchant: "wholesale", wantCode: http.StatusOK, wantBody: "wholesale-key wholesale"},
+		{name: "Bound Caller Naming Another", caller: "wholesale-portal", merchant: "eu-store", wantCode: http.StatusForbidden},
+		{name: "Unbound Caller", caller: "checkout", merchant: "eu-store", wantCode: http.StatusOK, wantBody: "eu-key eu-store"},
+		{name: "Unknown Merchant", merchant: "nope", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := request(tt.caller, tt.merchant)
+			assert.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			} else {
+				assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -2,18 +2,32 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"time"
 
+	"nmi-pay-int/fallback"
+	"nmi-pay-int/logctx"
 	"nmi-pay-int/metrics" // Make sure this matches your module name
+	"nmi-pay-int/requestid"
 
 	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
 // SecurityMiddleware handles rate limiting and security measures
 type SecurityMiddleware struct {
 	limiter *rate.Limiter
+
+	// shared, when set, counts requests across replicas in Redis. limiter
+	// takes over while Redis is unreachable.
+	shared           *redis.Client
+	sharedDependency *fallback.Dependency
 }
 
 // NewSecurityMiddleware creates a new security middleware instance
@@ -23,10 +37,15 @@ func NewSecurityMiddleware(requestsPerMinute float64) *SecurityMiddleware {
 	}
 }
 
+// SetLimit changes the rate limit for the requests that follow
+func (m *SecurityMiddleware) SetLimit(requestsPerMinute float64) {
+	m.limiter.SetLimit(rate.Limit(requestsPerMinute / 60))
+}
+
 // RateLimiter implements rate limiting middleware
 func (m *SecurityMiddleware) RateLimiter(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !m.limiter.Allow() {
+		if !m.allow(r.Context()) {
 			http.Error(w, "Too many requests", http.StatusTooManyRequests)
 			metrics.RecordErrorMetrics("rate_limit", "too_many_requests")
 			return
@@ -60,15 +79,74 @@ func MetricsMiddleware(next http.Handler) http.Handler {
 			r.Method,
 			path,
 			duration,
-			string(rw.statusCode),
+			strconv.Itoa(rw.statusCode),
 		)
 	})
 }
 
-// TimeoutMiddleware adds request timeout
+// UsageMiddleware records per-caller usage statistics. It runs after
+// authentication and identifies callers by the name they authenticated
+// as, so unauthenticated requests share one bucket.
+func UsageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rw := &responseWriterWrapper{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+
+		next.ServeHTTP(rw, r)
+
+		caller := logctx.Caller(r.Context())
+		if caller == "" {
+			caller = metrics.AnonymousCaller
+		}
+		path, _ := mux.CurrentRoute(r).GetPathTemplate()
+		metrics.Usage.Record(caller, r.Method, path, rw.statusCode, time.Since(start))
+	})
+}
+
+// LogContextMiddleware attaches a log entry tagged with the request ID,
+// merchant, masked API key, route and trace ID to the request context
+func LogContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := logrus.Fields{logctx.FieldRequestID: requestid.From(r.Context())}
+		if merchant := r.Header.Get("X-Merchant-ID"); merchant != "" {
+			fields[logctx.FieldMerchant] = merchant
+		}
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			fields[logctx.FieldAPIKey] = metrics.MaskAPIKey(apiKey)
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			fields[logctx.FieldRoute], _ = route.GetPathTemplate()
+		}
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			fields[logctx.FieldTraceID] = span.TraceID().String()
+		}
+
+		ctx := logctx.WithFields(r.Context(), fields)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// streamingRoutes are the route path templates left without a timeout:
+// they stream until the client disconnects
+var streamingRoutes = map[string]bool{
+	"/events/stream": true,
+}
+
+// TimeoutMiddleware adds request timeout, except on streaming routes
 func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if path, _ := route.GetPathTemplate(); streamingRoutes[path] {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
 			ctx, cancel := context.WithTimeout(r.Context(), timeout)
 			defer cancel()
 
@@ -97,7 +175,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		start := time.Now()
 
 		// Log incoming request
-		metrics.LogInfo("Incoming request: " + r.Method + " " + r.URL.Path)
+		metrics.LogInfo(r.Context(), "Incoming request: "+r.Method+" "+r.URL.Path)
 
 		// Create a custom response writer to capture the status code
 		rw := &responseWriterWrapper{
@@ -110,9 +188,27 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 
 		// Log response
 		duration := time.Since(start)
-		metrics.LogDebug("Request completed: " + r.Method + " " + r.URL.Path +
-			" Status: " + string(rw.statusCode) +
-			" Duration: " + duration.String())
+		metrics.LogDebug(r.Context(), "Request completed: "+r.Method+" "+r.URL.Path+
+			" Status: "+strconv.Itoa(rw.statusCode)+
+			" Duration: "+duration.String())
+	})
+}
+
+// RecoveryMiddleware turns a handler panic into a 500 response instead of
+// crashing the process, logging the panic with its stack
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logctx.From(r.Context()).WithFields(logrus.Fields{
+					"panic": fmt.Sprint(err),
+					"stack": string(debug.Stack()),
+				}).Error("Handler panicked")
+				metrics.RecordErrorMetrics("panic", "handler_panic")
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
 	})
 }
 
@@ -121,7 +217,7 @@ func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -143,23 +239,29 @@ func (rw *responseWriterWrapper) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// RequestIDMiddleware adds a unique request ID to each request
+// Flush passes through so streamed responses are not held back
+func (rw *responseWriterWrapper) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (rw *responseWriterWrapper) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// RequestIDMiddleware gives each request an ID, keeping the caller's
+// X-Request-ID when it is safe to reuse, puts it on the request context and
+// returns it in the X-Request-ID response header
 func RequestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Header.Get("X-Request-ID")
-		if requestID == "" {
-			requestID = generateRequestID()
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
 		}
 
-		ctx := context.WithValue(r.Context(), "requestID", requestID)
-		w.Header().Set("X-Request-ID", requestID)
-
-		next.ServeHTTP(w, r.WithContext(ctx))
+		w.Header().Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.With(r.Context(), id)))
 	})
 }
-
-// generateRequestID generates a unique request ID
-func generateRequestID() string {
-	return time.Now().Format("20060102150405") + "-" +
-		string(time.Now().Nanosecond())
-}
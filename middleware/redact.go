@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/metrics"
+)
+
+// ResponseRedactor removes fields from the JSON responses sent to callers
+// with a redaction policy, such as kiosks that must never see raw gateway
+// payloads. Callers without a policy get responses unchanged.
+type ResponseRedactor struct {
+	policies map[string]map[string]bool
+}
+
+// NewResponseRedactor builds a redactor from caller names to the JSON field
+// names removed from their responses, at any depth
+func NewResponseRedactor(policies map[string][]string) *ResponseRedactor {
+	rr := &ResponseRedactor{policies: make(map[string]map[string]bool)}
+	for caller, fields := range policies {
+		set := make(map[string]bool)
+		for _, field := range fields {
+			set[field] = true
+		}
+		rr.policies[caller] = set
+	}
+	return rr
+}
+
+// Middleware buffers JSON responses to callers with a policy and rewrites
+// them without the policy's fields. Other content types pass through. A
+// JSON body that cannot be decoded is replaced by an error rather than sent
+// unredacted.
+func (rr *ResponseRedactor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logctx.From(r.Context())
+		caller, _ := log.Data[logctx.FieldCaller].(string)
+		fields := rr.policies[caller]
+		if len(fields) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &redactingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if !rw.buffering {
+			return
+		}
+
+		body, err := redactJSON(rw.body.Bytes(), fields)
+		if err != nil {
+			log.WithError(err).Error("Could not redact response")
+			metrics.RecordErrorMetrics("redaction", "invalid_json")
+			w.Header().Del("Content-Length")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(rw.status)
+		w.Write(body)
+	})
+}
+
+// redactingWriter holds back JSON responses until the handler is done, and
+// lets everything else through as it is written
+type redactingWriter struct {
+	http.ResponseWriter
+	status    int
+	decided   bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+// decide picks buffering or pass-through once the headers are final
+func (rw *redactingWriter) decide() {
+	if rw.decided {
+		return
+	}
+	rw.decided = true
+	rw.buffering = strings.Contains(rw.Header().Get("Content-Type"), "json")
+	if !rw.buffering {
+		rw.ResponseWriter.WriteHeader(rw.status)
+	}
+}
+
+func (rw *redactingWriter) WriteHeader(code int) {
+	if rw.decided {
+		return
+	}
+	rw.status = code
+	rw.decide()
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.decide()
+	if rw.buffering {
+		return rw.body.Write(p)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// Flush passes through for streamed responses; buffered ones are sent when
+// the handler returns
+func (rw *redactingWriter) Flush() {
+	if rw.decided && !rw.buffering {
+		if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (rw *redactingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// redactJSON removes the named fields from every object in a JSON document
+func redactJSON(body []byte, fields map[string]bool) ([]byte, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return body, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Keep amounts and IDs exactly as the handler wrote them
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	redactValue(doc, fields)
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func redactValue(v interface{}, fields map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if fields[key] {
+				delete(v, key)
+				continue
+			}
+			redactValue(value, fields)
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactValue(item, fields)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/logctx"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func redactRequest(handler http.Handler, caller string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/payments/sale", nil)
+	req = req.WithContext(logctx.WithFields(context.Background(), logrus.Fields{logctx.FieldCaller: caller}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestResponseRedactor(t *testing.T) {
+	rr := NewResponseRedactor(map[string][]string{"kiosk": {"raw_response", "raw", "authcode"}})
+	body := `{"transactionid":"9001","amount":10.50,"authcode":"123456","raw_response":"response=1&authcode=123456","history":[{"raw":"x","type":"sale"}]}`
+	handler := rr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		w.Write([]byte(body))
+	}))
+
+	rec := redactRequest(handler, "kiosk")
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+	assert.JSONEq(t, `{"transactionid":"9001","amount":10.50,"history":[{"type":"sale"}]}`, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"amount":10.50`, "numbers are kept as written")
+
+	// Back-office callers get every field
+	rec = redactRequest(handler, "back-office")
+	assert.Equal(t, body, rec.Body.String())
+}
+
+func TestResponseRedactorPassesOtherContent(t *testing.T) {
+	rr := NewResponseRedactor(map[string][]string{"kiosk": {"raw"}})
+	csv := rr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte("raw,amount\n1,2\n"))
+	}))
+	assert.Equal(t, "raw,amount\n1,2\n", redactRequest(csv, "kiosk").Body.String())
+
+	// A broken JSON body is withheld rather than sent unredacted
+	broken := rr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"raw":"response=1`))
+	}))
+	rec := redactRequest(broken, "kiosk")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "response=1")
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"nmi-pay-int/fallback"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// sharedLimitPrefix namespaces rate limit windows in a shared Redis
+	sharedLimitPrefix = "nmi:ratelimit:"
+	// sharedLimitTimeout bounds the Redis round trip added to each request
+	sharedLimitTimeout = 200 * time.Millisecond
+)
+
+// NewSharedSecurityMiddleware enforces requestsPerMinute across every replica
+// using the given Redis client, counting requests in fixed one-minute
+// windows. While Redis is unreachable each replica applies the limit locally.
+func NewSharedSecurityMiddleware(requestsPerMinute float64, client *redis.Client) *SecurityMiddleware {
+	return &SecurityMiddleware{
+		limiter:          rate.NewLimiter(rate.Limit(requestsPerMinute/60), 1),
+		shared:           client,
+		sharedDependency: fallback.NewDependency("redis_rate_limit", 0),
+	}
+}
+
+// allow reports whether a request is within the limit
+func (m *SecurityMiddleware) allow(ctx context.Context) bool {
+	if m.shared != nil && m.sharedDependency.Available() {
+		allowed, err := m.allowShared(ctx)
+		if err == nil {
+			m.sharedDependency.Succeeded()
+			return allowed
+		}
+		m.sharedDependency.Failed(err)
+	}
+	return m.limiter.Allow()
+}
+
+func (m *SecurityMiddleware) allowShared(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, sharedLimitTimeout)
+	defer cancel()
+
+	key := sharedLimitPrefix + strconv.FormatInt(time.Now().Unix()/60, 10)
+	pipe := m.shared.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	// The local limiter holds the current limit, which SetLimit may change
+	requestsPerMinute := math.Round(float64(m.limiter.Limit()) * 60)
+	return float64(count.Val()) <= requestsPerMinute, nil
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedRateLimitAcrossReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// Two replicas share a limit of 3 requests per minute
+	first := NewSharedSecurityMiddleware(3, redis.NewClient(&redis.Options{Addr: server.Addr()})).RateLimiter(ok)
+	second := NewSharedSecurityMiddleware(3, redis.NewClient(&redis.Options{Addr: server.Addr()})).RateLimiter(ok)
+
+	codes := make([]int, 0, 4)
+	for _, handler := range []http.Handler{first, second, first, second} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes = append(codes, rec.Code)
+	}
+	assert.Equal(t, []int{200, 200, 200, 429}, codes)
+}
+
+func TestSharedRateLimitFallsBackWhenRedisIsDown(t *testing.T) {
+	server := miniredis.RunT(t)
+	limiter := NewSharedSecurityMiddleware(60, redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	handler := limiter.RateLimiter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "requests are not failed because Redis is down")
+	assert.True(t, limiter.sharedDependency.Degraded())
+}
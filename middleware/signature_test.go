@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nmi-pay-int/client"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sharedSecret  = "shared-secret-shared-secret-00000"
+	billingSecret = "billing-secret-billing-secret-000"
+)
+
+// signatureRouter echoes the body the handler received
+func signatureRouter(v *RequestVerifier, caller string) http.Handler {
+	r := mux.NewRouter()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}
+	r.HandleFunc("/payments/sale", echo)
+	r.HandleFunc("/health", echo)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if caller != "" {
+				r = r.WithContext(logctx.WithFields(r.Context(), logrus.Fields{logctx.FieldCaller: caller}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, v.Middleware)
+	return r
+}
+
+func signedRequest(t *testing.T, handler http.Handler, path, body, secret string, at time.Time) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set(SignatureHeader, client.Signature(secret, at, []byte(body)))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequestVerifier(t *testing.T) {
+	v := NewRequestVerifier(&config.Config{RequestSigningSecrets: []config.SigningSecret{
+		{Secret: sharedSecret},
+		{Caller: "billing", Secret: billingSecret},
+	}})
+	body := `{"amount":"10.00"}`
+	anyone := signatureRouter(v, "")
+
+	rec := signedRequest(t, anyone, "/payments/sale", body, sharedSecret, time.Now())
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, body, rec.Body.String(), "the handler still reads the body")
+
+	rec = signedRequest(t, anyone, "/payments/sale", body, "", time.Now())
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "unsigned")
+	assert.JSONEq(t, `{"code":"unauthorized","message":"missing or invalid request signature"}`, rec.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, signedRequest(t, anyone, "/payments/sale", body, billingSecret, time.Now()).Code, "wrong secret")
+	assert.Equal(t, http.StatusUnauthorized, signedRequest(t, anyone, "/payments/sale", body, sharedSecret, time.Now().Add(-time.Hour)).Code, "replayed")
+	assert.Equal(t, http.StatusOK, signedRequest(t, anyone, "/health", body, "", time.Now()).Code, "open routes need no signature")
+
+	// A tampered body no longer matches
+	req := httptest.NewRequest(http.MethodPost, "/payments/sale", strings.NewReader(`{"amount":"1000.00"}`))
+	req.Header.Set(SignatureHeader, client.Signature(sharedSecret, time.Now(), []byte(body)))
+	rec = httptest.NewRecorder()
+	anyone.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// A caller with its own secret must use it
+	billing := signatureRouter(v, "billing")
+	assert.Equal(t, http.StatusOK, signedRequest(t, billing, "/payments/sale", body, billingSecret, time.Now()).Code)
+	assert.Equal(t, http.StatusUnauthorized, signedRequest(t, billing, "/payments/sale", body, sharedSecret, time.Now()).Code)
+}
+
+func TestRequestVerifierAcceptsClientSignatures(t *testing.T) {
+	srv := httptest.NewServer(signatureRouter(NewRequestVerifier(&config.Config{
+		RequestSigningSecrets: []config.SigningSecret{{Secret: sharedSecret}},
+	}), ""))
+	defer srv.Close()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+"/payments/sale", strings.NewReader(`{"amount":"10.00"}`))
+	require.NoError(t, err)
+	require.NoError(t, client.SignRequest(req, sharedSecret))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
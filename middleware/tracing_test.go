@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+	"nmi-pay-int/tracing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	_, err := tracing.Setup(context.Background(), &config.Config{})
+	require.NoError(t, err)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response=2&responsetext=DECLINE&transactionid=123&type=sale&response_code=200"))
+	}))
+	defer gateway.Close()
+	client := api.NewClient(&config.Config{APIBaseURL: gateway.URL, QueryURL: gateway.URL})
+
+	var traceID string
+	r := mux.NewRouter()
+	r.Use(TracingMiddleware, LogContextMiddleware)
+	r.HandleFunc("/payments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		traceID, _ = logctx.From(r.Context()).Data[logctx.FieldTraceID].(string)
+		client.ProcessPayment(r.Context(), api.PaymentRequest{Amount: "10.00", Type: "sale", CustomerVaultID: "123456789"})
+		http.Error(w, "gateway error", http.StatusBadGateway)
+	}).Methods("POST")
+
+	req := httptest.NewRequest(http.MethodPost, "/payments/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	gatewaySpan, serverSpan := spans[0], spans[1]
+
+	// The server span continues the caller's trace under the route template
+	assert.Equal(t, "POST /payments/{id}", serverSpan.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", serverSpan.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan.Parent().SpanID().String())
+	assert.Contains(t, serverSpan.Attributes(), attribute.Int("http.response.status_code", http.StatusBadGateway))
+	assert.Equal(t, codes.Error, serverSpan.Status().Code)
+
+	// The gateway call is a child carrying the transaction type and response code
+	assert.Equal(t, "nmi.transact", gatewaySpan.Name())
+	assert.Equal(t, serverSpan.SpanContext().SpanID(), gatewaySpan.Parent().SpanID())
+	assert.Contains(t, gatewaySpan.Attributes(), attribute.String("nmi.transaction_type", "sale"))
+	assert.Contains(t, gatewaySpan.Attributes(), attribute.String("nmi.response_code", "200"))
+}
@@ -0,0 +1,65 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type money string
+
+type address struct {
+	Zip string `json:"zip"`
+}
+
+type base struct {
+	ID string `json:"id"`
+}
+
+type order struct {
+	*base
+	Total    money             `json:"total"`
+	Count    int               `json:"count,omitempty"`
+	Secret   string            `json:"-"`
+	Ship     *address          `json:"ship,omitempty"`
+	Items    []address         `json:"items"`
+	Tags     map[string]string `json:"tags"`
+	Created  time.Time         `json:"created"`
+	Payload  json.RawMessage   `json:"payload"`
+	Quantity int64             `json:"quantity,string"`
+	internal string
+}
+
+func TestSchemas(t *testing.T) {
+	s := NewSchemas()
+	s.Override(money(""), Schema{Type: "string", Pattern: `^\d+\.\d{2}$`})
+	s.Require(order{}, "total")
+
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/order"}, s.Ref(&order{}))
+	assert.Equal(t, &Schema{Type: "array", Items: &Schema{Ref: "#/components/schemas/order"}}, s.Ref([]order{}))
+
+	components := s.Components()
+	require.Contains(t, components, "order")
+	require.Contains(t, components, "address")
+
+	o := components["order"]
+	assert.Equal(t, []string{"total"}, o.Required)
+	assert.ElementsMatch(t, []string{"id", "total", "count", "ship", "items", "tags", "created", "payload", "quantity"}, keys(o.Properties))
+	assert.Equal(t, `^\d+\.\d{2}$`, o.Properties["total"].Pattern)
+	assert.Equal(t, "#/components/schemas/address", o.Properties["ship"].Ref)
+	assert.Equal(t, "#/components/schemas/address", o.Properties["items"].Items.Ref)
+	assert.Equal(t, "string", o.Properties["tags"].AdditionalProperties.Type)
+	assert.Equal(t, "date-time", o.Properties["created"].Format)
+	assert.Equal(t, "string", o.Properties["quantity"].Type)
+}
+
+func keys(m map[string]*Schema) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
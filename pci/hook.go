@@ -0,0 +1,40 @@
+package pci
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Hook scrubs every log entry before it is written, so card data or a key
+// that reaches a log message or field by mistake is masked rather than
+// stored
+type Hook struct{}
+
+// Levels applies the hook at every level
+func (Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire masks the entry's message and its string, error and Stringer fields.
+// Fields named after card data or credentials are masked whatever they hold.
+func (Hook) Fire(entry *logrus.Entry) error {
+	entry.Message = Scrub(entry.Message)
+	for key, value := range entry.Data {
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case error:
+			text = v.Error()
+		case fmt.Stringer:
+			text = v.String()
+		default:
+			continue
+		}
+		if masked := Scrub(MaskField(key, text)); masked != text {
+			entry.Data[key] = masked
+		}
+	}
+	return nil
+}
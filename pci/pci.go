@@ -0,0 +1,175 @@
+// Package pci masks cardholder data and credentials before they reach logs
+// or are echoed back to callers: card numbers keep their last four digits,
+// security keys their last four characters, and CVVs, expiry dates and
+// wallet tokens nothing at all.
+package pci
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// sensitiveFields maps the names card data and credentials travel under, in
+// NMI form data and responses and in this service's JSON, to their masks
+var sensitiveFields = map[string]func(string) string{
+	"security_key":           MaskSecret,
+	"api_key":                MaskSecret,
+	"ccnumber":               MaskPAN,
+	"cc_number":              MaskPAN,
+	"credit_card":            MaskPAN,
+	"card_number":            MaskPAN,
+	"checkaccount":           MaskPAN,
+	"check_account":          MaskPAN,
+	"cvv":                    MaskAll,
+	"ccexp":                  MaskAll,
+	"cc_exp":                 MaskAll,
+	"exp_date":               MaskAll,
+	"cavv":                   MaskAll,
+	"applepay_payment_data":  MaskAll,
+	"googlepay_payment_data": MaskAll,
+	"apple_pay_payment_data": MaskAll,
+	"google_pay_token":       MaskAll,
+	"payment_token":          MaskSecret,
+}
+
+var (
+	// queryField matches a sensitive key=value pair in form data or an NMI
+	// response
+	queryField = regexp.MustCompile(`(?i)(^|[&?\s])(` + fieldNames() + `)=([^&\s]*)`)
+	// jsonField matches a sensitive string member of a JSON document
+	jsonField = regexp.MustCompile(`(?i)("(?:` + fieldNames() + `)"\s*:\s*")((?:[^"\\]|\\.)*)"`)
+	// panCandidate matches 13 to 19 digits, optionally grouped by spaces or
+	// dashes, that are not part of a longer number
+	panCandidate = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+func fieldNames() string {
+	names := make([]string, 0, len(sensitiveFields))
+	for name := range sensitiveFields {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	return strings.Join(names, "|")
+}
+
+// MaskField masks value if key names card data or a credential, and
+// returns it unchanged otherwise
+func MaskField(key, value string) string {
+	if mask, ok := sensitiveFields[strings.ToLower(key)]; ok {
+		return mask(value)
+	}
+	return value
+}
+
+// Sensitive reports whether key names card data or a credential
+func Sensitive(key string) bool {
+	_, ok := sensitiveFields[strings.ToLower(key)]
+	return ok
+}
+
+// MaskPAN keeps only the last four digits of a card or account number
+func MaskPAN(number string) string {
+	number = strings.NewReplacer(" ", "", "-", "").Replace(number)
+	if len(number) <= 4 {
+		return number
+	}
+	return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+}
+
+// MaskSecret keeps only the last four characters of a secret
+func MaskSecret(value string) string {
+	if len(value) <= 4 {
+		return strings.Repeat("*", len(value))
+	}
+	return strings.Repeat("*", len(value)-4) + value[len(value)-4:]
+}
+
+// MaskAll replaces every character of a value
+func MaskAll(value string) string {
+	return strings.Repeat("*", len(value))
+}
+
+// Scrub masks the card data and credentials found in free text: the values
+// of sensitive fields in form data, NMI responses and JSON, and anything
+// else that passes the Luhn check as a card number
+func Scrub(s string) string {
+	s = queryField.ReplaceAllStringFunc(s, func(match string) string {
+		parts := queryField.FindStringSubmatch(match)
+		return parts[1] + parts[2] + "=" + MaskField(parts[2], parts[3])
+	})
+	s = jsonField.ReplaceAllStringFunc(s, func(match string) string {
+		parts := jsonField.FindStringSubmatch(match)
+		key := strings.Trim(strings.SplitN(parts[1], ":", 2)[0], `" `)
+		return parts[1] + MaskField(key, parts[2]) + `"`
+	})
+	return panCandidate.ReplaceAllStringFunc(s, func(match string) string {
+		if !luhn(match) {
+			return match
+		}
+		return MaskPAN(match)
+	})
+}
+
+// luhn reports whether the digits of s pass the Luhn checksum card numbers
+// carry
+func luhn(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Format renders a struct like fmt's %+v, masking string fields whose JSON
+// names are sensitive and scrubbing the rest. Request types use it for
+// String so that logging one by accident does not leak the card behind it.
+func Format(v interface{}) string {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return Scrub(fmt.Sprintf("%+v", v))
+	}
+	rt := rv.Type()
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(field.Name)
+		b.WriteByte(':')
+
+		value := rv.Field(i)
+		if value.Kind() == reflect.Ptr && !value.IsNil() {
+			value = value.Elem()
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case value.Kind() == reflect.String:
+			b.WriteString(Scrub(MaskField(name, value.String())))
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8:
+			// Raw JSON such as wallet tokens
+			b.WriteString(MaskField(name, string(value.Bytes())))
+		default:
+			b.WriteString(Scrub(fmt.Sprintf("%+v", value.Interface())))
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
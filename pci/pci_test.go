@@ -0,0 +1,76 @@
+package pci
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrub(t *testing.T) {
+	// NMI responses and form data
+	raw := "response=1&responsetext=SUCCESS&transactionid=10234567890&ccnumber=4111111111111111&cvv=123&security_key=6457Thfj624V5r7WUwc5v6a68Zsd6YEm"
+	assert.Equal(t,
+		"response=1&responsetext=SUCCESS&transactionid=10234567890&ccnumber=************1111&cvv=***&security_key=****************************6YEm",
+		Scrub(raw))
+
+	// JSON bodies
+	assert.Equal(t,
+		`{"amount":"10.00","credit_card":"************1111","exp_date":"****"}`,
+		Scrub(`{"amount":"10.00","credit_card":"4111111111111111","exp_date":"1230"}`))
+
+	// Card numbers in free text, grouped or not
+	assert.Equal(t, "card ************4242 declined", Scrub("card 4242 4242 4242 4242 declined"))
+	assert.Equal(t, "paid with ***********0005", Scrub("paid with 378282246310005"))
+
+	// Long numbers that are not cards are left alone
+	assert.Equal(t, "order 1234567890123456", Scrub("order 1234567890123456"))
+}
+
+func TestFormat(t *testing.T) {
+	type billing struct {
+		Zip string `json:"zip"`
+	}
+	req := struct {
+		APIKey     string   `json:"api_key,omitempty"`
+		Amount     string   `json:"amount"`
+		CreditCard string   `json:"credit_card,omitempty"`
+		CVV        string   `json:"cvv,omitempty"`
+		Billing    *billing `json:"billing,omitempty"`
+		Note       string   `json:"note"`
+	}{
+		APIKey:     "abcdefgh1234",
+		Amount:     "10.00",
+		CreditCard: "4111111111111111",
+		CVV:        "123",
+		Billing:    &billing{Zip: "90210"},
+		Note:       "card 4111111111111111",
+	}
+
+	assert.Equal(t,
+		"{APIKey:********1234 Amount:10.00 CreditCard:************1111 CVV:*** Billing:{Zip:90210} Note:card ************1111}",
+		Format(req))
+}
+
+func TestHook(t *testing.T) {
+	var out bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&out)
+	log.SetFormatter(&logrus.JSONFormatter{})
+	log.AddHook(Hook{})
+
+	log.WithFields(logrus.Fields{
+		"form_data": "ccnumber=4111111111111111&amount=10.00",
+		"cvv":       "123",
+		"error":     errors.New("rejected 4111 1111 1111 1111"),
+		"attempts":  2,
+	}).Info("Charging 4111111111111111")
+
+	assert.NotContains(t, out.String(), "4111111111111111")
+	assert.NotContains(t, out.String(), "4111 1111")
+	assert.NotContains(t, out.String(), `"123"`)
+	assert.Contains(t, out.String(), "************1111")
+	assert.Contains(t, out.String(), `"attempts":2`)
+}
@@ -0,0 +1,169 @@
+// Package recorder writes processed transactions to their sinks from a
+// background goroutine, so request handlers only queue them.
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"nmi-pay-int/metrics"
+	"nmi-pay-int/store"
+)
+
+// DefaultBufferSize is how many transactions may wait for the writer
+const DefaultBufferSize = 1024
+
+// maxBatch bounds how many queued transactions one sink write carries
+const maxBatch = 100
+
+// writeTimeout bounds a single sink write
+const writeTimeout = 10 * time.Second
+
+// ErrClosed is returned for transactions recorded after Close
+var ErrClosed = errors.New("transaction recorder is closed")
+
+// Sink persists recorded transactions
+type Sink interface {
+	// Name identifies the sink in logs and metrics
+	Name() string
+	// Write stores a batch of transactions, oldest first
+	Write(ctx context.Context, batch []store.Transaction) error
+}
+
+// entry is a queued transaction, or a flush marker when flushed is set
+type entry struct {
+	transaction store.Transaction
+	flushed     chan struct{}
+}
+
+// Recorder queues transactions and writes them to every sink in order. A
+// sink that fails is logged and counted; the others still get the batch.
+type Recorder struct {
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan entry
+	sinks   []Sink
+	stopped chan struct{}
+}
+
+// New starts a recorder buffering up to size transactions
+func New(size int, sinks ...Sink) *Recorder {
+	if size < 1 {
+		size = DefaultBufferSize
+	}
+	r := &Recorder{queue: make(chan entry, size), sinks: sinks, stopped: make(chan struct{})}
+	go r.run()
+	return r
+}
+
+// Record queues a transaction, stamping CreatedAt when it is zero. It blocks
+// only while the buffer is full, so a burst slows requests down rather than
+// losing transactions.
+func (r *Recorder) Record(t store.Transaction) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return ErrClosed
+	}
+
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	r.queue <- entry{transaction: t}
+	metrics.RecorderQueueDepth.Set(float64(len(r.queue)))
+	return nil
+}
+
+// Flush waits until every transaction recorded before it has been written
+func (r *Recorder) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return ErrClosed
+	}
+	select {
+	case r.queue <- entry{flushed: flushed}:
+		r.mu.RUnlock()
+	case <-ctx.Done():
+		r.mu.RUnlock()
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting transactions and waits for the queued ones to be
+// written or ctx to end
+func (r *Recorder) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.stopped)
+	for first := range r.queue {
+		var batch []store.Transaction
+		var flushed []chan struct{}
+		add := func(e entry) {
+			if e.flushed != nil {
+				flushed = append(flushed, e.flushed)
+			} else {
+				batch = append(batch, e.transaction)
+			}
+		}
+
+		// Take whatever else is already waiting along with it
+		add(first)
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case e, ok := <-r.queue:
+				if !ok {
+					break drain
+				}
+				add(e)
+			default:
+				break drain
+			}
+		}
+		metrics.RecorderQueueDepth.Set(float64(len(r.queue)))
+
+		if len(batch) > 0 {
+			r.write(batch)
+		}
+		for _, done := range flushed {
+			close(done)
+		}
+	}
+}
+
+func (r *Recorder) write(batch []store.Transaction) {
+	for _, sink := range r.sinks {
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		if err := sink.Write(ctx, batch); err != nil {
+			metrics.RecorderWriteErrors.WithLabelValues(sink.Name()).Inc()
+			metrics.LogError(ctx, fmt.Errorf("failed to record %d transactions to %s: %v", len(batch), sink.Name(), err))
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,80 @@
+package recorder
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"nmi-pay-int/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingSink struct{}
+
+func (failingSink) Name() string { return "failing" }
+
+func (failingSink) Write(context.Context, []store.Transaction) error { return errors.New("disk full") }
+
+func TestRecorderConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	history := store.NewMemoryStore(1000)
+	r := New(8, failingSink{}, NewCSVSink(filepath.Join(dir, "transactions.csv")), NewStoreSink(history))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status := store.StatusApproved
+			if i%4 == 0 {
+				status = store.StatusDeclined
+			}
+			assert.NoError(t, r.Record(store.Transaction{TransactionID: strconv.Itoa(i), Type: "sale", Status: status, Amount: "1.00"}))
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, r.Close(context.Background()))
+	assert.ErrorIs(t, r.Record(store.Transaction{}), ErrClosed)
+
+	// Every transaction reaches the store despite the failing sink, and the
+	// CSV holds one header and the approved ones
+	page, err := history.List(context.Background(), store.Filter{Limit: store.MaxLimit})
+	require.NoError(t, err)
+	assert.Len(t, page.Transactions, 200)
+
+	file, err := os.Open(filepath.Join(dir, "transactions.csv"))
+	require.NoError(t, err)
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 151)
+	assert.Equal(t, "Transaction ID", rows[0][1])
+}
+
+func TestRecorderFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.jsonl")
+	r := New(DefaultBufferSize, NewJSONLSink(path))
+	defer r.Close(context.Background())
+
+	require.NoError(t, r.Record(store.Transaction{TransactionID: "1", Status: store.StatusApproved, Amount: "5.00"}))
+	require.NoError(t, r.Record(store.Transaction{Status: store.StatusDeclined, Amount: "7.50"}))
+	require.NoError(t, r.Flush(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	var declined store.Transaction
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &declined))
+	assert.Equal(t, store.StatusDeclined, declined.Status)
+	assert.False(t, declined.CreatedAt.IsZero())
+}
@@ -0,0 +1,110 @@
+package recorder
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"nmi-pay-int/store"
+)
+
+// CSVSink appends approved transactions to a CSV file, the format of the
+// transactions.csv export
+type CSVSink struct {
+	path string
+}
+
+// NewCSVSink creates a sink appending to the CSV file at path
+func NewCSVSink(path string) *CSVSink {
+	return &CSVSink{path: path}
+}
+
+func (s *CSVSink) Name() string { return "csv" }
+
+func (s *CSVSink) Write(ctx context.Context, batch []store.Transaction) error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	// Write headers if file is empty
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		writer.Write([]string{"Timestamp", "Transaction ID", "Type", "Response", "Amount", "Order Description", "PO Number"})
+	}
+	for _, t := range batch {
+		if t.Status != store.StatusApproved {
+			continue
+		}
+		writer.Write([]string{
+			t.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			t.TransactionID,
+			t.Type,
+			t.ResponseText,
+			t.Amount.String(),
+			t.OrderDescription,
+			t.PONumber,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// JSONLSink appends every transaction, declines included, to a file as one
+// JSON object per line
+type JSONLSink struct {
+	path string
+}
+
+// NewJSONLSink creates a sink appending to the JSON Lines file at path
+func NewJSONLSink(path string) *JSONLSink {
+	return &JSONLSink{path: path}
+}
+
+func (s *JSONLSink) Name() string { return "jsonl" }
+
+func (s *JSONLSink) Write(ctx context.Context, batch []store.Transaction) error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, t := range batch {
+		if err := encoder.Encode(t); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// StoreSink saves every transaction to a transaction history store
+type StoreSink struct {
+	store store.Store
+}
+
+// NewStoreSink creates a sink saving to s
+func NewStoreSink(s store.Store) *StoreSink {
+	return &StoreSink{store: s}
+}
+
+func (s *StoreSink) Name() string { return "database" }
+
+// Write saves each transaction, carrying on past failures so one bad row
+// does not drop the rest of the batch
+func (s *StoreSink) Write(ctx context.Context, batch []store.Transaction) error {
+	var errs []error
+	for _, t := range batch {
+		if _, err := s.store.Save(ctx, t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
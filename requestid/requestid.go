@@ -0,0 +1,53 @@
+// Package requestid carries the ID that ties a request's log lines, its
+// response and the caller's own records together.
+package requestid
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// Header carries the request ID on HTTP requests and responses
+const Header = "X-Request-ID"
+
+// maxLength bounds a caller-supplied request ID
+const maxLength = 128
+
+type contextKey struct{}
+
+// New returns a fresh random request ID
+func New() string {
+	return uuid.NewString()
+}
+
+// Valid reports whether a caller-supplied ID can be used as is: short and
+// limited to letters, digits and ._:- so it is safe to log and echo back
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// With returns a copy of ctx carrying the request ID
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// From returns the request ID on ctx, or "" outside a request
+func From(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
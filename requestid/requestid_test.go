@@ -0,0 +1,24 @@
+package requestid
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	id := New()
+	assert.Len(t, id, 36)
+	assert.NotEqual(t, id, New())
+	assert.True(t, Valid(id))
+
+	assert.True(t, Valid("checkout-2025.01:abc_1"))
+	assert.False(t, Valid(""))
+	assert.False(t, Valid("has space"))
+	assert.False(t, Valid("line\nbreak"))
+	assert.False(t, Valid(string(make([]byte, maxLength+1))))
+
+	assert.Empty(t, From(context.Background()))
+	assert.Equal(t, id, From(With(context.Background(), id)))
+}
@@ -0,0 +1,83 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"nmi-pay-int/awsauth"
+)
+
+// awsProvider reads a secret with Secrets Manager's GetSecretValue
+type awsProvider struct {
+	secretID    string
+	field       string
+	endpoint    string
+	region      string
+	credentials awsauth.Credentials
+	client      *http.Client
+}
+
+// newAWSProvider takes the region from a secret ARN
+// (arn:aws:secretsmanager:<region>:...) and from opts otherwise
+func newAWSProvider(opts Options, client *http.Client) (*awsProvider, error) {
+	region := opts.AWSRegion
+	if parts := strings.Split(opts.ID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no AWS region for secret %q", opts.ID)
+	}
+	endpoint := opts.AWSEndpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com/"
+	}
+	return &awsProvider{
+		secretID:    opts.ID,
+		field:       opts.Field,
+		endpoint:    endpoint,
+		region:      region,
+		credentials: opts.AWSCredentials,
+		client:      client,
+	}, nil
+}
+
+func (p *awsProvider) Name() string { return BackendAWS }
+
+type awsSecretValue struct {
+	SecretString string `json:"SecretString"`
+	SecretBinary string `json:"SecretBinary"`
+}
+
+func (p *awsProvider) Fetch(ctx context.Context) (string, error) {
+	body, err := json.Marshal(map[string]string{"SecretId": p.secretID})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awsauth.Sign(req, string(body), p.region, "secretsmanager", p.credentials, time.Now())
+
+	var value awsSecretValue
+	if err := get(p.client, req, &value); err != nil {
+		return "", err
+	}
+	secret := value.SecretString
+	if secret == "" && value.SecretBinary != "" {
+		decoded, err := base64.StdEncoding.DecodeString(value.SecretBinary)
+		if err != nil {
+			return "", fmt.Errorf("invalid SecretBinary: %v", err)
+		}
+		secret = string(decoded)
+	}
+	return field(secret, p.field)
+}
@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpEndpoint = "https://secretmanager.googleapis.com/v1/"
+	// gcpMetadataTokenURL hands out access tokens for the instance's
+	// service account on GCE, GKE and Cloud Run
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcpProvider reads the latest, or a pinned, version of a Secret Manager
+// secret
+type gcpProvider struct {
+	name   string
+	field  string
+	client *http.Client
+	// endpoint and tokenURL are replaced in tests
+	endpoint string
+	tokenURL string
+
+	mu           sync.Mutex
+	token        string
+	tokenExpires time.Time
+	// staticToken is never refreshed
+	staticToken bool
+}
+
+func newGCPProvider(opts Options, client *http.Client) *gcpProvider {
+	name := strings.Trim(opts.ID, "/")
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return &gcpProvider{
+		name:        name,
+		field:       opts.Field,
+		client:      client,
+		endpoint:    gcpEndpoint,
+		tokenURL:    gcpMetadataTokenURL,
+		token:       opts.GCPAccessToken,
+		staticToken: opts.GCPAccessToken != "",
+	}
+}
+
+func (p *gcpProvider) Name() string { return BackendGCP }
+
+type gcpAccessResponse struct {
+	Payload struct {
+		Data string `json:"data"`
+	} `json:"payload"`
+}
+
+func (p *gcpProvider) Fetch(ctx context.Context) (string, error) {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("no GCP access token: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint+p.name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var access gcpAccessResponse
+	if err := get(p.client, req, &access); err != nil {
+		return "", err
+	}
+	secret, err := base64.StdEncoding.DecodeString(access.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret payload: %v", err)
+	}
+	return field(string(secret), p.field)
+}
+
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// accessToken returns the configured token, or one from the metadata
+// server, reused until a minute before it expires
+func (p *gcpProvider) accessToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.staticToken || (p.token != "" && time.Now().Before(p.tokenExpires)) {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var token gcpToken
+	if err := get(p.client, req, &token); err != nil {
+		return "", err
+	}
+	p.token = token.AccessToken
+	p.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return p.token, nil
+}
@@ -0,0 +1,118 @@
+// Package secrets reads the NMI security key from a secrets manager: AWS
+// Secrets Manager, GCP Secret Manager or HashiCorp Vault. Each is called
+// over its HTTP API, so no cloud SDK is needed.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"nmi-pay-int/awsauth"
+)
+
+// Backends for SECRETS_BACKEND
+const (
+	BackendAWS   = "aws"
+	BackendGCP   = "gcp"
+	BackendVault = "vault"
+)
+
+// DefaultVaultField is the field of a Vault secret read when Options.Field
+// is empty, since Vault secrets are always a set of fields
+const DefaultVaultField = "api_key"
+
+// fetchTimeout bounds one call to a secrets manager
+const fetchTimeout = 10 * time.Second
+
+// Provider reads one secret from a secrets manager
+type Provider interface {
+	// Name identifies the backend in logs and metrics
+	Name() string
+	// Fetch returns the secret's current value
+	Fetch(ctx context.Context) (string, error)
+}
+
+// Options locate a secret and the credentials to read it with
+type Options struct {
+	Backend string
+	// ID names the secret: an AWS secret name or ARN, a GCP resource name
+	// (projects/p/secrets/s, optionally with /versions/v) or a Vault path
+	// such as secret/data/nmi
+	ID string
+	// Field is the JSON field holding the value, for secrets stored as an
+	// object. Empty uses the whole secret, or DefaultVaultField for Vault.
+	Field string
+
+	AWSRegion      string
+	AWSEndpoint    string
+	AWSCredentials awsauth.Credentials
+
+	// GCPAccessToken authenticates to Secret Manager. Empty requests tokens
+	// from the GCE metadata server.
+	GCPAccessToken string
+
+	VaultAddr  string
+	VaultToken string
+}
+
+// New returns the provider for opts.Backend
+func New(opts Options) (Provider, error) {
+	if opts.ID == "" {
+		return nil, fmt.Errorf("no secret to read")
+	}
+	client := &http.Client{Timeout: fetchTimeout}
+	switch opts.Backend {
+	case BackendAWS:
+		return newAWSProvider(opts, client)
+	case BackendGCP:
+		return newGCPProvider(opts, client), nil
+	case BackendVault:
+		return newVaultProvider(opts, client)
+	}
+	return nil, fmt.Errorf("unknown secrets backend %q", opts.Backend)
+}
+
+// field picks name out of a secret stored as a JSON object, or returns the
+// secret as it is when name is empty
+func field(secret, name string) (string, error) {
+	if name == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, so it has no field %q", name)
+	}
+	value, ok := fields[name].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("secret has no field %q", name)
+	}
+	return value, nil
+}
+
+// get sends req and decodes a JSON answer into result. Failures quote the
+// status, and the backend's error message where it is short, never the
+// body of a successful answer.
+func get(client *http.Client, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(body))
+		if len(message) > 200 {
+			message = message[:200]
+		}
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, message)
+	}
+	return json.Unmarshal(body, result)
+}
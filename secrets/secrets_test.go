@@ -0,0 +1,114 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nmi-pay-int/awsauth"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-2/secretsmanager/aws4_request")
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "arn:aws:secretsmanager:us-east-2:123456789012:secret:nmi", body["SecretId"])
+		w.Write([]byte(`{"Name":"nmi","SecretString":"{\"api_key\":\"key-from-aws\"}"}`))
+	}))
+	defer server.Close()
+
+	provider, err := New(Options{
+		Backend:        BackendAWS,
+		ID:             "arn:aws:secretsmanager:us-east-2:123456789012:secret:nmi",
+		Field:          "api_key",
+		AWSEndpoint:    server.URL,
+		AWSCredentials: awsauth.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	})
+	require.NoError(t, err)
+	key, err := provider.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "key-from-aws", key)
+
+	_, err = New(Options{Backend: BackendAWS, ID: "nmi"})
+	assert.ErrorContains(t, err, "no AWS region")
+}
+
+func TestGCPProviderUsesMetadataToken(t *testing.T) {
+	tokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokens++
+			assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+			w.Write([]byte(`{"access_token":"ya29.test","expires_in":3600}`))
+			return
+		}
+		assert.Equal(t, "/v1/projects/acme/secrets/nmi/versions/latest:access", r.URL.Path)
+		assert.Equal(t, "Bearer ya29.test", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"payload":{"data":"` + base64.StdEncoding.EncodeToString([]byte("key-from-gcp")) + `"}}`))
+	}))
+	defer server.Close()
+
+	provider, err := New(Options{Backend: BackendGCP, ID: "projects/acme/secrets/nmi"})
+	require.NoError(t, err)
+	gcp := provider.(*gcpProvider)
+	gcp.endpoint, gcp.tokenURL = server.URL+"/v1/", server.URL+"/token"
+
+	for i := 0; i < 2; i++ {
+		key, err := provider.Fetch(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "key-from-gcp", key)
+	}
+	assert.Equal(t, 1, tokens, "the metadata token is reused until it expires")
+}
+
+func TestVaultProvider(t *testing.T) {
+	answer := `{"data":{"data":{"api_key":"key-from-vault"},"metadata":{"version":3}}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/secret/data/nmi", r.URL.Path)
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(answer))
+	}))
+	defer server.Close()
+
+	provider, err := New(Options{Backend: BackendVault, ID: "secret/data/nmi", VaultAddr: server.URL, VaultToken: "s.token"})
+	require.NoError(t, err)
+	key, err := provider.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "key-from-vault", key)
+
+	// KV version 1 keeps the fields directly under data
+	answer = `{"data":{"api_key":"key-from-kv1"}}`
+	key, err = provider.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "key-from-kv1", key)
+
+	denied, err := New(Options{Backend: BackendVault, ID: "secret/data/nmi", VaultAddr: server.URL, VaultToken: "wrong"})
+	require.NoError(t, err)
+	_, err = denied.Fetch(context.Background())
+	assert.ErrorContains(t, err, "403: {\"errors\":[\"permission denied\"]}")
+}
+
+func TestField(t *testing.T) {
+	value, err := field("plain-key", "")
+	require.NoError(t, err)
+	assert.Equal(t, "plain-key", value)
+
+	_, err = field("plain-key", "api_key")
+	assert.ErrorContains(t, err, "not a JSON object")
+	_, err = field(`{"other":"x"}`, "api_key")
+	assert.ErrorContains(t, err, `no field "api_key"`)
+}
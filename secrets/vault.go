@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// vaultProvider reads a field of a key/value secret, from either version
+// of Vault's KV engine
+type vaultProvider struct {
+	url    string
+	token  string
+	field  string
+	client *http.Client
+}
+
+func newVaultProvider(opts Options, client *http.Client) (*vaultProvider, error) {
+	if opts.VaultAddr == "" || opts.VaultToken == "" {
+		return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required to read from Vault")
+	}
+	name := opts.Field
+	if name == "" {
+		name = DefaultVaultField
+	}
+	return &vaultProvider{
+		url:    strings.TrimSuffix(opts.VaultAddr, "/") + "/v1/" + strings.Trim(opts.ID, "/"),
+		token:  opts.VaultToken,
+		field:  name,
+		client: client,
+	}, nil
+}
+
+func (p *vaultProvider) Name() string { return BackendVault }
+
+// vaultSecret is a KV read. Version 2 nests the fields in data.data, next
+// to data.metadata; version 1 has them directly in data.
+type vaultSecret struct {
+	Data json.RawMessage `json:"data"`
+}
+
+func (p *vaultProvider) Fetch(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	var secret vaultSecret
+	if err := get(p.client, req, &secret); err != nil {
+		return "", err
+	}
+	var v2 struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	data := secret.Data
+	if json.Unmarshal(secret.Data, &v2) == nil && v2.Data != nil && v2.Metadata != nil {
+		data = v2.Data
+	}
+	return field(string(data), p.field)
+}
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS transactions (
+    seq               BIGINT PRIMARY KEY,
+    transaction_id    TEXT NOT NULL,
+    merchant_id       TEXT NOT NULL,
+    type              TEXT NOT NULL,
+    status            TEXT NOT NULL,
+    response_text     TEXT NOT NULL,
+    amount            TEXT NOT NULL,
+    amount_minor      BIGINT NOT NULL,
+    order_description TEXT NOT NULL,
+    po_number         TEXT NOT NULL,
+    created_at        TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS transactions_merchant_seq ON transactions (merchant_id, seq);
+CREATE INDEX IF NOT EXISTS transactions_transaction_id ON transactions (transaction_id);
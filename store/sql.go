@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+	"strings"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/db"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// saveAttempts bounds retries when concurrent writers race for the same
+// sequence number
+const saveAttempts = 5
+
+// errSeqTaken is returned when another instance claimed the sequence number
+var errSeqTaken = errors.New("transaction sequence number already taken")
+
+// SQLStore keeps the transaction history in Postgres or SQLite
+type SQLStore struct {
+	db *db.DB
+}
+
+// NewSQLStore migrates the transactions schema and returns a store
+func NewSQLStore(ctx context.Context, database *db.DB) (*SQLStore, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "store", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: database}, nil
+}
+
+const transactionColumns = `seq, transaction_id, merchant_id, type, status, response_text, amount, order_description, po_number, created_at`
+
+// Save takes the next sequence number inside a transaction; replicas saving
+// at the same moment collide on the primary key and the loser retries
+func (s *SQLStore) Save(ctx context.Context, t Transaction) (Transaction, error) {
+	t = prepare(t)
+	var err error
+	for attempt := 0; attempt < saveAttempts; attempt++ {
+		var saved Transaction
+		if saved, err = s.save(ctx, t); !errors.Is(err, errSeqTaken) {
+			return saved, err
+		}
+	}
+	return Transaction{}, err
+}
+
+func (s *SQLStore) save(ctx context.Context, t Transaction) (Transaction, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) + 1 FROM transactions`).Scan(&t.Seq); err != nil {
+		return Transaction{}, err
+	}
+	_, err = tx.ExecContext(ctx, s.db.Rebind(`INSERT INTO transactions (`+transactionColumns+`, amount_minor)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		t.Seq, t.TransactionID, t.MerchantID, t.Type, t.Status, t.ResponseText, string(t.Amount),
+		t.OrderDescription, t.PONumber, t.CreatedAt, t.Amount.Minor())
+	if db.IsUniqueViolation(err) {
+		return Transaction{}, errSeqTaken
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+	return t, tx.Commit()
+}
+
+func (s *SQLStore) List(ctx context.Context, filter Filter) (Page, error) {
+	limit, err := filter.limit()
+	if err != nil {
+		return Page{}, err
+	}
+	before, err := filter.before()
+	if err != nil {
+		return Page{}, err
+	}
+
+	var where []string
+	var args []any
+	add := func(clause string, values ...any) {
+		where = append(where, clause)
+		args = append(args, values...)
+	}
+	in := func(column string, values []string) {
+		placeholders, bound := make([]string, len(values)), make([]any, len(values))
+		for i, value := range values {
+			placeholders[i], bound[i] = "?", value
+		}
+		add(column+" IN ("+strings.Join(placeholders, ", ")+")", bound...)
+	}
+
+	if before > 0 {
+		add("seq < ?", before)
+	}
+	if filter.MerchantID != "" {
+		add("merchant_id = ?", filter.MerchantID)
+	}
+	if len(filter.Types) > 0 {
+		in("type", filter.Types)
+	}
+	if len(filter.Statuses) > 0 {
+		in("status", filter.Statuses)
+	}
+	if !filter.From.IsZero() {
+		add("created_at >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		add("created_at < ?", filter.To.UTC())
+	}
+	if filter.MinAmount != "" {
+		add("amount_minor >= ?", filter.MinAmount.Minor())
+	}
+	if filter.MaxAmount != "" {
+		add("amount_minor <= ?", filter.MaxAmount.Minor())
+	}
+
+	query := `SELECT ` + transactionColumns + ` FROM transactions`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY seq DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := s.db.QueryContext(ctx, s.db.Rebind(query), args...)
+	if err != nil {
+		return Page{}, err
+	}
+	defer rows.Close()
+
+	matches := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		var amount string
+		if err := rows.Scan(&t.Seq, &t.TransactionID, &t.MerchantID, &t.Type, &t.Status, &t.ResponseText, &amount,
+			&t.OrderDescription, &t.PONumber, &t.CreatedAt); err != nil {
+			return Page{}, err
+		}
+		t.Amount = api.Amount(amount)
+		t.CreatedAt = t.CreatedAt.UTC()
+		matches = append(matches, t)
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, err
+	}
+	return page(matches, limit), nil
+}
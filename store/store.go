@@ -0,0 +1,206 @@
+// Package store keeps a queryable history of the transactions the service
+// processes, in Postgres or SQLite when a database is configured.
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"nmi-pay-int/api"
+)
+
+// Transaction statuses
+const (
+	StatusApproved = "approved"
+	StatusDeclined = "declined"
+	// StatusError is a transaction the gateway could not process
+	StatusError = "error"
+)
+
+// Page sizes for List
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+// DefaultMemorySize is how many transactions the in-memory store retains
+const DefaultMemorySize = 10000
+
+// Errors List returns for a bad filter
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidLimit  = errors.New("limit must be between 1 and " + strconv.Itoa(MaxLimit))
+)
+
+// Transaction is one processed transaction. Seq orders transactions by when
+// they were stored.
+type Transaction struct {
+	Seq           int64  `json:"-"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	MerchantID    string `json:"merchant_id"`
+	// Type is the operation: sale, auth, capture, refund, void, ach_sale, ...
+	Type             string     `json:"type"`
+	Status           string     `json:"status"`
+	ResponseText     string     `json:"response_text,omitempty"`
+	Amount           api.Amount `json:"amount"`
+	OrderDescription string     `json:"order_description,omitempty"`
+	PONumber         string     `json:"ponumber,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// Filter selects transactions for List. Empty fields match everything;
+// From and To bound CreatedAt as [From, To), and the amounts are inclusive.
+type Filter struct {
+	MerchantID string
+	Types      []string
+	Statuses   []string
+	From       time.Time
+	To         time.Time
+	MinAmount  api.Amount
+	MaxAmount  api.Amount
+	// Cursor continues from the page that returned it
+	Cursor string
+	Limit  int
+}
+
+func (f Filter) matches(t Transaction) bool {
+	switch {
+	case f.MerchantID != "" && t.MerchantID != f.MerchantID,
+		len(f.Types) > 0 && !contains(f.Types, t.Type),
+		len(f.Statuses) > 0 && !contains(f.Statuses, t.Status),
+		!f.From.IsZero() && t.CreatedAt.Before(f.From),
+		!f.To.IsZero() && !t.CreatedAt.Before(f.To),
+		f.MinAmount != "" && t.Amount.Minor() < f.MinAmount.Minor(),
+		f.MaxAmount != "" && t.Amount.Minor() > f.MaxAmount.Minor():
+		return false
+	}
+	return true
+}
+
+// limit returns the page size, or an error for one out of range
+func (f Filter) limit() (int, error) {
+	switch {
+	case f.Limit == 0:
+		return DefaultLimit, nil
+	case f.Limit < 0 || f.Limit > MaxLimit:
+		return 0, ErrInvalidLimit
+	}
+	return f.Limit, nil
+}
+
+// before returns the sequence number a page starts below, zero for the
+// first page
+func (f Filter) before() (int64, error) {
+	if f.Cursor == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(f.Cursor, 10, 64)
+	if err != nil || seq < 1 {
+		return 0, ErrInvalidCursor
+	}
+	return seq, nil
+}
+
+// Page is one page of transactions, newest first
+type Page struct {
+	Transactions []Transaction `json:"transactions"`
+	// NextCursor fetches the following page; empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// page builds a page from up to limit+1 matches, the extra one showing
+// there is more to come
+func page(matches []Transaction, limit int) Page {
+	p := Page{Transactions: matches}
+	if len(matches) > limit {
+		p.Transactions = matches[:limit]
+		p.NextCursor = strconv.FormatInt(p.Transactions[limit-1].Seq, 10)
+	}
+	return p
+}
+
+// Store records processed transactions
+type Store interface {
+	// Save stores a transaction, assigning its Seq and, when zero, its
+	// CreatedAt
+	Save(ctx context.Context, t Transaction) (Transaction, error)
+	List(ctx context.Context, filter Filter) (Page, error)
+}
+
+// MemoryStore keeps the most recent transactions in process. Older ones are
+// dropped beyond its size and everything is lost on restart; set
+// DATABASE_URL for a durable history.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	transactions []Transaction
+	nextSeq      int64
+	size         int
+}
+
+// NewMemoryStore creates an in-memory store retaining up to size
+// transactions
+func NewMemoryStore(size int) *MemoryStore {
+	if size < 1 {
+		size = DefaultMemorySize
+	}
+	return &MemoryStore{nextSeq: 1, size: size}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, t Transaction) (Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t = prepare(t)
+	t.Seq = s.nextSeq
+	s.nextSeq++
+	s.transactions = append(s.transactions, t)
+	if len(s.transactions) > s.size {
+		s.transactions = append([]Transaction(nil), s.transactions[len(s.transactions)-s.size:]...)
+	}
+	return t, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, filter Filter) (Page, error) {
+	limit, err := filter.limit()
+	if err != nil {
+		return Page{}, err
+	}
+	before, err := filter.before()
+	if err != nil {
+		return Page{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matches := []Transaction{}
+	for i := len(s.transactions) - 1; i >= 0 && len(matches) <= limit; i-- {
+		t := s.transactions[i]
+		if (before == 0 || t.Seq < before) && filter.matches(t) {
+			matches = append(matches, t)
+		}
+	}
+	return page(matches, limit), nil
+}
+
+// prepare fills in the creation time, kept to the microsecond both
+// databases store
+func prepare(t Transaction) Transaction {
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	t.CreatedAt = t.CreatedAt.UTC().Truncate(time.Microsecond)
+	return t
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
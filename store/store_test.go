@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	day := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	for i, tx := range []Transaction{
+		{TransactionID: "1", MerchantID: "m1", Type: "sale", Status: StatusApproved, Amount: "10.00"},
+		{TransactionID: "2", MerchantID: "m1", Type: "refund", Status: StatusApproved, Amount: "5.00"},
+		{MerchantID: "m1", Type: "sale", Status: StatusDeclined, Amount: "250.00"},
+		{TransactionID: "4", MerchantID: "m2", Type: "sale", Status: StatusApproved, Amount: "99.99"},
+		{TransactionID: "5", MerchantID: "m1", Type: "auth", Status: StatusApproved, Amount: "100.00"},
+	} {
+		tx.CreatedAt = day.Add(time.Duration(i) * time.Hour)
+		saved, err := s.Save(ctx, tx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), saved.Seq)
+	}
+
+	ids := func(p Page) []string {
+		var got []string
+		for _, tx := range p.Transactions {
+			got = append(got, tx.TransactionID+"/"+string(tx.Amount))
+		}
+		return got
+	}
+	list := func(filter Filter) Page {
+		p, err := s.List(ctx, filter)
+		require.NoError(t, err)
+		return p
+	}
+
+	all := list(Filter{})
+	assert.Equal(t, []string{"5/100.00", "4/99.99", "/250.00", "2/5.00", "1/10.00"}, ids(all))
+	assert.Empty(t, all.NextCursor)
+	assert.True(t, day.Equal(all.Transactions[4].CreatedAt))
+
+	assert.Equal(t, []string{"/250.00", "1/10.00"}, ids(list(Filter{MerchantID: "m1", Types: []string{"sale"}})))
+	assert.Equal(t, []string{"/250.00"}, ids(list(Filter{Statuses: []string{StatusDeclined, StatusError}})))
+	assert.Equal(t, []string{"/250.00", "2/5.00"}, ids(list(Filter{From: day.Add(time.Hour), To: day.Add(3 * time.Hour)})))
+	assert.Equal(t, []string{"5/100.00", "4/99.99", "1/10.00"}, ids(list(Filter{MinAmount: "10.00", MaxAmount: "100.00"})))
+
+	// Cursor paging walks every match exactly once
+	first := list(Filter{MerchantID: "m1", Limit: 2})
+	assert.Equal(t, []string{"5/100.00", "/250.00"}, ids(first))
+	require.NotEmpty(t, first.NextCursor)
+	second := list(Filter{MerchantID: "m1", Limit: 2, Cursor: first.NextCursor})
+	assert.Equal(t, []string{"2/5.00", "1/10.00"}, ids(second))
+	assert.Empty(t, second.NextCursor)
+
+	_, err := s.List(ctx, Filter{Cursor: "abc"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = s.List(ctx, Filter{Limit: MaxLimit + 1})
+	assert.ErrorIs(t, err, ErrInvalidLimit)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(DefaultMemorySize))
+}
+
+func TestMemoryStoreDropsOldest(t *testing.T) {
+	s := NewMemoryStore(2)
+	for _, id := range []string{"1", "2", "3"} {
+		_, err := s.Save(context.Background(), Transaction{TransactionID: id, Amount: api.Amount("1.00")})
+		require.NoError(t, err)
+	}
+	p, err := s.List(context.Background(), Filter{})
+	require.NoError(t, err)
+	require.Len(t, p.Transactions, 2)
+	assert.Equal(t, "3", p.Transactions[0].TransactionID)
+	assert.Equal(t, "2", p.Transactions[1].TransactionID)
+}
+
+func TestSQLStore(t *testing.T) {
+	database, err := db.Open(context.Background(), "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	s, err := NewSQLStore(context.Background(), database)
+	require.NoError(t, err)
+	testStore(t, s)
+}
@@ -0,0 +1,110 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/logctx"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// etag formats a mapping version as an HTTP entity tag
+func etag(m Mapping) string {
+	return `"` + strconv.Itoa(m.Version) + `"`
+}
+
+// HandleList lists every terminal mapping
+func HandleList(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mappings, err := store.List(r.Context())
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to list terminal mappings")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load terminal mappings")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Mapping{"terminals": mappings})
+	}
+}
+
+// HandlePut creates or replaces the mapping for the terminal in the path
+func HandlePut(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m Mapping
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+		m.TerminalID = mux.Vars(r)["terminal_id"]
+		if err := m.Validate(); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, err.Error())
+			return
+		}
+
+		stored, err := store.Put(r.Context(), m)
+		if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to store terminal mapping")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to store terminal mapping")
+			return
+		}
+
+		logctx.From(r.Context()).WithFields(logrus.Fields{
+			"terminal_id": stored.TerminalID,
+			"merchant_id": stored.MerchantID,
+			"version":     stored.Version,
+		}).Info("Terminal mapping stored")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(stored))
+		json.NewEncoder(w).Encode(stored)
+	}
+}
+
+// HandleDelete removes the mapping for the terminal in the path
+func HandleDelete(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := store.Delete(r.Context(), mux.Vars(r)["terminal_id"])
+		if errors.Is(err, ErrNotFound) {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		} else if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to delete terminal mapping")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to delete terminal mapping")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleConfig lets a device check for new configuration between inits. It
+// answers 304 when If-None-Match carries the current version's ETag; the
+// config_version query parameter works the same way for devices that
+// cannot send headers.
+func HandleConfig(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, err := store.Get(r.Context(), mux.Vars(r)["terminal_id"])
+		if errors.Is(err, ErrNotFound) {
+			api.WriteErrorCode(w, r, api.ErrNotFound, err.Error())
+			return
+		} else if err != nil {
+			logctx.From(r.Context()).WithError(err).Error("Failed to load terminal mapping")
+			api.WriteErrorCode(w, r, api.ErrInternal, "Failed to load terminal mapping")
+			return
+		}
+
+		deviceVersion, _ := strconv.Atoi(r.URL.Query().Get("config_version"))
+		w.Header().Set("ETag", etag(m))
+		if r.Header.Get("If-None-Match") == etag(m) || deviceVersion == m.Version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Sync(m, deviceVersion))
+	}
+}
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS terminal_mappings (
+    terminal_id      TEXT PRIMARY KEY,
+    merchant_id      TEXT NOT NULL,
+    register         TEXT NOT NULL DEFAULT '',
+    tax_jurisdiction TEXT NOT NULL DEFAULT '',
+    config           TEXT NOT NULL DEFAULT '{}',
+    version          INTEGER NOT NULL,
+    updated_at       TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS terminal_mappings_merchant_id ON terminal_mappings (merchant_id);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS terminals (
+    terminal_id         TEXT PRIMARY KEY,
+    merchant_id         TEXT NOT NULL,
+    nickname            TEXT NOT NULL DEFAULT '',
+    serial_number       TEXT NOT NULL DEFAULT '',
+    model               TEXT NOT NULL DEFAULT '',
+    firmware_version    TEXT NOT NULL DEFAULT '',
+    status              TEXT NOT NULL,
+    last_seen           TIMESTAMP NOT NULL,
+    current_transaction TEXT NOT NULL DEFAULT '',
+    registered_at       TIMESTAMP NOT NULL,
+    updated_at          TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS terminals_merchant_id ON terminals (merchant_id);
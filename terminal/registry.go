@@ -0,0 +1,183 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"nmi-pay-int/api"
+)
+
+// ErrNotRegistered is returned for a terminal the registry has not seen
+var ErrNotRegistered = errors.New("terminal not registered")
+
+// Terminal is a payment device registered with the gateway, as the service
+// last saw it
+type Terminal struct {
+	ID              string `json:"terminal_id"`
+	MerchantID      string `json:"merchant_id"`
+	Nickname        string `json:"nickname,omitempty"`
+	SerialNumber    string `json:"serial_number,omitempty"`
+	Model           string `json:"model,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	// Status is the connection state the gateway last reported: online,
+	// busy or offline
+	Status string `json:"status"`
+	// LastSeen is the last heartbeat: when the gateway last reported the
+	// terminal connected
+	LastSeen time.Time `json:"last_seen"`
+	// CurrentTransaction is the async status ID of the payment the terminal
+	// is prompting for, empty while it is idle
+	CurrentTransaction string    `json:"current_transaction,omitempty"`
+	RegisteredAt       time.Time `json:"registered_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// FromDevice describes a device the gateway reported at now for the given
+// merchant. A connected device counts as seen now.
+func FromDevice(merchantID string, device *api.Device, now time.Time) Terminal {
+	t := Terminal{
+		ID:              device.ID,
+		MerchantID:      merchantID,
+		Nickname:        device.Nickname,
+		SerialNumber:    device.SerialNumber,
+		Model:           device.Model,
+		FirmwareVersion: device.FirmwareVersion,
+		Status:          device.Status,
+	}
+	if device.Status != api.DeviceOffline {
+		t.LastSeen = now.UTC()
+	} else if device.LastSeen != nil {
+		t.LastSeen = device.LastSeen.UTC()
+	}
+	return t
+}
+
+// Online reports whether the terminal was connected at its last heartbeat
+// and that heartbeat is no older than staleAfter
+func (t Terminal) Online(now time.Time, staleAfter time.Duration) bool {
+	return t.Status != api.DeviceOffline && now.Sub(t.LastSeen) <= staleAfter
+}
+
+// merge applies a fresh report to the stored terminal. Details the report
+// leaves empty, the registration time and the current transaction are
+// kept, and the heartbeat only moves forward.
+func merge(stored, report Terminal, now time.Time) Terminal {
+	merged := report
+	merged.RegisteredAt = stored.RegisteredAt
+	merged.CurrentTransaction = stored.CurrentTransaction
+	merged.UpdatedAt = now
+	if merged.RegisteredAt.IsZero() {
+		merged.RegisteredAt = now
+	}
+	if merged.MerchantID == "" {
+		merged.MerchantID = stored.MerchantID
+	}
+	if merged.Nickname == "" {
+		merged.Nickname = stored.Nickname
+	}
+	if merged.SerialNumber == "" {
+		merged.SerialNumber = stored.SerialNumber
+	}
+	if merged.Model == "" {
+		merged.Model = stored.Model
+	}
+	if merged.FirmwareVersion == "" {
+		merged.FirmwareVersion = stored.FirmwareVersion
+	}
+	if merged.LastSeen.Before(stored.LastSeen) {
+		merged.LastSeen = stored.LastSeen
+	}
+	return merged
+}
+
+// Registry tracks the terminals registered with the gateway
+type Registry interface {
+	// Record stores what the gateway reported about a terminal,
+	// registering it the first time it is seen
+	Record(ctx context.Context, t Terminal) (Terminal, error)
+	Get(ctx context.Context, terminalID string) (Terminal, error)
+	// List returns the terminals of a merchant, or of every merchant when
+	// merchantID is empty, ordered by terminal ID
+	List(ctx context.Context, merchantID string) ([]Terminal, error)
+	// SetTransaction records the payment a terminal is prompting for
+	SetTransaction(ctx context.Context, terminalID, transaction string) error
+	// ClearTransaction marks the terminal prompting for transaction idle.
+	// It is not an error when no terminal is.
+	ClearTransaction(ctx context.Context, transaction string) error
+}
+
+// MemoryRegistry keeps terminals in process
+type MemoryRegistry struct {
+	mu        sync.RWMutex
+	terminals map[string]Terminal
+}
+
+// NewMemoryRegistry creates an empty registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{terminals: make(map[string]Terminal)}
+}
+
+func (r *MemoryRegistry) Record(ctx context.Context, t Terminal) (Terminal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	merged := merge(r.terminals[t.ID], t, time.Now().UTC())
+	r.terminals[t.ID] = merged
+	return merged, nil
+}
+
+func (r *MemoryRegistry) Get(ctx context.Context, terminalID string) (Terminal, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.terminals[terminalID]
+	if !ok {
+		return Terminal{}, ErrNotRegistered
+	}
+	return t, nil
+}
+
+func (r *MemoryRegistry) List(ctx context.Context, merchantID string) ([]Terminal, error) {
+	r.mu.RLock()
+	terminals := []Terminal{}
+	for _, t := range r.terminals {
+		if merchantID == "" || t.MerchantID == merchantID {
+			terminals = append(terminals, t)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(terminals, func(i, j int) bool { return terminals[i].ID < terminals[j].ID })
+	return terminals, nil
+}
+
+func (r *MemoryRegistry) SetTransaction(ctx context.Context, terminalID, transaction string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.terminals[terminalID]
+	if !ok {
+		return ErrNotRegistered
+	}
+	t.CurrentTransaction = transaction
+	t.UpdatedAt = time.Now().UTC()
+	r.terminals[terminalID] = t
+	return nil
+}
+
+func (r *MemoryRegistry) ClearTransaction(ctx context.Context, transaction string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, t := range r.terminals {
+		if t.CurrentTransaction == transaction {
+			t.CurrentTransaction = ""
+			t.UpdatedAt = time.Now().UTC()
+			r.terminals[id] = t
+		}
+	}
+	return nil
+}
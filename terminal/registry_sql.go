@@ -0,0 +1,110 @@
+package terminal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"nmi-pay-int/db"
+)
+
+// SQLRegistry keeps terminals in Postgres or SQLite. It shares the schema
+// NewSQLStore migrates.
+type SQLRegistry struct {
+	db *db.DB
+}
+
+// NewSQLRegistry returns a registry on a database NewSQLStore has migrated
+func NewSQLRegistry(database *db.DB) *SQLRegistry {
+	return &SQLRegistry{db: database}
+}
+
+const terminalColumns = `terminal_id, merchant_id, nickname, serial_number, model, firmware_version, status, last_seen, current_transaction, registered_at, updated_at`
+
+func scanTerminal(row interface{ Scan(...any) error }) (Terminal, error) {
+	var t Terminal
+	err := row.Scan(&t.ID, &t.MerchantID, &t.Nickname, &t.SerialNumber, &t.Model, &t.FirmwareVersion,
+		&t.Status, &t.LastSeen, &t.CurrentTransaction, &t.RegisteredAt, &t.UpdatedAt)
+	return t, err
+}
+
+// Record merges the report into the stored terminal. The current
+// transaction is left to SetTransaction so a heartbeat cannot undo it.
+func (r *SQLRegistry) Record(ctx context.Context, t Terminal) (Terminal, error) {
+	stored, err := r.Get(ctx, t.ID)
+	if err != nil && !errors.Is(err, ErrNotRegistered) {
+		return Terminal{}, err
+	}
+	merged := merge(stored, t, time.Now().UTC())
+
+	// ON CONFLICT ... DO UPDATE is understood by both Postgres and SQLite
+	_, err = r.db.ExecContext(ctx, r.db.Rebind(`INSERT INTO terminals (`+terminalColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (terminal_id) DO UPDATE SET
+			merchant_id = excluded.merchant_id,
+			nickname = excluded.nickname,
+			serial_number = excluded.serial_number,
+			model = excluded.model,
+			firmware_version = excluded.firmware_version,
+			status = excluded.status,
+			last_seen = excluded.last_seen,
+			updated_at = excluded.updated_at`),
+		merged.ID, merged.MerchantID, merged.Nickname, merged.SerialNumber, merged.Model, merged.FirmwareVersion,
+		merged.Status, merged.LastSeen, merged.CurrentTransaction, merged.RegisteredAt, merged.UpdatedAt)
+	if err != nil {
+		return Terminal{}, err
+	}
+	return merged, nil
+}
+
+func (r *SQLRegistry) Get(ctx context.Context, terminalID string) (Terminal, error) {
+	t, err := scanTerminal(r.db.QueryRowContext(ctx,
+		r.db.Rebind(`SELECT `+terminalColumns+` FROM terminals WHERE terminal_id = ?`), terminalID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Terminal{}, ErrNotRegistered
+	}
+	return t, err
+}
+
+func (r *SQLRegistry) List(ctx context.Context, merchantID string) ([]Terminal, error) {
+	query, args := `SELECT `+terminalColumns+` FROM terminals ORDER BY terminal_id`, []any{}
+	if merchantID != "" {
+		query, args = `SELECT `+terminalColumns+` FROM terminals WHERE merchant_id = ? ORDER BY terminal_id`, []any{merchantID}
+	}
+	rows, err := r.db.QueryContext(ctx, r.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	terminals := []Terminal{}
+	for rows.Next() {
+		t, err := scanTerminal(rows)
+		if err != nil {
+			return nil, err
+		}
+		terminals = append(terminals, t)
+	}
+	return terminals, rows.Err()
+}
+
+func (r *SQLRegistry) SetTransaction(ctx context.Context, terminalID, transaction string) error {
+	result, err := r.db.ExecContext(ctx, r.db.Rebind(`UPDATE terminals SET current_transaction = ?, updated_at = ? WHERE terminal_id = ?`),
+		transaction, time.Now().UTC(), terminalID)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrNotRegistered
+	}
+	return nil
+}
+
+func (r *SQLRegistry) ClearTransaction(ctx context.Context, transaction string) error {
+	_, err := r.db.ExecContext(ctx, r.db.Rebind(`UPDATE terminals SET current_transaction = '', updated_at = ? WHERE current_transaction = ?`),
+		time.Now().UTC(), transaction)
+	return err
+}
@@ -0,0 +1,79 @@
+package terminal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRegistry(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	seen := time.Date(2026, 10, 16, 15, 4, 5, 0, time.UTC)
+	device := &api.Device{ID: "dev-1", Nickname: "Store-01", FirmwareVersion: "2.1.4", Status: api.DeviceOnline}
+
+	registered, err := registry.Record(ctx, FromDevice("m1", device, seen))
+	require.NoError(t, err)
+	assert.False(t, registered.RegisteredAt.IsZero())
+	require.NoError(t, registry.SetTransaction(ctx, "dev-1", "guid-1"))
+
+	// An offline report keeps the last heartbeat, the details it leaves out
+	// and the payment in progress
+	offline, err := registry.Record(ctx, FromDevice("m1", &api.Device{ID: "dev-1", Status: api.DeviceOffline}, seen.Add(time.Minute)))
+	require.NoError(t, err)
+	got, err := registry.Get(ctx, "dev-1")
+	require.NoError(t, err)
+	assert.Equal(t, offline.Status, got.Status)
+	assert.Equal(t, api.DeviceOffline, got.Status)
+	assert.True(t, seen.Equal(got.LastSeen), "got %s", got.LastSeen)
+	assert.Equal(t, "2.1.4", got.FirmwareVersion)
+	assert.Equal(t, "guid-1", got.CurrentTransaction)
+	assert.True(t, registered.RegisteredAt.Equal(got.RegisteredAt))
+
+	_, err = registry.Record(ctx, FromDevice("m2", &api.Device{ID: "dev-0", Status: api.DeviceBusy}, seen))
+	require.NoError(t, err)
+	all, err := registry.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "dev-0", all[0].ID)
+	mine, err := registry.List(ctx, "m1")
+	require.NoError(t, err)
+	require.Len(t, mine, 1)
+	assert.Equal(t, "dev-1", mine[0].ID)
+
+	require.NoError(t, registry.ClearTransaction(ctx, "guid-1"))
+	got, err = registry.Get(ctx, "dev-1")
+	require.NoError(t, err)
+	assert.Empty(t, got.CurrentTransaction)
+
+	_, err = registry.Get(ctx, "dev-2")
+	assert.ErrorIs(t, err, ErrNotRegistered)
+	assert.ErrorIs(t, registry.SetTransaction(ctx, "dev-2", "guid-2"), ErrNotRegistered)
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistry(t, NewMemoryRegistry())
+}
+
+func TestSQLRegistry(t *testing.T) {
+	database, err := db.Open(context.Background(), "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	_, err = NewSQLStore(context.Background(), database)
+	require.NoError(t, err)
+	testRegistry(t, NewSQLRegistry(database))
+}
+
+func TestTerminalOnline(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	online := Terminal{Status: api.DeviceOnline, LastSeen: now.Add(-time.Minute)}
+	assert.True(t, online.Online(now, 2*time.Minute))
+	assert.False(t, online.Online(now.Add(2*time.Minute), 2*time.Minute))
+	assert.False(t, Terminal{Status: api.DeviceOffline, LastSeen: now}.Online(now, time.Minute))
+}
@@ -0,0 +1,230 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/metrics"
+
+	"github.com/google/uuid"
+)
+
+// Payment session states
+const (
+	SessionPending = "pending"
+	// SessionComplete has the gateway's result, approved or declined
+	SessionComplete  = "complete"
+	SessionCancelled = "cancelled"
+	// SessionFailed could not learn the result, or the cardholder did not
+	// finish within SessionTimeout
+	SessionFailed = "failed"
+)
+
+const (
+	// SessionTimeout is how long a terminal payment may wait for the
+	// cardholder before its prompt is cancelled
+	SessionTimeout = 5 * time.Minute
+	// SessionRetention is how long finished sessions can still be polled
+	SessionRetention = time.Hour
+)
+
+// ErrSessionNotFound is returned for an unknown or expired payment session
+var ErrSessionNotFound = errors.New("payment session not found")
+
+// PaymentSession is a payment sent to a terminal and followed in the
+// background until the cardholder finishes it
+type PaymentSession struct {
+	ID         string `json:"payment_session_id"`
+	MerchantID string `json:"merchant_id"`
+	TerminalID string `json:"terminal_id"`
+	Status     string `json:"status"`
+	// Payment is the latest answer about the payment: pending with its
+	// async status ID, then the gateway's result
+	Payment *api.TerminalResponse `json:"payment,omitempty"`
+	// Error is why a failed session has no result
+	Error     *api.NMIError `json:"error,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// Finished reports whether the session has reached its final state
+func (s PaymentSession) Finished() bool {
+	return s.Status != SessionPending
+}
+
+// sessionEntry is a session and the channel closed on its next change
+type sessionEntry struct {
+	session PaymentSession
+	changed chan struct{}
+}
+
+// Sessions runs terminal payments asynchronously, so a request does not
+// have to outlast the cardholder. Sessions are held in memory.
+type Sessions struct {
+	client   *api.Client
+	registry Registry
+	// finished is called once with every session that reaches its final
+	// state
+	finished func(PaymentSession)
+
+	mu      sync.Mutex
+	entries map[string]*sessionEntry
+}
+
+// NewSessions creates the session tracker. Terminals' current transactions
+// are kept in registry, and finished, when not nil, is told about each
+// finished session.
+func NewSessions(client *api.Client, registry Registry, finished func(PaymentSession)) *Sessions {
+	return &Sessions{
+		client:   client,
+		registry: registry,
+		finished: finished,
+		entries:  make(map[string]*sessionEntry),
+	}
+}
+
+// Start sends the payment to the terminal and returns its session without
+// waiting for the cardholder. An error sending the payment, or a decline,
+// is returned; a payment the gateway answers without prompting gives a
+// finished session.
+func (s *Sessions) Start(ctx context.Context, merchantID string, req api.TerminalPaymentRequest) (PaymentSession, error) {
+	started, err := s.client.StartTerminalPayment(ctx, req)
+	if err != nil {
+		return PaymentSession{}, err
+	}
+
+	now := time.Now().UTC()
+	session := PaymentSession{
+		ID:         uuid.NewString(),
+		MerchantID: merchantID,
+		TerminalID: req.TerminalID,
+		Status:     SessionPending,
+		Payment:    started,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if started.Status != api.TerminalPaymentPending {
+		session.Status = SessionComplete
+	}
+
+	s.mu.Lock()
+	s.prune(now)
+	s.entries[session.ID] = &sessionEntry{session: session, changed: make(chan struct{})}
+	s.mu.Unlock()
+
+	if session.Finished() {
+		s.notify(session)
+		return session, nil
+	}
+
+	if err := s.registry.SetTransaction(ctx, req.TerminalID, started.AsyncStatusID); err != nil && !errors.Is(err, ErrNotRegistered) {
+		metrics.LogError(ctx, fmt.Errorf("failed to record payment on terminal %s: %v", req.TerminalID, err))
+	}
+	// The payment outlives the request but keeps its merchant and log fields
+	go s.follow(context.WithoutCancel(ctx), req.APIKey, session.ID, started)
+	return session, nil
+}
+
+// follow waits for the cardholder and records the result. A payment still
+// pending after SessionTimeout has its prompt cancelled.
+func (s *Sessions) follow(ctx context.Context, apiKey, id string, started *api.TerminalResponse) {
+	waitCtx, cancel := context.WithTimeout(ctx, SessionTimeout)
+	defer cancel()
+
+	resp := started
+	var err error
+	for resp.Status == api.TerminalPaymentPending && waitCtx.Err() == nil {
+		// Each wait ends after api.MaxDeviceWait; keep waiting until the
+		// session times out
+		current, waitErr := s.client.WaitForTerminalPayment(waitCtx, apiKey, started)
+		if waitErr != nil {
+			if waitCtx.Err() == nil {
+				err = waitErr
+			}
+			break
+		}
+		resp = current
+	}
+
+	status := SessionComplete
+	var nmiErr *api.NMIError
+	switch {
+	case err != nil:
+		status = SessionFailed
+		if !errors.As(err, &nmiErr) {
+			nmiErr = api.NewNMIError(api.ErrInternal, err.Error(), "")
+		}
+	case resp.Status == api.TerminalPaymentPending:
+		status = SessionFailed
+		nmiErr = api.NewNMIError(api.ErrDeadlineExceeded, "the cardholder did not finish the payment in time", "")
+		cancelCtx, cancelCancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := s.client.CancelDevicePrompt(cancelCtx, apiKey, started.TerminalID); err != nil {
+			metrics.LogError(ctx, fmt.Errorf("failed to cancel timed out prompt on terminal %s: %v", started.TerminalID, err))
+		}
+		cancelCancel()
+	case resp.Status == api.TerminalPaymentCancelled:
+		status = SessionCancelled
+	}
+
+	if err := s.registry.ClearTransaction(ctx, started.AsyncStatusID); err != nil {
+		metrics.LogError(ctx, fmt.Errorf("failed to clear payment on terminal %s: %v", started.TerminalID, err))
+	}
+	s.notify(s.finish(id, status, resp, nmiErr))
+}
+
+// notify passes a finished session to the finished callback, if there is
+// one
+func (s *Sessions) notify(session PaymentSession) {
+	if s.finished != nil {
+		s.finished(session)
+	}
+}
+
+// finish records a session's final state and wakes its watchers
+func (s *Sessions) finish(id, status string, resp *api.TerminalResponse, nmiErr *api.NMIError) PaymentSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.entries[id]
+	entry.session.Status = status
+	entry.session.Payment = resp
+	entry.session.Error = nmiErr
+	entry.session.UpdatedAt = time.Now().UTC()
+	close(entry.changed)
+	entry.changed = make(chan struct{})
+	return entry.session
+}
+
+// Get returns a session of the given merchant. Another merchant's session
+// is reported as not found.
+func (s *Sessions) Get(merchantID, id string) (PaymentSession, error) {
+	session, _, err := s.Watch(merchantID, id)
+	return session, err
+}
+
+// Watch returns a session of the given merchant and a channel closed when
+// it next changes
+func (s *Sessions) Watch(merchantID, id string) (PaymentSession, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[id]
+	if !ok || entry.session.MerchantID != merchantID {
+		return PaymentSession{}, nil, ErrSessionNotFound
+	}
+	return entry.session, entry.changed, nil
+}
+
+// prune forgets sessions finished more than SessionRetention ago. The
+// caller holds s.mu.
+func (s *Sessions) prune(now time.Time) {
+	for id, entry := range s.entries {
+		if entry.session.Finished() && now.Sub(entry.session.UpdatedAt) > SessionRetention {
+			delete(s.entries, id)
+		}
+	}
+}
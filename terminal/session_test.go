@@ -0,0 +1,140 @@
+package terminal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sessionGateway answers a payment on terminal dev-1 after one pending status
+// poll, and approves payments on any other terminal without prompting
+type sessionGateway struct {
+	mu        sync.Mutex
+	cancelled bool
+	polled    bool
+}
+
+func (g *sessionGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/transact.php":
+		r.ParseForm()
+		if r.PostForm.Get("poi_device_id") != "dev-1" {
+			w.Write([]byte("response=1&responsetext=SUCCESS&transactionid=9002&amount=25.99&response_code=100"))
+			return
+		}
+		w.Write([]byte("response=1&responsetext=Pending&async_status_guid=guid-1&response_code=100"))
+	case "/v2/devices/dev-1/cancel":
+		g.cancelled = true
+		w.Write([]byte(`{}`))
+	case "/v2/async/guid-1":
+		switch {
+		case g.cancelled:
+			w.Write([]byte(`{"status":"cancelled"}`))
+		case !g.polled:
+			g.polled = true
+			w.Write([]byte(`{"status":"pending"}`))
+		default:
+			w.Write([]byte(`{"status":"complete","response":"response=1&responsetext=SUCCESS&transactionid=9001&amount=25.99&response_code=100"}`))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestSessions(t *testing.T, gateway *sessionGateway, registry Registry) (*Sessions, <-chan PaymentSession) {
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+	client := api.NewClient(&config.Config{
+		APIBaseURL:   server.URL + "/transact.php",
+		DeviceAPIURL: server.URL + "/v2",
+	})
+
+	finished := make(chan PaymentSession, 1)
+	return NewSessions(client, registry, func(s PaymentSession) { finished <- s }), finished
+}
+
+func awaitSession(t *testing.T, finished <-chan PaymentSession) PaymentSession {
+	select {
+	case session := <-finished:
+		return session
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not finish")
+		return PaymentSession{}
+	}
+}
+
+func TestSessionComplete(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	_, err := registry.Record(ctx, Terminal{ID: "dev-1", MerchantID: "m1", Status: api.DeviceOnline})
+	require.NoError(t, err)
+	sessions, finished := newTestSessions(t, &sessionGateway{}, registry)
+
+	session, err := sessions.Start(ctx, "m1", api.TerminalPaymentRequest{APIKey: "key", TerminalID: "dev-1", Amount: "25.99"})
+	require.NoError(t, err)
+	assert.Equal(t, SessionPending, session.Status)
+	assert.Equal(t, "guid-1", session.Payment.AsyncStatusID)
+
+	_, changed, err := sessions.Watch("m1", session.ID)
+	require.NoError(t, err)
+	_, err = sessions.Get("m2", session.ID)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	done := awaitSession(t, finished)
+	assert.Equal(t, SessionComplete, done.Status)
+	assert.Equal(t, "9001", done.Payment.TransactionID)
+	assert.True(t, done.Payment.Success)
+	assert.Nil(t, done.Error)
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("watchers were not told the session finished")
+	}
+	got, err := sessions.Get("m1", session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, SessionComplete, got.Status)
+
+	stored, err := registry.Get(ctx, "dev-1")
+	require.NoError(t, err)
+	assert.Empty(t, stored.CurrentTransaction)
+}
+
+func TestSessionCancelled(t *testing.T) {
+	gateway := &sessionGateway{}
+	sessions, finished := newTestSessions(t, gateway, NewMemoryRegistry())
+
+	session, err := sessions.Start(context.Background(), "m1", api.TerminalPaymentRequest{APIKey: "key", TerminalID: "dev-1", Amount: "25.99"})
+	require.NoError(t, err)
+	require.False(t, session.Finished())
+	require.NoError(t, sessions.client.CancelDevicePrompt(context.Background(), "key", "dev-1"))
+
+	assert.Equal(t, SessionCancelled, awaitSession(t, finished).Status)
+}
+
+func TestSessionAnsweredAtOnce(t *testing.T) {
+	sessions, finished := newTestSessions(t, &sessionGateway{}, NewMemoryRegistry())
+
+	// A payment the gateway answers without prompting has its result
+	// straight away
+	session, err := sessions.Start(context.Background(), "m1", api.TerminalPaymentRequest{APIKey: "key", TerminalID: "dev-9", Amount: "25.99"})
+	require.NoError(t, err)
+	assert.Equal(t, SessionComplete, session.Status)
+	assert.Equal(t, "9002", session.Payment.TransactionID)
+	assert.Equal(t, session.ID, awaitSession(t, finished).ID)
+
+	_, err = sessions.Start(context.Background(), "m1", api.TerminalPaymentRequest{APIKey: "key", Amount: "25.99"})
+	assert.Error(t, err)
+}
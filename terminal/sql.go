@@ -0,0 +1,149 @@
+package terminal
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"time"
+
+	"nmi-pay-int/db"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// putAttempts bounds retries when two writers change the same mapping at
+// once
+const putAttempts = 5
+
+// errConcurrentPut is returned when another writer changed the mapping
+// between the read and the write
+var errConcurrentPut = errors.New("terminal mapping changed concurrently")
+
+// SQLStore keeps mappings in Postgres or SQLite
+type SQLStore struct {
+	db *db.DB
+}
+
+// NewSQLStore migrates the terminal mapping schema and returns a store
+func NewSQLStore(ctx context.Context, database *db.DB) (*SQLStore, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Migrate(ctx, "terminal", migrations); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: database}, nil
+}
+
+const mappingColumns = `terminal_id, merchant_id, register, tax_jurisdiction, config, version, updated_at`
+
+func scanMapping(row interface{ Scan(...any) error }) (Mapping, error) {
+	var m Mapping
+	var config string
+	if err := row.Scan(&m.TerminalID, &m.MerchantID, &m.Register, &m.TaxJurisdiction, &config, &m.Version, &m.UpdatedAt); err != nil {
+		return Mapping{}, err
+	}
+	return m, json.Unmarshal([]byte(config), &m.Config)
+}
+
+func (s *SQLStore) Get(ctx context.Context, terminalID string) (Mapping, error) {
+	m, err := scanMapping(s.db.QueryRowContext(ctx,
+		s.db.Rebind(`SELECT `+mappingColumns+` FROM terminal_mappings WHERE terminal_id = ?`), terminalID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Mapping{}, ErrNotFound
+	}
+	return m, err
+}
+
+func (s *SQLStore) List(ctx context.Context) ([]Mapping, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+mappingColumns+` FROM terminal_mappings ORDER BY terminal_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mappings := []Mapping{}
+	for rows.Next() {
+		m, err := scanMapping(rows)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, rows.Err()
+}
+
+// Put compares against the stored mapping and writes only on a change,
+// guarding the write with the version it read
+func (s *SQLStore) Put(ctx context.Context, m Mapping) (Mapping, error) {
+	var err error
+	for attempt := 0; attempt < putAttempts; attempt++ {
+		var stored Mapping
+		if stored, err = s.put(ctx, m); !errors.Is(err, errConcurrentPut) {
+			return stored, err
+		}
+	}
+	return Mapping{}, err
+}
+
+func (s *SQLStore) put(ctx context.Context, m Mapping) (Mapping, error) {
+	current, err := s.Get(ctx, m.TerminalID)
+	switch {
+	case err == nil && sameContent(current, m):
+		return current, nil
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return Mapping{}, err
+	}
+
+	config, err := json.Marshal(m.Config)
+	if err != nil {
+		return Mapping{}, err
+	}
+	m.Version = current.Version + 1
+	m.UpdatedAt = time.Now().UTC()
+
+	if current.Version == 0 {
+		_, err = s.db.ExecContext(ctx, s.db.Rebind(`INSERT INTO terminal_mappings (`+mappingColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			m.TerminalID, m.MerchantID, m.Register, m.TaxJurisdiction, string(config), m.Version, m.UpdatedAt)
+		if db.IsUniqueViolation(err) {
+			return Mapping{}, errConcurrentPut
+		}
+		if err != nil {
+			return Mapping{}, err
+		}
+		return m, nil
+	}
+
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(`UPDATE terminal_mappings
+		SET merchant_id = ?, register = ?, tax_jurisdiction = ?, config = ?, version = ?, updated_at = ?
+		WHERE terminal_id = ? AND version = ?`),
+		m.MerchantID, m.Register, m.TaxJurisdiction, string(config), m.Version, m.UpdatedAt,
+		m.TerminalID, current.Version)
+	if err != nil {
+		return Mapping{}, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return Mapping{}, err
+	} else if updated == 0 {
+		return Mapping{}, errConcurrentPut
+	}
+	return m, nil
+}
+
+func (s *SQLStore) Delete(ctx context.Context, terminalID string) error {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(`DELETE FROM terminal_mappings WHERE terminal_id = ?`), terminalID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
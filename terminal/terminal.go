@@ -0,0 +1,190 @@
+// Package terminal maps payment terminals to the merchant, register (lane)
+// and tax jurisdiction they serve, and holds the configuration pushed to
+// each device when it initializes.
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxSurchargePercent is the card brand cap on surcharges
+const MaxSurchargePercent = 3.0
+
+// ErrNotFound is returned for a terminal without a mapping
+var ErrNotFound = errors.New("terminal mapping not found")
+
+// TipPrompt configures the device's tip screen
+type TipPrompt struct {
+	Enabled bool `json:"enabled"`
+	// Percentages are the suggested tips, e.g. 15, 18, 20
+	Percentages []int `json:"percentages,omitempty"`
+	AllowCustom bool  `json:"allow_custom,omitempty"`
+}
+
+// SurchargeRule is the card surcharge a device discloses and adds
+type SurchargeRule struct {
+	Enabled bool    `json:"enabled"`
+	Percent float64 `json:"percent"`
+	// DebitExempt skips the surcharge on debit and prepaid cards, which
+	// card brand rules do not allow surcharging
+	DebitExempt bool   `json:"debit_exempt,omitempty"`
+	Disclosure  string `json:"disclosure,omitempty"`
+}
+
+// DeviceConfig is the configuration pushed to a device
+type DeviceConfig struct {
+	TipPrompt *TipPrompt     `json:"tip_prompt,omitempty"`
+	Surcharge *SurchargeRule `json:"surcharge,omitempty"`
+}
+
+// Mapping assigns a terminal to a merchant, register and tax jurisdiction
+type Mapping struct {
+	TerminalID      string       `json:"terminal_id"`
+	MerchantID      string       `json:"merchant_id"`
+	Register        string       `json:"register,omitempty"`
+	TaxJurisdiction string       `json:"tax_jurisdiction,omitempty"`
+	Config          DeviceConfig `json:"config"`
+	// Version increases whenever the mapping or its config changes. Devices
+	// report the version they last applied so stale ones can be updated.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate checks a mapping before it is stored
+func (m Mapping) Validate() error {
+	if m.TerminalID == "" || m.MerchantID == "" {
+		return errors.New("terminal_id and merchant_id are required")
+	}
+	if tip := m.Config.TipPrompt; tip != nil {
+		if len(tip.Percentages) > 4 {
+			return errors.New("tip_prompt allows at most 4 percentages")
+		}
+		for _, p := range tip.Percentages {
+			if p < 1 || p > 100 {
+				return fmt.Errorf("tip percentage %d must be between 1 and 100", p)
+			}
+		}
+	}
+	if s := m.Config.Surcharge; s != nil && s.Enabled {
+		if s.Percent <= 0 || s.Percent > MaxSurchargePercent {
+			return fmt.Errorf("surcharge percent must be above 0 and at most %g", MaxSurchargePercent)
+		}
+	}
+	return nil
+}
+
+// sameContent reports whether two mappings differ only in version and
+// update time
+func sameContent(a, b Mapping) bool {
+	a.Version, a.UpdatedAt = 0, time.Time{}
+	b.Version, b.UpdatedAt = 0, time.Time{}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// Store keeps terminal mappings
+type Store interface {
+	Get(ctx context.Context, terminalID string) (Mapping, error)
+	// List returns all mappings ordered by terminal ID
+	List(ctx context.Context) ([]Mapping, error)
+	// Put creates or replaces a mapping. The version is bumped only when
+	// something changed, so applying the same mapping twice is harmless.
+	Put(ctx context.Context, m Mapping) (Mapping, error)
+	Delete(ctx context.Context, terminalID string) error
+}
+
+// MemoryStore keeps mappings in process
+type MemoryStore struct {
+	mu       sync.RWMutex
+	mappings map[string]Mapping
+}
+
+// NewMemoryStore creates an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{mappings: make(map[string]Mapping)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, terminalID string) (Mapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.mappings[terminalID]
+	if !ok {
+		return Mapping{}, ErrNotFound
+	}
+	return m, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]Mapping, error) {
+	s.mu.RLock()
+	mappings := make([]Mapping, 0, len(s.mappings))
+	for _, m := range s.mappings {
+		mappings = append(mappings, m)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].TerminalID < mappings[j].TerminalID })
+	return mappings, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, m Mapping) (Mapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.mappings[m.TerminalID]
+	if exists && sameContent(current, m) {
+		return current, nil
+	}
+	m.Version = current.Version + 1
+	m.UpdatedAt = time.Now().UTC()
+	s.mappings[m.TerminalID] = m
+	return m, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, terminalID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.mappings[terminalID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.mappings, terminalID)
+	return nil
+}
+
+// DeviceSync is what a device receives on init: its assignment and, when
+// the version it reported is out of date, its configuration
+type DeviceSync struct {
+	MerchantID      string `json:"merchant_id"`
+	Register        string `json:"register,omitempty"`
+	TaxJurisdiction string `json:"tax_jurisdiction,omitempty"`
+	ConfigVersion   int    `json:"config_version"`
+	// ConfigChanged is set when the device's version differs from
+	// ConfigVersion; only then is Config included
+	ConfigChanged bool          `json:"config_changed"`
+	Config        *DeviceConfig `json:"config,omitempty"`
+}
+
+// Sync builds the init payload for a device that last applied
+// deviceVersion (zero if it has none)
+func Sync(m Mapping, deviceVersion int) *DeviceSync {
+	s := &DeviceSync{
+		MerchantID:      m.MerchantID,
+		Register:        m.Register,
+		TaxJurisdiction: m.TaxJurisdiction,
+		ConfigVersion:   m.Version,
+	}
+	if deviceVersion != m.Version {
+		config := m.Config
+		s.ConfigChanged = true
+		s.Config = &config
+	}
+	return s
+}
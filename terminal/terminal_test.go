@@ -0,0 +1,146 @@
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nmi-pay-int/db"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func laneOne() Mapping {
+	return Mapping{
+		TerminalID:      "TERM123",
+		MerchantID:      "m1",
+		Register:        "lane-1",
+		TaxJurisdiction: "US-TX-AUSTIN",
+		Config: DeviceConfig{
+			TipPrompt: &TipPrompt{Enabled: true, Percentages: []int{15, 18, 20}},
+		},
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	stored, err := store.Put(ctx, laneOne())
+	require.NoError(t, err)
+	assert.Equal(t, 1, stored.Version)
+	assert.False(t, stored.UpdatedAt.IsZero())
+
+	// Re-applying the same mapping keeps the version
+	again, err := store.Put(ctx, laneOne())
+	require.NoError(t, err)
+	assert.Equal(t, 1, again.Version)
+
+	changed := laneOne()
+	changed.Config.Surcharge = &SurchargeRule{Enabled: true, Percent: 3, DebitExempt: true}
+	stored, err = store.Put(ctx, changed)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stored.Version)
+
+	got, err := store.Get(ctx, "TERM123")
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Version)
+	assert.Equal(t, "lane-1", got.Register)
+	require.NotNil(t, got.Config.Surcharge)
+	assert.Equal(t, 3.0, got.Config.Surcharge.Percent)
+	assert.Equal(t, []int{15, 18, 20}, got.Config.TipPrompt.Percentages)
+
+	other := laneOne()
+	other.TerminalID = "TERM001"
+	_, err = store.Put(ctx, other)
+	require.NoError(t, err)
+	list, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "TERM001", list[0].TerminalID)
+
+	require.NoError(t, store.Delete(ctx, "TERM123"))
+	_, err = store.Get(ctx, "TERM123")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, store.Delete(ctx, "TERM123"), ErrNotFound)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestSQLStore(t *testing.T) {
+	database, err := db.Open(context.Background(), "sqlite::memory:")
+	require.NoError(t, err)
+	defer database.Close()
+
+	store, err := NewSQLStore(context.Background(), database)
+	require.NoError(t, err)
+	testStore(t, store)
+}
+
+func TestMappingValidate(t *testing.T) {
+	assert.NoError(t, laneOne().Validate())
+
+	missing := laneOne()
+	missing.MerchantID = ""
+	assert.EqualError(t, missing.Validate(), "terminal_id and merchant_id are required")
+
+	tips := laneOne()
+	tips.Config.TipPrompt.Percentages = []int{0}
+	assert.Error(t, tips.Validate())
+
+	surcharge := laneOne()
+	surcharge.Config.Surcharge = &SurchargeRule{Enabled: true, Percent: 4}
+	assert.Error(t, surcharge.Validate())
+}
+
+func TestSync(t *testing.T) {
+	m := laneOne()
+	m.Version = 3
+
+	stale := Sync(m, 2)
+	assert.True(t, stale.ConfigChanged)
+	require.NotNil(t, stale.Config)
+	assert.Equal(t, 3, stale.ConfigVersion)
+	assert.Equal(t, "m1", stale.MerchantID)
+
+	current := Sync(m, 3)
+	assert.False(t, current.ConfigChanged)
+	assert.Nil(t, current.Config)
+}
+
+func TestHandleConfig(t *testing.T) {
+	store := NewMemoryStore()
+	_, err := store.Put(context.Background(), laneOne())
+	require.NoError(t, err)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/terminal/config/{terminal_id}", HandleConfig(store))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terminal/config/TERM123", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+	var sync DeviceSync
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sync))
+	assert.True(t, sync.ConfigChanged)
+	assert.True(t, sync.Config.TipPrompt.Enabled)
+
+	req := httptest.NewRequest(http.MethodGet, "/terminal/config/TERM123", nil)
+	req.Header.Set("If-None-Match", `"1"`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terminal/config/TERM123?config_version=1", nil))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terminal/config/UNKNOWN", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -2,9 +2,11 @@ package tests
 
 import (
 	"context"
+	"os"
 	"testing"
 
 	"nmi-pay-int/api"
+	"nmi-pay-int/config"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,19 +17,32 @@ func TestPaymentIntegration(t *testing.T) {
 		t.Skip("Skipping integration tests")
 	}
 
+	apiKey := os.Getenv("NMI_API_KEY")
+	if apiKey == "" {
+		t.Skip("Skipping integration tests: NMI_API_KEY not set")
+	}
+
+	// Default to the sandbox so integration runs never hit production
+	apiURL := os.Getenv("API_URL")
+	if apiURL == "" {
+		apiURL = "https://secure.networkmerchants.com/api/transact.php"
+	}
+	client := api.NewClient(&config.Config{APIBaseURL: apiURL})
+
 	ctx := context.Background()
 
 	// Test Sale Transaction
 	t.Run("Process Sale", func(t *testing.T) {
 		req := api.PaymentRequest{
+			APIKey:     apiKey,
 			Amount:     "10.99",
 			CreditCard: "4111111111111111",
-			ExpDate:    "1225",
+			ExpDate:    "1230",
 			CVV:        "123",
 			Type:       "sale",
 		}
 
-		resp, err := api.ProcessPayment(ctx, req)
+		resp, err := client.ProcessPayment(ctx, req)
 		assert.NoError(t, err)
 		assert.NotNil(t, resp)
 		assert.Equal(t, "1", resp.Response)
@@ -37,12 +52,13 @@ func TestPaymentIntegration(t *testing.T) {
 	// Test Tokenization
 	t.Run("Process Tokenization", func(t *testing.T) {
 		req := api.PaymentRequest{
+			APIKey:     apiKey,
 			CreditCard: "4111111111111111",
-			ExpDate:    "1225",
+			ExpDate:    "1230",
 			CVV:        "123",
 		}
 
-		resp, err := api.ProcessTokenization(ctx, req)
+		resp, err := client.ProcessTokenization(ctx, req)
 		assert.NoError(t, err)
 		assert.NotNil(t, resp)
 		assert.True(t, resp.Success)
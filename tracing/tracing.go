@@ -0,0 +1,78 @@
+// Package tracing exports OpenTelemetry spans for HTTP requests and the
+// NMI calls made while serving them, so a slow payment can be followed from
+// the caller's trace into the gateway.
+package tracing
+
+import (
+	"context"
+
+	"nmi-pay-int/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is reported on spans unless OTEL_SERVICE_NAME overrides it
+const ServiceName = "nmi-payment"
+
+// instrumentationName names the tracer spans are created with
+const instrumentationName = "nmi-pay-int"
+
+// Setup installs the W3C trace context propagator and, when an OTLP
+// endpoint is configured, a tracer provider exporting to it. The returned
+// function flushes and stops the exporter. Without an endpoint spans are not
+// recorded, but incoming trace IDs still reach the logs.
+func Setup(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	if cfg.TracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The exporter reads its endpoint, headers, timeout and compression from
+	// the standard OTEL_EXPORTER_OTLP_* variables
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the above
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sampling follows OTEL_TRACES_SAMPLER; by default a sampled caller's
+	// requests are always traced
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer the service's spans are created with
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// End marks span failed when err is set, then ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
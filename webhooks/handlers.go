@@ -0,0 +1,146 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"nmi-pay-int/api"
+	"nmi-pay-int/config"
+	"nmi-pay-int/logctx"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// EndpointRequest registers or updates an endpoint. On update, omitted fields
+// keep their current values.
+type EndpointRequest struct {
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// The handlers manage the endpoints of the merchant the request resolved to;
+// other merchants' endpoints and dead letters are not found.
+
+// HandleCreate registers an endpoint and returns its signing secret
+func HandleCreate(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req EndpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload: url is required")
+			return
+		}
+
+		endpoint, err := m.Register(merchantID(r.Context()), *req.URL, req.Events)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		logctx.From(r.Context()).WithFields(logrus.Fields{
+			"webhook_id": endpoint.ID,
+			"url":        endpoint.URL,
+		}).Info("Webhook endpoint registered")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(endpoint)
+	}
+}
+
+// HandleList returns the merchant's registered endpoints
+func HandleList(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.List(merchantID(r.Context())))
+	}
+}
+
+// HandleGet returns one endpoint
+func HandleGet(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpoint, err := m.Get(merchantID(r.Context()), mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(endpoint)
+	}
+}
+
+// HandleUpdate changes an endpoint's URL, events or active flag
+func HandleUpdate(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req EndpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.WriteErrorCode(w, r, api.ErrInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		endpoint, err := m.Update(merchantID(r.Context()), mux.Vars(r)["id"], req.URL, req.Events, req.Active)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(endpoint)
+	}
+}
+
+// HandleDelete removes an endpoint
+func HandleDelete(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := m.Delete(merchantID(r.Context()), id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		logctx.From(r.Context()).WithField("webhook_id", id).Info("Webhook endpoint deleted")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleDeadLetters lists deliveries that exhausted their retries
+func HandleDeadLetters(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.DeadLetters(merchantID(r.Context())))
+	}
+}
+
+// HandleRedeliver retries a dead-lettered delivery
+func HandleRedeliver(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Redeliver(merchantID(r.Context()), mux.Vars(r)["id"]); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// merchantID returns the merchant the request resolved to
+func merchantID(ctx context.Context) string {
+	if merchant, ok := api.MerchantFromContext(ctx); ok {
+		return merchant.ID
+	}
+	return config.DefaultMerchantID
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := api.ErrInvalidRequest
+	switch {
+	case errors.Is(err, ErrEndpointNotFound), errors.Is(err, ErrDeadLetterNotFound):
+		code = api.ErrNotFound
+	case errors.Is(err, ErrClosed):
+		code = api.ErrInternal
+	}
+	api.WriteErrorCode(w, r, code, err.Error())
+}
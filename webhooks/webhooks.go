@@ -0,0 +1,614 @@
+// Package webhooks notifies merchant systems when payments and subscriptions
+// change, with HMAC-signed POSTs that are retried with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"nmi-pay-int/eventlog"
+	"nmi-pay-int/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Event types
+const (
+	EventPaymentSale          = "payment.sale"
+	EventPaymentRefund        = "payment.refund"
+	EventPaymentVoid          = "payment.void"
+	EventSubscriptionCreated  = "subscription.created"
+	EventSubscriptionUpdated  = "subscription.updated"
+	EventSubscriptionCanceled = "subscription.canceled"
+	EventBatchClosed          = "batch.closed"
+	EventChargebackCreated    = "chargeback.created"
+	// EventTerminalPaymentCompleted carries a terminal payment session
+	// that has finished: approved, declined, cancelled or failed
+	EventTerminalPaymentCompleted = "terminal_payment.completed"
+)
+
+// EventTypes lists every event an endpoint can subscribe to
+var EventTypes = []string{
+	EventPaymentSale,
+	EventPaymentRefund,
+	EventPaymentVoid,
+	EventSubscriptionCreated,
+	EventSubscriptionUpdated,
+	EventSubscriptionCanceled,
+	EventBatchClosed,
+	EventChargebackCreated,
+	EventTerminalPaymentCompleted,
+}
+
+// Registration errors
+var (
+	ErrEndpointNotFound   = errors.New("webhook endpoint not found")
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrClosed             = errors.New("webhook deliveries have stopped")
+	ErrInvalidURL         = errors.New("webhook url must be an absolute https URL")
+	ErrUnknownEvent       = errors.New("unknown event type")
+	// ErrBlockedAddress fails a delivery whose host resolves to a private,
+	// loopback or link-local address
+	ErrBlockedAddress = errors.New("webhook host is not a public address")
+)
+
+// deliveryTimeout bounds a single delivery attempt
+const deliveryTimeout = 10 * time.Second
+
+// recordTimeout bounds appending a published event to the event log
+const recordTimeout = 2 * time.Second
+
+// Endpoint is a registered merchant callback URL. It receives the events of
+// the merchant that registered it; an empty Events list subscribes to every
+// event type.
+type Endpoint struct {
+	ID         string    `json:"id"`
+	MerchantID string    `json:"merchant_id"`
+	URL        string    `json:"url"`
+	Events     []string  `json:"events,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (e Endpoint) subscribed(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the JSON body POSTed to endpoints
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	MerchantID string      `json:"merchant_id"`
+	CreatedAt  time.Time   `json:"created_at"`
+	Data       interface{} `json:"data"`
+}
+
+// DeadLetter records a delivery that exhausted its retries
+type DeadLetter struct {
+	ID         string    `json:"id"`
+	EndpointID string    `json:"endpoint_id"`
+	URL        string    `json:"url"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	LastStatus int       `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// RetryPolicy controls redelivery after a failed attempt. The wait doubles
+// after each failure, up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy gives a receiver roughly five minutes to recover
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    6,
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     2 * time.Minute,
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// Manager keeps webhook registrations and delivers events to them
+type Manager struct {
+	retry      RetryPolicy
+	httpClient *http.Client
+
+	mu          sync.RWMutex
+	endpoints   map[string]Endpoint
+	deadLetters map[string]DeadLetter
+
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	// log, when set, records every published event for replay
+	log eventlog.Log
+	// observers are called with every published event
+	observers []func(Event)
+}
+
+// NewManager creates a manager using the given retry policy
+func NewManager(retry RetryPolicy) *Manager {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	return &Manager{
+		retry:       retry,
+		httpClient:  newDeliveryClient(),
+		endpoints:   make(map[string]Endpoint),
+		deadLetters: make(map[string]DeadLetter),
+		done:        make(chan struct{}),
+	}
+}
+
+// Register adds an endpoint for a merchant and returns it with its signing
+// secret. The secret is not returned again.
+func (m *Manager) Register(merchantID, rawURL string, events []string) (Endpoint, error) {
+	if err := validateEndpoint(rawURL, events); err != nil {
+		return Endpoint{}, err
+	}
+
+	endpoint := Endpoint{
+		ID:         "wh_" + randomHex(12),
+		MerchantID: merchantID,
+		URL:        rawURL,
+		Events:     events,
+		Secret:     "whsec_" + randomHex(24),
+		Active:     true,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	m.mu.Lock()
+	m.endpoints[endpoint.ID] = endpoint
+	m.mu.Unlock()
+
+	return endpoint, nil
+}
+
+// Update changes a merchant's endpoint's URL, event subscriptions or active
+// flag. Nil fields are left unchanged.
+func (m *Manager) Update(merchantID, id string, rawURL *string, events []string, active *bool) (Endpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	endpoint, ok := m.endpoints[id]
+	if !ok || endpoint.MerchantID != merchantID {
+		return Endpoint{}, ErrEndpointNotFound
+	}
+
+	if rawURL != nil {
+		endpoint.URL = *rawURL
+	}
+	if events != nil {
+		endpoint.Events = events
+	}
+	if active != nil {
+		endpoint.Active = *active
+	}
+	if err := validateEndpoint(endpoint.URL, endpoint.Events); err != nil {
+		return Endpoint{}, err
+	}
+
+	m.endpoints[id] = endpoint
+	return redacted(endpoint), nil
+}
+
+// Delete removes a merchant's endpoint. Deliveries already waiting to retry
+// are dropped.
+func (m *Manager) Delete(merchantID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if endpoint, ok := m.endpoints[id]; !ok || endpoint.MerchantID != merchantID {
+		return ErrEndpointNotFound
+	}
+	delete(m.endpoints, id)
+	return nil
+}
+
+// Get returns a merchant's endpoint without its secret. Endpoints of other
+// merchants are not found.
+func (m *Manager) Get(merchantID, id string) (Endpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	endpoint, ok := m.endpoints[id]
+	if !ok || endpoint.MerchantID != merchantID {
+		return Endpoint{}, ErrEndpointNotFound
+	}
+	return redacted(endpoint), nil
+}
+
+// List returns a merchant's endpoints, oldest first, without their secrets
+func (m *Manager) List(merchantID string) []Endpoint {
+	m.mu.RLock()
+	endpoints := make([]Endpoint, 0, len(m.endpoints))
+	for _, endpoint := range m.endpoints {
+		if endpoint.MerchantID == merchantID {
+			endpoints = append(endpoints, redacted(endpoint))
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+	})
+	return endpoints
+}
+
+// DeadLetters returns a merchant's deliveries that exhausted their retries,
+// newest first
+func (m *Manager) DeadLetters(merchantID string) []DeadLetter {
+	m.mu.RLock()
+	letters := make([]DeadLetter, 0, len(m.deadLetters))
+	for _, letter := range m.deadLetters {
+		if letter.Event.MerchantID == merchantID {
+			letters = append(letters, letter)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.After(letters[j].FailedAt)
+	})
+	return letters
+}
+
+// Redeliver retries a merchant's dead-lettered event against its endpoint
+// with a fresh set of attempts. The dead letter is removed; it comes back if
+// they fail too.
+func (m *Manager) Redeliver(merchantID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	letter, ok := m.deadLetters[id]
+	if !ok || letter.Event.MerchantID != merchantID {
+		return ErrDeadLetterNotFound
+	}
+	endpoint, ok := m.endpoints[letter.EndpointID]
+	if !ok {
+		return ErrEndpointNotFound
+	}
+	if m.closed() {
+		return ErrClosed
+	}
+	delete(m.deadLetters, id)
+
+	m.wg.Add(1)
+	go m.deliver(endpoint, letter.Event)
+	return nil
+}
+
+// SetHTTPClient replaces the client deliveries are posted with, and with it
+// the refusal to connect to private addresses. Tests use it to deliver to a
+// receiver on localhost.
+func (m *Manager) SetHTTPClient(client *http.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.httpClient = client
+}
+
+// RecordTo appends every event published from now on to log, whether or not
+// any endpoint is subscribed to it
+func (m *Manager) RecordTo(log eventlog.Log) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.log = log
+}
+
+// Observe calls fn with every event published from now on, before it is
+// delivered. fn runs on the publishing goroutine and should be quick.
+func (m *Manager) Observe(fn func(Event)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+// Publish records a merchant's event in the event log, if one is set, and
+// sends it to each of the merchant's active endpoints subscribed to its
+// type. Delivery happens in the background and never blocks the caller;
+// after Close, events are recorded but no longer delivered.
+func (m *Manager) Publish(merchantID, eventType string, data interface{}) {
+	event := Event{
+		ID:         "evt_" + randomHex(12),
+		Type:       eventType,
+		MerchantID: merchantID,
+		CreatedAt:  time.Now().UTC(),
+		Data:       data,
+	}
+	m.record(event)
+
+	// Observers run without the lock, so one that calls back into the
+	// manager cannot deadlock it
+	m.mu.RLock()
+	observers := make([]func(Event), len(m.observers))
+	copy(observers, m.observers)
+	m.mu.RUnlock()
+	for _, observe := range observers {
+		observe(event)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed() {
+		return
+	}
+	for _, endpoint := range m.endpoints {
+		if endpoint.MerchantID == merchantID && endpoint.Active && endpoint.subscribed(eventType) {
+			m.wg.Add(1)
+			go m.deliver(endpoint, event)
+		}
+	}
+}
+
+// Close stops scheduling retries and waits for in-flight attempts to finish
+// or ctx to end
+func (m *Manager) Close(ctx context.Context) error {
+	// Closing under the lock orders it with the wg.Add calls in Publish
+	// and Redeliver, which check done while holding it
+	m.mu.Lock()
+	close(m.done)
+	m.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closed reports whether Close has been called. Callers hold m.mu.
+func (m *Manager) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// record appends the event to the event log. A log failure is reported but
+// does not stop delivery, since the payment has already happened.
+func (m *Manager) record(event Event) {
+	m.mu.RLock()
+	log := m.log
+	m.mu.RUnlock()
+	if log == nil {
+		return
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+		defer cancel()
+		_, err = log.Append(ctx, eventlog.Event{
+			ID:         event.ID,
+			Type:       event.Type,
+			MerchantID: event.MerchantID,
+			CreatedAt:  event.CreatedAt,
+			Data:       data,
+		})
+	}
+	if err != nil {
+		metrics.LogError(context.Background(), fmt.Errorf("failed to record event %s (%s) in the event log: %v", event.ID, event.Type, err))
+	}
+}
+
+func (m *Manager) deliver(endpoint Endpoint, event Event) {
+	defer m.wg.Done()
+
+	log := metrics.GetLogger().WithFields(logrus.Fields{
+		"webhook_id": endpoint.ID,
+		"event_id":   event.ID,
+		"event_type": event.Type,
+	})
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode webhook event")
+		return
+	}
+
+	var status int
+	attempt := 0
+retry:
+	for {
+		attempt++
+		status, err = m.post(endpoint, body)
+		if err == nil {
+			metrics.RecordWebhookDelivery(event.Type, "delivered")
+			log.WithField("attempt", attempt).Debug("Webhook delivered")
+			return
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warn("Webhook delivery failed")
+		if attempt >= m.retry.MaxAttempts {
+			break
+		}
+		metrics.RecordWebhookDelivery(event.Type, "retry")
+
+		select {
+		case <-time.After(m.retry.backoff(attempt)):
+		case <-m.done:
+			break retry
+		}
+
+		// Stop quietly if the endpoint was deleted while we waited
+		m.mu.RLock()
+		current, ok := m.endpoints[endpoint.ID]
+		m.mu.RUnlock()
+		if !ok {
+			return
+		}
+		endpoint = current
+	}
+
+	m.deadLetter(endpoint, event, attempt, status, err)
+}
+
+func (m *Manager) deadLetter(endpoint Endpoint, event Event, attempts, status int, err error) {
+	letter := DeadLetter{
+		ID:         "dl_" + randomHex(12),
+		EndpointID: endpoint.ID,
+		URL:        endpoint.URL,
+		Event:      event,
+		Attempts:   attempts,
+		LastStatus: status,
+		LastError:  err.Error(),
+		FailedAt:   time.Now().UTC(),
+	}
+
+	m.mu.Lock()
+	m.deadLetters[letter.ID] = letter
+	m.mu.Unlock()
+
+	metrics.RecordWebhookDelivery(event.Type, "dead_letter")
+	metrics.GetLogger().WithFields(logrus.Fields{
+		"webhook_id":     endpoint.ID,
+		"event_id":       event.ID,
+		"dead_letter_id": letter.ID,
+		"attempts":       attempts,
+	}).Error("Webhook delivery moved to dead letters")
+}
+
+// post makes one delivery attempt. Any 2xx response counts as delivered.
+func (m *Manager) post(endpoint Endpoint, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, SignatureHeaderValue(endpoint.Secret, time.Now(), body))
+
+	m.mu.RLock()
+	client := m.httpClient
+	m.mu.RUnlock()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// newDeliveryClient returns the client deliveries are posted with. It does
+// not follow redirects, and it refuses to connect to private, loopback and
+// link-local addresses, such as the cloud metadata service at
+// 169.254.169.254, so a registered URL cannot reach inside our network. The
+// check runs on the address being dialed, after DNS resolution, so a public
+// name pointing inside is refused too.
+func newDeliveryClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: deliveryTimeout,
+		Control: checkDialAddress,
+	}
+	return &http.Client{
+		Timeout: deliveryTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: deliveryTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkDialAddress is a net.Dialer Control func rejecting addresses that are
+// not publicly routable
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+func validateEndpoint(rawURL string, events []string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return ErrInvalidURL
+	}
+
+	for _, event := range events {
+		known := false
+		for _, t := range EventTypes {
+			if event == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: %s", ErrUnknownEvent, event)
+		}
+	}
+	return nil
+}
+
+func redacted(endpoint Endpoint) Endpoint {
+	endpoint.Secret = ""
+	return endpoint
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
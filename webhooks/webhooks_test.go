@@ -0,0 +1,179 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nmi-pay-int/eventlog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliverySignedAndFiltered(t *testing.T) {
+	received := make(chan Event, 4)
+	var secret string
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, Verify(secret, r.Header.Get(SignatureHeader), body, time.Minute))
+
+		var event Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		received <- event
+	}))
+	defer receiver.Close()
+
+	m := NewManager(DefaultRetryPolicy)
+	m.SetHTTPClient(receiver.Client())
+	endpoint, err := m.Register("m1", receiver.URL, []string{EventPaymentRefund})
+	require.NoError(t, err)
+	secret = endpoint.Secret
+	assert.NotEmpty(t, secret)
+
+	m.Publish("m1", EventPaymentSale, map[string]string{"transaction_id": "1"})
+	m.Publish("m1", EventPaymentRefund, map[string]string{"transaction_id": "2"})
+	// Another merchant's refund is not delivered here
+	m.Publish("m2", EventPaymentRefund, map[string]string{"transaction_id": "3"})
+	require.NoError(t, m.Close(context.Background()))
+
+	require.Len(t, received, 1)
+	event := <-received
+	assert.Equal(t, EventPaymentRefund, event.Type)
+	assert.Equal(t, "m1", event.MerchantID)
+	assert.Equal(t, "2", event.Data.(map[string]interface{})["transaction_id"])
+}
+
+func TestFailedDeliveryRetriesThenDeadLetters(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	m := NewManager(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	m.SetHTTPClient(receiver.Client())
+	endpoint, err := m.Register("m1", receiver.URL, nil)
+	require.NoError(t, err)
+
+	m.Publish("m1", EventPaymentVoid, nil)
+	require.Eventually(t, func() bool { return len(m.DeadLetters("m1")) == 1 }, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.Empty(t, m.DeadLetters("m2"))
+	assert.ErrorIs(t, m.Redeliver("m2", m.DeadLetters("m1")[0].ID), ErrDeadLetterNotFound)
+	letters := m.DeadLetters("m1")
+	require.Len(t, letters, 1)
+	assert.Equal(t, endpoint.ID, letters[0].EndpointID)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, letters[0].LastStatus)
+	assert.Equal(t, EventPaymentVoid, letters[0].Event.Type)
+}
+
+func TestRegisterValidation(t *testing.T) {
+	m := NewManager(DefaultRetryPolicy)
+
+	_, err := m.Register("m1", "not a url", nil)
+	assert.ErrorIs(t, err, ErrInvalidURL)
+
+	_, err = m.Register("m1", "http://example.com/hook", nil)
+	assert.ErrorIs(t, err, ErrInvalidURL, "deliveries must use https")
+
+	_, err = m.Register("m1", "https://example.com/hook", []string{"payment.unknown"})
+	assert.ErrorIs(t, err, ErrUnknownEvent)
+
+	endpoint, err := m.Register("m1", "https://example.com/hook", nil)
+	require.NoError(t, err)
+
+	stored, err := m.Get("m1", endpoint.ID)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Secret, "secret is only returned on registration")
+	assert.Equal(t, "m1", stored.MerchantID)
+}
+
+func TestEndpointsBelongToTheirMerchant(t *testing.T) {
+	m := NewManager(DefaultRetryPolicy)
+	endpoint, err := m.Register("m1", "https://example.com/hook", nil)
+	require.NoError(t, err)
+
+	_, err = m.Get("m2", endpoint.ID)
+	assert.ErrorIs(t, err, ErrEndpointNotFound)
+	active := false
+	_, err = m.Update("m2", endpoint.ID, nil, nil, &active)
+	assert.ErrorIs(t, err, ErrEndpointNotFound)
+	assert.ErrorIs(t, m.Delete("m2", endpoint.ID), ErrEndpointNotFound)
+	assert.Empty(t, m.List("m2"))
+
+	require.Len(t, m.List("m1"), 1)
+	assert.True(t, m.List("m1")[0].Active)
+	assert.NoError(t, m.Delete("m1", endpoint.ID))
+}
+
+func TestDeliveryRefusesInternalAddresses(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.10", "169.254.169.254", "[::1]", "[fe80::1]"} {
+		t.Run(host, func(t *testing.T) {
+			m := NewManager(RetryPolicy{MaxAttempts: 1})
+			_, err := m.Register("m1", "https://"+host+"/hook", nil)
+			require.NoError(t, err)
+
+			m.Publish("m1", EventPaymentSale, nil)
+			require.NoError(t, m.Close(context.Background()))
+
+			letters := m.DeadLetters("m1")
+			require.Len(t, letters, 1)
+			assert.Contains(t, letters[0].LastError, ErrBlockedAddress.Error())
+		})
+	}
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer receiver.Close()
+
+	m := NewManager(DefaultRetryPolicy)
+	m.SetHTTPClient(receiver.Client())
+	_, err := m.Register("m1", receiver.URL, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Close(context.Background()))
+
+	m.Publish("m1", EventPaymentSale, nil)
+	assert.Zero(t, atomic.LoadInt32(&attempts))
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	header := SignatureHeaderValue("whsec_test", time.Now(), body)
+
+	assert.NoError(t, Verify("whsec_test", header, body, time.Minute))
+	assert.ErrorIs(t, Verify("whsec_other", header, body, time.Minute), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("whsec_test", header, []byte(`{"id":"evt_2"}`), time.Minute), ErrInvalidSignature)
+
+	stale := SignatureHeaderValue("whsec_test", time.Now().Add(-time.Hour), body)
+	assert.ErrorIs(t, Verify("whsec_test", stale, body, 5*time.Minute), ErrInvalidSignature)
+}
+
+func TestPublishRecordsEventLog(t *testing.T) {
+	log := eventlog.NewMemoryLog(0)
+	m := NewManager(DefaultRetryPolicy)
+	m.RecordTo(log)
+
+	m.Publish("m1", EventPaymentSale, map[string]string{"transaction_id": "123"})
+	m.Publish("m2", EventSubscriptionCanceled, map[string]string{"subscription_id": "456"})
+
+	events, err := log.Read(context.Background(), 1, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, EventPaymentSale, events[0].Type)
+	assert.JSONEq(t, `{"transaction_id":"123"}`, string(events[0].Data))
+	assert.Equal(t, int64(2), events[1].Seq)
+	assert.Equal(t, EventSubscriptionCanceled, events[1].Type)
+}